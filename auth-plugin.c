@@ -14,6 +14,111 @@
 # define mosquitto_auth_opt mosquitto_opt
 #endif
 
+// The certificate subject and the certificate itself need openssl, so they're only read when building with -DGO_AUTH_CERT_SUBJECT and linking -lcrypto.
+#ifdef GO_AUTH_CERT_SUBJECT
+# include <openssl/x509.h>
+#endif
+
+// The client's socket isn't given by the plugin api, so it's only read when building with -DGO_AUTH_CLIENT_SOCKET against the broker's own sources,
+// with the same WITH_* flags it was built with, so the client struct is laid out as the broker's.
+#if defined(GO_AUTH_CLIENT_SOCKET) && MOSQ_AUTH_PLUGIN_VERSION >= 3
+# include <mosquitto_internal.h>
+#endif
+
+// Results of checks returned by Go, as defined in go-auth.go.
+#define GO_AUTH_GRANTED 0
+#define GO_AUTH_DENIED 1
+#define GO_AUTH_DEFERRED 2
+#define GO_AUTH_ERROR 3
+
+/*
+  Map the result of a check to mosquitto's return codes, with denied being the one for denials of the check's kind.
+  Deferring is only understood from plugin version 4 on, so with older versions deferred checks are denied.
+*/
+static int check_return_code(GoInt result, int denied) {
+  switch (result) {
+    case GO_AUTH_GRANTED:
+      return MOSQ_ERR_SUCCESS;
+    case GO_AUTH_DEFERRED:
+      #if MOSQ_AUTH_PLUGIN_VERSION >= 4
+        return MOSQ_ERR_PLUGIN_DEFER;
+      #else
+        return denied;
+      #endif
+    case GO_AUTH_ERROR:
+      return MOSQ_ERR_UNKNOWN;
+  }
+  return denied;
+}
+
+struct client_metadata {
+  const char* address;
+  char cert_subject[256];
+  unsigned char* cert;
+  int cert_len;
+  GoInt clean_session;
+  GoInt protocol_version;
+  GoInt socket;
+};
+
+/*
+  Get what mosquitto tells about the client besides its id and username, which older plugin versions don't.
+  Unknown values are left empty, with clean_session and socket at -1 and protocol_version at 0.
+  The DER encoded certificate, if any, must be released with free_client_metadata.
+*/
+static void get_client_metadata(const struct mosquitto *client, struct client_metadata *metadata) {
+  metadata->address = "";
+  metadata->cert_subject[0] = '\0';
+  metadata->cert = NULL;
+  metadata->cert_len = 0;
+  metadata->clean_session = -1;
+  metadata->protocol_version = 0;
+  metadata->socket = -1;
+
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    if (client == NULL) {
+      return;
+    }
+
+    const char* address = mosquitto_client_address(client);
+    if (address != NULL) {
+      metadata->address = address;
+    }
+    metadata->clean_session = mosquitto_client_clean_session(client) ? 1 : 0;
+
+    // The protocol version is only given by mosquitto 2.0 and later.
+    #if LIBMOSQUITTO_MAJOR >= 2
+      metadata->protocol_version = mosquitto_client_protocol_version(client);
+    #endif
+
+    #ifdef GO_AUTH_CLIENT_SOCKET
+      if (client->sock != INVALID_SOCKET) {
+        metadata->socket = client->sock;
+      }
+    #endif
+
+    #ifdef GO_AUTH_CERT_SUBJECT
+      X509* cert = mosquitto_client_certificate(client);
+      if (cert != NULL) {
+        X509_NAME_oneline(X509_get_subject_name(cert), metadata->cert_subject, sizeof(metadata->cert_subject));
+        int len = i2d_X509(cert, &metadata->cert);
+        if (len > 0) {
+          metadata->cert_len = len;
+        }
+        X509_free(cert);
+      }
+    #endif
+  #endif
+}
+
+static void free_client_metadata(struct client_metadata *metadata) {
+  #ifdef GO_AUTH_CERT_SUBJECT
+    OPENSSL_free(metadata->cert);
+  #endif
+  metadata->cert = NULL;
+  metadata->cert_len = 0;
+}
+
 int mosquitto_auth_plugin_version(void) {
   return MOSQ_AUTH_PLUGIN_VERSION;
 }
@@ -73,11 +178,32 @@ int mosquitto_auth_unpwd_check(void *userdata, const char *username, const char
   GoString go_username = {username, strlen(username)};
   GoString go_password = {password, strlen(password)};
 
-  if(AuthUnpwdCheck(go_username, go_password)){
-    return MOSQ_ERR_SUCCESS;
+  // The clientid is not available for older plugin versions.
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    const char* clientid = mosquitto_client_id(client);
+  #else
+    const char* clientid = NULL;
+  #endif
+  if (clientid == NULL) {
+    clientid = "";
   }
+  GoString go_clientid = {clientid, strlen(clientid)};
+
+  struct client_metadata metadata;
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    get_client_metadata(client, &metadata);
+  #else
+    get_client_metadata(NULL, &metadata);
+  #endif
+  GoString go_address = {metadata.address, strlen(metadata.address)};
+  GoString go_cert_subject = {metadata.cert_subject, strlen(metadata.cert_subject)};
+
+  GoString go_cert = {(const char*)metadata.cert, metadata.cert_len};
 
-  return MOSQ_ERR_AUTH;
+  GoInt ret = AuthUnpwdCheck(go_username, go_password, go_clientid, go_address, go_cert_subject, go_cert, metadata.clean_session, metadata.protocol_version, metadata.socket);
+  free_client_metadata(&metadata);
+
+  return check_return_code(ret, MOSQ_ERR_AUTH);
 }
 
 #if MOSQ_AUTH_PLUGIN_VERSION >= 4
@@ -104,11 +230,28 @@ int mosquitto_auth_acl_check(void *userdata, const char *clientid, const char *u
   GoString go_topic = {topic, strlen(topic)};
   GoInt32 go_access = access;
 
-  if(AuthAclCheck(go_clientid, go_username, go_topic, go_access)){
-    return MOSQ_ERR_SUCCESS;
-  }
+  // The client's address and metadata are not available for older plugin versions.
+  struct client_metadata metadata;
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    get_client_metadata(client, &metadata);
+  #else
+    get_client_metadata(NULL, &metadata);
+  #endif
+  GoString go_address = {metadata.address, strlen(metadata.address)};
+  GoString go_cert_subject = {metadata.cert_subject, strlen(metadata.cert_subject)};
+
+  // Whether a publish is retained is not known for older plugin versions.
+  GoInt retain = 0;
+  #if MOSQ_AUTH_PLUGIN_VERSION >= 3
+    retain = msg->retain;
+  #endif
+
+  GoString go_cert = {(const char*)metadata.cert, metadata.cert_len};
+
+  GoInt ret = AuthAclCheck(go_clientid, go_username, go_topic, go_access, retain, go_address, go_cert_subject, go_cert, metadata.clean_session, metadata.protocol_version, metadata.socket);
+  free_client_metadata(&metadata);
 
-  return MOSQ_ERR_ACL_DENIED;
+  return check_return_code(ret, MOSQ_ERR_ACL_DENIED);
 }
 
 #if MOSQ_AUTH_PLUGIN_VERSION >= 4
@@ -119,5 +262,34 @@ int mosquitto_auth_psk_key_get(void *userdata, const struct mosquitto *client, c
 int mosquitto_auth_psk_key_get(void *userdata, const char *hint, const char *identity, char *key, int max_key_len)
 #endif
 {
-  return MOSQ_ERR_AUTH;
+  if (identity == NULL || key == NULL || max_key_len <= 0) {
+    printf("error: received null identity or key buffer for psk key get\n");
+    fflush(stdout);
+    return MOSQ_ERR_AUTH;
+  }
+
+  if (hint == NULL) {
+    hint = "";
+  }
+
+  GoString go_hint = {hint, strlen(hint)};
+  GoString go_identity = {identity, strlen(identity)};
+
+  // The key is allocated by Go with malloc, so it must be freed here.
+  char* psk_key = AuthPskKeyGet(go_hint, go_identity);
+  if (psk_key == NULL) {
+    return MOSQ_ERR_AUTH;
+  }
+
+  if (strlen(psk_key) >= (size_t)max_key_len) {
+    printf("error: psk key for identity %s exceeds max key length\n", identity);
+    fflush(stdout);
+    free(psk_key);
+    return MOSQ_ERR_AUTH;
+  }
+
+  strncpy(key, psk_key, max_key_len);
+  free(psk_key);
+
+  return MOSQ_ERR_SUCCESS;
 }
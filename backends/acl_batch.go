@@ -0,0 +1,28 @@
+package backends
+
+//AclQuery is a topic and access level checked within a batch.
+type AclQuery struct {
+	Topic string `json:"topic"`
+	Acc   int32  `json:"acc"`
+}
+
+//AclBatch is the request body of a batched acl check: a client and the topics it's checked for.
+type AclBatch struct {
+	Username string     `json:"username"`
+	Clientid string     `json:"clientid"`
+	Checks   []AclQuery `json:"checks"`
+}
+
+//AclBatchResponse is the response to a batched acl check, with whether each check was granted in the order they were given.
+type AclBatchResponse struct {
+	Results []bool `json:"results"`
+}
+
+//AclBatcher is implemented by backends that may check several acls of a client in a single call, saving round trips when many are checked at once.
+type AclBatcher interface {
+	//BatchesAcls tells if the backend is set to check acls in batches.
+	BatchesAcls() bool
+	//CheckAclBatch checks the queries for username and clientid, returning whether each one was granted in the same order.
+	//Superusers aren't checked, so queries are granted by acls only.
+	CheckAclBatch(username, clientid string, queries []AclQuery) ([]bool, error)
+}
@@ -0,0 +1,275 @@
+// +build !nobolt
+
+package backends
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//boltUsersBucket holds users by username, each one a json encoded SnapshotUser.
+var boltUsersBucket = []byte("users")
+
+//Bolt keeps users, their superuser status and acls in an embedded bolt db file, so no external store is needed and they survive restarts.
+//Users are managed through the admin api or imported from another backend, since the file is locked while the plugin runs.
+type Bolt struct {
+	DB       *bolt.DB
+	Path     string
+	ReadOnly bool
+	errs     *checkErrors
+}
+
+func init() {
+	register("bolt", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewBolt(authOpts, logLevel)
+	})
+}
+
+func NewBolt(authOpts map[string]string, logLevel log.Level) (Bolt, error) {
+
+	log.SetLevel(logLevel)
+
+	var b = Bolt{}
+
+	if path, ok := authOpts["bolt_path"]; ok {
+		b.Path = path
+	} else {
+		return b, errors.New("Bolt backend error: missing options bolt_path.\n")
+	}
+
+	//Wait a while for the file lock, which another process may hold.
+	timeout := time.Second
+	if boltTimeout, ok := authOpts["bolt_timeout"]; ok {
+		d, err := time.ParseDuration(strings.Replace(boltTimeout, " ", "", -1))
+		if err != nil || d <= 0 {
+			return b, errors.Errorf("Bolt backend error: couldn't parse bolt_timeout %s.\n", boltTimeout)
+		}
+		timeout = d
+	}
+
+	//In read only mode the file must already exist, and nothing is ever written to it.
+	b.ReadOnly = authOpts["read_only"] == "true"
+
+	db, err := bolt.Open(b.Path, 0600, &bolt.Options{Timeout: timeout, ReadOnly: b.ReadOnly})
+	if err != nil {
+		return b, errors.Errorf("Bolt backend error: couldn't open %s: %s\n", b.Path, err)
+	}
+	b.DB = db
+
+	if !b.ReadOnly {
+		err = b.DB.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltUsersBucket)
+			return err
+		})
+		if err != nil {
+			b.DB.Close()
+			return b, errors.Errorf("Bolt backend error: couldn't create users bucket: %s\n", err)
+		}
+	}
+
+	return b, nil
+}
+
+//GetUser checks that the username exists and the given password hashes to the same password.
+func (o Bolt) GetUser(username, password string) bool {
+	user, ok := o.getUser(username)
+	if !ok {
+		return false
+	}
+
+	if common.HashCompare(password, user.PasswordHash) {
+		return true
+	}
+
+	o.errs.set(ErrBadCredentials, nil)
+	return false
+}
+
+//GetSuperuser checks that the user exists and is a superuser.
+func (o Bolt) GetSuperuser(username string) bool {
+	user, ok := o.getUser(username)
+	return ok && user.Superuser
+}
+
+//CheckAcl matches the user's acls against topic and acc, replacing %u and %c in them with the username and clientid.
+func (o Bolt) CheckAcl(username, topic, clientid string, acc int32) bool {
+	user, ok := o.getUser(username)
+	if !ok {
+		return false
+	}
+
+	return ManifestAllows(user.Acls, username, topic, clientid, acc)
+}
+
+//getUser gets a stored user, keeping the error if it's missing or couldn't be read.
+func (o Bolt) getUser(username string) (SnapshotUser, bool) {
+	user, ok, err := o.StoredUser(username)
+	if err != nil {
+		log.Debugf("Bolt get user error: %s\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
+		return user, false
+	}
+	if !ok {
+		log.Debugf("Bolt get user error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
+	}
+	return user, ok
+}
+
+//StoredUser returns the stored user, if any.
+func (o Bolt) StoredUser(username string) (SnapshotUser, bool, error) {
+	var user SnapshotUser
+	var found bool
+
+	err := o.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get([]byte(username))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, &user)
+	})
+
+	return user, found && err == nil, err
+}
+
+//StoreUser stores the user, replacing it if it's already stored.
+func (o Bolt) StoreUser(user SnapshotUser) error {
+	if user.Username == "" {
+		return errors.New("Bolt store user error: empty username")
+	}
+
+	value, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return o.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Put([]byte(user.Username), value)
+	})
+}
+
+//DeleteUser removes the user, failing with ErrNotFound if it isn't stored.
+func (o Bolt) DeleteUser(username string) error {
+	return o.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		if bucket.Get([]byte(username)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(username))
+	})
+}
+
+//UserExists checks if the user is stored, regardless of its password.
+func (o Bolt) UserExists(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	_, ok := o.getUser(username)
+	return ok, o.errs.take()
+}
+
+//Export gets every stored user.
+func (o Bolt) Export() (Snapshot, error) {
+	var snapshot Snapshot
+
+	err := o.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var user SnapshotUser
+			if err := json.Unmarshal(v, &user); err != nil {
+				return errors.Errorf("user %s: %s", k, err)
+			}
+			snapshot.Users = append(snapshot.Users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return snapshot, errors.Errorf("Bolt export error: %s", err)
+	}
+
+	return snapshot, nil
+}
+
+//Import replaces every stored user with the snapshot's in a single transaction, so checks never see a partial import.
+func (o Bolt) Import(snapshot Snapshot) error {
+	err := o.DB.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltUsersBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		bucket, err := tx.CreateBucket(boltUsersBucket)
+		if err != nil {
+			return err
+		}
+		for _, user := range snapshot.Users {
+			value, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(user.Username), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Errorf("Bolt import error: %s", err)
+	}
+
+	return nil
+}
+
+//Healthy checks that the db file is still there.
+func (o Bolt) Healthy() bool {
+	_, err := os.Stat(o.Path)
+	return err == nil
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Bolt) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Bolt) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Bolt) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//GetName returns the backend's name
+func (o Bolt) GetName() string {
+	return "Bolt"
+}
+
+//Halt closes the db file, releasing its lock.
+func (o Bolt) Halt() {
+	if o.DB != nil {
+		if err := o.DB.Close(); err != nil {
+			log.Errorf("Bolt cleanup error: %s", err)
+		}
+	}
+}
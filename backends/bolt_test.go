@@ -0,0 +1,107 @@
+// +build !nobolt
+
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBolt(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	authOpts := map[string]string{
+		"bolt_path": filepath.Join(dir, "auth.db"),
+	}
+
+	Convey("Given no path, the backend should fail", t, func() {
+		_, err := NewBolt(map[string]string{}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given stored users, checks should be answered from the db file", t, func() {
+		b, err := NewBolt(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		So(b.StoreUser(SnapshotUser{Username: "test", PasswordHash: userPassHash, Acls: []ManifestAcl{{Topic: "test/%u/#", Acc: MOSQ_ACL_READWRITE}, {Topic: "clients/%c", Acc: MOSQ_ACL_READ}}}), ShouldBeNil)
+		So(b.StoreUser(SnapshotUser{Username: "admin", PasswordHash: userPassHash, Superuser: true}), ShouldBeNil)
+
+		So(b.GetUser("test", "testpw"), ShouldBeTrue)
+		granted, err := b.UserCheck("test", "wrong")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+		granted, err = b.UserCheck("unknown", "testpw")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrNotFound)
+
+		So(b.GetSuperuser("admin"), ShouldBeTrue)
+		So(b.GetSuperuser("test"), ShouldBeFalse)
+
+		So(b.CheckAcl("test", "test/test/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(b.CheckAcl("test", "test/other/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(b.CheckAcl("test", "clients/client", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(b.CheckAcl("test", "clients/client", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(b.CheckAcl("unknown", "test/unknown/temp", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+		So(b.DeleteUser("admin"), ShouldBeNil)
+		So(b.DeleteUser("admin"), ShouldEqual, ErrNotFound)
+		exists, err := b.UserExists("admin")
+		So(exists, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		exists, err = b.UserExists("test")
+		So(exists, ShouldBeTrue)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given a reopened db file, stored users should still be there", t, func() {
+		b, err := NewBolt(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		So(b.GetUser("test", "testpw"), ShouldBeTrue)
+		So(b.GetSuperuser("admin"), ShouldBeFalse)
+	})
+
+	Convey("Given a snapshot, importing it should replace every user and exporting should give them back", t, func() {
+		b, err := NewBolt(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		snapshot := Snapshot{Users: []SnapshotUser{
+			{Username: "imported", PasswordHash: userPassHash, Superuser: true, Acls: []ManifestAcl{{Topic: "a/#", Acc: MOSQ_ACL_READ}}},
+		}}
+		So(b.Import(snapshot), ShouldBeNil)
+
+		exists, _ := b.UserExists("test")
+		So(exists, ShouldBeFalse)
+		So(b.GetUser("imported", "testpw"), ShouldBeTrue)
+		So(b.GetSuperuser("imported"), ShouldBeTrue)
+
+		exported, err := b.Export()
+		So(err, ShouldBeNil)
+		So(exported, ShouldResemble, snapshot)
+		So(b.Healthy(), ShouldBeTrue)
+	})
+
+	Convey("Given a db file locked by another backend, opening it should time out", t, func() {
+		b, err := NewBolt(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer b.Halt()
+
+		_, err = NewBolt(map[string]string{"bolt_path": authOpts["bolt_path"], "bolt_timeout": "100ms"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
@@ -0,0 +1,163 @@
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//CacheHint is the cache ttl hinted by a remote response for its decision. A zero TTL means the decision must not be cached.
+type CacheHint struct {
+	TTL    time.Duration
+	Hinted bool
+}
+
+//Shortest returns the hint with the shortest ttl, so decisions made by several backends are cached no longer than any of them allows.
+func (h CacheHint) Shortest(other CacheHint) CacheHint {
+	if !other.Hinted || (h.Hinted && h.TTL <= other.TTL) {
+		return h
+	}
+	return other
+}
+
+//CacheHinter is implemented by remote backends whose responses may tell how long a decision should be cached.
+//Its checks are the ErrorChecker ones, returning the hint of the response along with the decision.
+type CacheHinter interface {
+	HintedUserCheck(username, password string) (bool, CacheHint, error)
+	HintedSuperuserCheck(username string) (bool, CacheHint, error)
+	AclHinter
+}
+
+//AclHinter is implemented by backends that may only hint how long acl decisions should be cached, such as those with acl rules conditioned on time.
+type AclHinter interface {
+	HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error)
+}
+
+//HintedCheckUser checks username and password against backend as CheckUser does, returning the cache hint of the response if the backend gives it.
+func HintedCheckUser(backend Backend, username, password string) (bool, CacheHint, error) {
+	if hinter, ok := backend.(CacheHinter); ok {
+		return hinter.HintedUserCheck(username, password)
+	}
+	granted, err := CheckUser(backend, username, password)
+	return granted, CacheHint{}, err
+}
+
+//HintedCheckSuperuser checks if username is a superuser for backend as CheckSuperuser does, returning the cache hint of the response if the backend gives it.
+func HintedCheckSuperuser(backend Backend, username string) (bool, CacheHint, error) {
+	if hinter, ok := backend.(CacheHinter); ok {
+		return hinter.HintedSuperuserCheck(username)
+	}
+	granted, err := CheckSuperuser(backend, username)
+	return granted, CacheHint{}, err
+}
+
+//HintedCheckAcl checks an acl against backend as CheckAcl does, returning the cache hint of the response if the backend gives it.
+func HintedCheckAcl(backend Backend, username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	if hinter, ok := backend.(AclHinter); ok {
+		return hinter.HintedAclCheck(username, topic, clientid, acc)
+	}
+	granted, err := CheckAcl(backend, username, topic, clientid, acc)
+	return granted, CacheHint{}, err
+}
+
+//HintedCheckAccess grants superusers or checks the acl against backend as CheckAccess does, returning the shortest cache hint of the responses.
+func HintedCheckAccess(backend Backend, username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	superuser, superHint, superErr := HintedCheckSuperuser(backend, username)
+	if superuser {
+		return true, superHint, nil
+	}
+	granted, hint, err := HintedCheckAcl(backend, username, topic, clientid, acc)
+	if err == nil && !granted {
+		err = superErr
+	}
+	return granted, hint.Shortest(superHint), err
+}
+
+//TokenIdentifier is implemented by backends that take tokens as usernames and may identify them, so cache entries are keyed by a short id instead of the whole token.
+type TokenIdentifier interface {
+	//TokenID returns the token's id and expiration, which may be zero, or false if the username is not an identified token.
+	TokenID(username string) (string, time.Time, bool)
+}
+
+//TokenExpirer is implemented by backends that take tokens as usernames and may tell if they expired without a full check.
+type TokenExpirer interface {
+	//TokenExpired returns true if username is a token past its expiration.
+	TokenExpired(username string) bool
+}
+
+//cacheHint keeps the hint of the response to a single check. Backends get a new one for every CacheHinter or AclHinter call on their copy of themselves,
+//and none for other calls, in which case hints aren't kept.
+type cacheHint struct {
+	sync.Mutex
+	hint CacheHint
+}
+
+//set keeps the hinted ttl.
+func (h *cacheHint) set(ttl time.Duration) {
+	h.keep(CacheHint{TTL: ttl, Hinted: true})
+}
+
+//keep keeps the shortest of the kept hint and the given one, e.g. by another backend.
+func (h *cacheHint) keep(hint CacheHint) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.hint = h.hint.Shortest(hint)
+}
+
+//inEffect returns whether an acl rule matching the checked topic is in effect, hinting the decision must not be cached if the rule is timed,
+//as it changes when the rule's window opens or closes, and cached decisions would outlast it.
+func (h *cacheHint) inEffect(active, timed bool) bool {
+	if timed {
+		h.set(0)
+	}
+	return active
+}
+
+//get returns the kept hint, if any.
+func (h *cacheHint) get() CacheHint {
+	if h == nil {
+		return CacheHint{}
+	}
+	h.Lock()
+	defer h.Unlock()
+	return h.hint
+}
+
+//parseCacheHint gets a ttl from a remote response. For json responses, a numeric ttlField (in seconds) takes precedence over the Cache-Control header.
+func parseCacheHint(header http.Header, body []byte, responseMode, ttlField string) (time.Duration, bool) {
+
+	if responseMode == "json" && ttlField != "" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err == nil {
+			if seconds, ok := fields[ttlField].(float64); ok && seconds >= 0 {
+				return time.Duration(seconds * float64(time.Second)), true
+			}
+		}
+	}
+
+	cacheControl := header.Get("Cache-Control")
+	if cacheControl == "" {
+		return 0, false
+	}
+
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-store" || directive == "no-cache" {
+			return 0, true
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`), 10, 64)
+			if err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+
+	return 0, false
+}
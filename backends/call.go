@@ -0,0 +1,30 @@
+package backends
+
+import "time"
+
+//CallResult is the outcome of a backend check: whether it was granted, the cache hint of its response and the error of a failed check.
+type CallResult struct {
+	Granted bool
+	Hint    CacheHint
+	Err     error
+}
+
+//CallWithin makes a backend check, waiting for it at most timeout, and returns false if it timed out.
+//A check that times out is left running, and its result goes to a buffered channel of its own that's no longer read, so it can't be taken for another check's.
+func CallWithin(timeout time.Duration, call func() (bool, CacheHint, error)) (CallResult, bool) {
+	result := make(chan CallResult, 1)
+	go func() {
+		granted, hint, err := call()
+		result <- CallResult{Granted: granted, Hint: hint, Err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-result:
+		return r, true
+	case <-timer.C:
+		return CallResult{}, false
+	}
+}
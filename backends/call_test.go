@@ -0,0 +1,98 @@
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//slowBackend grants users after a delay, failing with its error, or hinting its ttl, so late results may be told apart.
+type slowBackend struct {
+	delay time.Duration
+	err   error
+	hint  CacheHint
+}
+
+func (o slowBackend) GetUser(username, password string) bool {
+	time.Sleep(o.delay)
+	return o.err == nil
+}
+
+func (o slowBackend) GetSuperuser(username string) bool {
+	return false
+}
+
+func (o slowBackend) CheckAcl(username, topic, clientid string, acc int32) bool {
+	return false
+}
+
+func (o slowBackend) GetName() string {
+	return "Slow"
+}
+
+func (o slowBackend) Halt() {}
+
+func (o slowBackend) HintedUserCheck(username, password string) (bool, CacheHint, error) {
+	return o.GetUser(username, password), o.hint, o.err
+}
+
+func (o slowBackend) HintedSuperuserCheck(username string) (bool, CacheHint, error) {
+	return false, CacheHint{}, nil
+}
+
+func (o slowBackend) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	return false, CacheHint{}, nil
+}
+
+func TestCallWithin(t *testing.T) {
+
+	slow := slowBackend{delay: 100 * time.Millisecond, err: &CheckError{Kind: ErrBackendUnavailable}, hint: CacheHint{TTL: 0, Hinted: true}}
+	fast := slowBackend{delay: time.Millisecond, hint: CacheHint{TTL: time.Minute, Hinted: true}}
+
+	Convey("Given a call within its timeout, its own result should be returned", t, func() {
+		result, ok := CallWithin(time.Second, func() (bool, CacheHint, error) {
+			return HintedCheckUser(fast, "user", "pass")
+		})
+		So(ok, ShouldBeTrue)
+		So(result, ShouldResemble, CallResult{Granted: true, Hint: fast.hint})
+	})
+
+	Convey("Given a call that times out, the next call shouldn't get its late error or hint", t, func() {
+		_, ok := CallWithin(10*time.Millisecond, func() (bool, CacheHint, error) {
+			return HintedCheckUser(slow, "user", "pass")
+		})
+		So(ok, ShouldBeFalse)
+
+		//The next call outlives the timed out one, which returns meanwhile.
+		result, ok := CallWithin(time.Second, func() (bool, CacheHint, error) {
+			return HintedCheckUser(slowBackend{delay: 200 * time.Millisecond, hint: fast.hint}, "user", "pass")
+		})
+		So(ok, ShouldBeTrue)
+		So(result.Granted, ShouldBeTrue)
+		So(result.Err, ShouldBeNil)
+		So(result.Hint, ShouldResemble, fast.hint)
+	})
+
+	Convey("Given a check budget, a slow backend should only take its share, leaving the rest to the next one", t, func() {
+		start := time.Now()
+		budget := common.NewCheckBudget(start, 100*time.Millisecond)
+
+		share, _ := budget.Share(time.Now(), 2)
+		_, ok := CallWithin(share, func() (bool, CacheHint, error) {
+			return HintedCheckUser(slow, "user", "pass")
+		})
+		So(ok, ShouldBeFalse)
+
+		share, _ = budget.Share(time.Now(), 1)
+		So(share, ShouldBeGreaterThan, 0)
+		result, ok := CallWithin(share, func() (bool, CacheHint, error) {
+			return HintedCheckUser(fast, "user", "pass")
+		})
+		So(ok, ShouldBeTrue)
+		So(result.Granted, ShouldBeTrue)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+	})
+
+}
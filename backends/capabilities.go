@@ -0,0 +1,94 @@
+package backends
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//Capabilities are the checks a backend supports and the optional features it has, given its options.
+type Capabilities struct {
+	User      bool
+	Superuser bool
+	Acl       bool
+	Psk       bool
+	Batch     bool //Batch tells if acls may be checked in batches, see AclBatcher.
+	Manifest  bool //Manifest tells if permission manifests may be given at authentication, see Manifester.
+}
+
+//Capable is implemented by backends declaring their capabilities, e.g. sql ones without a superuser query, so the plugin doesn't call them for checks they can't grant.
+type Capable interface {
+	Capabilities() Capabilities
+}
+
+//Readier is implemented by backends that can tell if they're ready to answer checks, and why not.
+type Readier interface {
+	Ready() error
+}
+
+//CapabilitiesOf returns the capabilities declared by the backend. Backends not declaring them are assumed to support user, superuser and acl checks,
+//and optional features are taken from the interfaces they implement.
+func CapabilitiesOf(backend Backend) Capabilities {
+	if capable, ok := backend.(Capable); ok {
+		return capable.Capabilities()
+	}
+
+	capabilities := Capabilities{User: true, Superuser: true, Acl: true}
+	_, capabilities.Psk = backend.(PskKeyGetter)
+	if batcher, ok := backend.(AclBatcher); ok {
+		capabilities.Batch = batcher.BatchesAcls()
+	}
+	_, capabilities.Manifest = backend.(Manifester)
+	return capabilities
+}
+
+//sqlCapabilities are the capabilities of sql backends given their queries. Without an acl query every acl is granted, so acls are always checked.
+func sqlCapabilities(superuserQuery, pskQuery, manifestQuery string) Capabilities {
+	return Capabilities{
+		User:      true,
+		Superuser: superuserQuery != "",
+		Acl:       true,
+		Psk:       pskQuery != "",
+		Manifest:  manifestQuery != "",
+	}
+}
+
+//Checks returns the names of the supported checks and features, e.g. for logging.
+func (c Capabilities) Checks() []string {
+	var checks []string
+	for _, capability := range []struct {
+		name      string
+		supported bool
+	}{
+		{"user", c.User},
+		{"superuser", c.Superuser},
+		{"acl", c.Acl},
+		{"psk", c.Psk},
+		{"batch", c.Batch},
+		{"manifest", c.Manifest},
+	} {
+		if capability.supported {
+			checks = append(checks, capability.name)
+		}
+	}
+	return checks
+}
+
+func (c Capabilities) String() string {
+	checks := c.Checks()
+	if len(checks) == 0 {
+		return "none"
+	}
+	return strings.Join(checks, ", ")
+}
+
+//Ready tells if the backend is ready to answer checks, asking backends implementing Readier or HealthChecker. Others are assumed to be ready.
+func Ready(backend Backend) error {
+	if readier, ok := backend.(Readier); ok {
+		return readier.Ready()
+	}
+	if checker, ok := backend.(HealthChecker); ok && !checker.Healthy() {
+		return errors.New("upstream unreachable")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package backends
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCapabilities(t *testing.T) {
+
+	Convey("Given backends declaring their capabilities, they should depend on their options", t, func() {
+		So(CapabilitiesOf(Files{}), ShouldResemble, Capabilities{User: true, Acl: true})
+		So(CapabilitiesOf(Files{PskPath: "psks"}).Psk, ShouldBeTrue)
+
+		pg := CapabilitiesOf(Postgres{})
+		So(pg.Superuser, ShouldBeFalse)
+		So(pg.Acl, ShouldBeTrue)
+		So(pg.Psk, ShouldBeFalse)
+		So(pg.Manifest, ShouldBeFalse)
+
+		pg = CapabilitiesOf(Postgres{SuperuserQuery: "select", PskQuery: "select", ManifestQuery: "select"})
+		So(pg, ShouldResemble, Capabilities{User: true, Superuser: true, Acl: true, Psk: true, Manifest: true})
+
+		So(CapabilitiesOf(HTTP{}).Batch, ShouldBeFalse)
+		So(CapabilitiesOf(HTTP{AclBatchUri: "/batch"}).Batch, ShouldBeTrue)
+		So(CapabilitiesOf(JWT{ManifestClaim: "acls"}).Manifest, ShouldBeTrue)
+	})
+
+	Convey("Given backends not declaring them, they should be taken from their interfaces", t, func() {
+		So(CapabilitiesOf(Redis{}), ShouldResemble, Capabilities{User: true, Superuser: true, Acl: true, Psk: true})
+	})
+
+	Convey("Given capabilities, they should be listed by name", t, func() {
+		So(Capabilities{User: true, Acl: true, Batch: true}.String(), ShouldEqual, "user, acl, batch")
+		So(Capabilities{}.String(), ShouldEqual, "none")
+	})
+}
@@ -0,0 +1,32 @@
+package backends
+
+import (
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//ClientAware is implemented by backends that take what mosquitto tells about the client being checked, such as remote ones sending it along.
+type ClientAware interface {
+	//ForClient returns a copy of the backend that checks the given client, to be used for a single check.
+	ForClient(metadata common.ClientMetadata) Backend
+}
+
+//ForClient returns backend as it checks the client with the given metadata, if it takes it, or backend itself. Nil metadata means none is known.
+func ForClient(backend Backend, metadata *common.ClientMetadata) Backend {
+	if aware, ok := backend.(ClientAware); ok && metadata != nil {
+		return aware.ForClient(*metadata)
+	}
+	return backend
+}
+
+//addClientMetadata adds the known metadata of the client being checked to a remote request's params and values, if given.
+func addClientMetadata(metadata *common.ClientMetadata, dataMap map[string]interface{}, urlValues map[string][]string) {
+	if metadata == nil {
+		return
+	}
+	for k, v := range metadata.Params() {
+		dataMap[k] = v
+	}
+	for k, v := range metadata.Values() {
+		urlValues[k] = v
+	}
+}
@@ -0,0 +1,37 @@
+package backends
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+//ConnectionLimiter is implemented by backends that know how many simultaneous connections a user may have.
+type ConnectionLimiter interface {
+	//MaxConnections returns the maximum simultaneous connections for username, or false if it's not known.
+	MaxConnections(username string) (int, bool)
+}
+
+//queryMaxConnections runs a query that returns the maximum simultaneous connections for username.
+func queryMaxConnections(db *sqlx.DB, query, username, backend string) (int, bool) {
+
+	if query == "" {
+		return 0, false
+	}
+
+	var max sql.NullInt64
+	err := db.Get(&max, query, username)
+
+	if err != nil {
+		log.Debugf("%s max connections error: %s\n", backend, err)
+		return 0, false
+	}
+
+	if !max.Valid {
+		return 0, false
+	}
+
+	return int(max.Int64), true
+
+}
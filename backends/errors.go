@@ -0,0 +1,167 @@
+package backends
+
+import (
+	"database/sql"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//Kinds of errors backends report for failed checks, so a denial may be told apart from a failure and handled consistently.
+var (
+	//ErrNotFound means the user, or anything else the check needed, doesn't exist.
+	ErrNotFound = errors.New("not found")
+	//ErrBadCredentials means the user exists but the password or token didn't match.
+	ErrBadCredentials = errors.New("bad credentials")
+	//ErrBackendUnavailable means the backend's store or service couldn't be reached or failed.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	//ErrMisconfigured means the check couldn't be run as configured, e.g. a bad query.
+	ErrMisconfigured = errors.New("backend misconfigured")
+)
+
+//errorKindNames are the names of error kinds as used in logs and metrics.
+var errorKindNames = map[error]string{
+	ErrNotFound:           "not_found",
+	ErrBadCredentials:     "bad_credentials",
+	ErrBackendUnavailable: "unavailable",
+	ErrMisconfigured:      "misconfigured",
+}
+
+//CheckError is the error of a failed check: its kind, one of the Err values, and its cause, if any.
+type CheckError struct {
+	Kind  error
+	Cause error
+}
+
+func (e *CheckError) Error() string {
+	if e.Cause == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Cause.Error()
+}
+
+//ErrorKind returns the kind of err, or ErrBackendUnavailable if it has none.
+func ErrorKind(err error) error {
+	if checkErr, ok := err.(*CheckError); ok {
+		return checkErr.Kind
+	}
+	if _, ok := errorKindNames[err]; ok {
+		return err
+	}
+	return ErrBackendUnavailable
+}
+
+//ErrorKindName returns the name of err's kind, e.g. not_found.
+func ErrorKindName(err error) string {
+	return errorKindNames[ErrorKind(err)]
+}
+
+//ErrorChecker is implemented by backends that tell why a check was denied.
+//Its checks are the same as the Backend ones, but return the error of a failed check along with its result, or nil if it didn't fail.
+//Errors are kept apart for every call, so concurrent checks never get each other's.
+type ErrorChecker interface {
+	UserCheck(username, password string) (bool, error)
+	SuperuserCheck(username string) (bool, error)
+	AclCheck(username, topic, clientid string, acc int32) (bool, error)
+}
+
+//CheckUser checks a user against backend, returning the error of a failed check if the backend tells it.
+func CheckUser(backend Backend, username, password string) (bool, error) {
+	if checker, ok := backend.(ErrorChecker); ok {
+		return checker.UserCheck(username, password)
+	}
+	return backend.GetUser(username, password), nil
+}
+
+//CheckSuperuser checks if username is a superuser for backend, returning the error of a failed check if the backend tells it.
+func CheckSuperuser(backend Backend, username string) (bool, error) {
+	if checker, ok := backend.(ErrorChecker); ok {
+		return checker.SuperuserCheck(username)
+	}
+	return backend.GetSuperuser(username), nil
+}
+
+//CheckAcl checks an acl against backend, returning the error of a failed check if the backend tells it.
+func CheckAcl(backend Backend, username, topic, clientid string, acc int32) (bool, error) {
+	if checker, ok := backend.(ErrorChecker); ok {
+		return checker.AclCheck(username, topic, clientid, acc)
+	}
+	return backend.CheckAcl(username, topic, clientid, acc), nil
+}
+
+//CheckAccess grants superusers or checks the acl against backend, returning the error of the acl check or else the superuser one.
+func CheckAccess(backend Backend, username, topic, clientid string, acc int32) (bool, error) {
+	superuser, superErr := CheckSuperuser(backend, username)
+	if superuser {
+		return true, nil
+	}
+	granted, err := CheckAcl(backend, username, topic, clientid, acc)
+	if err == nil && !granted {
+		err = superErr
+	}
+	return granted, err
+}
+
+//checkErrors keeps the error of a single check. Backends get a new one for every ErrorChecker call on their copy of themselves,
+//and none for plain Backend calls, in which case errors aren't kept.
+type checkErrors struct {
+	sync.Mutex
+	err error
+}
+
+//set keeps an error of the given kind and cause, which may be nil.
+func (c *checkErrors) set(kind, cause error) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.err = &CheckError{Kind: kind, Cause: cause}
+}
+
+//keep keeps an error as given, e.g. by another backend.
+func (c *checkErrors) keep(err error) {
+	if c == nil || err == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.err = err
+}
+
+//take returns the kept error, if any, clearing it.
+func (c *checkErrors) take() error {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	err := c.err
+	c.err = nil
+	return err
+}
+
+//setDB keeps a DB error: no rows mean nothing was found, while any other error means the DB failed.
+func (c *checkErrors) setDB(err error) {
+	if err == sql.ErrNoRows {
+		c.set(ErrNotFound, nil)
+		return
+	}
+	c.set(ErrBackendUnavailable, err)
+}
+
+//setStatus keeps the error of a remote response with a non 200 status: server errors mean the service failed, while other statuses deny user checks for bad credentials and are plain denials otherwise.
+func (c *checkErrors) setStatus(status int, userCheck bool) {
+	if status >= 500 {
+		c.set(ErrBackendUnavailable, errors.Errorf("status %d", status))
+		return
+	}
+	c.setDenied(userCheck)
+}
+
+//setDenied keeps the error of a remote denial, which for user checks means bad credentials.
+func (c *checkErrors) setDenied(userCheck bool) {
+	if userCheck {
+		c.set(ErrBadCredentials, nil)
+	}
+}
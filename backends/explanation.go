@@ -0,0 +1,62 @@
+package backends
+
+import (
+	"encoding/json"
+)
+
+//Consultation is the result of a backend consulted earlier in an acl check, as told to the backends consulted after it.
+type Consultation struct {
+	Backend string `json:"backend"`
+	//Check is either superuser or acl.
+	Check   string `json:"check"`
+	Granted bool   `json:"granted"`
+	//Error is the kind of error the backend failed with, if any, e.g. unavailable.
+	Error string `json:"error,omitempty"`
+}
+
+//Explainable is implemented by backends that may send the results of the backends consulted before them along with their requests,
+//so a remote service may act as a second opinion, e.g. only reviewing checks other backends denied.
+type Explainable interface {
+	//ExplainedSuperuserCheck and ExplainedAclCheck check as HintedSuperuserCheck and HintedAclCheck do, sending the results of the backends consulted so far in the ongoing acl check along with the request.
+	ExplainedSuperuserCheck(consulted []Consultation, username string) (bool, CacheHint, error)
+	ExplainedAclCheck(consulted []Consultation, username, topic, clientid string, acc int32) (bool, CacheHint, error)
+}
+
+//ExplainedCheckSuperuser checks if username is a superuser for backend as HintedCheckSuperuser does, telling it the results of the backends consulted before it if it takes them.
+func ExplainedCheckSuperuser(backend Backend, consulted []Consultation, username string) (bool, CacheHint, error) {
+	if explainable, ok := backend.(Explainable); ok {
+		return explainable.ExplainedSuperuserCheck(consulted, username)
+	}
+	return HintedCheckSuperuser(backend, username)
+}
+
+//ExplainedCheckAcl checks an acl against backend as HintedCheckAcl does, telling it the results of the backends consulted before it if it takes them.
+func ExplainedCheckAcl(backend Backend, consulted []Consultation, username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	if explainable, ok := backend.(Explainable); ok {
+		return explainable.ExplainedAclCheck(consulted, username, topic, clientid, acc)
+	}
+	return HintedCheckAcl(backend, username, topic, clientid, acc)
+}
+
+//consultationParams returns consultations as a generic list, so they may be encoded in any params mode.
+func consultationParams(consulted []Consultation) []interface{} {
+	params := make([]interface{}, 0, len(consulted))
+	for _, c := range consulted {
+		param := map[string]interface{}{
+			"backend": c.Backend,
+			"check":   c.Check,
+			"granted": c.Granted,
+		}
+		if c.Error != "" {
+			param["error"] = c.Error
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+//consultationValue returns consultations as a json string, for form params and query strings.
+func consultationValue(consulted []Consultation) string {
+	value, _ := json.Marshal(consulted)
+	return string(value)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -27,8 +28,9 @@ type FileUser struct {
 
 //AclRecord holds a topic and access privileges.
 type AclRecord struct {
-	Topic string
-	Acc   byte //None 0x00, Read 0x01, Write 0x02, ReadWrite: Read | Write : 0x03
+	Topic      string
+	Acc        byte                  //None 0x00, Read 0x01, Write 0x02, ReadWrite: Read | Write : 0x03
+	Conditions *common.AclConditions //Optional conditions for the record to be in effect.
 }
 
 //FileBE holds paths to files, list of file users and general (no user or pattern) acl records.
@@ -38,6 +40,16 @@ type Files struct {
 	CheckAcls    bool
 	Users        map[string]*FileUser //Users keeps a registry of username/FileUser pairs, holding a user's password and Acl records.
 	AclRecords   []AclRecord
+	PskPath      string
+	PskKeys      map[string]string //PskKeys holds hex encoded TLS-PSK keys by identity.
+	errs         *checkErrors
+	hint         *cacheHint
+}
+
+func init() {
+	register("files", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewFiles(authOpts, logLevel)
+	})
 }
 
 //NewFiles initializes a files backend.
@@ -51,6 +63,7 @@ func NewFiles(authOpts map[string]string, logLevel log.Level) (Files, error) {
 		CheckAcls:    false,
 		Users:        make(map[string]*FileUser),
 		AclRecords:   make([]AclRecord, 0, 0),
+		PskKeys:      make(map[string]string),
 	}
 
 	if passwordPath, ok := authOpts["password_path"]; ok {
@@ -85,6 +98,16 @@ func NewFiles(authOpts map[string]string, logLevel log.Level) (Files, error) {
 		}
 	}
 
+	//Psk keys are optional.
+	if pskPath, ok := authOpts["psk_path"]; ok {
+		files.PskPath = pskPath
+		pskCount, pskErr := files.readPskKeys()
+		if pskErr != nil {
+			return files, errors.Errorf("Fatal: %s\n", pskErr)
+		}
+		log.Infof("Got %d keys from psk file.\n", pskCount)
+	}
+
 	return files, nil
 
 }
@@ -112,7 +135,8 @@ func (o Files) readPasswords() (int, error) {
 			continue
 		}
 
-		lineArr := strings.Split(scanner.Text(), ":")
+		//Split only at the first colon, as SCRAM credentials contain them.
+		lineArr := strings.SplitN(scanner.Text(), ":", 2)
 		if len(lineArr) != 2 {
 			log.Errorf("Read passwords error: line %d is not well formatted.\n", index)
 			continue
@@ -137,6 +161,44 @@ func (o Files) readPasswords() (int, error) {
 
 }
 
+//readPskKeys reads identity:key lines from the psk file, as in mosquitto's psk_file. Return amount of keys seen and possible error.
+func (o Files) readPskKeys() (int, error) {
+
+	keysCount := 0
+
+	file, fErr := os.Open(o.PskPath)
+	if fErr != nil {
+		return keysCount, errors.Errorf("Files backend error: couldn't open psk file: %s\n", fErr)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanLines)
+
+	index := 0
+	for scanner.Scan() {
+		index++
+
+		if checkCommentOrEmpty(scanner.Text()) {
+			continue
+		}
+
+		lineArr := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(lineArr) != 2 || !validPskKey(lineArr[1]) {
+			log.Errorf("Read psk keys error: line %d is not well formatted.\n", index)
+			continue
+		}
+
+		if _, ok := o.PskKeys[lineArr[0]]; !ok {
+			keysCount++
+		}
+		o.PskKeys[lineArr[0]] = lineArr[1]
+	}
+
+	return keysCount, nil
+
+}
+
 //ReadAcls reads the Acl file and associates them to existing users. It omits any non existing users.
 func (o *Files) readAcls() (int, error) {
 
@@ -164,10 +226,13 @@ func (o *Files) readAcls() (int, error) {
 			continue
 		}
 
+		//Split keeping acl templates, which may have spaces, whole.
+		fields := common.AclFields(line)
+
 		//If we see a user line, change the current user.
-		if strings.Contains(line, "user") {
+		if fields[0] == "user" {
 			//Try to get username
-			lineArr := strings.Fields(line)
+			lineArr := fields
 
 			//Check format
 			if len(lineArr) == 2 && lineArr[0] == "user" {
@@ -183,16 +248,20 @@ func (o *Files) readAcls() (int, error) {
 			} else {
 				return 0, errors.Errorf("Files backend error: wrong acl format at line %d\n", index)
 			}
-		} else if strings.Contains(line, "topic") {
+		} else if fields[0] == "topic" {
 
-			//Split and check for read, write or empty (readwwrite) privileges.
-			lineArr := strings.Fields(line)
+			//Split and check for read, write or empty (readwwrite) privileges, and optional conditions.
+			lineArr, conditions, cErr := splitConditions(fields)
+			if cErr != nil {
+				return 0, errors.Errorf("Files backend error: wrong acl conditions at line %d: %s\n", index, cErr)
+			}
 
 			if (len(lineArr) == 2 || len(lineArr) == 3) && lineArr[0] == "topic" {
 
 				var aclRecord = AclRecord{
-					Topic: "",
-					Acc:   MOSQ_ACL_NONE,
+					Topic:      "",
+					Acc:        MOSQ_ACL_NONE,
+					Conditions: conditions,
 				}
 
 				//If len is 2, then we assume ReadWrite privileges.
@@ -217,6 +286,12 @@ func (o *Files) readAcls() (int, error) {
 				//Append to user or general depending on currentUser.
 				if currentUser != "" {
 					fUser, _ := o.Users[currentUser]
+					if lErr := common.CheckAclRule(currentUser, strings.Join(fields[len(lineArr)-1:], " ")); lErr != nil {
+						return 0, errors.Errorf("Files backend error: acl over limits at line %d: %s\n", index, lErr)
+					}
+					if lErr := common.CheckAclRuleCount(currentUser, len(fUser.AclRecords)+1); lErr != nil {
+						return 0, errors.Errorf("Files backend error: acl over limits at line %d: %s\n", index, lErr)
+					}
 					fUser.AclRecords = append(fUser.AclRecords, aclRecord)
 				} else {
 					o.AclRecords = append(o.AclRecords, aclRecord)
@@ -228,16 +303,20 @@ func (o *Files) readAcls() (int, error) {
 				return 0, errors.Errorf("Files backend error: wrong acl format at line %d\n", index)
 			}
 
-		} else if strings.Contains(line, "pattern") {
+		} else if fields[0] == "pattern" {
 
-			//Split and check for read, write or empty (readwwrite) privileges.
-			lineArr := strings.Fields(line)
+			//Split and check for read, write or empty (readwwrite) privileges, and optional conditions.
+			lineArr, conditions, cErr := splitConditions(fields)
+			if cErr != nil {
+				return 0, errors.Errorf("Files backend error: wrong acl conditions at line %d: %s\n", index, cErr)
+			}
 
 			if (len(lineArr) == 2 || len(lineArr) == 3) && lineArr[0] == "pattern" {
 
 				var aclRecord = AclRecord{
-					Topic: "",
-					Acc:   MOSQ_ACL_NONE,
+					Topic:      "",
+					Acc:        MOSQ_ACL_NONE,
+					Conditions: conditions,
 				}
 
 				//If len is 2, then we assume ReadWrite privileges.
@@ -259,6 +338,10 @@ func (o *Files) readAcls() (int, error) {
 					}
 				}
 
+				if tErr := common.ValidateAclTopic(aclRecord.Topic); tErr != nil {
+					return 0, errors.Errorf("Files backend error: wrong acl template at line %d: %s\n", index, tErr)
+				}
+
 				//Append to general acls.
 				o.AclRecords = append(o.AclRecords, aclRecord)
 
@@ -275,6 +358,16 @@ func (o *Files) readAcls() (int, error) {
 
 }
 
+//splitConditions separates trailing condition tokens from an acl line's fields.
+func splitConditions(fields []string) ([]string, *common.AclConditions, error) {
+	i := len(fields)
+	for i > 1 && common.IsConditionToken(fields[i-1]) {
+		i--
+	}
+	conditions, err := common.ParseAclConditions(fields[i:])
+	return fields[:i], conditions, err
+}
+
 func checkCommentOrEmpty(line string) bool {
 	if len(strings.Replace(line, " ", "", -1)) == 0 || line[0:1] == "#" {
 		return true
@@ -287,6 +380,7 @@ func (o Files) GetUser(username, password string) bool {
 
 	fileUser, ok := o.Users[username]
 	if !ok {
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -295,6 +389,7 @@ func (o Files) GetUser(username, password string) bool {
 	}
 
 	log.Warnf("wrong password for user %s\n", username)
+	o.errs.set(ErrBadCredentials, nil)
 
 	return false
 
@@ -313,20 +408,23 @@ func (o Files) CheckAcl(username, topic, clientid string, acc int32) bool {
 	}
 
 	fileUser, ok := o.Users[username]
+	now := time.Now()
+	address := common.ClientAddress(clientid)
 
 	//If user exists, check against his acls and common ones. If not, check against common acls only.
 	if ok {
 		for _, aclRecord := range fileUser.AclRecords {
-			if common.TopicsMatch(aclRecord.Topic, topic) && (acc == int32(aclRecord.Acc) || int32(aclRecord.Acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.Acc) == MOSQ_ACL_READ || int32(aclRecord.Acc) == MOSQ_ACL_SUBSCRIBE))) {
+			if common.TopicsMatch(aclRecord.Topic, topic) && (acc == int32(aclRecord.Acc) || int32(aclRecord.Acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.Acc) == MOSQ_ACL_READ || int32(aclRecord.Acc) == MOSQ_ACL_SUBSCRIBE))) &&
+				o.hint.inEffect(aclRecord.Conditions.Met(now, address), aclRecord.Conditions.Timed()) {
 				return true
 			}
 		}
 	}
 	for _, aclRecord := range o.AclRecords {
-		//Replace all occurrences of %c for clientid and %u for username
-		aclTopic := strings.Replace(aclRecord.Topic, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) && (acc == int32(aclRecord.Acc) || int32(aclRecord.Acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.Acc) == MOSQ_ACL_READ || int32(aclRecord.Acc) == MOSQ_ACL_SUBSCRIBE))) {
+		//Replace all occurrences of %c for clientid and %u for username, and templates.
+		aclTopic, ok := common.ExpandAclTopic(aclRecord.Topic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && (acc == int32(aclRecord.Acc) || int32(aclRecord.Acc) == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && (int32(aclRecord.Acc) == MOSQ_ACL_READ || int32(aclRecord.Acc) == MOSQ_ACL_SUBSCRIBE))) &&
+			o.hint.inEffect(aclRecord.Conditions.Met(now, address), aclRecord.Conditions.Timed()) {
 			return true
 		}
 	}
@@ -335,6 +433,45 @@ func (o Files) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//GetPskKey returns the key for identity from the psk file, if any.
+func (o Files) GetPskKey(hint, identity string) (string, bool) {
+	key, ok := o.PskKeys[identity]
+	return key, ok
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Files) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Files) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Files) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Files) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//Capabilities tells files never grants superusers, and only gets psk keys when a psk file is given.
+func (o Files) Capabilities() Capabilities {
+	return Capabilities{User: true, Acl: true, Psk: o.PskPath != ""}
+}
+
 //GetName returns the backend's name
 func (o Files) GetName() string {
 	return "Files"
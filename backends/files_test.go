@@ -1,9 +1,15 @@
 package backends
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/iegomez/mosquitto-go-auth/common"
 	log "github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -43,6 +49,8 @@ func TestFiles(t *testing.T) {
 			pattern read test/%u
 
 			pattern read test/%c
+
+			pattern read tenants/{{username | split "@" 1 | lower}}/devices/{{clientid}}/#
 		*/
 
 		//Password are the same as users
@@ -64,6 +72,27 @@ func TestFiles(t *testing.T) {
 
 		})
 
+		Convey("Given failed user checks, the error should tell why, and only for the check that failed", func() {
+
+			_, err := files.UserCheck(user1, user2)
+			So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+
+			_, err = files.UserCheck(user1, user1)
+			So(err, ShouldBeNil)
+
+			_, err = files.UserCheck("unknown", "unknown")
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+			So(ErrorKindName(err), ShouldEqual, "not_found")
+
+		})
+
+		Convey("Given a user with SCRAM-SHA-256 credentials, it should authenticate it with the correct password only", func() {
+
+			So(files.GetUser("test4", "test4"), ShouldBeTrue)
+			So(files.GetUser("test4", "test1"), ShouldBeFalse)
+
+		})
+
 		//There are no superusers for files
 		Convey("For any user superuser should return false", func() {
 			superuser := files.GetSuperuser(user1)
@@ -136,9 +165,168 @@ func TestFiles(t *testing.T) {
 			So(tt1, ShouldBeTrue)
 		})
 
+		Convey("Given a pattern with templates, acl check should pass only when they can be expanded", func() {
+			So(files.CheckAcl("device@Acme", "tenants/acme/devices/test_client/state", clientID, 1), ShouldBeTrue)
+			So(files.CheckAcl("device@Other", "tenants/acme/devices/test_client/state", clientID, 1), ShouldBeFalse)
+			So(files.CheckAcl(user1, "tenants/test1/devices/test_client/state", clientID, 1), ShouldBeFalse)
+		})
+
+		Convey("Given conditional rules, only rules in effect should be checked", func() {
+			tt1 := files.CheckAcl(user1, "expired/topic", clientID, 1)
+			tt2 := files.CheckAcl(user1, "window/topic", clientID, 1)
+			So(tt1, ShouldBeFalse)
+			So(tt2, ShouldBeTrue)
+		})
+
+		Convey("Time conditions should honor dates, days and hours", func() {
+			_, conditions, err := splitConditions(strings.Fields("topic read some/topic from=2019-01-01T00:00:00Z until=2019-12-31T23:59:59Z days=fri-mon hours=22:00-06:00 tz=UTC"))
+			So(err, ShouldBeNil)
+
+			//Friday 2019-03-01 at 23:00 and Monday 2019-03-04 at 05:59 are within the window.
+			So(conditions.Met(time.Date(2019, 3, 1, 23, 0, 0, 0, time.UTC), nil), ShouldBeTrue)
+			So(conditions.Met(time.Date(2019, 3, 4, 5, 59, 0, 0, time.UTC), nil), ShouldBeTrue)
+
+			//Friday at noon is outside the hours range and Wednesday outside the days range.
+			So(conditions.Met(time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC), nil), ShouldBeFalse)
+			So(conditions.Met(time.Date(2019, 3, 6, 23, 0, 0, 0, time.UTC), nil), ShouldBeFalse)
+
+			//Out of the dates range.
+			So(conditions.Met(time.Date(2020, 3, 6, 23, 0, 0, 0, time.UTC), nil), ShouldBeFalse)
+
+			_, _, err = splitConditions(strings.Fields("topic read some/topic days=someday"))
+			So(err, ShouldBeError)
+		})
+
+		Convey("Given network conditional rules, only clients connecting from those networks should pass", func() {
+			//Unknown addresses never meet network conditions.
+			So(files.CheckAcl(user1, "ops/command", clientID, 2), ShouldBeFalse)
+
+			for address, granted := range map[string]bool{"10.1.2.3": true, "192.168.1.10": true, "192.168.1.11": false} {
+				So(common.SetClientAddress(clientID, address), ShouldBeTrue)
+				So(files.CheckAcl(user1, "ops/command", clientID, 2), ShouldEqual, granted)
+				common.ClearClientAddress(clientID)
+			}
+
+			So(files.CheckAcl(user1, "ops/command", clientID, 2), ShouldBeFalse)
+
+			//A prewarm check ending while the client's own check runs keeps its address registered.
+			So(common.SetClientAddress(clientID, "10.1.2.3"), ShouldBeTrue)
+			So(common.SetClientAddress(clientID, "10.1.2.3"), ShouldBeTrue)
+			common.ClearClientAddress(clientID)
+			So(files.CheckAcl(user1, "ops/command", clientID, 2), ShouldBeTrue)
+			common.ClearClientAddress(clientID)
+			So(files.CheckAcl(user1, "ops/command", clientID, 2), ShouldBeFalse)
+
+			So(common.SetClientAddress(clientID, "not an address"), ShouldBeFalse)
+		})
+
+		Convey("Without a psk file, no psk keys should be found", func() {
+			_, ok := files.GetPskKey("", "psk-device")
+			So(ok, ShouldBeFalse)
+		})
+
 		//Halt files
 		files.Halt()
 
 	})
 
+	Convey("Given a psk file, psk keys should be found by identity", t, func() {
+		pskPath, _ := filepath.Abs("../test-files/psk")
+		authOpts["psk_path"] = pskPath
+		files, err := NewFiles(authOpts, log.DebugLevel)
+		delete(authOpts, "psk_path")
+		So(err, ShouldBeNil)
+
+		key, ok := files.GetPskKey("", "psk-device")
+		So(ok, ShouldBeTrue)
+		So(key, ShouldEqual, "0123456789abcdef")
+
+		//Keys that aren't hex strings are ignored.
+		_, ok = files.GetPskKey("", "bad-device")
+		So(ok, ShouldBeFalse)
+
+		_, ok = files.GetPskKey("", "unknown")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given acl limits, an acl file giving a user rules over them should fail to load", t, func() {
+		defer common.SetAclLimits(common.AclLimits{})
+
+		common.SetAclLimits(common.AclLimits{MaxRules: 6, MaxWildcards: 1})
+		_, err := NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		common.SetAclLimits(common.AclLimits{MaxRules: 5})
+		_, err = NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "user test1 has 6 acl rules")
+
+		common.SetAclLimits(common.AclLimits{MaxRuleLength: 40})
+		_, err = NewFiles(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestFilesTimedAcls(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "timed_acls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//The window closes within a couple of seconds, as conditions are given with second precision.
+	until := time.Now().Add(2 * time.Second).Truncate(time.Second)
+	aclPath := filepath.Join(dir, "acls")
+	acls := fmt.Sprintf("user test1\ntopic read window/topic until=%s\ntopic read always/topic\ntopic read other/topic cidr=10.0.0.0/8\n", until.UTC().Format(time.RFC3339))
+	if err := ioutil.WriteFile(aclPath, []byte(acls), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	files, err := NewFiles(map[string]string{"password_path": pwPath, "acl_path": aclPath}, log.DebugLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Halt()
+
+	Convey("Given timed rules, their decisions should be hinted not to be cached, and others not hinted", t, func() {
+		granted, hint, err := HintedCheckAcl(files, "test1", "window/topic", "client", MOSQ_ACL_READ)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(hint, ShouldResemble, CacheHint{TTL: 0, Hinted: true})
+
+		granted, hint, err = HintedCheckAcl(files, "test1", "always/topic", "client", MOSQ_ACL_READ)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(hint, ShouldResemble, CacheHint{})
+
+		granted, hint, err = HintedCheckAcl(files, "test1", "other/topic", "client", MOSQ_ACL_READ)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeFalse)
+		So(hint, ShouldResemble, CacheHint{})
+	})
+
+	Convey("Given a check with the cache on across the window closing, the grant should not outlast it", t, func() {
+		//Decisions are cached as the plugin does, unless hinted not to.
+		cache := make(map[string]bool)
+		check := func() bool {
+			if granted, ok := cache["window/topic"]; ok {
+				return granted
+			}
+			granted, hint, err := HintedCheckAcl(files, "test1", "window/topic", "client", MOSQ_ACL_READ)
+			So(err, ShouldBeNil)
+			if !hint.Hinted || hint.TTL > 0 {
+				cache["window/topic"] = granted
+			}
+			return granted
+		}
+
+		So(check(), ShouldBeTrue)
+		time.Sleep(time.Until(until) + time.Second)
+		So(check(), ShouldBeFalse)
+		So(cache, ShouldBeEmpty)
+	})
+
 }
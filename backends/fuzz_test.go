@@ -0,0 +1,54 @@
+// +build go1.18
+
+package backends
+
+import (
+	h "net/http"
+	"testing"
+)
+
+//FuzzRemoteResponse runs remote responses through the same steps http and jwt backends do: transcoding, limits and decoding, with schemas and a mapping.
+//Run it with go test ./backends -run=^$ -fuzz=FuzzRemoteResponse, or make fuzz.
+func FuzzRemoteResponse(f *testing.F) {
+	f.Add([]byte(`{"ok": true, "error": ""}`), "application/json")
+	f.Add([]byte(`{"ok": false, "error": "denied"}`), "application/json")
+	f.Add([]byte(`{"decision": "allow", "reason": "owner"}`), "application/vnd.mosquitto-auth.v2+json")
+	f.Add([]byte(`{"result": {"allowed": [true]}, "message": null}`), "application/json")
+	f.Add([]byte(`[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[[]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]]`), "application/json")
+	f.Add([]byte("\x82\xa2ok\xc3\xa5error\xa0"), "application/msgpack")
+	f.Add([]byte("\x91\xc3"), "application/x-msgpack")
+	f.Add([]byte("\xdf\xff\xff\xff\xff"), "application/msgpack")
+
+	mapping, err := parseResponseMapping(map[string]string{
+		"http_response_ok_path":    "result.allowed[0]",
+		"http_response_error_path": "message",
+	}, "http")
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, body []byte, contentType string) {
+		header := h.Header{}
+		header.Set("Content-Type", contentType)
+
+		body, err := transcodeResponse(header, body)
+		if err != nil {
+			return
+		}
+
+		for _, version := range []int{SchemaV1, SchemaV2} {
+			if defaultResponseLimits.checkJSON(body, schemaFields(version)...) != nil {
+				continue
+			}
+			if granted, _, err := decodeResponse(body, version); granted && err != nil {
+				t.Errorf("v%d response %q granted with error %s", version, body, err)
+			}
+		}
+
+		if defaultResponseLimits.checkJSON(body, mapping.fields(SchemaV1)...) == nil {
+			if granted, _, err := mapping.decode(body, SchemaV1); granted && err != nil {
+				t.Errorf("mapped response %q granted with error %s", body, err)
+			}
+		}
+	})
+}
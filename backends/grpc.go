@@ -1,3 +1,5 @@
+// +build !nogrpc
+
 package backends
 
 import (
@@ -5,15 +7,18 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 
+	"github.com/golang/protobuf/ptypes/empty"
 	grpc_logrus "github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
-	"github.com/golang/protobuf/ptypes/empty"
 
+	"github.com/iegomez/mosquitto-go-auth/common"
 	gs "github.com/iegomez/mosquitto-go-auth/grpc"
 )
 
@@ -21,22 +26,46 @@ import (
 type GRPC struct {
 	client gs.AuthServiceClient
 	conn   *grpc.ClientConn
+	errs   *checkErrors
+}
+
+func init() {
+	register("grpc", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewGRPC(authOpts, logLevel)
+	})
 }
 
 // NewGRPC tries to connect to the gRPC service at the given host.
 func NewGRPC(authOpts map[string]string, logLevel log.Level) (GRPC, error) {
-	var g GRPC
+	g := GRPC{}
 
-	if authOpts["grpc_host"] == "" || authOpts["grpc_port"] == "" {
+	// A host given as a unix domain socket needs no port.
+	socket, isSocket := unixSocketPath(authOpts["grpc_host"])
+	if authOpts["grpc_host"] == "" || (authOpts["grpc_port"] == "" && !isSocket) {
 		return g, errors.New("grpc must have a host and port")
 	}
+	if isSocket && socket == "" {
+		return g, errors.Errorf("grpc host %s has no socket path", authOpts["grpc_host"])
+	}
 
 	caCert := []byte(authOpts["grpc_ca_cert"])
 	tlsCert := []byte(authOpts["grpc_tls_cert"])
 	tlsKey := []byte(authOpts["grpc_tls_key"])
 	addr := fmt.Sprintf("%s:%s", authOpts["grpc_host"], authOpts["grpc_port"])
+	if isSocket {
+		addr = strings.TrimSpace(authOpts["grpc_host"])
+	}
 
-	conn, gsClient, err := createClient(addr, caCert, tlsCert, tlsKey)
+	dialer, err := common.NewDialer(authOpts, "grpc")
+	if err != nil {
+		return g, errors.Wrap(err, "grpc dialer error")
+	}
+	if isSocket && dialer != nil {
+		log.Warnf("grpc local address and ip version don't apply to unix socket %s, ignoring them", socket)
+		dialer = nil
+	}
+
+	conn, gsClient, err := createClient(addr, socket, caCert, tlsCert, tlsKey, dialer)
 	if err != nil {
 		return g, err
 	}
@@ -59,6 +88,7 @@ func (o GRPC) GetUser(username, password string) bool {
 
 	if err != nil {
 		log.Errorf("grpc get user error: %s", err)
+		o.errs.set(ErrBackendUnavailable, err)
 		return false
 	}
 
@@ -77,6 +107,7 @@ func (o GRPC) GetSuperuser(username string) bool {
 
 	if err != nil {
 		log.Errorf("grpc get superuser error: %s", err)
+		o.errs.set(ErrBackendUnavailable, err)
 		return false
 	}
 
@@ -98,6 +129,7 @@ func (o GRPC) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 	if err != nil {
 		log.Errorf("grpc check acl error: %s", err)
+		o.errs.set(ErrBackendUnavailable, err)
 		return false
 	}
 
@@ -105,6 +137,27 @@ func (o GRPC) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o GRPC) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o GRPC) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o GRPC) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
 // GetName gets the gRPC backend's name.
 func (o GRPC) GetName() string {
 	resp, err := o.client.GetName(context.Background(), &empty.Empty{})
@@ -119,7 +172,8 @@ func (o GRPC) Halt() {
 	o.client.Halt(context.Background(), &empty.Empty{})
 }
 
-func createClient(hostname string, caCert, tlsCert, tlsKey []byte) (*grpc.ClientConn, gs.AuthServiceClient, error) {
+// createClient connects to the service at hostname, or at the unix domain socket at socket if not empty.
+func createClient(hostname, socket string, caCert, tlsCert, tlsKey []byte, dialer *common.Dialer) (*grpc.ClientConn, gs.AuthServiceClient, error) {
 	logrusEntry := log.NewEntry(log.StandardLogger())
 	logrusOpts := []grpc_logrus.Option{
 		grpc_logrus.WithLevels(grpc_logrus.DefaultCodeToLevel),
@@ -132,6 +186,17 @@ func createClient(hostname string, caCert, tlsCert, tlsKey []byte) (*grpc.Client
 		),
 	}
 
+	if socket != "" {
+		dialSocket := unixDialContext(socket, 0)
+		nsOpts = append(nsOpts, grpc.WithAuthority(unixSocketHost), grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialSocket(ctx, "unix", addr)
+		}))
+	} else if dialer != nil {
+		nsOpts = append(nsOpts, grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}))
+	}
+
 	if len(caCert) == 0 && len(tlsCert) == 0 && len(tlsKey) == 0 {
 		nsOpts = append(nsOpts, grpc.WithInsecure())
 		log.WithField("server", hostname).Warning("creating insecure grpc client")
@@ -1,8 +1,13 @@
+// +build !nogrpc
+
 package backends
 
 import (
 	"context"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/golang/protobuf/ptypes/empty"
@@ -130,3 +135,47 @@ func TestGRPC(t *testing.T) {
 	})
 
 }
+
+func TestGRPCUnixSocket(t *testing.T) {
+
+	Convey("given a mock grpc server listening at a unix socket", t, func(c C) {
+		dir, err := ioutil.TempDir("", "grpc")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		grpcServer := grpc.NewServer()
+		gs.RegisterAuthServiceServer(grpcServer, NewAuthServiceAPI())
+
+		socket := filepath.Join(dir, "auth.sock")
+		lis, err := net.Listen("unix", socket)
+		So(err, ShouldBeNil)
+
+		go grpcServer.Serve(lis)
+		defer grpcServer.Stop()
+
+		authOpts := make(map[string]string)
+		authOpts["grpc_host"] = "unix://" + socket
+
+		Convey("the backend should connect without a port and check users", func(c C) {
+			g, err := NewGRPC(authOpts, log.DebugLevel)
+			c.So(err, ShouldBeNil)
+			c.So(g.GetUser(grpcUsername, grpcPassword), ShouldBeTrue)
+			c.So(g.GetUser(grpcUsername, "wrong"), ShouldBeFalse)
+		})
+
+		Convey("a host without a socket path should fail", func(c C) {
+			authOpts["grpc_host"] = "unix://"
+			_, err := NewGRPC(authOpts, log.DebugLevel)
+			c.So(err, ShouldNotBeNil)
+		})
+	})
+
+}
+
+func TestGRPCCapabilities(t *testing.T) {
+
+	Convey("Given a grpc backend, which doesn't declare its capabilities, they should be taken from its interfaces", t, func() {
+		So(CapabilitiesOf(GRPC{}), ShouldResemble, Capabilities{User: true, Superuser: true, Acl: true})
+	})
+
+}
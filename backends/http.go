@@ -5,27 +5,64 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"net"
 	h "net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
 type HTTP struct {
 	UserUri      string
 	SuperuserUri string
 	AclUri       string
+	AclBatchUri  string
+	Methods      RemoteMethods
 	Host         string
 	Port         string
+	Socket       string //Socket is the path of the unix domain socket the service listens at, when the host is given as unix:///path.
 	WithTLS      bool
 	VerifyPeer   bool
+	TLSConfig    *tls.Config
 	ParamsMode   string
 	ResponseMode string
+	SuccessCodes SuccessCodes
+	Retry        RemoteRetry
+	Pool         RemotePool
+	Signer       *RemoteSigner
+	Credentials  *RemoteCredentials
+	Headers      h.Header
+	transport    *h.Transport
+
+	CacheHints    bool
+	CacheTTLField string
+	hint          *cacheHint
+
+	ManifestField string
+	manifests     *manifestStore
+
+	ClientMetadata bool
+	metadata       *common.ClientMetadata
+
+	Limits  ResponseLimits
+	Schemas ResponseSchemas
+	Mapping ResponseMapping
+
+	Dialer *common.Dialer
+
+	ExportUri string
+
+	Explain   bool
+	consulted []Consultation
+
+	errs *checkErrors
 }
 
 type HTTPResponse struct {
@@ -33,6 +70,12 @@ type HTTPResponse struct {
 	Error string `json:"error"`
 }
 
+func init() {
+	register("http", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewHTTP(authOpts, logLevel)
+	})
+}
+
 func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 
 	log.SetLevel(logLevel)
@@ -57,7 +100,7 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 	}
 
 	if paramsMode, ok := authOpts["http_params_mode"]; ok {
-		if paramsMode == "form" {
+		if paramsMode == "form" || paramsMode == "msgpack" || paramsMode == "protobuf" {
 			http.ParamsMode = paramsMode
 		}
 	}
@@ -83,16 +126,28 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 		missingOpts += " http_aclcheck_uri"
 	}
 
+	if aclBatchUri, ok := authOpts["http_aclbatch_uri"]; ok {
+		http.AclBatchUri = aclBatchUri
+	}
+
 	if host, ok := authOpts["http_host"]; ok {
 		http.Host = host
+		if socket, isSocket := unixSocketPath(host); isSocket {
+			if socket == "" {
+				return http, errors.Errorf("HTTP backend error: http_host %s has no socket path\n", host)
+			}
+			http.Socket = socket
+			http.Host = unixSocketHost
+		}
 	} else {
 		httpOk = false
 		missingOpts += " http_host"
 	}
 
-	if port, ok := authOpts["http_port"]; ok {
+	//A unix domain socket needs no port.
+	if port, ok := authOpts["http_port"]; ok && http.Socket == "" {
 		http.Port = port
-	} else {
+	} else if !ok && http.Socket == "" {
 		httpOk = false
 		missingOpts += " http_port"
 	}
@@ -101,8 +156,114 @@ func NewHTTP(authOpts map[string]string, logLevel log.Level) (HTTP, error) {
 		http.WithTLS = true
 	}
 
-	if verifyPeer, ok := authOpts["http_verify_peer"]; ok && verifyPeer == "true" {
-		http.VerifyPeer = true
+	http.VerifyPeer = parseVerifyPeer(authOpts, "http", http.WithTLS)
+
+	tlsConfig, err := parseRemoteTLS(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.TLSConfig = tlsConfig
+
+	if cacheHints, ok := authOpts["http_cache_hints"]; ok && cacheHints == "true" {
+		http.CacheHints = true
+	}
+
+	if ttlField, ok := authOpts["http_cache_ttl_field"]; ok {
+		http.CacheTTLField = ttlField
+	}
+
+	methods, err := parseRemoteMethods(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Methods = methods
+
+	successCodes, err := parseSuccessCodes(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.SuccessCodes = successCodes
+
+	retry, err := parseRemoteRetry(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Retry = retry
+
+	http.Limits = parseResponseLimits(authOpts, "http")
+
+	schemas, err := parseResponseSchemas(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Schemas = schemas
+
+	mapping, err := parseResponseMapping(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Mapping = mapping
+
+	if explain, ok := authOpts["http_explain"]; ok && explain == "true" {
+		http.Explain = true
+	}
+
+	if clientMetadata, ok := authOpts["http_client_metadata"]; ok && clientMetadata == "true" {
+		http.ClientMetadata = true
+	}
+
+	if exportUri, ok := authOpts["http_export_uri"]; ok {
+		http.ExportUri = exportUri
+	}
+
+	dialer, err := common.NewDialer(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Dialer = dialer
+
+	if http.Socket != "" && http.Dialer != nil {
+		log.Warnf("http local address and ip version don't apply to unix socket %s, ignoring them", http.Socket)
+		http.Dialer = nil
+	}
+
+	pool, err := parseRemotePool(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Pool = pool
+	http.transport = pool.transport(http.TLSConfig, http.VerifyPeer, http.Dialer)
+	if http.Socket != "" {
+		http.transport.DialContext = unixDialContext(http.Socket, pool.ConnectTimeout)
+		http.transport.Proxy = nil
+	}
+
+	signer, err := parseRemoteSigner(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Signer = signer
+
+	credentials, err := parseRemoteCredentials(authOpts, "http")
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Credentials = credentials
+
+	headers, err := parseRemoteHeaders(authOpts, "http", credentials)
+	if err != nil {
+		return http, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+	http.Headers = headers
+
+	//Manifests are read from a json response field, so they need json response mode.
+	if manifestField, ok := authOpts["http_manifest_field"]; ok {
+		if http.ResponseMode == "json" {
+			http.ManifestField = manifestField
+			http.manifests = newManifestStore()
+		} else {
+			log.Warn("http_manifest_field needs json response mode, manifests disabled")
+		}
 	}
 
 	if !httpOk {
@@ -124,7 +285,7 @@ func (o HTTP) GetUser(username, password string) bool {
 		"password": []string{password},
 	}
 
-	return httpRequest(o.Host, o.UserUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	return o.httpRequest(o.UserUri, o.Methods.User, username, dataMap, urlValues)
 
 }
 
@@ -138,7 +299,7 @@ func (o HTTP) GetSuperuser(username string) bool {
 		"username": []string{username},
 	}
 
-	return httpRequest(o.Host, o.SuperuserUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	return o.httpRequest(o.SuperuserUri, o.Methods.Superuser, username, dataMap, urlValues)
 
 }
 
@@ -158,100 +319,232 @@ func (o HTTP) CheckAcl(username, topic, clientid string, acc int32) bool {
 		"acc":      []string{strconv.Itoa(int(acc))},
 	}
 
-	return httpRequest(o.Host, o.AclUri, username, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+	return o.httpRequest(o.AclUri, o.Methods.Acl, username, dataMap, urlValues)
 
 }
 
-func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap map[string]interface{}, port, paramsMode, responseMode string, urlValues map[string][]string) bool {
+//BatchesAcls tells if an acl batch uri is set.
+func (o HTTP) BatchesAcls() bool {
+	return o.AclBatchUri != ""
+}
 
-	tlsStr := "http://"
+//CheckAclBatch posts the queries as json to the acl batch uri, which must answer with the result of each one in the same order, e.g. {"results": [true, false]}.
+func (o HTTP) CheckAclBatch(username, clientid string, queries []AclQuery) ([]bool, error) {
 
-	if withTLS {
-		tlsStr = "https://"
+	dataJson, err := json.Marshal(AclBatch{Username: username, Clientid: clientid, Checks: queries})
+	if err != nil {
+		return nil, errors.Errorf("HTTP backend error: %s\n", err)
+	}
+
+	uri := o.fullUri(expandUriTemplate(o.AclBatchUri, username, clientid, ""))
+	req, err := h.NewRequest("POST", uri, bytes.NewReader(dataJson))
+	if err != nil {
+		return nil, errors.Errorf("HTTP backend error: %s\n", err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, uri)
-	if port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, port, uri)
+	resp, err := o.Retry.do(o.client(o.Retry.Timeout), req)
+	if err != nil {
+		return nil, errors.Errorf("HTTP backend error: %s\n", err)
 	}
+	defer resp.Body.Close()
 
-	client := &h.Client{Timeout: 5 * time.Second}
+	body, err := o.Limits.read(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("HTTP backend error: %s\n", err)
+	}
 
-	if !verifyPeer {
-		tr := &h.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client.Transport = tr
+	if !o.SuccessCodes.accepts(resp.StatusCode) {
+		return nil, errors.Errorf("HTTP backend error: wrong http status %d for acl batch\n", resp.StatusCode)
 	}
 
-	var resp *h.Response
-	var err error
+	var batchResp AclBatchResponse
+	if err := json.Unmarshal(body, &batchResp); err != nil {
+		return nil, errors.Errorf("HTTP backend error: couldn't decode acl batch response: %s\n", err)
+	}
+
+	if len(batchResp.Results) != len(queries) {
+		return nil, errors.Errorf("HTTP backend error: got %d acl batch results for %d checks\n", len(batchResp.Results), len(queries))
+	}
+
+	return batchResp.Results, nil
+
+}
 
-	if paramsMode == "form" {
-		resp, err = client.PostForm(fullUri, urlValues)
+func (o HTTP) httpRequest(uri, method, username string, dataMap map[string]interface{}, urlValues map[string][]string) bool {
+
+	//Results of the backends consulted before this one in an acl check are sent along, if told.
+	if o.Explain && o.consulted != nil {
+		dataMap["consulted"] = consultationParams(o.consulted)
+		urlValues["consulted"] = []string{consultationValue(o.consulted)}
+	}
+
+	//So is what mosquitto tells about the client being checked.
+	if o.ClientMetadata {
+		addClientMetadata(o.metadata, dataMap, urlValues)
+	}
+
+	params := url.Values(urlValues)
+	fullUri := o.fullUri(expandUriTemplate(uri, params.Get("username"), params.Get("clientid"), params.Get("topic")))
+	client := o.client(o.Retry.Timeout)
+
+	var req *h.Request
+	var reqErr error
+
+	if method == "GET" {
+		req, reqErr = h.NewRequest(method, withQuery(fullUri, params), nil)
+
+		if reqErr != nil {
+			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
+			return false
+		}
+	} else if o.ParamsMode == "form" {
+		req, reqErr = h.NewRequest(method, fullUri, strings.NewReader(url.Values(urlValues).Encode()))
+
+		if reqErr != nil {
+			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
+			return false
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else if contentType, ok := binaryContentTypes[o.ParamsMode]; ok {
+		payload, mErr := marshalParams(o.ParamsMode, dataMap)
+
+		if mErr != nil {
+			log.Errorf("marshal error: %v\n", mErr)
+			o.errs.set(ErrMisconfigured, mErr)
+			return false
+		}
+
+		req, reqErr = h.NewRequest(method, fullUri, bytes.NewReader(payload))
+
+		if reqErr != nil {
+			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
+			return false
+		}
+
+		req.Header.Set("Content-Type", contentType)
 	} else {
 		dataJson, mErr := json.Marshal(dataMap)
 
 		if mErr != nil {
 			log.Errorf("marshal error: %v\n", mErr)
+			o.errs.set(ErrMisconfigured, mErr)
 			return false
 		}
 
 		contentReader := bytes.NewReader(dataJson)
-		req, reqErr := h.NewRequest("POST", fullUri, contentReader)
+		req, reqErr = h.NewRequest(method, fullUri, contentReader)
 
 		if reqErr != nil {
 			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
 			return false
 		}
 
 		req.Header.Set("Content-Type", "application/json")
+	}
 
-		resp, err = client.Do(req)
+	if o.ResponseMode == "json" {
+		o.Schemas.setHeaders(req.Header)
+		//Prefer responses in the same encoding as params.
+		if contentType, ok := binaryContentTypes[o.ParamsMode]; ok {
+			req.Header.Set("Accept", contentType+", "+req.Header.Get("Accept"))
+		}
 	}
 
+	resp, err := o.Retry.do(client, req)
+
 	if err != nil {
-		log.Errorf("POST error: %v\n", err)
+		log.Errorf("%s error: %v\n", method, err)
+		o.errs.set(ErrBackendUnavailable, err)
 		return false
 	}
 
-	body, bErr := ioutil.ReadAll(resp.Body)
+	body, bErr := o.Limits.read(resp.Body)
 	defer resp.Body.Close()
 
 	if bErr != nil {
 		log.Errorf("read error: %v\n", bErr)
+		o.errs.set(ErrBackendUnavailable, bErr)
 		return false
 	}
 
-	if resp.StatusCode != 200 {
-		log.Infof("Wrong http status: %v\n", resp.StatusCode)
+	version := SchemaV1
+	if o.ResponseMode == "json" {
+		var tErr error
+		body, tErr = transcodeResponse(resp.Header, body)
+		if tErr != nil {
+			log.Errorf("response error: %v\n", tErr)
+			o.errs.set(ErrBackendUnavailable, tErr)
+			return false
+		}
+
+		var vErr error
+		version, vErr = o.Schemas.version(resp.Header)
+		if vErr != nil {
+			log.Errorf("response error: %v\n", vErr)
+			o.errs.set(ErrBackendUnavailable, vErr)
+			return false
+		}
+
+		if lErr := o.Limits.checkJSON(body, append(o.Mapping.fields(version), o.CacheTTLField, o.ManifestField)...); lErr != nil {
+			log.Errorf("response error: %v\n", lErr)
+			o.errs.set(ErrBackendUnavailable, lErr)
+			return false
+		}
+	}
+
+	if o.CacheHints {
+		if ttl, ok := parseCacheHint(resp.Header, body, o.ResponseMode, o.CacheTTLField); ok {
+			o.hint.set(ttl)
+		}
+	}
+
+	//Server errors mean the service failed, so they are never taken as denials.
+	if !o.SuccessCodes.accepts(resp.StatusCode) {
+		if resp.StatusCode >= 500 {
+			log.Errorf("http server error status: %v\n", resp.StatusCode)
+		} else {
+			log.Infof("Wrong http status: %v\n", resp.StatusCode)
+		}
+		o.errs.setStatus(resp.StatusCode, uri == o.UserUri)
 		return false
 	}
 
-	if responseMode == "text" {
+	if o.ResponseMode == "text" {
 
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
 			log.Infof("api error: %s\n", string(body))
+			o.errs.setDenied(uri == o.UserUri)
 			return false
 		}
 
-	} else if responseMode == "json" {
+	} else if o.ResponseMode == "json" {
 
-		//For json response, we expect Ok and Error fields.
-		response := HTTPResponse{Ok: false, Error: ""}
-		jErr := json.Unmarshal(body, &response)
+		//For json response, we expect the mapped fields or those of the response's schema version.
+		ok, message, jErr := o.Mapping.decode(body, version)
 
 		if jErr != nil {
 			log.Errorf("unmarshal error: %v\n", jErr)
+			o.errs.set(ErrBackendUnavailable, jErr)
 			return false
 		}
 
-		if !response.Ok {
-			log.Infof("api error: %s\n", response.Error)
+		if !ok {
+			log.Infof("api error: %s\n", message)
+			o.errs.setDenied(uri == o.UserUri)
 			return false
 		}
 
+		if uri == o.UserUri && o.ManifestField != "" {
+			o.setManifest(username, body)
+		}
+
 	}
 
 	log.Debugf("http request approved for %s\n", username)
@@ -259,12 +552,211 @@ func httpRequest(host, uri, username string, withTLS, verifyPeer bool, dataMap m
 
 }
 
+//setManifest keeps the manifest found at the user response's manifest field, if any.
+func (o HTTP) setManifest(username string, body []byte) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return
+	}
+
+	value, ok := fields[o.ManifestField]
+	if !ok {
+		return
+	}
+
+	acls, err := parseManifest(value)
+	if err != nil {
+		log.Errorf("manifest error for %s: %s\n", username, err)
+		return
+	}
+
+	o.manifests.set(username, acls)
+}
+
+//Manifest returns the manifest given by the response to the last user check for username, if any.
+func (o HTTP) Manifest(username string) ([]ManifestAcl, bool) {
+	if o.ManifestField == "" {
+		return nil, false
+	}
+	return o.manifests.take(username)
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o HTTP) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o HTTP) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o HTTP) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedUserCheck checks the user as UserCheck does, returning the cache hint of the response.
+func (o HTTP) HintedUserCheck(username, password string) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.UserCheck(username, password)
+	return granted, o.hint.get(), err
+}
+
+//HintedSuperuserCheck checks the superuser as SuperuserCheck does, returning the cache hint of the response.
+func (o HTTP) HintedSuperuserCheck(username string) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.SuperuserCheck(username)
+	return granted, o.hint.get(), err
+}
+
+//HintedAclCheck checks the acl as AclCheck does, returning the cache hint of the response.
+func (o HTTP) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend sending the client's metadata along with its requests, if told.
+func (o HTTP) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//ExplainedSuperuserCheck checks the superuser as HintedSuperuserCheck does, sending consulted along with the request if explanations are enabled.
+func (o HTTP) ExplainedSuperuserCheck(consulted []Consultation, username string) (bool, CacheHint, error) {
+	o.consulted = consulted
+	return o.HintedSuperuserCheck(username)
+}
+
+//ExplainedAclCheck checks the acl as HintedAclCheck does, sending consulted along with the request if explanations are enabled.
+func (o HTTP) ExplainedAclCheck(consulted []Consultation, username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.consulted = consulted
+	return o.HintedAclCheck(username, topic, clientid, acc)
+}
+
+//fullUri returns the full uri for a path at the backend's host.
+func (o HTTP) fullUri(uri string) string {
+	tlsStr := "http://"
+
+	if o.WithTLS {
+		tlsStr = "https://"
+	}
+
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, o.Host, uri)
+	if o.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, o.Host, o.Port, uri)
+	}
+
+	return fullUri
+}
+
+//client returns an http client with the given timeout, sharing the backend's transport so connections are pooled across requests.
+//Requests carry static headers and credentials, and are signed when told.
+func (o HTTP) client(timeout time.Duration) *h.Client {
+	client := &h.Client{Timeout: timeout}
+
+	if o.transport != nil {
+		client.Transport = o.transport
+	} else if tr := remoteTransport(o.TLSConfig, o.VerifyPeer, o.Dialer); tr != nil {
+		client.Transport = tr
+	}
+
+	client.Transport = remoteHeadersTransport(o.Headers, client.Transport)
+
+	if o.Credentials != nil {
+		client.Transport = o.Credentials.transport(client.Transport)
+	}
+
+	if o.Signer != nil {
+		client.Transport = o.Signer.transport(client.Transport)
+	}
+
+	return client
+}
+
+//Export gets every user and their acls from the export uri, which must answer a GET with a json snapshot.
+//Snapshots aren't subject to response limits, as they're expected to be big.
+func (o HTTP) Export() (Snapshot, error) {
+
+	var snapshot Snapshot
+
+	if o.ExportUri == "" {
+		return snapshot, errors.New("HTTP export error: no export uri")
+	}
+
+	resp, err := o.client(time.Minute).Get(o.fullUri(o.ExportUri))
+	if err != nil {
+		return snapshot, errors.Errorf("HTTP export error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return snapshot, errors.Errorf("HTTP export error: wrong http status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&snapshot); err != nil {
+		return snapshot, errors.Errorf("HTTP export error: couldn't decode snapshot: %s", err)
+	}
+
+	return snapshot, nil
+
+}
+
+//Healthy checks the backend's host, or unix socket, accepts connections.
+func (o HTTP) Healthy() bool {
+	if o.Socket != "" {
+		conn, err := net.DialTimeout("unix", o.Socket, 2*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	port := o.Port
+	if port == "" {
+		port = "80"
+		if o.WithTLS {
+			port = "443"
+		}
+	}
+
+	addr := net.JoinHostPort(o.Host, port)
+
+	var conn net.Conn
+	var err error
+	if o.Dialer != nil {
+		conn, err = o.Dialer.DialTimeout("tcp", addr, 2*time.Second)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, 2*time.Second)
+	}
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+//Capabilities tells acls are batched when an acl batch uri is given, and manifests taken when a manifest field is.
+func (o HTTP) Capabilities() Capabilities {
+	return Capabilities{User: true, Superuser: true, Acl: true, Batch: o.BatchesAcls(), Manifest: o.ManifestField != ""}
+}
+
 //GetName returns the backend's name
 func (o HTTP) GetName() string {
 	return "HTTP"
 }
 
-//Halt does nothing for http as there's no cleanup needed.
+//Halt closes the pooled idle connections.
 func (o HTTP) Halt() {
-	//Do nothing
+	if o.transport != nil {
+		o.transport.CloseIdleConnections()
+	}
 }
@@ -0,0 +1,50 @@
+package backends
+
+import (
+	"encoding/json"
+	"mime"
+	h "net/http"
+
+	"github.com/pkg/errors"
+)
+
+//Content types of the binary encodings the http backend may send params in and decode responses from.
+const (
+	msgpackContentType  = "application/msgpack"
+	protobufContentType = "application/x-protobuf"
+)
+
+var binaryContentTypes = map[string]string{
+	"msgpack":  msgpackContentType,
+	"protobuf": protobufContentType,
+}
+
+//marshalParams encodes check params with a binary params mode.
+func marshalParams(paramsMode string, dataMap map[string]interface{}) ([]byte, error) {
+	if paramsMode == "protobuf" {
+		return marshalProtobuf(dataMap)
+	}
+	return marshalMsgpack(dataMap)
+}
+
+//transcodeResponse decodes a MessagePack or protobuf response, as told by its content type, into its json equivalent, so it's checked as any json response.
+//Other responses are returned as they are.
+func transcodeResponse(header h.Header, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	switch mediaType {
+	case msgpackContentType, "application/x-msgpack":
+		value, err := unmarshalMsgpack(body)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := value.(map[string]interface{}); !ok {
+			return nil, errors.New("msgpack response is not a map")
+		}
+		return json.Marshal(value)
+	case protobufContentType, "application/protobuf":
+		return unmarshalProtobuf(body)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,47 @@
+// +build !nogrpc
+
+package backends
+
+import (
+	"encoding/json"
+
+	"github.com/golang/protobuf/proto"
+
+	gs "github.com/iegomez/mosquitto-go-auth/grpc"
+)
+
+//marshalProtobuf encodes check params as the gRPC backend's request messages: CheckAclRequest for acl checks, GetUserRequest for user checks and GetSuperuserRequest for superuser ones.
+func marshalProtobuf(dataMap map[string]interface{}) ([]byte, error) {
+	username, _ := dataMap["username"].(string)
+
+	if acc, ok := dataMap["acc"].(int32); ok {
+		topic, _ := dataMap["topic"].(string)
+		clientid, _ := dataMap["clientid"].(string)
+		return proto.Marshal(&gs.CheckAclRequest{
+			Username: username,
+			Topic:    topic,
+			Clientid: clientid,
+			Acc:      acc,
+		})
+	}
+
+	if password, ok := dataMap["password"].(string); ok {
+		return proto.Marshal(&gs.GetUserRequest{
+			Username: username,
+			Password: password,
+		})
+	}
+
+	return proto.Marshal(&gs.GetSuperuserRequest{
+		Username: username,
+	})
+}
+
+//unmarshalProtobuf decodes an AuthResponse into a version 1 json response.
+func unmarshalProtobuf(body []byte) ([]byte, error) {
+	var response gs.AuthResponse
+	if err := proto.Unmarshal(body, &response); err != nil {
+		return nil, err
+	}
+	return json.Marshal(HTTPResponse{Ok: response.Ok})
+}
@@ -0,0 +1,15 @@
+// +build nogrpc
+
+package backends
+
+import "github.com/pkg/errors"
+
+//Protobuf messages are those of the gRPC backend, so they're left out along with it.
+
+func marshalProtobuf(dataMap map[string]interface{}) ([]byte, error) {
+	return nil, errors.New("protobuf params are not compiled in this build")
+}
+
+func unmarshalProtobuf(body []byte) ([]byte, error) {
+	return nil, errors.New("protobuf responses are not compiled in this build")
+}
@@ -0,0 +1,68 @@
+// +build !nogrpc
+
+package backends
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+
+	gs "github.com/iegomez/mosquitto-go-auth/grpc"
+)
+
+func TestHTTPProtobuf(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		var granted bool
+		switch r.URL.Path {
+		case "/user":
+			var req gs.GetUserRequest
+			granted = proto.Unmarshal(body, &req) == nil && req.Username == "user" && req.Password == "pass"
+		case "/superuser":
+			var req gs.GetSuperuserRequest
+			granted = proto.Unmarshal(body, &req) == nil && req.Username == "user"
+		case "/acl":
+			var req gs.CheckAclRequest
+			granted = proto.Unmarshal(body, &req) == nil && req.Username == "user" && req.Topic == "test/topic" && req.Acc == MOSQ_ACL_READ
+		}
+
+		response, _ := proto.Marshal(&gs.AuthResponse{Ok: granted})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "protobuf"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given protobuf params mode, params and responses should be encoded as gRPC backend messages", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetUser("user", "wrong"), ShouldBeFalse)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+	})
+
+}
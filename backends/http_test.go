@@ -1,14 +1,33 @@
 package backends
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/iegomez/mosquitto-go-auth/common"
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -808,3 +827,1408 @@ func TestHTTPFormTextResponseServer(t *testing.T) {
 	})
 
 }
+
+func TestHTTPCacheHints(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/user":
+			w.Header().Set("Cache-Control", "private, max-age=120")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok": true, "error": ""}`))
+		case "/superuser":
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok": false, "error": "not a superuser"}`))
+		case "/acl":
+			w.Header().Set("Cache-Control", "max-age=120")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ok": true, "error": "", "ttl": 5}`))
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given cache hints are disabled, no ttl should be returned", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		granted, hint, err := hb.HintedUserCheck("user", "pass")
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(hint.Hinted, ShouldBeFalse)
+	})
+
+	authOpts["http_cache_hints"] = "true"
+	authOpts["http_cache_ttl_field"] = "ttl"
+
+	Convey("Given cache hints are enabled", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("A Cache-Control max-age should be returned as ttl, only for the check it was given to", func() {
+			granted, hint, err := hb.HintedUserCheck("user", "pass")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(hint, ShouldResemble, CacheHint{TTL: 120 * time.Second, Hinted: true})
+
+			granted, err = hb.UserCheck("user", "pass")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+
+			_, hint, err = HintedCheckUser(hb, "user", "pass")
+			So(err, ShouldBeNil)
+			So(hint.TTL, ShouldEqual, 120*time.Second)
+		})
+
+		Convey("A no-store directive should be returned as a zero ttl", func() {
+			granted, hint, _ := hb.HintedSuperuserCheck("user")
+			So(granted, ShouldBeFalse)
+			So(hint, ShouldResemble, CacheHint{TTL: 0, Hinted: true})
+		})
+
+		Convey("The json ttl field should take precedence over Cache-Control", func() {
+			granted, hint, err := hb.HintedAclCheck("user", "test/topic", "client", MOSQ_ACL_READ)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(hint, ShouldResemble, CacheHint{TTL: 5 * time.Second, Hinted: true})
+		})
+
+		Convey("Checking access should return the shortest hint of the superuser and acl responses", func() {
+			granted, hint, err := HintedCheckAccess(hb, "user", "test/topic", "client", MOSQ_ACL_READ)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(hint, ShouldResemble, CacheHint{TTL: 0, Hinted: true})
+		})
+
+		hb.Halt()
+	})
+
+}
+
+func TestHTTPManifest(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"ok": true, "error": "", "acls": [{"topic": "devices/%u/#", "acc": 3}, {"topic": "broadcast/+", "acc": 1}]}`))
+		default:
+			w.Write([]byte(`{"ok": false, "error": "unexpected request"}`))
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given no manifest field, no manifest should be returned", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		_, ok := hb.Manifest("user")
+		So(ok, ShouldBeFalse)
+	})
+
+	authOpts["http_manifest_field"] = "acls"
+
+	Convey("Given a manifest field, the user check should return a manifest", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		manifest, ok := hb.Manifest("user")
+		So(ok, ShouldBeTrue)
+		So(len(manifest), ShouldEqual, 2)
+
+		Convey("The manifest should only be returned once", func() {
+			_, ok := hb.Manifest("user")
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("The manifest should grant its topics with the right access", func() {
+			So(ManifestAllows(manifest, "user", "devices/user/status", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(ManifestAllows(manifest, "user", "devices/other/status", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(ManifestAllows(manifest, "user", "broadcast/news", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+			So(ManifestAllows(manifest, "user", "broadcast/news", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+	})
+
+}
+
+func TestHTTPResponseLimits(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		switch r.URL.Path {
+		case "/user":
+			w.Write([]byte(`{"ok": true, "error": ""}`))
+		case "/superuser":
+			w.Write([]byte(`{"ok": true, "error": "", "extra": "` + strings.Repeat("a", 2048) + `"}`))
+		case "/acl":
+			w.Write([]byte(`{"ok": true, "error": "", "nested": ` + strings.Repeat("[", 40) + strings.Repeat("]", 40) + `}`))
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given default limits, no response should fail", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given a maximum json depth, responses nested too deep should fail", t, func() {
+		authOpts["http_max_json_depth"] = "32"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_max_json_depth")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+	})
+
+	Convey("Given a maximum response size, bigger responses should fail", t, func() {
+		authOpts["http_max_response_size"] = "1024"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_max_response_size")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeFalse)
+	})
+
+	Convey("Given strict json, responses with unknown fields should fail", t, func() {
+		authOpts["http_strict_json"] = "true"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_strict_json")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeFalse)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+	})
+
+}
+
+func TestHTTPResponseSchemas(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var params map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		json.Unmarshal(body, &params)
+
+		granted := params["username"] == "user"
+
+		//Superuser checks are answered by a legacy service that ignores versioning.
+		if r.URL.Path == "/superuser" || !strings.HasPrefix(r.Header.Get(SchemaHeader), "2") {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(HTTPResponse{Ok: granted})
+			return
+		}
+
+		decision := "deny"
+		if granted {
+			decision = "allow"
+		}
+		w.Header().Set("Content-Type", "application/vnd.mosquitto-auth.v2+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"decision": "` + decision + `", "reason": "checked"}`))
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given no schema versions, version 1 responses should be checked", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetUser("other", "pass"), ShouldBeFalse)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+	})
+
+	Convey("Given versions 2 and 1, responses of both versions should be checked", t, func() {
+		authOpts["http_schema_versions"] = "2, 1"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_schema_versions")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetUser("other", "pass"), ShouldBeFalse)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+	})
+
+	Convey("Given only version 2, version 1 responses should fail", t, func() {
+		authOpts["http_schema_versions"] = "2"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_schema_versions")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeFalse)
+	})
+
+	Convey("Given an unknown schema version, the backend should fail", t, func() {
+		authOpts["http_schema_versions"] = "3"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_schema_versions")
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPMsgpack(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		value, err := unmarshalMsgpack(body)
+		params, ok := value.(map[string]interface{})
+		granted := err == nil && ok && r.Header.Get("Content-Type") == "application/msgpack" && params["username"] == "user"
+
+		if r.URL.Path == "/acl" {
+			granted = granted && params["acc"] == int64(MOSQ_ACL_READ)
+		}
+
+		response, _ := marshalMsgpack(map[string]interface{}{"ok": granted, "error": ""})
+		w.Header().Set("Content-Type", "application/msgpack")
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "msgpack"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given msgpack params mode, params and responses should be encoded with msgpack", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetUser("other", "pass"), ShouldBeFalse)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+	})
+
+}
+
+func TestHTTPMethodsAndTemplates(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var granted bool
+		switch r.URL.EscapedPath() {
+		case "/users/user":
+			granted = r.Method == http.MethodGet && r.URL.Query().Get("password") == "pass"
+		case "/superusers":
+			granted = r.Method == http.MethodPut && r.URL.Query().Get("name") == "user"
+		case "/acl/user/test%2Ftopic":
+			granted = r.Method == http.MethodGet && r.URL.Query().Get("client") == "client" && r.URL.Query().Get("acc") == "1"
+		}
+
+		if granted {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/users/%u"
+	authOpts["http_getuser_method"] = "get"
+	authOpts["http_superuser_uri"] = "/superusers?name=%u"
+	authOpts["http_superuser_method"] = "PUT"
+	authOpts["http_aclcheck_uri"] = "/acl/%u/%t?client=%c"
+	authOpts["http_aclcheck_method"] = "GET"
+
+	Convey("Given methods and uri templates, checks should be requested with them", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetUser("user", "wrong"), ShouldBeFalse)
+		So(hb.GetUser("other", "pass"), ShouldBeFalse)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+		So(hb.GetSuperuser("other"), ShouldBeFalse)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/other", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		So(hb.CheckAcl("user", "test/topic", "other", MOSQ_ACL_READ), ShouldBeFalse)
+	})
+
+	Convey("Given an unknown method, the backend should fail", t, func() {
+		authOpts["http_aclcheck_method"] = "DELETE"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPExplain(t *testing.T) {
+
+	var received []interface{}
+	var hasConsulted bool
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var params map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+
+		if r.Header.Get("Content-Type") == "application/x-www-form-urlencoded" {
+			values, _ := url.ParseQuery(string(body))
+			_, hasConsulted = values["consulted"]
+			json.Unmarshal([]byte(values.Get("consulted")), &received)
+		} else {
+			json.Unmarshal(body, &params)
+			_, hasConsulted = params["consulted"]
+			received, _ = params["consulted"].([]interface{})
+		}
+
+		w.WriteHeader(http.StatusOK)
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_explain"] = "true"
+
+	consulted := []Consultation{
+		{Backend: "files", Check: "superuser", Granted: false},
+		{Backend: "postgres", Check: "acl", Granted: false, Error: "unavailable"},
+	}
+	expected := []interface{}{
+		map[string]interface{}{"backend": "files", "check": "superuser", "granted": false},
+		map[string]interface{}{"backend": "postgres", "check": "acl", "granted": false, "error": "unavailable"},
+	}
+
+	for _, mode := range []string{"json", "form"} {
+		authOpts["http_params_mode"] = mode
+
+		Convey("Given consulted backends in "+mode+" params mode, they should be sent along with the explained request only", t, func() {
+			hb, err := NewHTTP(authOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			granted, _, err := hb.ExplainedAclCheck(consulted, "user", "test/topic", "client", MOSQ_ACL_READ)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(hasConsulted, ShouldBeTrue)
+			So(received, ShouldResemble, expected)
+
+			So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(hasConsulted, ShouldBeFalse)
+
+			granted, _, err = hb.ExplainedSuperuserCheck([]Consultation{}, "user")
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(hasConsulted, ShouldBeTrue)
+			So(received, ShouldBeEmpty)
+
+			granted, _, err = ExplainedCheckAcl(hb, nil, "user", "test/topic", "client", MOSQ_ACL_READ)
+			So(err, ShouldBeNil)
+			So(granted, ShouldBeTrue)
+			So(hasConsulted, ShouldBeFalse)
+		})
+	}
+
+	Convey("Given concurrent explained checks, each request should carry its own consulted backends", t, func() {
+		authOpts["http_params_mode"] = "json"
+		var mu sync.Mutex
+		seen := make(map[string]string)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var params map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&params)
+			consulted, _ := params["consulted"].([]interface{})
+			backend := ""
+			if len(consulted) == 1 {
+				backend, _ = consulted[0].(map[string]interface{})["backend"].(string)
+			}
+			mu.Lock()
+			seen[params["topic"].(string)] = backend
+			mu.Unlock()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer server.Close()
+
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["http_host"] = strings.Replace(server.URL, "http://", "", -1)
+		hb, err := NewHTTP(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				backend := fmt.Sprintf("backend%d", i)
+				hb.ExplainedAclCheck([]Consultation{{Backend: backend, Check: "acl"}}, "user", backend, "client", MOSQ_ACL_READ)
+			}(i)
+		}
+		wg.Wait()
+
+		So(seen, ShouldHaveLength, 20)
+		for topic, backend := range seen {
+			So(backend, ShouldEqual, topic)
+		}
+	})
+
+	Convey("Given explanations aren't enabled, consulted backends shouldn't be sent", t, func() {
+		authOpts["http_params_mode"] = "json"
+		delete(authOpts, "http_explain")
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		granted, _, err := hb.ExplainedAclCheck(consulted, "user", "test/topic", "client", MOSQ_ACL_READ)
+		So(err, ShouldBeNil)
+		So(granted, ShouldBeTrue)
+		So(hasConsulted, ShouldBeFalse)
+	})
+
+}
+
+func TestHTTPResponseMapping(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		var params map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		defer r.Body.Close()
+		json.Unmarshal(body, &params)
+
+		granted := params["username"] == "user"
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/superuser" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"results": []interface{}{map[string]interface{}{"decision": "deny"}}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"allowed": granted, "reason": "checked"}})
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "json"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_response_ok_path"] = "data.allowed"
+	authOpts["http_response_error_path"] = "data.reason"
+
+	Convey("Given response paths, checks should be granted by the mapped fields", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		granted, err := hb.UserCheck("other", "pass")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+
+		//The superuser response lacks the mapped field.
+		granted, err = hb.SuperuserCheck("user")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+	})
+
+	Convey("Given strict limits, the mapped top level fields should be allowed", t, func() {
+		authOpts["http_strict_json"] = "true"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_strict_json")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+	})
+
+	Convey("Given an ok value, responses should be granted when the mapped field equals it", t, func() {
+		authOpts["http_response_ok_path"] = "$.results[0].decision"
+		authOpts["http_response_ok_value"] = "deny"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		authOpts["http_response_ok_path"] = "data.allowed"
+		delete(authOpts, "http_response_ok_value")
+		So(err, ShouldBeNil)
+
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+	})
+
+	Convey("Given bad paths, the backend should fail", t, func() {
+		authOpts["http_response_ok_path"] = "data.allowed[x]"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		delete(authOpts, "http_response_ok_path")
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPSuccessCodes(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		switch r.URL.Path {
+		case "/user":
+			w.WriteHeader(http.StatusCreated)
+		case "/acl":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given no success codes, only 200 should grant checks", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		granted, err := hb.UserCheck("user", "pass")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeFalse)
+	})
+
+	Convey("Given success codes, any of them should grant checks while server errors fail the backend", t, func() {
+		authOpts["http_success_codes"] = "200, 201, 204"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		granted, err := hb.SuperuserCheck("user")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+	})
+
+	Convey("Given server error or unparsable success codes, the backend should fail", t, func() {
+		authOpts["http_success_codes"] = "200, 503"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		authOpts["http_success_codes"] = "ok"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPTLS(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	//Create a ca and a client certificate signed by it.
+	caKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDer, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	caCert, _ := x509.ParseCertificate(caDer)
+
+	clientKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mosquitto"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDer, _ := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	caFile := filepath.Join(dir, "server_ca.crt")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDer}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)}), 0600)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(caCert)
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 && r.TLS.PeerCertificates[0].Subject.CommonName == "mosquitto" {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	mockServer.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	mockServer.StartTLS()
+	defer mockServer.Close()
+
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mockServer.Certificate().Raw}), 0600)
+
+	authOpts := make(map[string]string)
+	authOpts["http_params_mode"] = "json"
+	authOpts["http_response_mode"] = "status"
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "https://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_with_tls"] = "true"
+	authOpts["http_verify_peer"] = "true"
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_ca_file"] = caFile
+
+	Convey("Given no client certificate, the service should refuse the backend", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeFalse)
+	})
+
+	Convey("Given a client certificate, the backend should authenticate itself with it and verify the service with the ca", t, func() {
+		authOpts["http_cert_file"] = certFile
+		authOpts["http_key_file"] = keyFile
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given a server name, the service's certificate should be verified for it", t, func() {
+		authOpts["http_server_name"] = "example.com"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+
+		authOpts["http_server_name"] = "auth.internal"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_server_name")
+		So(err, ShouldBeNil)
+		So(hb.GetUser("user", "pass"), ShouldBeFalse)
+	})
+
+	Convey("Given insecure skip verify, the service's certificate shouldn't be verified even when verifying peers", t, func() {
+		delete(authOpts, "http_ca_file")
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("user", "pass"), ShouldBeFalse)
+
+		authOpts["http_insecure_skip_verify"] = "true"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_insecure_skip_verify")
+		So(err, ShouldBeNil)
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+	})
+
+	Convey("Given a certificate without its key or a missing file, the backend should fail", t, func() {
+		delete(authOpts, "http_key_file")
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		authOpts["http_key_file"] = filepath.Join(dir, "missing.key")
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPAclBatch(t *testing.T) {
+
+	var batch AclBatch
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path != "/acls/device-1" || r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		batch = AclBatch{}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if batch.Username == "broken" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var resp AclBatchResponse
+		for _, check := range batch.Checks {
+			resp.Results = append(resp.Results, strings.HasPrefix(check.Topic, "devices/"))
+		}
+		if batch.Username == "short" {
+			resp.Results = resp.Results[1:]
+		}
+		json.NewEncoder(w).Encode(resp)
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	queries := []AclQuery{
+		{Topic: "devices/device-1/config", Acc: MOSQ_ACL_READ},
+		{Topic: "broadcast/firmware", Acc: MOSQ_ACL_READ},
+	}
+
+	Convey("Given no acl batch uri, the backend shouldn't batch acls", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.BatchesAcls(), ShouldBeFalse)
+	})
+
+	Convey("Given an acl batch uri, every check should be sent in a single request", t, func() {
+		authOpts["http_aclbatch_uri"] = "/acls/%c"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.BatchesAcls(), ShouldBeTrue)
+
+		results, err := hb.CheckAclBatch("user", "device-1", queries)
+		So(err, ShouldBeNil)
+		So(results, ShouldResemble, []bool{true, false})
+		So(batch.Username, ShouldEqual, "user")
+		So(batch.Clientid, ShouldEqual, "device-1")
+		So(batch.Checks, ShouldResemble, queries)
+	})
+
+	Convey("Given failed or mismatched responses, the batch should fail", t, func() {
+		authOpts["http_aclbatch_uri"] = "/acls/%c"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		_, err = hb.CheckAclBatch("broken", "device-1", queries)
+		So(err, ShouldNotBeNil)
+
+		_, err = hb.CheckAclBatch("short", "device-1", queries)
+		So(err, ShouldNotBeNil)
+
+		_, err = hb.CheckAclBatch("user", "device-2", queries)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPRetry(t *testing.T) {
+
+	var failures, requests int
+	var mu sync.Mutex
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		mu.Lock()
+		requests++
+		fail := requests <= failures
+		mu.Unlock()
+
+		var params map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params["username"] != "user" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case r.URL.Path == "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case fail:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	reset := func(n int) {
+		mu.Lock()
+		failures, requests = n, 0
+		mu.Unlock()
+	}
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/slow"
+
+	Convey("Given no retries, a transient failure should fail the check", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		reset(1)
+		granted, err := hb.UserCheck("user", "pass")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+		So(requests, ShouldEqual, 1)
+	})
+
+	Convey("Given retries, transient failures should be retried with the same params", t, func() {
+		authOpts["http_retries"] = "2"
+		authOpts["http_retry_backoff"] = "1ms"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		reset(2)
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(requests, ShouldEqual, 3)
+
+		reset(3)
+		So(hb.GetUser("user", "pass"), ShouldBeFalse)
+		So(requests, ShouldEqual, 3)
+	})
+
+	Convey("Given a timeout, slow requests should fail", t, func() {
+		authOpts["http_retries"] = "0"
+		authOpts["http_timeout"] = "50ms"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		reset(0)
+		granted, err := hb.AclCheck("user", "test/topic", "client", MOSQ_ACL_READ)
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+	})
+
+	Convey("Given bad retry options, the backend should fail", t, func() {
+		authOpts["http_retries"] = "-1"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		authOpts["http_retries"] = "1"
+		authOpts["http_timeout"] = "soon"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPConnectionPool(t *testing.T) {
+
+	var conns int64
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	mockServer.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	mockServer.Start()
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given keep alive connections, requests should reuse them", t, func() {
+		atomic.StoreInt64(&conns, 0)
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer hb.Halt()
+
+		for i := 0; i < 5; i++ {
+			So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		}
+		So(atomic.LoadInt64(&conns), ShouldEqual, 1)
+	})
+
+	Convey("Given keep alive disabled, every request should connect", t, func() {
+		atomic.StoreInt64(&conns, 0)
+		authOpts["http_keepalive"] = "false"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 5; i++ {
+			So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		}
+		So(atomic.LoadInt64(&conns), ShouldEqual, 5)
+	})
+
+	Convey("Given bad pool options, the backend should fail", t, func() {
+		authOpts["http_connect_timeout"] = "soon"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		authOpts["http_connect_timeout"] = "1s"
+		authOpts["http_max_idle_conns_per_host"] = "-1"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPSigning(t *testing.T) {
+
+	secret := "shared_secret"
+
+	var lock sync.Mutex
+	var nonces []string
+	failFirst := false
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		timestamp := r.Header.Get(SignatureTimestampHeader)
+		nonce := r.Header.Get(SignatureNonceHeader)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "\n" + nonce + "\n" + r.Method + "\n" + r.URL.RequestURI() + "\n"))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+		sent, _ := strconv.ParseInt(timestamp, 10, 64)
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(expected)) || time.Since(time.Unix(sent, 0)) > time.Minute {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, seen := range nonces {
+			if seen == nonce {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		nonces = append(nonces, nonce)
+
+		if failFirst && len(nonces) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+	authOpts["http_superuser_method"] = "GET"
+	authOpts["http_signing_secret"] = secret
+
+	Convey("Given a signing secret, requests with and without a body should be signed", t, func() {
+		nonces = nil
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer hb.Halt()
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(len(nonces), ShouldEqual, 3)
+	})
+
+	Convey("Given retries, each attempt should be signed with a new nonce", t, func() {
+		nonces = nil
+		failFirst = true
+		authOpts["http_retries"] = "1"
+		authOpts["http_retry_backoff"] = "1ms"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_retries")
+		delete(authOpts, "http_retry_backoff")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(len(nonces), ShouldEqual, 2)
+		failFirst = false
+	})
+
+	Convey("Given a different secret, requests should be rejected", t, func() {
+		authOpts["http_signing_secret"] = "other_secret"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		authOpts["http_signing_secret"] = secret
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeFalse)
+	})
+
+	Convey("Given bad signing options, the backend should fail", t, func() {
+		authOpts["http_signing_algorithm"] = "md5"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_signing_algorithm")
+
+		authOpts["http_signing_secret"] = ""
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		authOpts["http_signing_secret"] = secret
+	})
+
+}
+
+func TestHTTPCredentials(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if (ok && username == "gateway" && password == "gateway_pw") || r.Header.Get("X-Api-Key") == "api_key" || r.Header.Get("Authorization") == "Bearer api_token" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	defer mockServer.Close()
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("gateway_pw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given no credentials, requests should be rejected by the gateway", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("user", "pass"), ShouldBeFalse)
+	})
+
+	Convey("Given basic auth with a password file, requests should carry it", t, func() {
+		authOpts["http_basic_auth_username"] = "gateway"
+		authOpts["http_basic_auth_password_file"] = passwordFile
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_basic_auth_username")
+		delete(authOpts, "http_basic_auth_password_file")
+		So(err, ShouldBeNil)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given an auth header, requests should carry it at the given header", t, func() {
+		authOpts["http_auth_header"] = "Bearer api_token"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+
+		authOpts["http_auth_header"] = "api_key"
+		authOpts["http_auth_header_name"] = "x-api-key"
+		hb, err = NewHTTP(authOpts, log.DebugLevel)
+		delete(authOpts, "http_auth_header")
+		delete(authOpts, "http_auth_header_name")
+		So(err, ShouldBeNil)
+		So(hb.Credentials.Header, ShouldEqual, "X-Api-Key")
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+	})
+
+	Convey("Given conflicting or missing credentials, the backend should fail", t, func() {
+		authOpts["http_auth_header"] = "Bearer api_token"
+		authOpts["http_basic_auth_username"] = "gateway"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_basic_auth_username")
+
+		authOpts["http_auth_header_file"] = passwordFile
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_auth_header")
+
+		authOpts["http_auth_header_file"] = filepath.Join(dir, "missing")
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_auth_header_file")
+
+		authOpts["http_basic_auth_password"] = "gateway_pw"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_basic_auth_password")
+	})
+
+}
+
+func TestHTTPHeaders(t *testing.T) {
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant-Id") == "tenant" && r.Header.Get("Traceparent") == "00-trace" && r.Header.Get("Content-Type") == "application/json" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given static headers, requests should carry them along with the plugin's own", t, func() {
+		authOpts["http_header_X-Tenant-ID"] = "tenant"
+		authOpts["http_header_traceparent"] = "00-trace"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Headers.Get("X-Tenant-Id"), ShouldEqual, "tenant")
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeTrue)
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given reserved or repeated headers, the backend should fail", t, func() {
+		authOpts["http_header_Content-Type"] = "text/plain"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_header_Content-Type")
+
+		authOpts["http_header_x-tenant-id"] = "other"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_header_x-tenant-id")
+
+		authOpts["http_header_Authorization"] = "Bearer token"
+		authOpts["http_auth_header"] = "Bearer api_token"
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "http_auth_header")
+
+		_, err = NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+	})
+
+}
+
+func TestHTTPUnixSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "auth.sock")
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mockServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/user" && r.Host == "localhost" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	mockServer.Listener = lis
+	mockServer.Start()
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = "unix://" + socket
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	Convey("Given a host given as a unix socket, requests should be made through it without a port", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(hb.Socket, ShouldEqual, socket)
+
+		So(hb.GetUser("user", "pass"), ShouldBeTrue)
+		So(hb.GetSuperuser("user"), ShouldBeFalse)
+		So(hb.Healthy(), ShouldBeTrue)
+	})
+
+	Convey("Given a host without a socket path, the backend should fail", t, func() {
+		authOpts["http_host"] = "unix://"
+		_, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestHTTPClientMetadata(t *testing.T) {
+
+	var got map[string]interface{}
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = make(map[string]interface{})
+		if r.Header.Get("Content-Type") == "application/json" {
+			json.NewDecoder(r.Body).Decode(&got)
+		} else {
+			r.ParseForm()
+			for k := range r.PostForm {
+				got[k] = r.PostForm.Get(k)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["http_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["http_port"] = ""
+	authOpts["http_getuser_uri"] = "/user"
+	authOpts["http_superuser_uri"] = "/superuser"
+	authOpts["http_aclcheck_uri"] = "/acl"
+
+	clean := true
+	metadata := &common.ClientMetadata{Address: "10.0.0.1", CleanSession: &clean, ProtocolVersion: 5, CertSubject: "/CN=device-1"}
+
+	Convey("Given client metadata isn't told, it shouldn't be sent", t, func() {
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(ForClient(hb, metadata).GetUser("user", "pass"), ShouldBeTrue)
+		So(got, ShouldNotContainKey, "address")
+	})
+
+	Convey("Given client metadata is told, it should be sent along in json by the copy checking the client only", t, func() {
+		authOpts["http_client_metadata"] = "true"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(ForClient(hb, metadata).CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(got["address"], ShouldEqual, "10.0.0.1")
+		So(got["clean_session"], ShouldEqual, true)
+		So(got["protocol_version"], ShouldEqual, 5)
+		So(got["cert_subject"], ShouldEqual, "/CN=device-1")
+		So(got["topic"], ShouldEqual, "test/topic")
+
+		So(hb.CheckAcl("user", "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(got, ShouldNotContainKey, "address")
+
+		So(ForClient(hb, nil).GetUser("user", "pass"), ShouldBeTrue)
+		So(got, ShouldNotContainKey, "address")
+	})
+
+	Convey("Given form params, known metadata should be sent as form values", t, func() {
+		authOpts["http_params_mode"] = "form"
+		hb, err := NewHTTP(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(ForClient(hb, &common.ClientMetadata{Address: "10.0.0.2"}).GetUser("user", "pass"), ShouldBeTrue)
+		So(got["address"], ShouldEqual, "10.0.0.2")
+		So(got, ShouldNotContainKey, "clean_session")
+		So(got, ShouldNotContainKey, "protocol_version")
+	})
+
+}
@@ -0,0 +1,7 @@
+// +build integration
+
+package backends
+
+func init() {
+	integrationAll = true
+}
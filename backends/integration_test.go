@@ -0,0 +1,42 @@
+package backends
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//integrationAll is set when building tests with the integration tag, so every integration test runs.
+var integrationAll = false
+
+//integration tells if tests against the given service (postgres, mysql, mssql, oracle, redis or mongo) run: every one does with the integration build tag,
+//else only those listed at the GO_AUTH_TEST_SERVICES environment variable, e.g. GO_AUTH_TEST_SERVICES=postgres,redis.
+//The services are expected as provisioned by docker/test/docker-compose.yml.
+func integration(service string) bool {
+	if integrationAll {
+		return true
+	}
+	for _, s := range strings.Split(os.Getenv("GO_AUTH_TEST_SERVICES"), ",") {
+		if s = strings.TrimSpace(s); s == service || s == "all" {
+			return true
+		}
+	}
+	return false
+}
+
+//requireIntegration skips the test unless tests against service run.
+func requireIntegration(t testing.TB, service string) {
+	if !integration(service) {
+		t.Skipf("skipping %s integration test, set GO_AUTH_TEST_SERVICES=%s or build with the integration tag to run it", service, service)
+	}
+}
+
+//integrationConvey returns Convey if tests against service run, else SkipConvey, for tests that only need it in some of their cases.
+func integrationConvey(service string) func(items ...interface{}) {
+	if integration(service) {
+		return Convey
+	}
+	return SkipConvey
+}
@@ -0,0 +1,535 @@
+package backends
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	h "net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//Introspection authenticates clients giving an opaque OAuth2 access token as their password, asking the authorization server's
+//introspection endpoint (RFC 7662) whether it's active. Superuser and acl checks are answered from the scopes of the token
+//the user last authenticated with, introspected again once its cached result expires, so revoked tokens lose access.
+type Introspection struct {
+	URL            string
+	ClientID       string
+	ClientSecret   string
+	AuthMethod     string //AuthMethod is how the plugin authenticates to the endpoint: basic (client_secret_basic) or post (client_secret_post).
+	Timeout        time.Duration
+	UsernameField  string //UsernameField is the response field that must match the username, none if empty.
+	Audience       string
+	SuperuserScope string
+	ScopeAcls      map[string][]ManifestAcl
+	TLSConfig      *tls.Config
+	VerifyPeer     bool
+	Dialer         *common.Dialer
+	Limits         ResponseLimits
+	cache          *introspectionCache
+	tokens         *introspectionTokens
+	errs           *checkErrors
+}
+
+//IntrospectionResult holds the fields of an introspection response the backend uses.
+type IntrospectionResult struct {
+	Active bool
+	Scopes map[string]bool
+	Fields map[string]interface{}
+}
+
+//introspectionFields are the response fields defined by RFC 7662, allowed by strict response limits.
+var introspectionFields = []string{"active", "scope", "client_id", "username", "token_type", "exp", "iat", "nbf", "sub", "aud", "iss", "jti"}
+
+func init() {
+	register("introspection", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewIntrospection(authOpts, logLevel)
+	})
+}
+
+//NewIntrospection initializes an OAuth2 token introspection backend.
+func NewIntrospection(authOpts map[string]string, logLevel log.Level) (Introspection, error) {
+
+	log.SetLevel(logLevel)
+
+	var o = Introspection{
+		AuthMethod:    "basic",
+		Timeout:       5 * time.Second,
+		UsernameField: "username",
+		ScopeAcls:     make(map[string][]ManifestAcl),
+		tokens:        &introspectionTokens{tokens: make(map[string]string)},
+	}
+
+	if introspectionURL, ok := authOpts["introspection_url"]; ok && strings.TrimSpace(introspectionURL) != "" {
+		o.URL = strings.TrimSpace(introspectionURL)
+	} else {
+		return o, errors.New("Introspection backend error: missing option introspection_url.\n")
+	}
+
+	u, err := url.Parse(o.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return o, errors.Errorf("Introspection backend error: bad introspection_url %s.\n", o.URL)
+	}
+
+	o.ClientID = strings.TrimSpace(authOpts["introspection_client_id"])
+	o.ClientSecret, err = optionOrFile(authOpts, "introspection_client_secret")
+	if err != nil {
+		return o, errors.Errorf("Introspection backend error: %s\n", err)
+	}
+	if o.ClientID == "" || o.ClientSecret == "" {
+		return o, errors.New("Introspection backend error: introspection_client_id and introspection_client_secret must be given.\n")
+	}
+
+	if authMethod, ok := authOpts["introspection_auth_method"]; ok {
+		switch strings.TrimSpace(authMethod) {
+		case "basic", "post":
+			o.AuthMethod = strings.TrimSpace(authMethod)
+		default:
+			return o, errors.Errorf("Introspection backend error: unknown introspection_auth_method %s.\n", authMethod)
+		}
+	}
+
+	if timeout, ok := authOpts["introspection_timeout"]; ok {
+		d, err := time.ParseDuration(strings.Replace(timeout, " ", "", -1))
+		if err != nil || d <= 0 {
+			return o, errors.Errorf("Introspection backend error: couldn't parse introspection_timeout %s.\n", timeout)
+		}
+		o.Timeout = d
+	}
+
+	ttl := time.Minute
+	if cacheTTL, ok := authOpts["introspection_cache_ttl"]; ok {
+		d, err := time.ParseDuration(strings.Replace(cacheTTL, " ", "", -1))
+		if err != nil || d < 0 {
+			return o, errors.Errorf("Introspection backend error: couldn't parse introspection_cache_ttl %s.\n", cacheTTL)
+		}
+		ttl = d
+	}
+
+	size := 10000
+	if cacheSize, ok := authOpts["introspection_cache_size"]; ok {
+		n, err := strconv.Atoi(strings.Replace(cacheSize, " ", "", -1))
+		if err != nil || n <= 0 {
+			return o, errors.Errorf("Introspection backend error: couldn't parse introspection_cache_size %s.\n", cacheSize)
+		}
+		size = n
+	}
+
+	if ttl > 0 {
+		o.cache = &introspectionCache{size: size, ttl: ttl, entries: make(map[[sha256.Size]byte]introspectionCacheEntry)}
+	}
+
+	if usernameField, ok := authOpts["introspection_username_field"]; ok {
+		o.UsernameField = strings.TrimSpace(usernameField)
+	}
+
+	o.Audience = strings.TrimSpace(authOpts["introspection_audience"])
+	o.SuperuserScope = strings.TrimSpace(authOpts["introspection_superuser_scope"])
+
+	if scopeAcls, ok := authOpts["introspection_scope_acls"]; ok {
+		o.ScopeAcls, err = parseScopeAcls(scopeAcls)
+		if err != nil {
+			return o, errors.Errorf("Introspection backend error: wrong introspection_scope_acls format: %s\n", err)
+		}
+	}
+
+	o.TLSConfig, err = parseRemoteTLS(authOpts, "introspection")
+	if err != nil {
+		return o, errors.Errorf("Introspection backend error: %s\n", err)
+	}
+	o.VerifyPeer = parseVerifyPeer(authOpts, "introspection", u.Scheme == "https")
+
+	o.Dialer, err = common.NewDialer(authOpts, "introspection")
+	if err != nil {
+		return o, errors.Errorf("Introspection backend error: %s\n", err)
+	}
+
+	o.Limits = parseResponseLimits(authOpts, "introspection")
+
+	return o, nil
+}
+
+//parseScopeAcls parses comma separated scope:acc:topic triples, where acc is read, write, readwrite or subscribe, e.g. telemetry:write:devices/%u/#.
+//Acls granted by groups or roles are given the same way, with their name in place of the scope.
+func parseScopeAcls(s string) (map[string][]ManifestAcl, error) {
+	scopeAcls := make(map[string][]ManifestAcl)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, errors.Errorf("expected scope:acc:topic, got %s", item)
+		}
+
+		var acc int32
+		switch parts[1] {
+		case "read":
+			acc = MOSQ_ACL_READ
+		case "write":
+			acc = MOSQ_ACL_WRITE
+		case "readwrite":
+			acc = MOSQ_ACL_READWRITE
+		case "subscribe":
+			acc = MOSQ_ACL_SUBSCRIBE
+		default:
+			return nil, errors.Errorf("unknown acc %s for %s", parts[1], parts[0])
+		}
+
+		if err := common.ValidateAclTopic(parts[2]); err != nil {
+			return nil, err
+		}
+
+		scopeAcls[parts[0]] = append(scopeAcls[parts[0]], ManifestAcl{Topic: parts[2], Acc: acc})
+	}
+	return scopeAcls, nil
+}
+
+//GetUser checks the password is an active token issued for the username, remembering it for the user's superuser and acl checks.
+func (o Introspection) GetUser(username, password string) bool {
+	if password == "" {
+		o.errs.set(ErrBadCredentials, nil)
+		return false
+	}
+
+	result, err := o.lookup(password)
+	if err != nil {
+		log.Errorf("Introspection backend error: %s\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
+		return false
+	}
+
+	if !o.valid(username, result) {
+		return false
+	}
+
+	if o.UsernameField != "" {
+		if tokenUsername, _ := result.Fields[o.UsernameField].(string); tokenUsername != username {
+			log.Debugf("Introspection backend error: token was issued for %q, not %s\n", tokenUsername, username)
+			o.errs.set(ErrBadCredentials, errors.Errorf("token was not issued for %s", username))
+			return false
+		}
+	}
+
+	o.tokens.set(username, password)
+	return true
+}
+
+//GetSuperuser checks that the user's token is still active and has the superuser scope.
+func (o Introspection) GetSuperuser(username string) bool {
+	if o.SuperuserScope == "" {
+		return false
+	}
+
+	result, ok := o.userToken(username)
+	return ok && result.Scopes[o.SuperuserScope]
+}
+
+//CheckAcl checks that the user's token is still active and one of its scopes grants acc on topic.
+func (o Introspection) CheckAcl(username, topic, clientid string, acc int32) bool {
+	result, ok := o.userToken(username)
+	if !ok {
+		return false
+	}
+
+	for scope := range result.Scopes {
+		if acls, ok := o.ScopeAcls[scope]; ok && ManifestAllows(acls, username, topic, clientid, acc) {
+			return true
+		}
+	}
+	return false
+}
+
+//userToken introspects the token the user last authenticated with, forgetting it if it's no longer valid.
+func (o Introspection) userToken(username string) (*IntrospectionResult, bool) {
+	token, ok := o.tokens.get(username)
+	if !ok {
+		log.Debugf("Introspection backend error: no token known for %s\n", username)
+		o.errs.set(ErrNotFound, nil)
+		return nil, false
+	}
+
+	result, err := o.lookup(token)
+	if err != nil {
+		log.Errorf("Introspection backend error: %s\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
+		return nil, false
+	}
+
+	if !o.valid(username, result) {
+		o.tokens.remove(username, token)
+		return nil, false
+	}
+	return result, true
+}
+
+//lookup returns the cached result for a token, introspecting it if missing.
+func (o Introspection) lookup(token string) (*IntrospectionResult, error) {
+	if result, ok := o.cache.get(token); ok {
+		return result, nil
+	}
+
+	result, err := o.introspect(token)
+	if err != nil {
+		return nil, err
+	}
+	o.cache.set(token, result, introspectionExpiry(result))
+	return result, nil
+}
+
+//valid tells if a token is active, not expired and meant for the backend's audience.
+func (o Introspection) valid(username string, result *IntrospectionResult) bool {
+	if !result.Active {
+		log.Debugf("Introspection backend error: token of %s is not active\n", username)
+		o.errs.set(ErrBadCredentials, errors.New("token is not active"))
+		return false
+	}
+
+	if exp := introspectionExpiry(result); !exp.IsZero() && !time.Now().Before(exp) {
+		log.Debugf("Introspection backend error: token of %s expired\n", username)
+		o.errs.set(ErrBadCredentials, errors.New("token expired"))
+		return false
+	}
+
+	if o.Audience != "" && !containsAudience(result.Fields["aud"], o.Audience) {
+		log.Debugf("Introspection backend error: token of %s is not meant for audience %s\n", username, o.Audience)
+		o.errs.set(ErrBadCredentials, errors.Errorf("token is not meant for audience %s", o.Audience))
+		return false
+	}
+
+	return true
+}
+
+//introspect asks the endpoint about a token. Responses other than 200 are errors, as the endpoint answers inactive tokens with a 200 too.
+func (o Introspection) introspect(token string) (*IntrospectionResult, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	if o.AuthMethod == "post" {
+		form.Set("client_id", o.ClientID)
+		form.Set("client_secret", o.ClientSecret)
+	}
+
+	req, err := h.NewRequest("POST", o.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Errorf("couldn't create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.AuthMethod == "basic" {
+		req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+	}
+
+	client := &h.Client{Timeout: o.Timeout}
+	if tr := remoteTransport(o.TLSConfig, o.VerifyPeer, o.Dialer); tr != nil {
+		client.Transport = tr
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := o.Limits.read(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read response: %s", err)
+	}
+
+	if resp.StatusCode != h.StatusOK {
+		return nil, errors.Errorf("endpoint answered with status %d", resp.StatusCode)
+	}
+
+	if err := o.Limits.checkJSON(body, append(introspectionFields, o.UsernameField)...); err != nil {
+		return nil, errors.Errorf("bad response: %s", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, errors.Errorf("couldn't decode response: %s", err)
+	}
+
+	result := &IntrospectionResult{Scopes: make(map[string]bool), Fields: fields}
+	result.Active, _ = fields["active"].(bool)
+	if scope, ok := fields["scope"].(string); ok {
+		for _, s := range strings.Fields(scope) {
+			result.Scopes[s] = true
+		}
+	}
+
+	return result, nil
+}
+
+//introspectionExpiry returns the token's expiration given by the exp field, or zero if there's none.
+func introspectionExpiry(result *IntrospectionResult) time.Time {
+	if exp, ok := result.Fields["exp"].(float64); ok && exp > 0 {
+		return time.Unix(int64(exp), 0)
+	}
+	return time.Time{}
+}
+
+//containsAudience checks an aud field or claim, a string or a list of them, holds the audience.
+func containsAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Introspection) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Introspection) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Introspection) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//Capabilities tells superusers are only checked when a superuser scope is given.
+func (o Introspection) Capabilities() Capabilities {
+	return Capabilities{User: true, Superuser: o.SuperuserScope != "", Acl: true}
+}
+
+//GetName returns the backend's name
+func (o Introspection) GetName() string {
+	return "OAuth2 Introspection"
+}
+
+//Halt forgets every known token.
+func (o Introspection) Halt() {
+	o.tokens.clear()
+}
+
+//introspectionTokens keeps the token each user last authenticated with.
+type introspectionTokens struct {
+	sync.Mutex
+	tokens map[string]string
+}
+
+func (t *introspectionTokens) set(username, token string) {
+	t.Lock()
+	defer t.Unlock()
+	t.tokens[username] = token
+}
+
+func (t *introspectionTokens) get(username string) (string, bool) {
+	t.Lock()
+	defer t.Unlock()
+	token, ok := t.tokens[username]
+	return token, ok
+}
+
+//remove forgets the user's token, unless it authenticated with another one meanwhile.
+func (t *introspectionTokens) remove(username, token string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.tokens[username] == token {
+		delete(t.tokens, username)
+	}
+}
+
+func (t *introspectionTokens) clear() {
+	t.Lock()
+	defer t.Unlock()
+	t.tokens = make(map[string]string)
+}
+
+//introspectionCache keeps introspection results by a digest of the token, for at most ttl and never past the token's expiration,
+//so checks don't call the endpoint every time. Inactive results are cached too. At most size of them are kept.
+type introspectionCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]introspectionCacheEntry
+}
+
+type introspectionCacheEntry struct {
+	result *IntrospectionResult
+	expiry time.Time
+}
+
+//get returns the cached result for token, if any and not expired.
+func (c *introspectionCache) get(token string) (*IntrospectionResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expiry) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.result, true
+}
+
+//set caches the result for token until ttl passes or expiry, if not zero, whichever comes first.
+//When full, expired entries are dropped, and if none were, an arbitrary one is.
+func (c *introspectionCache) set(token string, result *IntrospectionResult, expiry time.Time) {
+	if c == nil {
+		return
+	}
+
+	now := time.Now()
+	if limit := now.Add(c.ttl); expiry.IsZero() || limit.Before(expiry) {
+		expiry = limit
+	}
+	if !now.Before(expiry) {
+		return
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiry) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			for k := range c.entries {
+				delete(c.entries, k)
+				break
+			}
+		}
+	}
+
+	c.entries[key] = introspectionCacheEntry{result: result, expiry: expiry}
+}
@@ -0,0 +1,166 @@
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIntrospection(t *testing.T) {
+
+	var calls int32
+	responses := map[string]map[string]interface{}{
+		"active_token": {
+			"active":   true,
+			"username": "device@acme",
+			"scope":    "telemetry admin",
+			"aud":      []string{"broker"},
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		},
+		"reader_token": {
+			"active":   true,
+			"username": "reader",
+			"scope":    "telemetry",
+			"aud":      "other",
+		},
+		"expired_token": {
+			"active":   true,
+			"username": "device@acme",
+			"exp":      time.Now().Add(-time.Minute).Unix(),
+		},
+		"revoked_token": {
+			"active": false,
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		//Client credentials are form encoded before being given as basic auth.
+		clientID, secret, ok := r.BasicAuth()
+		secret, _ = url.QueryUnescape(secret)
+		if !ok || clientID != "broker" || secret != "broker secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		r.ParseForm()
+		if r.Form.Get("token") == "failing_token" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		response, ok := responses[r.Form.Get("token")]
+		if !ok {
+			response = map[string]interface{}{"active": false}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	authOpts := map[string]string{
+		"introspection_url":             server.URL,
+		"introspection_client_id":       "broker",
+		"introspection_client_secret":   "broker secret",
+		"introspection_superuser_scope": "admin",
+		"introspection_scope_acls":      "telemetry:write:devices/%u/#, telemetry:read:{{username | split \"@\" 1}}/status",
+	}
+
+	Convey("Given wrong options, the backend should fail to start", t, func() {
+		for option, value := range map[string]string{
+			"introspection_url":         "ftp://auth",
+			"introspection_auth_method": "jwt",
+			"introspection_cache_ttl":   "soon",
+			"introspection_scope_acls":  "telemetry:publish:devices/#",
+		} {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts[option] = value
+			_, err := NewIntrospection(opts, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+
+		_, err := NewIntrospection(map[string]string{"introspection_url": server.URL}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given an introspection endpoint, tokens should be checked against it", t, func() {
+		o, err := NewIntrospection(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(o.Capabilities().Superuser, ShouldBeTrue)
+
+		So(o.GetUser("device@acme", "active_token"), ShouldBeTrue)
+		granted, err := o.UserCheck("device@acme", "revoked_token")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+		So(o.GetUser("device@acme", "expired_token"), ShouldBeFalse)
+		So(o.GetUser("someone", "active_token"), ShouldBeFalse)
+		So(o.GetUser("device@acme", ""), ShouldBeFalse)
+
+		granted, err = o.UserCheck("device@acme", "failing_token")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+
+		Convey("Superuser and acl checks should be given by the token's scopes", func() {
+			So(o.GetSuperuser("device@acme"), ShouldBeTrue)
+			So(o.CheckAcl("device@acme", "devices/device@acme/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl("device@acme", "devices/other/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl("device@acme", "acme/status", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("device@acme", "acme/status", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+
+			So(o.GetUser("reader", "reader_token"), ShouldBeTrue)
+			So(o.GetSuperuser("reader"), ShouldBeFalse)
+
+			granted, err := o.AclCheck("unknown", "devices/unknown/temp", "client", MOSQ_ACL_WRITE)
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		})
+
+		Convey("Results should be cached", func() {
+			atomic.StoreInt32(&calls, 0)
+			So(o.GetUser("device@acme", "active_token"), ShouldBeTrue)
+			So(o.GetSuperuser("device@acme"), ShouldBeTrue)
+			So(o.GetUser("device@acme", "revoked_token"), ShouldBeFalse)
+			So(atomic.LoadInt32(&calls), ShouldEqual, 0)
+		})
+
+		o.Halt()
+	})
+
+	Convey("Given an audience, tokens not meant for it should be rejected", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["introspection_audience"] = "broker"
+		opts["introspection_cache_ttl"] = "0s"
+
+		o, err := NewIntrospection(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(o.GetUser("device@acme", "active_token"), ShouldBeTrue)
+		So(o.GetUser("reader", "reader_token"), ShouldBeFalse)
+
+		Convey("Revoked tokens should lose access once their result isn't cached", func() {
+			responses["active_token"]["active"] = false
+			granted, err := o.SuperuserCheck("device@acme")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+
+			responses["active_token"]["active"] = true
+			granted, err = o.AclCheck("device@acme", "devices/device@acme/temp", "client", MOSQ_ACL_WRITE)
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		})
+	})
+}
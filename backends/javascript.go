@@ -0,0 +1,203 @@
+// +build !nojs
+
+package backends
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//Javascript checks users, superusers and acls by running user given scripts in an embedded JS runtime, so custom logic may be
+//added without recompiling the plugin. Each script is run with the check's params as globals, and its last expression's value,
+//which must be a boolean, is the check's result.
+type Javascript struct {
+	UserScript      *goja.Program
+	SuperuserScript *goja.Program
+	AclScript       *goja.Program
+	StackDepthLimit int
+	Timeout         time.Duration
+	errs            *checkErrors
+}
+
+func init() {
+	register("javascript", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewJavascript(authOpts, logLevel)
+	})
+}
+
+//NewJavascript initializes a javascript backend, compiling the given scripts.
+func NewJavascript(authOpts map[string]string, logLevel log.Level) (Javascript, error) {
+
+	log.SetLevel(logLevel)
+
+	var o = Javascript{
+		StackDepthLimit: 32,
+		Timeout:         200 * time.Millisecond,
+	}
+
+	var err error
+	for option, program := range map[string]**goja.Program{
+		"js_user_script_path":      &o.UserScript,
+		"js_superuser_script_path": &o.SuperuserScript,
+		"js_acl_script_path":       &o.AclScript,
+	} {
+		if path, ok := authOpts[option]; ok {
+			*program, err = compileScript(path)
+			if err != nil {
+				return o, errors.Errorf("Javascript backend error: %s\n", err)
+			}
+		}
+	}
+
+	if o.UserScript == nil && o.SuperuserScript == nil && o.AclScript == nil {
+		return o, errors.New("Javascript backend error: missing options, at least one of js_user_script_path, js_superuser_script_path or js_acl_script_path must be given.\n")
+	}
+
+	if limit, ok := authOpts["js_stack_depth_limit"]; ok {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return o, errors.Errorf("Javascript backend error: couldn't parse js_stack_depth_limit %s.\n", limit)
+		}
+		o.StackDepthLimit = n
+	}
+
+	if timeout, ok := authOpts["js_timeout"]; ok {
+		d, err := time.ParseDuration(strings.Replace(timeout, " ", "", -1))
+		if err != nil || d <= 0 {
+			return o, errors.Errorf("Javascript backend error: couldn't parse js_timeout %s.\n", timeout)
+		}
+		o.Timeout = d
+	}
+
+	return o, nil
+}
+
+//compileScript reads and compiles the script at path, so syntax errors fail at startup instead of failing every check.
+func compileScript(path string) (*goja.Program, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read script %s: %s", path, err)
+	}
+
+	program, err := goja.Compile(path, string(src), false)
+	if err != nil {
+		return nil, errors.Errorf("couldn't compile script %s: %s", path, err)
+	}
+
+	return program, nil
+}
+
+//GetUser runs the user script with username and password.
+func (o Javascript) GetUser(username, password string) bool {
+	if o.UserScript == nil {
+		return false
+	}
+
+	return o.run(o.UserScript, map[string]interface{}{
+		"username": username,
+		"password": password,
+	})
+}
+
+//GetSuperuser runs the superuser script with username.
+func (o Javascript) GetSuperuser(username string) bool {
+	if o.SuperuserScript == nil {
+		return false
+	}
+
+	return o.run(o.SuperuserScript, map[string]interface{}{
+		"username": username,
+	})
+}
+
+//CheckAcl runs the acl script with username, topic, clientid and acc.
+func (o Javascript) CheckAcl(username, topic, clientid string, acc int32) bool {
+	if o.AclScript == nil {
+		return false
+	}
+
+	return o.run(o.AclScript, map[string]interface{}{
+		"username": username,
+		"topic":    topic,
+		"clientid": clientid,
+		"acc":      acc,
+	})
+}
+
+//run runs program with params as globals. Every run gets its own runtime, so checks may run concurrently and scripts can't keep
+//state between them. Scripts running for longer than the timeout are interrupted and reported as the backend being unavailable,
+//while exceptions and results other than booleans are reported as it being misconfigured.
+func (o Javascript) run(program *goja.Program, params map[string]interface{}) bool {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(o.StackDepthLimit)
+	for name, value := range params {
+		vm.Set(name, value)
+	}
+
+	timer := time.AfterFunc(o.Timeout, func() {
+		vm.Interrupt("timeout")
+	})
+	defer timer.Stop()
+
+	value, err := vm.RunProgram(program)
+	if err != nil {
+		log.Errorf("Javascript backend error: script failed: %s\n", err)
+		if _, ok := err.(*goja.InterruptedError); ok {
+			o.errs.set(ErrBackendUnavailable, err)
+		} else {
+			o.errs.set(ErrMisconfigured, err)
+		}
+		return false
+	}
+
+	result, ok := value.Export().(bool)
+	if !ok {
+		err := errors.Errorf("script must result in a boolean, got %v", value)
+		log.Errorf("Javascript backend error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	return result
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Javascript) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Javascript) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Javascript) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//Capabilities tells checks are supported when their script is given.
+func (o Javascript) Capabilities() Capabilities {
+	return Capabilities{User: o.UserScript != nil, Superuser: o.SuperuserScript != nil, Acl: o.AclScript != nil}
+}
+
+//GetName returns the backend's name
+func (o Javascript) GetName() string {
+	return "Javascript"
+}
+
+//Halt does nothing, as runtimes aren't kept between checks.
+func (o Javascript) Halt() {}
@@ -0,0 +1,115 @@
+// +build !nojs
+
+package backends
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestJavascript(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	scripts := map[string]string{
+		"user.js":      `username == "test" && password == "testpw"`,
+		"superuser.js": `username == "admin"`,
+		"acl.js":       `function owns(topic) { return topic.indexOf("devices/" + username + "/") == 0 }; acc == 2 && owns(topic) || topic == "clients/" + clientid`,
+		"loop.js":      `while (true) {}`,
+		"throw.js":     `throw new Error("nope")`,
+		"string.js":    `"true"`,
+		"recurse.js":   `function f(n) { return f(n + 1) }; f(0)`,
+		"syntax.js":    `username ==`,
+	}
+	for name, src := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	Convey("Given missing or wrong options, the backend should fail to start", t, func() {
+		_, err := NewJavascript(map[string]string{}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewJavascript(map[string]string{"js_user_script_path": path("missing.js")}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewJavascript(map[string]string{"js_user_script_path": path("syntax.js")}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewJavascript(map[string]string{"js_user_script_path": path("user.js"), "js_timeout": "soon"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewJavascript(map[string]string{"js_user_script_path": path("user.js"), "js_stack_depth_limit": "-1"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given user, superuser and acl scripts, checks should be decided by them", t, func() {
+		o, err := NewJavascript(map[string]string{
+			"js_user_script_path":      path("user.js"),
+			"js_superuser_script_path": path("superuser.js"),
+			"js_acl_script_path":       path("acl.js"),
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		So(o.Capabilities(), ShouldResemble, Capabilities{User: true, Superuser: true, Acl: true})
+
+		So(o.GetUser("test", "testpw"), ShouldBeTrue)
+		granted, err := o.UserCheck("test", "wrong")
+		So(granted, ShouldBeFalse)
+		So(err, ShouldBeNil)
+
+		So(o.GetSuperuser("admin"), ShouldBeTrue)
+		So(o.GetSuperuser("test"), ShouldBeFalse)
+
+		So(o.CheckAcl("test", "devices/test/temp", "id", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(o.CheckAcl("test", "devices/test/temp", "id", MOSQ_ACL_READ), ShouldBeFalse)
+		So(o.CheckAcl("test", "devices/other/temp", "id", MOSQ_ACL_WRITE), ShouldBeFalse)
+		granted, err = o.AclCheck("test", "clients/id", "id", MOSQ_ACL_READ)
+		So(granted, ShouldBeTrue)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given only an acl script, other checks should be unsupported and denied", t, func() {
+		o, err := NewJavascript(map[string]string{"js_acl_script_path": path("acl.js")}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(o.Capabilities(), ShouldResemble, Capabilities{Acl: true})
+		So(o.GetUser("test", "testpw"), ShouldBeFalse)
+		So(o.GetSuperuser("admin"), ShouldBeFalse)
+	})
+
+	Convey("Given a script running past the timeout, it should be interrupted and the backend reported unavailable", t, func() {
+		o, err := NewJavascript(map[string]string{"js_user_script_path": path("loop.js"), "js_timeout": "50ms"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		granted, err := o.UserCheck("test", "testpw")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+	})
+
+	Convey("Given failing scripts or non boolean results, the backend should be reported misconfigured", t, func() {
+		for _, name := range []string{"throw.js", "string.js", "recurse.js"} {
+			o, err := NewJavascript(map[string]string{"js_user_script_path": path(name)}, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			granted, err := o.UserCheck("test", "testpw")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrMisconfigured)
+		}
+	})
+}
@@ -0,0 +1,262 @@
+package backends
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//jwksKeySet fetches token signing keys from a JWKS endpoint, keeping them by kid and refreshing them periodically or when a token has an unknown kid.
+type jwksKeySet struct {
+	sync.RWMutex
+	url         string
+	client      *http.Client
+	keys        map[string]interface{}
+	fetchedAt   time.Time
+	minInterval time.Duration
+	stop        chan struct{}
+}
+
+//jsonWebKey holds the fields of a JWK used to build RSA and EC public keys.
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//newJWKSKeySet fetches keys from url and refreshes them every refreshInterval, and at most every minInterval for unknown kids.
+//Keys are fetched through transport, or the default one if nil.
+//A failed first fetch is logged but not fatal, so the broker may start while the identity provider is down.
+func newJWKSKeySet(url string, refreshInterval, minInterval time.Duration, transport *http.Transport) *jwksKeySet {
+	client := &http.Client{Timeout: 5 * time.Second}
+	if transport != nil {
+		client.Transport = transport
+	}
+
+	set := &jwksKeySet{
+		url:         url,
+		client:      client,
+		keys:        make(map[string]interface{}),
+		minInterval: minInterval,
+		stop:        make(chan struct{}),
+	}
+
+	if err := set.refresh(); err != nil {
+		log.Errorf("jwks fetch error: %s", err)
+	}
+
+	go set.run(refreshInterval)
+
+	return set
+}
+
+func (s *jwksKeySet) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.refresh(); err != nil {
+				log.Errorf("jwks refresh error: %s", err)
+			}
+		}
+	}
+}
+
+//refresh replaces the keys with the ones currently served. On error, previous keys are kept.
+func (s *jwksKeySet) refresh() error {
+	s.Lock()
+	s.fetchedAt = time.Now()
+	s.Unlock()
+
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("wrong http status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return errors.Errorf("couldn't decode key set: %s", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Warningf("jwks: skipping key %s: %s", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+
+	log.Debugf("jwks: fetched %d keys from %s", len(keys), s.url)
+	return nil
+}
+
+//key returns the key for kid, refreshing the keys once if it's unknown and they weren't fetched within the minimum interval.
+//Tokens without kid may only be verified when the set has a single key.
+func (s *jwksKeySet) key(kid string) (interface{}, error) {
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+
+	s.RLock()
+	stale := time.Since(s.fetchedAt) >= s.minInterval
+	s.RUnlock()
+
+	if stale {
+		if err := s.refresh(); err != nil {
+			log.Errorf("jwks refresh error: %s", err)
+		}
+		if key, ok := s.lookup(kid); ok {
+			return key, nil
+		}
+	}
+
+	return nil, errors.Errorf("unknown key id %s", kid)
+}
+
+func (s *jwksKeySet) lookup(kid string) (interface{}, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if kid == "" {
+		if len(s.keys) == 1 {
+			for _, key := range s.keys {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+func (s *jwksKeySet) halt() {
+	close(s.stop)
+}
+
+//publicKey builds the RSA or EC public key of a JWK.
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("rsa exponent too big")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.Errorf("unsupported key type %s", k.Kty)
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Errorf("bad key value: %s", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+//checkKeyMethod checks a token's signing method suits the kind of key it's verified with.
+func checkKeyMethod(token *jwt.Token, key interface{}) error {
+	var ok bool
+	switch key.(type) {
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	}
+	if !ok {
+		return errors.Errorf("unexpected signing method %s", token.Header["alg"])
+	}
+	return nil
+}
+
+//parseJWKSIntervals gets the jwks refresh interval and minimum interval between refreshes for unknown kids from the options with the given prefix (e.g. jwt or oidc).
+func parseJWKSIntervals(authOpts map[string]string, prefix string) (time.Duration, time.Duration) {
+	refresh := time.Hour
+	min := time.Minute
+
+	if interval, ok := authOpts[prefix+"_jwks_refresh_interval"]; ok {
+		if d, err := time.ParseDuration(interval); err == nil && d > 0 {
+			refresh = d
+		} else {
+			log.Warningf("couldn't parse %s_jwks_refresh_interval %s, defaulting to %s", prefix, interval, refresh)
+		}
+	}
+
+	if interval, ok := authOpts[prefix+"_jwks_min_refresh_interval"]; ok {
+		if d, err := time.ParseDuration(interval); err == nil && d >= 0 {
+			min = d
+		} else {
+			log.Warningf("couldn't parse %s_jwks_min_refresh_interval %s, defaulting to %s", prefix, interval, min)
+		}
+	}
+
+	return refresh, min
+}
@@ -2,11 +2,13 @@ package backends
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/tls"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -18,6 +20,8 @@ import (
 	"github.com/pkg/errors"
 
 	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
 )
 
 type JWT struct {
@@ -27,6 +31,13 @@ type JWT struct {
 	Postgres       Postgres
 	Mysql          Mysql
 	Secret         string
+	Keyring        jwtKeyring
+	PublicKey      *rsa.PublicKey
+	JWE            *jweDecrypter
+	Leeway         time.Duration
+	SkipExpiration bool
+	JWKS           *jwksKeySet
+	ClaimsCache    *claimsCache
 	UserQuery      string
 	SuperuserQuery string
 	AclQuery       string
@@ -34,22 +45,73 @@ type JWT struct {
 	UserUri      string
 	SuperuserUri string
 	AclUri       string
+	Methods      RemoteMethods
 	Host         string
 	Port         string
 	WithTLS      bool
 	VerifyPeer   bool
+	TLSConfig    *tls.Config
+
+	//UserHost, SuperuserHost and AclHost are the hosts each check is requested from, which default to Host.
+	UserHost      string
+	SuperuserHost string
+	AclHost       string
 
 	ParamsMode   string
 	ResponseMode string
+	SuccessCodes SuccessCodes
+	Retry        RemoteRetry
+	Credentials  *RemoteCredentials
+	Headers      http.Header
+
+	UserField      string
+	SuperuserClaim string
+
+	CacheHints    bool
+	CacheTTLField string
+	hint          *cacheHint
+	CacheByJti    bool
+
+	ClientMetadata bool
+	metadata       *common.ClientMetadata
+
+	PasswordFallback bool
+
+	Delegate         Backend
+	DelegatePassword bool
+
+	ManifestClaim string
+
+	Revocations *jwtRevocations
+
+	errs *checkErrors
+
+	Limits  ResponseLimits
+	Schemas ResponseSchemas
+	Mapping ResponseMapping
 
-	UserField string
+	Dialer *common.Dialer
+
+	Explain   bool
+	consulted []Consultation
 }
 
-// Claims defines the struct containing the token claims. StandardClaim's Subject field should contain the username, unless an opt is set to support Username field.
+// Claims defines the struct containing the token claims. StandardClaim's Subject field should contain the username, unless an opt is set to support Username field or any other claim.
 type Claims struct {
 	jwt.StandardClaims
 	// If set, Username defines the identity of the user.
 	Username string `json:"username"`
+	// Raw holds every claim, so the username may be taken from any of them.
+	Raw map[string]interface{} `json:"-"`
+}
+
+//UnmarshalJSON decodes the standard and username claims, keeping every claim at Raw too.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(data, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.Raw)
 }
 
 type Response struct {
@@ -57,6 +119,12 @@ type Response struct {
 	Error string `json:"error"`
 }
 
+func init() {
+	register("jwt", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewJWT(authOpts, logLevel)
+	})
+}
+
 func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 
 	log.SetLevel(logLevel)
@@ -72,16 +140,36 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 		UserField:    "Subject",
 	}
 
-	if userField, ok := authOpts["jwt_userfield"]; ok && userField == "Username" {
-		jwt.UserField = userField
+	if userField, ok := authOpts["jwt_userfield"]; ok && strings.TrimSpace(userField) != "" {
+		jwt.UserField = strings.TrimSpace(userField)
 	} else {
-		log.Debugln("JWT user field not present or incorrect, defaulting to Subject field.")
+		log.Debugln("JWT user field not present, defaulting to Subject field.")
 	}
 
 	if remote, ok := authOpts["jwt_remote"]; ok && remote == "true" {
 		jwt.Remote = true
 	}
 
+	if passwordFallback, ok := authOpts["jwt_password_fallback"]; ok && passwordFallback == "true" {
+		jwt.PasswordFallback = true
+	}
+
+	if localDB, ok := authOpts["jwt_db"]; ok {
+		jwt.LocalDB = localDB
+	}
+
+	if manifestClaim, ok := authOpts["jwt_manifest_claim"]; ok {
+		jwt.ManifestClaim = manifestClaim
+	}
+
+	if revocation, ok := authOpts["jwt_revocation"]; ok && revocation == "true" {
+		revocations, err := newJWTRevocations(authOpts)
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.Revocations = revocations
+	}
+
 	//If remote, set remote api fields. Else, set jwt secret.
 	if jwt.Remote {
 
@@ -121,9 +209,17 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			missingOpts += " jwt_aclcheck_uri"
 		}
 
-		if hostname, ok := authOpts["jwt_host"]; ok {
-			jwt.Host = hostname
-		} else {
+		//Each check may go to its own host, so jwt_host is only needed for those that don't.
+		jwt.Host = authOpts["jwt_host"]
+		jwt.UserHost = authOpts["jwt_getuser_host"]
+		jwt.SuperuserHost = authOpts["jwt_superuser_host"]
+		jwt.AclHost = authOpts["jwt_aclcheck_host"]
+		for _, host := range []*string{&jwt.UserHost, &jwt.SuperuserHost, &jwt.AclHost} {
+			if *host == "" {
+				*host = jwt.Host
+			}
+		}
+		if jwt.UserHost == "" || jwt.SuperuserHost == "" || jwt.AclHost == "" {
 			remoteOk = false
 			missingOpts += " jwt_host"
 		}
@@ -139,9 +235,90 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			jwt.WithTLS = true
 		}
 
-		if verifyPeer, ok := authOpts["jwt_verify_peer"]; ok && verifyPeer == "true" {
-			jwt.VerifyPeer = true
+		jwt.VerifyPeer = parseVerifyPeer(authOpts, "jwt", jwt.WithTLS)
+
+		tlsConfig, err := parseRemoteTLS(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.TLSConfig = tlsConfig
+
+		if cacheHints, ok := authOpts["jwt_cache_hints"]; ok && cacheHints == "true" {
+			jwt.CacheHints = true
+		}
+
+		if ttlField, ok := authOpts["jwt_cache_ttl_field"]; ok {
+			jwt.CacheTTLField = ttlField
+		}
+
+		if cacheByJti, ok := authOpts["jwt_cache_by_jti"]; ok && cacheByJti == "true" {
+			jwt.CacheByJti = true
+		}
+
+		if explain, ok := authOpts["jwt_explain"]; ok && explain == "true" {
+			jwt.Explain = true
+		}
+
+		if clientMetadata, ok := authOpts["jwt_client_metadata"]; ok && clientMetadata == "true" {
+			jwt.ClientMetadata = true
+		}
+
+		methods, err := parseRemoteMethods(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.Methods = methods
+
+		successCodes, err := parseSuccessCodes(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.SuccessCodes = successCodes
+
+		retry, err := parseRemoteRetry(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.Retry = retry
+
+		jwt.Limits = parseResponseLimits(authOpts, "jwt")
+
+		schemas, err := parseResponseSchemas(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.Schemas = schemas
+
+		mapping, err := parseResponseMapping(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.Mapping = mapping
+
+		dialer, err := common.NewDialer(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		jwt.Dialer = dialer
+
+		credentials, err := parseRemoteCredentials(authOpts, "jwt")
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		//Tokens are sent at the Authorization header, so credentials need another one.
+		if credentials != nil && credentials.Header == "Authorization" {
+			return jwt, errors.New("JWT backend error: remote mode sends tokens at the Authorization header, so credentials need another jwt_auth_header_name.\n")
 		}
+		jwt.Credentials = credentials
+
+		headers, err := parseRemoteHeaders(authOpts, "jwt", credentials)
+		if err != nil {
+			return jwt, errors.Errorf("JWT backend error: %s\n", err)
+		}
+		if headers.Get("Authorization") != "" {
+			return jwt, errors.New("JWT backend error: remote mode sends tokens at the Authorization header, so it can't be given at jwt_header_Authorization.\n")
+		}
+		jwt.Headers = headers
 
 		if !remoteOk {
 			return jwt, errors.Errorf("JWT backend error: missing remote options%s.\n", missingOpts)
@@ -152,10 +329,93 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 		missingOpts := ""
 		localOk := true
 
-		if secret, ok := authOpts["jwt_secret"]; ok {
-			jwt.Secret = secret
+		//Encrypted tokens are decrypted with the private key before being verified.
+		if jweKeyFile, ok := authOpts["jwt_jwe_private_key_file"]; ok {
+			decrypter, err := newJWEDecrypter(jweKeyFile, authOpts["jwt_jwe_required"] == "true")
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: %s\n", err)
+			}
+			jwt.JWE = decrypter
+		}
+
+		//Tokens are verified with an RSA public key if given, else with keys from a JWKS endpoint, else with the HMAC secrets.
+		if pubkeyFile, ok := authOpts["jwt_pubkey_file"]; ok {
+			publicKey, err := loadPublicKey(pubkeyFile)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: %s\n", err)
+			}
+			jwt.PublicKey = publicKey
+		} else if jwksUrl, ok := authOpts["jwt_jwks_url"]; ok {
+			dialer, err := common.NewDialer(authOpts, "jwt")
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: %s\n", err)
+			}
+			refreshInterval, minInterval := parseJWKSIntervals(authOpts, "jwt")
+			jwt.JWKS = newJWKSKeySet(jwksUrl, refreshInterval, minInterval, remoteTransport(nil, true, dialer))
 		} else {
-			return jwt, errors.New("JWT backend error: missing jwt secret.\n")
+			keyring, err := parseJWTKeyring(authOpts)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: %s\n", err)
+			}
+			if len(keyring) == 0 {
+				return jwt, errors.New("JWT backend error: missing jwt secret, public key file or jwks url.\n")
+			}
+			jwt.Secret = authOpts["jwt_secret"]
+			jwt.Keyring = keyring
+		}
+
+		if leeway, ok := authOpts["jwt_leeway_seconds"]; ok {
+			seconds, err := strconv.Atoi(strings.TrimSpace(leeway))
+			if err != nil || seconds < 0 {
+				return jwt, errors.Errorf("JWT backend error: invalid jwt_leeway_seconds %s.\n", leeway)
+			}
+			jwt.Leeway = time.Duration(seconds) * time.Second
+		}
+
+		if skipExpiration, ok := authOpts["jwt_skip_expiration"]; ok && skipExpiration == "true" {
+			jwt.SkipExpiration = true
+			log.Warning("JWT expiration won't be checked, tokens will be valid forever.")
+		}
+
+		if cacheSize, ok := authOpts["jwt_claims_cache_size"]; ok {
+			size, err := strconv.Atoi(strings.TrimSpace(cacheSize))
+			if err != nil || size < 0 {
+				return jwt, errors.Errorf("JWT backend error: invalid jwt_claims_cache_size %s.\n", cacheSize)
+			}
+			seconds := 300
+			if cacheSeconds, ok := authOpts["jwt_claims_cache_seconds"]; ok {
+				seconds, err = strconv.Atoi(strings.TrimSpace(cacheSeconds))
+				if err != nil || seconds <= 0 {
+					return jwt, errors.Errorf("JWT backend error: invalid jwt_claims_cache_seconds %s.\n", cacheSeconds)
+				}
+			}
+			if size > 0 {
+				jwt.ClaimsCache = newClaimsCache(size, time.Duration(seconds)*time.Second)
+			}
+		}
+
+		if superuserClaim, ok := authOpts["jwt_superuser_claim"]; ok {
+			jwt.SuperuserClaim = strings.TrimSpace(superuserClaim)
+		}
+
+		//When delegating, tokens are only verified here and checks for their username are forwarded to the delegate, so no DB is needed.
+		//Redis and Mongo keep users and acls in their own way, so they're always delegates.
+		delegate, delegated := authOpts["jwt_delegate"]
+		if !delegated && (jwt.LocalDB == "redis" || jwt.LocalDB == "mongo") {
+			delegate, delegated = jwt.LocalDB, true
+		}
+		if delegated {
+			delegate = strings.TrimSpace(delegate)
+			if delegate == "jwt" {
+				return jwt, errors.New("JWT backend error: checks can't be delegated to another jwt backend.\n")
+			}
+			backend, err := New(delegate, authOpts, logLevel)
+			if err != nil {
+				return jwt, errors.Errorf("JWT backend error: couldn't create %s backend to delegate checks to: %s\n", delegate, err)
+			}
+			jwt.Delegate = backend
+			jwt.DelegatePassword = authOpts["jwt_delegate_password"] == "true"
+			return jwt, nil
 		}
 
 		if userQuery, ok := authOpts["jwt_userquery"]; ok {
@@ -173,10 +433,6 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 			jwt.AclQuery = aclQuery
 		}
 
-		if localDB, ok := authOpts["jwt_db"]; ok {
-			jwt.LocalDB = localDB
-		}
-
 		if !localOk {
 			return jwt, errors.Errorf("JWT backend error: missing local options%s.\n", missingOpts)
 		}
@@ -213,10 +469,14 @@ func NewJWT(authOpts map[string]string, logLevel log.Level) (JWT, error) {
 //GetUser authenticates a given user.
 func (o JWT) GetUser(token, password string) bool {
 
+	if o.notToken(token) {
+		return false
+	}
+
 	if o.Remote {
 		var dataMap map[string]interface{}
 		var urlValues = url.Values{}
-		return jwtRequest(o.Host, o.UserUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		return o.jwtRequest(o.UserHost, o.UserUri, o.Methods.User, token, dataMap, urlValues)
 	}
 
 	//If not remote, get the claims and check against postgres for user.
@@ -224,28 +484,50 @@ func (o JWT) GetUser(token, password string) bool {
 
 	if err != nil {
 		log.Printf("jwt get user error: %s\n", err)
+		o.errs.set(ErrBadCredentials, err)
 		return false
 	}
-	//Now check against the DB.
-	if o.UserField == "Username" {
-		return o.getLocalUser(claims.Username)
+	username, err := o.claimsUsername(claims)
+	if err != nil {
+		log.Debugf("jwt get user error: %s\n", err)
+		return false
+	}
+	//A verified token is enough for the delegate, as long as the user exists if it may tell, unless it must check the password too.
+	if o.Delegate != nil {
+		if o.DelegatePassword {
+			granted, hint, err := HintedCheckUser(o.Delegate, username, password)
+			o.hint.keep(hint)
+			o.errs.keep(err)
+			return granted
+		}
+		if finder, ok := o.Delegate.(UserFinder); ok {
+			exists, err := finder.UserExists(username)
+			o.errs.keep(err)
+			return exists
+		}
+		return true
 	}
-	return o.getLocalUser(claims.Subject)
+	//Now check against the DB.
+	return o.getLocalUser(username)
 
 }
 
 //GetSuperuser checks if the given user is a superuser.
 func (o JWT) GetSuperuser(token string) bool {
 
+	if o.notToken(token) {
+		return false
+	}
+
 	if o.Remote {
 		var dataMap map[string]interface{}
 		var urlValues = url.Values{}
-		return jwtRequest(o.Host, o.SuperuserUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		return o.jwtRequest(o.SuperuserHost, o.SuperuserUri, o.Methods.Superuser, token, dataMap, urlValues)
 	}
 
 	//If not remote, get the claims and check against postgres for user.
-	//But check first that there's superuser query.
-	if o.SuperuserQuery == "" {
+	//But check first that there's superuser query or claim.
+	if o.SuperuserQuery == "" && o.SuperuserClaim == "" && o.Delegate == nil {
 		return false
 	}
 	claims, err := o.getClaims(token)
@@ -254,19 +536,29 @@ func (o JWT) GetSuperuser(token string) bool {
 		log.Debugf("jwt get superuser error: %s\n", err)
 		return false
 	}
-	//Now check against DB
-	if o.UserField == "Username" {
-		if o.LocalDB == "mysql" {
-			return o.Mysql.GetSuperuser(claims.Username)
-		} else {
-			return o.Postgres.GetSuperuser(claims.Username)
-		}
+	//A token declaring superuser status is trusted without querying the DB.
+	if o.SuperuserClaim != "" && claimsFlag(claims, o.SuperuserClaim) {
+		return true
 	}
-
+	if o.SuperuserQuery == "" && o.Delegate == nil {
+		return false
+	}
+	username, err := o.claimsUsername(claims)
+	if err != nil {
+		log.Debugf("jwt get superuser error: %s\n", err)
+		return false
+	}
+	if o.Delegate != nil {
+		granted, hint, err := HintedCheckSuperuser(o.Delegate, username)
+		o.hint.keep(hint)
+		o.errs.keep(err)
+		return granted
+	}
+	//Now check against DB
 	if o.LocalDB == "mysql" {
-		return o.Mysql.GetSuperuser(claims.Subject)
+		return o.Mysql.GetSuperuser(username)
 	} else {
-		return o.Postgres.GetSuperuser(claims.Subject)
+		return o.Postgres.GetSuperuser(username)
 	}
 
 }
@@ -274,6 +566,10 @@ func (o JWT) GetSuperuser(token string) bool {
 //CheckAcl checks user authorization.
 func (o JWT) CheckAcl(token, topic, clientid string, acc int32) bool {
 
+	if o.notToken(token) {
+		return false
+	}
+
 	if o.Remote {
 		dataMap := map[string]interface{}{
 			"clientid": clientid,
@@ -285,12 +581,12 @@ func (o JWT) CheckAcl(token, topic, clientid string, acc int32) bool {
 			"topic":    []string{topic},
 			"acc":      []string{strconv.Itoa(int(acc))},
 		}
-		return jwtRequest(o.Host, o.AclUri, token, o.WithTLS, o.VerifyPeer, dataMap, o.Port, o.ParamsMode, o.ResponseMode, urlValues)
+		return o.jwtRequest(o.AclHost, o.AclUri, o.Methods.Acl, token, dataMap, urlValues)
 	}
 
 	//If not remote, get the claims and check against postgres for user.
 	//But check first that there's acl query.
-	if o.AclQuery == "" {
+	if o.AclQuery == "" && o.Delegate == nil {
 		return true
 	}
 	claims, err := o.getClaims(token)
@@ -299,120 +595,213 @@ func (o JWT) CheckAcl(token, topic, clientid string, acc int32) bool {
 		log.Debugf("jwt check acl error: %s\n", err)
 		return false
 	}
-	//Now check against the DB.
-	if o.UserField == "Username" {
-		if o.LocalDB == "mysql" {
-			return o.Mysql.CheckAcl(claims.Username, topic, clientid, acc)
-		} else {
-			return o.Postgres.CheckAcl(claims.Username, topic, clientid, acc)
-		}
+	username, err := o.claimsUsername(claims)
+	if err != nil {
+		log.Debugf("jwt check acl error: %s\n", err)
+		return false
 	}
+	if o.Delegate != nil {
+		granted, hint, err := HintedCheckAcl(o.Delegate, username, topic, clientid, acc)
+		o.hint.keep(hint)
+		o.errs.keep(err)
+		return granted
+	}
+	//Now check against the DB.
 	if o.LocalDB == "mysql" {
-		return o.Mysql.CheckAcl(claims.Subject, topic, clientid, acc)
+		return o.Mysql.CheckAcl(username, topic, clientid, acc)
 	} else {
-		return o.Postgres.CheckAcl(claims.Subject, topic, clientid, acc)
+		return o.Postgres.CheckAcl(username, topic, clientid, acc)
 	}
 
 }
 
-func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[string]interface{}, port, paramsMode, responseMode string, urlValues url.Values) bool {
+func (o JWT) jwtRequest(host, uri, method, token string, dataMap map[string]interface{}, urlValues url.Values) bool {
+
+	//Revoked tokens are denied without asking the remote service, which still verifies the rest.
+	if o.Revocations != nil {
+		claims := &Claims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err == nil && o.isRevoked(claims) {
+			log.Debugf("jwt request denied for revoked token\n")
+			o.errs.setDenied(uri == o.UserUri)
+			return false
+		}
+	}
+
+	//Usernames in uri templates are taken from the token, which the remote service still verifies.
+	username := ""
+	if strings.Contains(uri, "%u") {
+		claims := &Claims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err == nil {
+			username, _ = o.claimsUsername(claims)
+		}
+	}
+	path := expandUriTemplate(uri, username, urlValues.Get("clientid"), urlValues.Get("topic"))
+
+	//Results of the backends consulted before this one in an acl check are sent along, if told.
+	if o.Explain && o.consulted != nil {
+		if dataMap == nil {
+			dataMap = make(map[string]interface{})
+		}
+		dataMap["consulted"] = o.consulted
+		urlValues.Set("consulted", consultationValue(o.consulted))
+	}
+
+	//So is what mosquitto tells about the client being checked.
+	if o.ClientMetadata {
+		if dataMap == nil {
+			dataMap = make(map[string]interface{})
+		}
+		addClientMetadata(o.metadata, dataMap, urlValues)
+	}
 
 	tlsStr := "http://"
 
-	if withTLS {
+	if o.WithTLS {
 		tlsStr = "https://"
 	}
 
-	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, uri)
-	if port != "" {
-		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, port, uri)
+	//Hosts that give their own port don't get jwt_port.
+	fullUri := fmt.Sprintf("%s%s%s", tlsStr, host, path)
+	if _, _, err := net.SplitHostPort(host); err != nil && o.Port != "" {
+		fullUri = fmt.Sprintf("%s%s:%s%s", tlsStr, host, o.Port, path)
 	}
 
-	client := &http.Client{Timeout: 5 * time.Second}
+	client := &http.Client{Timeout: o.Retry.Timeout}
 
 	var resp *http.Response
 	var err error
 
-	if !verifyPeer {
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+	if tr := remoteTransport(o.TLSConfig, o.VerifyPeer, o.Dialer); tr != nil {
 		client.Transport = tr
 	}
 
+	client.Transport = remoteHeadersTransport(o.Headers, client.Transport)
+
+	if o.Credentials != nil {
+		client.Transport = o.Credentials.transport(client.Transport)
+	}
+
 	var req *http.Request
 	var reqErr error
 
-	if paramsMode == "json" {
+	if method == "GET" {
+		req, reqErr = http.NewRequest(method, withQuery(fullUri, urlValues), nil)
+
+		if reqErr != nil {
+			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
+			return false
+		}
+	} else if o.ParamsMode == "json" {
 		dataJson, mErr := json.Marshal(dataMap)
 
 		if mErr != nil {
 			log.Errorf("marshal error: %v\n", mErr)
+			o.errs.set(ErrMisconfigured, mErr)
 			return false
 		}
 
 		contentReader := bytes.NewReader(dataJson)
-		req, reqErr = http.NewRequest("POST", fullUri, contentReader)
+		req, reqErr = http.NewRequest(method, fullUri, contentReader)
 
 		if reqErr != nil {
 			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
 			return false
 		}
 		req.Header.Set("Content-Type", "application/json")
 	} else {
-		req, reqErr = http.NewRequest("POST", fullUri, strings.NewReader(urlValues.Encode()))
+		req, reqErr = http.NewRequest(method, fullUri, strings.NewReader(urlValues.Encode()))
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		req.Header.Set("Content-Length", strconv.Itoa(len(urlValues.Encode())))
 
 		if reqErr != nil {
 			log.Errorf("req error: %v\n", reqErr)
+			o.errs.set(ErrMisconfigured, reqErr)
 			return false
 		}
 	}
 
 	req.Header.Set("authorization", token)
 
-	resp, err = client.Do(req)
+	if o.ResponseMode == "json" {
+		o.Schemas.setHeaders(req.Header)
+	}
+
+	resp, err = o.Retry.do(client, req)
 
 	if err != nil {
 		log.Errorf("error: %v\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
 		return false
 	}
 
-	body, bErr := ioutil.ReadAll(resp.Body)
+	body, bErr := o.Limits.read(resp.Body)
 	defer resp.Body.Close()
 
 	if bErr != nil {
 		log.Errorf("read error: %v\n", bErr)
+		o.errs.set(ErrBackendUnavailable, bErr)
 		return false
 	}
 
-	if resp.Status != "200 OK" {
-		log.Infof("error code: %v\n", err)
+	version := SchemaV1
+	if o.ResponseMode == "json" {
+		var vErr error
+		version, vErr = o.Schemas.version(resp.Header)
+		if vErr != nil {
+			log.Errorf("response error: %v\n", vErr)
+			o.errs.set(ErrBackendUnavailable, vErr)
+			return false
+		}
+
+		if lErr := o.Limits.checkJSON(body, append(o.Mapping.fields(version), o.CacheTTLField)...); lErr != nil {
+			log.Errorf("response error: %v\n", lErr)
+			o.errs.set(ErrBackendUnavailable, lErr)
+			return false
+		}
+	}
+
+	if o.CacheHints {
+		if ttl, ok := parseCacheHint(resp.Header, body, o.ResponseMode, o.CacheTTLField); ok {
+			o.hint.set(ttl)
+		}
+	}
+
+	//Server errors mean the service failed, so they are never taken as denials.
+	if !o.SuccessCodes.accepts(resp.StatusCode) {
+		if resp.StatusCode >= 500 {
+			log.Errorf("jwt server error status: %v\n", resp.StatusCode)
+		} else {
+			log.Infof("error code: %v\n", resp.StatusCode)
+		}
+		o.errs.setStatus(resp.StatusCode, uri == o.UserUri)
 		return false
 	}
 
-	if responseMode == "text" {
+	if o.ResponseMode == "text" {
 
 		//For test response, we expect "ok" or an error message.
 		if string(body) != "ok" {
 			log.Infof("api error: %s\n", string(body))
+			o.errs.setDenied(uri == o.UserUri)
 			return false
 		}
 
-	} else if responseMode == "json" {
+	} else if o.ResponseMode == "json" {
 
-		//For json response, we expect Ok and Error fields.
-		response := Response{Ok: false, Error: ""}
-		jErr := json.Unmarshal(body, &response)
+		//For json response, we expect the mapped fields or those of the response's schema version.
+		ok, message, jErr := o.Mapping.decode(body, version)
 
 		if jErr != nil {
 			log.Errorf("unmarshal error: %v\n", jErr)
+			o.errs.set(ErrBackendUnavailable, jErr)
 			return false
 		}
 
-		if !response.Ok {
-			log.Infof("api error: %s\n", response.Error)
+		if !ok {
+			log.Infof("api error: %s\n", message)
+			o.errs.setDenied(uri == o.UserUri)
 			return false
 		}
 
@@ -423,6 +812,165 @@ func jwtRequest(host, uri, token string, withTLS, verifyPeer bool, dataMap map[s
 
 }
 
+//UserCheck checks the user as GetUser does, returning the error of a failed check, including those of the local DB backend or the delegate.
+func (o JWT) UserCheck(token, password string) (bool, error) {
+	o.keepErrors()
+	granted := o.GetUser(token, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check, including those of the local DB backend or the delegate.
+func (o JWT) SuperuserCheck(token string) (bool, error) {
+	o.keepErrors()
+	granted := o.GetSuperuser(token)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check, including those of the local DB backend or the delegate.
+func (o JWT) AclCheck(token, topic, clientid string, acc int32) (bool, error) {
+	o.keepErrors()
+	granted := o.CheckAcl(token, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//keepErrors gives this copy of the backend, and of its local DB backend, a new error collector for a single check.
+func (o *JWT) keepErrors() {
+	o.errs = &checkErrors{}
+	o.Postgres.errs = o.errs
+	o.Mysql.errs = o.errs
+}
+
+//HintedUserCheck checks the user as UserCheck does, returning the cache hint of the remote response or the delegate's.
+func (o JWT) HintedUserCheck(token, password string) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.UserCheck(token, password)
+	return granted, o.hint.get(), err
+}
+
+//HintedSuperuserCheck checks the superuser as SuperuserCheck does, returning the cache hint of the remote response or the delegate's.
+func (o JWT) HintedSuperuserCheck(token string) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.SuperuserCheck(token)
+	return granted, o.hint.get(), err
+}
+
+//HintedAclCheck checks the acl as AclCheck does, returning the cache hint of the remote response or the delegate's.
+func (o JWT) HintedAclCheck(token, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	o.Postgres.hint = o.hint
+	o.Mysql.hint = o.hint
+	granted, err := o.AclCheck(token, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend sending the client's metadata along with its remote requests, if told, and passing it to its local DB backend and the delegate.
+func (o JWT) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	o.Postgres.metadata = &metadata
+	o.Mysql.metadata = &metadata
+	if o.Delegate != nil {
+		o.Delegate = ForClient(o.Delegate, &metadata)
+	}
+	return o
+}
+
+//ExplainedSuperuserCheck checks the superuser as HintedSuperuserCheck does, sending consulted along with the remote request if explanations are enabled.
+func (o JWT) ExplainedSuperuserCheck(consulted []Consultation, token string) (bool, CacheHint, error) {
+	o.consulted = consulted
+	return o.HintedSuperuserCheck(token)
+}
+
+//ExplainedAclCheck checks the acl as HintedAclCheck does, sending consulted along with the remote request if explanations are enabled.
+func (o JWT) ExplainedAclCheck(consulted []Consultation, token, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.consulted = consulted
+	return o.HintedAclCheck(token, topic, clientid, acc)
+}
+
+//TokenID returns the token's jti and expiration when caching by jti is enabled, reading them without verifying the token.
+//Cache keys still hold a digest of the whole token, so a forged token with a known jti won't hit the cache.
+func (o JWT) TokenID(token string) (string, time.Time, bool) {
+	if !o.CacheByJti {
+		return "", time.Time{}, false
+	}
+
+	token, err := o.plainToken(token)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	var claims jwt.StandardClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, &claims); err != nil || claims.Id == "" {
+		return "", time.Time{}, false
+	}
+
+	var expiry time.Time
+	if claims.ExpiresAt > 0 {
+		expiry = time.Unix(claims.ExpiresAt, 0)
+	}
+
+	return claims.Id, expiry, true
+}
+
+//TokenExpired checks the token's exp claim, with the configured leeway, without verifying the token.
+//Tokens are verified when checked against the backend, so this only tells if a cached decision must no longer be trusted.
+func (o JWT) TokenExpired(token string) bool {
+	if o.SkipExpiration {
+		return false
+	}
+
+	//Cached claims are dropped once expired, which also spares decrypting the token again.
+	if _, ok := o.ClaimsCache.get(token); ok {
+		return false
+	}
+
+	token, err := o.plainToken(token)
+	if err != nil {
+		return false
+	}
+
+	var claims jwt.StandardClaims
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, &claims); err != nil {
+		return false
+	}
+
+	return !claims.VerifyExpiresAt(time.Now().Add(-o.Leeway).Unix(), false)
+}
+
+//VerifyToken verifies a token as local checks do, returning its username, every claim and its expiry, which is zero if it doesn't expire.
+func (o JWT) VerifyToken(token string) (string, map[string]interface{}, time.Time, error) {
+	if o.Remote {
+		return "", nil, time.Time{}, errors.New("jwt tokens are verified by the remote service")
+	}
+
+	claims, err := o.getClaims(token)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+
+	username, err := o.claimsUsername(claims)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+
+	return username, claims.Raw, o.claimsExpiry(claims), nil
+}
+
+//notToken tells if, when falling back to passwords, the credentials aren't structurally a token.
+//These are reported as not found, so the backends listed after this one check them as a username and password.
+func (o JWT) notToken(token string) bool {
+	if !o.PasswordFallback || isJWT(token) {
+		return false
+	}
+	log.Debugf("jwt: credentials for %s are not a token, leaving them to other backends\n", token)
+	o.errs.set(ErrNotFound, nil)
+	return true
+}
+
+//Capabilities tells manifests are only taken from tokens when a manifest claim is given.
+func (o JWT) Capabilities() Capabilities {
+	return Capabilities{User: true, Superuser: true, Acl: true, Manifest: o.ManifestClaim != ""}
+}
+
 //GetName returns the backend's name
 func (o JWT) GetName() string {
 	return "JWT"
@@ -461,9 +1009,41 @@ func (o JWT) getLocalUser(username string) bool {
 
 func (o JWT) getClaims(tokenStr string) (*Claims, error) {
 
-	jwtToken, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(o.Secret), nil
-	})
+	claims, ok := o.ClaimsCache.get(tokenStr)
+	if !ok {
+		var err error
+		claims, err = o.verifyClaims(tokenStr)
+		if err != nil {
+			return nil, err
+		}
+		o.ClaimsCache.set(tokenStr, claims, o.claimsExpiry(claims))
+	}
+
+	//Revocations are checked for cached claims too, so revoked tokens are rejected right away.
+	if o.Revocations != nil && o.isRevoked(claims) {
+		return nil, errors.New("jwt revoked token")
+	}
+
+	return claims, nil
+}
+
+//verifyClaims parses the token, decrypting it first if encrypted, verifying its signature and time based claims.
+func (o JWT) verifyClaims(tokenStr string) (*Claims, error) {
+
+	tokenStr, err := o.plainToken(tokenStr)
+	if err != nil {
+		log.Debugf("jwt decryption error: %s\n", err)
+		return nil, err
+	}
+
+	//Time based claims are validated apart to apply the leeway.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	var jwtToken *jwt.Token
+	if len(o.Keyring) > 0 {
+		jwtToken, err = o.Keyring.parse(parser, tokenStr)
+	} else {
+		jwtToken, err = parser.ParseWithClaims(tokenStr, &Claims{}, o.verificationKey)
+	}
 
 	if err != nil {
 		log.Debugf("jwt parse error: %s\n", err)
@@ -481,11 +1061,190 @@ func (o JWT) getClaims(tokenStr string) (*Claims, error) {
 		return nil, errors.New("got strange claims")
 	}
 
+	if err := o.validateTimes(claims); err != nil {
+		log.Debugf("jwt validation error: %s\n", err)
+		return nil, err
+	}
+
 	return claims, nil
 }
 
+//plainToken returns the signed token within an encrypted one when a jwe key is given, or the token as is otherwise.
+func (o JWT) plainToken(tokenStr string) (string, error) {
+	if o.JWE == nil {
+		return tokenStr, nil
+	}
+	return o.JWE.decrypt(tokenStr)
+}
+
+//claimsExpiry returns when the token stops being valid, including the leeway, or zero if it never does.
+func (o JWT) claimsExpiry(claims *Claims) time.Time {
+	if o.SkipExpiration || claims.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.ExpiresAt, 0).Add(o.Leeway)
+}
+
+//validateTimes checks the token's exp, nbf and iat claims, if present, allowing for the leeway so clients with drifting clocks aren't rejected.
+//The expiration isn't checked when skipped.
+func (o JWT) validateTimes(claims *Claims) error {
+	now := time.Now()
+
+	if !o.SkipExpiration && !claims.VerifyExpiresAt(now.Add(-o.Leeway).Unix(), false) {
+		return errors.New("jwt token is expired")
+	}
+
+	if !claims.VerifyNotBefore(now.Add(o.Leeway).Unix(), false) {
+		return errors.New("jwt token is not valid yet")
+	}
+
+	if !claims.VerifyIssuedAt(now.Add(o.Leeway).Unix(), false) {
+		return errors.New("jwt token used before issued")
+	}
+
+	return nil
+}
+
+//claimsUsername gets the username from the claim given by the user field: Subject, Username, or any other claim as found by claimValue.
+func (o JWT) claimsUsername(claims *Claims) (string, error) {
+	switch o.UserField {
+	case "", "Subject":
+		return claims.Subject, nil
+	case "Username":
+		return claims.Username, nil
+	}
+
+	username, ok := claimValue(claims, o.UserField).(string)
+	if !ok || username == "" {
+		return "", errors.Errorf("missing username claim %s", o.UserField)
+	}
+	return username, nil
+}
+
+//isRevoked checks the token's jti and username against the revocation list.
+func (o JWT) isRevoked(claims *Claims) bool {
+	username, _ := o.claimsUsername(claims)
+	return o.Revocations.revoked(claims.Id, username)
+}
+
+//claimValue gets the claim with the given name, which may be a dotted path into nested claims (e.g. user.email), or nil if missing.
+//A claim named as a whole path (e.g. https://example.com/username) is preferred over a nested one.
+func claimValue(claims *Claims, name string) interface{} {
+	if value, ok := claims.Raw[name]; ok {
+		return value
+	}
+
+	var current interface{} = claims.Raw
+	for _, key := range strings.Split(name, ".") {
+		fields, isMap := current.(map[string]interface{})
+		if !isMap {
+			return nil
+		}
+		current = fields[key]
+	}
+	return current
+}
+
+//claimsFlag tells if the named claim is set to true, either as a boolean or as a "true" string.
+func claimsFlag(claims *Claims, name string) bool {
+	switch value := claimValue(claims, name).(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+//verificationKey returns the key to verify a token with, rejecting tokens signed with a method of another kind than the key's.
+//Checking the method keeps tokens signed with HMAC using the public key as secret from being accepted.
+func (o JWT) verificationKey(token *jwt.Token) (interface{}, error) {
+	if o.PublicKey != nil {
+		return o.PublicKey, checkKeyMethod(token, o.PublicKey)
+	}
+
+	if o.JWKS != nil {
+		kid, _ := token.Header["kid"].(string)
+		key, err := o.JWKS.key(kid)
+		if err != nil {
+			return nil, err
+		}
+		return key, checkKeyMethod(token, key)
+	}
+
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.Errorf("unexpected signing method %s", token.Header["alg"])
+	}
+	return []byte(o.Secret), nil
+}
+
+//loadPublicKey reads a PEM encoded RSA public key, which may be a PKIX key or a certificate.
+func loadPublicKey(path string) (*rsa.PublicKey, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read public key file %s: %s", path, err)
+	}
+
+	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, errors.Errorf("couldn't parse public key file %s: %s", path, err)
+	}
+
+	return publicKey, nil
+}
+
+//Manifest gets the permission manifest from the token's manifest claim, if given. It's only called after the token was validated by GetUser.
+func (o JWT) Manifest(token string) ([]ManifestAcl, bool) {
+	if o.ManifestClaim == "" {
+		return nil, false
+	}
+
+	token, err := o.plainToken(token)
+	if err != nil {
+		log.Debugf("jwt manifest error: %s\n", err)
+		return nil, false
+	}
+
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, claims); err != nil {
+		log.Debugf("jwt manifest error: %s\n", err)
+		return nil, false
+	}
+
+	value, ok := claims[o.ManifestClaim]
+	if !ok {
+		return nil, false
+	}
+
+	acls, err := parseManifest(value)
+	if err != nil {
+		log.Errorf("jwt manifest error: %s\n", err)
+		return nil, false
+	}
+
+	return acls, true
+}
+
+//isJWT checks if the given string is structurally a JWT, signed or encrypted, regardless of its signature being valid.
+func isJWT(tokenStr string) bool {
+	_, _, err := new(jwt.Parser).ParseUnverified(tokenStr, &Claims{})
+	return err == nil || isJWE(tokenStr)
+}
+
 //Halt closes any DB connection.
 func (o JWT) Halt() {
+	if o.Revocations != nil {
+		o.Revocations.halt()
+	}
+
+	if o.JWKS != nil {
+		o.JWKS.halt()
+	}
+
+	if o.Delegate != nil {
+		o.Delegate.Halt()
+	}
+
 	if o.Postgres != (Postgres{}) && o.Postgres.DB != nil {
 		err := o.Postgres.DB.Close()
 		if err != nil {
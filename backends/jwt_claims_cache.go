@@ -0,0 +1,88 @@
+package backends
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+//claimsCache keeps the claims of verified tokens, so repeated checks for the same token don't verify its signature again.
+//Entries are keyed by a digest of the token and kept for at most ttl, never past the token's expiration, and at most size of them are kept.
+type claimsCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[[sha256.Size]byte]claimsCacheEntry
+}
+
+type claimsCacheEntry struct {
+	claims *Claims
+	expiry time.Time
+}
+
+func newClaimsCache(size int, ttl time.Duration) *claimsCache {
+	return &claimsCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]claimsCacheEntry, size),
+	}
+}
+
+//get returns the cached claims for token, if any and not expired.
+func (c *claimsCache) get(token string) (*Claims, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expiry) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.claims, true
+}
+
+//set caches the claims for token until ttl passes or expiry, if not zero, whichever comes first.
+//When full, expired entries are dropped, and if none were, an arbitrary one is.
+func (c *claimsCache) set(token string, claims *Claims, expiry time.Time) {
+	if c == nil {
+		return
+	}
+
+	now := time.Now()
+	if limit := now.Add(c.ttl); expiry.IsZero() || limit.Before(expiry) {
+		expiry = limit
+	}
+	if !now.Before(expiry) {
+		return
+	}
+
+	key := sha256.Sum256([]byte(token))
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiry) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.size {
+			for k := range c.entries {
+				delete(c.entries, k)
+				break
+			}
+		}
+	}
+
+	c.entries[key] = claimsCacheEntry{claims: claims, expiry: expiry}
+}
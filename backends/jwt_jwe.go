@@ -0,0 +1,127 @@
+package backends
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+//jweDecrypter decrypts compact JWE tokens, whose payload is the signed token to verify.
+//Content must be encrypted with A256GCM and its key wrapped with RSA-OAEP or RSA-OAEP-256 using the decrypter's private key.
+type jweDecrypter struct {
+	key *rsa.PrivateKey
+	//required rejects tokens that aren't encrypted, else they're verified as they are.
+	required bool
+}
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Zip string `json:"zip"`
+}
+
+//newJWEDecrypter reads a PEM encoded RSA private key, either PKCS1 or PKCS8.
+func newJWEDecrypter(path string, required bool) (*jweDecrypter, error) {
+	keyPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read jwe private key file %s: %s", path, err)
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, errors.Errorf("couldn't parse jwe private key file %s: %s", path, err)
+	}
+
+	return &jweDecrypter{key: privateKey, required: required}, nil
+}
+
+//decrypt returns the signed token within an encrypted one, or the token itself if it isn't encrypted and that's allowed.
+func (d *jweDecrypter) decrypt(tokenStr string) (string, error) {
+	if !isJWE(tokenStr) {
+		if d.required {
+			return "", errors.New("jwt token isn't encrypted")
+		}
+		return tokenStr, nil
+	}
+
+	parts := strings.Split(tokenStr, ".")
+	var segments [5][]byte
+	for i, part := range parts {
+		segment, err := jwt.DecodeSegment(part)
+		if err != nil {
+			return "", errors.Errorf("jwe malformed segment %d: %s", i, err)
+		}
+		segments[i] = segment
+	}
+
+	var header jweHeader
+	if err := json.Unmarshal(segments[0], &header); err != nil {
+		return "", errors.Errorf("jwe malformed header: %s", err)
+	}
+
+	var oaepHash hash.Hash
+	switch header.Alg {
+	case "RSA-OAEP":
+		oaepHash = sha1.New()
+	case "RSA-OAEP-256":
+		oaepHash = sha256.New()
+	default:
+		return "", errors.Errorf("jwe unsupported key algorithm %s", header.Alg)
+	}
+	if header.Enc != "A256GCM" {
+		return "", errors.Errorf("jwe unsupported content encryption %s", header.Enc)
+	}
+	if header.Zip != "" {
+		return "", errors.Errorf("jwe unsupported compression %s", header.Zip)
+	}
+
+	cek, err := rsa.DecryptOAEP(oaepHash, rand.Reader, d.key, segments[1], nil)
+	if err != nil || len(cek) != 32 {
+		return "", errors.New("jwe couldn't decrypt content key")
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	iv, ciphertext, tag := segments[2], segments[3], segments[4]
+	if len(iv) != gcm.NonceSize() || len(tag) != gcm.Overhead() {
+		return "", errors.New("jwe invalid iv or tag")
+	}
+
+	//The encoded protected header is the additional authenticated data.
+	payload, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", errors.New("jwe couldn't decrypt content")
+	}
+
+	return string(payload), nil
+}
+
+//isJWE checks if the given string is structurally a compact JWE: five segments, the first one a header with an enc field.
+func isJWE(tokenStr string) bool {
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) != 5 {
+		return false
+	}
+	headerJSON, err := jwt.DecodeSegment(parts[0])
+	if err != nil {
+		return false
+	}
+	var header jweHeader
+	return json.Unmarshal(headerJSON, &header) == nil && header.Enc != ""
+}
@@ -0,0 +1,122 @@
+package backends
+
+import (
+	"bufio"
+	"os"
+	"sort"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+//jwtKey is an HMAC secret and the kid tokens signed with it may carry, if any.
+type jwtKey struct {
+	kid    string
+	secret []byte
+}
+
+//jwtKeyring holds several HMAC secrets, so tokens signed with a previous one stay valid while secrets are rotated.
+type jwtKeyring []jwtKey
+
+//parseJWTKeyring gets the secrets given at jwt_secret, jwt_secret_<kid> options and the jwt_secrets_file, in that order.
+//jwt_secret_<kid> options are ordered by kid, so jwt_secret_1 is tried before jwt_secret_2.
+func parseJWTKeyring(authOpts map[string]string) (jwtKeyring, error) {
+	var keyring jwtKeyring
+
+	if secret, ok := authOpts["jwt_secret"]; ok {
+		keyring = append(keyring, jwtKey{secret: []byte(secret)})
+	}
+
+	var kids []string
+	for k := range authOpts {
+		if strings.HasPrefix(k, "jwt_secret_") && len(k) > len("jwt_secret_") {
+			kids = append(kids, strings.TrimPrefix(k, "jwt_secret_"))
+		}
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		keyring = append(keyring, jwtKey{kid: kid, secret: []byte(authOpts["jwt_secret_"+kid])})
+	}
+
+	if file, ok := authOpts["jwt_secrets_file"]; ok {
+		secrets, err := readJWTSecrets(file)
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, secrets...)
+	}
+
+	for _, s := range keyring {
+		if len(s.secret) == 0 {
+			return nil, errors.Errorf("empty jwt secret for kid %s", s.kid)
+		}
+	}
+
+	return keyring, nil
+}
+
+//readJWTSecrets reads kid:secret lines, ignoring empty ones and those starting with #.
+func readJWTSecrets(file string) (jwtKeyring, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Errorf("couldn't open jwt secrets file %s: %s", file, err)
+	}
+	defer f.Close()
+
+	var keyring jwtKeyring
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, errors.Errorf("bad line in jwt secrets file %s: expected kid:secret", file)
+		}
+		keyring = append(keyring, jwtKey{kid: line[:i], secret: []byte(line[i+1:])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Errorf("couldn't read jwt secrets file %s: %s", file, err)
+	}
+
+	return keyring, nil
+}
+
+//candidates returns the secret matching kid, or every secret when none does, in order.
+func (k jwtKeyring) candidates(kid string) jwtKeyring {
+	if kid != "" {
+		for _, s := range k {
+			if s.kid == kid {
+				return jwtKeyring{s}
+			}
+		}
+	}
+	return k
+}
+
+//parse verifies the token with the secret matching its kid header, or else with each secret in order until one verifies it.
+func (k jwtKeyring) parse(parser *jwt.Parser, tokenStr string) (*jwt.Token, error) {
+	unverified, _, err := parser.ParseUnverified(tokenStr, &Claims{})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := unverified.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.Errorf("unexpected signing method %s", unverified.Header["alg"])
+	}
+	kid, _ := unverified.Header["kid"].(string)
+
+	var token *jwt.Token
+	err = errors.New("no jwt secrets")
+	for _, s := range k.candidates(kid) {
+		secret := s.secret
+		token, err = parser.ParseWithClaims(tokenStr, &Claims{}, func(*jwt.Token) (interface{}, error) {
+			return secret, nil
+		})
+		if err == nil {
+			return token, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,98 @@
+package backends
+
+import (
+	"fmt"
+	"strconv"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//jwtRevocations checks tokens against Redis sets of revoked jtis and usernames, so compromised tokens may be invalidated before they expire.
+type jwtRevocations struct {
+	conn     *goredis.Client
+	jtisKey  string
+	usersKey string
+	failOpen bool
+}
+
+//newJWTRevocations connects to the Redis set by the jwt_revocation_redis_host, _port, _password and _db options.
+//Revoked jtis and usernames are the members of the <prefix>jtis and <prefix>users sets, with prefix given by jwt_revocation_redis_prefix.
+func newJWTRevocations(authOpts map[string]string) (*jwtRevocations, error) {
+	host := "localhost"
+	port := "6379"
+	db := 3
+	prefix := "mosquitto_auth:jwt_revocation:"
+	if revocationHost, ok := authOpts["jwt_revocation_redis_host"]; ok {
+		host = revocationHost
+	}
+	if revocationPort, ok := authOpts["jwt_revocation_redis_port"]; ok {
+		port = revocationPort
+	}
+	if revocationDB, ok := authOpts["jwt_revocation_redis_db"]; ok {
+		n, err := strconv.Atoi(revocationDB)
+		if err != nil {
+			return nil, errors.Errorf("couldn't parse jwt_revocation_redis_db %s", revocationDB)
+		}
+		db = n
+	}
+	if revocationPrefix, ok := authOpts["jwt_revocation_redis_prefix"]; ok {
+		prefix = revocationPrefix
+	}
+
+	dialer, err := common.NewDialer(authOpts, "jwt_revocation")
+	if err != nil {
+		return nil, err
+	}
+
+	addr := fmt.Sprintf("%s:%s", host, port)
+	conn := goredis.NewClient(&goredis.Options{
+		Addr:     addr,
+		Password: authOpts["jwt_revocation_redis_password"],
+		DB:       db,
+		Dialer:   dialer.RedisDialer(addr),
+	})
+	if _, err := conn.Ping().Result(); err != nil {
+		conn.Close()
+		return nil, errors.Errorf("couldn't connect to revocation Redis: %s", err)
+	}
+
+	return &jwtRevocations{
+		conn:     conn,
+		jtisKey:  prefix + "jtis",
+		usersKey: prefix + "users",
+		failOpen: authOpts["jwt_revocation_fail_open"] == "true",
+	}, nil
+}
+
+//revoked checks if the token's jti, if any, or username were revoked.
+//When Redis can't be reached tokens are taken as revoked, unless failing open.
+func (r *jwtRevocations) revoked(jti, username string) bool {
+	for _, check := range [][2]string{{r.jtisKey, jti}, {r.usersKey, username}} {
+		key, member := check[0], check[1]
+		if member == "" {
+			continue
+		}
+		revoked, err := r.conn.SIsMember(key, member).Result()
+		if err != nil {
+			log.Errorf("jwt revocation check error: %s", err)
+			if r.failOpen {
+				continue
+			}
+			return true
+		}
+		if revoked {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *jwtRevocations) halt() {
+	if err := r.conn.Close(); err != nil {
+		log.Errorf("jwt revocation cleanup error: %s", err)
+	}
+}
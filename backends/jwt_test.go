@@ -1,18 +1,32 @@
 package backends
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	goredis "github.com/go-redis/redis"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -48,6 +62,8 @@ var wrongJwtToken = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 
 func TestLocalPostgresJWT(t *testing.T) {
 
+	requireIntegration(t, "postgres")
+
 	Convey("Creating a token should return a nil error", t, func() {
 		token, err := jwtToken.SignedString([]byte(jwtSecret))
 		So(err, ShouldBeNil)
@@ -191,6 +207,8 @@ func TestLocalPostgresJWT(t *testing.T) {
 
 func TestLocalMysqlJWT(t *testing.T) {
 
+	requireIntegration(t, "mysql")
+
 	Convey("Creating a token should return a nil error", t, func() {
 		token, err := jwtToken.SignedString([]byte(jwtSecret))
 		So(err, ShouldBeNil)
@@ -1131,3 +1149,990 @@ func TestJWTFormTextResponseServer(t *testing.T) {
 	})
 
 }
+
+func TestJWTPublicKey(t *testing.T) {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	keyFile, err := ioutil.TempFile("", "jwt_pubkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.Write(keyPEM)
+	keyFile.Close()
+
+	claims := jwt.MapClaims{
+		"iss": "jwt-test",
+		"nbf": nowSecondsSinceEpoch,
+		"exp": expSecondsSinceEpoch,
+		"sub": "user",
+	}
+
+	Convey("Given a public key file, tokens signed with its private key should be verified", t, func() {
+		publicKey, err := loadPublicKey(keyFile.Name())
+		So(err, ShouldBeNil)
+		jwtBackend := JWT{PublicKey: publicKey}
+
+		for _, method := range []jwt.SigningMethod{jwt.SigningMethodRS256, jwt.SigningMethodRS384, jwt.SigningMethodRS512} {
+			token, err := jwt.NewWithClaims(method, claims).SignedString(privateKey)
+			So(err, ShouldBeNil)
+
+			parsed, err := jwtBackend.getClaims(token)
+			So(err, ShouldBeNil)
+			So(parsed.Subject, ShouldEqual, "user")
+		}
+
+		Convey("Tokens signed with another key should fail", func() {
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			So(err, ShouldBeNil)
+			token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(otherKey)
+			So(err, ShouldBeNil)
+
+			_, err = jwtBackend.getClaims(token)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens signed with HMAC using the public key as secret should fail", func() {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(keyPEM)
+			So(err, ShouldBeNil)
+
+			_, err = jwtBackend.getClaims(token)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a secret, tokens signed with RSA should fail", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+		So(err, ShouldBeNil)
+
+		_, err = jwtBackend.getClaims(token)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTJWKS(t *testing.T) {
+
+	type signingKey struct {
+		kid string
+		key *rsa.PrivateKey
+	}
+
+	newKey := func(kid string) signingKey {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signingKey{kid: kid, key: key}
+	}
+
+	var mu sync.Mutex
+	served := newKey("first")
+	fetches := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+
+		publicKey := served.key.PublicKey
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kid": served.kid,
+					"kty": "RSA",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+				},
+			},
+		})
+	}))
+	defer ts.Close()
+
+	claims := jwt.MapClaims{
+		"iss": "jwt-test",
+		"nbf": nowSecondsSinceEpoch,
+		"exp": expSecondsSinceEpoch,
+		"sub": "user",
+	}
+
+	sign := func(k signingKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = k.kid
+		signed, err := token.SignedString(k.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	Convey("Given a jwks url, tokens signed with a served key should be verified", t, func() {
+		mu.Lock()
+		first := served
+		mu.Unlock()
+
+		jwtBackend := JWT{JWKS: newJWKSKeySet(ts.URL, time.Hour, 0, nil)}
+		defer jwtBackend.JWKS.halt()
+
+		parsed, err := jwtBackend.getClaims(sign(first))
+		So(err, ShouldBeNil)
+		So(parsed.Subject, ShouldEqual, "user")
+
+		Convey("Tokens with an unknown kid should fail", func() {
+			_, err := jwtBackend.getClaims(sign(signingKey{kid: "unknown", key: first.key}))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens signed with a rotated key should be verified after refetching the keys", func() {
+			second := newKey("second")
+			mu.Lock()
+			served = second
+			mu.Unlock()
+
+			parsed, err := jwtBackend.getClaims(sign(second))
+			So(err, ShouldBeNil)
+			So(parsed.Subject, ShouldEqual, "user")
+
+			_, err = jwtBackend.getClaims(sign(first))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a minimum refresh interval, unknown kids shouldn't refetch the keys within it", t, func() {
+		jwtBackend := JWT{JWKS: newJWKSKeySet(ts.URL, time.Hour, time.Hour, nil)}
+		defer jwtBackend.JWKS.halt()
+
+		mu.Lock()
+		before := fetches
+		current := served
+		mu.Unlock()
+
+		_, err := jwtBackend.getClaims(sign(signingKey{kid: "unknown", key: current.key}))
+		So(err, ShouldNotBeNil)
+
+		mu.Lock()
+		So(fetches, ShouldEqual, before)
+		mu.Unlock()
+	})
+
+}
+
+func TestJWTUserField(t *testing.T) {
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":                          "jwt-test",
+		"nbf":                          nowSecondsSinceEpoch,
+		"exp":                          expSecondsSinceEpoch,
+		"sub":                          "5d1b2a7e",
+		"username":                     "loraserver",
+		"preferred_username":           "test",
+		"https://example.com/username": "namespaced",
+		"user": map[string]interface{}{
+			"email": "test@example.com",
+			"id":    12,
+		},
+	}).SignedString([]byte(jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Given a user field, the username should be taken from that claim", t, func() {
+		for field, expected := range map[string]string{
+			"":                             "5d1b2a7e",
+			"Subject":                      "5d1b2a7e",
+			"sub":                          "5d1b2a7e",
+			"Username":                     "loraserver",
+			"preferred_username":           "test",
+			"user.email":                   "test@example.com",
+			"https://example.com/username": "namespaced",
+		} {
+			jwtBackend := JWT{Secret: jwtSecret, UserField: field}
+			claims, err := jwtBackend.getClaims(token)
+			So(err, ShouldBeNil)
+
+			username, err := jwtBackend.claimsUsername(claims)
+			So(err, ShouldBeNil)
+			So(username, ShouldEqual, expected)
+		}
+	})
+
+	Convey("Given a user field for a missing or non string claim, getting the username should fail", t, func() {
+		for _, field := range []string{"email", "user.name", "user.id", "user", "sub.name"} {
+			jwtBackend := JWT{Secret: jwtSecret, UserField: field}
+			claims, err := jwtBackend.getClaims(token)
+			So(err, ShouldBeNil)
+
+			_, err = jwtBackend.claimsUsername(claims)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+}
+
+func TestJWTKeyring(t *testing.T) {
+
+	sign := func(secret, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"})
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	secretsFile, err := ioutil.TempFile("", "jwt_secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretsFile.Name())
+	secretsFile.WriteString("# rotated secrets\n2020-01:file secret\n\n2020-02:other:secret\n")
+	secretsFile.Close()
+
+	authOpts := map[string]string{
+		"jwt_secret":       jwtSecret,
+		"jwt_secret_2":     "second secret",
+		"jwt_secret_1":     "first secret",
+		"jwt_secrets_file": secretsFile.Name(),
+	}
+
+	Convey("Given several secrets, they should be kept in order with their kids", t, func() {
+		keyring, err := parseJWTKeyring(authOpts)
+		So(err, ShouldBeNil)
+		So(keyring, ShouldResemble, jwtKeyring{
+			{secret: []byte(jwtSecret)},
+			{kid: "1", secret: []byte("first secret")},
+			{kid: "2", secret: []byte("second secret")},
+			{kid: "2020-01", secret: []byte("file secret")},
+			{kid: "2020-02", secret: []byte("other:secret")},
+		})
+	})
+
+	Convey("Given a keyring, tokens should be verified by kid or by any secret", t, func() {
+		keyring, err := parseJWTKeyring(authOpts)
+		So(err, ShouldBeNil)
+		jwtBackend := JWT{Keyring: keyring}
+
+		for _, token := range []string{
+			sign(jwtSecret, ""),
+			sign("first secret", "1"),
+			sign("second secret", ""),
+			sign("file secret", "2020-01"),
+			sign("other:secret", "unknown"),
+		} {
+			claims, err := jwtBackend.getClaims(token)
+			So(err, ShouldBeNil)
+			So(claims.Subject, ShouldEqual, "user")
+		}
+
+		for _, token := range []string{
+			sign("wrong secret", ""),
+			sign("first secret", "2"),
+			sign(jwtSecret, "1"),
+		} {
+			_, err := jwtBackend.getClaims(token)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given a keyring, tokens not signed with HMAC should be rejected", t, func() {
+		keyring, err := parseJWTKeyring(authOpts)
+		So(err, ShouldBeNil)
+		jwtBackend := JWT{Keyring: keyring}
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{"sub": "user"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		So(err, ShouldBeNil)
+		_, err = jwtBackend.getClaims(token)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a missing secrets file or an empty secret, the keyring should fail", t, func() {
+		_, err := parseJWTKeyring(map[string]string{"jwt_secrets_file": "/nonexistent/jwt_secrets"})
+		So(err, ShouldNotBeNil)
+
+		_, err = parseJWTKeyring(map[string]string{"jwt_secret_1": ""})
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTRevocation(t *testing.T) {
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	authOpts := map[string]string{
+		"jwt_revocation_redis_host":   "localhost",
+		"jwt_revocation_redis_port":   "6379",
+		"jwt_revocation_redis_db":     "2",
+		"jwt_revocation_redis_prefix": "test:jwt_revocation:",
+	}
+
+	integrationConvey("redis")("Given a revocation list, tokens with a revoked jti or username should be rejected", t, func() {
+		revocations, err := newJWTRevocations(authOpts)
+		So(err, ShouldBeNil)
+		defer revocations.halt()
+
+		revocations.conn.SAdd("test:jwt_revocation:jtis", "revoked-jti")
+		revocations.conn.SAdd("test:jwt_revocation:users", "revoked-user")
+		defer revocations.conn.Del("test:jwt_revocation:jtis", "test:jwt_revocation:users")
+
+		jwtBackend := JWT{Secret: jwtSecret, Revocations: revocations}
+
+		_, err = jwtBackend.getClaims(sign(jwt.MapClaims{"sub": "user", "jti": "valid-jti"}))
+		So(err, ShouldBeNil)
+
+		_, err = jwtBackend.getClaims(sign(jwt.MapClaims{"sub": "user"}))
+		So(err, ShouldBeNil)
+
+		_, err = jwtBackend.getClaims(sign(jwt.MapClaims{"sub": "user", "jti": "revoked-jti"}))
+		So(err, ShouldNotBeNil)
+
+		_, err = jwtBackend.getClaims(sign(jwt.MapClaims{"sub": "revoked-user", "jti": "valid-jti"}))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given an unreachable revocation list, tokens should be taken as revoked unless failing open", t, func() {
+		revocations := &jwtRevocations{
+			conn:     goredis.NewClient(&goredis.Options{Addr: "localhost:1"}),
+			jtisKey:  "jtis",
+			usersKey: "users",
+		}
+		defer revocations.halt()
+
+		So(revocations.revoked("jti", "user"), ShouldBeTrue)
+
+		revocations.failOpen = true
+		So(revocations.revoked("jti", "user"), ShouldBeFalse)
+	})
+
+}
+
+func TestJWTClaimsCache(t *testing.T) {
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	Convey("Given a claims cache, verified tokens should not be verified again", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret, ClaimsCache: newClaimsCache(10, time.Minute)}
+		token := sign(jwt.MapClaims{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()})
+
+		claims, err := jwtBackend.getClaims(token)
+		So(err, ShouldBeNil)
+		So(claims.Subject, ShouldEqual, "user")
+
+		//With another secret the token wouldn't verify, so it must come from the cache.
+		jwtBackend.Secret = "other secret"
+		cached, err := jwtBackend.getClaims(token)
+		So(err, ShouldBeNil)
+		So(cached, ShouldEqual, claims)
+
+		_, err = jwtBackend.getClaims(sign(jwt.MapClaims{"sub": "other"}))
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a claims cache, entries should not outlive the token nor the ttl", t, func() {
+		cache := newClaimsCache(10, time.Minute)
+		claims := &Claims{}
+
+		cache.set("expired", claims, time.Now().Add(-time.Second))
+		_, ok := cache.get("expired")
+		So(ok, ShouldBeFalse)
+
+		cache.set("expiring", claims, time.Now().Add(50*time.Millisecond))
+		_, ok = cache.get("expiring")
+		So(ok, ShouldBeTrue)
+
+		short := newClaimsCache(10, 50*time.Millisecond)
+		short.set("forever", claims, time.Time{})
+		_, ok = short.get("forever")
+		So(ok, ShouldBeTrue)
+
+		time.Sleep(100 * time.Millisecond)
+
+		_, ok = cache.get("expiring")
+		So(ok, ShouldBeFalse)
+		_, ok = short.get("forever")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given a full claims cache, it should stay bounded", t, func() {
+		cache := newClaimsCache(2, time.Minute)
+		for _, token := range []string{"a", "b", "c", "d"} {
+			cache.set(token, &Claims{}, time.Time{})
+		}
+		So(len(cache.entries), ShouldEqual, 2)
+
+		_, ok := cache.get("d")
+		So(ok, ShouldBeTrue)
+	})
+
+	Convey("Given a token, its expiry should include the leeway unless expiration is skipped", t, func() {
+		exp := time.Now().Add(time.Hour).Unix()
+		claims := &Claims{StandardClaims: jwt.StandardClaims{ExpiresAt: exp}}
+
+		So(JWT{}.claimsExpiry(claims), ShouldResemble, time.Unix(exp, 0))
+		So(JWT{Leeway: time.Minute}.claimsExpiry(claims), ShouldResemble, time.Unix(exp, 0).Add(time.Minute))
+		So(JWT{SkipExpiration: true}.claimsExpiry(claims).IsZero(), ShouldBeTrue)
+		So(JWT{}.claimsExpiry(&Claims{}).IsZero(), ShouldBeTrue)
+	})
+
+}
+
+func TestJWTSuperuserClaim(t *testing.T) {
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	Convey("Given a superuser claim, tokens setting it to true should be superusers without a superuser query", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret, SuperuserClaim: "is_admin"}
+
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "admin", "is_admin": true})), ShouldBeTrue)
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "admin", "is_admin": "true"})), ShouldBeTrue)
+
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "user", "is_admin": false})), ShouldBeFalse)
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "user", "is_admin": 1})), ShouldBeFalse)
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "user"})), ShouldBeFalse)
+	})
+
+	Convey("Given a nested superuser claim, it should be found by its path", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret, SuperuserClaim: "permissions.admin"}
+
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "admin", "permissions": map[string]interface{}{"admin": true}})), ShouldBeTrue)
+		So(jwtBackend.GetSuperuser(sign(jwt.MapClaims{"sub": "user", "permissions": map[string]interface{}{"admin": false}})), ShouldBeFalse)
+	})
+
+	Convey("Given a superuser claim, tokens signed with another secret should not be superusers", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret, SuperuserClaim: "is_admin"}
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "admin", "is_admin": true}).SignedString([]byte("other secret"))
+		So(err, ShouldBeNil)
+		So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+	})
+
+}
+
+func TestJWTPasswordFallback(t *testing.T) {
+
+	Convey("Given password fallback, credentials that aren't a token should be reported as not found", t, func() {
+		jwtBackend, err := NewJWT(map[string]string{
+			"jwt_secret":            jwtSecret,
+			"jwt_password_fallback": "true",
+			"jwt_delegate":          "files",
+			"password_path":         "../test-files/passwords",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer jwtBackend.Halt()
+
+		granted, err := jwtBackend.UserCheck("test1", "test1")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		granted, err = jwtBackend.SuperuserCheck("test1")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		granted, err = jwtBackend.AclCheck("test1", "test/topic/1", "id", MOSQ_ACL_READ)
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrNotFound)
+
+		Convey("Tokens should still be checked, and those failing verification denied as bad credentials", func() {
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "test1"}).SignedString([]byte(jwtSecret))
+			So(err, ShouldBeNil)
+			So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+
+			forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "test1"}).SignedString([]byte("other secret"))
+			So(err, ShouldBeNil)
+			granted, err := jwtBackend.UserCheck(forged, "")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+		})
+	})
+
+}
+
+func TestJWTDelegate(t *testing.T) {
+
+	pwPath, _ := filepath.Abs("../test-files/passwords")
+	aclPath, _ := filepath.Abs("../test-files/acls")
+	authOpts := map[string]string{
+		"jwt_secret":    jwtSecret,
+		"jwt_delegate":  "files",
+		"password_path": pwPath,
+		"acl_path":      aclPath,
+	}
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	Convey("Given a delegate, checks for the token's username should be forwarded to it", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer jwtBackend.Halt()
+		So(jwtBackend.Delegate, ShouldHaveSameTypeAs, Files{})
+
+		token := sign(jwt.MapClaims{"sub": "test1"})
+
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+		So(jwtBackend.CheckAcl(token, "test/topic/1", "id", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(jwtBackend.CheckAcl(token, "test/topic/2", "id", MOSQ_ACL_WRITE), ShouldBeFalse)
+
+		Convey("Tokens that don't verify should be denied without asking the delegate", func() {
+			forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "test1"}).SignedString([]byte("other secret"))
+			So(err, ShouldBeNil)
+
+			So(jwtBackend.GetUser(forged, ""), ShouldBeFalse)
+			So(jwtBackend.CheckAcl(forged, "test/topic/1", "id", MOSQ_ACL_WRITE), ShouldBeFalse)
+		})
+
+		Convey("The delegate should check the password when told to", func() {
+			jwtBackend.DelegatePassword = true
+
+			So(jwtBackend.GetUser(token, "test1"), ShouldBeTrue)
+			So(jwtBackend.GetUser(token, "wrong"), ShouldBeFalse)
+		})
+
+		Convey("Credentials that aren't a token should be left to other backends instead of the delegate", func() {
+			jwtBackend.PasswordFallback = true
+
+			granted, err := jwtBackend.UserCheck("test1", "test1")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		})
+	})
+
+	integrationConvey("redis")("Given redis as jwt db, token users should be checked against Redis users and acls", t, func() {
+		jwtBackend, err := NewJWT(map[string]string{
+			"jwt_secret": jwtSecret,
+			"jwt_db":     "redis",
+			"redis_host": "localhost",
+			"redis_port": "6379",
+			"redis_db":   "2",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer jwtBackend.Halt()
+
+		redis, ok := jwtBackend.Delegate.(Redis)
+		So(ok, ShouldBeTrue)
+		redis.Conn.FlushDB()
+		defer redis.Conn.FlushDB()
+		redis.Conn.Set("test1", userPassHash, 0)
+		redis.Conn.SAdd("test1:racls", "test/topic/1")
+
+		token := sign(jwt.MapClaims{"sub": "test1"})
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.CheckAcl(token, "test/topic/1", "id", MOSQ_ACL_READ), ShouldBeTrue)
+		So(jwtBackend.CheckAcl(token, "test/topic/2", "id", MOSQ_ACL_READ), ShouldBeFalse)
+
+		granted, err := jwtBackend.UserCheck(sign(jwt.MapClaims{"sub": "unknown"}), "")
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrNotFound)
+	})
+
+	Convey("Given jwt as delegate, the backend should fail", t, func() {
+		_, err := NewJWT(map[string]string{"jwt_secret": jwtSecret, "jwt_delegate": "jwt"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+}
+
+func TestJWTLeeway(t *testing.T) {
+
+	now := time.Now()
+
+	sign := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(jwtSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	expired := sign(jwt.MapClaims{"sub": "user", "exp": now.Add(-30 * time.Second).Unix()})
+	notYetValid := sign(jwt.MapClaims{"sub": "user", "nbf": now.Add(30 * time.Second).Unix(), "iat": now.Add(30 * time.Second).Unix()})
+	longExpired := sign(jwt.MapClaims{"sub": "user", "exp": now.Add(-24 * time.Hour).Unix()})
+
+	Convey("Given no leeway, tokens just expired or not yet valid should fail", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret}
+
+		_, err := jwtBackend.getClaims(expired)
+		So(err, ShouldNotBeNil)
+
+		_, err = jwtBackend.getClaims(notYetValid)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a leeway, tokens within it should be valid", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret, Leeway: time.Minute}
+
+		_, err := jwtBackend.getClaims(expired)
+		So(err, ShouldBeNil)
+
+		_, err = jwtBackend.getClaims(notYetValid)
+		So(err, ShouldBeNil)
+
+		_, err = jwtBackend.getClaims(longExpired)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given skipped expiration, expired tokens should be valid but not those not yet valid", t, func() {
+		jwtBackend := JWT{Secret: jwtSecret, SkipExpiration: true}
+
+		_, err := jwtBackend.getClaims(longExpired)
+		So(err, ShouldBeNil)
+
+		_, err = jwtBackend.getClaims(notYetValid)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a token, its expiration should be told without verifying it, honoring leeway", t, func() {
+		jwtBackend := JWT{}
+		So(jwtBackend.TokenExpired(expired), ShouldBeTrue)
+		So(jwtBackend.TokenExpired(longExpired), ShouldBeTrue)
+		So(jwtBackend.TokenExpired(notYetValid), ShouldBeFalse)
+		So(jwtBackend.TokenExpired("not a token"), ShouldBeFalse)
+
+		jwtBackend = JWT{Leeway: time.Minute}
+		So(jwtBackend.TokenExpired(expired), ShouldBeFalse)
+		So(jwtBackend.TokenExpired(longExpired), ShouldBeTrue)
+
+		jwtBackend = JWT{SkipExpiration: true}
+		So(jwtBackend.TokenExpired(longExpired), ShouldBeFalse)
+	})
+
+}
+
+func TestJWTJWE(t *testing.T) {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, err := ioutil.TempFile("", "jwt_jwe_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	keyFile.Write(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}))
+	keyFile.Close()
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "user",
+		"jti": "encrypted-jti",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte(jwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypt := func(payload string, alg string, publicKey *rsa.PublicKey) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","enc":"A256GCM","cty":"JWT"}`))
+
+		cek := make([]byte, 32)
+		iv := make([]byte, 12)
+		rand.Read(cek)
+		rand.Read(iv)
+
+		oaepHash := sha1.New()
+		if alg == "RSA-OAEP-256" {
+			oaepHash = sha256.New()
+		}
+		encryptedKey, err := rsa.EncryptOAEP(oaepHash, rand.Reader, publicKey, cek, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block, _ := aes.NewCipher(cek)
+		gcm, _ := cipher.NewGCM(block)
+		sealed := gcm.Seal(nil, iv, []byte(payload), []byte(header))
+		ciphertext, tag := sealed[:len(sealed)-16], sealed[len(sealed)-16:]
+
+		return strings.Join([]string{
+			header,
+			base64.RawURLEncoding.EncodeToString(encryptedKey),
+			base64.RawURLEncoding.EncodeToString(iv),
+			base64.RawURLEncoding.EncodeToString(ciphertext),
+			base64.RawURLEncoding.EncodeToString(tag),
+		}, ".")
+	}
+
+	Convey("Given a jwe private key, encrypted tokens should be decrypted and then verified", t, func() {
+		decrypter, err := newJWEDecrypter(keyFile.Name(), false)
+		So(err, ShouldBeNil)
+		jwtBackend := JWT{Secret: jwtSecret, JWE: decrypter, CacheByJti: true}
+
+		for _, alg := range []string{"RSA-OAEP", "RSA-OAEP-256"} {
+			token := encrypt(signed, alg, &privateKey.PublicKey)
+			So(isJWT(token), ShouldBeTrue)
+
+			claims, err := jwtBackend.getClaims(token)
+			So(err, ShouldBeNil)
+			So(claims.Subject, ShouldEqual, "user")
+
+			jti, _, ok := jwtBackend.TokenID(token)
+			So(ok, ShouldBeTrue)
+			So(jti, ShouldEqual, "encrypted-jti")
+			So(jwtBackend.TokenExpired(token), ShouldBeFalse)
+		}
+
+		Convey("Unencrypted tokens should still be verified unless encryption is required", func() {
+			_, err := jwtBackend.getClaims(signed)
+			So(err, ShouldBeNil)
+
+			jwtBackend.JWE.required = true
+			_, err = jwtBackend.getClaims(signed)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tokens encrypted for another key should fail", func() {
+			otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			So(err, ShouldBeNil)
+
+			_, err = jwtBackend.getClaims(encrypt(signed, "RSA-OAEP", &otherKey.PublicKey))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Tampered tokens should fail", func() {
+			parts := strings.Split(encrypt(signed, "RSA-OAEP", &privateKey.PublicKey), ".")
+			parts[0] = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RSA-OAEP","enc":"A256GCM"}`))
+
+			_, err := jwtBackend.getClaims(strings.Join(parts, "."))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Encrypted tokens whose signature doesn't verify should fail", func() {
+			forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user"}).SignedString([]byte("other secret"))
+			So(err, ShouldBeNil)
+
+			_, err = jwtBackend.getClaims(encrypt(forged, "RSA-OAEP", &privateKey.PublicKey))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+}
+
+func TestJWTMethodsAndTemplates(t *testing.T) {
+
+	token, _ := jwtToken.SignedString([]byte(jwtSecret))
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		granted := r.Header.Get("authorization") == token
+		switch r.URL.EscapedPath() {
+		case "/users/test":
+			granted = granted && r.Method == http.MethodGet
+		case "/acl/test/test%2Ftopic":
+			granted = granted && r.Method == http.MethodGet && r.URL.Query().Get("clientid") == "client"
+		default:
+			granted = false
+		}
+
+		if granted {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "true"
+	authOpts["jwt_params_mode"] = "json"
+	authOpts["jwt_response_mode"] = "status"
+	authOpts["jwt_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["jwt_port"] = ""
+	authOpts["jwt_userfield"] = "Username"
+	authOpts["jwt_getuser_uri"] = "/users/%u"
+	authOpts["jwt_getuser_method"] = "GET"
+	authOpts["jwt_superuser_uri"] = "/superusers/%u"
+	authOpts["jwt_aclcheck_uri"] = "/acl/%u/%t"
+	authOpts["jwt_aclcheck_method"] = "GET"
+
+	Convey("Given methods and uri templates, checks should be requested with them and the token's username", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+		So(jwtBackend.CheckAcl(token, "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(jwtBackend.CheckAcl(token, "test/other", "client", MOSQ_ACL_READ), ShouldBeFalse)
+	})
+
+}
+
+func TestJWTEndpointHosts(t *testing.T) {
+
+	token, _ := jwtToken.SignedString([]byte(jwtSecret))
+
+	handler := func(path string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == path && r.Header.Get("authorization") == token {
+				w.WriteHeader(http.StatusOK)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}
+	}
+
+	usersServer := httptest.NewServer(handler("/user"))
+	defer usersServer.Close()
+	aclsServer := httptest.NewServer(handler("/acl"))
+	defer aclsServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "true"
+	authOpts["jwt_params_mode"] = "json"
+	authOpts["jwt_response_mode"] = "status"
+	authOpts["jwt_port"] = ""
+	authOpts["jwt_getuser_uri"] = "/user"
+	authOpts["jwt_superuser_uri"] = "/superuser"
+	authOpts["jwt_aclcheck_uri"] = "/acl"
+	authOpts["jwt_getuser_host"] = strings.Replace(usersServer.URL, "http://", "", -1)
+	authOpts["jwt_aclcheck_host"] = strings.Replace(aclsServer.URL, "http://", "", -1)
+
+	Convey("Given no host for some check, the backend should fail", t, func() {
+		_, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given per endpoint hosts, each check should be requested from its own host", t, func() {
+		authOpts["jwt_host"] = strings.Replace(usersServer.URL, "http://", "", -1)
+		defer delete(authOpts, "jwt_host")
+
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+		So(jwtBackend.CheckAcl(token, "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+}
+
+func TestJWTResponseMapping(t *testing.T) {
+
+	token, _ := jwtToken.SignedString([]byte(jwtSecret))
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		granted := r.Header.Get("authorization") == token && r.URL.Path != "/superuser"
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"allowed": granted, "reason": "checked"}})
+
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "true"
+	authOpts["jwt_params_mode"] = "json"
+	authOpts["jwt_response_mode"] = "json"
+	authOpts["jwt_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["jwt_port"] = ""
+	authOpts["jwt_getuser_uri"] = "/user"
+	authOpts["jwt_superuser_uri"] = "/superuser"
+	authOpts["jwt_aclcheck_uri"] = "/acl"
+	authOpts["jwt_response_ok_path"] = "data.allowed"
+	authOpts["jwt_response_error_path"] = "data.reason"
+
+	Convey("Given response paths, checks should be granted by the mapped fields", t, func() {
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.GetUser("wrong_token", ""), ShouldBeFalse)
+		So(jwtBackend.GetSuperuser(token), ShouldBeFalse)
+		So(jwtBackend.CheckAcl(token, "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+}
+
+func TestJWTRemoteCredentials(t *testing.T) {
+
+	token, _ := jwtToken.SignedString([]byte(jwtSecret))
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") == "api_key" && r.Header.Get("Authorization") == token {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	defer mockServer.Close()
+
+	authOpts := make(map[string]string)
+	authOpts["jwt_remote"] = "true"
+	authOpts["jwt_host"] = strings.Replace(mockServer.URL, "http://", "", -1)
+	authOpts["jwt_port"] = ""
+	authOpts["jwt_getuser_uri"] = "/user"
+	authOpts["jwt_superuser_uri"] = "/superuser"
+	authOpts["jwt_aclcheck_uri"] = "/acl"
+	authOpts["jwt_auth_header"] = "api_key"
+
+	Convey("Given credentials at the Authorization header, the backend should fail as tokens are sent there", t, func() {
+		_, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given credentials at another header, requests should carry both them and the token", t, func() {
+		authOpts["jwt_auth_header_name"] = "X-Api-Key"
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+		So(jwtBackend.CheckAcl(token, "test/topic", "client", MOSQ_ACL_READ), ShouldBeTrue)
+	})
+
+	Convey("Given static headers, requests should carry them, but not at the Authorization header", t, func() {
+		authOpts["jwt_header_X-Tenant-ID"] = "tenant"
+		jwtBackend, err := NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		So(jwtBackend.Headers.Get("X-Tenant-Id"), ShouldEqual, "tenant")
+		So(jwtBackend.GetUser(token, ""), ShouldBeTrue)
+
+		authOpts["jwt_header_Authorization"] = "Bearer other"
+		_, err = NewJWT(authOpts, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+		delete(authOpts, "jwt_header_Authorization")
+	})
+
+}
@@ -0,0 +1,227 @@
+package backends
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//keycloakRoleAclPrefix prefixes the options giving the acls each role grants, e.g. keycloak_role_acl_device.
+const keycloakRoleAclPrefix = "keycloak_role_acl_"
+
+//Keycloak authenticates clients giving a token issued by a Keycloak realm as their password, as the oidc backend does,
+//and answers superuser and acl checks from the realm and client roles the token grants.
+type Keycloak struct {
+	OIDC
+	URL            string
+	Realm          string
+	ClientID       string
+	RoleClients    []string //RoleClients are the clients whose roles are read from resource_access along with realm roles.
+	SuperuserRoles map[string]bool
+	RoleAcls       map[string][]ManifestAcl
+}
+
+func init() {
+	register("keycloak", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewKeycloak(authOpts, logLevel)
+	})
+}
+
+//NewKeycloak initializes a Keycloak backend for the given realm, failing if its discovery document can't be fetched.
+func NewKeycloak(authOpts map[string]string, logLevel log.Level) (Keycloak, error) {
+
+	log.SetLevel(logLevel)
+
+	var k = Keycloak{
+		SuperuserRoles: make(map[string]bool),
+		RoleAcls:       make(map[string][]ManifestAcl),
+	}
+
+	if keycloakURL, ok := authOpts["keycloak_url"]; ok && strings.TrimSpace(keycloakURL) != "" {
+		k.URL = strings.TrimSuffix(strings.TrimSpace(keycloakURL), "/")
+	} else {
+		return k, errors.New("Keycloak backend error: missing option keycloak_url.\n")
+	}
+
+	if realm, ok := authOpts["keycloak_realm"]; ok && strings.TrimSpace(realm) != "" {
+		k.Realm = strings.TrimSpace(realm)
+	} else {
+		return k, errors.New("Keycloak backend error: missing option keycloak_realm.\n")
+	}
+
+	k.ClientID = strings.TrimSpace(authOpts["keycloak_client_id"])
+
+	if roleClients, ok := authOpts["keycloak_role_clients"]; ok {
+		for _, client := range strings.Split(roleClients, ",") {
+			if client = strings.TrimSpace(client); client != "" {
+				k.RoleClients = append(k.RoleClients, client)
+			}
+		}
+	} else if k.ClientID != "" {
+		k.RoleClients = []string{k.ClientID}
+	}
+
+	if superuserRoles, ok := authOpts["keycloak_superuser_roles"]; ok {
+		for _, role := range strings.Split(superuserRoles, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				k.SuperuserRoles[role] = true
+			}
+		}
+	}
+
+	for option, value := range authOpts {
+		if !strings.HasPrefix(option, keycloakRoleAclPrefix) {
+			continue
+		}
+		role := strings.TrimPrefix(option, keycloakRoleAclPrefix)
+		acls, err := parseRoleAcls(value)
+		if err != nil {
+			return k, errors.Errorf("Keycloak backend error: wrong %s format: %s\n", option, err)
+		}
+		if role == "" || len(acls) == 0 {
+			return k, errors.Errorf("Keycloak backend error: %s must name a role and give its acls.\n", option)
+		}
+		k.RoleAcls[role] = acls
+	}
+
+	var err error
+	k.OIDC, err = newOIDC(authOpts, "keycloak", k.URL+"/realms/"+k.Realm)
+	if err != nil {
+		return k, errors.Errorf("Keycloak backend error: %s\n", err)
+	}
+
+	//Keycloak's access tokens are meant for the account service unless an audience mapper says otherwise,
+	//so without an explicit audience tokens must have been issued to the client.
+	if _, ok := authOpts["keycloak_audience"]; !ok {
+		k.AuthorizedParty = k.ClientID
+	}
+	if _, ok := authOpts["keycloak_username_claim"]; !ok {
+		k.UsernameClaim = "preferred_username"
+	}
+
+	if k.Audience == "" && k.AuthorizedParty == "" {
+		log.Warning("No keycloak_client_id nor keycloak_audience given, so tokens issued for any client of the realm will be accepted.")
+	}
+
+	roles := make([]string, 0, len(k.RoleAcls))
+	for role := range k.RoleAcls {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	log.Infof("keycloak: realm %s with acls for roles %s", k.Realm, strings.Join(roles, ", "))
+
+	return k, nil
+}
+
+//parseRoleAcls parses a role's comma separated acls, each a topic optionally preceded by its acc, which may be read, write, readwrite or subscribe,
+//e.g. devices/%u/#, read:config/#. Topics without acc are granted readwrite.
+func parseRoleAcls(s string) ([]ManifestAcl, error) {
+	var acls []ManifestAcl
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		acl := ManifestAcl{Topic: item, Acc: MOSQ_ACL_READWRITE}
+		if i := strings.Index(item, ":"); i > 0 {
+			switch item[:i] {
+			case "read":
+				acl = ManifestAcl{Topic: item[i+1:], Acc: MOSQ_ACL_READ}
+			case "write":
+				acl = ManifestAcl{Topic: item[i+1:], Acc: MOSQ_ACL_WRITE}
+			case "readwrite":
+				acl = ManifestAcl{Topic: item[i+1:], Acc: MOSQ_ACL_READWRITE}
+			case "subscribe":
+				acl = ManifestAcl{Topic: item[i+1:], Acc: MOSQ_ACL_SUBSCRIBE}
+			}
+		}
+
+		if acl.Topic == "" {
+			return nil, errors.Errorf("missing topic in %s", item)
+		}
+		if err := common.ValidateAclTopic(acl.Topic); err != nil {
+			return nil, err
+		}
+		acls = append(acls, acl)
+	}
+	return acls, nil
+}
+
+//GetSuperuser checks that the user's token hasn't expired and grants one of the superuser roles, or is a superuser as the oidc backend tells.
+func (k Keycloak) GetSuperuser(username string) bool {
+	if len(k.SuperuserRoles) == 0 && len(k.SuperuserGroups) == 0 && k.SuperuserScope == "" {
+		return false
+	}
+
+	session, ok := k.session(username)
+	if !ok {
+		return false
+	}
+
+	for _, role := range k.roles(session) {
+		if k.SuperuserRoles[role] {
+			return true
+		}
+	}
+	return k.superuser(session)
+}
+
+//CheckAcl checks that the user's token hasn't expired and one of its roles, groups or scopes grants acc on topic.
+func (k Keycloak) CheckAcl(username, topic, clientid string, acc int32) bool {
+	session, ok := k.session(username)
+	if !ok {
+		return false
+	}
+
+	for _, role := range k.roles(session) {
+		if acls, ok := k.RoleAcls[role]; ok && ManifestAllows(acls, username, topic, clientid, acc) {
+			return true
+		}
+	}
+	return k.allows(session, username, topic, clientid, acc)
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+//It's Keycloak's own, as the one of the oidc backend would check without roles.
+func (k Keycloak) SuperuserCheck(username string) (bool, error) {
+	k.errs = &checkErrors{}
+	granted := k.GetSuperuser(username)
+	return granted, k.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+//It's Keycloak's own, as the one of the oidc backend would check without roles.
+func (k Keycloak) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	k.errs = &checkErrors{}
+	granted := k.CheckAcl(username, topic, clientid, acc)
+	return granted, k.errs.take()
+}
+
+//roles returns the realm roles the session's token grants, given by realm_access.roles, and those of the role clients, given by resource_access.<client>.roles.
+//Client ids may hold dots, so resource_access is walked by hand rather than as a dotted claim path.
+func (k Keycloak) roles(session oidcSession) []string {
+	roles := k.claimStrings(session, "realm_access.roles")
+
+	resourceAccess, _ := session.claims["resource_access"].(map[string]interface{})
+	for _, client := range k.RoleClients {
+		access, _ := resourceAccess[client].(map[string]interface{})
+		roles = append(roles, k.claimStrings(oidcSession{claims: access}, "roles")...)
+	}
+	return roles
+}
+
+//Capabilities tells superusers are only checked when superuser roles, groups or a scope are given.
+func (k Keycloak) Capabilities() Capabilities {
+	return Capabilities{User: true, Superuser: len(k.SuperuserRoles) > 0 || len(k.SuperuserGroups) > 0 || k.SuperuserScope != "", Acl: true}
+}
+
+//GetName returns the backend's name
+func (k Keycloak) GetName() string {
+	return "Keycloak"
+}
@@ -0,0 +1,144 @@
+package backends
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeycloak(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var realm string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/iot/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":   realm,
+			"jwks_uri": realm + "/protocol/openid-connect/certs",
+		})
+	})
+	mux.HandleFunc("/realms/iot/protocol/openid-connect/certs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kid": "realm-key",
+					"kty": "RSA",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				},
+			},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	realm = server.URL + "/realms/iot"
+
+	//sign issues a token like Keycloak's access tokens, meant for the account service and issued to the mqtt client.
+	sign := func(username string, realmRoles []string, clientRoles map[string][]string, azp string) string {
+		resourceAccess := map[string]interface{}{"account": map[string]interface{}{"roles": []string{"view-profile"}}}
+		for client, roles := range clientRoles {
+			resourceAccess[client] = map[string]interface{}{"roles": roles}
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":                realm,
+			"aud":                "account",
+			"azp":                azp,
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"sub":                "5c1e2f10",
+			"preferred_username": username,
+			"realm_access":       map[string]interface{}{"roles": realmRoles},
+			"resource_access":    resourceAccess,
+		})
+		token.Header["kid"] = "realm-key"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	authOpts := map[string]string{
+		"keycloak_url":                server.URL + "/",
+		"keycloak_realm":              "iot",
+		"keycloak_client_id":          "mqtt",
+		"keycloak_superuser_roles":    "broker-admin",
+		"keycloak_role_acl_device":    "devices/%u/#, read:config/{{username | split \"-\" 0}}/#",
+		"keycloak_role_acl_dashboard": "subscribe:devices/+/status",
+	}
+
+	Convey("Given wrong options, the backend should fail to start", t, func() {
+		for option, value := range map[string]string{
+			"keycloak_realm":           "other",
+			"keycloak_role_acl_device": "read:",
+			"keycloak_role_acl_":       "devices/#",
+		} {
+			opts := make(map[string]string)
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			opts[option] = value
+			_, err := NewKeycloak(opts, log.DebugLevel)
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Given a realm, tokens issued to the client should be verified and their roles mapped to acls", t, func() {
+		k, err := NewKeycloak(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer k.Halt()
+
+		So(k.Issuer, ShouldEqual, realm)
+		So(k.Capabilities().Superuser, ShouldBeTrue)
+
+		So(k.GetUser("sensor-1", sign("sensor-1", []string{"device"}, nil, "mqtt")), ShouldBeTrue)
+		granted, err := k.UserCheck("sensor-1", sign("sensor-1", []string{"device"}, nil, "other-client"))
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+
+		So(k.GetSuperuser("sensor-1"), ShouldBeFalse)
+		So(k.CheckAcl("sensor-1", "devices/sensor-1/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(k.CheckAcl("sensor-1", "devices/sensor-2/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		So(k.CheckAcl("sensor-1", "config/sensor/rate", "client", MOSQ_ACL_READ), ShouldBeTrue)
+		So(k.CheckAcl("sensor-1", "config/sensor/rate", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+
+		Convey("Client roles should only be read for the role clients", func() {
+			So(k.GetUser("ops", sign("ops", nil, map[string][]string{"mqtt": {"dashboard", "broker-admin"}}, "mqtt")), ShouldBeTrue)
+			So(k.GetSuperuser("ops"), ShouldBeTrue)
+			So(k.CheckAcl("ops", "devices/sensor-1/status", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeTrue)
+
+			So(k.GetUser("ops", sign("ops", nil, map[string][]string{"other": {"dashboard", "broker-admin"}}, "mqtt")), ShouldBeTrue)
+			So(k.GetSuperuser("ops"), ShouldBeFalse)
+			So(k.CheckAcl("ops", "devices/sensor-1/status", "client", MOSQ_ACL_SUBSCRIBE), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given an audience, it should be checked instead of the client", t, func() {
+		opts := make(map[string]string)
+		for k, v := range authOpts {
+			opts[k] = v
+		}
+		opts["keycloak_audience"] = "account"
+
+		k, err := NewKeycloak(opts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer k.Halt()
+
+		So(k.GetUser("sensor-1", sign("sensor-1", []string{"device"}, nil, "other-client")), ShouldBeTrue)
+	})
+}
@@ -0,0 +1,128 @@
+package backends
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//ManifestAcl is a topic a user may access, with the acc values used for acl checks (1 read, 2 write, 3 readwrite, 4 subscribe).
+type ManifestAcl struct {
+	Topic string `json:"topic"`
+	Acc   int32  `json:"acc"`
+}
+
+//Manifester is implemented by backends that may return every topic a user is allowed to access when authenticating it.
+type Manifester interface {
+	//Manifest returns the permission manifest for a user that was just authenticated by the backend, if any.
+	Manifest(username string) ([]ManifestAcl, bool)
+}
+
+//manifestStore keeps the manifests returned by remote user checks until they're taken.
+type manifestStore struct {
+	sync.Mutex
+	manifests map[string][]ManifestAcl
+}
+
+func newManifestStore() *manifestStore {
+	return &manifestStore{
+		manifests: make(map[string][]ManifestAcl),
+	}
+}
+
+func (s *manifestStore) set(username string, acls []ManifestAcl) {
+	s.Lock()
+	defer s.Unlock()
+	s.manifests[username] = acls
+}
+
+func (s *manifestStore) take(username string) ([]ManifestAcl, bool) {
+	s.Lock()
+	defer s.Unlock()
+	acls, ok := s.manifests[username]
+	delete(s.manifests, username)
+	return acls, ok
+}
+
+//parseManifest decodes a manifest from a json value, as found in a response field or a token claim.
+func parseManifest(value interface{}) ([]ManifestAcl, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var acls []ManifestAcl
+	if err := json.Unmarshal(raw, &acls); err != nil {
+		return nil, err
+	}
+	return acls, nil
+}
+
+//queryManifest runs a query that returns topic and acc rows for username. No rows means there's no manifest.
+func queryManifest(db *sqlx.DB, query, username, backend string) ([]ManifestAcl, bool) {
+
+	if query == "" {
+		return nil, false
+	}
+
+	rows, err := db.Queryx(query, username)
+	if err != nil {
+		log.Debugf("%s manifest error: %s\n", backend, err)
+		return nil, false
+	}
+	defer rows.Close()
+
+	var acls []ManifestAcl
+	for rows.Next() {
+		var acl ManifestAcl
+		if err := rows.Scan(&acl.Topic, &acl.Acc); err != nil {
+			log.Debugf("%s manifest scan error: %s\n", backend, err)
+			return nil, false
+		}
+		acls = append(acls, acl)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Debugf("%s manifest error: %s\n", backend, err)
+		return nil, false
+	}
+
+	return acls, len(acls) > 0
+
+}
+
+//ManifestAllows checks if a manifest grants acc on topic, replacing %u, %c and templates in its topics. Read acls allow subscribing, except to #.
+//Manifests over the acl limits allow nothing.
+func ManifestAllows(acls []ManifestAcl, username, topic, clientid string, acc int32) bool {
+	if err := CheckManifestLimits(acls, username); err != nil {
+		log.Errorf("manifest acl error: %s", err)
+		return false
+	}
+
+	for _, acl := range acls {
+		aclTopic, ok := common.ExpandAclTopic(acl.Topic, username, clientid)
+		if !ok || !common.TopicsMatch(aclTopic, topic) {
+			continue
+		}
+		if acc == acl.Acc || acl.Acc == MOSQ_ACL_READWRITE || (acc == MOSQ_ACL_SUBSCRIBE && topic != "#" && acl.Acc == MOSQ_ACL_READ) {
+			return true
+		}
+	}
+	return false
+}
+
+//CheckManifestLimits checks a manifest's acls are within the acl limits, as set with common.SetAclLimits.
+func CheckManifestLimits(acls []ManifestAcl, username string) error {
+	if err := common.CheckAclRuleCount(username, len(acls)); err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		if err := common.CheckAclRule(username, acl.Topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
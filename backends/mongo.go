@@ -1,9 +1,10 @@
+// +build !nomongo
+
 package backends
 
 import (
 	"context"
 	"fmt"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -26,6 +27,8 @@ type Mongo struct {
 	UsersCollection string
 	AclsCollection  string
 	Conn            *mongo.Client
+	errs            *checkErrors
+	hint            *cacheHint
 }
 
 type MongoAcl struct {
@@ -38,6 +41,15 @@ type MongoUser struct {
 	PasswordHash string     `bson:"password"`
 	Superuser    bool       `bson:"superuser"`
 	Acls         []MongoAcl `bson:"acls"`
+	Pending      bool       `bson:"pending"`
+	ChangedAt    time.Time  `bson:"password_changed_at"`
+	MaxConns     int        `bson:"max_connections"`
+}
+
+func init() {
+	register("mongo", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewMongo(authOpts, logLevel)
+	})
 }
 
 func NewMongo(authOpts map[string]string, logLevel log.Level) (Mongo, error) {
@@ -91,6 +103,14 @@ func NewMongo(authOpts map[string]string, logLevel log.Level) (Mongo, error) {
 
 	opts.ApplyURI(addr)
 
+	dialer, err := common.NewDialer(authOpts, "mongo")
+	if err != nil {
+		return m, errors.Errorf("Mongo backend error: %s\n", err)
+	}
+	if dialer != nil {
+		opts.SetDialer(dialer)
+	}
+
 	if m.Username != "" && m.Password != "" {
 		opts.Auth = &options.Credential{
 			AuthSource:  m.DBName,
@@ -118,9 +138,10 @@ func (o Mongo) GetUser(username, password string) bool {
 
 	var user MongoUser
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	err := uc.FindOne(context.TODO(), activeUser(username)).Decode(&user)
 	if err != nil {
 		log.Debugf("Mongo get user error: %s", err)
+		o.setError(err)
 		return false
 	}
 
@@ -128,20 +149,41 @@ func (o Mongo) GetUser(username, password string) bool {
 		return true
 	}
 
+	o.errs.set(ErrBadCredentials, nil)
 	return false
 
 }
 
 //GetSuperuser checks that the key username:su exists and has value "true".
+//UserExists checks if the user is in the users collection and not pending.
+func (o Mongo) UserExists(username string) (bool, error) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(context.TODO(), activeUser(username)).Decode(&user)
+	if err != nil {
+		log.Debugf("Mongo user exists error: %s", err)
+		o.errs = &checkErrors{}
+		o.setError(err)
+		return false, o.errs.take()
+	}
+
+	return true, nil
+
+}
+
 func (o Mongo) GetSuperuser(username string) bool {
 
 	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
 
 	var user MongoUser
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	err := uc.FindOne(context.TODO(), activeUser(username)).Decode(&user)
 	if err != nil {
 		log.Debugf("Mongo get superuser error: %s", err)
+		o.setError(err)
 		return false
 	}
 
@@ -157,14 +199,30 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 	var user MongoUser
 
-	err := uc.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	err := uc.FindOne(context.TODO(), activeUser(username)).Decode(&user)
 	if err != nil {
 		log.Debugf("Mongo get superuser error: %s", err)
+		o.setError(err)
+		return false
+	}
+
+	if err := common.CheckAclRuleCount(username, len(user.Acls)); err != nil {
+		log.Errorf("Mongo check acl error: %s", err)
+		o.errs.set(ErrMisconfigured, err)
 		return false
 	}
+	for _, acl := range user.Acls {
+		if err := common.CheckAclRule(username, acl.Topic); err != nil {
+			log.Errorf("Mongo check acl error: %s", err)
+			o.errs.set(ErrMisconfigured, err)
+			return false
+		}
+	}
 
+	now := time.Now()
 	for _, acl := range user.Acls {
-		if (acl.Acc == acc || acl.Acc == 3) && common.TopicsMatch(acl.Topic, topic) {
+		aclTopic, active, timed := common.ActiveAclTopic(acl.Topic, clientid, now)
+		if (acl.Acc == acc || acl.Acc == 3) && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 			return true
 		}
 	}
@@ -176,6 +234,7 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 	if aErr != nil {
 		log.Debugf("Mongo check acl error: %s", err)
+		o.setError(aErr)
 		return false
 	}
 
@@ -185,9 +244,9 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 		var acl MongoAcl
 		err = cur.Decode(&acl)
 		if err == nil {
-			aclTopic := strings.Replace(acl.Topic, "%c", clientid, -1)
-			aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-			if common.TopicsMatch(aclTopic, topic) {
+			aclTopic, active, timed := common.ActiveAclTopic(acl.Topic, clientid, now)
+			aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+			if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 				return true
 			}
 		} else {
@@ -199,6 +258,153 @@ func (o Mongo) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//activeUser filters users by username, leaving out pending ones.
+func activeUser(username string) bson.M {
+	return bson.M{"username": username, "pending": bson.M{"$ne": true}}
+}
+
+//RegisterPending inserts username as a pending user with the hashed password and no acls.
+func (o Mongo) RegisterPending(username, password string) error {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	count, err := uc.CountDocuments(context.TODO(), bson.M{"username": username})
+	if err != nil {
+		return errors.Errorf("Mongo register pending error: %s", err)
+	}
+	if count > 0 {
+		return errors.Errorf("Mongo register pending error: user %s already exists", username)
+	}
+
+	pwHash, err := HashPassword(password)
+	if err != nil {
+		return errors.Errorf("Mongo register pending error: %s", err)
+	}
+
+	_, err = uc.InsertOne(context.TODO(), MongoUser{
+		Username:     username,
+		PasswordHash: pwHash,
+		Acls:         []MongoAcl{},
+		Pending:      true,
+	})
+	if err != nil {
+		return errors.Errorf("Mongo register pending error: %s", err)
+	}
+
+	return nil
+
+}
+
+//IsPending checks that a user with the given username exists and is pending.
+func (o Mongo) IsPending(username string) bool {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	count, err := uc.CountDocuments(context.TODO(), bson.M{"username": username, "pending": true})
+	if err != nil {
+		log.Debugf("Mongo is pending error: %s", err)
+		return false
+	}
+
+	return count > 0
+
+}
+
+//GetPending checks that username is pending and the given password hashes to the same password.
+func (o Mongo) GetPending(username, password string) bool {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(context.TODO(), bson.M{"username": username, "pending": true}).Decode(&user)
+	if err != nil {
+		log.Debugf("Mongo get pending error: %s", err)
+		return false
+	}
+
+	return common.HashCompare(password, user.PasswordHash)
+
+}
+
+//PasswordChangedAt gets the user's password_changed_at date, if present.
+func (o Mongo) PasswordChangedAt(username string) (time.Time, bool) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(context.TODO(), activeUser(username)).Decode(&user)
+	if err != nil {
+		log.Debugf("Mongo password changed at error: %s", err)
+		return time.Time{}, false
+	}
+
+	return user.ChangedAt, !user.ChangedAt.IsZero()
+
+}
+
+//MaxConnections gets the user's max_connections, if present.
+func (o Mongo) MaxConnections(username string) (int, bool) {
+
+	uc := o.Conn.Database(o.DBName).Collection(o.UsersCollection)
+
+	var user MongoUser
+
+	err := uc.FindOne(context.TODO(), activeUser(username)).Decode(&user)
+	if err != nil {
+		log.Debugf("Mongo max connections error: %s", err)
+		return 0, false
+	}
+
+	return user.MaxConns, user.MaxConns > 0
+
+}
+
+//Healthy checks mongo answers a ping.
+func (o Mongo) Healthy() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return o.Conn.Ping(ctx, nil) == nil
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Mongo) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Mongo) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Mongo) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Mongo) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//setError keeps a Mongo error: no documents mean nothing was found, while any other error means Mongo failed.
+func (o Mongo) setError(err error) {
+	if err == mongo.ErrNoDocuments {
+		o.errs.set(ErrNotFound, nil)
+		return
+	}
+	o.errs.set(ErrBackendUnavailable, err)
+}
+
 //GetName returns the backend's name
 func (o Mongo) GetName() string {
 	return "Mongo"
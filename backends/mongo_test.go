@@ -1,3 +1,5 @@
+// +build !nomongo
+
 package backends
 
 import (
@@ -10,6 +12,8 @@ import (
 
 func TestMongo(t *testing.T) {
 
+	requireIntegration(t, "mongo")
+
 	//Initialize Mongo with some test values.
 	authOpts := make(map[string]string)
 	authOpts["mongo_host"] = "localhost"
@@ -0,0 +1,266 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+//This is a minimal MessagePack codec for the small maps exchanged with remote backends.
+//It encodes nil, bools, integers, floats, strings, slices and string keyed maps, and decodes every type but extensions.
+
+//marshalMsgpack encodes v as MessagePack.
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if value {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		encodeMsgpackInt(buf, int64(value))
+	case int32:
+		encodeMsgpackInt(buf, int64(value))
+	case int64:
+		encodeMsgpackInt(buf, value)
+	case float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(value))
+	case string:
+		encodeMsgpackString(buf, value)
+	case []interface{}:
+		encodeMsgpackLength(buf, len(value), 0x90, 15, 0xdc)
+		for _, item := range value {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		encodeMsgpackLength(buf, len(value), 0x80, 15, 0xde)
+		for key, item := range value {
+			encodeMsgpackString(buf, key)
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+//encodeMsgpackInt encodes n as a fixint or a 64 bit integer.
+func encodeMsgpackInt(buf *bytes.Buffer, n int64) {
+	if n >= -32 && n <= 127 {
+		buf.WriteByte(byte(int8(n)))
+		return
+	}
+	buf.WriteByte(0xd3)
+	binary.Write(buf, binary.BigEndian, n)
+}
+
+func encodeMsgpackString(buf *bytes.Buffer, s string) {
+	if len(s) <= 31 {
+		buf.WriteByte(0xa0 | byte(len(s)))
+	} else if len(s) <= math.MaxUint8 {
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(len(s)))
+	} else if len(s) <= math.MaxUint16 {
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	} else {
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(len(s)))
+	}
+	buf.WriteString(s)
+}
+
+//encodeMsgpackLength encodes an array or map length as a fix type when it fits, or as its 16 bit (code) or 32 bit (code + 1) type.
+func encodeMsgpackLength(buf *bytes.Buffer, n int, fix byte, fixMax int, code byte) {
+	if n <= fixMax {
+		buf.WriteByte(fix | byte(n))
+	} else if n <= math.MaxUint16 {
+		buf.WriteByte(code)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	} else {
+		buf.WriteByte(code + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+//unmarshalMsgpack decodes MessagePack data into nil, bool, int64, uint64, float64, string, []interface{} and map[string]interface{} values.
+//Map keys that aren't strings are formatted as such, so decoded values may always be encoded as json.
+func unmarshalMsgpack(data []byte) (interface{}, error) {
+	d := msgpackDecoder{data: data}
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, errors.New("msgpack: trailing data")
+	}
+	return v, nil
+}
+
+//maxMsgpackDepth bounds nesting while decoding, as response limits only check depth once decoded.
+const maxMsgpackDepth = 64
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || d.pos+n > len(d.data) {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+//uint reads a big endian unsigned integer of n bytes.
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.Errorf("msgpack: exceeds depth of %d", maxMsgpackDepth)
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code&0x0f), depth)
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code&0x0f), depth)
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		//Binary values are taken as strings.
+		sizes := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}
+		n, err := d.uint(sizes[code])
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (code - 0xcc))
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n), depth)
+	}
+
+	return nil, errors.Errorf("msgpack: unsupported type 0x%x", code)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (interface{}, error) {
+	//Every item takes at least a byte, so bigger lengths are malformed and shouldn't be allocated.
+	if n > len(d.data)-d.pos {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		item, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errors.New("msgpack: unexpected end of data")
+	}
+	fields := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		fields[fmt.Sprint(key)] = value
+	}
+	return fields, nil
+}
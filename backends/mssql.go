@@ -0,0 +1,370 @@
+// +build !nomssql
+
+package backends
+
+import (
+	"database/sql"
+	"net"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jmoiron/sqlx"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//Mssql holds all fields of the Microsoft SQL Server db connection.
+type Mssql struct {
+	DB                     *sqlx.DB
+	Host                   string
+	Port                   string
+	DBName                 string
+	User                   string
+	Password               string
+	UserQuery              string
+	SuperuserQuery         string
+	AclQuery               string
+	QueryParams            *QueryParams
+	Encrypt                string
+	TrustServerCertificate bool
+	Certificate            string
+	HostNameInCertificate  string
+	errs                   *checkErrors
+	hint                   *cacheHint
+	metadata               *common.ClientMetadata
+}
+
+func init() {
+	register("mssql", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewMssql(authOpts, logLevel)
+	})
+}
+
+func NewMssql(authOpts map[string]string, logLevel log.Level) (Mssql, error) {
+
+	log.SetLevel(logLevel)
+
+	//Set defaults for mssql
+
+	mssqlOk := true
+	missingOptions := ""
+
+	var ms = Mssql{
+		Host: "localhost",
+		Port: "1433",
+	}
+
+	if host, ok := authOpts["mssql_host"]; ok {
+		ms.Host = host
+	}
+
+	if port, ok := authOpts["mssql_port"]; ok {
+		ms.Port = port
+	}
+
+	if dbName, ok := authOpts["mssql_dbname"]; ok {
+		ms.DBName = dbName
+	} else {
+		mssqlOk = false
+		missingOptions += " mssql_dbname"
+	}
+
+	if user, ok := authOpts["mssql_user"]; ok {
+		ms.User = user
+	} else {
+		mssqlOk = false
+		missingOptions += " mssql_user"
+	}
+
+	if password, ok := authOpts["mssql_password"]; ok {
+		ms.Password = password
+	} else {
+		mssqlOk = false
+		missingOptions += " mssql_password"
+	}
+
+	if userQuery, ok := authOpts["mssql_userquery"]; ok {
+		ms.UserQuery = userQuery
+	} else {
+		mssqlOk = false
+		missingOptions += " mssql_userquery"
+	}
+
+	if superuserQuery, ok := authOpts["mssql_superquery"]; ok {
+		ms.SuperuserQuery = superuserQuery
+	}
+
+	if aclQuery, ok := authOpts["mssql_aclquery"]; ok {
+		ms.AclQuery = aclQuery
+	}
+
+	queryParams, err := parseQueryParams(authOpts, "mssql")
+	if err != nil {
+		return ms, errors.Errorf("MSSQL backend error: %s\n", err)
+	}
+	if err := queryParams.validate(ms.UserQuery, ms.SuperuserQuery, ms.AclQuery); err != nil {
+		return ms, errors.Errorf("MSSQL backend error: %s\n", err)
+	}
+	ms.QueryParams = queryParams
+
+	if encrypt, ok := authOpts["mssql_encrypt"]; ok {
+		switch encrypt {
+		case "true", "false", "disable":
+			ms.Encrypt = encrypt
+		default:
+			return ms, errors.Errorf("MSSQL backend error: mssql_encrypt must be true, false or disable, got %s.\n", encrypt)
+		}
+	}
+
+	if trust, ok := authOpts["mssql_trust_server_certificate"]; ok && trust == "true" {
+		ms.TrustServerCertificate = true
+	}
+
+	if certificate, ok := authOpts["mssql_certificate"]; ok {
+		ms.Certificate = certificate
+	}
+
+	if hostNameInCertificate, ok := authOpts["mssql_hostname_in_certificate"]; ok {
+		ms.HostNameInCertificate = hostNameInCertificate
+	}
+
+	//Exit if any mandatory option is missing.
+	if !mssqlOk {
+		return ms, errors.Errorf("MSSQL backend error: missing options%s.\n", missingOptions)
+	}
+
+	connector, err := mssql.NewConnector(ms.dsn())
+	if err != nil {
+		return ms, errors.Errorf("MSSQL backend error: %s\n", err)
+	}
+
+	dialer, err := common.NewDialer(authOpts, "mssql")
+	if err != nil {
+		return ms, errors.Errorf("MSSQL backend error: %s\n", err)
+	}
+	if dialer != nil {
+		connector.Dialer = dialer
+	}
+
+	ms.DB = common.OpenConnector(connector, "sqlserver")
+
+	return ms, nil
+
+}
+
+//dsn builds the url connection string of the db, which the driver parses.
+func (o Mssql) dsn() string {
+	query := url.Values{}
+	query.Set("database", o.DBName)
+
+	if o.Encrypt != "" {
+		query.Set("encrypt", o.Encrypt)
+	}
+	if o.TrustServerCertificate {
+		query.Set("TrustServerCertificate", "true")
+	}
+	if o.Certificate != "" {
+		query.Set("certificate", o.Certificate)
+	}
+	if o.HostNameInCertificate != "" {
+		query.Set("hostNameInCertificate", o.HostNameInCertificate)
+	}
+
+	u := url.URL{
+		Scheme:   "sqlserver",
+		Host:     net.JoinHostPort(o.Host, o.Port),
+		RawQuery: query.Encode(),
+	}
+	if o.User != "" || o.Password != "" {
+		u.User = url.UserPassword(o.User, o.Password)
+	}
+
+	return u.String()
+}
+
+//GetUser checks that the username exists and the given password hashes to the same password.
+func (o Mssql) GetUser(username, password string) bool {
+
+	query, args, err := o.QueryParams.bind(o.DB, o.UserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("MSSQL get user error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	var pwHash sql.NullString
+	err = o.DB.Get(&pwHash, query, args...)
+
+	if err != nil {
+		log.Debugf("MSSQL get user error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("MSSQL get user error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
+		return false
+	}
+
+	if common.HashCompare(password, pwHash.String) {
+		return true
+	}
+
+	o.errs.set(ErrBadCredentials, nil)
+	return false
+
+}
+
+//GetSuperuser checks that the username meets the superuser query.
+func (o Mssql) GetSuperuser(username string) bool {
+
+	//If there's no superuser query, return false.
+	if o.SuperuserQuery == "" {
+		return false
+	}
+
+	query, args, err := o.QueryParams.bind(o.DB, o.SuperuserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("MSSQL get superuser error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	var count sql.NullInt64
+	err = o.DB.Get(&count, query, args...)
+
+	if err != nil {
+		log.Debugf("MSSQL get superuser error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if !count.Valid {
+		log.Debugf("MSSQL get superuser error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
+		return false
+	}
+
+	if count.Int64 > 0 {
+		return true
+	}
+
+	return false
+
+}
+
+//CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
+func (o Mssql) CheckAcl(username, topic, clientid string, acc int32) bool {
+
+	//If there's no acl query, assume all privileges for all users.
+	if o.AclQuery == "" {
+		return true
+	}
+
+	query, args, err := o.QueryParams.bind(o.DB, o.AclQuery, username, o.metadata, map[string]interface{}{"acc": acc, "clientid": clientid, "topic": topic}, username, acc)
+	if err != nil {
+		log.Debugf("MSSQL check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	var acls []string
+
+	err = o.DB.Select(&acls, query, args...)
+
+	if err != nil {
+		log.Debugf("MSSQL check acl error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if err := common.CheckAclRules(username, acls); err != nil {
+		log.Errorf("MSSQL check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	now := time.Now()
+	for _, acl := range acls {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+//Healthy checks the database answers a ping.
+func (o Mssql) Healthy() bool {
+	return o.DB != nil && o.DB.Ping() == nil
+}
+
+//OpenConnections returns the number of connections to the database, in use or idle.
+func (o Mssql) OpenConnections() int {
+	if o.DB == nil {
+		return 0
+	}
+	return o.DB.Stats().OpenConnections
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Mssql) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Mssql) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Mssql) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Mssql) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend binding the client's cert_subject and address to named query params.
+func (o Mssql) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//Capabilities tells which checks are set by the given queries.
+func (o Mssql) Capabilities() Capabilities {
+	return sqlCapabilities(o.SuperuserQuery, "", "")
+}
+
+//GetName returns the backend's name
+func (o Mssql) GetName() string {
+	return "MSSQL"
+}
+
+//Halt closes the mssql connection.
+func (o Mssql) Halt() {
+	if o.DB != nil {
+		err := o.DB.Close()
+		if err != nil {
+			log.Errorf("MSSQL cleanup error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// +build !nomssql
+
+package backends
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMssqlOptions(t *testing.T) {
+
+	Convey("If mandatory params are not set initialization should fail", t, func() {
+		_, err := NewMssql(map[string]string{"mssql_host": "localhost"}, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a wrong encryption mode initialization should fail", t, func() {
+		authOpts := map[string]string{
+			"mssql_dbname":    "go_auth_test",
+			"mssql_user":      "go_auth_test",
+			"mssql_password":  "go_auth_test",
+			"mssql_userquery": "SELECT password_hash FROM test_user WHERE username = @p1",
+			"mssql_encrypt":   "required",
+		}
+		_, err := NewMssql(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("The connection string should carry encryption options", t, func() {
+		ms := Mssql{
+			Host:                  "example.database.windows.net",
+			Port:                  "1433",
+			DBName:                "go_auth_test",
+			User:                  "go_auth_test",
+			Password:              "p@ss word",
+			Encrypt:               "true",
+			HostNameInCertificate: "*.database.windows.net",
+		}
+
+		u, err := url.Parse(ms.dsn())
+		So(err, ShouldBeNil)
+		So(u.Host, ShouldEqual, "example.database.windows.net:1433")
+		So(u.User.Username(), ShouldEqual, "go_auth_test")
+		password, _ := u.User.Password()
+		So(password, ShouldEqual, "p@ss word")
+		So(u.Query().Get("database"), ShouldEqual, "go_auth_test")
+		So(u.Query().Get("encrypt"), ShouldEqual, "true")
+		So(u.Query().Get("hostNameInCertificate"), ShouldEqual, "*.database.windows.net")
+	})
+
+	Convey("Named params should be rebound to sqlserver's placeholders", t, func() {
+		db := sqlx.NewDb(nil, "sqlserver")
+		params := &QueryParams{}
+
+		query, args, err := params.bind(db, "SELECT topic FROM test_acl WHERE username = :username AND rw >= :acc AND topic <> :username", "test", nil, map[string]interface{}{"acc": int32(1)})
+		So(err, ShouldBeNil)
+		So(query, ShouldEqual, "SELECT topic FROM test_acl WHERE username = @p1 AND rw >= @p2 AND topic <> @p3")
+		So(args, ShouldHaveLength, 3)
+	})
+}
+
+func TestMssql(t *testing.T) {
+
+	requireIntegration(t, "mssql")
+
+	authOpts := map[string]string{
+		"mssql_dbname":                   "tempdb",
+		"mssql_user":                     "sa",
+		"mssql_password":                 "go_auth_test_P4ss",
+		"mssql_encrypt":                  "true",
+		"mssql_trust_server_certificate": "true",
+		"mssql_userquery":                "SELECT TOP 1 password_hash FROM test_user WHERE username = @p1",
+		"mssql_superquery":               "SELECT COUNT(*) FROM test_user WHERE username = @p1 AND is_admin = 1",
+		"mssql_aclquery":                 "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = @p1 AND test_acl.test_user_id = test_user.id AND (rw >= @p2 OR rw = 3)",
+	}
+
+	Convey("Given valid params NewMssql should return a Mssql backend instance", t, func() {
+		ms, err := NewMssql(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer ms.Halt()
+
+		ms.DB.MustExec("IF OBJECT_ID('test_user') IS NULL CREATE TABLE test_user(id INT IDENTITY PRIMARY KEY, username VARCHAR(100) NOT NULL, password_hash VARCHAR(200) NOT NULL, is_admin BIT NOT NULL)")
+		ms.DB.MustExec("IF OBJECT_ID('test_acl') IS NULL CREATE TABLE test_acl(id INT IDENTITY PRIMARY KEY, test_user_id INT NOT NULL, topic VARCHAR(200) NOT NULL, rw INT NOT NULL)")
+		ms.DB.MustExec("DELETE FROM test_acl")
+		ms.DB.MustExec("DELETE FROM test_user")
+
+		//Hash generated by the pw utility
+		userPassHash := "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+		var userID int64
+		err = ms.DB.Get(&userID, "INSERT INTO test_user(username, password_hash, is_admin) OUTPUT INSERTED.id VALUES(@p1, @p2, @p3)", "test", userPassHash, true)
+		So(err, ShouldBeNil)
+
+		_, err = ms.DB.Exec("INSERT INTO test_acl(test_user_id, topic, rw) VALUES(@p1, @p2, @p3)", userID, "test/topic/1", MOSQ_ACL_READ)
+		So(err, ShouldBeNil)
+
+		Convey("Given a username and a correct password, it should correctly authenticate it", func() {
+			So(ms.GetUser("test", "testpw"), ShouldBeTrue)
+			So(ms.GetUser("test", "wrong_password"), ShouldBeFalse)
+			So(ms.GetUser("not_present", "testpw"), ShouldBeFalse)
+		})
+
+		Convey("Given a username that is admin, super user should pass", func() {
+			So(ms.GetSuperuser("test"), ShouldBeTrue)
+			So(ms.GetSuperuser("not_admin"), ShouldBeFalse)
+		})
+
+		Convey("Given acls, only the saved topics with the right access should pass", func() {
+			So(ms.CheckAcl("test", "test/topic/1", "test_client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(ms.CheckAcl("test", "test/topic/1", "test_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(ms.CheckAcl("test", "test/topic/2", "test_client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+}
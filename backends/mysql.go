@@ -6,7 +6,8 @@ import (
 	"database/sql"
 	"fmt"
 	"io/ioutil"
-	"strings"
+	"net"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -29,6 +30,15 @@ type Mysql struct {
 	UserQuery            string
 	SuperuserQuery       string
 	AclQuery             string
+	RegisterQuery        string
+	PendingQuery         string
+	PasswordAgeQuery     string
+	MaxConnsQuery        string
+	ManifestQuery        string
+	PskQuery             string
+	ExportUsersQuery     string
+	ExportAclsQuery      string
+	QueryParams          *QueryParams
 	SSLMode              string
 	SSLCert              string
 	SSLKey               string
@@ -36,6 +46,15 @@ type Mysql struct {
 	Protocol             string
 	SocketPath           string
 	AllowNativePasswords bool
+	errs                 *checkErrors
+	hint                 *cacheHint
+	metadata             *common.ClientMetadata
+}
+
+func init() {
+	register("mysql", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewMysql(authOpts, logLevel)
+	})
 }
 
 func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
@@ -108,6 +127,52 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 		mysql.AclQuery = aclQuery
 	}
 
+	//Registering pending clients needs both queries.
+	registerQuery, hasRegister := authOpts["mysql_registerquery"]
+	pendingQuery, hasPending := authOpts["mysql_pendingquery"]
+	if hasRegister && !hasPending {
+		mysqlOk = false
+		missingOptions += " mysql_pendingquery"
+	} else if hasPending && !hasRegister {
+		mysqlOk = false
+		missingOptions += " mysql_registerquery"
+	}
+	mysql.RegisterQuery = registerQuery
+	mysql.PendingQuery = pendingQuery
+
+	if passwordAgeQuery, ok := authOpts["mysql_passwordagequery"]; ok {
+		mysql.PasswordAgeQuery = passwordAgeQuery
+	}
+
+	if maxConnsQuery, ok := authOpts["mysql_maxconnsquery"]; ok {
+		mysql.MaxConnsQuery = maxConnsQuery
+	}
+
+	if manifestQuery, ok := authOpts["mysql_manifestquery"]; ok {
+		mysql.ManifestQuery = manifestQuery
+	}
+
+	if pskQuery, ok := authOpts["mysql_pskquery"]; ok {
+		mysql.PskQuery = pskQuery
+	}
+
+	if exportUsersQuery, ok := authOpts["mysql_exportusersquery"]; ok {
+		mysql.ExportUsersQuery = exportUsersQuery
+	}
+
+	if exportAclsQuery, ok := authOpts["mysql_exportaclsquery"]; ok {
+		mysql.ExportAclsQuery = exportAclsQuery
+	}
+
+	queryParams, err := parseQueryParams(authOpts, "mysql")
+	if err != nil {
+		return mysql, errors.Errorf("MySql backend error: %s\n", err)
+	}
+	if err := queryParams.validate(mysql.UserQuery, mysql.SuperuserQuery, mysql.AclQuery); err != nil {
+		return mysql, errors.Errorf("MySql backend error: %s\n", err)
+	}
+	mysql.QueryParams = queryParams
+
 	if allowNativePasswords, ok := authOpts["mysql_allow_native_passwords"]; ok && allowNativePasswords == "true" {
 		mysql.AllowNativePasswords = true
 	}
@@ -155,6 +220,19 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 		return mysql, errors.Errorf("MySql backend error: missing options%s.\n", missingOptions)
 	}
 
+	dialer, err := common.NewDialer(authOpts, "mysql")
+	if err != nil {
+		return mysql, errors.Errorf("MySql backend error: %s\n", err)
+	}
+
+	//The driver dials with functions registered by network name, so register one for this dialer and use it instead of tcp.
+	if dialer != nil && mysql.Protocol == "tcp" {
+		mysql.Protocol = "dialer-mysql"
+		mq.RegisterDial(mysql.Protocol, func(addr string) (net.Conn, error) {
+			return dialer.Dial("tcp", addr)
+		})
+	}
+
 	var msConfig = mq.Config{
 		User:                 mysql.User,
 		Passwd:               mysql.Password,
@@ -202,16 +280,25 @@ func NewMysql(authOpts map[string]string, logLevel log.Level) (Mysql, error) {
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Mysql) GetUser(username, password string) bool {
 
+	query, args, err := o.QueryParams.bind(o.DB, o.UserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("MySql get user error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err = o.DB.Get(&pwHash, query, args...)
 
 	if err != nil {
 		log.Debugf("MySql get user error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
 	if !pwHash.Valid {
 		log.Debugf("MySql get user error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -219,6 +306,7 @@ func (o Mysql) GetUser(username, password string) bool {
 		return true
 	}
 
+	o.errs.set(ErrBadCredentials, nil)
 	return false
 
 }
@@ -231,16 +319,25 @@ func (o Mysql) GetSuperuser(username string) bool {
 		return false
 	}
 
+	query, args, err := o.QueryParams.bind(o.DB, o.SuperuserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("MySql get superuser error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err = o.DB.Get(&count, query, args...)
 
 	if err != nil {
 		log.Debugf("MySql get superuser error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
 	if !count.Valid {
 		log.Debugf("MySql get superuser error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -259,19 +356,34 @@ func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) bool {
 		return true
 	}
 
+	query, args, err := o.QueryParams.bind(o.DB, o.AclQuery, username, o.metadata, map[string]interface{}{"acc": acc, "clientid": clientid, "topic": topic}, username, acc)
+	if err != nil {
+		log.Debugf("MySql check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err = o.DB.Select(&acls, query, args...)
 
 	if err != nil {
 		log.Debugf("MySql check acl error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if err := common.CheckAclRules(username, acls); err != nil {
+		log.Errorf("MySql check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
 		return false
 	}
 
+	now := time.Now()
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 			return true
 		}
 	}
@@ -280,6 +392,166 @@ func (o Mysql) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//RegisterPending inserts username as a pending client using the register query, which gets the username and the password hash.
+func (o Mysql) RegisterPending(username, password string) error {
+
+	if o.RegisterQuery == "" {
+		return errors.New("MySql register pending error: no register query given.")
+	}
+
+	pwHash, err := HashPassword(password)
+	if err != nil {
+		return errors.Errorf("MySql register pending error: %s", err)
+	}
+
+	_, err = o.DB.Exec(o.RegisterQuery, username, pwHash)
+	if err != nil {
+		return errors.Errorf("MySql register pending error: %s", err)
+	}
+
+	return nil
+
+}
+
+//IsPending checks that the pending query returns a password hash for username.
+func (o Mysql) IsPending(username string) bool {
+
+	if o.PendingQuery == "" {
+		return false
+	}
+
+	var pwHash sql.NullString
+	err := o.DB.Get(&pwHash, o.PendingQuery, username)
+
+	if err != nil {
+		log.Debugf("MySql is pending error: %s\n", err)
+		return false
+	}
+
+	return pwHash.Valid
+
+}
+
+//GetPending checks that username is pending and the given password hashes to the same password.
+func (o Mysql) GetPending(username, password string) bool {
+
+	if o.PendingQuery == "" {
+		return false
+	}
+
+	var pwHash sql.NullString
+	err := o.DB.Get(&pwHash, o.PendingQuery, username)
+
+	if err != nil {
+		log.Debugf("MySql get pending error: %s\n", err)
+		return false
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("MySql get pending error: user %s not found.\n", username)
+		return false
+	}
+
+	return common.HashCompare(password, pwHash.String)
+
+}
+
+//PasswordChangedAt gets the unix time at which the password for username was last changed using the password age query.
+func (o Mysql) PasswordChangedAt(username string) (time.Time, bool) {
+	return queryPasswordChangedAt(o.DB, o.PasswordAgeQuery, username, "MySql")
+}
+
+//MaxConnections gets the maximum simultaneous connections for username using the max connections query.
+func (o Mysql) MaxConnections(username string) (int, bool) {
+	return queryMaxConnections(o.DB, o.MaxConnsQuery, username, "MySql")
+}
+
+//Manifest gets the topics and acc values username may access using the manifest query.
+func (o Mysql) Manifest(username string) ([]ManifestAcl, bool) {
+	return queryManifest(o.DB, o.ManifestQuery, username, "MySql")
+}
+
+//GetPskKey gets the hex key for identity using the psk query.
+func (o Mysql) GetPskKey(hint, identity string) (string, bool) {
+
+	if o.PskQuery == "" {
+		return "", false
+	}
+
+	var key sql.NullString
+	err := o.DB.Get(&key, o.PskQuery, identity)
+
+	if err != nil {
+		log.Debugf("MySql get psk key error: %s\n", err)
+		return "", false
+	}
+
+	if !key.Valid || !validPskKey(key.String) {
+		log.Debugf("MySql get psk key error: no valid key for %s\n", identity)
+		return "", false
+	}
+
+	return key.String, true
+
+}
+
+//Export exports every user and their acls with the export queries.
+func (o Mysql) Export() (Snapshot, error) {
+	return exportSQL(o.DB, o.ExportUsersQuery, o.ExportAclsQuery, "Mysql")
+}
+
+//Healthy checks the database answers a ping.
+func (o Mysql) Healthy() bool {
+	return o.DB != nil && o.DB.Ping() == nil
+}
+
+//OpenConnections returns the number of connections to the database, in use or idle.
+func (o Mysql) OpenConnections() int {
+	if o.DB == nil {
+		return 0
+	}
+	return o.DB.Stats().OpenConnections
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Mysql) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Mysql) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Mysql) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Mysql) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend binding the client's cert_subject and address to named query params.
+func (o Mysql) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//Capabilities tells which checks and features are set by the given queries.
+func (o Mysql) Capabilities() Capabilities {
+	return sqlCapabilities(o.SuperuserQuery, o.PskQuery, o.ManifestQuery)
+}
+
 //GetName returns the backend's name
 func (o Mysql) GetName() string {
 	return "Mysql"
@@ -9,6 +9,8 @@ import (
 
 func TestMysql(t *testing.T) {
 
+	requireIntegration(t, "mysql")
+
 	//Initialize Mysql without mandatory values (fail).
 	authOpts := make(map[string]string)
 	authOpts["mysql_host"] = "localhost"
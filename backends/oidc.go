@@ -0,0 +1,466 @@
+package backends
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	h "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//OIDC authenticates clients giving an ID or access token issued by an OpenID Connect provider as their password.
+//It's configured with the issuer alone: the provider's signing keys are found through discovery and tokens are verified locally.
+//Superuser and acl checks are answered from the groups and scopes of the token the user last authenticated with, until it expires.
+type OIDC struct {
+	Issuer          string
+	Audience        string
+	AuthorizedParty string //AuthorizedParty is a client id tokens must be issued to, given by their azp claim or holding it as audience.
+	UsernameClaim   string
+	GroupsClaim     string
+	ScopeClaim      string
+	SuperuserGroups map[string]bool
+	SuperuserScope  string
+	GroupAcls       map[string][]ManifestAcl
+	ScopeAcls       map[string][]ManifestAcl
+	Leeway          time.Duration
+	Timeout         time.Duration
+	JWKSURL         string
+	JWKS            *jwksKeySet
+	TLSConfig       *tls.Config
+	VerifyPeer      bool
+	Dialer          *common.Dialer
+	Limits          ResponseLimits
+	sessions        *oidcSessions
+	errs            *checkErrors
+}
+
+//oidcDiscovery holds the fields of the provider's discovery document the backend uses.
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+func init() {
+	register("oidc", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewOIDC(authOpts, logLevel)
+	})
+}
+
+//NewOIDC initializes an OpenID Connect backend, failing if the provider's discovery document can't be fetched.
+func NewOIDC(authOpts map[string]string, logLevel log.Level) (OIDC, error) {
+
+	log.SetLevel(logLevel)
+
+	issuer, ok := authOpts["oidc_issuer"]
+	if !ok || strings.TrimSpace(issuer) == "" {
+		return OIDC{}, errors.New("OIDC backend error: missing option oidc_issuer.\n")
+	}
+
+	o, err := newOIDC(authOpts, "oidc", strings.TrimSpace(issuer))
+	if err != nil {
+		return o, errors.Errorf("OIDC backend error: %s\n", err)
+	}
+
+	if o.Audience == "" {
+		log.Warning("No oidc_audience given, so tokens issued for any client of the provider will be accepted.")
+	}
+
+	return o, nil
+}
+
+//newOIDC initializes an OpenID Connect backend for the issuer with the options with the given prefix, so providers' own backends may build on it.
+func newOIDC(authOpts map[string]string, prefix, issuer string) (OIDC, error) {
+
+	var o = OIDC{
+		Issuer:          issuer,
+		UsernameClaim:   "sub",
+		GroupsClaim:     "groups",
+		ScopeClaim:      "scope",
+		SuperuserGroups: make(map[string]bool),
+		GroupAcls:       make(map[string][]ManifestAcl),
+		ScopeAcls:       make(map[string][]ManifestAcl),
+		Timeout:         5 * time.Second,
+		sessions:        &oidcSessions{sessions: make(map[string]oidcSession)},
+	}
+
+	u, err := url.Parse(o.Issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return o, errors.Errorf("bad issuer %s", o.Issuer)
+	}
+	if u.Scheme == "http" {
+		log.Warningf("OIDC issuer %s is not served over https, so its keys may be tampered with.", o.Issuer)
+	}
+
+	o.Audience = strings.TrimSpace(authOpts[prefix+"_audience"])
+
+	if usernameClaim, ok := authOpts[prefix+"_username_claim"]; ok && strings.TrimSpace(usernameClaim) != "" {
+		o.UsernameClaim = strings.TrimSpace(usernameClaim)
+	}
+	if groupsClaim, ok := authOpts[prefix+"_groups_claim"]; ok && strings.TrimSpace(groupsClaim) != "" {
+		o.GroupsClaim = strings.TrimSpace(groupsClaim)
+	}
+	if scopeClaim, ok := authOpts[prefix+"_scope_claim"]; ok && strings.TrimSpace(scopeClaim) != "" {
+		o.ScopeClaim = strings.TrimSpace(scopeClaim)
+	}
+
+	if superuserGroups, ok := authOpts[prefix+"_superuser_groups"]; ok {
+		for _, group := range strings.Split(superuserGroups, ",") {
+			if group = strings.TrimSpace(group); group != "" {
+				o.SuperuserGroups[group] = true
+			}
+		}
+	}
+	o.SuperuserScope = strings.TrimSpace(authOpts[prefix+"_superuser_scope"])
+
+	if groupAcls, ok := authOpts[prefix+"_group_acls"]; ok {
+		o.GroupAcls, err = parseScopeAcls(groupAcls)
+		if err != nil {
+			return o, errors.Errorf("wrong %s_group_acls format: %s", prefix, err)
+		}
+	}
+	if scopeAcls, ok := authOpts[prefix+"_scope_acls"]; ok {
+		o.ScopeAcls, err = parseScopeAcls(scopeAcls)
+		if err != nil {
+			return o, errors.Errorf("wrong %s_scope_acls format: %s", prefix, err)
+		}
+	}
+
+	if leeway, ok := authOpts[prefix+"_leeway"]; ok {
+		d, err := time.ParseDuration(strings.Replace(leeway, " ", "", -1))
+		if err != nil || d < 0 {
+			return o, errors.Errorf("couldn't parse %s_leeway %s", prefix, leeway)
+		}
+		o.Leeway = d
+	}
+
+	if timeout, ok := authOpts[prefix+"_timeout"]; ok {
+		d, err := time.ParseDuration(strings.Replace(timeout, " ", "", -1))
+		if err != nil || d <= 0 {
+			return o, errors.Errorf("couldn't parse %s_timeout %s", prefix, timeout)
+		}
+		o.Timeout = d
+	}
+
+	o.TLSConfig, err = parseRemoteTLS(authOpts, prefix)
+	if err != nil {
+		return o, err
+	}
+	o.VerifyPeer = parseVerifyPeer(authOpts, prefix, u.Scheme == "https")
+
+	o.Dialer, err = common.NewDialer(authOpts, prefix)
+	if err != nil {
+		return o, err
+	}
+
+	o.Limits = parseResponseLimits(authOpts, prefix)
+
+	discovery, err := o.discover()
+	if err != nil {
+		return o, errors.Errorf("discovery failed: %s", err)
+	}
+	o.JWKSURL = discovery.JWKSURI
+
+	refreshInterval, minInterval := parseJWKSIntervals(authOpts, prefix)
+	o.JWKS = newJWKSKeySet(o.JWKSURL, refreshInterval, minInterval, remoteTransport(o.TLSConfig, o.VerifyPeer, o.Dialer))
+
+	return o, nil
+}
+
+//discover fetches the provider's discovery document, which must be for the configured issuer and give a jwks uri.
+func (o OIDC) discover() (*oidcDiscovery, error) {
+	client := &h.Client{Timeout: o.Timeout}
+	if tr := remoteTransport(o.TLSConfig, o.VerifyPeer, o.Dialer); tr != nil {
+		client.Transport = tr
+	}
+
+	resp, err := client.Get(strings.TrimSuffix(o.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, errors.Errorf("request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := o.Limits.read(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read response: %s", err)
+	}
+
+	if resp.StatusCode != h.StatusOK {
+		return nil, errors.Errorf("provider answered with status %d", resp.StatusCode)
+	}
+
+	//Discovery documents hold many fields the backend ignores, so only their depth is limited.
+	if o.Limits.MaxDepth > 0 {
+		if err := checkJSONDepth(body, o.Limits.MaxDepth); err != nil {
+			return nil, errors.Errorf("bad response: %s", err)
+		}
+	}
+
+	var discovery oidcDiscovery
+	if err := json.Unmarshal(body, &discovery); err != nil {
+		return nil, errors.Errorf("couldn't decode response: %s", err)
+	}
+
+	if discovery.Issuer != o.Issuer {
+		return nil, errors.Errorf("document is for issuer %s, not %s", discovery.Issuer, o.Issuer)
+	}
+
+	jwksURI, err := url.Parse(discovery.JWKSURI)
+	if err != nil || (jwksURI.Scheme != "http" && jwksURI.Scheme != "https") || jwksURI.Host == "" {
+		return nil, errors.Errorf("bad jwks_uri %q", discovery.JWKSURI)
+	}
+
+	log.Debugf("oidc: discovered jwks uri %s for issuer %s", discovery.JWKSURI, o.Issuer)
+	return &discovery, nil
+}
+
+//GetUser checks the password is a valid token issued for the username, remembering its claims for the user's superuser and acl checks.
+func (o OIDC) GetUser(username, password string) bool {
+	if password == "" {
+		o.errs.set(ErrBadCredentials, nil)
+		return false
+	}
+
+	claims, expiry, err := o.verify(password)
+	if err != nil {
+		log.Debugf("OIDC backend error: %s\n", err)
+		o.errs.set(ErrBadCredentials, err)
+		return false
+	}
+
+	tokenUsername, _ := claimValue(&Claims{Raw: claims}, o.UsernameClaim).(string)
+	if tokenUsername != username {
+		log.Debugf("OIDC backend error: token was issued for %q, not %s\n", tokenUsername, username)
+		o.errs.set(ErrBadCredentials, errors.Errorf("token was not issued for %s", username))
+		return false
+	}
+
+	o.sessions.set(username, oidcSession{claims: claims, expiry: expiry})
+	return true
+}
+
+//GetSuperuser checks that the user's token hasn't expired and has one of the superuser groups or the superuser scope.
+func (o OIDC) GetSuperuser(username string) bool {
+	if len(o.SuperuserGroups) == 0 && o.SuperuserScope == "" {
+		return false
+	}
+
+	session, ok := o.session(username)
+	return ok && o.superuser(session)
+}
+
+//CheckAcl checks that the user's token hasn't expired and one of its groups or scopes grants acc on topic.
+func (o OIDC) CheckAcl(username, topic, clientid string, acc int32) bool {
+	session, ok := o.session(username)
+	return ok && o.allows(session, username, topic, clientid, acc)
+}
+
+//superuser tells if the session's token has one of the superuser groups or the superuser scope.
+func (o OIDC) superuser(session oidcSession) bool {
+	for _, group := range o.claimStrings(session, o.GroupsClaim) {
+		if o.SuperuserGroups[group] {
+			return true
+		}
+	}
+	for _, scope := range o.claimStrings(session, o.ScopeClaim) {
+		if scope == o.SuperuserScope {
+			return true
+		}
+	}
+	return false
+}
+
+//allows tells if one of the session's token groups or scopes grants acc on topic.
+func (o OIDC) allows(session oidcSession, username, topic, clientid string, acc int32) bool {
+	for _, group := range o.claimStrings(session, o.GroupsClaim) {
+		if acls, ok := o.GroupAcls[group]; ok && ManifestAllows(acls, username, topic, clientid, acc) {
+			return true
+		}
+	}
+	for _, scope := range o.claimStrings(session, o.ScopeClaim) {
+		if acls, ok := o.ScopeAcls[scope]; ok && ManifestAllows(acls, username, topic, clientid, acc) {
+			return true
+		}
+	}
+	return false
+}
+
+//session returns the user's session, forgetting it once its token expired.
+func (o OIDC) session(username string) (oidcSession, bool) {
+	session, ok := o.sessions.get(username)
+	if !ok {
+		log.Debugf("OIDC backend error: no token known for %s\n", username)
+		o.errs.set(ErrNotFound, nil)
+		return session, false
+	}
+
+	if !time.Now().Before(session.expiry) {
+		log.Debugf("OIDC backend error: token of %s expired\n", username)
+		o.errs.set(ErrBadCredentials, errors.New("token expired"))
+		o.sessions.remove(username, session)
+		return session, false
+	}
+	return session, true
+}
+
+//verify checks the token's signature with the provider's keys, its issuer, audience and authorized party, and its exp and nbf claims allowing for the leeway.
+//It returns the token's claims and when it stops being valid.
+func (o OIDC) verify(tokenStr string) (jwt.MapClaims, time.Time, error) {
+	claims := jwt.MapClaims{}
+	//Claims are validated apart, as the library can't check audiences given as lists.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.ParseWithClaims(tokenStr, claims, o.verificationKey)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !token.Valid {
+		return nil, time.Time{}, errors.New("invalid token")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != o.Issuer {
+		return nil, time.Time{}, errors.Errorf("token issued by %q, not %s", iss, o.Issuer)
+	}
+
+	if o.Audience != "" && !containsAudience(claims["aud"], o.Audience) {
+		return nil, time.Time{}, errors.Errorf("token is not meant for audience %s", o.Audience)
+	}
+
+	if azp, _ := claims["azp"].(string); o.AuthorizedParty != "" && azp != o.AuthorizedParty && !containsAudience(claims["aud"], o.AuthorizedParty) {
+		return nil, time.Time{}, errors.Errorf("token was not issued to client %s", o.AuthorizedParty)
+	}
+
+	now := time.Now()
+
+	//OpenID Connect tokens always expire, so tokens without exp are rejected.
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, time.Time{}, errors.New("token has no exp claim")
+	}
+	expiry := time.Unix(int64(exp), 0).Add(o.Leeway)
+	if !now.Before(expiry) {
+		return nil, time.Time{}, errors.New("token is expired")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(o.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, time.Time{}, errors.New("token is not valid yet")
+	}
+
+	return claims, expiry, nil
+}
+
+//verificationKey returns the provider's key for the token's kid, rejecting tokens signed with a method of another kind than the key's.
+func (o OIDC) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := o.JWKS.key(kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKeyMethod(token, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+//claimStrings gets the values of the session's token claim, given as a list of strings or as a single space separated one, as OAuth2 scopes are.
+func (o OIDC) claimStrings(session oidcSession, name string) []string {
+	switch value := claimValue(&Claims{Raw: session.claims}, name).(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o OIDC) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o OIDC) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o OIDC) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//Capabilities tells superusers are only checked when superuser groups or a superuser scope are given.
+func (o OIDC) Capabilities() Capabilities {
+	return Capabilities{User: true, Superuser: len(o.SuperuserGroups) > 0 || o.SuperuserScope != "", Acl: true}
+}
+
+//GetName returns the backend's name
+func (o OIDC) GetName() string {
+	return "OIDC"
+}
+
+//Halt stops refreshing the provider's keys and forgets every session.
+func (o OIDC) Halt() {
+	if o.JWKS != nil {
+		o.JWKS.halt()
+	}
+	o.sessions.clear()
+}
+
+//oidcSession holds the claims of the token a user last authenticated with, and when it expires.
+type oidcSession struct {
+	claims jwt.MapClaims
+	expiry time.Time
+}
+
+//oidcSessions keeps each user's session.
+type oidcSessions struct {
+	sync.Mutex
+	sessions map[string]oidcSession
+}
+
+func (s *oidcSessions) set(username string, session oidcSession) {
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[username] = session
+}
+
+func (s *oidcSessions) get(username string) (oidcSession, bool) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[username]
+	return session, ok
+}
+
+//remove forgets the user's session, unless it authenticated again meanwhile.
+func (s *oidcSessions) remove(username string, session oidcSession) {
+	s.Lock()
+	defer s.Unlock()
+	if current, ok := s.sessions[username]; ok && current.expiry.Equal(session.expiry) {
+		delete(s.sessions, username)
+	}
+}
+
+func (s *oidcSessions) clear() {
+	s.Lock()
+	defer s.Unlock()
+	s.sessions = make(map[string]oidcSession)
+}
@@ -0,0 +1,146 @@
+package backends
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOIDC(t *testing.T) {
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/iot/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 issuer,
+			"jwks_uri":               issuer + "/certs",
+			"authorization_endpoint": issuer + "/auth",
+		})
+	})
+	mux.HandleFunc("/realms/iot/certs", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kid": "oidc-key",
+					"kty": "RSA",
+					"use": "sig",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				},
+			},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	issuer = server.URL + "/realms/iot"
+
+	sign := func(claims jwt.MapClaims) string {
+		base := jwt.MapClaims{
+			"iss":                issuer,
+			"aud":                []string{"broker", "account"},
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"sub":                "f3b1c2d4",
+			"preferred_username": "device-1",
+			"groups":             []string{"/devices"},
+			"scope":              "openid telemetry",
+		}
+		for k, v := range claims {
+			if v == nil {
+				delete(base, k)
+				continue
+			}
+			base[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, base)
+		token.Header["kid"] = "oidc-key"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	authOpts := map[string]string{
+		"oidc_issuer":           issuer,
+		"oidc_audience":         "broker",
+		"oidc_username_claim":   "preferred_username",
+		"oidc_superuser_groups": "/admins",
+		"oidc_group_acls":       "/devices:write:devices/%u/#",
+		"oidc_scope_acls":       "telemetry:read:telemetry/#",
+	}
+
+	Convey("Given a wrong issuer, the backend should fail to start", t, func() {
+		_, err := NewOIDC(map[string]string{"oidc_issuer": server.URL + "/realms/other"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewOIDC(map[string]string{}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given an issuer, tokens should be verified with its discovered keys", t, func() {
+		o, err := NewOIDC(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		So(o.JWKSURL, ShouldEqual, issuer+"/certs")
+		So(o.Capabilities().Superuser, ShouldBeTrue)
+
+		So(o.GetUser("device-1", sign(nil)), ShouldBeTrue)
+		granted, err := o.UserCheck("device-2", sign(nil))
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+
+		So(o.GetUser("device-1", sign(jwt.MapClaims{"iss": "https://evil.example.com"})), ShouldBeFalse)
+		So(o.GetUser("device-1", sign(jwt.MapClaims{"aud": "other"})), ShouldBeFalse)
+		So(o.GetUser("device-1", sign(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), ShouldBeFalse)
+		So(o.GetUser("device-1", sign(jwt.MapClaims{"exp": nil})), ShouldBeFalse)
+		So(o.GetUser("device-1", sign(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()})), ShouldBeFalse)
+
+		other, _ := rsa.GenerateKey(rand.Reader, 2048)
+		forged := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"iss": issuer, "aud": "broker", "preferred_username": "device-1", "exp": time.Now().Add(time.Hour).Unix()})
+		forged.Header["kid"] = "oidc-key"
+		forgedToken, _ := forged.SignedString(other)
+		So(o.GetUser("device-1", forgedToken), ShouldBeFalse)
+
+		Convey("Superuser and acl checks should be given by the token's groups and scopes", func() {
+			So(o.GetUser("device-1", sign(nil)), ShouldBeTrue)
+			So(o.GetSuperuser("device-1"), ShouldBeFalse)
+			So(o.CheckAcl("device-1", "devices/device-1/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(o.CheckAcl("device-1", "devices/device-2/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(o.CheckAcl("device-1", "telemetry/room", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(o.CheckAcl("device-1", "telemetry/room", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+
+			So(o.GetUser("admin", sign(jwt.MapClaims{"preferred_username": "admin", "groups": []string{"/admins"}, "scope": nil})), ShouldBeTrue)
+			So(o.GetSuperuser("admin"), ShouldBeTrue)
+			So(o.CheckAcl("admin", "telemetry/room", "client", MOSQ_ACL_READ), ShouldBeFalse)
+
+			granted, err := o.AclCheck("unknown", "telemetry/room", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		})
+
+		Convey("Checks should fail once the user's token expired", func() {
+			So(o.GetUser("device-1", sign(jwt.MapClaims{"exp": time.Now().Add(time.Second).Unix()})), ShouldBeTrue)
+			time.Sleep(time.Until(time.Unix(time.Now().Add(time.Second).Unix(), 0)))
+			granted, err := o.AclCheck("device-1", "telemetry/room", "client", MOSQ_ACL_READ)
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+		})
+	})
+}
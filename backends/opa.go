@@ -0,0 +1,274 @@
+package backends
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	h "net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//OPA answers acl checks, and optionally superuser ones, by asking an Open Policy Agent server to evaluate a policy through its data api,
+//so topic authorization may be written as Rego policies. It doesn't check users, so it's meant to be used along with a backend that does.
+type OPA struct {
+	URL           string
+	AclPath       string //AclPath is the path of the rule deciding acl checks, e.g. mqtt/acl/allow for data.mqtt.acl.allow.
+	SuperuserPath string //SuperuserPath is the path of the rule deciding superuser checks, none if empty.
+	Token         string
+	Timeout       time.Duration
+	TLSConfig     *tls.Config
+	VerifyPeer    bool
+	Dialer        *common.Dialer
+	Limits        ResponseLimits
+	errs          *checkErrors
+}
+
+//opaFields are the response fields of the data api, allowed by strict response limits.
+var opaFields = []string{"result", "decision_id", "metrics", "provenance"}
+
+func init() {
+	register("opa", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewOPA(authOpts, logLevel)
+	})
+}
+
+//NewOPA initializes an Open Policy Agent backend.
+func NewOPA(authOpts map[string]string, logLevel log.Level) (OPA, error) {
+
+	log.SetLevel(logLevel)
+
+	var o = OPA{
+		AclPath: "mqtt/acl/allow",
+		Timeout: 5 * time.Second,
+	}
+
+	if opaURL, ok := authOpts["opa_url"]; ok && strings.TrimSpace(opaURL) != "" {
+		o.URL = strings.TrimSuffix(strings.TrimSpace(opaURL), "/")
+	} else {
+		return o, errors.New("OPA backend error: missing option opa_url.\n")
+	}
+
+	u, err := url.Parse(o.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return o, errors.Errorf("OPA backend error: bad opa_url %s.\n", o.URL)
+	}
+
+	if aclPath, ok := authOpts["opa_acl_path"]; ok {
+		o.AclPath = opaPath(aclPath)
+		if o.AclPath == "" {
+			return o, errors.New("OPA backend error: opa_acl_path can't be empty.\n")
+		}
+	}
+	o.SuperuserPath = opaPath(authOpts["opa_superuser_path"])
+
+	o.Token, err = optionOrFile(authOpts, "opa_token")
+	if err != nil {
+		return o, errors.Errorf("OPA backend error: %s\n", err)
+	}
+
+	if timeout, ok := authOpts["opa_timeout"]; ok {
+		d, err := time.ParseDuration(strings.Replace(timeout, " ", "", -1))
+		if err != nil || d <= 0 {
+			return o, errors.Errorf("OPA backend error: couldn't parse opa_timeout %s.\n", timeout)
+		}
+		o.Timeout = d
+	}
+
+	o.TLSConfig, err = parseRemoteTLS(authOpts, "opa")
+	if err != nil {
+		return o, errors.Errorf("OPA backend error: %s\n", err)
+	}
+	o.VerifyPeer = parseVerifyPeer(authOpts, "opa", u.Scheme == "https")
+
+	o.Dialer, err = common.NewDialer(authOpts, "opa")
+	if err != nil {
+		return o, errors.Errorf("OPA backend error: %s\n", err)
+	}
+
+	o.Limits = parseResponseLimits(authOpts, "opa")
+
+	log.Infof("opa: acl checks decided by data.%s at %s", strings.Replace(o.AclPath, "/", ".", -1), o.URL)
+
+	return o, nil
+}
+
+//opaPath turns a rule given as a path (mqtt/acl/allow) or a reference (data.mqtt.acl.allow) into a data api path.
+func opaPath(rule string) string {
+	rule = strings.Trim(strings.TrimSpace(rule), "/")
+	if strings.Contains(rule, "/") {
+		return rule
+	}
+	rule = strings.TrimPrefix(rule, "data.")
+	return strings.Replace(rule, ".", "/", -1)
+}
+
+//GetUser always fails, as users aren't checked by policies.
+func (o OPA) GetUser(username, password string) bool {
+	return false
+}
+
+//GetSuperuser asks the superuser rule, if given, whether the user is a superuser.
+func (o OPA) GetSuperuser(username string) bool {
+	if o.SuperuserPath == "" {
+		return false
+	}
+
+	return o.decide(o.SuperuserPath, map[string]interface{}{"username": username})
+}
+
+//CheckAcl asks the acl rule whether the user may access topic with acc.
+func (o OPA) CheckAcl(username, topic, clientid string, acc int32) bool {
+	input := map[string]interface{}{
+		"username": username,
+		"clientid": clientid,
+		"topic":    topic,
+		"acc":      acc,
+	}
+	if address := common.ClientAddress(clientid); address != nil {
+		input["address"] = address.String()
+	}
+
+	return o.decide(o.AclPath, input)
+}
+
+//decide evaluates the rule at path with input. Rules must result in a boolean: an undefined result means the policy isn't loaded
+//or doesn't define the rule, and is taken as the backend being misconfigured.
+func (o OPA) decide(path string, input map[string]interface{}) bool {
+	payload, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		log.Errorf("OPA backend error: couldn't encode input: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	req, err := h.NewRequest("POST", o.URL+"/v1/data/"+path, bytes.NewReader(payload))
+	if err != nil {
+		log.Errorf("OPA backend error: couldn't create request: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.Token)
+	}
+
+	resp, err := o.client().Do(req)
+	if err != nil {
+		log.Errorf("OPA backend error: request failed: %s\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := o.Limits.read(resp.Body)
+	if err != nil {
+		log.Errorf("OPA backend error: couldn't read response: %s\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
+		return false
+	}
+
+	//OPA answers bad input or policy errors with 4xx and failures to evaluate with 5xx.
+	if resp.StatusCode != h.StatusOK {
+		err := errors.Errorf("wrong http status %d for data.%s", resp.StatusCode, strings.Replace(path, "/", ".", -1))
+		log.Errorf("OPA backend error: %s\n", err)
+		if resp.StatusCode >= 500 {
+			o.errs.set(ErrBackendUnavailable, err)
+		} else {
+			o.errs.set(ErrMisconfigured, err)
+		}
+		return false
+	}
+
+	if err := o.Limits.checkJSON(body, opaFields...); err != nil {
+		log.Errorf("OPA backend error: bad response: %s\n", err)
+		o.errs.set(ErrBackendUnavailable, err)
+		return false
+	}
+
+	var response struct {
+		Result     *bool  `json:"result"`
+		DecisionID string `json:"decision_id"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		err = errors.Errorf("data.%s must result in a boolean: %s", strings.Replace(path, "/", ".", -1), err)
+		log.Errorf("OPA backend error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	if response.Result == nil {
+		err := errors.Errorf("data.%s is undefined", strings.Replace(path, "/", ".", -1))
+		log.Errorf("OPA backend error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	if response.DecisionID != "" {
+		log.Debugf("opa decision %s: %t", response.DecisionID, *response.Result)
+	}
+
+	return *response.Result
+}
+
+func (o OPA) client() *h.Client {
+	client := &h.Client{Timeout: o.Timeout}
+	if tr := remoteTransport(o.TLSConfig, o.VerifyPeer, o.Dialer); tr != nil {
+		client.Transport = tr
+	}
+	return client
+}
+
+//Healthy checks the server's health api answers it's ready.
+func (o OPA) Healthy() bool {
+	client := o.client()
+	client.Timeout = 2 * time.Second
+
+	resp, err := client.Get(o.URL + "/health")
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == h.StatusOK
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o OPA) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o OPA) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o OPA) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//Capabilities tells users aren't checked, and superusers only when a superuser rule is given.
+func (o OPA) Capabilities() Capabilities {
+	return Capabilities{Superuser: o.SuperuserPath != "", Acl: true}
+}
+
+//GetName returns the backend's name
+func (o OPA) GetName() string {
+	return "OPA"
+}
+
+//Halt does nothing, as requests aren't kept open.
+func (o OPA) Halt() {}
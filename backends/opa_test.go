@@ -0,0 +1,118 @@
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOPA(t *testing.T) {
+
+	//The server evaluates a policy letting users write to their own devices and admins be superusers.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/data/mqtt/acl/allow", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request struct {
+			Input struct {
+				Username string `json:"username"`
+				Clientid string `json:"clientid"`
+				Topic    string `json:"topic"`
+				Acc      int32  `json:"acc"`
+			} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		allowed := request.Input.Acc == MOSQ_ACL_WRITE && strings.HasPrefix(request.Input.Topic, "devices/"+request.Input.Username+"/")
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": allowed, "decision_id": "4ca636c1"})
+	})
+	mux.HandleFunc("/v1/data/mqtt/superuser", func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Input map[string]interface{} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": request.Input["username"] == "admin"})
+	})
+	mux.HandleFunc("/v1/data/mqtt/undefined", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/v1/data/mqtt/object", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result": {"allow": true}}`))
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	authOpts := map[string]string{
+		"opa_url":            server.URL,
+		"opa_token":          "secret",
+		"opa_superuser_path": "data.mqtt.superuser",
+	}
+
+	Convey("Given missing or wrong options, the backend should fail to start", t, func() {
+		_, err := NewOPA(map[string]string{}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+
+		_, err = NewOPA(map[string]string{"opa_url": "localhost:8181"}, log.DebugLevel)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a policy, acl and superuser checks should be decided by it", t, func() {
+		o, err := NewOPA(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer o.Halt()
+
+		So(o.AclPath, ShouldEqual, "mqtt/acl/allow")
+		So(o.SuperuserPath, ShouldEqual, "mqtt/superuser")
+		So(o.Capabilities().User, ShouldBeFalse)
+		So(o.Capabilities().Superuser, ShouldBeTrue)
+		So(o.Healthy(), ShouldBeTrue)
+
+		So(o.GetUser("test", "test"), ShouldBeFalse)
+		So(o.GetSuperuser("admin"), ShouldBeTrue)
+		So(o.GetSuperuser("test"), ShouldBeFalse)
+
+		So(o.CheckAcl("test", "devices/test/temp", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+		So(o.CheckAcl("test", "devices/other/temp", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+		granted, err := o.AclCheck("test", "devices/test/temp", "client", MOSQ_ACL_READ)
+		So(granted, ShouldBeFalse)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Undefined or non boolean results and rejected requests should be reported as misconfigurations", t, func() {
+		for _, path := range []string{"mqtt/undefined", "mqtt.object"} {
+			opts := map[string]string{"opa_url": server.URL, "opa_token": "secret", "opa_acl_path": path}
+			o, err := NewOPA(opts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			granted, err := o.AclCheck("test", "devices/test/temp", "client", MOSQ_ACL_WRITE)
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrMisconfigured)
+		}
+
+		o, err := NewOPA(map[string]string{"opa_url": server.URL}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		granted, err := o.AclCheck("test", "devices/test/temp", "client", MOSQ_ACL_WRITE)
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrMisconfigured)
+	})
+
+	Convey("Given an unreachable server, checks should fail as unavailable", t, func() {
+		o, err := NewOPA(map[string]string{"opa_url": "http://127.0.0.1:1"}, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		granted, err := o.AclCheck("test", "devices/test/temp", "client", MOSQ_ACL_WRITE)
+		So(granted, ShouldBeFalse)
+		So(ErrorKind(err), ShouldEqual, ErrBackendUnavailable)
+		So(o.Healthy(), ShouldBeFalse)
+	})
+}
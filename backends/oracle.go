@@ -0,0 +1,349 @@
+// +build !nooracle
+
+package backends
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	goora "github.com/sijms/go-ora/v2"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//Oracle holds all fields of the Oracle db connection.
+type Oracle struct {
+	DB              *sqlx.DB
+	Host            string
+	Port            int
+	Service         string
+	User            string
+	Password        string
+	UserQuery       string
+	SuperuserQuery  string
+	AclQuery        string
+	QueryParams     *QueryParams
+	MaxOpenConns    int           //MaxOpenConns is the maximum number of open connections, unlimited if 0.
+	MaxIdleConns    int           //MaxIdleConns is the maximum number of idle connections kept, database/sql's default if 0.
+	ConnMaxLifetime time.Duration //ConnMaxLifetime is how long a connection may be reused, forever if 0.
+	errs            *checkErrors
+	hint            *cacheHint
+	metadata        *common.ClientMetadata
+}
+
+func init() {
+	register("oracle", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewOracle(authOpts, logLevel)
+	})
+}
+
+func NewOracle(authOpts map[string]string, logLevel log.Level) (Oracle, error) {
+
+	log.SetLevel(logLevel)
+
+	//Set defaults for oracle
+
+	oracleOk := true
+	missingOptions := ""
+
+	var oracle = Oracle{
+		Host: "localhost",
+		Port: 1521,
+	}
+
+	if host, ok := authOpts["oracle_host"]; ok {
+		oracle.Host = host
+	}
+
+	if port, ok := authOpts["oracle_port"]; ok {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 {
+			return oracle, errors.Errorf("Oracle backend error: couldn't parse oracle_port %s.\n", port)
+		}
+		oracle.Port = p
+	}
+
+	if service, ok := authOpts["oracle_service"]; ok {
+		oracle.Service = service
+	} else {
+		oracleOk = false
+		missingOptions += " oracle_service"
+	}
+
+	if user, ok := authOpts["oracle_user"]; ok {
+		oracle.User = user
+	} else {
+		oracleOk = false
+		missingOptions += " oracle_user"
+	}
+
+	if password, ok := authOpts["oracle_password"]; ok {
+		oracle.Password = password
+	} else {
+		oracleOk = false
+		missingOptions += " oracle_password"
+	}
+
+	if userQuery, ok := authOpts["oracle_userquery"]; ok {
+		oracle.UserQuery = userQuery
+	} else {
+		oracleOk = false
+		missingOptions += " oracle_userquery"
+	}
+
+	if superuserQuery, ok := authOpts["oracle_superquery"]; ok {
+		oracle.SuperuserQuery = superuserQuery
+	}
+
+	if aclQuery, ok := authOpts["oracle_aclquery"]; ok {
+		oracle.AclQuery = aclQuery
+	}
+
+	queryParams, err := parseQueryParams(authOpts, "oracle")
+	if err != nil {
+		return oracle, errors.Errorf("Oracle backend error: %s\n", err)
+	}
+	if err := queryParams.validate(oracle.UserQuery, oracle.SuperuserQuery, oracle.AclQuery); err != nil {
+		return oracle, errors.Errorf("Oracle backend error: %s\n", err)
+	}
+	oracle.QueryParams = queryParams
+
+	if maxOpenConns, ok := authOpts["oracle_max_open_conns"]; ok {
+		n, err := strconv.Atoi(maxOpenConns)
+		if err != nil || n < 0 {
+			return oracle, errors.Errorf("Oracle backend error: couldn't parse oracle_max_open_conns %s.\n", maxOpenConns)
+		}
+		oracle.MaxOpenConns = n
+	}
+
+	if maxIdleConns, ok := authOpts["oracle_max_idle_conns"]; ok {
+		n, err := strconv.Atoi(maxIdleConns)
+		if err != nil || n < 0 {
+			return oracle, errors.Errorf("Oracle backend error: couldn't parse oracle_max_idle_conns %s.\n", maxIdleConns)
+		}
+		oracle.MaxIdleConns = n
+	}
+
+	if lifetime, ok := authOpts["oracle_conn_max_lifetime"]; ok {
+		d, err := time.ParseDuration(strings.Replace(lifetime, " ", "", -1))
+		if err != nil || d < 0 {
+			return oracle, errors.Errorf("Oracle backend error: couldn't parse oracle_conn_max_lifetime %s.\n", lifetime)
+		}
+		oracle.ConnMaxLifetime = d
+	}
+
+	//Exit if any mandatory option is missing.
+	if !oracleOk {
+		return oracle, errors.Errorf("Oracle backend error: missing options%s.\n", missingOptions)
+	}
+
+	dialer, err := common.NewDialer(authOpts, "oracle")
+	if err != nil {
+		return oracle, errors.Errorf("Oracle backend error: %s\n", err)
+	}
+
+	connector := goora.NewConnector(goora.BuildUrl(oracle.Host, oracle.Port, oracle.Service, oracle.User, oracle.Password, nil)).(*goora.OracleConnector)
+	if dialer != nil {
+		connector.Dialer(dialer)
+	}
+
+	oracle.DB = common.OpenConnector(connector, "oracle")
+
+	oracle.DB.SetMaxOpenConns(oracle.MaxOpenConns)
+	if oracle.MaxIdleConns > 0 {
+		oracle.DB.SetMaxIdleConns(oracle.MaxIdleConns)
+	}
+	oracle.DB.SetConnMaxLifetime(oracle.ConnMaxLifetime)
+
+	return oracle, nil
+
+}
+
+//GetUser checks that the username exists and the given password hashes to the same password.
+func (o Oracle) GetUser(username, password string) bool {
+
+	query, args, err := o.QueryParams.bind(o.DB, o.UserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("Oracle get user error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	var pwHash sql.NullString
+	err = o.DB.Get(&pwHash, query, args...)
+
+	if err != nil {
+		log.Debugf("Oracle get user error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("Oracle get user error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
+		return false
+	}
+
+	if common.HashCompare(password, pwHash.String) {
+		return true
+	}
+
+	o.errs.set(ErrBadCredentials, nil)
+	return false
+
+}
+
+//GetSuperuser checks that the username meets the superuser query.
+func (o Oracle) GetSuperuser(username string) bool {
+
+	//If there's no superuser query, return false.
+	if o.SuperuserQuery == "" {
+		return false
+	}
+
+	query, args, err := o.QueryParams.bind(o.DB, o.SuperuserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("Oracle get superuser error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	var count sql.NullInt64
+	err = o.DB.Get(&count, query, args...)
+
+	if err != nil {
+		log.Debugf("Oracle get superuser error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if !count.Valid {
+		log.Debugf("Oracle get superuser error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
+		return false
+	}
+
+	if count.Int64 > 0 {
+		return true
+	}
+
+	return false
+
+}
+
+//CheckAcl gets all acls for the username and tries to match against topic, acc, and username/clientid if needed.
+func (o Oracle) CheckAcl(username, topic, clientid string, acc int32) bool {
+
+	//If there's no acl query, assume all privileges for all users.
+	if o.AclQuery == "" {
+		return true
+	}
+
+	query, args, err := o.QueryParams.bind(o.DB, o.AclQuery, username, o.metadata, map[string]interface{}{"acc": acc, "clientid": clientid, "topic": topic}, username, acc)
+	if err != nil {
+		log.Debugf("Oracle check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	var acls []string
+
+	err = o.DB.Select(&acls, query, args...)
+
+	if err != nil {
+		log.Debugf("Oracle check acl error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if err := common.CheckAclRules(username, acls); err != nil {
+		log.Errorf("Oracle check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	now := time.Now()
+	for _, acl := range acls {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
+			return true
+		}
+	}
+
+	return false
+
+}
+
+//Healthy checks the database answers a ping.
+func (o Oracle) Healthy() bool {
+	return o.DB != nil && o.DB.Ping() == nil
+}
+
+//OpenConnections returns the number of connections to the database, in use or idle.
+func (o Oracle) OpenConnections() int {
+	if o.DB == nil {
+		return 0
+	}
+	return o.DB.Stats().OpenConnections
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Oracle) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Oracle) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Oracle) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Oracle) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend binding the client's cert_subject and address to named query params.
+func (o Oracle) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//Capabilities tells which checks are set by the given queries.
+func (o Oracle) Capabilities() Capabilities {
+	return sqlCapabilities(o.SuperuserQuery, "", "")
+}
+
+//GetName returns the backend's name
+func (o Oracle) GetName() string {
+	return "Oracle"
+}
+
+//Halt closes the oracle connection.
+func (o Oracle) Halt() {
+	if o.DB != nil {
+		err := o.DB.Close()
+		if err != nil {
+			log.Errorf("Oracle cleanup error: %s", err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// +build !nooracle
+
+package backends
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestOracleOptions(t *testing.T) {
+
+	authOpts := map[string]string{
+		"oracle_service":   "XEPDB1",
+		"oracle_user":      "go_auth_test",
+		"oracle_password":  "go_auth_test",
+		"oracle_userquery": "SELECT password_hash FROM test_user WHERE username = :1",
+	}
+
+	Convey("If mandatory params are not set initialization should fail", t, func() {
+		_, err := NewOracle(map[string]string{"oracle_host": "localhost"}, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given wrong port or pool settings initialization should fail", t, func() {
+		for option, value := range map[string]string{
+			"oracle_port":              "port",
+			"oracle_max_open_conns":    "-1",
+			"oracle_max_idle_conns":    "some",
+			"oracle_conn_max_lifetime": "1 hour",
+		} {
+			opts := map[string]string{option: value}
+			for k, v := range authOpts {
+				opts[k] = v
+			}
+			_, err := NewOracle(opts, log.DebugLevel)
+			So(err, ShouldBeError)
+		}
+	})
+
+	Convey("Named params should be rebound to oracle's placeholders", t, func() {
+		db := sqlx.NewDb(nil, "oracle")
+		params := &QueryParams{}
+
+		query, args, err := params.bind(db, "SELECT topic FROM test_acl WHERE username = :username AND rw >= :acc", "test", nil, map[string]interface{}{"acc": int32(1)})
+		So(err, ShouldBeNil)
+		So(query, ShouldEqual, "SELECT topic FROM test_acl WHERE username = :arg1 AND rw >= :arg2")
+		So(args, ShouldResemble, []interface{}{"test", int32(1)})
+	})
+}
+
+func TestOracle(t *testing.T) {
+
+	requireIntegration(t, "oracle")
+
+	authOpts := map[string]string{
+		"oracle_service":           "XEPDB1",
+		"oracle_user":              "go_auth_test",
+		"oracle_password":          "go_auth_test",
+		"oracle_max_open_conns":    "4",
+		"oracle_max_idle_conns":    "2",
+		"oracle_conn_max_lifetime": "5m",
+		"oracle_userquery":         "SELECT password_hash FROM test_user WHERE username = :1 FETCH FIRST 1 ROWS ONLY",
+		"oracle_superquery":        "SELECT COUNT(*) FROM test_user WHERE username = :1 AND is_admin = 1",
+		"oracle_aclquery":          "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = :1 AND test_acl.test_user_id = test_user.id AND (rw >= :2 OR rw = 3)",
+	}
+
+	Convey("Given valid params NewOracle should return an Oracle backend instance", t, func() {
+		oracle, err := NewOracle(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer oracle.Halt()
+
+		So(oracle.MaxOpenConns, ShouldEqual, 4)
+		So(oracle.ConnMaxLifetime, ShouldEqual, 5*time.Minute)
+		So(oracle.DB.Stats().MaxOpenConnections, ShouldEqual, 4)
+
+		//Oracle has no CREATE TABLE IF NOT EXISTS, so existing tables (ORA-00955) are ignored.
+		for _, table := range []string{
+			"CREATE TABLE test_user(id NUMBER PRIMARY KEY, username VARCHAR2(100) NOT NULL, password_hash VARCHAR2(200) NOT NULL, is_admin NUMBER(1) NOT NULL)",
+			"CREATE TABLE test_acl(id NUMBER PRIMARY KEY, test_user_id NUMBER NOT NULL, topic VARCHAR2(200) NOT NULL, rw NUMBER NOT NULL)",
+		} {
+			oracle.DB.MustExec("BEGIN EXECUTE IMMEDIATE '" + table + "'; EXCEPTION WHEN OTHERS THEN IF SQLCODE != -955 THEN RAISE; END IF; END;")
+		}
+		oracle.DB.MustExec("DELETE FROM test_acl")
+		oracle.DB.MustExec("DELETE FROM test_user")
+
+		//Hash generated by the pw utility
+		userPassHash := "PBKDF2$sha512$100000$os24lcPr9cJt2QDVWssblQ==$BK1BQ2wbwU1zNxv3Ml3wLuu5//hPop3/LvaPYjjCwdBvnpwusnukJPpcXQzyyjOlZdieXTx6sXAcX4WnZRZZnw=="
+
+		oracle.DB.MustExec("INSERT INTO test_user(id, username, password_hash, is_admin) VALUES(1, :1, :2, 1)", "test", userPassHash)
+		oracle.DB.MustExec("INSERT INTO test_acl(id, test_user_id, topic, rw) VALUES(1, 1, :1, :2)", "test/topic/1", MOSQ_ACL_READ)
+
+		Convey("Given a username and a correct password, it should correctly authenticate it", func() {
+			So(oracle.GetUser("test", "testpw"), ShouldBeTrue)
+			So(oracle.GetUser("test", "wrong_password"), ShouldBeFalse)
+			So(oracle.GetUser("not_present", "testpw"), ShouldBeFalse)
+		})
+
+		Convey("Given a username that is admin, super user should pass", func() {
+			So(oracle.GetSuperuser("test"), ShouldBeTrue)
+			So(oracle.GetSuperuser("not_admin"), ShouldBeFalse)
+		})
+
+		Convey("Given acls, only the saved topics with the right access should pass", func() {
+			So(oracle.CheckAcl("test", "test/topic/1", "test_client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(oracle.CheckAcl("test", "test/topic/1", "test_client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(oracle.CheckAcl("test", "test/topic/2", "test_client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,38 @@
+package backends
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+//PasswordAger is implemented by backends that know when a user's password was last changed.
+type PasswordAger interface {
+	//PasswordChangedAt returns when the password for username was last changed, or false if it's not known.
+	PasswordChangedAt(username string) (time.Time, bool)
+}
+
+//queryPasswordChangedAt runs a query that returns the unix time at which the password for username was last changed.
+func queryPasswordChangedAt(db *sqlx.DB, query, username, backend string) (time.Time, bool) {
+
+	if query == "" {
+		return time.Time{}, false
+	}
+
+	var changedAt sql.NullInt64
+	err := db.Get(&changedAt, query, username)
+
+	if err != nil {
+		log.Debugf("%s password changed at error: %s\n", backend, err)
+		return time.Time{}, false
+	}
+
+	if !changedAt.Valid {
+		return time.Time{}, false
+	}
+
+	return time.Unix(changedAt.Int64, 0), true
+
+}
@@ -0,0 +1,270 @@
+package backends
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//PeerCred authorizes clients connected through a mosquitto unix socket listener by the uid/gid of the process at the other end of their own connection.
+type PeerCred struct {
+	SocketPath string
+	Uids       map[uint32]string //Uids maps a peer's uid to the username it may connect as.
+	Gids       map[uint32]string //Gids maps a peer's gid to the username it may connect as.
+	Superusers map[string]bool
+	CheckAcls  bool
+	Acls       Files //Acls holds the acl records read from peercred_acl_path, parsed as a files backend acl file.
+	metadata   *common.ClientMetadata
+	errs       *checkErrors
+}
+
+//Ucred holds the credentials of the process at the other end of a unix socket connection.
+type Ucred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+func init() {
+	register("peercred", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewPeerCred(authOpts, logLevel)
+	})
+}
+
+//NewPeerCred initializes a peer credentials backend.
+func NewPeerCred(authOpts map[string]string, logLevel log.Level) (PeerCred, error) {
+
+	log.SetLevel(logLevel)
+
+	var peerCred = PeerCred{
+		Uids:       make(map[uint32]string),
+		Gids:       make(map[uint32]string),
+		Superusers: make(map[string]bool),
+		CheckAcls:  false,
+	}
+
+	if socketPath, ok := authOpts["peercred_socket"]; ok {
+		peerCred.SocketPath = socketPath
+	} else {
+		return peerCred, errors.New("PeerCred backend error: no socket path given.\n")
+	}
+
+	var err error
+
+	if uids, ok := authOpts["peercred_uids"]; ok {
+		peerCred.Uids, err = parseIdMap(uids)
+		if err != nil {
+			return peerCred, errors.Errorf("PeerCred backend error: wrong peercred_uids format: %s\n", err)
+		}
+	}
+
+	if gids, ok := authOpts["peercred_gids"]; ok {
+		peerCred.Gids, err = parseIdMap(gids)
+		if err != nil {
+			return peerCred, errors.Errorf("PeerCred backend error: wrong peercred_gids format: %s\n", err)
+		}
+	}
+
+	if len(peerCred.Uids) == 0 && len(peerCred.Gids) == 0 {
+		return peerCred, errors.New("PeerCred backend error: at least one of peercred_uids or peercred_gids must be given.\n")
+	}
+
+	if superusers, ok := authOpts["peercred_superusers"]; ok {
+		for _, superuser := range strings.Split(strings.Replace(superusers, " ", "", -1), ",") {
+			if superuser != "" {
+				peerCred.Superusers[superuser] = true
+			}
+		}
+	}
+
+	//Acls are optional and use the same format as the files backend. Users are the mapped usernames.
+	if aclPath, ok := authOpts["peercred_acl_path"]; ok {
+		peerCred.CheckAcls = true
+		peerCred.Acls = Files{
+			AclPath:    aclPath,
+			CheckAcls:  true,
+			Users:      make(map[string]*FileUser),
+			AclRecords: make([]AclRecord, 0, 0),
+		}
+
+		for _, username := range peerCred.usernames() {
+			peerCred.Acls.Users[username] = &FileUser{
+				AclRecords: make([]AclRecord, 0, 0),
+			}
+		}
+
+		aclCount, aclErr := peerCred.Acls.readAcls()
+		if aclErr != nil {
+			return peerCred, errors.Errorf("PeerCred backend error: %s\n", aclErr)
+		}
+		log.Infof("Got %d lines from peercred acl file.\n", aclCount)
+	} else {
+		log.Info("PeerCred acls won't be checked, so access is denied to peers unless other backends grant it.\n")
+	}
+
+	return peerCred, nil
+}
+
+//parseIdMap parses a list of id:username pairs separated by commas.
+func parseIdMap(s string) (map[uint32]string, error) {
+	idMap := make(map[uint32]string)
+	for _, pair := range strings.Split(strings.Replace(s, " ", "", -1), ",") {
+		if pair == "" {
+			continue
+		}
+		pairArr := strings.Split(pair, ":")
+		if len(pairArr) != 2 || pairArr[1] == "" {
+			return nil, errors.Errorf("expected id:username, got %s", pair)
+		}
+		id, err := strconv.ParseUint(pairArr[0], 10, 32)
+		if err != nil {
+			return nil, errors.Errorf("invalid id %s: %s", pairArr[0], err)
+		}
+		idMap[uint32(id)] = pairArr[1]
+	}
+	return idMap, nil
+}
+
+//usernames returns every username mapped from a uid or gid.
+func (o PeerCred) usernames() []string {
+	seen := make(map[string]bool)
+	var usernames []string
+	for _, username := range o.Uids {
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	for _, username := range o.Gids {
+		if !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+//matches checks if the given credentials map to the username, either by uid or by gid.
+func (o PeerCred) matches(cred Ucred, username string) bool {
+	if mapped, ok := o.Uids[cred.Uid]; ok && mapped == username {
+		return true
+	}
+	if mapped, ok := o.Gids[cred.Gid]; ok && mapped == username {
+		return true
+	}
+	return false
+}
+
+//peerMatches checks that the client being checked is connected through the unix socket listener and that the process at the other end of its connection maps to username.
+//Clients connected through other listeners are not found, so other backends may check them.
+func (o PeerCred) peerMatches(username string) bool {
+
+	if o.metadata == nil || o.metadata.Socket == nil {
+		log.Errorf("PeerCred error: the client's connection is unknown, the plugin must be built with GO_AUTH_CLIENT_SOCKET\n")
+		o.errs.set(ErrMisconfigured, errors.New("client socket unknown"))
+		return false
+	}
+
+	peer, err := connectionPeer(*o.metadata.Socket, o.SocketPath)
+	if err != nil {
+		log.Debugf("PeerCred: user %s not connected through %s: %s\n", username, o.SocketPath, err)
+		o.errs.set(ErrNotFound, err)
+		return false
+	}
+
+	if !o.matches(peer, username) {
+		log.Debugf("PeerCred: peer with pid %d, uid %d and gid %d doesn't map to user %s\n", peer.Pid, peer.Uid, peer.Gid, username)
+		o.errs.set(ErrNotFound, nil)
+		return false
+	}
+
+	log.Debugf("PeerCred: user %s matched peer with pid %d, uid %d and gid %d\n", username, peer.Pid, peer.Uid, peer.Gid)
+	return true
+}
+
+//ForClient returns a copy of the backend checking the client's connection.
+func (o PeerCred) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//GetUser checks that the process at the other end of the client's connection maps to username. The password is ignored.
+func (o PeerCred) GetUser(username, password string) bool {
+	return o.peerMatches(username)
+}
+
+//GetSuperuser checks that the username is listed at peercred_superusers and that the client is connected as it.
+func (o PeerCred) GetSuperuser(username string) bool {
+	if !o.Superusers[username] {
+		return false
+	}
+	return o.peerMatches(username)
+}
+
+//CheckAcl checks the topic against the acl file for clients connected as username. With no acl file, access is denied.
+func (o PeerCred) CheckAcl(username, topic, clientid string, acc int32) bool {
+	if !o.CheckAcls || !o.peerMatches(username) {
+		return false
+	}
+
+	return o.Acls.CheckAcl(username, topic, clientid, acc)
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o PeerCred) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o PeerCred) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o PeerCred) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedUserCheck checks the user as UserCheck does, hinting the decision must not be cached,
+//as cache entries are keyed by credentials and not by the connection that was checked.
+func (o PeerCred) HintedUserCheck(username, password string) (bool, CacheHint, error) {
+	granted, err := o.UserCheck(username, password)
+	return granted, CacheHint{TTL: 0, Hinted: true}, err
+}
+
+//HintedSuperuserCheck checks the superuser as SuperuserCheck does, hinting the decision must not be cached.
+func (o PeerCred) HintedSuperuserCheck(username string) (bool, CacheHint, error) {
+	granted, err := o.SuperuserCheck(username)
+	return granted, CacheHint{TTL: 0, Hinted: true}, err
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached.
+func (o PeerCred) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, CacheHint{TTL: 0, Hinted: true}, err
+}
+
+//Capabilities tells superusers are only checked when peercred_superusers are given, and acls when peercred_acl_path is.
+func (o PeerCred) Capabilities() Capabilities {
+	return Capabilities{User: true, Superuser: len(o.Superusers) > 0, Acl: o.CheckAcls}
+}
+
+//GetName returns the backend's name
+func (o PeerCred) GetName() string {
+	return "PeerCred"
+}
+
+//Halt does nothing for peercred as there's no cleanup needed.
+func (o PeerCred) Halt() {
+	//Do nothing
+}
@@ -0,0 +1,37 @@
+// +build linux
+
+package backends
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+//connectionPeer returns the credentials of the process at the other end of the client connection with file descriptor fd,
+//which must have been accepted on the unix socket listener at socketPath. Mosquitto doesn't hand the client's socket to plugins,
+//but when built to read it the plugin gets its descriptor, which is valid in the broker's process the plugin lives in.
+func connectionPeer(fd int, socketPath string) (Ucred, error) {
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return Ucred{}, errors.Wrap(err, "couldn't get the connection's address")
+	}
+
+	unixAddr, ok := sa.(*syscall.SockaddrUnix)
+	if !ok || unixAddr.Name != socketPath {
+		return Ucred{}, errors.New("not connected through the unix socket listener")
+	}
+
+	//A listening socket has no peer, which would mean the descriptor isn't the client's.
+	if listening, aErr := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); aErr != nil || listening == 1 {
+		return Ucred{}, errors.New("not a client connection")
+	}
+
+	cred, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return Ucred{}, errors.Wrap(err, "couldn't get peer credentials")
+	}
+
+	return Ucred{Pid: cred.Pid, Uid: cred.Uid, Gid: cred.Gid}, nil
+}
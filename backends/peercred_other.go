@@ -0,0 +1,12 @@
+// +build !linux
+
+package backends
+
+import (
+	"github.com/pkg/errors"
+)
+
+//connectionPeer is only supported on linux, where peer credentials may be retrieved with SO_PEERCRED.
+func connectionPeer(fd int, socketPath string) (Ucred, error) {
+	return Ucred{}, errors.New("peer credentials are only supported on linux")
+}
@@ -0,0 +1,178 @@
+// +build linux
+
+package backends
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPeerCred(t *testing.T) {
+
+	authOpts := make(map[string]string)
+
+	Convey("Given empty opts NewPeerCred should fail", t, func() {
+		_, err := NewPeerCred(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	dir, err := ioutil.TempDir("", "peercred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "mosquitto.sock")
+	aclPath := filepath.Join(dir, "acls")
+
+	aclFile := "user tester\ntopic write test/topic/1\n\npattern read peers/%u\n"
+	if err := ioutil.WriteFile(aclPath, []byte(aclFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	authOpts["peercred_socket"] = socketPath
+
+	Convey("Given no uid or gid mappings NewPeerCred should fail", t, func() {
+		_, err := NewPeerCred(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	Convey("Given a wrong uid mapping NewPeerCred should fail", t, func() {
+		authOpts["peercred_uids"] = "root"
+		_, err := NewPeerCred(authOpts, log.DebugLevel)
+		So(err, ShouldBeError)
+	})
+
+	authOpts["peercred_uids"] = fmt.Sprintf("%d:tester", os.Getuid())
+	authOpts["peercred_gids"] = fmt.Sprintf("%d:testers", os.Getgid()+1)
+	authOpts["peercred_superusers"] = "admin"
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	Convey("Given valid params NewPeerCred should return a new peercred backend instance", t, func() {
+		peerCred, err := NewPeerCred(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+
+		Convey("Without the client's connection, checks should fail as misconfigured", func() {
+			granted, err := peerCred.UserCheck("tester", "")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrMisconfigured)
+		})
+
+		client, dErr := net.Dial("unix", socketPath)
+		So(dErr, ShouldBeNil)
+		conn, aErr := listener.Accept()
+		So(aErr, ShouldBeNil)
+		connFile, fErr := conn.(*net.UnixConn).File()
+		So(fErr, ShouldBeNil)
+
+		socket := int(connFile.Fd())
+		unchecked := peerCred
+		peerCred = ForClient(peerCred, &common.ClientMetadata{Socket: &socket}).(PeerCred)
+
+		Convey("Given a copy not checking the client, user check should still fail as misconfigured", func() {
+			granted, err := unchecked.UserCheck("tester", "")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrMisconfigured)
+		})
+
+		Convey("Given the client's connection whose peer uid maps to the username, user check should pass", func() {
+			So(peerCred.GetUser("tester", ""), ShouldBeTrue)
+		})
+
+		Convey("Given a username not mapped to the client's peer, user check should fail", func() {
+			So(peerCred.GetUser("testers", ""), ShouldBeFalse)
+			granted, err := peerCred.UserCheck("unknown", "")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		})
+
+		Convey("Given a client connected elsewhere, user check should fail even with a peer connected to the listener", func() {
+			tcpListener, lErr := net.Listen("tcp", "127.0.0.1:0")
+			So(lErr, ShouldBeNil)
+			defer tcpListener.Close()
+			tcpClient, tErr := net.Dial("tcp", tcpListener.Addr().String())
+			So(tErr, ShouldBeNil)
+			defer tcpClient.Close()
+			tcpConn, tErr := tcpListener.Accept()
+			So(tErr, ShouldBeNil)
+			defer tcpConn.Close()
+			tcpFile, tErr := tcpConn.(*net.TCPConn).File()
+			So(tErr, ShouldBeNil)
+			defer tcpFile.Close()
+
+			tcpSocket := int(tcpFile.Fd())
+			tcpPeerCred := ForClient(peerCred, &common.ClientMetadata{Socket: &tcpSocket}).(PeerCred)
+
+			granted, err := tcpPeerCred.UserCheck("tester", "")
+			So(granted, ShouldBeFalse)
+			So(ErrorKind(err), ShouldEqual, ErrNotFound)
+		})
+
+		Convey("Given the listening socket instead of a client's connection, user check should fail", func() {
+			listenerFile, lErr := listener.(*net.UnixListener).File()
+			So(lErr, ShouldBeNil)
+			defer listenerFile.Close()
+
+			listenerSocket := int(listenerFile.Fd())
+
+			So(ForClient(peerCred, &common.ClientMetadata{Socket: &listenerSocket}).GetUser("tester", ""), ShouldBeFalse)
+		})
+
+		Convey("User checks should hint their decision must not be cached", func() {
+			_, hint, _ := HintedCheckUser(peerCred, "tester", "")
+			So(hint, ShouldResemble, CacheHint{TTL: 0, Hinted: true})
+		})
+
+		Convey("Superuser check should only pass for listed superusers connected as them", func() {
+			So(peerCred.GetSuperuser("admin"), ShouldBeFalse)
+			So(peerCred.GetSuperuser("tester"), ShouldBeFalse)
+
+			authOpts["peercred_superusers"] = "tester"
+			superPeerCred, err := NewPeerCred(authOpts, log.DebugLevel)
+			authOpts["peercred_superusers"] = "admin"
+			So(err, ShouldBeNil)
+			So(ForClient(superPeerCred, &common.ClientMetadata{Socket: &socket}).GetSuperuser("tester"), ShouldBeTrue)
+		})
+
+		Convey("Without an acl file, access should be denied", func() {
+			So(peerCred.CheckAcl("tester", "any/topic", "client", MOSQ_ACL_WRITE), ShouldBeFalse)
+			So(peerCred.Capabilities().Acl, ShouldBeFalse)
+		})
+
+		Convey("Given an acl file, acls should be checked against it for clients connected as the username", func() {
+			authOpts["peercred_acl_path"] = aclPath
+			aclPeerCred, err := NewPeerCred(authOpts, log.DebugLevel)
+			delete(authOpts, "peercred_acl_path")
+			So(err, ShouldBeNil)
+			peerCred := ForClient(aclPeerCred, &common.ClientMetadata{Socket: &socket})
+
+			So(peerCred.CheckAcl("tester", "test/topic/1", "client", MOSQ_ACL_WRITE), ShouldBeTrue)
+			So(peerCred.CheckAcl("tester", "test/topic/1", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(peerCred.CheckAcl("tester", "peers/tester", "client", MOSQ_ACL_READ), ShouldBeTrue)
+			So(peerCred.CheckAcl("tester", "peers/other", "client", MOSQ_ACL_READ), ShouldBeFalse)
+			So(peerCred.CheckAcl("testers", "peers/testers", "client", MOSQ_ACL_READ), ShouldBeFalse)
+		})
+
+		Reset(func() {
+			connFile.Close()
+			client.Close()
+			conn.Close()
+		})
+
+		peerCred.Halt()
+	})
+
+}
@@ -0,0 +1,58 @@
+package backends
+
+import (
+	"plugin"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//PluginInterfaceVersion is the version of the Backend interface implemented by backends loaded from Go plugins.
+//It's bumped whenever Backend changes incompatibly, so plugins built for another version are refused when loaded instead of misbehaving.
+const PluginInterfaceVersion = 1
+
+//NewPluginBackend creates the backend exported by a Go plugin, which must export its interface version and constructor as:
+//
+//	var BackendInterfaceVersion = 1
+//
+//	func NewBackend(authOpts map[string]string, logLevel log.Level) (backends.Backend, error)
+//
+//It returns false when the plugin doesn't export NewBackend, so it may be loaded as a plugin exporting check functions instead.
+func NewPluginBackend(p *plugin.Plugin, authOpts map[string]string, logLevel log.Level) (Backend, bool, error) {
+	return newPluginBackend(p.Lookup, authOpts, logLevel)
+}
+
+//newPluginBackend creates the backend exported by a plugin, looking its symbols up with lookup.
+func newPluginBackend(lookup func(string) (plugin.Symbol, error), authOpts map[string]string, logLevel log.Level) (Backend, bool, error) {
+	symbol, err := lookup("NewBackend")
+	if err != nil {
+		return nil, false, nil
+	}
+
+	newBackend, ok := symbol.(func(map[string]string, log.Level) (Backend, error))
+	if !ok {
+		return nil, true, errors.Errorf("NewBackend is a %T, not a func(map[string]string, log.Level) (backends.Backend, error)", symbol)
+	}
+
+	symbol, err = lookup("BackendInterfaceVersion")
+	if err != nil {
+		return nil, true, errors.Errorf("missing BackendInterfaceVersion, it must be %d", PluginInterfaceVersion)
+	}
+	version, ok := symbol.(*int)
+	if !ok {
+		return nil, true, errors.Errorf("BackendInterfaceVersion is a %T, not an int", symbol)
+	}
+	if *version != PluginInterfaceVersion {
+		return nil, true, errors.Errorf("plugin implements backend interface version %d, but version %d is required", *version, PluginInterfaceVersion)
+	}
+
+	backend, err := newBackend(authOpts, logLevel)
+	if err != nil {
+		return nil, true, err
+	}
+	if backend == nil {
+		return nil, true, errors.New("NewBackend returned no backend")
+	}
+	return backend, true, nil
+}
@@ -0,0 +1,67 @@
+package backends
+
+import (
+	"plugin"
+	"testing"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPluginBackend(t *testing.T) {
+
+	newBackend := func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewFiles(authOpts, logLevel)
+	}
+
+	//lookup mimics plugin.Plugin's Lookup for a plugin exporting the given symbols.
+	lookup := func(symbols map[string]plugin.Symbol) func(string) (plugin.Symbol, error) {
+		return func(name string) (plugin.Symbol, error) {
+			if symbol, ok := symbols[name]; ok {
+				return symbol, nil
+			}
+			return nil, errors.Errorf("symbol %s not found", name)
+		}
+	}
+
+	authOpts := map[string]string{"password_path": "../test-files/passwords"}
+
+	Convey("Given a plugin exporting check functions only, no backend should be created", t, func() {
+		_, ok, err := newPluginBackend(lookup(map[string]plugin.Symbol{"GetUser": func(username, password string) bool { return true }}), authOpts, log.DebugLevel)
+		So(ok, ShouldBeFalse)
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Given a plugin exporting a backend of the current interface version, it should be created", t, func() {
+		version := PluginInterfaceVersion
+		backend, ok, err := newPluginBackend(lookup(map[string]plugin.Symbol{"NewBackend": newBackend, "BackendInterfaceVersion": &version}), authOpts, log.DebugLevel)
+		So(ok, ShouldBeTrue)
+		So(err, ShouldBeNil)
+		So(backend.GetName(), ShouldEqual, "Files")
+		So(backend.GetUser("test1", "test1"), ShouldBeTrue)
+	})
+
+	Convey("Given a plugin exporting a backend of another or no interface version, it should be refused", t, func() {
+		version := PluginInterfaceVersion + 1
+		_, ok, err := newPluginBackend(lookup(map[string]plugin.Symbol{"NewBackend": newBackend, "BackendInterfaceVersion": &version}), authOpts, log.DebugLevel)
+		So(ok, ShouldBeTrue)
+		So(err, ShouldNotBeNil)
+
+		_, ok, err = newPluginBackend(lookup(map[string]plugin.Symbol{"NewBackend": newBackend}), authOpts, log.DebugLevel)
+		So(ok, ShouldBeTrue)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a NewBackend of the wrong type or failing, the backend should be refused", t, func() {
+		version := PluginInterfaceVersion
+		_, ok, err := newPluginBackend(lookup(map[string]plugin.Symbol{"NewBackend": func() Backend { return nil }, "BackendInterfaceVersion": &version}), authOpts, log.DebugLevel)
+		So(ok, ShouldBeTrue)
+		So(err, ShouldNotBeNil)
+
+		_, ok, err = newPluginBackend(lookup(map[string]plugin.Symbol{"NewBackend": newBackend, "BackendInterfaceVersion": &version}), map[string]string{}, log.DebugLevel)
+		So(ok, ShouldBeTrue)
+		So(err, ShouldNotBeNil)
+	})
+}
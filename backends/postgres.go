@@ -3,7 +3,7 @@ package backends
 import (
 	"database/sql"
 	"fmt"
-	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -16,19 +16,37 @@ import (
 
 //Postgres holds all fields of the postgres db connection.
 type Postgres struct {
-	DB             *sqlx.DB
-	Host           string
-	Port           string
-	DBName         string
-	User           string
-	Password       string
-	UserQuery      string
-	SuperuserQuery string
-	AclQuery       string
-	SSLMode        string
-	SSLCert        string
-	SSLKey         string
-	SSLRootCert    string
+	DB               *sqlx.DB
+	Host             string
+	Port             string
+	DBName           string
+	User             string
+	Password         string
+	UserQuery        string
+	SuperuserQuery   string
+	AclQuery         string
+	RegisterQuery    string
+	PendingQuery     string
+	PasswordAgeQuery string
+	MaxConnsQuery    string
+	ManifestQuery    string
+	PskQuery         string
+	ExportUsersQuery string
+	ExportAclsQuery  string
+	QueryParams      *QueryParams
+	SSLMode          string
+	SSLCert          string
+	SSLKey           string
+	SSLRootCert      string
+	errs             *checkErrors
+	hint             *cacheHint
+	metadata         *common.ClientMetadata
+}
+
+func init() {
+	register("postgres", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewPostgres(authOpts, logLevel)
+	})
 }
 
 func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, error) {
@@ -92,6 +110,52 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 		postgres.AclQuery = aclQuery
 	}
 
+	//Registering pending clients needs both queries.
+	registerQuery, hasRegister := authOpts["pg_registerquery"]
+	pendingQuery, hasPending := authOpts["pg_pendingquery"]
+	if hasRegister && !hasPending {
+		pgOk = false
+		missingOptions += " pg_pendingquery"
+	} else if hasPending && !hasRegister {
+		pgOk = false
+		missingOptions += " pg_registerquery"
+	}
+	postgres.RegisterQuery = registerQuery
+	postgres.PendingQuery = pendingQuery
+
+	if passwordAgeQuery, ok := authOpts["pg_passwordagequery"]; ok {
+		postgres.PasswordAgeQuery = passwordAgeQuery
+	}
+
+	if maxConnsQuery, ok := authOpts["pg_maxconnsquery"]; ok {
+		postgres.MaxConnsQuery = maxConnsQuery
+	}
+
+	if manifestQuery, ok := authOpts["pg_manifestquery"]; ok {
+		postgres.ManifestQuery = manifestQuery
+	}
+
+	if pskQuery, ok := authOpts["pg_pskquery"]; ok {
+		postgres.PskQuery = pskQuery
+	}
+
+	if exportUsersQuery, ok := authOpts["pg_exportusersquery"]; ok {
+		postgres.ExportUsersQuery = exportUsersQuery
+	}
+
+	if exportAclsQuery, ok := authOpts["pg_exportaclsquery"]; ok {
+		postgres.ExportAclsQuery = exportAclsQuery
+	}
+
+	queryParams, err := parseQueryParams(authOpts, "pg")
+	if err != nil {
+		return postgres, errors.Errorf("PG backend error: %s\n", err)
+	}
+	if err := queryParams.validate(postgres.UserQuery, postgres.SuperuserQuery, postgres.AclQuery); err != nil {
+		return postgres, errors.Errorf("PG backend error: %s\n", err)
+	}
+	postgres.QueryParams = queryParams
+
 	checkSSL := true
 
 	if sslmode, ok := authOpts["pg_sslmode"]; ok {
@@ -134,8 +198,13 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 		connStr = fmt.Sprintf("%s sslmode=disable", connStr)
 	}
 
+	dialer, err := common.NewDialer(authOpts, "pg")
+	if err != nil {
+		return postgres, errors.Errorf("PG backend error: %s\n", err)
+	}
+
 	var dbErr error
-	postgres.DB, dbErr = common.OpenDatabase(connStr, "postgres")
+	postgres.DB, dbErr = common.OpenPostgres(connStr, dialer)
 
 	if dbErr != nil {
 		return postgres, errors.Errorf("PG backend error: couldn't open DB: %s\n", dbErr)
@@ -148,16 +217,25 @@ func NewPostgres(authOpts map[string]string, logLevel log.Level) (Postgres, erro
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Postgres) GetUser(username, password string) bool {
 
+	query, args, err := o.QueryParams.bind(o.DB, o.UserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("PG get user error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err = o.DB.Get(&pwHash, query, args...)
 
 	if err != nil {
 		log.Debugf("PG get user error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
 	if !pwHash.Valid {
 		log.Debugf("PG get user error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -165,6 +243,7 @@ func (o Postgres) GetUser(username, password string) bool {
 		return true
 	}
 
+	o.errs.set(ErrBadCredentials, nil)
 	return false
 
 }
@@ -177,16 +256,25 @@ func (o Postgres) GetSuperuser(username string) bool {
 		return false
 	}
 
+	query, args, err := o.QueryParams.bind(o.DB, o.SuperuserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("PG get superuser error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err = o.DB.Get(&count, query, args...)
 
 	if err != nil {
 		log.Debugf("PG get superuser error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
 	if !count.Valid {
 		log.Debugf("PG get superuser error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -206,19 +294,34 @@ func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) bool {
 		return true
 	}
 
+	query, args, err := o.QueryParams.bind(o.DB, o.AclQuery, username, o.metadata, map[string]interface{}{"acc": acc, "clientid": clientid, "topic": topic}, username, acc)
+	if err != nil {
+		log.Debugf("PG check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err = o.DB.Select(&acls, query, args...)
 
 	if err != nil {
 		log.Debugf("PG check acl error: %s\n", err)
+		o.errs.setDB(err)
+		return false
+	}
+
+	if err := common.CheckAclRules(username, acls); err != nil {
+		log.Errorf("PG check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
 		return false
 	}
 
+	now := time.Now()
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 			return true
 		}
 	}
@@ -227,6 +330,166 @@ func (o Postgres) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//RegisterPending inserts username as a pending client using the register query, which gets the username and the password hash.
+func (o Postgres) RegisterPending(username, password string) error {
+
+	if o.RegisterQuery == "" {
+		return errors.New("PG register pending error: no register query given.")
+	}
+
+	pwHash, err := HashPassword(password)
+	if err != nil {
+		return errors.Errorf("PG register pending error: %s", err)
+	}
+
+	_, err = o.DB.Exec(o.RegisterQuery, username, pwHash)
+	if err != nil {
+		return errors.Errorf("PG register pending error: %s", err)
+	}
+
+	return nil
+
+}
+
+//IsPending checks that the pending query returns a password hash for username.
+func (o Postgres) IsPending(username string) bool {
+
+	if o.PendingQuery == "" {
+		return false
+	}
+
+	var pwHash sql.NullString
+	err := o.DB.Get(&pwHash, o.PendingQuery, username)
+
+	if err != nil {
+		log.Debugf("PG is pending error: %s\n", err)
+		return false
+	}
+
+	return pwHash.Valid
+
+}
+
+//GetPending checks that username is pending and the given password hashes to the same password.
+func (o Postgres) GetPending(username, password string) bool {
+
+	if o.PendingQuery == "" {
+		return false
+	}
+
+	var pwHash sql.NullString
+	err := o.DB.Get(&pwHash, o.PendingQuery, username)
+
+	if err != nil {
+		log.Debugf("PG get pending error: %s\n", err)
+		return false
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("PG get pending error: user %s not found.\n", username)
+		return false
+	}
+
+	return common.HashCompare(password, pwHash.String)
+
+}
+
+//PasswordChangedAt gets the unix time at which the password for username was last changed using the password age query.
+func (o Postgres) PasswordChangedAt(username string) (time.Time, bool) {
+	return queryPasswordChangedAt(o.DB, o.PasswordAgeQuery, username, "PG")
+}
+
+//MaxConnections gets the maximum simultaneous connections for username using the max connections query.
+func (o Postgres) MaxConnections(username string) (int, bool) {
+	return queryMaxConnections(o.DB, o.MaxConnsQuery, username, "PG")
+}
+
+//Manifest gets the topics and acc values username may access using the manifest query.
+func (o Postgres) Manifest(username string) ([]ManifestAcl, bool) {
+	return queryManifest(o.DB, o.ManifestQuery, username, "PG")
+}
+
+//GetPskKey gets the hex key for identity using the psk query.
+func (o Postgres) GetPskKey(hint, identity string) (string, bool) {
+
+	if o.PskQuery == "" {
+		return "", false
+	}
+
+	var key sql.NullString
+	err := o.DB.Get(&key, o.PskQuery, identity)
+
+	if err != nil {
+		log.Debugf("PG get psk key error: %s\n", err)
+		return "", false
+	}
+
+	if !key.Valid || !validPskKey(key.String) {
+		log.Debugf("PG get psk key error: no valid key for %s\n", identity)
+		return "", false
+	}
+
+	return key.String, true
+
+}
+
+//Export exports every user and their acls with the export queries.
+func (o Postgres) Export() (Snapshot, error) {
+	return exportSQL(o.DB, o.ExportUsersQuery, o.ExportAclsQuery, "Postgres")
+}
+
+//Healthy checks the database answers a ping.
+func (o Postgres) Healthy() bool {
+	return o.DB != nil && o.DB.Ping() == nil
+}
+
+//OpenConnections returns the number of connections to the database, in use or idle.
+func (o Postgres) OpenConnections() int {
+	if o.DB == nil {
+		return 0
+	}
+	return o.DB.Stats().OpenConnections
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Postgres) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Postgres) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Postgres) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Postgres) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend binding the client's cert_subject and address to named query params.
+func (o Postgres) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//Capabilities tells which checks and features are set by the given queries.
+func (o Postgres) Capabilities() Capabilities {
+	return sqlCapabilities(o.SuperuserQuery, o.PskQuery, o.ManifestQuery)
+}
+
 //GetName returns the backend's name
 func (o Postgres) GetName() string {
 	return "Postgres"
@@ -9,6 +9,8 @@ import (
 
 func TestPostgres(t *testing.T) {
 
+	requireIntegration(t, "postgres")
+
 	//Initialize Postgres without mandatory values (fail).
 	authOpts := make(map[string]string)
 	authOpts["pg_host"] = "localhost"
@@ -0,0 +1,20 @@
+package backends
+
+import (
+	"encoding/hex"
+)
+
+//PskKeyGetter is implemented by backends that store TLS-PSK keys, as hex strings, per identity.
+type PskKeyGetter interface {
+	//GetPskKey returns the hex encoded key for identity, or false if the backend doesn't know it.
+	GetPskKey(hint, identity string) (string, bool)
+}
+
+//validPskKey checks that a stored key is a non empty hex string, as mosquitto expects it.
+func validPskKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
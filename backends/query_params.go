@@ -0,0 +1,201 @@
+package backends
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/jmoiron/sqlx"
+
+	"github.com/pkg/errors"
+)
+
+//QueryParams makes user, superuser and acl queries use named parameters instead of positional ones, so they may reference them in any position and any number of times.
+//Queries get :username, :cert_subject and :address, acl ones also get :clientid, :topic and :acc, and every named group of the param pattern, if any, is available by its name.
+type QueryParams struct {
+	Pattern *regexp.Regexp
+}
+
+//Names of the params every check gets, and of those only acl checks get.
+//cert_subject and address are what mosquitto told about the client, empty when unknown.
+var (
+	checkParams = []string{"username", "cert_subject", "address"}
+	aclParams   = []string{"clientid", "topic", "acc"}
+)
+
+//parseQueryParams returns the query params set by the <prefix>_named_params and <prefix>_param_pattern options, or nil when queries use positional parameters.
+func parseQueryParams(authOpts map[string]string, prefix string) (*QueryParams, error) {
+	pattern, err := parseParamPattern(authOpts, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	if pattern == nil && authOpts[prefix+"_named_params"] != "true" {
+		return nil, nil
+	}
+
+	return &QueryParams{Pattern: pattern}, nil
+}
+
+//parseParamPattern compiles the pattern given at the <prefix>_param_pattern option, if any. Its named groups become named query parameters.
+func parseParamPattern(authOpts map[string]string, prefix string) (*regexp.Regexp, error) {
+	pattern, ok := authOpts[prefix+"_param_pattern"]
+	if !ok || pattern == "" {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Errorf("couldn't compile %s_param_pattern: %s", prefix, err)
+	}
+
+	for _, name := range re.SubexpNames() {
+		if isCheckParam(name) {
+			return nil, errors.Errorf("%s_param_pattern group %s shadows a check param", prefix, name)
+		}
+	}
+
+	return re, nil
+}
+
+//validate checks the given queries only reference params they'll get, so typos fail at startup instead of failing every check.
+func (p *QueryParams) validate(userQuery, superuserQuery, aclQuery string) error {
+	if p == nil {
+		return nil
+	}
+
+	known := map[string]bool{}
+	for _, name := range checkParams {
+		known[name] = true
+	}
+	if p.Pattern != nil {
+		for _, name := range p.Pattern.SubexpNames() {
+			if name != "" {
+				known[name] = true
+			}
+		}
+	}
+
+	for _, query := range []string{userQuery, superuserQuery} {
+		for _, name := range queryParamNames(query) {
+			if !known[name] {
+				return errors.Errorf("query %s references unknown param :%s", query, name)
+			}
+		}
+	}
+
+	for _, name := range aclParams {
+		known[name] = true
+	}
+	for _, name := range queryParamNames(aclQuery) {
+		if !known[name] {
+			return errors.Errorf("query %s references unknown param :%s", aclQuery, name)
+		}
+	}
+
+	return nil
+}
+
+//bind returns the query and its arguments. Without query params, the positional arguments are used as is.
+//Otherwise the query's named params are bound to username, the client's metadata, if known, the given named values and the pattern's named groups matched against username,
+//and rebound to the driver's placeholders.
+func (p *QueryParams) bind(db *sqlx.DB, query, username string, metadata *common.ClientMetadata, named map[string]interface{}, positional ...interface{}) (string, []interface{}, error) {
+	if p == nil {
+		return query, positional, nil
+	}
+
+	params := map[string]interface{}{
+		"username":     username,
+		"cert_subject": "",
+		"address":      "",
+	}
+	if metadata != nil {
+		params["cert_subject"] = metadata.CertSubject
+		params["address"] = metadata.Address
+	}
+	for k, v := range named {
+		params[k] = v
+	}
+
+	if p.Pattern != nil {
+		match := p.Pattern.FindStringSubmatch(username)
+		if match == nil {
+			return "", nil, errors.Errorf("username %s doesn't match param pattern", username)
+		}
+		for i, name := range p.Pattern.SubexpNames() {
+			if i > 0 && name != "" {
+				params[name] = match[i]
+			}
+		}
+	}
+
+	boundQuery, args, err := sqlx.Named(query, params)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return rebind(db, boundQuery), args, nil
+}
+
+//rebind rebinds a query from ? placeholders to the driver's ones. sqlx doesn't know sqlserver's @p1, @p2, etc., nor go-ora's driver name, so they're rebound here.
+func rebind(db *sqlx.DB, query string) string {
+	switch db.DriverName() {
+	case "sqlserver":
+	case "oracle":
+		return sqlx.Rebind(sqlx.NAMED, query)
+	default:
+		return db.Rebind(query)
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("@p" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func isCheckParam(name string) bool {
+	for _, params := range [][]string{checkParams, aclParams} {
+		for _, param := range params {
+			if name == param {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//queryParamNames returns the names of the params in query, following sqlx's rules: a param is a colon followed by letters, digits, underscores or dots, and a double colon is an escaped one (e.g. a postgres cast).
+//As with sqlx, a colon followed by anything else is a param with an empty name.
+func queryParamNames(query string) []string {
+	var names []string
+	for i := 0; i < len(query); i++ {
+		if query[i] != ':' {
+			continue
+		}
+		if i+1 < len(query) && query[i+1] == ':' {
+			i++
+			continue
+		}
+		end := i + 1
+		for end < len(query) && isParamNameByte(query[end]) {
+			end++
+		}
+		if i+1 < len(query) {
+			names = append(names, query[i+1:end])
+		}
+		i = end - 1
+	}
+	return names
+}
+
+func isParamNameByte(c byte) bool {
+	return c == '_' || c == '.' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
@@ -3,11 +3,12 @@ package backends
 import (
 	"fmt"
 	"strconv"
-	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
+	"github.com/pkg/errors"
+
 	"github.com/iegomez/mosquitto-go-auth/common"
 
 	goredis "github.com/go-redis/redis"
@@ -19,6 +20,14 @@ type Redis struct {
 	Password string
 	DB       int32
 	Conn     *goredis.Client
+	errs     *checkErrors
+	hint     *cacheHint
+}
+
+func init() {
+	register("redis", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewRedis(authOpts, logLevel)
+	})
 }
 
 func NewRedis(authOpts map[string]string, logLevel log.Level) (Redis, error) {
@@ -52,11 +61,17 @@ func NewRedis(authOpts map[string]string, logLevel log.Level) (Redis, error) {
 
 	addr := fmt.Sprintf("%s:%s", redis.Host, redis.Port)
 
+	dialer, err := common.NewDialer(authOpts, "redis")
+	if err != nil {
+		return redis, errors.Errorf("Redis backend error: %s\n", err)
+	}
+
 	//Try to start redis.
 	goredisClient := goredis.NewClient(&goredis.Options{
 		Addr:     addr,
 		Password: redis.Password,
 		DB:       int(redis.DB),
+		Dialer:   dialer.RedisDialer(addr),
 	})
 
 	for {
@@ -81,6 +96,7 @@ func (o Redis) GetUser(username, password string) bool {
 
 	if err != nil {
 		log.Debugf("Redis get user error: %s\n", err)
+		o.setError(err)
 		return false
 	}
 
@@ -88,6 +104,7 @@ func (o Redis) GetUser(username, password string) bool {
 		return true
 	}
 
+	o.errs.set(ErrBadCredentials, nil)
 	return false
 
 }
@@ -99,6 +116,7 @@ func (o Redis) GetSuperuser(username string) bool {
 
 	if err != nil {
 		log.Debugf("Redis get superuser error: %s\n", err)
+		o.setError(err)
 		return false
 	}
 
@@ -124,6 +142,7 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		acls, err = o.Conn.SMembers(fmt.Sprintf("%s:sacls", username)).Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 
@@ -131,6 +150,7 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		commonAcls, err = o.Conn.SMembers("common:sacls").Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 
@@ -139,11 +159,13 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		urAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:racls", username)).Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 		urwAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:rwacls", username)).Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 
@@ -151,19 +173,21 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		rAcls, err := o.Conn.SMembers("common:racls").Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 		rwAcls, err := o.Conn.SMembers("common:rwacls").Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 
-		acls = make([]string, len(urAcls)+len(urwAcls), len(urAcls)+len(urwAcls))
+		acls = make([]string, 0, len(urAcls)+len(urwAcls))
 		acls = append(acls, urAcls...)
 		acls = append(acls, urwAcls...)
 
-		commonAcls = make([]string, len(rAcls)+len(rwAcls), len(rAcls)+len(rwAcls))
+		commonAcls = make([]string, 0, len(rAcls)+len(rwAcls))
 		commonAcls = append(commonAcls, rAcls...)
 		commonAcls = append(commonAcls, rwAcls...)
 	case MOSQ_ACL_WRITE:
@@ -171,11 +195,13 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		uwAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:wacls", username)).Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 		urwAcls, err := o.Conn.SMembers(fmt.Sprintf("%s:rwacls", username)).Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 
@@ -183,34 +209,44 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 		wAcls, err := o.Conn.SMembers("common:wacls").Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 		rwAcls, err := o.Conn.SMembers("common:rwacls").Result()
 		if err != nil {
 			log.Debugf("Redis check acl error: %s\n", err)
+			o.setError(err)
 			return false
 		}
 
-		acls = make([]string, len(uwAcls)+len(urwAcls), len(uwAcls)+len(urwAcls))
+		acls = make([]string, 0, len(uwAcls)+len(urwAcls))
 		acls = append(acls, uwAcls...)
 		acls = append(acls, urwAcls...)
 
-		commonAcls = make([]string, len(wAcls)+len(rwAcls), len(wAcls)+len(rwAcls))
+		commonAcls = make([]string, 0, len(wAcls)+len(rwAcls))
 		commonAcls = append(commonAcls, wAcls...)
 		commonAcls = append(commonAcls, rwAcls...)
 	}
 
+	if err := common.CheckAclRules(username, acls); err != nil {
+		log.Errorf("Redis check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	//Now loop through acls looking for a match.
+	now := time.Now()
 	for _, acl := range acls {
-		if common.TopicsMatch(acl, topic) {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		if common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 			return true
 		}
 	}
 
 	for _, acl := range commonAcls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 			return true
 		}
 	}
@@ -219,6 +255,166 @@ func (o Redis) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//RegisterPending sets the key username:pending to the hashed password, unless username or username:pending already exist.
+func (o Redis) RegisterPending(username, password string) error {
+
+	exists, err := o.Conn.Exists(username).Result()
+	if err != nil {
+		return errors.Errorf("Redis register pending error: %s", err)
+	}
+	if exists > 0 {
+		return errors.Errorf("Redis register pending error: user %s already exists", username)
+	}
+
+	pwHash, err := HashPassword(password)
+	if err != nil {
+		return errors.Errorf("Redis register pending error: %s", err)
+	}
+
+	set, err := o.Conn.SetNX(fmt.Sprintf("%s:pending", username), pwHash, 0).Result()
+	if err != nil {
+		return errors.Errorf("Redis register pending error: %s", err)
+	}
+	if !set {
+		return errors.Errorf("Redis register pending error: user %s is already pending", username)
+	}
+
+	return nil
+
+}
+
+//IsPending checks that the key username:pending exists.
+func (o Redis) IsPending(username string) bool {
+
+	exists, err := o.Conn.Exists(fmt.Sprintf("%s:pending", username)).Result()
+	if err != nil {
+		log.Debugf("Redis is pending error: %s\n", err)
+		return false
+	}
+
+	return exists > 0
+
+}
+
+//GetPending checks that the key username:pending exists and the given password hashes to the same password.
+func (o Redis) GetPending(username, password string) bool {
+
+	pwHash, err := o.Conn.Get(fmt.Sprintf("%s:pending", username)).Result()
+	if err != nil {
+		log.Debugf("Redis get pending error: %s\n", err)
+		return false
+	}
+
+	return common.HashCompare(password, pwHash)
+
+}
+
+//PasswordChangedAt gets the unix time at which the password for username was last changed from the key username:changed_at.
+func (o Redis) PasswordChangedAt(username string) (time.Time, bool) {
+
+	changedAt, err := o.Conn.Get(fmt.Sprintf("%s:changed_at", username)).Int64()
+	if err != nil {
+		log.Debugf("Redis password changed at error: %s\n", err)
+		return time.Time{}, false
+	}
+
+	return time.Unix(changedAt, 0), true
+
+}
+
+//MaxConnections gets the maximum simultaneous connections for username from the key username:max_connections.
+func (o Redis) MaxConnections(username string) (int, bool) {
+
+	max, err := o.Conn.Get(fmt.Sprintf("%s:max_connections", username)).Int64()
+	if err != nil {
+		log.Debugf("Redis max connections error: %s\n", err)
+		return 0, false
+	}
+
+	return int(max), true
+
+}
+
+//GetPskKey returns the hex key stored at the key identity:psk.
+func (o Redis) GetPskKey(hint, identity string) (string, bool) {
+
+	key, err := o.Conn.Get(fmt.Sprintf("%s:psk", identity)).Result()
+	if err != nil {
+		log.Debugf("Redis get psk key error: %s\n", err)
+		return "", false
+	}
+
+	if !validPskKey(key) {
+		log.Errorf("Redis get psk key error: key for %s is not a hex string\n", identity)
+		return "", false
+	}
+
+	return key, true
+
+}
+
+//Healthy checks redis answers a ping.
+func (o Redis) Healthy() bool {
+	return o.Conn.Ping().Err() == nil
+}
+
+//OpenConnections returns the number of connections in the client's pool.
+func (o Redis) OpenConnections() int {
+	return int(o.Conn.PoolStats().TotalConns)
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Redis) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Redis) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Redis) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Redis) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//setError keeps a Redis error: a missing key means nothing was found, while any other error means Redis failed.
+//UserExists checks if the user's password hash is set.
+func (o Redis) UserExists(username string) (bool, error) {
+	n, err := o.Conn.Exists(username).Result()
+	if err != nil {
+		log.Debugf("Redis user exists error: %s\n", err)
+		o.errs = &checkErrors{}
+		o.setError(err)
+		return false, o.errs.take()
+	}
+	if n == 0 {
+		return false, &CheckError{Kind: ErrNotFound}
+	}
+	return true, nil
+}
+
+func (o Redis) setError(err error) {
+	if err == goredis.Nil {
+		o.errs.set(ErrNotFound, nil)
+		return
+	}
+	o.errs.set(ErrBackendUnavailable, err)
+}
+
 //GetName returns the backend's name
 func (o Redis) GetName() string {
 	return "Redis"
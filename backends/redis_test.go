@@ -9,6 +9,8 @@ import (
 
 func TestRedis(t *testing.T) {
 
+	requireIntegration(t, "redis")
+
 	//Initialize Redis with some test values.
 	authOpts := make(map[string]string)
 	authOpts["redis_host"] = "localhost"
@@ -179,6 +181,35 @@ func TestRedis(t *testing.T) {
 			})
 		})
 
+		Convey("Given a password change time, it should be returned for the user", func() {
+			_, ok := redis.PasswordChangedAt(username)
+			So(ok, ShouldBeFalse)
+
+			redis.Conn.Set(username+":changed_at", "1546300800", 0)
+			changedAt, ok := redis.PasswordChangedAt(username)
+			So(ok, ShouldBeTrue)
+			So(changedAt.Unix(), ShouldEqual, 1546300800)
+		})
+
+		Convey("Given an unknown username, it should be registered as pending", func() {
+			pendingUser := "device-1"
+			So(redis.IsPending(pendingUser), ShouldBeFalse)
+			So(redis.RegisterPending(pendingUser, "devicepw"), ShouldBeNil)
+			So(redis.IsPending(pendingUser), ShouldBeTrue)
+			So(redis.GetPending(pendingUser, "devicepw"), ShouldBeTrue)
+			So(redis.GetPending(pendingUser, "wrongpw"), ShouldBeFalse)
+			So(redis.GetUser(pendingUser, "devicepw"), ShouldBeFalse)
+
+			Convey("Registering it again should fail", func() {
+				So(redis.RegisterPending(pendingUser, "otherpw"), ShouldBeError)
+			})
+		})
+
+		Convey("Given a known username, it should not be registered as pending", func() {
+			So(redis.RegisterPending(username, userPass), ShouldBeError)
+			So(redis.IsPending(username), ShouldBeFalse)
+		})
+
 		//Empty db
 		redis.Conn.FlushDB()
 
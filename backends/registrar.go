@@ -0,0 +1,20 @@
+package backends
+
+import (
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//Registrar is implemented by backends that may register unknown clients in a pending state, so they can be approved later.
+type Registrar interface {
+	//RegisterPending stores username as pending with a hash of the given password. It must fail if the username is already known.
+	RegisterPending(username, password string) error
+	//IsPending checks that username is registered and still pending.
+	IsPending(username string) bool
+	//GetPending checks that username is pending and the password matches the one given at registration.
+	GetPending(username, password string) bool
+}
+
+//HashPassword hashes a password with the default settings, as the pw utility does, e.g. for pending clients or users stored through the admin api.
+func HashPassword(password string) (string, error) {
+	return common.Hash(password, saltSize, HashIterations, "sha512")
+}
@@ -0,0 +1,41 @@
+package backends
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//Backend is implemented by every backend, as expected by the plugin.
+type Backend interface {
+	GetUser(username, password string) bool
+	GetSuperuser(username string) bool
+	CheckAcl(username, topic, clientId string, acc int32) bool
+	GetName() string
+	Halt()
+}
+
+//constructor initializes a backend with the plugin's options.
+type constructor func(authOpts map[string]string, logLevel log.Level) (Backend, error)
+
+//constructors holds the backends compiled in this build. Each backend registers itself on init, so build tags may leave some out.
+var constructors = make(map[string]constructor)
+
+func register(name string, c constructor) {
+	constructors[name] = c
+}
+
+//Compiled checks if the named backend was compiled in this build.
+func Compiled(name string) bool {
+	_, ok := constructors[name]
+	return ok
+}
+
+//New initializes the named backend, failing if it wasn't compiled in this build.
+func New(name string, authOpts map[string]string, logLevel log.Level) (Backend, error) {
+	c, ok := constructors[name]
+	if !ok {
+		return nil, errors.Errorf("backend %s is not compiled in this build", name)
+	}
+	return c(authOpts, logLevel)
+}
@@ -0,0 +1,104 @@
+package backends
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	h "net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//RemoteCredentials is a static header sent with every remote request, so the service may be reached through gateways requiring an api key or basic auth.
+type RemoteCredentials struct {
+	Header string //Header is the header's name, Authorization unless told.
+	Value  string
+}
+
+//parseRemoteCredentials gets credentials from the <prefix>_auth_header (or _auth_header_file) and _auth_header_name options,
+//or basic auth ones from _basic_auth_username and _basic_auth_password (or _basic_auth_password_file). It returns nil when none are given.
+//Files are read once, their content trimmed of surrounding spaces and newlines.
+func parseRemoteCredentials(authOpts map[string]string, prefix string) (*RemoteCredentials, error) {
+	value, err := optionOrFile(authOpts, prefix+"_auth_header")
+	if err != nil {
+		return nil, err
+	}
+
+	username, hasUsername := authOpts[prefix+"_basic_auth_username"]
+	password, err := optionOrFile(authOpts, prefix+"_basic_auth_password")
+	if err != nil {
+		return nil, err
+	}
+
+	if hasUsername {
+		if value != "" {
+			return nil, errors.Errorf("%s_auth_header and %s_basic_auth_username can't be given together", prefix, prefix)
+		}
+		value = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	} else if password != "" {
+		return nil, errors.Errorf("%s_basic_auth_password given without %s_basic_auth_username", prefix, prefix)
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	credentials := &RemoteCredentials{
+		Header: "Authorization",
+		Value:  value,
+	}
+	if header, ok := authOpts[prefix+"_auth_header_name"]; ok && strings.TrimSpace(header) != "" {
+		credentials.Header = h.CanonicalHeaderKey(strings.TrimSpace(header))
+	}
+
+	return credentials, nil
+}
+
+//optionOrFile returns the option's value, or the trimmed content of the file given at the <option>_file one, failing if both are given.
+func optionOrFile(authOpts map[string]string, option string) (string, error) {
+	value, ok := authOpts[option]
+	path, fromFile := authOpts[option+"_file"]
+
+	if ok && fromFile {
+		return "", errors.Errorf("%s and %s_file can't be given together", option, option)
+	}
+	if !fromFile {
+		return value, nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Errorf("couldn't read %s_file %s: %s", option, path, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+//credentialsTransport sets the credentials' header on requests as they're sent.
+type credentialsTransport struct {
+	credentials *RemoteCredentials
+	base        h.RoundTripper
+}
+
+func (t credentialsTransport) RoundTrip(req *h.Request) (*h.Response, error) {
+	//Round trippers mustn't modify the request they're given, so the header is set on a copy.
+	withHeader := new(h.Request)
+	*withHeader = *req
+	withHeader.Header = make(h.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		withHeader.Header[k] = v
+	}
+	withHeader.Header.Set(t.credentials.Header, t.credentials.Value)
+
+	return t.base.RoundTrip(withHeader)
+}
+
+//transport wraps base so requests carry the credentials, or returns base if there are none.
+func (c *RemoteCredentials) transport(base h.RoundTripper) h.RoundTripper {
+	if c == nil {
+		return base
+	}
+	if base == nil {
+		base = h.DefaultTransport
+	}
+	return credentialsTransport{credentials: c, base: base}
+}
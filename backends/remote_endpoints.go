@@ -0,0 +1,83 @@
+package backends
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//RemoteMethods are the request methods of remote user, superuser and acl checks.
+//GET requests send params in the query string, while POST and PUT ones send them in the body as the params mode says.
+type RemoteMethods struct {
+	User      string
+	Superuser string
+	Acl       string
+}
+
+//remoteMethods are the methods remote checks may be made with.
+var remoteMethods = map[string]bool{
+	"GET":  true,
+	"POST": true,
+	"PUT":  true,
+}
+
+//parseRemoteMethods gets the methods set by the <prefix>_getuser_method, _superuser_method and _aclcheck_method options, each defaulting to POST.
+func parseRemoteMethods(authOpts map[string]string, prefix string) (RemoteMethods, error) {
+	methods := RemoteMethods{User: "POST", Superuser: "POST", Acl: "POST"}
+
+	for option, method := range map[string]*string{
+		prefix + "_getuser_method":   &methods.User,
+		prefix + "_superuser_method": &methods.Superuser,
+		prefix + "_aclcheck_method":  &methods.Acl,
+	} {
+		value, ok := authOpts[option]
+		if !ok {
+			continue
+		}
+		value = strings.ToUpper(strings.TrimSpace(value))
+		if !remoteMethods[value] {
+			return methods, errors.Errorf("unknown %s %s, expected GET, POST or PUT", option, value)
+		}
+		*method = value
+	}
+
+	return methods, nil
+}
+
+//expandUriTemplate replaces the %u, %c and %t placeholders in a uri with the given username, clientid and topic, e.g. /acl/%u/%t.
+//Values are escaped as path segments before the query string and as query values in it, so a topic's slashes don't become path separators.
+func expandUriTemplate(uri, username, clientid, topic string) string {
+	if !strings.Contains(uri, "%") {
+		return uri
+	}
+
+	path, query := uri, ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		path, query = uri[:i], uri[i:]
+	}
+
+	path = strings.NewReplacer(
+		"%u", url.PathEscape(username),
+		"%c", url.PathEscape(clientid),
+		"%t", url.PathEscape(topic),
+	).Replace(path)
+	query = strings.NewReplacer(
+		"%u", url.QueryEscape(username),
+		"%c", url.QueryEscape(clientid),
+		"%t", url.QueryEscape(topic),
+	).Replace(query)
+
+	return path + query
+}
+
+//withQuery adds params to a uri's query string, keeping any it already has.
+func withQuery(uri string, params url.Values) string {
+	if len(params) == 0 {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + params.Encode()
+	}
+	return uri + "?" + params.Encode()
+}
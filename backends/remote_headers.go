@@ -0,0 +1,87 @@
+package backends
+
+import (
+	h "net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//reservedHeaders are set by the plugin itself, so they may not be given as static headers.
+var reservedHeaders = map[string]bool{
+	"Content-Type":           true,
+	"Content-Length":         true,
+	"Host":                   true,
+	SignatureHeader:          true,
+	SignatureTimestampHeader: true,
+	SignatureNonceHeader:     true,
+}
+
+//parseRemoteHeaders gets static headers sent with every remote request from <prefix>_header_<name> options, e.g. http_header_X-Tenant-ID,
+//returning nil when none are given. Names are canonicalized, and the Authorization header may only be given when there are no credentials for it.
+func parseRemoteHeaders(authOpts map[string]string, prefix string, credentials *RemoteCredentials) (h.Header, error) {
+	optPrefix := prefix + "_header_"
+
+	//Options are sorted so errors are reported for the same one every time.
+	var opts []string
+	for k := range authOpts {
+		if strings.HasPrefix(k, optPrefix) {
+			opts = append(opts, k)
+		}
+	}
+	if len(opts) == 0 {
+		return nil, nil
+	}
+	sort.Strings(opts)
+
+	headers := make(h.Header, len(opts))
+	for _, opt := range opts {
+		name := h.CanonicalHeaderKey(strings.TrimSpace(strings.TrimPrefix(opt, optPrefix)))
+		switch {
+		case name == "":
+			return nil, errors.Errorf("%s has no header name", opt)
+		case reservedHeaders[name]:
+			return nil, errors.Errorf("%s can't be set, as the %s header is set by the plugin", opt, name)
+		case credentials != nil && name == credentials.Header:
+			return nil, errors.Errorf("%s can't be set along with credentials sent at the same header", opt)
+		case headers.Get(name) != "":
+			return nil, errors.Errorf("header %s is given more than once", name)
+		}
+		headers.Set(name, authOpts[opt])
+	}
+
+	return headers, nil
+}
+
+//headersTransport sets static headers on requests as they're sent.
+type headersTransport struct {
+	headers h.Header
+	base    h.RoundTripper
+}
+
+func (t headersTransport) RoundTrip(req *h.Request) (*h.Response, error) {
+	//Round trippers mustn't modify the request they're given, so headers are set on a copy.
+	withHeaders := new(h.Request)
+	*withHeaders = *req
+	withHeaders.Header = make(h.Header, len(req.Header)+len(t.headers))
+	for k, v := range req.Header {
+		withHeaders.Header[k] = v
+	}
+	for k, v := range t.headers {
+		withHeaders.Header[k] = v
+	}
+
+	return t.base.RoundTrip(withHeaders)
+}
+
+//remoteHeadersTransport wraps base so requests carry the headers, or returns base if there are none.
+func remoteHeadersTransport(headers h.Header, base h.RoundTripper) h.RoundTripper {
+	if len(headers) == 0 {
+		return base
+	}
+	if base == nil {
+		base = h.DefaultTransport
+	}
+	return headersTransport{headers: headers, base: base}
+}
@@ -0,0 +1,107 @@
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	h "net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//RemotePool tells how connections to a remote service are made and kept for reuse, so checks don't pay a new connection, and tls handshake, each.
+type RemotePool struct {
+	ConnectTimeout      time.Duration //ConnectTimeout bounds how long connecting may take.
+	KeepAlive           bool          //KeepAlive keeps connections open for reuse after requests.
+	MaxIdleConns        int           //MaxIdleConns is the maximum idle connections kept.
+	MaxIdleConnsPerHost int           //MaxIdleConnsPerHost is the maximum idle connections kept per host.
+	IdleConnTimeout     time.Duration //IdleConnTimeout is how long idle connections are kept.
+}
+
+//defaultRemotePool is applied when no pool options are given. Unlike Go's default, many idle connections are kept per host, as a single service answers every check.
+var defaultRemotePool = RemotePool{
+	ConnectTimeout:      5 * time.Second,
+	KeepAlive:           true,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 100,
+	IdleConnTimeout:     90 * time.Second,
+}
+
+//parseRemotePool gets the pool from the <prefix>_connect_timeout, _keepalive, _max_idle_conns, _max_idle_conns_per_host and _idle_conn_timeout options.
+func parseRemotePool(authOpts map[string]string, prefix string) (RemotePool, error) {
+	pool := defaultRemotePool
+
+	durations := map[string]*time.Duration{
+		prefix + "_connect_timeout":   &pool.ConnectTimeout,
+		prefix + "_idle_conn_timeout": &pool.IdleConnTimeout,
+	}
+	for option, d := range durations {
+		value, ok := authOpts[option]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || parsed <= 0 {
+			return pool, errors.Errorf("bad %s %s, expected a positive duration", option, value)
+		}
+		*d = parsed
+	}
+
+	counts := map[string]*int{
+		prefix + "_max_idle_conns":          &pool.MaxIdleConns,
+		prefix + "_max_idle_conns_per_host": &pool.MaxIdleConnsPerHost,
+	}
+	for option, n := range counts {
+		value, ok := authOpts[option]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || parsed < 0 {
+			return pool, errors.Errorf("bad %s %s, expected 0 or more", option, value)
+		}
+		*n = parsed
+	}
+
+	if keepAlive, ok := authOpts[prefix+"_keepalive"]; ok {
+		pool.KeepAlive = strings.TrimSpace(keepAlive) != "false"
+	}
+
+	return pool, nil
+}
+
+//transport returns a transport pooling connections as told, with the given tls config, peer verification and dialer.
+//It's meant to be shared by every request to the service, so connections are reused.
+func (p RemotePool) transport(tlsConfig *tls.Config, verifyPeer bool, dialer *common.Dialer) *h.Transport {
+	netDialer := &net.Dialer{
+		Timeout:   p.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	tr := &h.Transport{
+		Proxy:                 h.ProxyFromEnvironment,
+		DialContext:           netDialer.DialContext,
+		TLSClientConfig:       remoteTLSConfig(tlsConfig, verifyPeer),
+		TLSHandshakeTimeout:   p.ConnectTimeout,
+		DisableKeepAlives:     !p.KeepAlive,
+		MaxIdleConns:          p.MaxIdleConns,
+		MaxIdleConnsPerHost:   p.MaxIdleConnsPerHost,
+		IdleConnTimeout:       p.IdleConnTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if dialer != nil {
+		tr.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, p.ConnectTimeout)
+			defer cancel()
+			return dialer.DialContext(ctx, network, address)
+		}
+	}
+
+	return tr
+}
@@ -0,0 +1,104 @@
+package backends
+
+import (
+	"math/rand"
+	h "net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//RemoteRetry tells how long remote requests may take and how they're retried when they fail.
+//Only transient failures are retried: requests that couldn't be made, e.g. on connection errors or timeouts, and server error statuses.
+//Retries wait an exponential backoff, doubling from Backoff up to MaxBackoff, with jitter so clients reconnecting at once don't retry in lockstep.
+type RemoteRetry struct {
+	Timeout    time.Duration //Timeout of each attempt.
+	Retries    int           //Retries after the first attempt, 0 meaning requests aren't retried.
+	Backoff    time.Duration //Backoff before the first retry.
+	MaxBackoff time.Duration //MaxBackoff bounds the backoff between retries.
+}
+
+//defaultRemoteRetry is applied when no retry options are given: a single attempt with a 5 seconds timeout.
+var defaultRemoteRetry = RemoteRetry{
+	Timeout:    5 * time.Second,
+	Retries:    0,
+	Backoff:    100 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+//parseRemoteRetry gets the timeout and retries from the <prefix>_timeout, _retries, _retry_backoff and _retry_max_backoff options.
+func parseRemoteRetry(authOpts map[string]string, prefix string) (RemoteRetry, error) {
+	retry := defaultRemoteRetry
+
+	durations := map[string]*time.Duration{
+		prefix + "_timeout":           &retry.Timeout,
+		prefix + "_retry_backoff":     &retry.Backoff,
+		prefix + "_retry_max_backoff": &retry.MaxBackoff,
+	}
+	for option, d := range durations {
+		value, ok := authOpts[option]
+		if !ok {
+			continue
+		}
+		parsed, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || parsed <= 0 {
+			return retry, errors.Errorf("bad %s %s, expected a positive duration", option, value)
+		}
+		*d = parsed
+	}
+
+	if retries, ok := authOpts[prefix+"_retries"]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(retries))
+		if err != nil || n < 0 {
+			return retry, errors.Errorf("bad %s_retries %s, expected 0 or more", prefix, retries)
+		}
+		retry.Retries = n
+	}
+
+	if retry.MaxBackoff < retry.Backoff {
+		retry.MaxBackoff = retry.Backoff
+	}
+
+	return retry, nil
+}
+
+//do sends the request with client, retrying it on transient failures. Bodies are sent again on every attempt, so requests must have been created with a replayable body.
+//It returns the response of the last attempt, whose body the caller must close, or its error.
+func (r RemoteRetry) do(client *h.Client, req *h.Request) (*h.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := client.Do(req)
+		if attempt >= r.Retries || (err == nil && resp.StatusCode < 500) {
+			return resp, err
+		}
+
+		if err != nil {
+			log.Warnf("%s %s failed, retrying (%d/%d): %s", req.Method, req.URL.Path, attempt+1, r.Retries, err)
+		} else {
+			log.Warnf("%s %s got status %d, retrying (%d/%d)", req.Method, req.URL.Path, resp.StatusCode, attempt+1, r.Retries)
+			resp.Body.Close()
+		}
+
+		time.Sleep(r.backoff(attempt))
+	}
+}
+
+//backoff returns the wait before the retry following attempt: half the exponential backoff plus a random part of the other half.
+func (r RemoteRetry) backoff(attempt int) time.Duration {
+	d := r.MaxBackoff
+	if attempt < 30 && r.Backoff <= r.MaxBackoff>>uint(attempt) {
+		d = r.Backoff << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,100 @@
+package backends
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	h "net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//parseRemoteTLS loads the client certificate and key given by the <prefix>_cert_file and _key_file options, so the backend authenticates itself
+//to the remote service, and the ca given by _ca_file to verify the service with instead of the system's.
+//The service's certificate is verified for the name given by _server_name, also sent as SNI, instead of the host's. It returns nil when none is given.
+func parseRemoteTLS(authOpts map[string]string, prefix string) (*tls.Config, error) {
+	certFile := authOpts[prefix+"_cert_file"]
+	keyFile := authOpts[prefix+"_key_file"]
+	caFile := authOpts[prefix+"_ca_file"]
+	serverName := strings.TrimSpace(authOpts[prefix+"_server_name"])
+
+	if certFile == "" && keyFile == "" && caFile == "" && serverName == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{ServerName: serverName}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.Errorf("%s_cert_file and %s_key_file must be given together", prefix, prefix)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Errorf("couldn't load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Errorf("couldn't read %s_ca_file: %s", prefix, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificates found in %s_ca_file %s", prefix, caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+//parseVerifyPeer tells if the remote service's certificate is verified, as set by <prefix>_verify_peer, unless <prefix>_insecure_skip_verify explicitly skips it.
+//Not verifying it over tls is logged loudly, as anyone on the network path could then impersonate the service.
+func parseVerifyPeer(authOpts map[string]string, prefix string, withTLS bool) bool {
+	if insecure, ok := authOpts[prefix+"_insecure_skip_verify"]; ok && insecure == "true" {
+		log.Warnf("INSECURE: %s_insecure_skip_verify is true, the %s auth service's certificate won't be verified. Only do this in test environments!", prefix, prefix)
+		return false
+	}
+
+	verifyPeer := authOpts[prefix+"_verify_peer"] == "true"
+	if withTLS && !verifyPeer {
+		log.Warnf("%s_verify_peer isn't true, the %s auth service's certificate won't be verified", prefix, prefix)
+	}
+
+	return verifyPeer
+}
+
+//remoteTransport returns a transport with the given tls config, peer verification and dialer, or nil if the default one does.
+func remoteTransport(tlsConfig *tls.Config, verifyPeer bool, dialer *common.Dialer) *h.Transport {
+	if verifyPeer && tlsConfig == nil && dialer == nil {
+		return nil
+	}
+
+	tr := &h.Transport{TLSClientConfig: remoteTLSConfig(tlsConfig, verifyPeer)}
+	if dialer != nil {
+		tr.DialContext = dialer.DialContext
+	}
+
+	return tr
+}
+
+//remoteTLSConfig returns the tls config to connect with given peer verification, or nil if the default one does.
+func remoteTLSConfig(tlsConfig *tls.Config, verifyPeer bool) *tls.Config {
+	if verifyPeer && tlsConfig == nil {
+		return nil
+	}
+
+	config := &tls.Config{}
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
+	config.InsecureSkipVerify = !verifyPeer
+	return config
+}
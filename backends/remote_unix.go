@@ -0,0 +1,31 @@
+package backends
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+//unixSocketScheme prefixes hosts given as a unix domain socket, e.g. unix:///var/run/auth.sock, for services running along the broker.
+const unixSocketScheme = "unix://"
+
+//unixSocketHost is the host requests to a unix domain socket are made to, as they need one even though it's not dialed.
+const unixSocketHost = "localhost"
+
+//unixSocketPath returns the path of the socket a host is given as, and whether it's given as one. The path may be empty, which callers must reject.
+func unixSocketPath(host string) (string, bool) {
+	host = strings.TrimSpace(host)
+	if !strings.HasPrefix(host, unixSocketScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(host, unixSocketScheme), true
+}
+
+//unixDialContext returns a dial function connecting to the socket at path, whatever the address asked for.
+func unixDialContext(path string, timeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", path)
+	}
+}
@@ -0,0 +1,135 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//ResponseLimits bound the size and shape of remote responses, so a malformed or malicious one can't cause pathological memory or cpu use.
+type ResponseLimits struct {
+	MaxSize  int64 //MaxSize is the maximum body size in bytes, 0 meaning no limit.
+	MaxDepth int   //MaxDepth is the maximum nesting of json values, 0 meaning no limit.
+	Strict   bool  //Strict rejects json responses with fields not known to the backend.
+}
+
+//defaultResponseLimits are applied when no limit options are given: none, so responses accepted before limits existed still are.
+var defaultResponseLimits = ResponseLimits{
+	MaxSize:  0,
+	MaxDepth: 0,
+	Strict:   false,
+}
+
+//parseResponseLimits gets response limits from the options with the given prefix (e.g. http or jwt).
+func parseResponseLimits(authOpts map[string]string, prefix string) ResponseLimits {
+
+	limits := defaultResponseLimits
+
+	if maxSize, ok := authOpts[prefix+"_max_response_size"]; ok {
+		size, err := strconv.ParseInt(maxSize, 10, 64)
+		if err == nil && size >= 0 {
+			limits.MaxSize = size
+		} else {
+			log.Warningf("couldn't parse %s_max_response_size, defaulting to %d", prefix, limits.MaxSize)
+		}
+	}
+
+	if maxDepth, ok := authOpts[prefix+"_max_json_depth"]; ok {
+		depth, err := strconv.Atoi(maxDepth)
+		if err == nil && depth >= 0 {
+			limits.MaxDepth = depth
+		} else {
+			log.Warningf("couldn't parse %s_max_json_depth, defaulting to %d", prefix, limits.MaxDepth)
+		}
+	}
+
+	if strict, ok := authOpts[prefix+"_strict_json"]; ok && strict == "true" {
+		limits.Strict = true
+	}
+
+	return limits
+}
+
+//read reads a response body, failing if it's bigger than the maximum size.
+func (l ResponseLimits) read(r io.Reader) ([]byte, error) {
+	if l.MaxSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r, l.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > l.MaxSize {
+		return nil, errors.Errorf("response exceeds %d bytes", l.MaxSize)
+	}
+
+	return body, nil
+}
+
+//checkJSON checks a json response body against the depth limit and, when strict, that it's an object with only ok, error and the given fields.
+func (l ResponseLimits) checkJSON(body []byte, fields ...string) error {
+
+	if l.MaxDepth > 0 {
+		if err := checkJSONDepth(body, l.MaxDepth); err != nil {
+			return err
+		}
+	}
+
+	if !l.Strict {
+		return nil
+	}
+
+	allowed := map[string]bool{"ok": true, "error": true}
+	for _, field := range fields {
+		if field != "" {
+			allowed[field] = true
+		}
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return err
+	}
+
+	for field := range object {
+		if !allowed[field] {
+			return errors.Errorf("unknown response field %s", field)
+		}
+	}
+
+	return nil
+}
+
+//checkJSONDepth walks the json tokens without decoding values, failing when objects or arrays nest deeper than maxDepth.
+func checkJSONDepth(body []byte, maxDepth int) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if delim, ok := token.(json.Delim); ok {
+			switch delim {
+			case '{', '[':
+				depth++
+				if depth > maxDepth {
+					return errors.Errorf("response exceeds json depth of %d", maxDepth)
+				}
+			case '}', ']':
+				depth--
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//ResponseMapping tells where json responses keep whether a check is granted and why, for services whose responses don't follow a schema version,
+//e.g. {"data": {"allowed": true, "reason": "..."}} with data.allowed as ok path and data.reason as error path.
+//Paths are dot separated fields with optional array indexes, e.g. $.results[0].allowed, the leading $ being optional.
+type ResponseMapping struct {
+	OkPath    string
+	ErrorPath string
+	OkValue   string
+
+	okSteps    []pathStep
+	errorSteps []pathStep
+}
+
+//pathStep is a field of an object or, when field is empty, an index of an array.
+type pathStep struct {
+	field string
+	index int
+}
+
+//parseResponseMapping gets the mapping set by the <prefix>_response_ok_path, _response_error_path and _response_ok_value options.
+//The ok value is granting when it's true, or when it equals _response_ok_value if that's given, e.g. allow.
+func parseResponseMapping(authOpts map[string]string, prefix string) (ResponseMapping, error) {
+	var mapping ResponseMapping
+
+	okPath, ok := authOpts[prefix+"_response_ok_path"]
+	if !ok {
+		if _, ok := authOpts[prefix+"_response_error_path"]; ok {
+			return mapping, errors.Errorf("%s_response_error_path given without %s_response_ok_path", prefix, prefix)
+		}
+		return mapping, nil
+	}
+
+	steps, err := parsePath(okPath)
+	if err != nil {
+		return mapping, errors.Errorf("bad %s_response_ok_path %s: %s", prefix, okPath, err)
+	}
+	mapping.OkPath = okPath
+	mapping.okSteps = steps
+
+	if errorPath, ok := authOpts[prefix+"_response_error_path"]; ok {
+		steps, err := parsePath(errorPath)
+		if err != nil {
+			return mapping, errors.Errorf("bad %s_response_error_path %s: %s", prefix, errorPath, err)
+		}
+		mapping.ErrorPath = errorPath
+		mapping.errorSteps = steps
+	}
+
+	mapping.OkValue = authOpts[prefix+"_response_ok_value"]
+
+	return mapping, nil
+}
+
+//parsePath splits a path such as $.data.results[0].allowed into its steps.
+func parsePath(path string) ([]pathStep, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+
+	var steps []pathStep
+	for _, segment := range strings.Split(path, ".") {
+		field := segment
+		var indexes string
+		if i := strings.Index(segment, "["); i >= 0 {
+			field, indexes = segment[:i], segment[i:]
+		}
+		if field == "" && indexes == "" {
+			return nil, errors.New("empty field")
+		}
+		if field != "" {
+			steps = append(steps, pathStep{field: field})
+		}
+		for indexes != "" {
+			end := strings.Index(indexes, "]")
+			if !strings.HasPrefix(indexes, "[") || end < 0 {
+				return nil, errors.Errorf("bad index in %s", segment)
+			}
+			index, err := strconv.Atoi(indexes[1:end])
+			if err != nil || index < 0 {
+				return nil, errors.Errorf("bad index in %s", segment)
+			}
+			steps = append(steps, pathStep{index: index})
+			indexes = indexes[end+1:]
+		}
+	}
+
+	if steps[0].field == "" {
+		return nil, errors.New("path must start with a field")
+	}
+
+	return steps, nil
+}
+
+//lookup follows the steps from a decoded json value, telling if they lead anywhere.
+func lookup(value interface{}, steps []pathStep) (interface{}, bool) {
+	for _, step := range steps {
+		if step.field != "" {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			value, ok = object[step.field]
+			if !ok {
+				return nil, false
+			}
+			continue
+		}
+		array, ok := value.([]interface{})
+		if !ok || step.index >= len(array) {
+			return nil, false
+		}
+		value = array[step.index]
+	}
+	return value, true
+}
+
+//fields returns the top level fields allowed by strict response limits: the mapped ones if there's a mapping, the schema version's otherwise.
+func (m ResponseMapping) fields(version int) []string {
+	if m.okSteps == nil {
+		return schemaFields(version)
+	}
+	fields := []string{m.okSteps[0].field}
+	if m.errorSteps != nil {
+		fields = append(fields, m.errorSteps[0].field)
+	}
+	return fields
+}
+
+//decode decodes a json response with the mapping if there's one, or with the given schema version otherwise,
+//returning whether it grants the check and the error or reason it gives.
+func (m ResponseMapping) decode(body []byte, version int) (bool, string, error) {
+	if m.okSteps == nil {
+		return decodeResponse(body, version)
+	}
+
+	var response interface{}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false, "", err
+	}
+
+	value, found := lookup(response, m.okSteps)
+	if !found {
+		return false, "", errors.Errorf("missing response field %s", m.OkPath)
+	}
+
+	var granted bool
+	if m.OkValue != "" {
+		granted = fmt.Sprint(value) == m.OkValue
+	} else if b, ok := value.(bool); ok {
+		granted = b
+	} else {
+		return false, "", errors.Errorf("response field %s is not a boolean", m.OkPath)
+	}
+
+	var message string
+	if m.errorSteps != nil {
+		if reason, found := lookup(response, m.errorSteps); found && reason != nil {
+			if s, ok := reason.(string); ok {
+				message = s
+			} else {
+				raw, _ := json.Marshal(reason)
+				message = string(raw)
+			}
+		}
+	}
+
+	return granted, message, nil
+}
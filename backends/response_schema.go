@@ -0,0 +1,142 @@
+package backends
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	h "net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//SchemaHeader is sent with remote requests listing the accepted response schema versions, and may be set by responses to tell their version.
+const SchemaHeader = "X-Auth-Schema-Version"
+
+//schemaMediaType is the json media type of a response schema version, which responses may use as content type to tell their version.
+const schemaMediaType = "application/vnd.mosquitto-auth.v%d+json"
+
+//Response schema versions.
+//Version 1 responses have ok and error fields, e.g. {"ok": true, "error": ""}.
+//Version 2 responses have decision and reason fields, e.g. {"decision": "deny", "reason": "unknown device"}, where decision is allow or deny.
+const (
+	SchemaV1 = 1
+	SchemaV2 = 2
+)
+
+//ResponseSchemas holds the json response schema versions accepted by a remote backend, in order of preference.
+type ResponseSchemas struct {
+	Versions []int
+}
+
+//schemaV2Response is a version 2 json response.
+type schemaV2Response struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason"`
+}
+
+//parseResponseSchemas gets the accepted schema versions from the comma separated <prefix>_schema_versions option, defaulting to version 1 only.
+func parseResponseSchemas(authOpts map[string]string, prefix string) (ResponseSchemas, error) {
+
+	schemas := ResponseSchemas{Versions: []int{SchemaV1}}
+
+	versionsStr, ok := authOpts[prefix+"_schema_versions"]
+	if !ok {
+		return schemas, nil
+	}
+
+	var versions []int
+	for _, versionStr := range strings.Split(strings.Replace(versionsStr, " ", "", -1), ",") {
+		if versionStr == "" {
+			continue
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(versionStr, "v"))
+		if err != nil || (version != SchemaV1 && version != SchemaV2) {
+			return schemas, errors.Errorf("unknown schema version %s", versionStr)
+		}
+		versions = append(versions, version)
+	}
+
+	if len(versions) == 0 {
+		return schemas, errors.Errorf("no schema versions given at %s_schema_versions", prefix)
+	}
+
+	schemas.Versions = versions
+	return schemas, nil
+}
+
+//setHeaders advertises the accepted versions in the schema header and as versioned media types in the Accept header, plain json being accepted last.
+func (s ResponseSchemas) setHeaders(header h.Header) {
+	versions := make([]string, len(s.Versions))
+	accept := make([]string, 0, len(s.Versions)+1)
+	for i, version := range s.Versions {
+		versions[i] = strconv.Itoa(version)
+		accept = append(accept, fmt.Sprintf(schemaMediaType+";q=%.1f", version, 1-float64(i)/10))
+	}
+	accept = append(accept, "application/json;q=0.1")
+
+	header.Set(SchemaHeader, strings.Join(versions, ", "))
+	header.Set("Accept", strings.Join(accept, ", "))
+}
+
+//version gets a response's schema version from its content type or schema header, failing if it's not accepted.
+//Responses that don't tell their version are taken as version 1, so services unaware of versioning keep working.
+func (s ResponseSchemas) version(header h.Header) (int, error) {
+
+	version := SchemaV1
+
+	var n int
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if _, err := fmt.Sscanf(mediaType, schemaMediaType, &n); err == nil {
+		version = n
+	} else if versionStr := header.Get(SchemaHeader); versionStr != "" {
+		n, err = strconv.Atoi(strings.TrimSpace(versionStr))
+		if err != nil {
+			return 0, errors.Errorf("bad schema version %s", versionStr)
+		}
+		version = n
+	}
+
+	for _, accepted := range s.Versions {
+		if version == accepted {
+			return version, nil
+		}
+	}
+
+	return 0, errors.Errorf("schema version %d not accepted", version)
+}
+
+//schemaFields returns the fields of a schema version, which are allowed by strict response limits.
+func schemaFields(version int) []string {
+	if version == SchemaV2 {
+		return []string{"decision", "reason"}
+	}
+	return []string{"ok", "error"}
+}
+
+//decodeResponse decodes a json response with the given schema version, returning whether it grants the check and the error or reason it gives.
+func decodeResponse(body []byte, version int) (bool, string, error) {
+
+	if version == SchemaV2 {
+		var response schemaV2Response
+		if err := json.Unmarshal(body, &response); err != nil {
+			return false, "", err
+		}
+		switch response.Decision {
+		case "allow":
+			return true, response.Reason, nil
+		case "deny":
+			return false, response.Reason, nil
+		default:
+			return false, "", errors.Errorf("unknown decision %s", response.Decision)
+		}
+	}
+
+	response := HTTPResponse{Ok: false, Error: ""}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false, "", err
+	}
+
+	return response.Ok, response.Error, nil
+}
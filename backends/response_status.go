@@ -0,0 +1,48 @@
+package backends
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//SuccessCodes are the response statuses that let a remote check go on, e.g. 200, 201 and 204 for services answering status only checks with them.
+//Server errors are never successful, as they mean the service failed rather than denied the check.
+type SuccessCodes []int
+
+//parseSuccessCodes gets the statuses from the comma separated <prefix>_success_codes option, defaulting to 200 only.
+func parseSuccessCodes(authOpts map[string]string, prefix string) (SuccessCodes, error) {
+	codesStr, ok := authOpts[prefix+"_success_codes"]
+	if !ok {
+		return SuccessCodes{200}, nil
+	}
+
+	var codes SuccessCodes
+	for _, codeStr := range strings.Split(strings.Replace(codesStr, " ", "", -1), ",") {
+		if codeStr == "" {
+			continue
+		}
+		code, err := strconv.Atoi(codeStr)
+		if err != nil || code < 100 || code >= 500 {
+			return nil, errors.Errorf("bad %s_success_codes status %s, expected one below 500", prefix, codeStr)
+		}
+		codes = append(codes, code)
+	}
+
+	if len(codes) == 0 {
+		return nil, errors.Errorf("no statuses given at %s_success_codes", prefix)
+	}
+
+	return codes, nil
+}
+
+//accepts checks if the status is a successful one.
+func (s SuccessCodes) accepts(status int) bool {
+	for _, code := range s {
+		if status == code {
+			return true
+		}
+	}
+	return false
+}
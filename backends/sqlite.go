@@ -1,8 +1,10 @@
+// +build !nosqlite
+
 package backends
 
 import (
 	"database/sql"
-	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -15,11 +17,29 @@ import (
 
 //Sqlite holds all fields of the sqlite db connection.
 type Sqlite struct {
-	DB             *sqlx.DB
-	Source         string
-	UserQuery      string
-	SuperuserQuery string
-	AclQuery       string
+	DB               *sqlx.DB
+	Source           string
+	UserQuery        string
+	SuperuserQuery   string
+	AclQuery         string
+	RegisterQuery    string
+	PendingQuery     string
+	PasswordAgeQuery string
+	MaxConnsQuery    string
+	ManifestQuery    string
+	PskQuery         string
+	ExportUsersQuery string
+	ExportAclsQuery  string
+	QueryParams      *QueryParams
+	errs             *checkErrors
+	hint             *cacheHint
+	metadata         *common.ClientMetadata
+}
+
+func init() {
+	register("sqlite", func(authOpts map[string]string, logLevel log.Level) (Backend, error) {
+		return NewSqlite(authOpts, logLevel)
+	})
 }
 
 func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
@@ -43,9 +63,17 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 		missingOptions += " sqlite_source"
 	}
 
+	//A snapshot store reads from the snapshot tables, unless told otherwise.
+	snapshotStore := authOpts["sqlite_snapshot"] == "true"
+	if snapshotStore {
+		sqlite.UserQuery = "SELECT password_hash FROM snapshot_users WHERE username = ? limit 1"
+		sqlite.SuperuserQuery = "SELECT count(*) FROM snapshot_users WHERE username = ? AND is_admin = 1"
+		sqlite.AclQuery = "SELECT topic FROM snapshot_acls WHERE username = ? AND rw >= ?"
+	}
+
 	if userQuery, ok := authOpts["sqlite_userquery"]; ok {
 		sqlite.UserQuery = userQuery
-	} else {
+	} else if !snapshotStore {
 		sqliteOk = false
 		missingOptions += " sqlite_userquery"
 	}
@@ -58,6 +86,52 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 		sqlite.AclQuery = aclQuery
 	}
 
+	//Registering pending clients needs both queries.
+	registerQuery, hasRegister := authOpts["sqlite_registerquery"]
+	pendingQuery, hasPending := authOpts["sqlite_pendingquery"]
+	if hasRegister && !hasPending {
+		sqliteOk = false
+		missingOptions += " sqlite_pendingquery"
+	} else if hasPending && !hasRegister {
+		sqliteOk = false
+		missingOptions += " sqlite_registerquery"
+	}
+	sqlite.RegisterQuery = registerQuery
+	sqlite.PendingQuery = pendingQuery
+
+	if passwordAgeQuery, ok := authOpts["sqlite_passwordagequery"]; ok {
+		sqlite.PasswordAgeQuery = passwordAgeQuery
+	}
+
+	if maxConnsQuery, ok := authOpts["sqlite_maxconnsquery"]; ok {
+		sqlite.MaxConnsQuery = maxConnsQuery
+	}
+
+	if manifestQuery, ok := authOpts["sqlite_manifestquery"]; ok {
+		sqlite.ManifestQuery = manifestQuery
+	}
+
+	if pskQuery, ok := authOpts["sqlite_pskquery"]; ok {
+		sqlite.PskQuery = pskQuery
+	}
+
+	if exportUsersQuery, ok := authOpts["sqlite_exportusersquery"]; ok {
+		sqlite.ExportUsersQuery = exportUsersQuery
+	}
+
+	if exportAclsQuery, ok := authOpts["sqlite_exportaclsquery"]; ok {
+		sqlite.ExportAclsQuery = exportAclsQuery
+	}
+
+	queryParams, err := parseQueryParams(authOpts, "sqlite")
+	if err != nil {
+		return sqlite, errors.Errorf("Sqlite backend error: %s\n", err)
+	}
+	if err := queryParams.validate(sqlite.UserQuery, sqlite.SuperuserQuery, sqlite.AclQuery); err != nil {
+		return sqlite, errors.Errorf("Sqlite backend error: %s\n", err)
+	}
+	sqlite.QueryParams = queryParams
+
 	//Exit if any mandatory option is missing.
 	if !sqliteOk {
 		return sqlite, errors.Errorf("Sqlite backend error: missing options%s.\n", missingOptions)
@@ -76,6 +150,13 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 		return sqlite, errors.Errorf("Sqlite backend error: couldn't open DB %s: %s\n", connStr, dbErr)
 	}
 
+	//Create the snapshot tables so checks don't fail before the first import, unless nothing may be written.
+	if snapshotStore && authOpts["read_only"] != "true" {
+		if _, err := sqlite.DB.Exec(snapshotSchema); err != nil {
+			return sqlite, errors.Errorf("Sqlite backend error: couldn't create snapshot tables: %s\n", err)
+		}
+	}
+
 	return sqlite, nil
 
 }
@@ -83,16 +164,25 @@ func NewSqlite(authOpts map[string]string, logLevel log.Level) (Sqlite, error) {
 //GetUser checks that the username exists and the given password hashes to the same password.
 func (o Sqlite) GetUser(username, password string) bool {
 
+	query, args, err := o.QueryParams.bind(o.DB, o.UserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("SQlite get user error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var pwHash sql.NullString
-	err := o.DB.Get(&pwHash, o.UserQuery, username)
+	err = o.DB.Get(&pwHash, query, args...)
 
 	if err != nil {
 		log.Debugf("SQlite get user error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
 	if !pwHash.Valid {
 		log.Debugf("SQlite get user error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -100,6 +190,7 @@ func (o Sqlite) GetUser(username, password string) bool {
 		return true
 	}
 
+	o.errs.set(ErrBadCredentials, nil)
 	return false
 
 }
@@ -112,16 +203,25 @@ func (o Sqlite) GetSuperuser(username string) bool {
 		return false
 	}
 
+	query, args, err := o.QueryParams.bind(o.DB, o.SuperuserQuery, username, o.metadata, nil, username)
+	if err != nil {
+		log.Debugf("SQlite get superuser error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var count sql.NullInt64
-	err := o.DB.Get(&count, o.SuperuserQuery, username)
+	err = o.DB.Get(&count, query, args...)
 
 	if err != nil {
 		log.Debugf("SQlite get superuser error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
 	if !count.Valid {
 		log.Debugf("SQlite get superuser error: user %s not found.\n", username)
+		o.errs.set(ErrNotFound, nil)
 		return false
 	}
 
@@ -140,19 +240,34 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) bool {
 		return true
 	}
 
+	query, args, err := o.QueryParams.bind(o.DB, o.AclQuery, username, o.metadata, map[string]interface{}{"acc": acc, "clientid": clientid, "topic": topic}, username, acc)
+	if err != nil {
+		log.Debugf("SQlite check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
 	var acls []string
 
-	err := o.DB.Select(&acls, o.AclQuery, username, acc)
+	err = o.DB.Select(&acls, query, args...)
 
 	if err != nil {
 		log.Debugf("SQlite check acl error: %s\n", err)
+		o.errs.setDB(err)
 		return false
 	}
 
+	if err := common.CheckAclRules(username, acls); err != nil {
+		log.Errorf("SQlite check acl error: %s\n", err)
+		o.errs.set(ErrMisconfigured, err)
+		return false
+	}
+
+	now := time.Now()
 	for _, acl := range acls {
-		aclTopic := strings.Replace(acl, "%c", clientid, -1)
-		aclTopic = strings.Replace(aclTopic, "%u", username, -1)
-		if common.TopicsMatch(aclTopic, topic) {
+		aclTopic, active, timed := common.ActiveAclTopic(acl, clientid, now)
+		aclTopic, ok := common.ExpandAclTopic(aclTopic, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) && o.hint.inEffect(active, timed) {
 			return true
 		}
 	}
@@ -161,6 +276,171 @@ func (o Sqlite) CheckAcl(username, topic, clientid string, acc int32) bool {
 
 }
 
+//RegisterPending inserts username as a pending client using the register query, which gets the username and the password hash.
+func (o Sqlite) RegisterPending(username, password string) error {
+
+	if o.RegisterQuery == "" {
+		return errors.New("SQlite register pending error: no register query given.")
+	}
+
+	pwHash, err := HashPassword(password)
+	if err != nil {
+		return errors.Errorf("SQlite register pending error: %s", err)
+	}
+
+	_, err = o.DB.Exec(o.RegisterQuery, username, pwHash)
+	if err != nil {
+		return errors.Errorf("SQlite register pending error: %s", err)
+	}
+
+	return nil
+
+}
+
+//IsPending checks that the pending query returns a password hash for username.
+func (o Sqlite) IsPending(username string) bool {
+
+	if o.PendingQuery == "" {
+		return false
+	}
+
+	var pwHash sql.NullString
+	err := o.DB.Get(&pwHash, o.PendingQuery, username)
+
+	if err != nil {
+		log.Debugf("SQlite is pending error: %s\n", err)
+		return false
+	}
+
+	return pwHash.Valid
+
+}
+
+//GetPending checks that username is pending and the given password hashes to the same password.
+func (o Sqlite) GetPending(username, password string) bool {
+
+	if o.PendingQuery == "" {
+		return false
+	}
+
+	var pwHash sql.NullString
+	err := o.DB.Get(&pwHash, o.PendingQuery, username)
+
+	if err != nil {
+		log.Debugf("SQlite get pending error: %s\n", err)
+		return false
+	}
+
+	if !pwHash.Valid {
+		log.Debugf("SQlite get pending error: user %s not found.\n", username)
+		return false
+	}
+
+	return common.HashCompare(password, pwHash.String)
+
+}
+
+//PasswordChangedAt gets the unix time at which the password for username was last changed using the password age query.
+func (o Sqlite) PasswordChangedAt(username string) (time.Time, bool) {
+	return queryPasswordChangedAt(o.DB, o.PasswordAgeQuery, username, "SQlite")
+}
+
+//MaxConnections gets the maximum simultaneous connections for username using the max connections query.
+func (o Sqlite) MaxConnections(username string) (int, bool) {
+	return queryMaxConnections(o.DB, o.MaxConnsQuery, username, "SQlite")
+}
+
+//Manifest gets the topics and acc values username may access using the manifest query.
+func (o Sqlite) Manifest(username string) ([]ManifestAcl, bool) {
+	return queryManifest(o.DB, o.ManifestQuery, username, "SQlite")
+}
+
+//GetPskKey gets the hex key for identity using the psk query.
+func (o Sqlite) GetPskKey(hint, identity string) (string, bool) {
+
+	if o.PskQuery == "" {
+		return "", false
+	}
+
+	var key sql.NullString
+	err := o.DB.Get(&key, o.PskQuery, identity)
+
+	if err != nil {
+		log.Debugf("SQlite get psk key error: %s\n", err)
+		return "", false
+	}
+
+	if !key.Valid || !validPskKey(key.String) {
+		log.Debugf("SQlite get psk key error: no valid key for %s\n", identity)
+		return "", false
+	}
+
+	return key.String, true
+
+}
+
+//Export exports every user and their acls with the export queries.
+func (o Sqlite) Export() (Snapshot, error) {
+	return exportSQL(o.DB, o.ExportUsersQuery, o.ExportAclsQuery, "Sqlite")
+}
+
+//Import replaces the snapshot tables with the given snapshot, so sqlite may act as a standby.
+func (o Sqlite) Import(snapshot Snapshot) error {
+	return importSQL(o.DB, snapshot)
+}
+
+//Healthy checks the database answers a ping.
+func (o Sqlite) Healthy() bool {
+	return o.DB != nil && o.DB.Ping() == nil
+}
+
+//OpenConnections returns the number of connections to the database, in use or idle.
+func (o Sqlite) OpenConnections() int {
+	if o.DB == nil {
+		return 0
+	}
+	return o.DB.Stats().OpenConnections
+}
+
+//UserCheck checks the user as GetUser does, returning the error of a failed check.
+func (o Sqlite) UserCheck(username, password string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetUser(username, password)
+	return granted, o.errs.take()
+}
+
+//SuperuserCheck checks the superuser as GetSuperuser does, returning the error of a failed check.
+func (o Sqlite) SuperuserCheck(username string) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.GetSuperuser(username)
+	return granted, o.errs.take()
+}
+
+//AclCheck checks the acl as CheckAcl does, returning the error of a failed check.
+func (o Sqlite) AclCheck(username, topic, clientid string, acc int32) (bool, error) {
+	o.errs = &checkErrors{}
+	granted := o.CheckAcl(username, topic, clientid, acc)
+	return granted, o.errs.take()
+}
+
+//HintedAclCheck checks the acl as AclCheck does, hinting the decision must not be cached if it depended on timed acl rules.
+func (o Sqlite) HintedAclCheck(username, topic, clientid string, acc int32) (bool, CacheHint, error) {
+	o.hint = &cacheHint{}
+	granted, err := o.AclCheck(username, topic, clientid, acc)
+	return granted, o.hint.get(), err
+}
+
+//ForClient returns a copy of the backend binding the client's cert_subject and address to named query params.
+func (o Sqlite) ForClient(metadata common.ClientMetadata) Backend {
+	o.metadata = &metadata
+	return o
+}
+
+//Capabilities tells which checks and features are set by the given queries.
+func (o Sqlite) Capabilities() Capabilities {
+	return sqlCapabilities(o.SuperuserQuery, o.PskQuery, o.ManifestQuery)
+}
+
 //GetName returns the backend's name
 func (o Sqlite) GetName() string {
 	return "Sqlite"
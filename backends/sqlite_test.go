@@ -1,9 +1,12 @@
+// +build !nosqlite
+
 package backends
 
 import (
 	"os"
 	"testing"
 
+	"github.com/iegomez/mosquitto-go-auth/common"
 	log "github.com/sirupsen/logrus"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -29,6 +32,14 @@ foreign key(test_user_id) references test_user(id)
 );
 `
 
+var pendingSchema = `
+DROP TABLE IF EXISTS test_pending;
+CREATE TABLE test_pending (
+	id    INTEGER PRIMARY KEY,
+	username varchar(100) not null unique,
+	password_hash varchar(200) not null
+);`
+
 func TestFileSqlite(t *testing.T) {
 
 	//Initialize Sqlite without mandatory values (fail).
@@ -193,6 +204,119 @@ func TestFileSqlite(t *testing.T) {
 			So(tt1, ShouldBeTrue)
 		})
 
+		Convey("Given a param pattern, queries should get named params from the username", func() {
+			authOpts["sqlite_param_pattern"] = "^(?P<name>[a-z]+)$"
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = :name limit 1"
+			authOpts["sqlite_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = :username AND test_acl.test_user_id = test_user.id AND rw >= :acc"
+			paramSqlite, err := NewSqlite(authOpts, log.DebugLevel)
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = ? limit 1"
+			authOpts["sqlite_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?"
+			delete(authOpts, "sqlite_param_pattern")
+			So(err, ShouldBeNil)
+
+			So(paramSqlite.GetUser(username, userPass), ShouldBeTrue)
+			So(paramSqlite.GetUser(username, "wrong_password"), ShouldBeFalse)
+			So(paramSqlite.CheckAcl(username, "test/topic/1", clientID, MOSQ_ACL_READ), ShouldBeTrue)
+
+			Convey("A username not matching the pattern should fail", func() {
+				So(paramSqlite.GetUser("Test_1", userPass), ShouldBeFalse)
+			})
+
+			paramSqlite.Halt()
+		})
+
+		Convey("Given named params, acl queries may reference the topic and params in any position", func() {
+			authOpts["sqlite_named_params"] = "true"
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = :username limit 1"
+			authOpts["sqlite_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE rw >= :acc AND test_acl.test_user_id = test_user.id AND test_user.username = :username AND :topic NOT LIKE '%/' || :clientid"
+			namedSqlite, err := NewSqlite(authOpts, log.DebugLevel)
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = ? limit 1"
+			authOpts["sqlite_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?"
+			delete(authOpts, "sqlite_named_params")
+			So(err, ShouldBeNil)
+
+			So(namedSqlite.GetUser(username, userPass), ShouldBeTrue)
+			So(namedSqlite.CheckAcl(username, "test/topic/1", clientID, MOSQ_ACL_READ), ShouldBeTrue)
+			So(namedSqlite.CheckAcl(username, "test/topic/"+clientID, clientID, MOSQ_ACL_READ), ShouldBeFalse)
+
+			namedSqlite.Halt()
+		})
+
+		Convey("Given named params, queries may reference the client's cert subject and address", func() {
+			authOpts["sqlite_named_params"] = "true"
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = :username AND :cert_subject = '/CN=' || :username AND :address LIKE '10.%' limit 1"
+			clientSqlite, err := NewSqlite(authOpts, log.DebugLevel)
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = ? limit 1"
+			delete(authOpts, "sqlite_named_params")
+			So(err, ShouldBeNil)
+
+			So(ForClient(clientSqlite, &common.ClientMetadata{CertSubject: "/CN=" + username, Address: "10.0.0.1"}).GetUser(username, userPass), ShouldBeTrue)
+			So(ForClient(clientSqlite, &common.ClientMetadata{CertSubject: "/CN=other", Address: "10.0.0.1"}).GetUser(username, userPass), ShouldBeFalse)
+			So(ForClient(clientSqlite, &common.ClientMetadata{CertSubject: "/CN=" + username, Address: "192.168.1.1"}).GetUser(username, userPass), ShouldBeFalse)
+			So(clientSqlite.GetUser(username, userPass), ShouldBeFalse)
+
+			clientSqlite.Halt()
+		})
+
+		Convey("Given a password age query, the password change time should be returned for the user", func() {
+			_, ok := sqlite.PasswordChangedAt(username)
+			So(ok, ShouldBeFalse)
+
+			authOpts["sqlite_passwordagequery"] = "SELECT strftime('%s', '2019-01-01 00:00:00') FROM test_user WHERE username = ?"
+			ageSqlite, err := NewSqlite(authOpts, log.DebugLevel)
+			delete(authOpts, "sqlite_passwordagequery")
+			So(err, ShouldBeNil)
+
+			changedAt, ok := ageSqlite.PasswordChangedAt(username)
+			So(ok, ShouldBeTrue)
+			So(changedAt.Unix(), ShouldEqual, 1546300800)
+
+			_, ok = ageSqlite.PasswordChangedAt("unknown")
+			So(ok, ShouldBeFalse)
+
+			ageSqlite.Halt()
+		})
+
+		Convey("Given export queries, a snapshot exported from it should be imported into a standby", func() {
+			authOpts["sqlite_exportusersquery"] = "SELECT username, password_hash, is_admin FROM test_user"
+			authOpts["sqlite_exportaclsquery"] = "SELECT test_user.username, test_acl.topic, test_acl.rw FROM test_acl, test_user WHERE test_acl.test_user_id = test_user.id"
+			primary, err := NewSqlite(authOpts, log.DebugLevel)
+			delete(authOpts, "sqlite_exportusersquery")
+			delete(authOpts, "sqlite_exportaclsquery")
+			So(err, ShouldBeNil)
+			So(primary.Healthy(), ShouldBeTrue)
+			So(primary.OpenConnections(), ShouldBeGreaterThan, 0)
+
+			snapshot, err := primary.Export()
+			So(err, ShouldBeNil)
+			So(len(snapshot.Users), ShouldEqual, 1)
+			So(snapshot.Users[0].Username, ShouldEqual, username)
+			So(snapshot.Users[0].Superuser, ShouldBeTrue)
+
+			standbyOpts := map[string]string{
+				"sqlite_source":     authOpts["sqlite_source"],
+				"sqlite_userquery":  "SELECT password_hash FROM snapshot_users WHERE username = ? limit 1",
+				"sqlite_superquery": "SELECT count(*) FROM snapshot_users WHERE username = ? AND is_admin = 1",
+				"sqlite_aclquery":   "SELECT topic FROM snapshot_acls WHERE username = ? AND rw >= ?",
+			}
+			standby, err := NewSqlite(standbyOpts, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			So(standby.Import(snapshot), ShouldBeNil)
+			So(standby.GetUser(username, userPass), ShouldBeTrue)
+			So(standby.GetUser(username, "wrong_password"), ShouldBeFalse)
+			So(standby.GetSuperuser(username), ShouldBeTrue)
+
+			//A later import replaces the previous snapshot.
+			So(standby.Import(Snapshot{}), ShouldBeNil)
+			So(standby.GetUser(username, userPass), ShouldBeFalse)
+
+			standby.DB.MustExec("DROP TABLE snapshot_users")
+			standby.DB.MustExec("DROP TABLE snapshot_acls")
+			standby.Halt()
+			primary.Halt()
+		})
+
 		//Empty db
 		sqlite.DB.MustExec("delete from test_user where 1 = 1")
 		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
@@ -363,6 +487,103 @@ func TestMemorySqlite(t *testing.T) {
 		})
 
 		//Empty db
+		Convey("Given named params, queries referencing unknown params should fail at initialization", func() {
+			authOpts["sqlite_named_params"] = "true"
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = :username AND :clientid != '' limit 1"
+			_, err := NewSqlite(authOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = :username limit 1"
+			authOpts["sqlite_aclquery"] = "SELECT topic FROM test_acl WHERE rw >= :access"
+			_, err = NewSqlite(authOpts, log.DebugLevel)
+			So(err, ShouldBeError)
+
+			authOpts["sqlite_userquery"] = "SELECT password_hash FROM test_user WHERE username = ? limit 1"
+			authOpts["sqlite_aclquery"] = "SELECT test_acl.topic FROM test_acl, test_user WHERE test_user.username = ? AND test_acl.test_user_id = test_user.id AND rw >= ?"
+			delete(authOpts, "sqlite_named_params")
+		})
+
+		Convey("Given an invalid param pattern, initialization should fail", func() {
+			authOpts["sqlite_param_pattern"] = "^(?P<name>[a-z]+$"
+			_, err := NewSqlite(authOpts, log.DebugLevel)
+			delete(authOpts, "sqlite_param_pattern")
+			So(err, ShouldBeError)
+		})
+
+		Convey("Given snapshot mode, it should check against imported snapshots without queries", func() {
+			store, err := NewSqlite(map[string]string{
+				"sqlite_source":   authOpts["sqlite_source"],
+				"sqlite_snapshot": "true",
+			}, log.DebugLevel)
+			So(err, ShouldBeNil)
+			So(store.GetUser(username, userPass), ShouldBeFalse)
+
+			snapshot := Snapshot{
+				Users: []SnapshotUser{
+					{
+						Username:     username,
+						PasswordHash: userPassHash,
+						Acls:         []ManifestAcl{{Topic: "test/snapshot/+", Acc: MOSQ_ACL_READ}},
+					},
+				},
+			}
+			So(store.Import(snapshot), ShouldBeNil)
+			So(store.GetUser(username, userPass), ShouldBeTrue)
+			So(store.GetSuperuser(username), ShouldBeFalse)
+			So(store.CheckAcl(username, "test/snapshot/1", "clientid", MOSQ_ACL_READ), ShouldBeTrue)
+			So(store.CheckAcl(username, "test/snapshot/1", "clientid", MOSQ_ACL_WRITE), ShouldBeFalse)
+
+			store.DB.MustExec("DROP TABLE snapshot_users")
+			store.DB.MustExec("DROP TABLE snapshot_acls")
+			store.Halt()
+		})
+
+		Convey("Given snapshot and read only modes, snapshot tables shouldn't be created", func() {
+			store, err := NewSqlite(map[string]string{
+				"sqlite_source":   authOpts["sqlite_source"],
+				"sqlite_snapshot": "true",
+				"read_only":       "true",
+			}, log.DebugLevel)
+			So(err, ShouldBeNil)
+
+			var count int
+			So(store.DB.Get(&count, "SELECT count(*) FROM sqlite_master WHERE name = 'snapshot_users'"), ShouldBeNil)
+			So(count, ShouldEqual, 0)
+			So(store.GetUser(username, userPass), ShouldBeFalse)
+
+			store.Halt()
+		})
+
+		Convey("Given register and pending queries, an unknown username should be registered as pending", func() {
+			authOpts["sqlite_registerquery"] = "INSERT INTO test_pending(username, password_hash) VALUES (?, ?)"
+			authOpts["sqlite_pendingquery"] = "SELECT password_hash FROM test_pending WHERE username = ? limit 1"
+			pendingSqlite, err := NewSqlite(authOpts, log.DebugLevel)
+			delete(authOpts, "sqlite_registerquery")
+			delete(authOpts, "sqlite_pendingquery")
+			So(err, ShouldBeNil)
+
+			pendingSqlite.DB.MustExec(pendingSchema)
+
+			pendingUser := "device-1"
+			So(pendingSqlite.IsPending(pendingUser), ShouldBeFalse)
+			So(pendingSqlite.RegisterPending(pendingUser, "devicepw"), ShouldBeNil)
+			So(pendingSqlite.IsPending(pendingUser), ShouldBeTrue)
+			So(pendingSqlite.GetPending(pendingUser, "devicepw"), ShouldBeTrue)
+			So(pendingSqlite.GetPending(pendingUser, "wrongpw"), ShouldBeFalse)
+			So(pendingSqlite.GetUser(pendingUser, "devicepw"), ShouldBeFalse)
+			So(pendingSqlite.RegisterPending(pendingUser, "otherpw"), ShouldBeError)
+
+			pendingSqlite.DB.MustExec("DROP TABLE test_pending")
+			pendingSqlite.Halt()
+		})
+
+		Convey("Given a register query but no pending query, initialization should fail", func() {
+			authOpts["sqlite_registerquery"] = "INSERT INTO test_pending(username, password_hash) VALUES (?, ?)"
+			_, err := NewSqlite(authOpts, log.DebugLevel)
+			delete(authOpts, "sqlite_registerquery")
+			So(err, ShouldBeError)
+		})
+
 		sqlite.DB.MustExec("delete from test_user where 1 = 1")
 		sqlite.DB.MustExec("delete from test_acl where 1 = 1")
 
@@ -0,0 +1,165 @@
+package backends
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+//SnapshotUser is a user with its password hash, superuser status and acls, as exported by a backend.
+type SnapshotUser struct {
+	Username     string        `json:"username"`
+	PasswordHash string        `json:"password_hash"`
+	Superuser    bool          `json:"superuser"`
+	Acls         []ManifestAcl `json:"acls"`
+}
+
+//Snapshot is the full user and acl dataset of a backend.
+type Snapshot struct {
+	Users []SnapshotUser `json:"users"`
+}
+
+//Exporter is implemented by backends that may export their full dataset, so a standby may be kept in sync from them.
+type Exporter interface {
+	Export() (Snapshot, error)
+}
+
+//Importer is implemented by backends that may replace their dataset with a snapshot, so they may act as standby.
+type Importer interface {
+	Import(snapshot Snapshot) error
+}
+
+//HealthChecker is implemented by backends that can tell if their upstream is reachable, so a standby may be promoted when it's not.
+type HealthChecker interface {
+	Healthy() bool
+}
+
+//ConnectionCounter is implemented by backends that keep a pool of connections to their upstream, so open ones may be reported.
+type ConnectionCounter interface {
+	OpenConnections() int
+}
+
+//snapshotSchema creates the tables snapshots are imported into. Standby backends' queries must read from them.
+const snapshotSchema = `
+CREATE TABLE IF NOT EXISTS snapshot_users (
+	username TEXT PRIMARY KEY,
+	password_hash TEXT NOT NULL,
+	is_admin INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS snapshot_acls (
+	username TEXT NOT NULL,
+	topic TEXT NOT NULL,
+	rw INTEGER NOT NULL
+);`
+
+//exportSQL exports users with a query that returns username, password hash and superuser rows, and their acls with one that returns username, topic and acc rows.
+func exportSQL(db *sqlx.DB, usersQuery, aclsQuery, backend string) (Snapshot, error) {
+
+	var snapshot Snapshot
+
+	if usersQuery == "" {
+		return snapshot, errors.Errorf("%s export error: no export users query", backend)
+	}
+
+	rows, err := db.Queryx(usersQuery)
+	if err != nil {
+		return snapshot, errors.Errorf("%s export users error: %s", backend, err)
+	}
+	defer rows.Close()
+
+	index := make(map[string]int)
+	for rows.Next() {
+		var user SnapshotUser
+		var superuser sql.NullBool
+		if err := rows.Scan(&user.Username, &user.PasswordHash, &superuser); err != nil {
+			return snapshot, errors.Errorf("%s export users scan error: %s", backend, err)
+		}
+		user.Superuser = superuser.Valid && superuser.Bool
+		index[user.Username] = len(snapshot.Users)
+		snapshot.Users = append(snapshot.Users, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return snapshot, errors.Errorf("%s export users error: %s", backend, err)
+	}
+
+	if aclsQuery == "" {
+		return snapshot, nil
+	}
+
+	aclRows, err := db.Queryx(aclsQuery)
+	if err != nil {
+		return snapshot, errors.Errorf("%s export acls error: %s", backend, err)
+	}
+	defer aclRows.Close()
+
+	for aclRows.Next() {
+		var username string
+		var acl ManifestAcl
+		if err := aclRows.Scan(&username, &acl.Topic, &acl.Acc); err != nil {
+			return snapshot, errors.Errorf("%s export acls scan error: %s", backend, err)
+		}
+		//Acls of users that weren't exported are of no use.
+		if i, ok := index[username]; ok {
+			snapshot.Users[i].Acls = append(snapshot.Users[i].Acls, acl)
+		}
+	}
+
+	if err := aclRows.Err(); err != nil {
+		return snapshot, errors.Errorf("%s export acls error: %s", backend, err)
+	}
+
+	return snapshot, nil
+
+}
+
+//importSQL replaces the contents of the snapshot tables in a single transaction, so checks never see a partial snapshot.
+func importSQL(db *sqlx.DB, snapshot Snapshot) error {
+
+	if _, err := db.Exec(snapshotSchema); err != nil {
+		return errors.Wrap(err, "create snapshot tables error")
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "begin import error")
+	}
+
+	if err := importTx(tx, snapshot); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+func importTx(tx *sqlx.Tx, snapshot Snapshot) error {
+
+	if _, err := tx.Exec("DELETE FROM snapshot_acls"); err != nil {
+		return errors.Wrap(err, "clear snapshot acls error")
+	}
+
+	if _, err := tx.Exec("DELETE FROM snapshot_users"); err != nil {
+		return errors.Wrap(err, "clear snapshot users error")
+	}
+
+	for _, user := range snapshot.Users {
+		isAdmin := 0
+		if user.Superuser {
+			isAdmin = 1
+		}
+		if _, err := tx.Exec(tx.Rebind("INSERT INTO snapshot_users(username, password_hash, is_admin) VALUES (?, ?, ?)"), user.Username, user.PasswordHash, isAdmin); err != nil {
+			return errors.Wrapf(err, "import user %s error", user.Username)
+		}
+		for _, acl := range user.Acls {
+			if _, err := tx.Exec(tx.Rebind("INSERT INTO snapshot_acls(username, topic, rw) VALUES (?, ?, ?)"), user.Username, acl.Topic, acl.Acc); err != nil {
+				return errors.Wrapf(err, "import acl %s for user %s error", acl.Topic, user.Username)
+			}
+		}
+	}
+
+	return nil
+
+}
@@ -0,0 +1,246 @@
+package backends
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//Swap is a change of backends: the backends in check order, the running ones to create again, and options to set when creating them.
+type Swap struct {
+	Backends []string          `json:"backends"`
+	Reload   []string          `json:"reload"`
+	Options  map[string]string `json:"options"`
+}
+
+//BackendSet is the running backends, in check order, and the options they were created with.
+//Order may list backends that aren't in Backends, such as the custom plugin, which are kept as they are.
+type BackendSet struct {
+	Order    []string
+	Backends map[string]Backend
+	Opts     map[string]string
+}
+
+//SwapStatus is the running backends in check order and, while a swap is pending, the ones it replaced and created.
+type SwapStatus struct {
+	Backends []string
+	Pending  bool
+	Previous []string
+	Created  []string
+}
+
+//Swapper swaps backends atomically: new backends are created before any check sees them, and if any fails nothing changes.
+//Replaced backends are kept running until the swap is committed, so it may be rolled back, and no other swap may be done until then.
+//Load and Store get and replace the running backends, Create creates a backend with the given options,
+//and Check, if set, rejects swaps of the running backends before any is created.
+type Swapper struct {
+	Load   func() BackendSet
+	Store  func(BackendSet)
+	Create func(name string, opts map[string]string) (Backend, error)
+	Check  func(swap Swap, current BackendSet) error
+
+	mu   sync.Mutex
+	last *swapped
+}
+
+//swapped is the set replaced by a swap, along with the backends the swap created, added or reloaded.
+type swapped struct {
+	previous BackendSet
+	created  []string
+}
+
+//optionPrefixes holds the prefixes of backends' options that aren't named after the backend.
+var optionPrefixes = map[string][]string{
+	"postgres":   {"pg_"},
+	"javascript": {"js_"},
+	"files":      {"files_", "password_path", "acl_path", "psk_path"},
+	"jwt":        {"jwt_", "pg_", "mysql_"},
+}
+
+//OptionPrefixes returns the prefixes of the options the named backend is created with, which is its name followed by an underscore unless told otherwise.
+//The jwt backend includes those of the postgres and mysql ones, as it may check tokens against their DBs.
+func OptionPrefixes(name string) []string {
+	if prefixes, ok := optionPrefixes[name]; ok {
+		return prefixes
+	}
+	return []string{name + "_"}
+}
+
+//CheckSwapOptions checks every option is one of the given backends', so a swap can't change options of other backends or of the plugin itself.
+func CheckSwapOptions(options map[string]string, backends []string) error {
+	for option := range options {
+		owned := false
+		for _, bename := range backends {
+			for _, prefix := range OptionPrefixes(bename) {
+				if strings.HasPrefix(option, prefix) {
+					owned = true
+				}
+			}
+		}
+		if !owned {
+			return errors.Errorf("option %s isn't one of the backends created by the swap", option)
+		}
+	}
+	return nil
+}
+
+//Swap replaces the running backends with the given ones, in check order, creating those not running and those to reload with the current options and the given ones,
+//which must be options of the backends being created. It returns the status once swapped.
+func (s *Swapper) Swap(swap Swap) (SwapStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last != nil {
+		return SwapStatus{}, errors.New("the last swap must be committed or rolled back first")
+	}
+	if len(swap.Backends) == 0 {
+		return SwapStatus{}, errors.New("no backends given")
+	}
+
+	current := s.Load()
+
+	listed := make(map[string]bool)
+	for _, bename := range swap.Backends {
+		if listed[bename] {
+			return SwapStatus{}, errors.Errorf("backend %s given twice", bename)
+		}
+		listed[bename] = true
+	}
+
+	if s.Check != nil {
+		if err := s.Check(swap, current); err != nil {
+			return SwapStatus{}, err
+		}
+	}
+
+	reload := make(map[string]bool)
+	for _, bename := range swap.Reload {
+		if _, ok := current.Backends[bename]; !ok || !listed[bename] {
+			return SwapStatus{}, errors.Errorf("backend %s can't be reloaded, it's not running or not kept", bename)
+		}
+		reload[bename] = true
+	}
+
+	kept := make(map[string]bool)
+	for _, bename := range current.Order {
+		if _, ok := current.Backends[bename]; !ok {
+			kept[bename] = true
+		}
+	}
+
+	var creating []string
+	for _, bename := range swap.Backends {
+		if kept[bename] {
+			continue
+		}
+		if _, ok := current.Backends[bename]; !ok || reload[bename] {
+			creating = append(creating, bename)
+		}
+	}
+
+	if err := CheckSwapOptions(swap.Options, creating); err != nil {
+		return SwapStatus{}, err
+	}
+
+	newOpts := make(map[string]string, len(current.Opts)+len(swap.Options))
+	for k, v := range current.Opts {
+		newOpts[k] = v
+	}
+	for k, v := range swap.Options {
+		newOpts[k] = v
+	}
+
+	newBackends := make(map[string]Backend, len(swap.Backends))
+	for _, bename := range swap.Backends {
+		if backend, ok := current.Backends[bename]; ok && !reload[bename] {
+			newBackends[bename] = backend
+		}
+	}
+	var created []string
+	for _, bename := range creating {
+		backend, err := s.Create(bename, newOpts)
+		if err != nil {
+			for _, c := range created {
+				newBackends[c].Halt()
+			}
+			return SwapStatus{}, errors.Errorf("couldn't initialize %s backend, nothing was swapped: %s", bename, err)
+		}
+		newBackends[bename] = backend
+		created = append(created, bename)
+	}
+
+	s.Store(BackendSet{
+		Order:    append([]string(nil), swap.Backends...),
+		Backends: newBackends,
+		Opts:     newOpts,
+	})
+	s.last = &swapped{previous: current, created: created}
+
+	return s.status(), nil
+}
+
+//Commit commits the last swap, halting the backends it removed or reloaded.
+func (s *Swapper) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil {
+		return errors.New("there's no swap to commit")
+	}
+
+	current := s.Load()
+	for bename, backend := range s.last.previous.Backends {
+		if _, kept := current.Backends[bename]; kept && !s.last.isCreated(bename) {
+			continue
+		}
+		backend.Halt()
+	}
+
+	s.last = nil
+	return nil
+}
+
+//Rollback restores the backends and options replaced by the last swap, halting the backends it created.
+func (s *Swapper) Rollback() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil {
+		return errors.New("there's no swap to roll back")
+	}
+
+	current := s.Load()
+	s.Store(s.last.previous)
+	for _, bename := range s.last.created {
+		current.Backends[bename].Halt()
+	}
+
+	s.last = nil
+	return nil
+}
+
+//Status returns the running backends and, while a swap is pending, the ones it replaced and created.
+func (s *Swapper) Status() SwapStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status()
+}
+
+func (s *Swapper) status() SwapStatus {
+	status := SwapStatus{Backends: s.Load().Order, Pending: s.last != nil}
+	if s.last != nil {
+		status.Previous = s.last.previous.Order
+		status.Created = s.last.created
+	}
+	return status
+}
+
+func (s *swapped) isCreated(bename string) bool {
+	for _, c := range s.created {
+		if c == bename {
+			return true
+		}
+	}
+	return false
+}
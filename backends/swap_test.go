@@ -0,0 +1,204 @@
+package backends
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//swapBackend records whether it was halted and the options it was created with.
+type swapBackend struct {
+	name   string
+	opts   map[string]string
+	halted *bool
+}
+
+func newSwapBackend(name string, opts map[string]string) swapBackend {
+	return swapBackend{name: name, opts: opts, halted: new(bool)}
+}
+
+func (o swapBackend) GetUser(username, password string) bool {
+	return false
+}
+
+func (o swapBackend) GetSuperuser(username string) bool {
+	return false
+}
+
+func (o swapBackend) CheckAcl(username, topic, clientid string, acc int32) bool {
+	return false
+}
+
+func (o swapBackend) GetName() string {
+	return o.name
+}
+
+func (o swapBackend) Halt() {
+	*o.halted = true
+}
+
+//newTestSwapper returns a swapper of a postgres backend and the custom plugin, storing sets at running, whose Create fails for names in failing.
+func newTestSwapper(running *BackendSet, failing map[string]bool) *Swapper {
+	*running = BackendSet{
+		Order:    []string{"postgres", "plugin"},
+		Backends: map[string]Backend{"postgres": newSwapBackend("postgres", nil)},
+		Opts:     map[string]string{"pg_host": "localhost", "admin_token": "token"},
+	}
+	return &Swapper{
+		Load:  func() BackendSet { return *running },
+		Store: func(set BackendSet) { *running = set },
+		Create: func(name string, opts map[string]string) (Backend, error) {
+			if failing[name] {
+				return nil, errors.New("unreachable")
+			}
+			return newSwapBackend(name, opts), nil
+		},
+	}
+}
+
+func halted(backend Backend) bool {
+	return *backend.(swapBackend).halted
+}
+
+func TestSwapper(t *testing.T) {
+
+	Convey("Given a swap adding a backend, it should be created with the given options and the running ones kept", t, func() {
+		var running BackendSet
+		swapper := newTestSwapper(&running, nil)
+		postgres := running.Backends["postgres"]
+
+		status, err := swapper.Swap(Swap{Backends: []string{"http", "postgres", "plugin"}, Options: map[string]string{"http_host": "auth.example.com"}})
+		So(err, ShouldBeNil)
+		So(status, ShouldResemble, SwapStatus{Backends: []string{"http", "postgres", "plugin"}, Pending: true, Previous: []string{"postgres", "plugin"}, Created: []string{"http"}})
+
+		So(running.Backends["postgres"].(swapBackend).halted, ShouldEqual, postgres.(swapBackend).halted)
+		So(running.Backends["http"].(swapBackend).opts["http_host"], ShouldEqual, "auth.example.com")
+		So(running.Backends["http"].(swapBackend).opts["pg_host"], ShouldEqual, "localhost")
+		So(running.Opts["http_host"], ShouldEqual, "auth.example.com")
+
+		_, err = swapper.Swap(Swap{Backends: []string{"postgres", "plugin"}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a committed swap, backends it removed or reloaded should be halted, and kept ones not", t, func() {
+		var running BackendSet
+		swapper := newTestSwapper(&running, nil)
+		running.Order = []string{"postgres", "redis"}
+		running.Backends["redis"] = newSwapBackend("redis", nil)
+		postgres, redis := running.Backends["postgres"], running.Backends["redis"]
+
+		_, err := swapper.Swap(Swap{Backends: []string{"http", "redis"}, Reload: []string{"redis"}, Options: map[string]string{"redis_host": "other"}})
+		So(err, ShouldBeNil)
+		So(halted(postgres), ShouldBeFalse)
+		So(halted(redis), ShouldBeFalse)
+
+		So(swapper.Commit(), ShouldBeNil)
+		So(halted(postgres), ShouldBeTrue)
+		So(halted(redis), ShouldBeTrue)
+		So(halted(running.Backends["redis"]), ShouldBeFalse)
+		So(halted(running.Backends["http"]), ShouldBeFalse)
+		So(swapper.Status().Pending, ShouldBeFalse)
+
+		So(swapper.Commit(), ShouldNotBeNil)
+	})
+
+	Convey("Given a rolled back swap, the previous backends and options should be restored and the created ones halted", t, func() {
+		var running BackendSet
+		swapper := newTestSwapper(&running, nil)
+		previous := running
+
+		_, err := swapper.Swap(Swap{Backends: []string{"http", "plugin"}, Options: map[string]string{"http_host": "auth.example.com"}})
+		So(err, ShouldBeNil)
+		http := running.Backends["http"]
+
+		So(swapper.Rollback(), ShouldBeNil)
+		So(running, ShouldResemble, previous)
+		So(halted(http), ShouldBeTrue)
+		So(halted(running.Backends["postgres"]), ShouldBeFalse)
+		So(swapper.Status(), ShouldResemble, SwapStatus{Backends: []string{"postgres", "plugin"}})
+
+		So(swapper.Rollback(), ShouldNotBeNil)
+	})
+
+	Convey("Given a backend failing to be created, nothing should be swapped and those created halted", t, func() {
+		var running BackendSet
+		swapper := newTestSwapper(&running, map[string]bool{"redis": true})
+		previous := running
+		var created []Backend
+		create := swapper.Create
+		swapper.Create = func(name string, opts map[string]string) (Backend, error) {
+			backend, err := create(name, opts)
+			if err == nil {
+				created = append(created, backend)
+			}
+			return backend, err
+		}
+
+		_, err := swapper.Swap(Swap{Backends: []string{"http", "redis", "postgres", "plugin"}})
+		So(err, ShouldNotBeNil)
+		So(running, ShouldResemble, previous)
+		So(created, ShouldHaveLength, 1)
+		So(halted(created[0]), ShouldBeTrue)
+		So(swapper.Status().Pending, ShouldBeFalse)
+	})
+
+	Convey("Given options of backends the swap doesn't create, it should be refused", t, func() {
+		var running BackendSet
+		swapper := newTestSwapper(&running, nil)
+		previous := running
+
+		for _, options := range []map[string]string{
+			{"admin_token": "other"},
+			{"pg_host": "other"},
+			{"http_host": "auth.example.com", "backends": "http"},
+		} {
+			_, err := swapper.Swap(Swap{Backends: []string{"http", "postgres", "plugin"}, Options: options})
+			So(err, ShouldNotBeNil)
+			So(running, ShouldResemble, previous)
+		}
+
+		_, err := swapper.Swap(Swap{Backends: []string{"postgres", "plugin"}, Reload: []string{"postgres"}, Options: map[string]string{"pg_host": "other"}})
+		So(err, ShouldBeNil)
+		So(running.Backends["postgres"].(swapBackend).opts["pg_host"], ShouldEqual, "other")
+	})
+
+	Convey("Given bad swaps, they should be refused", t, func() {
+		var running BackendSet
+		swapper := newTestSwapper(&running, nil)
+		swapper.Check = func(swap Swap, current BackendSet) error {
+			for _, bename := range swap.Backends {
+				if bename == "mongo" {
+					return errors.New("not allowed")
+				}
+			}
+			return nil
+		}
+
+		for _, swap := range []Swap{
+			{},
+			{Backends: []string{"http", "http", "plugin"}},
+			{Backends: []string{"http", "plugin"}, Reload: []string{"postgres"}},
+			{Backends: []string{"postgres", "plugin"}, Reload: []string{"http"}},
+			{Backends: []string{"mongo", "plugin"}},
+		} {
+			_, err := swapper.Swap(swap)
+			So(err, ShouldNotBeNil)
+		}
+		So(swapper.Status().Pending, ShouldBeFalse)
+	})
+
+}
+
+func TestOptionPrefixes(t *testing.T) {
+
+	Convey("Given backends, their options should be told apart from other backends' and the plugin's", t, func() {
+		So(CheckSwapOptions(map[string]string{"pg_host": "a", "pg_port": "5432"}, []string{"postgres"}), ShouldBeNil)
+		So(CheckSwapOptions(map[string]string{"password_path": "a", "acl_path": "b"}, []string{"files"}), ShouldBeNil)
+		So(CheckSwapOptions(map[string]string{"jwt_mode": "local", "pg_host": "a"}, []string{"jwt"}), ShouldBeNil)
+		So(CheckSwapOptions(map[string]string{"mysql_host": "a"}, []string{"postgres"}), ShouldNotBeNil)
+		So(CheckSwapOptions(map[string]string{"cache": "true"}, []string{"redis"}), ShouldNotBeNil)
+		So(CheckSwapOptions(map[string]string{"http_host": "a"}, nil), ShouldNotBeNil)
+	})
+
+}
@@ -0,0 +1,7 @@
+package backends
+
+//UserFinder is implemented by backends that may tell if a user exists without checking a password, e.g. to check users authenticated by a token.
+type UserFinder interface {
+	//UserExists checks if the user exists and is active, returning the error of a failed check, e.g. ErrNotFound.
+	UserExists(username string) (bool, error)
+}
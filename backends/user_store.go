@@ -0,0 +1,11 @@
+package backends
+
+//UserStore is implemented by backends that keep users themselves, so they may be managed through the admin api.
+type UserStore interface {
+	//StoredUser returns the user with its password hash, superuser status and acls, if it's stored.
+	StoredUser(username string) (SnapshotUser, bool, error)
+	//StoreUser stores the user, replacing it if it's already stored.
+	StoreUser(user SnapshotUser) error
+	//DeleteUser removes the user, failing with ErrNotFound if it isn't stored.
+	DeleteUser(username string) error
+}
@@ -0,0 +1,346 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//AclConditions restricts when and from where an acl rule is in effect.
+type AclConditions struct {
+	From     time.Time
+	Until    time.Time
+	Days     map[time.Weekday]bool //Days the rule is in effect, any day if empty.
+	Start    int                   //Start of the daily hours range in minutes since midnight, -1 if there's no range.
+	End      int                   //End of the daily hours range in minutes since midnight, -1 if there's no range.
+	Location *time.Location        //Location used for days and hours, local time by default.
+	Networks []*net.IPNet          //Networks the client must connect from, any if empty.
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+//clientAddresses keeps the address of clients being checked, by clientid, along with how many of their checks are running,
+//as a client's checks may run alongside prewarm checks for it.
+var clientAddresses = struct {
+	sync.RWMutex
+	m map[string]*clientAddress
+}{m: make(map[string]*clientAddress)}
+
+type clientAddress struct {
+	ip     net.IP
+	checks int
+}
+
+//SetClientAddress registers the address of a client for conditions to be checked against while its checks are running.
+//It tells if it was registered, in which case ClearClientAddress must be called once the check is done.
+func SetClientAddress(clientid, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	clientAddresses.Lock()
+	defer clientAddresses.Unlock()
+	if registered, ok := clientAddresses.m[clientid]; ok {
+		registered.ip = ip
+		registered.checks++
+		return true
+	}
+	clientAddresses.m[clientid] = &clientAddress{ip: ip, checks: 1}
+	return true
+}
+
+//ClearClientAddress removes a client's registered address once none of its checks is running.
+func ClearClientAddress(clientid string) {
+	clientAddresses.Lock()
+	defer clientAddresses.Unlock()
+	registered, ok := clientAddresses.m[clientid]
+	if !ok {
+		return
+	}
+	registered.checks--
+	if registered.checks <= 0 {
+		delete(clientAddresses.m, clientid)
+	}
+}
+
+//ClientAddress returns the registered address of a client, or nil if it's unknown.
+func ClientAddress(clientid string) net.IP {
+	clientAddresses.RLock()
+	defer clientAddresses.RUnlock()
+	if registered, ok := clientAddresses.m[clientid]; ok {
+		return registered.ip
+	}
+	return nil
+}
+
+//IsConditionToken tells if a token is an acl condition key=value pair.
+func IsConditionToken(token string) bool {
+	kv := strings.SplitN(token, "=", 2)
+	if len(kv) != 2 {
+		return false
+	}
+	switch kv[0] {
+	case "from", "until", "days", "hours", "tz", "cidr":
+		return true
+	}
+	return false
+}
+
+//ParseAclConditions parses condition tokens (from, until, days, hours, tz and cidr), e.g.:
+//	from=2019-01-01T00:00:00Z until=2019-06-30T23:59:59Z days=mon-fri hours=08:00-18:00 tz=Europe/Madrid cidr=10.0.0.0/8
+//It returns nil conditions when no tokens are given.
+func ParseAclConditions(tokens []string) (*AclConditions, error) {
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	conditions := &AclConditions{
+		Days:     make(map[time.Weekday]bool),
+		Start:    -1,
+		End:      -1,
+		Location: time.Local,
+	}
+
+	for _, token := range tokens {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 || !IsConditionToken(token) {
+			return nil, errors.Errorf("unknown acl condition token %s", token)
+		}
+		var err error
+		switch kv[0] {
+		case "from":
+			conditions.From, err = time.Parse(time.RFC3339, kv[1])
+		case "until":
+			conditions.Until, err = time.Parse(time.RFC3339, kv[1])
+		case "days":
+			err = conditions.parseDays(kv[1])
+		case "hours":
+			err = conditions.parseHours(kv[1])
+		case "tz":
+			conditions.Location, err = time.LoadLocation(kv[1])
+		case "cidr":
+			err = conditions.parseNetworks(kv[1])
+		}
+		if err != nil {
+			return nil, errors.Errorf("invalid acl condition token %s: %s", token, err)
+		}
+	}
+
+	return conditions, nil
+}
+
+func (c *AclConditions) parseNetworks(cidrs string) error {
+	for _, cidr := range strings.Split(cidrs, ",") {
+		//Single addresses are taken as a network of their own.
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		c.Networks = append(c.Networks, network)
+	}
+	return nil
+}
+
+func (c *AclConditions) parseDays(days string) error {
+	for _, span := range strings.Split(strings.ToLower(days), ",") {
+		bounds := strings.Split(span, "-")
+		if len(bounds) > 2 {
+			return errors.Errorf("wrong days range %s", span)
+		}
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return errors.Errorf("unknown day %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return errors.Errorf("unknown day %s", bounds[1])
+			}
+		}
+		//Ranges may wrap around the week, e.g. fri-mon.
+		for d := first; ; d = (d + 1) % 7 {
+			c.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (c *AclConditions) parseHours(hours string) error {
+	bounds := strings.Split(hours, "-")
+	if len(bounds) != 2 {
+		return errors.Errorf("wrong hours range %s", hours)
+	}
+	var err error
+	if c.Start, err = parseClock(bounds[0]); err != nil {
+		return err
+	}
+	if c.End, err = parseClock(bounds[1]); err != nil {
+		return err
+	}
+	return nil
+}
+
+//parseClock parses a hh:mm time into minutes since midnight.
+func parseClock(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 {
+		return 0, errors.Errorf("wrong time %s, expected hh:mm", clock)
+	}
+	h, hErr := strconv.Atoi(parts[0])
+	m, mErr := strconv.Atoi(parts[1])
+	if hErr != nil || mErr != nil || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, errors.Errorf("wrong time %s, expected hh:mm", clock)
+	}
+	return h*60 + m, nil
+}
+
+//Met tells if the conditions are met at the given time for a client connecting from address, which may be nil if unknown.
+//Nil conditions are always met, while network conditions are never met for unknown addresses.
+func (c *AclConditions) Met(t time.Time, address net.IP) bool {
+	if c == nil {
+		return true
+	}
+
+	if len(c.Networks) > 0 {
+		if address == nil {
+			return false
+		}
+		inNetwork := false
+		for _, network := range c.Networks {
+			if network.Contains(address) {
+				inNetwork = true
+				break
+			}
+		}
+		if !inNetwork {
+			return false
+		}
+	}
+
+	if !c.From.IsZero() && t.Before(c.From) {
+		return false
+	}
+
+	if !c.Until.IsZero() && t.After(c.Until) {
+		return false
+	}
+
+	local := t.In(c.Location)
+
+	if len(c.Days) > 0 && !c.Days[local.Weekday()] {
+		return false
+	}
+
+	if c.Start >= 0 {
+		minute := local.Hour()*60 + local.Minute()
+		if c.Start <= c.End {
+			return minute >= c.Start && minute < c.End
+		}
+		//The range goes past midnight, e.g. 22:00-06:00.
+		return minute >= c.Start || minute < c.End
+	}
+
+	return true
+}
+
+//Timed tells if the conditions depend on time, so whether they're met changes as time passes. Nil conditions don't.
+func (c *AclConditions) Timed() bool {
+	if c == nil {
+		return false
+	}
+	return !c.From.IsZero() || !c.Until.IsZero() || len(c.Days) > 0 || c.Start >= 0
+}
+
+//String returns the conditions in the same format they're parsed from.
+func (c *AclConditions) String() string {
+	if c == nil {
+		return ""
+	}
+	var tokens []string
+	if !c.From.IsZero() {
+		tokens = append(tokens, "from="+c.From.Format(time.RFC3339))
+	}
+	if !c.Until.IsZero() {
+		tokens = append(tokens, "until="+c.Until.Format(time.RFC3339))
+	}
+	if len(c.Days) > 0 {
+		var days []string
+		for _, name := range []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} {
+			if c.Days[weekdays[name]] {
+				days = append(days, name)
+			}
+		}
+		tokens = append(tokens, "days="+strings.Join(days, ","))
+	}
+	if c.Start >= 0 {
+		tokens = append(tokens, fmt.Sprintf("hours=%02d:%02d-%02d:%02d", c.Start/60, c.Start%60, c.End/60, c.End%60))
+	}
+	if c.Location != time.Local {
+		tokens = append(tokens, "tz="+c.Location.String())
+	}
+	if len(c.Networks) > 0 {
+		var cidrs []string
+		for _, network := range c.Networks {
+			cidrs = append(cidrs, network.String())
+		}
+		tokens = append(tokens, "cidr="+strings.Join(cidrs, ","))
+	}
+	return strings.Join(tokens, " ")
+}
+
+//SplitAclRule separates an acl rule's topic from its optional conditions, given as space separated tokens after the topic.
+func SplitAclRule(rule string) (string, *AclConditions, error) {
+	fields := AclFields(rule)
+	i := len(fields)
+	for i > 1 && IsConditionToken(fields[i-1]) {
+		i--
+	}
+
+	//Leave rules without conditions untouched.
+	if i == len(fields) {
+		return rule, nil, nil
+	}
+
+	conditions, err := ParseAclConditions(fields[i:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return strings.Join(fields[:i], " "), conditions, nil
+}
+
+//ActiveAclTopic returns an acl rule's topic, if the rule's conditions are met for the client at the given time, and if they're timed,
+//so decisions depending on the rule change when its window opens or closes. Rules with malformed conditions are logged and never in effect.
+func ActiveAclTopic(rule, clientid string, t time.Time) (string, bool, bool) {
+	topic, conditions, err := SplitAclRule(rule)
+	if err != nil {
+		log.Errorf("acl rule %s has wrong conditions: %s", rule, err)
+		return "", false, false
+	}
+	return topic, conditions.Met(t, ClientAddress(clientid)), conditions.Timed()
+}
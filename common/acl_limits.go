@@ -0,0 +1,73 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//AclLimits bound the acl rules a single user may have, so one pathological account can't degrade matching for the whole broker.
+//Zero values mean no limit.
+type AclLimits struct {
+	MaxRules      int //MaxRules is the maximum number of acl rules of a user.
+	MaxRuleLength int //MaxRuleLength is the maximum length in bytes of a rule, templates and conditions included.
+	MaxWildcards  int //MaxWildcards is the maximum number of wildcard levels (+ or #) in a rule's topic.
+}
+
+var aclLimits AclLimits
+
+//SetAclLimits sets the limits enforced on acl rules when backends load or fetch them.
+func SetAclLimits(limits AclLimits) {
+	aclLimits = limits
+}
+
+//GetAclLimits returns the limits enforced on acl rules.
+func GetAclLimits() AclLimits {
+	return aclLimits
+}
+
+//CheckAclRules checks username's rules are within the acl limits, returning an error telling the first one exceeded otherwise.
+func CheckAclRules(username string, rules []string) error {
+	if err := CheckAclRuleCount(username, len(rules)); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if err := CheckAclRule(username, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//CheckAclRuleCount checks username's count of rules is within the acl limits.
+func CheckAclRuleCount(username string, count int) error {
+	if aclLimits.MaxRules > 0 && count > aclLimits.MaxRules {
+		return errors.Errorf("user %s has %d acl rules, over the limit of %d", username, count, aclLimits.MaxRules)
+	}
+	return nil
+}
+
+//CheckAclRule checks a single rule of username is within the acl limits.
+func CheckAclRule(username, rule string) error {
+	if aclLimits.MaxRuleLength > 0 && len(rule) > aclLimits.MaxRuleLength {
+		return errors.Errorf("user %s has an acl rule of %d bytes, over the limit of %d", username, len(rule), aclLimits.MaxRuleLength)
+	}
+
+	if aclLimits.MaxWildcards > 0 {
+		fields := AclFields(rule)
+		if len(fields) == 0 {
+			return nil
+		}
+		wildcards := 0
+		for _, level := range strings.Split(fields[0], "/") {
+			if level == "+" || level == "#" {
+				wildcards++
+			}
+		}
+		if wildcards > aclLimits.MaxWildcards {
+			return errors.Errorf("user %s has acl rule %s with %d wildcards, over the limit of %d", username, fields[0], wildcards, aclLimits.MaxWildcards)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,34 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAclLimits(t *testing.T) {
+
+	Convey("Given no limits, any rules should be allowed", t, func() {
+		So(CheckAclRules("test", []string{"a/#", strings.Repeat("+/", 100) + "#"}), ShouldBeNil)
+	})
+
+	Convey("Given limits, rules over them should be rejected", t, func() {
+		SetAclLimits(AclLimits{MaxRules: 2, MaxRuleLength: 40, MaxWildcards: 2})
+		defer SetAclLimits(AclLimits{})
+
+		So(CheckAclRules("test", []string{"a/+/b/#", "c/%u days=mon-fri"}), ShouldBeNil)
+		So(CheckAclRules("test", []string{"a", "b", "c"}), ShouldNotBeNil)
+		So(CheckAclRules("test", []string{strings.Repeat("a", 41)}), ShouldNotBeNil)
+		So(CheckAclRules("test", []string{"+/+/#"}), ShouldNotBeNil)
+
+		//Wildcards are only counted at whole levels of the topic, leaving templates and conditions aside.
+		So(CheckAclRule("test", `{{username | split "+" 0}}/+/#`), ShouldBeNil)
+		So(CheckAclRule("test", "a+/b#/+/#"), ShouldBeNil)
+		So(CheckAclRule("test", "a/+/# days=mon"), ShouldBeNil)
+
+		err := CheckAclRuleCount("test", 3)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "user test has 3 acl rules, over the limit of 2")
+	})
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//AclRoute sends acl checks for topics matching Topic to a single backend.
+type AclRoute struct {
+	Topic   string
+	Backend string
+}
+
+//AclRoutes are evaluated in order, the first route matching a topic being used.
+type AclRoutes []AclRoute
+
+//ParseAclRoutes parses comma separated topic:backend pairs, where backend must be one of the given ones.
+//Routes that are malformed, have a bad topic filter or an unknown backend are left out, returning an error for each.
+func ParseAclRoutes(routesStr string, backends []string) (AclRoutes, []error) {
+	var routes AclRoutes
+	var errs []error
+
+	for _, routeStr := range strings.Split(strings.Replace(routesStr, " ", "", -1), ",") {
+		if routeStr == "" {
+			continue
+		}
+
+		//Topics may contain colons, so split at the last one.
+		i := strings.LastIndex(routeStr, ":")
+		if i <= 0 || i == len(routeStr)-1 {
+			errs = append(errs, errors.Errorf("acl route %s is not well formatted", routeStr))
+			continue
+		}
+
+		route := AclRoute{
+			Topic:   routeStr[:i],
+			Backend: routeStr[i+1:],
+		}
+
+		if !validTopic(route.Topic) || !validFilter(strings.Split(route.Topic, "/")) {
+			errs = append(errs, errors.Errorf("acl route %s has a bad topic filter", route.Topic))
+			continue
+		}
+
+		registered := false
+		for _, bename := range backends {
+			if bename == route.Backend {
+				registered = true
+				break
+			}
+		}
+		if !registered {
+			errs = append(errs, errors.Errorf("acl route %s uses backend %s which is not registered", route.Topic, route.Backend))
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, errs
+}
+
+//Match returns the backend of the first route matching topic, if any.
+func (r AclRoutes) Match(topic string) (string, bool) {
+	for _, route := range r {
+		if TopicsMatch(route.Topic, topic) {
+			return route.Backend, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseAclRoutes(t *testing.T) {
+
+	backends := []string{"postgres", "files", "redis", "plugin"}
+
+	Convey("Given acl routes, only well formed ones with registered backends should be kept", t, func() {
+		cases := []struct {
+			routes   string
+			expected AclRoutes
+			errs     int
+		}{
+			{"bridge/#:files", AclRoutes{{Topic: "bridge/#", Backend: "files"}}, 0},
+			{" bridge/# : files , internal/+/status:redis ", AclRoutes{{Topic: "bridge/#", Backend: "files"}, {Topic: "internal/+/status", Backend: "redis"}}, 0},
+			{"urn:a:b/#:plugin", AclRoutes{{Topic: "urn:a:b/#", Backend: "plugin"}}, 0},
+			{"bridge/#:files,,", AclRoutes{{Topic: "bridge/#", Backend: "files"}}, 0},
+			{"", nil, 0},
+			{"bridge/#", nil, 1},
+			{":files", nil, 1},
+			{"bridge/#:", nil, 1},
+			{"bridge/#:mongo", nil, 1},
+			{"a/#/b:files", nil, 1},
+			{"a/b#:files", nil, 1},
+			{"a/+b/c:files", nil, 1},
+			{"a/#/b:files, bridge/#:mongo, bridge/#:files", AclRoutes{{Topic: "bridge/#", Backend: "files"}}, 2},
+		}
+
+		for _, c := range cases {
+			routes, errs := ParseAclRoutes(c.routes, backends)
+			So(routes, ShouldResemble, c.expected)
+			So(errs, ShouldHaveLength, c.errs)
+		}
+	})
+
+}
+
+func TestAclRoutesMatch(t *testing.T) {
+
+	routes, errs := ParseAclRoutes("bridge/internal/#:redis, bridge/#:files, +/status:plugin", []string{"postgres", "files", "redis", "plugin"})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	Convey("Given routes, the first matching one should select the backend, regardless of the chain's order", t, func() {
+		cases := []struct {
+			topic   string
+			backend string
+			routed  bool
+		}{
+			{"bridge/internal/a", "redis", true},
+			{"bridge/a", "files", true},
+			{"bridge", "files", true},
+			{"device/status", "plugin", true},
+			{"bridge/status", "files", true},
+			{"device/a/status", "", false},
+			{"other/topic", "", false},
+		}
+
+		for _, c := range cases {
+			backend, routed := routes.Match(c.topic)
+			So(routed, ShouldEqual, c.routed)
+			So(backend, ShouldEqual, c.backend)
+		}
+	})
+
+	Convey("Given no routes, no topic should be routed, so every one is checked against the chain", t, func() {
+		var none AclRoutes
+		_, routed := none.Match("bridge/a")
+		So(routed, ShouldBeFalse)
+	})
+
+}
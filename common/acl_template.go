@@ -0,0 +1,357 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+//Acl topics may hold templates between {{ and }}, whose expression takes a value and pipes it through functions, e.g. {{username | split "@" 0}}/devices/#.
+//Values are username, clientid or a quoted string, and arguments are quoted strings or integers.
+const (
+	aclTemplateOpen  = "{{"
+	aclTemplateClose = "}}"
+)
+
+//aclTemplateCacheSize caps how many parsed topics are kept, as topics with templates may come from any backend row.
+const aclTemplateCacheSize = 4096
+
+//aclTemplateFunc is a function values may be piped through, taking args arguments.
+type aclTemplateFunc struct {
+	args int
+	call func(value string, args []string) (string, error)
+}
+
+var aclTemplateFuncs = map[string]aclTemplateFunc{
+	//split SEP N returns the Nth part of the value split by SEP, counting from the end when N is negative.
+	"split": {2, func(value string, args []string) (string, error) {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "", errors.Errorf("split index %s is not an integer", args[1])
+		}
+		parts := strings.Split(value, args[0])
+		if n < 0 {
+			n += len(parts)
+		}
+		if n < 0 || n >= len(parts) {
+			return "", errors.Errorf("%s has no part %s split by %q", value, args[1], args[0])
+		}
+		return parts[n], nil
+	}},
+	"lower": {0, func(value string, _ []string) (string, error) {
+		return strings.ToLower(value), nil
+	}},
+	"upper": {0, func(value string, _ []string) (string, error) {
+		return strings.ToUpper(value), nil
+	}},
+	"trimprefix": {1, func(value string, args []string) (string, error) {
+		return strings.TrimPrefix(value, args[0]), nil
+	}},
+	"trimsuffix": {1, func(value string, args []string) (string, error) {
+		return strings.TrimSuffix(value, args[0]), nil
+	}},
+	"replace": {2, func(value string, args []string) (string, error) {
+		return strings.Replace(value, args[0], args[1], -1), nil
+	}},
+	//truncate N keeps the first N characters of the value.
+	"truncate": {1, func(value string, args []string) (string, error) {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return "", errors.Errorf("truncate length %s is not a positive integer", args[0])
+		}
+		runes := []rune(value)
+		if len(runes) > n {
+			runes = runes[:n]
+		}
+		return string(runes), nil
+	}},
+	//default D returns D when the value is empty.
+	"default": {1, func(value string, args []string) (string, error) {
+		if value == "" {
+			return args[0], nil
+		}
+		return value, nil
+	}},
+}
+
+//aclTemplate is a parsed acl topic: literal parts, where %u and %c are replaced, and expressions.
+type aclTemplate struct {
+	parts []aclTemplatePart
+}
+
+type aclTemplatePart struct {
+	text string
+	expr *aclExpr
+}
+
+type aclExpr struct {
+	value   string
+	literal bool
+	calls   []aclCall
+}
+
+type aclCall struct {
+	name string
+	fn   aclTemplateFunc
+	args []string
+}
+
+//aclTemplates caches parsed topics with templates, keeping their parse errors too.
+var aclTemplates = struct {
+	sync.RWMutex
+	m map[string]aclTemplateEntry
+}{m: make(map[string]aclTemplateEntry)}
+
+type aclTemplateEntry struct {
+	template *aclTemplate
+	err      error
+}
+
+//ExpandAclTopic replaces %u and %c in an acl topic with the username and clientid, and its templates with the result of their expression.
+//It returns false when the topic's templates are malformed or an expression fails or results in an empty value or one with wildcards,
+//in which case the topic must not match anything.
+func ExpandAclTopic(topic, username, clientid string) (string, bool) {
+	if !strings.Contains(topic, aclTemplateOpen) {
+		return replaceAclPlaceholders(topic, username, clientid), true
+	}
+
+	template, err := loadAclTemplate(topic)
+	if err != nil {
+		return "", false
+	}
+
+	var expanded strings.Builder
+	for _, part := range template.parts {
+		if part.expr == nil {
+			expanded.WriteString(replaceAclPlaceholders(part.text, username, clientid))
+			continue
+		}
+		value, err := part.expr.eval(username, clientid)
+		if err != nil || value == "" || strings.ContainsAny(value, "+#\x00") {
+			return "", false
+		}
+		expanded.WriteString(value)
+	}
+	return expanded.String(), true
+}
+
+//ValidateAclTopic checks an acl topic's templates are well formed, so bad ones may be reported when acls are loaded.
+func ValidateAclTopic(topic string) error {
+	if !strings.Contains(topic, aclTemplateOpen) {
+		return nil
+	}
+	_, err := loadAclTemplate(topic)
+	return err
+}
+
+//AclFields splits an acl line around spaces as strings.Fields does, except for those within templates.
+func AclFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch {
+		case strings.HasPrefix(line[i:], aclTemplateOpen):
+			depth++
+			field.WriteString(aclTemplateOpen)
+			i++
+			continue
+		case depth > 0 && strings.HasPrefix(line[i:], aclTemplateClose):
+			depth--
+			field.WriteString(aclTemplateClose)
+			i++
+			continue
+		case depth == 0 && unicode.IsSpace(rune(line[i])):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteByte(line[i])
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+func replaceAclPlaceholders(topic, username, clientid string) string {
+	topic = strings.Replace(topic, "%c", clientid, -1)
+	return strings.Replace(topic, "%u", username, -1)
+}
+
+//loadAclTemplate returns the parsed topic from the cache, parsing it if missing.
+func loadAclTemplate(topic string) (*aclTemplate, error) {
+	aclTemplates.RLock()
+	entry, ok := aclTemplates.m[topic]
+	aclTemplates.RUnlock()
+	if ok {
+		return entry.template, entry.err
+	}
+
+	template, err := parseAclTemplate(topic)
+
+	aclTemplates.Lock()
+	if len(aclTemplates.m) < aclTemplateCacheSize {
+		aclTemplates.m[topic] = aclTemplateEntry{template: template, err: err}
+	}
+	aclTemplates.Unlock()
+
+	return template, err
+}
+
+func parseAclTemplate(topic string) (*aclTemplate, error) {
+	template := &aclTemplate{}
+	rest := topic
+	for rest != "" {
+		start := strings.Index(rest, aclTemplateOpen)
+		if start < 0 {
+			template.parts = append(template.parts, aclTemplatePart{text: rest})
+			break
+		}
+		if start > 0 {
+			template.parts = append(template.parts, aclTemplatePart{text: rest[:start]})
+		}
+		rest = rest[start+len(aclTemplateOpen):]
+
+		end := strings.Index(rest, aclTemplateClose)
+		if end < 0 {
+			return nil, errors.Errorf("acl topic %s has an unclosed template", topic)
+		}
+		expr, err := parseAclExpr(rest[:end])
+		if err != nil {
+			return nil, errors.Errorf("acl topic %s has a bad template: %s", topic, err)
+		}
+		template.parts = append(template.parts, aclTemplatePart{expr: expr})
+		rest = rest[end+len(aclTemplateClose):]
+	}
+	return template, nil
+}
+
+//parseAclExpr parses a value followed by calls separated by |.
+func parseAclExpr(source string) (*aclExpr, error) {
+	tokens, err := tokenizeAclExpr(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var stages [][]aclToken
+	stage := []aclToken{}
+	for _, token := range tokens {
+		if token.pipe {
+			stages = append(stages, stage)
+			stage = []aclToken{}
+			continue
+		}
+		stage = append(stage, token)
+	}
+	stages = append(stages, stage)
+
+	if len(stages[0]) != 1 {
+		return nil, errors.New("templates must start with a single value")
+	}
+	expr := &aclExpr{value: stages[0][0].text, literal: stages[0][0].quoted}
+	if !expr.literal && expr.value != "username" && expr.value != "clientid" {
+		return nil, errors.Errorf("unknown value %s, expected username, clientid or a quoted string", expr.value)
+	}
+
+	for _, stage := range stages[1:] {
+		if len(stage) == 0 || stage[0].quoted {
+			return nil, errors.New("expected a function after |")
+		}
+		name := stage[0].text
+		fn, ok := aclTemplateFuncs[name]
+		if !ok {
+			return nil, errors.Errorf("unknown function %s", name)
+		}
+		if len(stage)-1 != fn.args {
+			return nil, errors.Errorf("%s takes %d arguments, got %d", name, fn.args, len(stage)-1)
+		}
+		call := aclCall{name: name, fn: fn}
+		for _, arg := range stage[1:] {
+			if !arg.quoted {
+				if _, err := strconv.Atoi(arg.text); err != nil {
+					return nil, errors.Errorf("argument %s of %s must be a quoted string or an integer", arg.text, name)
+				}
+			}
+			call.args = append(call.args, arg.text)
+		}
+		expr.calls = append(expr.calls, call)
+	}
+
+	return expr, nil
+}
+
+type aclToken struct {
+	text   string
+	quoted bool
+	pipe   bool
+}
+
+//tokenizeAclExpr splits an expression into words, quoted strings and pipes.
+func tokenizeAclExpr(source string) ([]aclToken, error) {
+	var tokens []aclToken
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '|':
+			tokens = append(tokens, aclToken{pipe: true})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, errors.New("unterminated string")
+			}
+			text, err := strconv.Unquote(source[i : end+1])
+			if err != nil {
+				return nil, errors.Errorf("bad string %s", source[i:end+1])
+			}
+			tokens = append(tokens, aclToken{text: text, quoted: true})
+			i = end + 1
+		default:
+			end := i
+			for end < len(source) && !unicode.IsSpace(rune(source[end])) && source[end] != '|' && source[end] != '"' {
+				end++
+			}
+			tokens = append(tokens, aclToken{text: source[i:end]})
+			i = end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty template")
+	}
+	return tokens, nil
+}
+
+//eval computes the expression for the given client.
+func (e *aclExpr) eval(username, clientid string) (string, error) {
+	value := e.value
+	if !e.literal {
+		if value == "username" {
+			value = username
+		} else {
+			value = clientid
+		}
+	}
+
+	for _, call := range e.calls {
+		var err error
+		value, err = call.fn.call(value, call.args)
+		if err != nil {
+			return "", errors.Errorf("%s failed: %s", call.name, err)
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAclTemplates(t *testing.T) {
+
+	Convey("Given topics without templates, placeholders should be replaced", t, func() {
+		topic, ok := ExpandAclTopic("devices/%u/%c/#", "user", "client")
+		So(ok, ShouldBeTrue)
+		So(topic, ShouldEqual, "devices/user/client/#")
+	})
+
+	Convey("Given topics with templates, expressions should be expanded", t, func() {
+		cases := map[string]string{
+			`{{username | split "@" 0}}/devices/#`:                        "device/devices/#",
+			`tenants/{{ username | split "@" -1 | lower }}/%c`:            "tenants/acme.com/dev-client",
+			`{{clientid | trimprefix "dev-" | upper}}`:                    "CLIENT",
+			`{{username | replace "@" "_" | truncate 6}}/x`:               "device/x",
+			`{{"fixed"}}/{{clientid}}`:                                    "fixed/dev-client",
+			`{{username | split "@" 0 | trimsuffix "ice" | default "x"}}`: "dev",
+		}
+		for template, expected := range cases {
+			topic, ok := ExpandAclTopic(template, "device@Acme.com", "dev-client")
+			So(ok, ShouldBeTrue)
+			So(topic, ShouldEqual, expected)
+		}
+
+		Convey("Placeholders in values shouldn't be replaced again", func() {
+			topic, ok := ExpandAclTopic("{{username}}/%c", "%c", "client")
+			So(ok, ShouldBeTrue)
+			So(topic, ShouldEqual, "%c/client")
+		})
+	})
+
+	Convey("Given expressions that fail or result in empty values or wildcards, topics shouldn't be expanded", t, func() {
+		for _, username := range []string{"device", "device@", "device@#", "device@+"} {
+			_, ok := ExpandAclTopic(`tenants/{{username | split "@" 1}}/#`, username, "client")
+			So(ok, ShouldBeFalse)
+		}
+
+		topic, ok := ExpandAclTopic(`tenants/{{username | split "@" 1 | default "public"}}/#`, "device@", "client")
+		So(ok, ShouldBeTrue)
+		So(topic, ShouldEqual, "tenants/public/#")
+	})
+
+	Convey("Given malformed templates, they should be rejected", t, func() {
+		for _, template := range []string{
+			"{{username",
+			"{{}}",
+			"{{topic}}",
+			"{{username | unknown}}",
+			"{{username | split \"@\"}}",
+			"{{username | split \"@\" x}}",
+			"{{username |}}",
+			"{{username clientid}}",
+			"{{\"unterminated}}",
+		} {
+			So(ValidateAclTopic(template), ShouldNotBeNil)
+			_, ok := ExpandAclTopic(template, "user", "client")
+			So(ok, ShouldBeFalse)
+		}
+		So(ValidateAclTopic(`{{username | split "@" 0}}/#`), ShouldBeNil)
+		So(ValidateAclTopic("devices/%u/#"), ShouldBeNil)
+	})
+
+	Convey("Given acl lines with templates, they should be split keeping templates whole", t, func() {
+		So(AclFields(`pattern read  {{username | split "@" 0}}/# days=mon-fri`), ShouldResemble, []string{"pattern", "read", `{{username | split "@" 0}}/#`, "days=mon-fri"})
+
+		topic, conditions, err := SplitAclRule(`{{username | split "@" 0}}/# tz=UTC`)
+		So(err, ShouldBeNil)
+		So(conditions, ShouldNotBeNil)
+		So(topic, ShouldEqual, `{{username | split "@" 0}}/#`)
+	})
+}
@@ -0,0 +1,59 @@
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+//CheckAdminAccess checks the admin api may be served at address: without a token, anyone reaching it could change backends, so it must be a loopback one.
+func CheckAdminAccess(address, token string) error {
+	if token != "" {
+		return nil
+	}
+	if err := CheckLoopback(address); err != nil {
+		return errors.Wrap(err, "admin_token is required")
+	}
+	return nil
+}
+
+//RequireToken serves next only to requests giving token as `Authorization: Bearer <token>`, answering others with 401.
+//An empty token lets every request through, which CheckAdminAccess only allows at loopback addresses.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//RejectCrossSite serves next only to requests that browsers can't send from other sites: those without an Origin header and, unless they're GETs, with a json body type.
+//Browsers send Origin along with cross site requests and can't set a json Content-Type without a preflight the api doesn't answer,
+//so a web page can't have a local browser change backends or users even when no token is required.
+func RejectCrossSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" {
+			writeAdminError(w, http.StatusForbidden, "requests from browsers aren't accepted")
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+				writeAdminError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
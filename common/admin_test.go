@@ -0,0 +1,92 @@
+package common
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequireToken(t *testing.T) {
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	serve := func(handler http.Handler, authorization string) int {
+		r := httptest.NewRequest(http.MethodGet, "/backends", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	Convey("Given a token, only requests giving it as bearer token should be served", t, func() {
+		handler := RequireToken("secret", ok)
+		So(serve(handler, "Bearer secret"), ShouldEqual, http.StatusOK)
+		So(serve(handler, ""), ShouldEqual, http.StatusUnauthorized)
+		So(serve(handler, "Bearer other"), ShouldEqual, http.StatusUnauthorized)
+		So(serve(handler, "secret"), ShouldEqual, http.StatusUnauthorized)
+		So(serve(handler, "Bearer "), ShouldEqual, http.StatusUnauthorized)
+	})
+
+	Convey("Given no token, every request should be served", t, func() {
+		So(serve(RequireToken("", ok), ""), ShouldEqual, http.StatusOK)
+	})
+
+}
+
+func TestCheckAdminAccess(t *testing.T) {
+
+	Convey("Given no token, the admin api should only be served at loopback addresses", t, func() {
+		So(CheckAdminAccess("127.0.0.1:9299", ""), ShouldBeNil)
+		So(CheckAdminAccess("localhost:9299", ""), ShouldBeNil)
+		So(CheckAdminAccess("0.0.0.0:9299", ""), ShouldNotBeNil)
+		So(CheckAdminAccess(":9299", ""), ShouldNotBeNil)
+		So(CheckAdminAccess("10.0.0.1:9299", ""), ShouldNotBeNil)
+	})
+
+	Convey("Given a token, the admin api may be served at any address", t, func() {
+		So(CheckAdminAccess("0.0.0.0:9299", "secret"), ShouldBeNil)
+	})
+
+}
+
+func TestRejectCrossSite(t *testing.T) {
+
+	handler := RejectCrossSite(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(method, contentType, origin string) int {
+		r := httptest.NewRequest(method, "/backends/commit", nil)
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	Convey("Given requests with a json body type and no origin, they should be served", t, func() {
+		So(serve(http.MethodPost, "application/json", ""), ShouldEqual, http.StatusOK)
+		So(serve(http.MethodPut, "application/json; charset=utf-8", ""), ShouldEqual, http.StatusOK)
+		So(serve(http.MethodGet, "", ""), ShouldEqual, http.StatusOK)
+	})
+
+	Convey("Given requests browsers may send from other sites, they should be rejected", t, func() {
+		So(serve(http.MethodPost, "", ""), ShouldEqual, http.StatusUnsupportedMediaType)
+		So(serve(http.MethodPost, "text/plain", ""), ShouldEqual, http.StatusUnsupportedMediaType)
+		So(serve(http.MethodPost, "application/x-www-form-urlencoded", ""), ShouldEqual, http.StatusUnsupportedMediaType)
+		So(serve(http.MethodDelete, "", ""), ShouldEqual, http.StatusUnsupportedMediaType)
+		So(serve(http.MethodPost, "application/json", "http://evil.example.com"), ShouldEqual, http.StatusForbidden)
+		So(serve(http.MethodGet, "", "http://evil.example.com"), ShouldEqual, http.StatusForbidden)
+	})
+
+}
@@ -0,0 +1,315 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//AuditRecord is a security relevant event, such as a lockout or a backend swap, with its fields.
+type AuditRecord struct {
+	Time   time.Time              `json:"time"`
+	Event  string                 `json:"event"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+//AuditSink stores audit records somewhere they may be reviewed. Write must only return nil once every record is stored,
+//as records are kept and written again on errors, so sinks may get a record more than once.
+type AuditSink interface {
+	Write(records []AuditRecord) error
+	Close() error
+}
+
+//AuditSinkFactory creates a sink from the plugin's options, reading those prefixed by audit_<name>_.
+type AuditSinkFactory func(authOpts map[string]string) (AuditSink, error)
+
+var auditSinksLock sync.RWMutex
+
+//auditSinks are the sink factories by name, built in ones included.
+var auditSinks = map[string]AuditSinkFactory{
+	"file":    newFileAuditSink,
+	"webhook": newWebhookAuditSink,
+	"db":      newDBAuditSink,
+	"kafka":   newKafkaAuditSink,
+}
+
+//RegisterAuditSink adds a sink that may be chosen with the audit_sink option. It may be called from an init func of a fork's package,
+//or from a custom plugin's Init. Names must be unique.
+func RegisterAuditSink(name string, factory AuditSinkFactory) error {
+	if name == "" || factory == nil {
+		return errors.New("audit sinks need a name and a factory")
+	}
+
+	auditSinksLock.Lock()
+	defer auditSinksLock.Unlock()
+
+	if _, ok := auditSinks[name]; ok {
+		return errors.Errorf("audit sink %s is already registered", name)
+	}
+	auditSinks[name] = factory
+	return nil
+}
+
+//AuditSinks returns the names of registered sinks, sorted.
+func AuditSinks() []string {
+	auditSinksLock.RLock()
+	defer auditSinksLock.RUnlock()
+
+	names := make([]string, 0, len(auditSinks))
+	for name := range auditSinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//NewAuditSink creates the named sink from the plugin's options.
+func NewAuditSink(name string, authOpts map[string]string) (AuditSink, error) {
+	auditSinksLock.RLock()
+	factory, ok := auditSinks[name]
+	auditSinksLock.RUnlock()
+
+	if !ok {
+		return nil, errors.Errorf("unknown audit sink %s, registered ones are %s", name, strings.Join(AuditSinks(), ", "))
+	}
+	return factory(authOpts)
+}
+
+//fileAuditSink appends records to a file as json lines.
+type fileAuditSink struct {
+	sync.Mutex
+	file *os.File
+}
+
+func newFileAuditSink(authOpts map[string]string) (AuditSink, error) {
+	path := strings.TrimSpace(authOpts["audit_file_path"])
+	if path == "" {
+		return nil, errors.New("file audit sink needs audit_file_path")
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Errorf("couldn't open audit file %s: %s", path, err)
+	}
+
+	return &fileAuditSink{file: file}, nil
+}
+
+func (s *fileAuditSink) Write(records []AuditRecord) error {
+	s.Lock()
+	defer s.Unlock()
+
+	w := bufio.NewWriter(s.file)
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return errors.Errorf("couldn't encode audit record: %s", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return errors.Errorf("couldn't write audit file: %s", err)
+	}
+	return s.file.Sync()
+}
+
+func (s *fileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+//webhookAuditSink posts records as a json array to a url, which must answer with a 2xx status.
+type webhookAuditSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newWebhookAuditSink(authOpts map[string]string) (AuditSink, error) {
+	url := strings.TrimSpace(authOpts["audit_webhook_url"])
+	if url == "" {
+		return nil, errors.New("webhook audit sink needs audit_webhook_url")
+	}
+
+	timeout, err := auditTimeout(authOpts, "audit_webhook_timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhookAuditSink{
+		url:    url,
+		token:  strings.TrimSpace(authOpts["audit_webhook_token"]),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *webhookAuditSink) Write(records []AuditRecord) error {
+	body, err := json.Marshal(records)
+	if err != nil {
+		return errors.Errorf("couldn't encode audit records: %s", err)
+	}
+	return postAuditRecords(s.client, s.url, "application/json", s.token, body)
+}
+
+func (s *webhookAuditSink) Close() error {
+	return nil
+}
+
+//kafkaAuditSink produces records to a topic through a Kafka REST proxy, so no Kafka client is needed.
+type kafkaAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func newKafkaAuditSink(authOpts map[string]string) (AuditSink, error) {
+	proxy := strings.TrimRight(strings.TrimSpace(authOpts["audit_kafka_rest_url"]), "/")
+	topic := strings.TrimSpace(authOpts["audit_kafka_topic"])
+	if proxy == "" || topic == "" {
+		return nil, errors.New("kafka audit sink needs audit_kafka_rest_url and audit_kafka_topic")
+	}
+
+	timeout, err := auditTimeout(authOpts, "audit_kafka_timeout")
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaAuditSink{
+		url:    proxy + "/topics/" + topic,
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (s *kafkaAuditSink) Write(records []AuditRecord) error {
+	type kafkaRecord struct {
+		Key   string      `json:"key"`
+		Value AuditRecord `json:"value"`
+	}
+
+	batch := struct {
+		Records []kafkaRecord `json:"records"`
+	}{}
+	for _, record := range records {
+		batch.Records = append(batch.Records, kafkaRecord{Key: record.Event, Value: record})
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return errors.Errorf("couldn't encode audit records: %s", err)
+	}
+	return postAuditRecords(s.client, s.url, "application/vnd.kafka.json.v2+json", "", body)
+}
+
+func (s *kafkaAuditSink) Close() error {
+	return nil
+}
+
+//postAuditRecords posts body to url, failing unless it's answered with a 2xx status.
+func postAuditRecords(client *http.Client, url, contentType, token string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Errorf("couldn't create audit request: %s", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Errorf("audit request to %s failed: %s", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("audit request to %s answered with status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+//auditTableName restricts table names, as they can't be given as query params.
+var auditTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+//dbAuditSink inserts records into a table with time, event and fields columns, fields being json encoded.
+//The driver must be registered, which postgres, mysql and sqlite3 are by the backends.
+type dbAuditSink struct {
+	db     *sql.DB
+	insert string
+}
+
+func newDBAuditSink(authOpts map[string]string) (AuditSink, error) {
+	driver := strings.TrimSpace(authOpts["audit_db_driver"])
+	dsn := strings.TrimSpace(authOpts["audit_db_dsn"])
+	if driver == "" || dsn == "" {
+		return nil, errors.New("db audit sink needs audit_db_driver and audit_db_dsn")
+	}
+
+	table := "audit_events"
+	if t, ok := authOpts["audit_db_table"]; ok {
+		table = strings.TrimSpace(t)
+	}
+	if !auditTableName.MatchString(table) {
+		return nil, errors.Errorf("bad audit_db_table %s", table)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Errorf("couldn't open audit db: %s", err)
+	}
+
+	//Postgres numbers its placeholders.
+	insert := "INSERT INTO " + table + " (time, event, fields) VALUES (?, ?, ?)"
+	if driver == "postgres" {
+		insert = "INSERT INTO " + table + " (time, event, fields) VALUES ($1, $2, $3)"
+	}
+
+	return &dbAuditSink{db: db, insert: insert}, nil
+}
+
+func (s *dbAuditSink) Write(records []AuditRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Errorf("couldn't begin audit transaction: %s", err)
+	}
+
+	for _, record := range records {
+		fields, err := json.Marshal(record.Fields)
+		if err != nil {
+			tx.Rollback()
+			return errors.Errorf("couldn't encode audit record: %s", err)
+		}
+		if _, err := tx.Exec(s.insert, record.Time.UTC(), record.Event, string(fields)); err != nil {
+			tx.Rollback()
+			return errors.Errorf("couldn't insert audit record: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Errorf("couldn't commit audit records: %s", err)
+	}
+	return nil
+}
+
+func (s *dbAuditSink) Close() error {
+	return s.db.Close()
+}
+
+//auditTimeout parses a sink's timeout option, defaulting to 5s.
+func auditTimeout(authOpts map[string]string, option string) (time.Duration, error) {
+	timeout := 5 * time.Second
+	if timeoutStr, ok := authOpts[option]; ok {
+		d, err := time.ParseDuration(strings.TrimSpace(timeoutStr))
+		if err != nil || d <= 0 {
+			return 0, errors.Errorf("bad %s %s", option, timeoutStr)
+		}
+		timeout = d
+	}
+	return timeout, nil
+}
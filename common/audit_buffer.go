@@ -0,0 +1,370 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	auditCurrentSegment = "current.jsonl"
+	auditSegmentPrefix  = "segment-"
+	auditSegmentSuffix  = ".jsonl"
+	auditMaxRetry       = time.Minute
+	auditQueueSize      = 1024 //auditQueueSize is how many records may wait to be written to disk before they're dropped.
+)
+
+//AuditBuffer queues audit records on disk in front of a sink, so they survive sink outages and restarts without blocking checks.
+//Records are appended to segment files of up to batchSize records, which are written to the sink in order and only removed once it stored them,
+//so every record is written at least once. Records are dropped, counted and logged only when the queue or the buffer's maximum size are full.
+type AuditBuffer struct {
+	sink      AuditSink
+	dir       string
+	maxBytes  int64
+	batchSize int
+	interval  time.Duration
+
+	records chan AuditRecord
+	flushes chan struct{}
+	stop    chan struct{}
+	done    sync.WaitGroup
+
+	seq     int64
+	size    int64
+	dropped int64
+	failed  int64
+}
+
+//NewAuditBuffer returns a buffer in dir for the sink, holding up to maxBytes and writing batches of batchSize records every interval,
+//or sooner when a batch is full. Segments left in dir, e.g. by a previous run, are written first.
+func NewAuditBuffer(sink AuditSink, dir string, maxBytes int64, batchSize int, interval time.Duration) (*AuditBuffer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Errorf("couldn't create audit buffer dir %s: %s", dir, err)
+	}
+
+	b := &AuditBuffer{
+		sink:      sink,
+		dir:       dir,
+		maxBytes:  maxBytes,
+		batchSize: batchSize,
+		interval:  interval,
+		records:   make(chan AuditRecord, auditQueueSize),
+		flushes:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+
+	segments, err := b.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		b.seq = segmentSeq(segment) + 1
+		if info, err := os.Stat(segment); err == nil {
+			b.size += info.Size()
+		}
+	}
+
+	//A segment left being written by a crash is queued as any other.
+	current := filepath.Join(dir, auditCurrentSegment)
+	if info, err := os.Stat(current); err == nil {
+		if err := os.Rename(current, b.segmentPath(b.seq)); err != nil {
+			return nil, errors.Errorf("couldn't queue audit segment %s: %s", current, err)
+		}
+		b.seq++
+		b.size += info.Size()
+	}
+
+	b.done.Add(2)
+	go b.write()
+	go b.flush()
+
+	return b, nil
+}
+
+//Add queues an event with its fields without blocking, returning false if it was dropped because the queue is full.
+func (b *AuditBuffer) Add(event string, fields map[string]interface{}) bool {
+	if b == nil {
+		return true
+	}
+
+	record := AuditRecord{Time: time.Now(), Event: event, Fields: make(map[string]interface{}, len(fields))}
+	for k, v := range fields {
+		record.Fields[k] = v
+	}
+
+	select {
+	case b.records <- record:
+		return true
+	default:
+		atomic.AddInt64(&b.dropped, 1)
+		return false
+	}
+}
+
+//Pending returns the bytes of records waiting to be written to the sink.
+func (b *AuditBuffer) Pending() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.size)
+}
+
+//Dropped returns how many records were dropped since the buffer was created.
+func (b *AuditBuffer) Dropped() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.dropped)
+}
+
+//Failed returns how many writes to the sink failed since the buffer was created.
+func (b *AuditBuffer) Failed() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.failed)
+}
+
+//Close stops the buffer, writing queued records to disk and trying once more to write them to the sink before closing it.
+//Records the sink doesn't store are kept in the buffer's dir for the next run.
+func (b *AuditBuffer) Close() {
+	if b == nil {
+		return
+	}
+
+	close(b.stop)
+	b.done.Wait()
+
+	if err := b.flushSegments(); err != nil {
+		log.Warnf("couldn't write audit records on close, they're kept in %s: %s", b.dir, err)
+	}
+	if err := b.sink.Close(); err != nil {
+		log.Warnf("couldn't close audit sink: %s", err)
+	}
+}
+
+//write appends queued records to the current segment, closing it when it has batchSize records or every interval.
+func (b *AuditBuffer) write() {
+	defer b.done.Done()
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	current := filepath.Join(b.dir, auditCurrentSegment)
+	var file *os.File
+	var count int
+	var full bool
+
+	rotate := func() {
+		if file == nil {
+			return
+		}
+		file.Close()
+		file = nil
+		count = 0
+		if err := os.Rename(current, b.segmentPath(b.seq)); err != nil {
+			log.Errorf("couldn't queue audit segment: %s", err)
+			return
+		}
+		b.seq++
+		select {
+		case b.flushes <- struct{}{}:
+		default:
+		}
+	}
+
+	add := func(record AuditRecord) {
+		line, err := json.Marshal(record)
+		if err != nil {
+			log.Errorf("couldn't encode audit event %s, dropping it: %s", record.Event, err)
+			atomic.AddInt64(&b.dropped, 1)
+			return
+		}
+		line = append(line, '\n')
+
+		if atomic.LoadInt64(&b.size)+int64(len(line)) > b.maxBytes {
+			if !full {
+				log.Errorf("audit buffer is full with %d bytes, dropping events until the sink catches up", atomic.LoadInt64(&b.size))
+				full = true
+			}
+			atomic.AddInt64(&b.dropped, 1)
+			return
+		}
+		full = false
+
+		if file == nil {
+			file, err = os.OpenFile(current, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+			if err != nil {
+				log.Errorf("couldn't open audit segment, dropping event %s: %s", record.Event, err)
+				atomic.AddInt64(&b.dropped, 1)
+				return
+			}
+		}
+		if _, err := file.Write(line); err != nil {
+			log.Errorf("couldn't write audit segment, dropping event %s: %s", record.Event, err)
+			atomic.AddInt64(&b.dropped, 1)
+			return
+		}
+		atomic.AddInt64(&b.size, int64(len(line)))
+
+		count++
+		if count >= b.batchSize {
+			rotate()
+		}
+	}
+
+	for {
+		select {
+		case record := <-b.records:
+			add(record)
+		case <-ticker.C:
+			rotate()
+		case <-b.stop:
+			for {
+				select {
+				case record := <-b.records:
+					add(record)
+				default:
+					rotate()
+					return
+				}
+			}
+		}
+	}
+}
+
+//flush writes segments to the sink when told or every interval, backing off while the sink fails.
+func (b *AuditBuffer) flush() {
+	defer b.done.Done()
+
+	wait := b.interval
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-b.flushes:
+		case <-timer.C:
+		}
+
+		if err := b.flushSegments(); err != nil {
+			atomic.AddInt64(&b.failed, 1)
+			wait *= 2
+			if wait > auditMaxRetry {
+				wait = auditMaxRetry
+			}
+			log.Warnf("couldn't write audit records, retrying in %s: %s", wait, err)
+		} else {
+			wait = b.interval
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+//flushSegments writes every segment to the sink in order, removing each once stored and stopping at the first failure.
+func (b *AuditBuffer) flushSegments() error {
+	segments, err := b.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		info, err := os.Stat(segment)
+		if err != nil {
+			return errors.Errorf("couldn't stat audit segment %s: %s", segment, err)
+		}
+
+		records, err := readAuditSegment(segment)
+		if err != nil {
+			return err
+		}
+
+		if len(records) > 0 {
+			if err := b.sink.Write(records); err != nil {
+				return err
+			}
+		}
+
+		if err := os.Remove(segment); err != nil {
+			return errors.Errorf("couldn't remove audit segment %s: %s", segment, err)
+		}
+		atomic.AddInt64(&b.size, -info.Size())
+	}
+
+	return nil
+}
+
+//segments returns the paths of queued segments, oldest first.
+func (b *AuditBuffer) segments() ([]string, error) {
+	files, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read audit buffer dir %s: %s", b.dir, err)
+	}
+
+	var segments []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), auditSegmentPrefix) && strings.HasSuffix(file.Name(), auditSegmentSuffix) {
+			segments = append(segments, filepath.Join(b.dir, file.Name()))
+		}
+	}
+	//Sequence numbers are zero padded, so names sort in order.
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func (b *AuditBuffer) segmentPath(seq int64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%s%020d%s", auditSegmentPrefix, seq, auditSegmentSuffix))
+}
+
+//segmentSeq returns the sequence number of a segment given its path.
+func segmentSeq(segment string) int64 {
+	var seq int64
+	fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(segment), auditSegmentPrefix), auditSegmentSuffix), "%d", &seq)
+	return seq
+}
+
+//readAuditSegment reads the records in a segment. Lines that can't be decoded, such as one cut by a crash, are skipped and logged.
+func readAuditSegment(segment string) ([]AuditRecord, error) {
+	file, err := os.Open(segment)
+	if err != nil {
+		return nil, errors.Errorf("couldn't open audit segment %s: %s", segment, err)
+	}
+	defer file.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Errorf("skipping bad audit record in %s: %s", segment, err)
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Errorf("couldn't read audit segment %s: %s", segment, err)
+	}
+
+	return records, nil
+}
@@ -0,0 +1,239 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//memoryAuditSink keeps written records in memory, failing while down, for testing purposes only.
+type memoryAuditSink struct {
+	sync.Mutex
+	down    bool
+	records []AuditRecord
+}
+
+func (s *memoryAuditSink) Write(records []AuditRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.down {
+		return errors.New("sink down")
+	}
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *memoryAuditSink) Close() error {
+	return nil
+}
+
+func (s *memoryAuditSink) setDown(down bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.down = down
+}
+
+func (s *memoryAuditSink) events() []string {
+	s.Lock()
+	defer s.Unlock()
+	var events []string
+	for _, record := range s.records {
+		events = append(events, record.Event)
+	}
+	return events
+}
+
+func TestAuditBuffer(t *testing.T) {
+
+	Convey("Given a working sink, records should be written in order", t, func() {
+		dir, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(dir)
+
+		sink := &memoryAuditSink{}
+		buffer, err := NewAuditBuffer(sink, dir, 1<<20, 2, 10*time.Millisecond)
+		So(err, ShouldBeNil)
+
+		So(buffer.Add("first", map[string]interface{}{"username": "test"}), ShouldBeTrue)
+		buffer.Add("second", nil)
+		buffer.Add("third", nil)
+
+		So(waitFor(func() bool { return len(sink.events()) == 3 }), ShouldBeTrue)
+		So(sink.events(), ShouldResemble, []string{"first", "second", "third"})
+		So(sink.records[0].Fields["username"], ShouldEqual, "test")
+
+		buffer.Close()
+		So(buffer.Pending(), ShouldEqual, 0)
+	})
+
+	Convey("Given a failing sink, records should be kept until it recovers", t, func() {
+		dir, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(dir)
+
+		sink := &memoryAuditSink{down: true}
+		buffer, err := NewAuditBuffer(sink, dir, 1<<20, 10, 10*time.Millisecond)
+		So(err, ShouldBeNil)
+
+		buffer.Add("kept", nil)
+		So(waitFor(func() bool { return buffer.Failed() > 0 }), ShouldBeTrue)
+		So(buffer.Pending(), ShouldBeGreaterThan, 0)
+		So(sink.events(), ShouldBeEmpty)
+
+		sink.setDown(false)
+		So(waitFor(func() bool { return len(sink.events()) == 1 }), ShouldBeTrue)
+		buffer.Close()
+	})
+
+	Convey("Given records left by a previous run, they should be written on start", t, func() {
+		dir, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(dir)
+
+		sink := &memoryAuditSink{down: true}
+		buffer, err := NewAuditBuffer(sink, dir, 1<<20, 10, time.Hour)
+		So(err, ShouldBeNil)
+		buffer.Add("survivor", nil)
+		buffer.Close()
+		So(sink.events(), ShouldBeEmpty)
+
+		sink = &memoryAuditSink{}
+		buffer, err = NewAuditBuffer(sink, dir, 1<<20, 10, 10*time.Millisecond)
+		So(err, ShouldBeNil)
+		So(buffer.Pending(), ShouldBeGreaterThan, 0)
+		So(waitFor(func() bool { return len(sink.events()) == 1 }), ShouldBeTrue)
+		So(sink.events(), ShouldResemble, []string{"survivor"})
+		buffer.Close()
+	})
+
+	Convey("Given a full buffer, records should be dropped and counted", t, func() {
+		dir, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(dir)
+
+		sink := &memoryAuditSink{down: true}
+		buffer, err := NewAuditBuffer(sink, dir, 100, 10, time.Hour)
+		So(err, ShouldBeNil)
+
+		for i := 0; i < 5; i++ {
+			buffer.Add("event", nil)
+		}
+		So(waitFor(func() bool { return buffer.Dropped() > 0 }), ShouldBeTrue)
+		So(buffer.Pending(), ShouldBeLessThanOrEqualTo, 100)
+		buffer.Close()
+	})
+
+	Convey("Given no buffer, adding records should do nothing", t, func() {
+		var buffer *AuditBuffer
+		So(buffer.Add("event", nil), ShouldBeTrue)
+		So(buffer.Pending(), ShouldEqual, 0)
+		buffer.Close()
+	})
+}
+
+func TestAuditSinks(t *testing.T) {
+
+	Convey("Given built in sinks, they should be registered, and others may be", t, func() {
+		So(AuditSinks(), ShouldResemble, []string{"db", "file", "kafka", "webhook"})
+
+		So(RegisterAuditSink("memory", func(map[string]string) (AuditSink, error) { return &memoryAuditSink{}, nil }), ShouldBeNil)
+		So(RegisterAuditSink("memory", func(map[string]string) (AuditSink, error) { return &memoryAuditSink{}, nil }), ShouldNotBeNil)
+		So(RegisterAuditSink("", nil), ShouldNotBeNil)
+
+		sink, err := NewAuditSink("memory", nil)
+		So(err, ShouldBeNil)
+		So(sink, ShouldNotBeNil)
+
+		_, err = NewAuditSink("unknown", nil)
+		So(err, ShouldNotBeNil)
+	})
+
+	records := []AuditRecord{{Time: time.Now(), Event: "auth_locked_out", Fields: map[string]interface{}{"username": "test"}}}
+
+	Convey("Given a file sink, records should be appended as json lines", t, func() {
+		dir, _ := ioutil.TempDir("", "audit")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "audit.log")
+
+		_, err := NewAuditSink("file", map[string]string{})
+		So(err, ShouldNotBeNil)
+
+		sink, err := NewAuditSink("file", map[string]string{"audit_file_path": path})
+		So(err, ShouldBeNil)
+		So(sink.Write(records), ShouldBeNil)
+		So(sink.Write(records), ShouldBeNil)
+		So(sink.Close(), ShouldBeNil)
+
+		file, _ := os.Open(path)
+		defer file.Close()
+		lines := 0
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record AuditRecord
+			So(json.Unmarshal(scanner.Bytes(), &record), ShouldBeNil)
+			So(record.Event, ShouldEqual, "auth_locked_out")
+			lines++
+		}
+		So(lines, ShouldEqual, 2)
+	})
+
+	Convey("Given webhook and kafka sinks, records should be posted and failures reported", t, func() {
+		var body map[string][]map[string]interface{}
+		var webhook []AuditRecord
+		status := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, _ := ioutil.ReadAll(r.Body)
+			switch {
+			case r.URL.Path == "/topics/audit" && r.Header.Get("Content-Type") == "application/vnd.kafka.json.v2+json":
+				json.Unmarshal(data, &body)
+			case r.URL.Path == "/audit" && r.Header.Get("Authorization") == "Bearer token":
+				json.Unmarshal(data, &webhook)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		sink, err := NewAuditSink("webhook", map[string]string{"audit_webhook_url": server.URL + "/audit", "audit_webhook_token": "token"})
+		So(err, ShouldBeNil)
+		So(sink.Write(records), ShouldBeNil)
+		So(webhook, ShouldHaveLength, 1)
+		So(webhook[0].Event, ShouldEqual, "auth_locked_out")
+
+		sink, err = NewAuditSink("kafka", map[string]string{"audit_kafka_rest_url": server.URL + "/", "audit_kafka_topic": "audit"})
+		So(err, ShouldBeNil)
+		So(sink.Write(records), ShouldBeNil)
+		So(body["records"], ShouldHaveLength, 1)
+		So(body["records"][0]["key"], ShouldEqual, "auth_locked_out")
+
+		status = http.StatusServiceUnavailable
+		So(sink.Write(records), ShouldNotBeNil)
+
+		_, err = NewAuditSink("kafka", map[string]string{"audit_kafka_rest_url": server.URL})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a db sink, bad table names should be rejected", t, func() {
+		_, err := NewAuditSink("db", map[string]string{"audit_db_driver": "postgres", "audit_db_dsn": "dbname=audit", "audit_db_table": "audit; drop table users"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+//waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+//maskedValue replaces secrets in the banner.
+const maskedValue = "********"
+
+//Option sources, telling which of the plugin's config sources set an option.
+const (
+	SourceMosquitto  = "mosquitto"
+	SourceConfigFile = "config_file"
+)
+
+//secretOptionWords mark options holding secrets, unless they end with one of secretOptionExceptions, e.g. pg_password but not password_path.
+var secretOptionWords = []string{"password", "secret", "token", "auth_header"}
+
+var secretOptionExceptions = []string{"_file", "_path", "_name", "_mode", "query", "_acls", "_age", "_fallback", "_passwords", "_field"}
+
+//urlUserinfo matches passwords in URLs, and dsnPassword and dsnUserinfo in key=value and user:password@ DSNs.
+var urlUserinfo = regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://[^:/@\s]*):[^@/\s]*@`)
+var dsnPassword = regexp.MustCompile(`(?i)(password=)[^\s;&]*`)
+var dsnUserinfo = regexp.MustCompile(`^([^:/@\s]+):[^@\s]*@`)
+
+//Banner summarizes the plugin's effective configuration on startup: every option with its source, masking secrets, and what they amount to.
+type Banner struct {
+	Time     time.Time              `json:"time"`
+	Backends []string               `json:"backends"`
+	Cache    map[string]interface{} `json:"cache"`
+	Policies map[string]interface{} `json:"policies"`
+	Options  []BannerOption         `json:"options"`
+}
+
+//BannerOption is an option's effective value, masked if it's a secret, and the source that set it.
+type BannerOption struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+//NewBanner returns a banner for the given options and their sources, which default to mosquitto, with options sorted by name.
+func NewBanner(backends []string, opts map[string]string, sources map[string]string) *Banner {
+	banner := &Banner{
+		Time:     time.Now(),
+		Backends: backends,
+		Cache:    make(map[string]interface{}),
+		Policies: make(map[string]interface{}),
+	}
+
+	for name, value := range opts {
+		source, ok := sources[name]
+		if !ok {
+			source = SourceMosquitto
+		}
+		banner.Options = append(banner.Options, BannerOption{Name: name, Value: MaskOption(name, value), Source: source})
+	}
+	sort.Slice(banner.Options, func(i, j int) bool { return banner.Options[i].Name < banner.Options[j].Name })
+
+	return banner
+}
+
+//IsSecretOption tells if an option holds a secret by its name.
+func IsSecretOption(name string) bool {
+	for _, exception := range secretOptionExceptions {
+		if strings.HasSuffix(name, exception) {
+			return false
+		}
+	}
+	for _, word := range secretOptionWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+//MaskOption returns an option's value with secrets masked: the whole value of secret options, and passwords in DSNs and URLs.
+func MaskOption(name, value string) string {
+	if IsSecretOption(name) {
+		if value == "" {
+			return ""
+		}
+		return maskedValue
+	}
+
+	value = urlUserinfo.ReplaceAllString(value, "${1}:"+maskedValue+"@")
+	if strings.HasSuffix(name, "_dsn") {
+		value = dsnUserinfo.ReplaceAllString(value, "${1}:"+maskedValue+"@")
+	}
+	return dsnPassword.ReplaceAllString(value, "${1}"+maskedValue)
+}
+
+//Log logs the banner's summary, then every option along with its source.
+func (b *Banner) Log() {
+	log.WithFields(log.Fields{
+		"backends": strings.Join(b.Backends, ","),
+		"cache":    formatBannerMap(b.Cache),
+		"policies": formatBannerMap(b.Policies),
+		"options":  len(b.Options),
+	}).Info("effective configuration")
+
+	for _, option := range b.Options {
+		log.WithFields(log.Fields{"option": option.Name, "value": option.Value, "source": option.Source}).Info("effective option")
+	}
+}
+
+//WriteFile writes the banner as json to path, readable by its owner only as values may reveal hosts and paths.
+func (b *Banner) WriteFile(path string) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return errors.Errorf("couldn't encode banner: %s", err)
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return errors.Errorf("couldn't write banner file %s: %s", path, err)
+	}
+	return nil
+}
+
+//formatBannerMap formats a map as sorted key=value pairs.
+func formatBannerMap(m map[string]interface{}) string {
+	pairs := make([]string, 0, len(m))
+	for k, v := range m {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
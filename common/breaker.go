@@ -0,0 +1,97 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+//Breaker states.
+const (
+	BreakerClosed   = "closed"    //Calls are made as usual.
+	BreakerOpen     = "open"      //Calls are skipped.
+	BreakerHalfOpen = "half_open" //A single probe call is made, and others skipped until its outcome is known.
+)
+
+//Breaker is a circuit breaker for a backend: it opens after consecutive failed calls, so calls are skipped instead of waiting on a backend that's down,
+//and after being open for a while lets a probe call through, closing again if it succeeds or reopening if it fails.
+type Breaker struct {
+	sync.Mutex
+	failures int
+	openFor  time.Duration
+	state    string
+	failed   int
+	since    time.Time
+}
+
+//NewBreaker returns a closed breaker that opens after the given consecutive failures, and stays open for openFor before probing.
+func NewBreaker(failures int, openFor time.Duration) *Breaker {
+	return &Breaker{
+		failures: failures,
+		openFor:  openFor,
+		state:    BreakerClosed,
+	}
+}
+
+//Allow tells if a call may be made at now. Once open for openFor, a probe is allowed and the breaker goes half open.
+//A probe whose outcome isn't recorded within openFor is given up, and another one allowed.
+func (b *Breaker) Allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == BreakerClosed {
+		return true
+	}
+	if now.Sub(b.since) < b.openFor {
+		return false
+	}
+
+	b.state = BreakerHalfOpen
+	b.since = now
+	return true
+}
+
+//Record records whether an allowed call made at now failed, returning the breaker's state and whether it changed.
+func (b *Breaker) Record(failed bool, now time.Time) (string, bool) {
+	if b == nil {
+		return BreakerClosed, false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	previous := b.state
+	if !failed {
+		b.failed = 0
+		b.state = BreakerClosed
+		return b.state, b.state != previous
+	}
+
+	b.failed++
+	if b.state == BreakerHalfOpen || b.failed >= b.failures {
+		b.state = BreakerOpen
+		b.since = now
+	}
+	return b.state, b.state != previous
+}
+
+//State returns the breaker's state.
+func (b *Breaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return b.state
+}
+
+//SkippedGrant tells if a call of the given check kind skipped by an open breaker is granted. Only acl calls are, and only when failing open,
+//as granting user or superuser calls would let any password in and make every client a superuser during the outage.
+func SkippedGrant(check string, failOpen bool) bool {
+	return failOpen && check == CheckAcl
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBreaker(t *testing.T) {
+
+	Convey("Given consecutive failures, the breaker should open", t, func() {
+		b := NewBreaker(3, time.Minute)
+		now := time.Now()
+
+		So(b.Allow(now), ShouldBeTrue)
+		b.Record(true, now)
+		b.Record(true, now)
+		b.Record(false, now)
+		b.Record(true, now)
+		state, changed := b.Record(true, now)
+		So(state, ShouldEqual, BreakerClosed)
+		So(changed, ShouldBeFalse)
+
+		state, changed = b.Record(true, now)
+		So(state, ShouldEqual, BreakerOpen)
+		So(changed, ShouldBeTrue)
+		So(b.Allow(now.Add(30*time.Second)), ShouldBeFalse)
+	})
+
+	Convey("Given an open breaker, a single probe should be allowed after it's been open for a while", t, func() {
+		b := NewBreaker(1, time.Minute)
+		now := time.Now()
+		b.Record(true, now)
+
+		probe := now.Add(time.Minute)
+		So(b.Allow(probe), ShouldBeTrue)
+		So(b.State(), ShouldEqual, BreakerHalfOpen)
+		So(b.Allow(probe.Add(time.Second)), ShouldBeFalse)
+
+		Convey("A failed probe should open it again", func() {
+			state, changed := b.Record(true, probe.Add(time.Second))
+			So(state, ShouldEqual, BreakerOpen)
+			So(changed, ShouldBeTrue)
+			So(b.Allow(probe.Add(30*time.Second)), ShouldBeFalse)
+			So(b.Allow(probe.Add(time.Minute+time.Second)), ShouldBeTrue)
+		})
+
+		Convey("A successful probe should close it", func() {
+			state, changed := b.Record(false, probe.Add(time.Second))
+			So(state, ShouldEqual, BreakerClosed)
+			So(changed, ShouldBeTrue)
+			So(b.Allow(probe.Add(time.Second)), ShouldBeTrue)
+		})
+
+		Convey("A probe that never ends should be given up", func() {
+			So(b.Allow(probe.Add(time.Minute)), ShouldBeTrue)
+		})
+	})
+
+	Convey("Given no breaker, every call should be allowed", t, func() {
+		var b *Breaker
+		So(b.Allow(time.Now()), ShouldBeTrue)
+		So(b.State(), ShouldEqual, BreakerClosed)
+	})
+}
+
+func TestSkippedGrant(t *testing.T) {
+
+	Convey("Given an open breaker failing open, only acl calls should be granted", t, func() {
+		So(SkippedGrant(CheckAcl, true), ShouldBeTrue)
+		So(SkippedGrant(CheckUser, true), ShouldBeFalse)
+		So(SkippedGrant(CheckSuperuser, true), ShouldBeFalse)
+		So(SkippedGrant(CheckShadow, true), ShouldBeFalse)
+	})
+
+	Convey("Given an open breaker failing closed, no call should be granted", t, func() {
+		for _, kind := range CheckKinds {
+			So(SkippedGrant(kind, false), ShouldBeFalse)
+		}
+	})
+
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//Bypass recognizes bridges and internal clients by username and clientid patterns, and checks them against a local password file and topics allow-list only, so they don't depend on backends being reachable.
+//Patterns are shell globs as matched by path.Match. When both username and clientid patterns are given, clients must match both.
+type Bypass struct {
+	usernames []string
+	clientids []string
+	topics    []string
+	passwords map[string]string
+}
+
+//NewBypass returns a bypass for the given patterns and allowed topics, with passwords read from passwordFile if not empty.
+//Topics may have wildcards, and %u and %c are replaced by the username and clientid.
+func NewBypass(usernames, clientids, topics []string, passwordFile string) (*Bypass, error) {
+	if len(usernames) == 0 && len(clientids) == 0 {
+		return nil, errors.New("no bypass usernames nor clientids given")
+	}
+
+	for _, pattern := range append(append([]string{}, usernames...), clientids...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("bad bypass pattern %s: %s", pattern, err)
+		}
+	}
+
+	b := &Bypass{
+		usernames: usernames,
+		clientids: clientids,
+		topics:    topics,
+	}
+
+	if passwordFile != "" {
+		passwords, err := readBypassPasswords(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		b.passwords = passwords
+	}
+
+	return b, nil
+}
+
+//readBypassPasswords reads username:hash lines, ignoring empty ones and those starting with #.
+func readBypassPasswords(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Errorf("couldn't open bypass password file %s: %s", file, err)
+	}
+	defer f.Close()
+
+	passwords := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, errors.Errorf("bad line in bypass password file %s: expected username:hash", file)
+		}
+		passwords[line[:i]] = line[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Errorf("couldn't read bypass password file %s: %s", file, err)
+	}
+
+	return passwords, nil
+}
+
+//Matches checks if the client is bypassed.
+func (b *Bypass) Matches(username, clientid string) bool {
+	if b == nil {
+		return false
+	}
+	if len(b.usernames) > 0 && !matchAny(b.usernames, username) {
+		return false
+	}
+	if len(b.clientids) > 0 && !matchAny(b.clientids, clientid) {
+		return false
+	}
+	return true
+}
+
+//ChecksAuth tells if bypassed clients are authenticated by the bypass, which needs a password file. Otherwise they're authenticated by backends.
+func (b *Bypass) ChecksAuth() bool {
+	return b != nil && b.passwords != nil
+}
+
+//CheckAuth checks the password against the username's hash in the password file.
+func (b *Bypass) CheckAuth(username, password string) bool {
+	hash, ok := b.passwords[username]
+	return ok && HashCompare(password, hash)
+}
+
+//CheckAcl checks if topic is matched by any allowed topic.
+func (b *Bypass) CheckAcl(username, clientid, topic string) bool {
+	for _, allowed := range b.topics {
+		allowed, ok := ExpandAclTopic(allowed, username, clientid)
+		if ok && TopicsMatch(allowed, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package common
+
+import "time"
+
+//CheckBudget is the time a single check may take, shared among the backend calls it makes.
+//Its zero value has no deadline, leaving calls to their own timeouts.
+type CheckBudget struct {
+	Deadline time.Time
+}
+
+//NewCheckBudget returns the budget of a check that started at start, which has no deadline if budget isn't positive.
+func NewCheckBudget(start time.Time, budget time.Duration) CheckBudget {
+	if budget <= 0 {
+		return CheckBudget{}
+	}
+	return CheckBudget{Deadline: start.Add(budget)}
+}
+
+//Share returns the time a call made at now may take: the time left divided by the calls left, including this one.
+//It returns false when there's no deadline, and a share that isn't positive when the budget is exhausted.
+func (b CheckBudget) Share(now time.Time, callsLeft int) (time.Duration, bool) {
+	if b.Deadline.IsZero() {
+		return 0, false
+	}
+	if callsLeft < 1 {
+		callsLeft = 1
+	}
+	return b.Deadline.Sub(now) / time.Duration(callsLeft), true
+}
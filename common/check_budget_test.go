@@ -0,0 +1,42 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCheckBudget(t *testing.T) {
+
+	start := time.Now()
+
+	Convey("Given no budget, calls should have no share", t, func() {
+		budget := NewCheckBudget(start, 0)
+		_, ok := budget.Share(start, 2)
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given a budget, the time left should be shared among the calls left", t, func() {
+		budget := NewCheckBudget(start, time.Second)
+
+		share, ok := budget.Share(start, 4)
+		So(ok, ShouldBeTrue)
+		So(share, ShouldEqual, 250*time.Millisecond)
+
+		//A call taking less than its share leaves more for the next ones.
+		share, _ = budget.Share(start.Add(100*time.Millisecond), 3)
+		So(share, ShouldEqual, 300*time.Millisecond)
+
+		share, _ = budget.Share(start.Add(500*time.Millisecond), 0)
+		So(share, ShouldEqual, 500*time.Millisecond)
+	})
+
+	Convey("Given an exhausted budget, shares shouldn't be positive", t, func() {
+		budget := NewCheckBudget(start, time.Second)
+		share, ok := budget.Share(start.Add(2*time.Second), 1)
+		So(ok, ShouldBeTrue)
+		So(share, ShouldBeLessThanOrEqualTo, 0)
+	})
+
+}
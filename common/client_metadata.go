@@ -0,0 +1,51 @@
+package common
+
+import (
+	"net/url"
+	"strconv"
+)
+
+//ClientMetadata is what mosquitto tells about the client being checked besides its username and clientid, kept by the check so remote backends may send it along.
+//Fields mosquitto doesn't give, depending on its version and the client's connection, are left empty.
+type ClientMetadata struct {
+	Address         string
+	CleanSession    *bool
+	ProtocolVersion int    //ProtocolVersion is the MQTT protocol level: 3 for 3.1, 4 for 3.1.1 and 5 for 5.0.
+	CertSubject     string //CertSubject is the subject of the certificate the client connected with over TLS.
+	Certificate     []byte //Certificate is the DER encoded certificate the client connected with, used for revocation checks and not sent to backends.
+	Socket          *int   //Socket is the file descriptor of the client's connection in the broker's process, used by the peercred backend and not sent to backends.
+}
+
+//Params returns the known fields as clean_session, protocol_version, address and cert_subject, to be added to json payloads.
+func (m ClientMetadata) Params() map[string]interface{} {
+	params := make(map[string]interface{})
+	if m.CleanSession != nil {
+		params["clean_session"] = *m.CleanSession
+	}
+	if m.ProtocolVersion > 0 {
+		params["protocol_version"] = m.ProtocolVersion
+	}
+	if m.Address != "" {
+		params["address"] = m.Address
+	}
+	if m.CertSubject != "" {
+		params["cert_subject"] = m.CertSubject
+	}
+	return params
+}
+
+//Values returns the known fields as Params does, formatted as form values.
+func (m ClientMetadata) Values() url.Values {
+	values := url.Values{}
+	for k, v := range m.Params() {
+		switch v := v.(type) {
+		case bool:
+			values.Set(k, strconv.FormatBool(v))
+		case int:
+			values.Set(k, strconv.Itoa(v))
+		case string:
+			values.Set(k, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,204 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//ConfigFile describes backends, chaining and cache settings in a structured way, as an alternative to flat auth_opt_* pairs.
+//It's read from yaml or json, which is parsed as yaml, and unknown sections or settings are rejected.
+type ConfigFile struct {
+	Backends []ConfigBackend        `yaml:"backends"`
+	Chain    map[string]interface{} `yaml:"chain"`
+	Cache    map[string]interface{} `yaml:"cache"`
+	Options  map[string]interface{} `yaml:"options"`
+}
+
+//ConfigBackend is a backend, in check order, with its options given without their prefix, e.g. host for postgres' pg_host.
+type ConfigBackend struct {
+	Name    string                 `yaml:"name"`
+	Options map[string]interface{} `yaml:"options"`
+}
+
+//configPrefixes are the option prefixes of backends, files' options having none.
+var configPrefixes = map[string]string{
+	"postgres":      "pg_",
+	"mysql":         "mysql_",
+	"mssql":         "mssql_",
+	"oracle":        "oracle_",
+	"sqlite":        "sqlite_",
+	"jwt":           "jwt_",
+	"http":          "http_",
+	"redis":         "redis_",
+	"mongo":         "mongo_",
+	"grpc":          "grpc_",
+	"bolt":          "bolt_",
+	"introspection": "introspection_",
+	"oidc":          "oidc_",
+	"keycloak":      "keycloak_",
+	"opa":           "opa_",
+	"javascript":    "js_",
+	"peercred":      "peercred_",
+	"plugin":        "plugin_",
+	"files":         "",
+}
+
+//configChainOptions are the options the chain section may set, which tell how backends are chained.
+var configChainOptions = map[string]bool{
+	"acl_check_order":   true,
+	"check_prefix":      true,
+	"prefixes":          true,
+	"acl_routes":        true,
+	"superuser_backend": true,
+	"shadow_backend":    true,
+	"standby_backends":  true,
+	"sync_backends":     true,
+	"backend_timeouts":  true,
+	"check_budget":      true,
+}
+
+//configCacheOptions are the options set by the cache section's settings.
+var configCacheOptions = map[string]string{
+	"enabled":      "cache",
+	"host":         "cache_host",
+	"port":         "cache_port",
+	"password":     "cache_password",
+	"db":           "cache_db",
+	"reset":        "cache_reset",
+	"auth_seconds": "auth_cache_seconds",
+	"acl_seconds":  "acl_cache_seconds",
+}
+
+//LoadConfigFile reads a config file and returns the flat options it stands for, e.g.:
+//
+//	backends:
+//	  - name: postgres
+//	    options:
+//	      host: localhost
+//	  - name: files
+//	    options:
+//	      password_path: /etc/mosquitto/passwords
+//	chain:
+//	  superuser_backend: files
+//	cache:
+//	  enabled: true
+//	  auth_seconds: 60
+//	options:
+//	  log_level: debug
+//
+//gives backends postgres,files, pg_host, password_path, superuser_backend, cache, auth_cache_seconds and log_level.
+//Lists are joined with commas, so prefixes may be given as [a, b] for a,b.
+func LoadConfigFile(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read config file %s: %s", file, err)
+	}
+
+	var config ConfigFile
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, errors.Errorf("couldn't parse config file %s: %s", file, err)
+	}
+
+	opts, err := config.Flatten()
+	if err != nil {
+		return nil, errors.Errorf("bad config file %s: %s", file, err)
+	}
+
+	return opts, nil
+}
+
+//Flatten validates the config and returns the flat options it stands for.
+func (c ConfigFile) Flatten() (map[string]string, error) {
+	opts := make(map[string]string)
+
+	set := func(option string, value interface{}) error {
+		s, err := configValue(value)
+		if err != nil {
+			return errors.Errorf("%s: %s", option, err)
+		}
+		if _, ok := opts[option]; ok {
+			return errors.Errorf("%s is given more than once", option)
+		}
+		opts[option] = s
+		return nil
+	}
+
+	var names []string
+	for _, backend := range c.Backends {
+		prefix, ok := configPrefixes[backend.Name]
+		if !ok {
+			return nil, errors.Errorf("unknown backend %s", backend.Name)
+		}
+		for _, name := range names {
+			if name == backend.Name {
+				return nil, errors.Errorf("backend %s is given more than once", backend.Name)
+			}
+		}
+		names = append(names, backend.Name)
+
+		for option, value := range backend.Options {
+			if err := set(prefix+option, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(names) > 0 {
+		opts["backends"] = strings.Join(names, ",")
+	}
+
+	for option, value := range c.Chain {
+		if !configChainOptions[option] {
+			return nil, errors.Errorf("unknown chain option %s", option)
+		}
+		if err := set(option, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for setting, value := range c.Cache {
+		option, ok := configCacheOptions[setting]
+		if !ok {
+			return nil, errors.Errorf("unknown cache setting %s", setting)
+		}
+		if err := set(option, value); err != nil {
+			return nil, err
+		}
+	}
+
+	for option, value := range c.Options {
+		if option == "backends" || option == "config_file" {
+			return nil, errors.Errorf("option %s can't be given in the options section", option)
+		}
+		if err := set(option, value); err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
+
+//configValue turns a scalar or a list of scalars into an option value.
+func configValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil || strings.Contains(s, ",") {
+				return "", errors.New("lists may only hold scalars without commas")
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", errors.Errorf("expected a scalar or a list, got %T", value)
+	}
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	Convey("Given a yaml config file, it should give the flat options it stands for", t, func() {
+		file := write("auth.yml", `
+backends:
+  - name: postgres
+    options:
+      host: localhost
+      port: 5432
+  - name: files
+    options:
+      password_path: /etc/mosquitto/passwords
+chain:
+  superuser_backend: files
+  prefixes: [pg, files]
+cache:
+  enabled: true
+  auth_seconds: 60
+options:
+  log_level: debug
+`)
+		opts, err := LoadConfigFile(file)
+		So(err, ShouldBeNil)
+		So(opts, ShouldResemble, map[string]string{
+			"backends":           "postgres,files",
+			"pg_host":            "localhost",
+			"pg_port":            "5432",
+			"password_path":      "/etc/mosquitto/passwords",
+			"superuser_backend":  "files",
+			"prefixes":           "pg,files",
+			"cache":              "true",
+			"auth_cache_seconds": "60",
+			"log_level":          "debug",
+		})
+	})
+
+	Convey("Given a json config file, it should be read as a yaml one", t, func() {
+		file := write("auth.json", `{"backends": [{"name": "jwt", "options": {"remote": true}}], "cache": {"acl_seconds": 10}}`)
+		opts, err := LoadConfigFile(file)
+		So(err, ShouldBeNil)
+		So(opts, ShouldResemble, map[string]string{"backends": "jwt", "jwt_remote": "true", "acl_cache_seconds": "10"})
+	})
+
+	Convey("Given a config file not following the schema, it should fail", t, func() {
+		for _, content := range []string{
+			`unknown: true`,
+			`backends: [{name: unknown}]`,
+			`backends: [{name: files}, {name: files}]`,
+			`backends: [{name: files, host: localhost}]`,
+			`chain: {log_level: debug}`,
+			`cache: {ttl: 10}`,
+			`options: {backends: files}`,
+			`options: {log_level: {level: debug}}`,
+			`backends: [{name: redis, options: {host: localhost}}]
+options: {redis_host: localhost}`,
+		} {
+			_, err := LoadConfigFile(write("bad.yml", content))
+			So(err, ShouldNotBeNil)
+		}
+
+		_, err := LoadConfigFile(filepath.Join(dir, "missing.yml"))
+		So(err, ShouldNotBeNil)
+	})
+
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+)
+
+//ConnectionTracker counts simultaneous connections per username.
+//Mosquitto doesn't tell plugins when clients disconnect, so connections are leases taken on auth and renewed on client activity, freed once they expire.
+type ConnectionTracker interface {
+	//Acquire takes a lease for clientid among username's connections, failing if max leases are already taken by other clientids.
+	Acquire(username, clientid string, max int) bool
+	//Renew extends clientid's lease, if it has one.
+	Renew(username, clientid string)
+}
+
+//LocalConnections tracks connection leases in memory, so limits are enforced per broker process.
+type LocalConnections struct {
+	sync.Mutex
+	lease  time.Duration
+	leases map[string]map[string]time.Time
+}
+
+//NewLocalConnections returns an in memory connection tracker with the given lease duration.
+func NewLocalConnections(lease time.Duration) *LocalConnections {
+	return &LocalConnections{
+		lease:  lease,
+		leases: make(map[string]map[string]time.Time),
+	}
+}
+
+func (c *LocalConnections) Acquire(username, clientid string, max int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	leases, ok := c.leases[username]
+	if !ok {
+		leases = make(map[string]time.Time)
+		c.leases[username] = leases
+	}
+
+	for id, expiry := range leases {
+		if now.After(expiry) {
+			delete(leases, id)
+		}
+	}
+
+	//A client reconnecting with the same clientid takes over its previous connection.
+	if _, ok := leases[clientid]; !ok && len(leases) >= max {
+		return false
+	}
+
+	leases[clientid] = now.Add(c.lease)
+	return true
+}
+
+func (c *LocalConnections) Renew(username, clientid string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if leases, ok := c.leases[username]; ok {
+		if _, ok := leases[clientid]; ok {
+			leases[clientid] = time.Now().Add(c.lease)
+		}
+	}
+}
+
+//acquireScript atomically drops expired leases and takes one for a clientid, which are kept in a sorted set scored by expiry in milliseconds.
+var acquireScript = goredis.NewScript(`
+local now = tonumber(ARGV[1])
+local expiry = tonumber(ARGV[2])
+local max = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZSCORE', KEYS[1], ARGV[4]) or redis.call('ZCARD', KEYS[1]) < max then
+	redis.call('ZADD', KEYS[1], expiry, ARGV[4])
+	redis.call('PEXPIREAT', KEYS[1], expiry)
+	return 1
+end
+return 0
+`)
+
+//RedisConnections tracks connection leases in Redis, so limits are enforced across every broker of a cluster sharing it.
+type RedisConnections struct {
+	sync.Mutex
+	lease   time.Duration
+	prefix  string
+	client  *goredis.Client
+	renewed map[string]time.Time
+}
+
+//NewRedisConnections returns a connection tracker using the given Redis client. Keys are prefixed by prefix.
+func NewRedisConnections(lease time.Duration, client *goredis.Client, prefix string) *RedisConnections {
+	return &RedisConnections{
+		lease:   lease,
+		prefix:  prefix,
+		client:  client,
+		renewed: make(map[string]time.Time),
+	}
+}
+
+//Acquire fails open when Redis can't be reached, as credentials were already checked.
+func (c *RedisConnections) Acquire(username, clientid string, max int) bool {
+	now := time.Now()
+	expiry := now.Add(c.lease)
+	result, err := acquireScript.Run(c.client, []string{c.prefix + username}, millis(now), millis(expiry), max, clientid).Int64()
+	if err != nil {
+		return true
+	}
+
+	c.Lock()
+	c.renewed[clientid] = now
+	c.Unlock()
+
+	return result == 1
+}
+
+//Renew extends the lease at most every third of its duration, sparing a Redis round trip on most client activity.
+func (c *RedisConnections) Renew(username, clientid string) {
+	now := time.Now()
+
+	c.Lock()
+	if now.Sub(c.renewed[clientid]) < c.lease/3 {
+		c.Unlock()
+		return
+	}
+	c.renewed[clientid] = now
+	c.Unlock()
+
+	expiry := now.Add(c.lease)
+	key := c.prefix + username
+	added, err := c.client.ZAddXXCh(key, goredis.Z{Score: float64(millis(expiry)), Member: clientid}).Result()
+	if err == nil && added > 0 {
+		c.client.PExpireAt(key, expiry)
+	}
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/pkg/errors"
+)
+
+//debugVarsName is the name counters are published under at /debug/vars, along with expvar's own cmdline and memstats.
+const debugVarsName = "go_auth"
+
+//DebugVars counts checks and backend failures for the debug listener, so they may be read at /debug/vars without a metrics sink.
+type DebugVars struct {
+	counters *expvar.Map
+}
+
+//NewDebugVars returns counters published at /debug/vars. As expvar publishes once per process, counters are kept across calls.
+func NewDebugVars() *DebugVars {
+	if counters, ok := expvar.Get(debugVarsName).(*expvar.Map); ok {
+		return &DebugVars{counters: counters}
+	}
+	return &DebugVars{counters: expvar.NewMap(debugVarsName)}
+}
+
+//Incr increments the counter with the given name.
+func (d *DebugVars) Incr(name string) {
+	if d == nil {
+		return
+	}
+	d.counters.Add(name, 1)
+}
+
+//CheckLoopback checks address is a host and port on a loopback interface, as the debug listener exposes profiles and the broker's command line.
+func CheckLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return errors.Errorf("%s is not a loopback address", host)
+}
+
+//DebugHandler serves expvar at /debug/vars and pprof profiles at /debug/pprof/, e.g. /debug/pprof/profile for cpu and /debug/pprof/heap for heap ones.
+//Handlers are set on their own mux instead of the default one, so they aren't exposed by other servers in the process.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//DebugFilter holds username and clientid patterns whose checks are logged at debug level regardless of the log level.
+//Patterns are shell globs as matched by path.Match, e.g. sensor-12 or gateway-*.
+type DebugFilter struct {
+	sync.RWMutex
+	usernames []string
+	clientids []string
+	file      string
+	modTime   time.Time
+	fileUsers []string
+	fileIds   []string
+}
+
+//NewDebugFilter returns a filter for the given patterns, plus those read from file if not empty.
+func NewDebugFilter(usernames, clientids []string, file string) (*DebugFilter, error) {
+	for _, pattern := range append(usernames, clientids...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("bad debug pattern %s: %s", pattern, err)
+		}
+	}
+
+	f := &DebugFilter{
+		usernames: usernames,
+		clientids: clientids,
+		file:      file,
+	}
+
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+//Matches checks if username or clientid match any pattern. Empty values never match.
+func (f *DebugFilter) Matches(username, clientid string) bool {
+	if f == nil {
+		return false
+	}
+	f.RLock()
+	defer f.RUnlock()
+	return matchAny(f.usernames, username) || matchAny(f.fileUsers, username) ||
+		matchAny(f.clientids, clientid) || matchAny(f.fileIds, clientid)
+}
+
+func matchAny(patterns []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//Reload reads the patterns file again if it changed since it was last read, returning whether it did.
+//Each line holds a pattern prefixed by username: or clientid:, and lines starting with # are ignored.
+//On error, previous patterns are kept.
+func (f *DebugFilter) Reload() (bool, error) {
+	if f.file == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(f.file)
+	if err != nil {
+		return false, errors.Errorf("couldn't stat debug file %s: %s", f.file, err)
+	}
+
+	f.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	file, err := os.Open(f.file)
+	if err != nil {
+		return false, errors.Errorf("couldn't open debug file %s: %s", f.file, err)
+	}
+	defer file.Close()
+
+	var usernames, clientids []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return false, errors.Errorf("bad debug file line %s, expected username:pattern or clientid:pattern", line)
+		}
+		pattern := strings.TrimSpace(parts[1])
+		if _, err := path.Match(pattern, ""); err != nil {
+			return false, errors.Errorf("bad debug pattern %s: %s", pattern, err)
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "username":
+			usernames = append(usernames, pattern)
+		case "clientid":
+			clientids = append(clientids, pattern)
+		default:
+			return false, errors.Errorf("bad debug file line %s, expected username:pattern or clientid:pattern", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, errors.Errorf("couldn't read debug file %s: %s", f.file, err)
+	}
+
+	f.Lock()
+	f.fileUsers = usernames
+	f.fileIds = clientids
+	f.modTime = info.ModTime()
+	f.Unlock()
+
+	return true, nil
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDebug(t *testing.T) {
+
+	Convey("Given addresses, only loopback ones should be accepted", t, func() {
+		So(CheckLoopback("127.0.0.1:6060"), ShouldBeNil)
+		So(CheckLoopback("[::1]:6060"), ShouldBeNil)
+		So(CheckLoopback("localhost:6060"), ShouldBeNil)
+		So(CheckLoopback("0.0.0.0:6060"), ShouldNotBeNil)
+		So(CheckLoopback(":6060"), ShouldNotBeNil)
+		So(CheckLoopback("192.168.1.10:6060"), ShouldNotBeNil)
+		So(CheckLoopback("127.0.0.1"), ShouldNotBeNil)
+	})
+
+	Convey("Given counters, they should be served at /debug/vars", t, func() {
+		d := NewDebugVars()
+		d.Incr("auth.granted")
+		d.Incr("auth.granted")
+		NewDebugVars().Incr("acl.denied")
+
+		var none *DebugVars
+		none.Incr("auth.granted")
+
+		rec := httptest.NewRecorder()
+		DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+		So(rec.Code, ShouldEqual, http.StatusOK)
+
+		var vars map[string]json.RawMessage
+		So(json.Unmarshal(rec.Body.Bytes(), &vars), ShouldBeNil)
+		So(vars, ShouldContainKey, "memstats")
+
+		var counters map[string]int
+		So(json.Unmarshal(vars["go_auth"], &counters), ShouldBeNil)
+		So(counters["auth.granted"], ShouldEqual, 2)
+		So(counters["acl.denied"], ShouldEqual, 1)
+	})
+
+	Convey("Given the pprof index and a heap profile, they should be served", t, func() {
+		rec := httptest.NewRecorder()
+		DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		So(rec.Code, ShouldEqual, http.StatusOK)
+
+		rec = httptest.NewRecorder()
+		DebugHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/heap", nil))
+		So(rec.Code, ShouldEqual, http.StatusOK)
+		So(rec.Body.Len(), ShouldBeGreaterThan, 0)
+	})
+}
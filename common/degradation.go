@@ -0,0 +1,232 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//Degradation tiers, from the most available to the strictest.
+const (
+	TierCache = "cache" //Cached decisions are still served, while checks the cache can't answer are denied.
+	TierSeen  = "seen"  //Besides, clients that authenticated before are allowed on the topics they were granted before.
+	TierDeny  = "deny"  //Every check is denied, even cached ones, until backends answer again.
+)
+
+//DegradationTier is the tier applied once an outage has lasted After.
+type DegradationTier struct {
+	After time.Duration
+	Tier  string
+}
+
+//Degradation tracks outages of backends, telling the tier to apply as they go on, and remembers the clients and grants seen while backends answered.
+type Degradation struct {
+	sync.Mutex
+	tiers   []DegradationTier
+	start   time.Time
+	tier    string
+	key     []byte
+	maxSeen int
+	users   map[string]string
+	grants  map[string]string
+}
+
+//ParseDegradationTiers parses comma separated after:tier pairs, e.g. 0s:cache, 2m:seen, 30m:deny, sorting them by after.
+func ParseDegradationTiers(tiersStr string) ([]DegradationTier, error) {
+	var tiers []DegradationTier
+	for _, tierStr := range strings.Split(strings.Replace(tiersStr, " ", "", -1), ",") {
+		if tierStr == "" {
+			continue
+		}
+		i := strings.LastIndex(tierStr, ":")
+		if i < 1 {
+			return nil, errors.Errorf("bad degradation tier %s: expected after:tier", tierStr)
+		}
+		after, err := time.ParseDuration(tierStr[:i])
+		if err != nil || after < 0 {
+			return nil, errors.Errorf("bad degradation tier %s: couldn't parse %s", tierStr, tierStr[:i])
+		}
+		tier := tierStr[i+1:]
+		if tier != TierCache && tier != TierSeen && tier != TierDeny {
+			return nil, errors.Errorf("unknown degradation tier %s, expected cache, seen or deny", tier)
+		}
+		tiers = append(tiers, DegradationTier{After: after, Tier: tier})
+	}
+
+	if len(tiers) == 0 {
+		return nil, errors.New("no degradation tiers given")
+	}
+
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i].After < tiers[j].After
+	})
+
+	return tiers, nil
+}
+
+//NewDegradation returns a tracker for the given tiers, remembering up to maxSeen clients and as many grants.
+func NewDegradation(tiers []DegradationTier, maxSeen int) (*Degradation, error) {
+	//Passwords are only remembered as digests keyed by a random key, which never leaves the process.
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Errorf("couldn't create degradation key: %s", err)
+	}
+
+	return &Degradation{
+		tiers:   tiers,
+		key:     key,
+		maxSeen: maxSeen,
+		users:   make(map[string]string),
+		grants:  make(map[string]string),
+	}, nil
+}
+
+//Failed records that backends couldn't answer a check at now, starting an outage if there's none.
+//It returns the tier to apply, empty if none applies yet, and whether it changed since the last failure.
+func (d *Degradation) Failed(now time.Time) (string, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.start.IsZero() {
+		d.start = now
+	}
+
+	tier := d.tierAt(now)
+	changed := tier != d.tier
+	d.tier = tier
+	return tier, changed
+}
+
+//Recovered records that backends answered a check, ending the ongoing outage if any and returning how long it lasted.
+func (d *Degradation) Recovered(now time.Time) (time.Duration, bool) {
+	if d == nil {
+		return 0, false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.start.IsZero() {
+		return 0, false
+	}
+
+	lasted := now.Sub(d.start)
+	d.start = time.Time{}
+	d.tier = ""
+	return lasted, true
+}
+
+//Tier returns the tier of the ongoing outage at now, empty if there's no outage or no tier applies yet.
+func (d *Degradation) Tier(now time.Time) string {
+	if d == nil {
+		return ""
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.start.IsZero() {
+		return ""
+	}
+	return d.tierAt(now)
+}
+
+//tierAt returns the last tier whose after has passed since the outage started.
+func (d *Degradation) tierAt(now time.Time) string {
+	tier := ""
+	for _, t := range d.tiers {
+		if now.Sub(d.start) >= t.After {
+			tier = t.Tier
+		}
+	}
+	return tier
+}
+
+//SeeUser remembers that username authenticated with password.
+func (d *Degradation) SeeUser(username, password string) {
+	if d == nil {
+		return
+	}
+
+	digest := d.digest(username, password)
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.users[username]; !ok {
+		evict(d.users, d.maxSeen)
+	}
+	d.users[username] = string(digest)
+}
+
+//SeenUser checks if username last authenticated with password.
+func (d *Degradation) SeenUser(username, password string) bool {
+	if d == nil {
+		return false
+	}
+
+	digest := d.digest(username, password)
+
+	d.Lock()
+	defer d.Unlock()
+
+	seen, ok := d.users[username]
+	return ok && hmac.Equal([]byte(seen), digest)
+}
+
+//SeeGrant remembers that username was granted acc on topic.
+func (d *Degradation) SeeGrant(username, topic string, acc int) {
+	if d == nil {
+		return
+	}
+
+	key := grantKey(username, topic, acc)
+
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.grants[key]; !ok {
+		evict(d.grants, d.maxSeen)
+	}
+	d.grants[key] = ""
+}
+
+//SeenGrant checks if username was granted acc on topic before.
+func (d *Degradation) SeenGrant(username, topic string, acc int) bool {
+	if d == nil {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	_, ok := d.grants[grantKey(username, topic, acc)]
+	return ok
+}
+
+func (d *Degradation) digest(username, password string) []byte {
+	mac := hmac.New(sha256.New, d.key)
+	mac.Write([]byte(username + "\x00" + password))
+	return mac.Sum(nil)
+}
+
+func grantKey(username, topic string, acc int) string {
+	return username + "\x00" + topic + "\x00" + strconv.Itoa(acc)
+}
+
+//evict makes room for a new entry in a map bounded to max entries by dropping any of them.
+func evict(m map[string]string, max int) {
+	for k := range m {
+		if len(m) < max {
+			return
+		}
+		delete(m, k)
+	}
+}
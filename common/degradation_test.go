@@ -0,0 +1,106 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDegradation(t *testing.T) {
+
+	Convey("Given tiers, they should be parsed and sorted by after", t, func() {
+		tiers, err := ParseDegradationTiers("30m:deny, 0s:cache, 2m:seen")
+		So(err, ShouldBeNil)
+		So(tiers, ShouldResemble, []DegradationTier{
+			{After: 0, Tier: TierCache},
+			{After: 2 * time.Minute, Tier: TierSeen},
+			{After: 30 * time.Minute, Tier: TierDeny},
+		})
+
+		_, err = ParseDegradationTiers("2m:allow")
+		So(err, ShouldNotBeNil)
+		_, err = ParseDegradationTiers("soon:deny")
+		So(err, ShouldNotBeNil)
+		_, err = ParseDegradationTiers("deny")
+		So(err, ShouldNotBeNil)
+		_, err = ParseDegradationTiers(" , ")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given an outage, tiers should apply as it goes on until backends recover", t, func() {
+		tiers, _ := ParseDegradationTiers("1m:cache, 2m:seen, 30m:deny")
+		d, err := NewDegradation(tiers, 10)
+		So(err, ShouldBeNil)
+
+		start := time.Now()
+		So(d.Tier(start), ShouldEqual, "")
+
+		tier, changed := d.Failed(start)
+		So(tier, ShouldEqual, "")
+		So(changed, ShouldBeFalse)
+
+		tier, changed = d.Failed(start.Add(90 * time.Second))
+		So(tier, ShouldEqual, TierCache)
+		So(changed, ShouldBeTrue)
+
+		tier, changed = d.Failed(start.Add(5 * time.Minute))
+		So(tier, ShouldEqual, TierSeen)
+		So(changed, ShouldBeTrue)
+
+		tier, changed = d.Failed(start.Add(6 * time.Minute))
+		So(tier, ShouldEqual, TierSeen)
+		So(changed, ShouldBeFalse)
+
+		So(d.Tier(start.Add(time.Hour)), ShouldEqual, TierDeny)
+
+		lasted, ok := d.Recovered(start.Add(time.Hour))
+		So(ok, ShouldBeTrue)
+		So(lasted, ShouldEqual, time.Hour)
+		So(d.Tier(start.Add(time.Hour)), ShouldEqual, "")
+
+		_, ok = d.Recovered(start.Add(time.Hour))
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given seen clients and grants, only the same ones should be seen", t, func() {
+		tiers, _ := ParseDegradationTiers("0s:seen")
+		d, err := NewDegradation(tiers, 2)
+		So(err, ShouldBeNil)
+
+		d.SeeUser("test", "secret")
+		So(d.SeenUser("test", "secret"), ShouldBeTrue)
+		So(d.SeenUser("test", "other"), ShouldBeFalse)
+		So(d.SeenUser("other", "secret"), ShouldBeFalse)
+
+		d.SeeUser("test", "changed")
+		So(d.SeenUser("test", "secret"), ShouldBeFalse)
+		So(d.SeenUser("test", "changed"), ShouldBeTrue)
+
+		d.SeeGrant("test", "test/topic", 1)
+		So(d.SeenGrant("test", "test/topic", 1), ShouldBeTrue)
+		So(d.SeenGrant("test", "test/topic", 2), ShouldBeFalse)
+		So(d.SeenGrant("test", "test/other", 1), ShouldBeFalse)
+	})
+
+	Convey("Given more seen clients than allowed, they should be bounded", t, func() {
+		tiers, _ := ParseDegradationTiers("0s:seen")
+		d, _ := NewDegradation(tiers, 2)
+
+		d.SeeUser("a", "a")
+		d.SeeUser("b", "b")
+		d.SeeUser("c", "c")
+		So(len(d.users), ShouldEqual, 2)
+		So(d.SeenUser("c", "c"), ShouldBeTrue)
+	})
+
+	Convey("Given no degradation, nothing should be seen nor degraded", t, func() {
+		var d *Degradation
+		d.SeeUser("test", "secret")
+		So(d.SeenUser("test", "secret"), ShouldBeFalse)
+		So(d.SeenGrant("test", "test/topic", 1), ShouldBeFalse)
+		So(d.Tier(time.Now()), ShouldEqual, "")
+		_, ok := d.Recovered(time.Now())
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+//Dialer dials outbound connections from a given local address and/or with a given ip version, for multi-homed hosts where the auth network is segregated.
+type Dialer struct {
+	LocalAddress string
+	IPVersion    string
+	dialer       *net.Dialer
+}
+
+//NewDialer returns a dialer set by the <prefix>_local_address and <prefix>_ip_version options, or the global local_address and ip_version ones.
+//The local address may be an ip or an interface name, in which case its first address of the right version is used. The ip version may be 4, 6 or any.
+//It returns nil when no options are given, so callers keep their default dialing.
+func NewDialer(authOpts map[string]string, prefix string) (*Dialer, error) {
+	localAddress := dialerOption(authOpts, prefix, "local_address")
+	ipVersion := dialerOption(authOpts, prefix, "ip_version")
+
+	if localAddress == "" && (ipVersion == "" || ipVersion == "any") {
+		return nil, nil
+	}
+
+	d := &Dialer{
+		LocalAddress: localAddress,
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+	}
+
+	switch ipVersion {
+	case "", "any":
+	case "4", "6":
+		d.IPVersion = ipVersion
+	default:
+		return nil, errors.Errorf("unknown ip version %s, must be 4, 6 or any", ipVersion)
+	}
+
+	if localAddress != "" {
+		ip, err := localIP(localAddress, d.IPVersion)
+		if err != nil {
+			return nil, err
+		}
+		d.dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		//Dialing from an address restricts the ip version to its own.
+		if d.IPVersion == "" {
+			d.IPVersion = "6"
+			if ip.To4() != nil {
+				d.IPVersion = "4"
+			}
+		}
+	}
+
+	return d, nil
+}
+
+//dialerOption gets a dialer option for prefix, falling back to the global one.
+func dialerOption(authOpts map[string]string, prefix, name string) string {
+	if value, ok := authOpts[prefix+"_"+name]; ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(authOpts[name])
+}
+
+//localIP parses an ip or gets the first address with the given version of the named interface.
+func localIP(address, ipVersion string) (net.IP, error) {
+	if ip := net.ParseIP(address); ip != nil {
+		if (ipVersion == "4" && ip.To4() == nil) || (ipVersion == "6" && ip.To4() != nil) {
+			return nil, errors.Errorf("local address %s is not ipv%s", address, ipVersion)
+		}
+		return ip, nil
+	}
+
+	iface, err := net.InterfaceByName(address)
+	if err != nil {
+		return nil, errors.Errorf("local address %s is neither an ip nor an interface: %s", address, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errors.Errorf("couldn't get addresses of interface %s: %s", address, err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		isV4 := ipNet.IP.To4() != nil
+		if ipVersion == "" || (ipVersion == "4" && isV4) || (ipVersion == "6" && !isV4) {
+			return ipNet.IP, nil
+		}
+	}
+
+	return nil, errors.Errorf("interface %s has no usable address", address)
+}
+
+//network restricts tcp and udp networks to the dialer's ip version.
+func (d *Dialer) network(network string) string {
+	if d.IPVersion != "" && (network == "tcp" || network == "udp") {
+		return network + d.IPVersion
+	}
+	return network
+}
+
+//DialContext dials address from the local address, if any, with the dialer's ip version.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, d.network(network), address)
+}
+
+//Dial dials address from the local address, if any, with the dialer's ip version.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+//DialTimeout is like Dial but fails after timeout. Along with Dial, it implements pq.Dialer.
+func (d *Dialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+//postgresConnector opens postgres connections with a dialer.
+type postgresConnector struct {
+	dialer *Dialer
+	dsn    string
+}
+
+func (c postgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return pq.DialOpen(c.dialer, c.dsn)
+}
+
+func (c postgresConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+//OpenPostgres opens a postgres database like OpenDatabase, dialing connections with dialer if not nil.
+func OpenPostgres(dsn string, dialer *Dialer) (*sqlx.DB, error) {
+	if dialer == nil {
+		return OpenDatabase(dsn, "postgres")
+	}
+
+	db := sqlx.NewDb(sql.OpenDB(postgresConnector{dialer: dialer, dsn: dsn}), "postgres")
+	pingDatabase(db)
+
+	return db, nil
+}
+
+//RedisDialer returns a go-redis dialer for addr, or nil for a nil dialer so go-redis keeps its default one.
+func (d *Dialer) RedisDialer(addr string) func() (net.Conn, error) {
+	if d == nil {
+		return nil
+	}
+	return func() (net.Conn, error) {
+		return d.Dial("tcp", addr)
+	}
+}
+
+//OpenConnector opens a database through connector like OpenDatabase, for drivers configured by more than a dsn.
+//driverName tells sqlx the driver's placeholders.
+func OpenConnector(connector driver.Connector, driverName string) *sqlx.DB {
+	db := sqlx.NewDb(sql.OpenDB(connector), driverName)
+	pingDatabase(db)
+
+	return db
+}
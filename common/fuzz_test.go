@@ -0,0 +1,81 @@
+// +build go1.18
+
+package common
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//Fuzz targets for input parsed on every connection. Seeds, and the corpus at testdata/fuzz, run with the test suite,
+//while fuzzing is done with e.g. go test ./common -run=^$ -fuzz=FuzzTopicsMatch, or make fuzz.
+
+func FuzzTopicsMatch(f *testing.F) {
+	f.Add("test/topic/1", "test/topic/1")
+	f.Add("test/+/1", "test/topic/1")
+	f.Add("test/#", "test/topic/1")
+	f.Add("#", "$SYS/broker/uptime")
+	f.Add("test/+", "test/#")
+	f.Add("test/#/1", "test/topic/1")
+	f.Add("", "")
+	f.Add("test//1", "test/\x00/1")
+
+	f.Fuzz(func(t *testing.T, saved, given string) {
+		defer SetStrictTopicMatching(false)
+
+		for _, strict := range []bool{false, true} {
+			SetStrictTopicMatching(strict)
+			matched := TopicsMatch(saved, given)
+
+			//Topics without wildcards always match themselves, unless invalid when strict.
+			if !strings.ContainsAny(given, "+#") && !TopicsMatch(given, given) && (!strict || validTopic(given)) {
+				t.Errorf("topic %q doesn't match itself (strict = %t)", given, strict)
+			}
+
+			//# matches anything it's lenient about, and any valid topic not starting with $ when strict.
+			if saved == "#" && !matched && (!strict || (validTopic(given) && validFilter(strings.Split(given, "/")) && !strings.HasPrefix(given, "$"))) {
+				t.Errorf("# doesn't match %q (strict = %t)", given, strict)
+			}
+		}
+	})
+}
+
+func FuzzHashCompare(f *testing.F) {
+	f.Add("testpw", "PBKDF2$sha256$1000$c2FsdA==$aGFzaA==")
+	f.Add("testpw", "PBKDF2$md5$-1$$")
+	f.Add("testpw", "SCRAM-SHA-256$100:c2FsdA==$c3RvcmVk:c2VydmVy")
+	f.Add("testpw", "SCRAM-SHA-256$0:$:")
+	f.Add("", "$$$$")
+
+	f.Fuzz(func(t *testing.T, password, passwordHash string) {
+		//Hashes are stored by admins, so only keep their cost low enough to fuzz.
+		if hashIterations(passwordHash) > 1000 {
+			t.Skip()
+		}
+
+		HashCompare(password, passwordHash)
+
+		for _, algorithm := range []string{"sha256", "sha512"} {
+			hash := hashWithSalt(password, []byte(passwordHash), 10, algorithm)
+			if !HashCompare(password, hash) {
+				t.Errorf("password %q doesn't match its own %s hash %s", password, algorithm, hash)
+			}
+			if HashCompare(password+"x", hash) {
+				t.Errorf("password %q matches the %s hash of %q", password+"x", algorithm, password)
+			}
+		}
+	})
+}
+
+//hashIterations returns the iterations of a PBKDF2 or SCRAM hash, or 0 if they can't be parsed.
+func hashIterations(passwordHash string) int {
+	var iterations string
+	if strings.HasPrefix(passwordHash, scramPrefix) {
+		iterations = strings.Split(strings.TrimPrefix(passwordHash, scramPrefix), ":")[0]
+	} else if parts := strings.Split(passwordHash, "$"); len(parts) > 2 {
+		iterations = parts[2]
+	}
+	n, _ := strconv.Atoi(iterations)
+	return n
+}
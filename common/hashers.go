@@ -0,0 +1,129 @@
+package common
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+//Hasher checks passwords against hashes in a given format, so formats besides PBKDF2 and SCRAM-SHA-256 may be added without changing backends.
+type Hasher interface {
+	//Matches checks if passwordHash is in the hasher's format, usually by its prefix.
+	Matches(passwordHash string) bool
+	//Compare checks password against passwordHash, which is in the hasher's format.
+	Compare(password, passwordHash string) bool
+}
+
+//HashValidator is implemented by hashers that may tell if a hash in their format is well formed, besides matching it.
+type HashValidator interface {
+	//Validate checks passwordHash, which is in the hasher's format, may be compared against.
+	Validate(passwordHash string) error
+}
+
+//MaxHashIterations bounds the iterations of built in formats, so a hash can't make every check against it pin a CPU.
+const MaxHashIterations = 1000000
+
+type namedHasher struct {
+	name   string
+	hasher Hasher
+}
+
+var hashersLock sync.RWMutex
+
+//hashers are checked in registration order, built in ones first.
+var hashers = []namedHasher{
+	{name: "pbkdf2", hasher: pbkdf2Hasher{}},
+	{name: "scram-sha-256", hasher: scramHasher{}},
+}
+
+//RegisterHasher adds a hash format checked by HashCompare, and thus by every backend. It may be called from an init func of a fork's package,
+//or from a custom plugin's Init. Names must be unique.
+func RegisterHasher(name string, hasher Hasher) error {
+	if name == "" || hasher == nil {
+		return errors.New("hashers need a name and an implementation")
+	}
+
+	hashersLock.Lock()
+	defer hashersLock.Unlock()
+
+	for _, h := range hashers {
+		if h.name == name {
+			return errors.Errorf("hasher %s is already registered", name)
+		}
+	}
+	hashers = append(hashers, namedHasher{name: name, hasher: hasher})
+	return nil
+}
+
+//Hashers returns the names of registered hashers, in the order they're checked.
+func Hashers() []string {
+	hashersLock.RLock()
+	defer hashersLock.RUnlock()
+
+	names := make([]string, len(hashers))
+	for i, h := range hashers {
+		names[i] = h.name
+	}
+	return names
+}
+
+//hasherFor returns the first registered hasher matching passwordHash, if any.
+func hasherFor(passwordHash string) (Hasher, bool) {
+	hashersLock.RLock()
+	defer hashersLock.RUnlock()
+
+	for _, h := range hashers {
+		if h.hasher.Matches(passwordHash) {
+			return h.hasher, true
+		}
+	}
+	return nil, false
+}
+
+//ValidateHash checks passwordHash is in the format of a registered hasher and, if the hasher tells, well formed, e.g. before storing a hash given as is.
+func ValidateHash(passwordHash string) error {
+	hasher, ok := hasherFor(passwordHash)
+	if !ok {
+		return errors.New("password hash isn't in any registered format")
+	}
+	if validator, ok := hasher.(HashValidator); ok {
+		return validator.Validate(passwordHash)
+	}
+	return nil
+}
+
+//pbkdf2Hasher checks hashes created by Hash: PBKDF2$<algorithm>$<iterations>$<salt>$<hash>.
+type pbkdf2Hasher struct{}
+
+func (pbkdf2Hasher) Matches(passwordHash string) bool {
+	return strings.HasPrefix(passwordHash, "PBKDF2$")
+}
+
+func (pbkdf2Hasher) Compare(password, passwordHash string) bool {
+	return pbkdf2Compare(password, passwordHash)
+}
+
+func (pbkdf2Hasher) Validate(passwordHash string) error {
+	algorithm, _, _, err := pbkdf2Params(passwordHash)
+	if err == nil && algorithm != "sha256" && algorithm != "sha512" {
+		err = errors.Errorf("unknown algorithm %s", algorithm)
+	}
+	return err
+}
+
+//scramHasher checks SCRAM-SHA-256 stored credentials created by ScramHash.
+type scramHasher struct{}
+
+func (scramHasher) Matches(passwordHash string) bool {
+	return strings.HasPrefix(passwordHash, scramPrefix)
+}
+
+func (scramHasher) Compare(password, passwordHash string) bool {
+	return scramCompare(password, passwordHash)
+}
+
+func (scramHasher) Validate(passwordHash string) error {
+	_, _, _, _, err := scramParams(passwordHash)
+	return err
+}
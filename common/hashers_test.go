@@ -0,0 +1,81 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//plainHasher checks PLAIN$<password> hashes, for testing purposes only.
+type plainHasher struct{}
+
+func (plainHasher) Matches(passwordHash string) bool {
+	return strings.HasPrefix(passwordHash, "PLAIN$")
+}
+
+func (plainHasher) Compare(password, passwordHash string) bool {
+	return passwordHash == "PLAIN$"+password
+}
+
+func TestHashers(t *testing.T) {
+
+	Convey("Given built in formats, they should be registered and compared", t, func() {
+		So(Hashers()[:2], ShouldResemble, []string{"pbkdf2", "scram-sha-256"})
+
+		pbkdf2Hash, err := Hash("password", 16, 10, "sha256")
+		So(err, ShouldBeNil)
+		So(HashCompare("password", pbkdf2Hash), ShouldBeTrue)
+		So(HashCompare("wrong", pbkdf2Hash), ShouldBeFalse)
+
+		scramHash, err := ScramHash("password", 16, 10)
+		So(err, ShouldBeNil)
+		So(HashCompare("password", scramHash), ShouldBeTrue)
+		So(HashCompare("wrong", scramHash), ShouldBeFalse)
+
+		So(HashCompare("password", "PLAIN$password"), ShouldBeFalse)
+	})
+
+	Convey("Given a registered hasher, its format should be compared", t, func() {
+		So(RegisterHasher("plain", plainHasher{}), ShouldBeNil)
+		So(Hashers(), ShouldContain, "plain")
+
+		So(HashCompare("password", "PLAIN$password"), ShouldBeTrue)
+		So(HashCompare("wrong", "PLAIN$password"), ShouldBeFalse)
+
+		So(RegisterHasher("plain", plainHasher{}), ShouldNotBeNil)
+		So(RegisterHasher("pbkdf2", plainHasher{}), ShouldNotBeNil)
+		So(RegisterHasher("", plainHasher{}), ShouldNotBeNil)
+		So(RegisterHasher("none", nil), ShouldNotBeNil)
+	})
+
+	Convey("Given hashes to store as given, only well formed ones of registered formats with bounded iterations should be valid", t, func() {
+		pbkdf2Hash, err := Hash("password", 16, 10, "sha512")
+		So(err, ShouldBeNil)
+		So(ValidateHash(pbkdf2Hash), ShouldBeNil)
+
+		scramHash, err := ScramHash("password", 16, 10)
+		So(err, ShouldBeNil)
+		So(ValidateHash(scramHash), ShouldBeNil)
+
+		So(ValidateHash("PLAIN$password"), ShouldBeNil)
+
+		for _, hash := range []string{
+			"",
+			"password",
+			"PBKDF2$sha512$10$salt",
+			"PBKDF2$md5$10$c2FsdA==$aGFzaA==",
+			"PBKDF2$sha512$0$c2FsdA==$aGFzaA==",
+			"PBKDF2$sha512$2147483647$c2FsdA==$aGFzaA==",
+			"PBKDF2$sha512$10$not base64$aGFzaA==",
+			"SCRAM-SHA-256$2147483647:c2FsdA==$a2V5:a2V5",
+			"SCRAM-SHA-256$10:c2FsdA==$a2V5",
+			"SCRAM-SHA-256$ten:c2FsdA==$a2V5:a2V5",
+		} {
+			So(ValidateHash(hash), ShouldNotBeNil)
+		}
+
+		So(HashCompare("password", "SCRAM-SHA-256$2147483647:c2FsdA==$a2V5:a2V5"), ShouldBeFalse)
+		So(HashCompare("password", "PBKDF2$sha512$2147483647$c2FsdA==$aGFzaA=="), ShouldBeFalse)
+	})
+}
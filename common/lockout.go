@@ -0,0 +1,192 @@
+package common
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+)
+
+//Lockout counts failed auth attempts per username and locks users out once they exceed a limit within a window.
+type Lockout interface {
+	//Locked checks if username is currently locked out.
+	Locked(username string) bool
+	//Fail records a failed attempt for username, locking it out if the limit was reached.
+	Fail(username string)
+	//Reset forgets failed attempts for username after a successful one.
+	Reset(username string)
+}
+
+//LockoutPolicy holds the limits shared by every lockout store.
+type LockoutPolicy struct {
+	MaxFailures int64
+	Window      time.Duration
+	Duration    time.Duration
+	//MaxEntries bounds the usernames the local store keeps, 0 meaning DefaultLockoutMaxEntries.
+	MaxEntries int
+}
+
+//DefaultLockoutMaxEntries is the default number of usernames the local store keeps.
+const DefaultLockoutMaxEntries = 100000
+
+type failures struct {
+	username    string
+	count       int64
+	since       time.Time
+	lockedUntil time.Time
+}
+
+//stale tells if the entry neither locks its user out nor counts failures within the window anymore.
+func (f *failures) stale(now time.Time, window time.Duration) bool {
+	return !now.Before(f.lockedUntil) && now.Sub(f.since) > window
+}
+
+//LocalLockout keeps failed attempts in memory, so limits are enforced per broker process.
+//Entries are kept in the order of their last failure, so stale ones are dropped from the front as new failures come,
+//and the least recently failed one is evicted when the store is full, keeping its size bounded no matter how many usernames are tried.
+type LocalLockout struct {
+	sync.Mutex
+	policy   LockoutPolicy
+	failures map[string]*list.Element
+	order    *list.List
+}
+
+//NewLocalLockout returns an in memory lockout store.
+func NewLocalLockout(policy LockoutPolicy) *LocalLockout {
+	if policy.MaxEntries <= 0 {
+		policy.MaxEntries = DefaultLockoutMaxEntries
+	}
+	return &LocalLockout{
+		policy:   policy,
+		failures: make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (l *LocalLockout) Locked(username string) bool {
+	l.Lock()
+	defer l.Unlock()
+	e, ok := l.failures[username]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	f := e.Value.(*failures)
+	if now.Before(f.lockedUntil) {
+		return true
+	}
+	//Drop expired locks and stale entries right away rather than waiting for them to be swept.
+	if !f.lockedUntil.IsZero() || now.Sub(f.since) > l.policy.Window {
+		l.remove(e)
+	}
+	return false
+}
+
+func (l *LocalLockout) Fail(username string) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.sweep(now)
+
+	var f *failures
+	if e, ok := l.failures[username]; ok {
+		f = e.Value.(*failures)
+		l.order.MoveToBack(e)
+	} else {
+		for l.order.Len() >= l.policy.MaxEntries {
+			l.remove(l.order.Front())
+		}
+		f = &failures{username: username, since: now}
+		l.failures[username] = l.order.PushBack(f)
+	}
+
+	if now.Sub(f.since) > l.policy.Window {
+		*f = failures{username: username, since: now}
+	}
+	f.count++
+	if f.count >= l.policy.MaxFailures {
+		f.lockedUntil = now.Add(l.policy.Duration)
+	}
+}
+
+func (l *LocalLockout) Reset(username string) {
+	l.Lock()
+	defer l.Unlock()
+	if e, ok := l.failures[username]; ok {
+		l.remove(e)
+	}
+}
+
+//Len returns the number of usernames kept.
+func (l *LocalLockout) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.order.Len()
+}
+
+//sweep drops stale entries from the front, stopping at the first one that isn't, so it takes constant time on average.
+func (l *LocalLockout) sweep(now time.Time) {
+	for e := l.order.Front(); e != nil && e.Value.(*failures).stale(now, l.policy.Window); e = l.order.Front() {
+		l.remove(e)
+	}
+}
+
+func (l *LocalLockout) remove(e *list.Element) {
+	delete(l.failures, e.Value.(*failures).username)
+	l.order.Remove(e)
+}
+
+//RedisLockout keeps failed attempts in Redis, so limits are enforced across every broker of a cluster sharing it.
+type RedisLockout struct {
+	policy LockoutPolicy
+	prefix string
+	client *goredis.Client
+}
+
+//NewRedisLockout returns a lockout store using the given Redis client. Keys are prefixed by prefix.
+func NewRedisLockout(policy LockoutPolicy, client *goredis.Client, prefix string) *RedisLockout {
+	return &RedisLockout{
+		policy: policy,
+		prefix: prefix,
+		client: client,
+	}
+}
+
+func (l *RedisLockout) failuresKey(username string) string {
+	return fmt.Sprintf("%s%s:failures", l.prefix, username)
+}
+
+func (l *RedisLockout) lockedKey(username string) string {
+	return fmt.Sprintf("%s%s:locked", l.prefix, username)
+}
+
+//Locked fails open when Redis can't be reached, as backends will still check credentials.
+func (l *RedisLockout) Locked(username string) bool {
+	n, err := l.client.Exists(l.lockedKey(username)).Result()
+	return err == nil && n > 0
+}
+
+//failScript atomically increments the failures counter, setting it to expire after the window when it's new or somehow lacks a ttl,
+//and sets the lock key, dropping the counter, once it reaches the limit.
+var failScript = goredis.NewScript(`
+local count = redis.call('INCR', KEYS[1])
+if count == 1 or redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+if count >= tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[2], count, 'PX', ARGV[3])
+	redis.call('DEL', KEYS[1])
+end
+return count
+`)
+
+//Fail counts a failure, so a counter never outlives the window even if a broker dies between incrementing and setting its expiration.
+func (l *RedisLockout) Fail(username string) {
+	failScript.Run(l.client, []string{l.failuresKey(username), l.lockedKey(username)}, int64(l.policy.Window/time.Millisecond), l.policy.MaxFailures, int64(l.policy.Duration/time.Millisecond))
+}
+
+func (l *RedisLockout) Reset(username string) {
+	l.client.Del(l.failuresKey(username))
+}
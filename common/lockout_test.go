@@ -0,0 +1,137 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLocalLockout(t *testing.T) {
+
+	policy := LockoutPolicy{MaxFailures: 3, Window: time.Minute, Duration: time.Minute}
+
+	Convey("Given failures up to the limit, the user should be locked out until reset", t, func() {
+		lockout := NewLocalLockout(policy)
+
+		lockout.Fail("user")
+		lockout.Fail("user")
+		So(lockout.Locked("user"), ShouldBeFalse)
+		lockout.Fail("user")
+		So(lockout.Locked("user"), ShouldBeTrue)
+		So(lockout.Locked("other"), ShouldBeFalse)
+
+		lockout.Reset("user")
+		So(lockout.Locked("user"), ShouldBeFalse)
+		So(lockout.Len(), ShouldEqual, 0)
+	})
+
+	Convey("Given failures spread beyond the window, they should not add up", t, func() {
+		lockout := NewLocalLockout(LockoutPolicy{MaxFailures: 2, Window: 20 * time.Millisecond, Duration: time.Minute})
+
+		lockout.Fail("user")
+		time.Sleep(30 * time.Millisecond)
+		lockout.Fail("user")
+		So(lockout.Locked("user"), ShouldBeFalse)
+	})
+
+	Convey("Given many usernames failing, the store should stay within its maximum entries", t, func() {
+		lockout := NewLocalLockout(LockoutPolicy{MaxFailures: 3, Window: time.Minute, Duration: time.Minute, MaxEntries: 10})
+
+		for i := 0; i < 1000; i++ {
+			lockout.Fail(fmt.Sprintf("user%d", i))
+		}
+		So(lockout.Len(), ShouldEqual, 10)
+
+		//The least recently failed ones are evicted.
+		lockout.Fail("user990")
+		lockout.Fail("user990")
+		So(lockout.Locked("user990"), ShouldBeTrue)
+		So(lockout.Len(), ShouldEqual, 10)
+	})
+
+	Convey("Given stale entries, they should be swept as new failures come", t, func() {
+		lockout := NewLocalLockout(LockoutPolicy{MaxFailures: 3, Window: 20 * time.Millisecond, Duration: time.Minute})
+
+		for i := 0; i < 100; i++ {
+			lockout.Fail(fmt.Sprintf("user%d", i))
+		}
+		So(lockout.Len(), ShouldEqual, 100)
+
+		time.Sleep(30 * time.Millisecond)
+		lockout.Fail("user")
+		So(lockout.Len(), ShouldEqual, 1)
+	})
+
+	Convey("Given a locked out user, its entry should not be swept until the lock expires", t, func() {
+		lockout := NewLocalLockout(LockoutPolicy{MaxFailures: 1, Window: 10 * time.Millisecond, Duration: time.Minute})
+
+		lockout.Fail("locked")
+		time.Sleep(20 * time.Millisecond)
+		lockout.Fail("user")
+		So(lockout.Locked("locked"), ShouldBeTrue)
+	})
+
+}
+
+func TestRedisLockout(t *testing.T) {
+
+	//Like backends' integration tests, this runs only when told Redis is available at localhost.
+	if !strings.Contains(os.Getenv("GO_AUTH_TEST_SERVICES"), "redis") && os.Getenv("GO_AUTH_TEST_SERVICES") != "all" {
+		t.Skip("skipping redis integration test, set GO_AUTH_TEST_SERVICES=redis to run it")
+	}
+
+	client := goredis.NewClient(&goredis.Options{Addr: "localhost:6379", DB: 3})
+	defer client.Close()
+
+	prefix := "mosquitto_auth:lockout_test:"
+	policy := LockoutPolicy{MaxFailures: 3, Window: time.Minute, Duration: time.Minute}
+	lockout := NewRedisLockout(policy, client, prefix)
+
+	Convey("Given failures up to the limit, the user should be locked out until the lock expires", t, func() {
+		defer client.Del(lockout.failuresKey("user"), lockout.lockedKey("user"))
+
+		lockout.Fail("user")
+		lockout.Fail("user")
+		So(lockout.Locked("user"), ShouldBeFalse)
+
+		//The counter expires within the window from the first failure on.
+		ttl, err := client.PTTL(lockout.failuresKey("user")).Result()
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, 0)
+		So(ttl, ShouldBeLessThanOrEqualTo, policy.Window)
+
+		lockout.Fail("user")
+		So(lockout.Locked("user"), ShouldBeTrue)
+		So(client.Exists(lockout.failuresKey("user")).Val(), ShouldEqual, 0)
+
+		ttl, err = client.PTTL(lockout.lockedKey("user")).Result()
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, 0)
+		So(ttl, ShouldBeLessThanOrEqualTo, policy.Duration)
+	})
+
+	Convey("Given a counter left without a ttl, the next failure should set it", t, func() {
+		defer client.Del(lockout.failuresKey("user"), lockout.lockedKey("user"))
+
+		client.Set(lockout.failuresKey("user"), 1, 0)
+		lockout.Fail("user")
+
+		ttl, err := client.PTTL(lockout.failuresKey("user")).Result()
+		So(err, ShouldBeNil)
+		So(ttl, ShouldBeGreaterThan, 0)
+	})
+
+	Convey("Given a reset, failures should be forgotten", t, func() {
+		defer client.Del(lockout.failuresKey("user"), lockout.lockedKey("user"))
+
+		lockout.Fail("user")
+		lockout.Reset("user")
+		So(client.Exists(lockout.failuresKey("user")).Val(), ShouldEqual, 0)
+	})
+
+}
@@ -0,0 +1,47 @@
+package common
+
+//Prewarmer runs acl prewarming in the background, so subscribing clients don't wait for it.
+//Jobs are run one at a time from a bounded queue, and those finding it full are dropped, as prewarming only saves later checks some time.
+type Prewarmer struct {
+	jobs chan func()
+}
+
+//NewPrewarmer starts a prewarmer whose queue holds up to size jobs, running them until stop is closed.
+func NewPrewarmer(size int, stop <-chan struct{}) *Prewarmer {
+	p := &Prewarmer{jobs: make(chan func(), size)}
+	go p.run(stop)
+	return p
+}
+
+func (p *Prewarmer) run(stop <-chan struct{}) {
+	for {
+		//Stopping takes precedence over queued jobs.
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		select {
+		case <-stop:
+			return
+		case job := <-p.jobs:
+			job()
+		}
+	}
+}
+
+//Add queues a job, returning false if the queue is full and it was dropped.
+func (p *Prewarmer) Add(job func()) bool {
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+//Len returns how many jobs are waiting to be run.
+func (p *Prewarmer) Len() int {
+	return len(p.jobs)
+}
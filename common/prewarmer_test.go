@@ -0,0 +1,92 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPrewarmer(t *testing.T) {
+
+	Convey("Given jobs, they should be run in the background one at a time", t, func() {
+		stop := make(chan struct{})
+		defer close(stop)
+		prewarmer := NewPrewarmer(10, stop)
+
+		done := make(chan int, 3)
+		running := make(chan bool, 1)
+		for i := 0; i < 3; i++ {
+			i := i
+			So(prewarmer.Add(func() {
+				select {
+				case running <- true:
+				default:
+					t.Error("jobs ran at the same time")
+				}
+				time.Sleep(5 * time.Millisecond)
+				<-running
+				done <- i
+			}), ShouldBeTrue)
+		}
+
+		for i := 0; i < 3; i++ {
+			select {
+			case n := <-done:
+				So(n, ShouldEqual, i)
+			case <-time.After(time.Second):
+				t.Fatal("job wasn't run")
+			}
+		}
+	})
+
+	Convey("Given a full queue, jobs should be dropped without waiting", t, func() {
+		stop := make(chan struct{})
+		defer close(stop)
+		prewarmer := NewPrewarmer(2, stop)
+
+		//The first job keeps the worker busy so the next ones stay queued.
+		release := make(chan struct{})
+		started := make(chan struct{})
+		So(prewarmer.Add(func() {
+			close(started)
+			<-release
+		}), ShouldBeTrue)
+		<-started
+
+		So(prewarmer.Add(func() {}), ShouldBeTrue)
+		So(prewarmer.Add(func() {}), ShouldBeTrue)
+
+		start := time.Now()
+		So(prewarmer.Add(func() {}), ShouldBeFalse)
+		So(time.Since(start), ShouldBeLessThan, 100*time.Millisecond)
+		So(prewarmer.Len(), ShouldEqual, 2)
+
+		close(release)
+	})
+
+	Convey("Given stop is closed, queued jobs shouldn't be run", t, func() {
+		stop := make(chan struct{})
+		prewarmer := NewPrewarmer(2, stop)
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+		prewarmer.Add(func() {
+			close(started)
+			<-release
+		})
+		<-started
+
+		ran := make(chan struct{}, 1)
+		prewarmer.Add(func() { ran <- struct{}{} })
+		close(stop)
+		close(release)
+
+		select {
+		case <-ran:
+			t.Error("queued job ran after stopping")
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+}
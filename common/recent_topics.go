@@ -0,0 +1,61 @@
+package common
+
+import (
+	"strings"
+	"sync"
+)
+
+//RecentTopics keeps the last concrete topics seen in acl checks, up to a fixed size, so they may be matched against subscriptions.
+type RecentTopics struct {
+	sync.Mutex
+	topics []string
+	seen   map[string]bool
+	next   int
+}
+
+//NewRecentTopics returns an index that keeps up to size topics, replacing the oldest ones when full.
+func NewRecentTopics(size int) *RecentTopics {
+	return &RecentTopics{
+		topics: make([]string, 0, size),
+		seen:   make(map[string]bool, size),
+	}
+}
+
+//Add records a concrete topic. Topics with wildcards are ignored.
+func (r *RecentTopics) Add(topic string) {
+	if r == nil || strings.ContainsAny(topic, "+#") {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.seen[topic] || cap(r.topics) == 0 {
+		return
+	}
+	if len(r.topics) < cap(r.topics) {
+		r.topics = append(r.topics, topic)
+	} else {
+		delete(r.seen, r.topics[r.next])
+		r.topics[r.next] = topic
+		r.next = (r.next + 1) % len(r.topics)
+	}
+	r.seen[topic] = true
+}
+
+//Matching returns up to max recent topics matched by filter.
+func (r *RecentTopics) Matching(filter string, max int) []string {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	var matches []string
+	for _, topic := range r.topics {
+		if len(matches) >= max {
+			break
+		}
+		if TopicsMatch(filter, topic) {
+			matches = append(matches, topic)
+		}
+	}
+	return matches
+}
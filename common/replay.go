@@ -0,0 +1,99 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+)
+
+//RecordedDecision is a check's decision as logged by the plugin, with the check as a self test case expecting the recorded result.
+type RecordedDecision struct {
+	Case    SelfTestCase
+	Backend string
+	Reason  string
+}
+
+//ParseDecisionLine parses a decision logged at debug level, in logrus' text format, either as key=value pairs or as printed to a terminal.
+//Lines that aren't decisions, or miss the check, username or result, aren't parsed. Passwords are never logged, so auth cases have none.
+func ParseDecisionLine(line string) (RecordedDecision, bool) {
+	fields, words := parseLogLine(line)
+	if fields["msg"] != "decision" && !words["decision"] {
+		return RecordedDecision{}, false
+	}
+
+	granted, err := strconv.ParseBool(fields["granted"])
+	if err != nil {
+		return RecordedDecision{}, false
+	}
+
+	c := SelfTestCase{
+		Check:    fields["check"],
+		Username: fields["username"],
+		Clientid: fields["clientid"],
+		Topic:    fields["topic"],
+		Allow:    granted,
+	}
+	if _, ok := fields["username"]; !ok || c.Check == "" {
+		return RecordedDecision{}, false
+	}
+	if c.Check == "acl" {
+		acc, err := parseSelfTestAcc(fields["acc"])
+		if err != nil || c.Topic == "" {
+			return RecordedDecision{}, false
+		}
+		c.Acc = acc
+	}
+
+	return RecordedDecision{Case: c, Backend: fields["backend"], Reason: fields["reason"]}, true
+}
+
+//parseLogLine splits a logrus text line into its key=value fields, unquoting quoted values, and the words without a key.
+func parseLogLine(line string) (map[string]string, map[string]bool) {
+	fields := make(map[string]string)
+	words := make(map[string]bool)
+
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != ' ' && line[i] != '=' {
+			i++
+		}
+		if i == len(line) || line[i] == ' ' {
+			words[line[start:i]] = true
+			continue
+		}
+		key := line[start:i]
+		i++
+
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return fields, words
+			}
+			value, err := strconv.Unquote(line[i : end+1])
+			if err == nil {
+				fields[key] = value
+			}
+			i = end + 1
+			continue
+		}
+
+		end := strings.IndexByte(line[i:], ' ')
+		if end < 0 {
+			end = len(line) - i
+		}
+		fields[key] = line[i : i+end]
+		i += end
+	}
+
+	return fields, words
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestParseDecisionLine(t *testing.T) {
+
+	Convey("Given a decision logged as key=value pairs, it should be parsed as a case expecting its result", t, func() {
+		line := `time="2020-01-02T15:04:05Z" level=debug msg=decision acc=2 backend=postgres check=acl clientid=sensor-1 granted=true reason=acl topic="sensors/sensor 1/temp" username=sensor-1`
+
+		decision, ok := ParseDecisionLine(line)
+		So(ok, ShouldBeTrue)
+		So(decision.Case, ShouldResemble, SelfTestCase{
+			Check:    "acl",
+			Username: "sensor-1",
+			Clientid: "sensor-1",
+			Topic:    "sensors/sensor 1/temp",
+			Acc:      2,
+			Allow:    true,
+		})
+		So(decision.Backend, ShouldEqual, "postgres")
+		So(decision.Reason, ShouldEqual, "acl")
+	})
+
+	Convey("Given a decision printed to a terminal, it should be parsed too", t, func() {
+		decision, ok := ParseDecisionLine(`DEBU[0001] decision                                      check=auth clientid=c1 granted=false reason=not_granted username=test`)
+		So(ok, ShouldBeTrue)
+		So(decision.Case, ShouldResemble, SelfTestCase{Check: "auth", Username: "test", Clientid: "c1"})
+		So(decision.Reason, ShouldEqual, "not_granted")
+	})
+
+	Convey("Given other lines, they should not be parsed", t, func() {
+		for _, line := range []string{
+			`time="2020-01-02T15:04:05Z" level=info msg="Backend registered: Files (id files)"`,
+			`time="2020-01-02T15:04:05Z" level=debug msg=decision check=acl granted=true username=test`,
+			`time="2020-01-02T15:04:05Z" level=debug msg=decision check=acl acc=9 granted=true topic=a username=test`,
+			`time="2020-01-02T15:04:05Z" level=debug msg=decision check=auth granted=maybe username=test`,
+			`time="2020-01-02T15:04:05Z" level=debug msg=decision check=acl topic="unterminated`,
+			``,
+		} {
+			_, ok := ParseDecisionLine(line)
+			So(ok, ShouldBeFalse)
+		}
+	})
+
+}
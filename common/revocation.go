@@ -0,0 +1,275 @@
+package common
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+)
+
+//ErrCertificateRevoked is returned by revocation checks of revoked certificates.
+var ErrCertificateRevoked = errors.New("certificate revoked")
+
+//Revocation checks client certificates against a CRL file and their issuer's OCSP responder, so revoked certificates are rejected even when the broker doesn't check them.
+//The CRL file may hold several CRLs, PEM or DER encoded, and is reloaded when it changes. OCSP responses are cached until their next update, up to a maximum.
+type Revocation struct {
+	sync.RWMutex
+	crlFile    string
+	modTime    time.Time
+	revoked    map[string]bool //Revoked certificates, by issuer and serial number.
+	nextUpdate time.Time
+	issuers    []*x509.Certificate
+	ocsp       bool
+	ocspURL    string
+	client     *http.Client
+	maxAge     time.Duration
+	responses  map[string]ocspStatus
+}
+
+//ocspStatus is a cached OCSP response.
+type ocspStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+//NewRevocation returns a revocation checker for the CRLs in crlFile, if not empty, and issuers' OCSP responders if useOCSP is true.
+//Issuers are read from caFile, which is needed for OCSP and, when given, used to verify CRLs' signatures. ocspURL, if not empty, overrides the responder given by certificates.
+func NewRevocation(crlFile, caFile string, useOCSP bool, ocspURL string, timeout, maxAge time.Duration) (*Revocation, error) {
+	r := &Revocation{
+		crlFile:   crlFile,
+		ocsp:      useOCSP,
+		ocspURL:   ocspURL,
+		client:    &http.Client{Timeout: timeout},
+		maxAge:    maxAge,
+		responses: make(map[string]ocspStatus),
+	}
+
+	if caFile != "" {
+		pemCerts, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Errorf("couldn't read revocation ca file %s: %s", caFile, err)
+		}
+		for block, rest := pem.Decode(pemCerts); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			issuer, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Errorf("couldn't parse revocation ca file %s: %s", caFile, err)
+			}
+			r.issuers = append(r.issuers, issuer)
+		}
+		if len(r.issuers) == 0 {
+			return nil, errors.Errorf("no certificates found in revocation ca file %s", caFile)
+		}
+	}
+
+	if useOCSP && len(r.issuers) == 0 {
+		return nil, errors.New("ocsp checks need the issuers' certificates")
+	}
+
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+//Reload reads the CRL file again if it changed since it was last read, returning whether it did. On error, previous CRLs are kept.
+func (r *Revocation) Reload() (bool, error) {
+	if r.crlFile == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(r.crlFile)
+	if err != nil {
+		return false, errors.Errorf("couldn't stat crl file %s: %s", r.crlFile, err)
+	}
+
+	r.RLock()
+	unchanged := info.ModTime().Equal(r.modTime)
+	r.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(r.crlFile)
+	if err != nil {
+		return false, errors.Errorf("couldn't read crl file %s: %s", r.crlFile, err)
+	}
+
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{data}
+	}
+
+	revoked := make(map[string]bool)
+	var nextUpdate time.Time
+	for _, der := range ders {
+		crl, err := x509.ParseDERCRL(der)
+		if err != nil {
+			return false, errors.Errorf("couldn't parse crl file %s: %s", r.crlFile, err)
+		}
+		issuerName := crl.TBSCertList.Issuer.String()
+		if len(r.issuers) > 0 {
+			issuer := r.issuerOf(issuerName)
+			if issuer == nil {
+				return false, errors.Errorf("crl in %s issued by %s, which is not a known issuer", r.crlFile, crl.TBSCertList.Issuer)
+			}
+			if err := issuer.CheckCRLSignature(crl); err != nil {
+				return false, errors.Errorf("bad signature of crl in %s: %s", r.crlFile, err)
+			}
+		}
+		for _, cert := range crl.TBSCertList.RevokedCertificates {
+			revoked[issuerName+":"+cert.SerialNumber.String()] = true
+		}
+		if nextUpdate.IsZero() || crl.TBSCertList.NextUpdate.Before(nextUpdate) {
+			nextUpdate = crl.TBSCertList.NextUpdate
+		}
+	}
+
+	r.Lock()
+	r.revoked = revoked
+	r.nextUpdate = nextUpdate
+	r.modTime = info.ModTime()
+	r.Unlock()
+
+	return true, nil
+}
+
+//Check checks the DER encoded certificate isn't revoked at now, returning ErrCertificateRevoked if it is,
+//or another error if its status couldn't be told, e.g. the CRLs expired or the OCSP responder couldn't be reached.
+func (r *Revocation) Check(der []byte, now time.Time) error {
+	if r == nil {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return errors.Errorf("couldn't parse client certificate: %s", err)
+	}
+	key := nameOf(cert.RawIssuer) + ":" + cert.SerialNumber.String()
+
+	if r.crlFile != "" {
+		r.RLock()
+		revoked, expired := r.revoked[key], !r.nextUpdate.IsZero() && now.After(r.nextUpdate)
+		r.RUnlock()
+		if revoked {
+			return ErrCertificateRevoked
+		}
+		if expired {
+			return errors.Errorf("crl in %s expired", r.crlFile)
+		}
+	}
+
+	if !r.ocsp {
+		return nil
+	}
+
+	r.RLock()
+	status, cached := r.responses[key]
+	r.RUnlock()
+	if !cached || now.After(status.expires) {
+		status, err = r.queryOCSP(cert, now)
+		if err != nil {
+			return err
+		}
+		r.Lock()
+		r.responses[key] = status
+		r.Unlock()
+	}
+
+	if status.revoked {
+		return ErrCertificateRevoked
+	}
+	return nil
+}
+
+//queryOCSP asks the certificate's OCSP responder for its status at now.
+func (r *Revocation) queryOCSP(cert *x509.Certificate, now time.Time) (ocspStatus, error) {
+	issuer := r.issuerOf(nameOf(cert.RawIssuer))
+	if issuer == nil {
+		return ocspStatus{}, errors.Errorf("issuer %s of certificate %s is not known", cert.Issuer, cert.Subject)
+	}
+
+	url := r.ocspURL
+	if url == "" {
+		if len(cert.OCSPServer) == 0 {
+			return ocspStatus{}, errors.Errorf("certificate %s has no ocsp responder", cert.Subject)
+		}
+		url = cert.OCSPServer[0]
+	}
+
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return ocspStatus{}, errors.Errorf("couldn't create ocsp request: %s", err)
+	}
+
+	resp, err := r.client.Post(url, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return ocspStatus{}, errors.Errorf("ocsp request to %s failed: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ocspStatus{}, errors.Errorf("ocsp responder %s answered with status %d", url, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return ocspStatus{}, errors.Errorf("couldn't read ocsp response from %s: %s", url, err)
+	}
+
+	response, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return ocspStatus{}, errors.Errorf("bad ocsp response from %s: %s", url, err)
+	}
+
+	status := ocspStatus{expires: now.Add(r.maxAge)}
+	if !response.NextUpdate.IsZero() && response.NextUpdate.Before(status.expires) {
+		status.expires = response.NextUpdate
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		status.revoked = true
+	default:
+		return ocspStatus{}, errors.Errorf("ocsp responder %s doesn't know certificate %s", url, cert.Subject)
+	}
+
+	return status, nil
+}
+
+//issuerOf returns the known issuer with the given name, nil if there's none.
+func (r *Revocation) issuerOf(name string) *x509.Certificate {
+	for _, issuer := range r.issuers {
+		if nameOf(issuer.RawSubject) == name {
+			return issuer
+		}
+	}
+	return nil
+}
+
+//nameOf returns the DER encoded name as a string, so names are compared regardless of how their values are encoded.
+func nameOf(raw []byte) string {
+	var name pkix.RDNSequence
+	if _, err := asn1.Unmarshal(raw, &name); err != nil {
+		return string(raw)
+	}
+	return name.String()
+}
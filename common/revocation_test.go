@@ -0,0 +1,161 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/ocsp"
+)
+
+//testCA is a certificate authority issuing client certificates, for testing purposes only.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA() *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "devices ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(serial int64, ocspServer string) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	return der
+}
+
+func (ca *testCA) crl(nextUpdate time.Time, serials ...int64) []byte {
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, _ := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), nextUpdate)
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestRevocation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA()
+	caFile := filepath.Join(dir, "ca.pem")
+	crlFile := filepath.Join(dir, "crl.pem")
+	ioutil.WriteFile(caFile, ca.pem, 0600)
+
+	Convey("Given a crl file, certificates it lists should be revoked", t, func() {
+		ioutil.WriteFile(crlFile, ca.crl(time.Now().Add(time.Hour), 2), 0600)
+		revocation, err := NewRevocation(crlFile, caFile, false, "", time.Second, time.Minute)
+		So(err, ShouldBeNil)
+
+		So(revocation.Check(ca.issue(2, ""), time.Now()), ShouldEqual, ErrCertificateRevoked)
+		So(revocation.Check(ca.issue(3, ""), time.Now()), ShouldBeNil)
+		So(revocation.Check([]byte("garbage"), time.Now()), ShouldNotBeNil)
+
+		Convey("Once the crl expires, statuses should be unknown", func() {
+			err := revocation.Check(ca.issue(3, ""), time.Now().Add(2*time.Hour))
+			So(err, ShouldNotBeNil)
+			So(err, ShouldNotEqual, ErrCertificateRevoked)
+		})
+
+		Convey("When the crl file changes, it should be reloaded", func() {
+			ioutil.WriteFile(crlFile, ca.crl(time.Now().Add(time.Hour), 3), 0600)
+			later := time.Now().Add(time.Minute)
+			os.Chtimes(crlFile, later, later)
+
+			reloaded, err := revocation.Reload()
+			So(err, ShouldBeNil)
+			So(reloaded, ShouldBeTrue)
+			So(revocation.Check(ca.issue(2, ""), time.Now()), ShouldBeNil)
+			So(revocation.Check(ca.issue(3, ""), time.Now()), ShouldEqual, ErrCertificateRevoked)
+		})
+	})
+
+	Convey("Given a crl by an unknown issuer, it should be rejected", t, func() {
+		ioutil.WriteFile(crlFile, newTestCA().crl(time.Now().Add(time.Hour), 2), 0600)
+		_, err := NewRevocation(crlFile, caFile, false, "", time.Second, time.Minute)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given an ocsp responder, certificates should be checked against it and responses cached", t, func() {
+		requests := 0
+		responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			body, _ := ioutil.ReadAll(r.Body)
+			req, err := ocsp.ParseRequest(body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			template := ocsp.Response{
+				Status:       ocsp.Good,
+				SerialNumber: req.SerialNumber,
+				ThisUpdate:   time.Now(),
+				NextUpdate:   time.Now().Add(time.Hour),
+			}
+			if req.SerialNumber.Int64() == 2 {
+				template.Status = ocsp.Revoked
+				template.RevokedAt = time.Now()
+			}
+			resp, _ := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+			w.Write(resp)
+		}))
+		defer responder.Close()
+
+		revocation, err := NewRevocation("", caFile, true, "", time.Second, time.Minute)
+		So(err, ShouldBeNil)
+
+		So(revocation.Check(ca.issue(2, responder.URL), time.Now()), ShouldEqual, ErrCertificateRevoked)
+		good := ca.issue(3, responder.URL)
+		So(revocation.Check(good, time.Now()), ShouldBeNil)
+		So(revocation.Check(good, time.Now()), ShouldBeNil)
+		So(requests, ShouldEqual, 2)
+
+		So(revocation.Check(good, time.Now().Add(2*time.Minute)), ShouldBeNil)
+		So(requests, ShouldEqual, 3)
+
+		So(revocation.Check(ca.issue(4, ""), time.Now()), ShouldNotBeNil)
+	})
+
+	Convey("Given ocsp checks without issuers, the checker should fail", t, func() {
+		_, err := NewRevocation("", "", true, "", time.Second, time.Minute)
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//SelfTestCase is a check run against backends with its expected result.
+type SelfTestCase struct {
+	Check    string
+	Username string
+	Password string
+	Clientid string
+	Topic    string
+	Acc      int
+	Allow    bool
+}
+
+//Access values as named in self test cases, matching mosquitto's.
+var selfTestAccs = map[string]int{
+	"read":      1,
+	"write":     2,
+	"subscribe": 4,
+}
+
+//ParseSelfTestCases parses cases separated by semicolons or new lines, ignoring empty ones and those starting with #.
+//Fields are separated by spaces and cases have one of these forms:
+//
+//	auth <username> <password> allow|deny
+//	acl <username> <clientid> <topic> read|write|subscribe allow|deny
+func ParseSelfTestCases(spec string) ([]SelfTestCase, error) {
+	var cases []SelfTestCase
+
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		c := SelfTestCase{Check: fields[0]}
+
+		switch {
+		case c.Check == "auth" && len(fields) == 4:
+			c.Username = fields[1]
+			c.Password = fields[2]
+		case c.Check == "acl" && len(fields) == 6:
+			c.Username = fields[1]
+			c.Clientid = fields[2]
+			c.Topic = fields[3]
+			acc, err := parseSelfTestAcc(fields[4])
+			if err != nil {
+				return nil, errors.Errorf("bad self test case %s: %s", line, err)
+			}
+			c.Acc = acc
+		default:
+			return nil, errors.Errorf("bad self test case %s", line)
+		}
+
+		switch fields[len(fields)-1] {
+		case "allow":
+			c.Allow = true
+		case "deny":
+		default:
+			return nil, errors.Errorf("bad self test case %s: expected result must be allow or deny", line)
+		}
+
+		cases = append(cases, c)
+	}
+
+	return cases, nil
+}
+
+//ReadSelfTestCases parses the cases in file, one per line.
+func ReadSelfTestCases(file string) ([]SelfTestCase, error) {
+	spec, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Errorf("couldn't read self test file %s: %s", file, err)
+	}
+	return ParseSelfTestCases(string(spec))
+}
+
+func parseSelfTestAcc(acc string) (int, error) {
+	if n, ok := selfTestAccs[acc]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(acc)
+	if err != nil {
+		return 0, errors.Errorf("unknown access %s", acc)
+	}
+	for _, known := range selfTestAccs {
+		if n == known {
+			return n, nil
+		}
+	}
+	return 0, errors.Errorf("unknown access %s", acc)
+}
+
+//String describes the case without its password.
+func (c SelfTestCase) String() string {
+	if c.Check == "acl" {
+		return "acl " + c.Username + " " + c.Clientid + " " + c.Topic + " " + strconv.Itoa(c.Acc)
+	}
+	return "auth " + c.Username
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+//ServiceAccounts recognizes fleet service accounts by username patterns, so they don't each need identical rows in backends.
+//Usernames matching a superuser pattern are superusers, and those matching a service account pattern are checked against its acl template.
+//Patterns are shell globs as matched by path.Match, and superusers may also be matched by a regular expression.
+type ServiceAccounts struct {
+	superusers     []string
+	superuserRegex *regexp.Regexp
+	accounts       []serviceAccount
+}
+
+//serviceAccount is a username pattern and the acl template of the usernames matching it.
+type serviceAccount struct {
+	pattern  string
+	template string
+	topics   []string
+}
+
+//NewServiceAccounts returns service accounts for the given superuser patterns and regular expression, which may be empty,
+//and accounts given as pattern:template pairs, with templates' topics as given by the templates map.
+//Accounts are matched in the given order, the first matching one being used.
+func NewServiceAccounts(superusers []string, superuserRegex string, accounts []string, templates map[string][]string) (*ServiceAccounts, error) {
+	s := &ServiceAccounts{
+		superusers: superusers,
+	}
+
+	for _, pattern := range superusers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("bad superuser pattern %s: %s", pattern, err)
+		}
+	}
+
+	if superuserRegex != "" {
+		re, err := regexp.Compile(superuserRegex)
+		if err != nil {
+			return nil, errors.Errorf("bad superuser regex %s: %s", superuserRegex, err)
+		}
+		s.superuserRegex = re
+	}
+
+	for _, account := range accounts {
+		i := strings.LastIndex(account, ":")
+		if i < 1 || i == len(account)-1 {
+			return nil, errors.Errorf("bad service account %s: expected pattern:template", account)
+		}
+		pattern, template := account[:i], account[i+1:]
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("bad service account pattern %s: %s", pattern, err)
+		}
+		topics, ok := templates[template]
+		if !ok {
+			return nil, errors.Errorf("unknown acl template %s for service account %s", template, pattern)
+		}
+		s.accounts = append(s.accounts, serviceAccount{pattern: pattern, template: template, topics: topics})
+	}
+
+	if len(s.superusers) == 0 && s.superuserRegex == nil && len(s.accounts) == 0 {
+		return nil, errors.New("no superuser patterns nor service accounts given")
+	}
+
+	return s, nil
+}
+
+//IsSuperuser checks if username matches a superuser pattern.
+func (s *ServiceAccounts) IsSuperuser(username string) bool {
+	if s == nil {
+		return false
+	}
+	if matchAny(s.superusers, username) {
+		return true
+	}
+	return s.superuserRegex != nil && s.superuserRegex.MatchString(username)
+}
+
+//Template returns the name and topics of the acl template of the first service account pattern matching username, if any.
+//Topics may have wildcards, and %u and %c placeholders for the username and clientid.
+func (s *ServiceAccounts) Template(username string) (string, []string, bool) {
+	if s == nil {
+		return "", nil, false
+	}
+	for _, account := range s.accounts {
+		if ok, _ := path.Match(account.pattern, username); ok {
+			return account.template, account.topics, true
+		}
+	}
+	return "", nil, false
+}
@@ -0,0 +1,64 @@
+package common
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestServiceAccounts(t *testing.T) {
+
+	templates := map[string][]string{
+		"ingest": {"devices/+/telemetry"},
+		"fleet":  {"fleet/#"},
+	}
+
+	Convey("Given superuser patterns, matching usernames should be superusers", t, func() {
+		s, err := NewServiceAccounts([]string{"ops-*"}, "^root-[0-9]+$", nil, nil)
+		So(err, ShouldBeNil)
+
+		So(s.IsSuperuser("ops-admin"), ShouldBeTrue)
+		So(s.IsSuperuser("root-1"), ShouldBeTrue)
+		So(s.IsSuperuser("root-x"), ShouldBeFalse)
+		So(s.IsSuperuser("svc-1"), ShouldBeFalse)
+	})
+
+	Convey("Given service accounts, the first matching pattern's template should be used", t, func() {
+		s, err := NewServiceAccounts(nil, "", []string{"svc-ingest-*:ingest", "svc-*:fleet"}, templates)
+		So(err, ShouldBeNil)
+
+		name, topics, ok := s.Template("svc-ingest-1")
+		So(ok, ShouldBeTrue)
+		So(name, ShouldEqual, "ingest")
+		So(topics, ShouldResemble, templates["ingest"])
+
+		name, _, ok = s.Template("svc-other")
+		So(ok, ShouldBeTrue)
+		So(name, ShouldEqual, "fleet")
+
+		_, _, ok = s.Template("device-1")
+		So(ok, ShouldBeFalse)
+		So(s.IsSuperuser("svc-other"), ShouldBeFalse)
+	})
+
+	Convey("Given no service accounts, nothing should match", t, func() {
+		var s *ServiceAccounts
+		So(s.IsSuperuser("ops-admin"), ShouldBeFalse)
+		_, _, ok := s.Template("svc-1")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given bad patterns or unknown templates, creating them should fail", t, func() {
+		_, err := NewServiceAccounts([]string{"ops-["}, "", nil, nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewServiceAccounts(nil, "root-(", nil, nil)
+		So(err, ShouldNotBeNil)
+		_, err = NewServiceAccounts(nil, "", []string{"svc-*:unknown"}, templates)
+		So(err, ShouldNotBeNil)
+		_, err = NewServiceAccounts(nil, "", []string{"svc-*"}, templates)
+		So(err, ShouldNotBeNil)
+		_, err = NewServiceAccounts(nil, "", nil, templates)
+		So(err, ShouldNotBeNil)
+	})
+
+}
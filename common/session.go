@@ -0,0 +1,284 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+)
+
+//Session is a short lived record minted when a client authenticates against a backend, which answers the client's later checks until it expires.
+//Passwords aren't kept, only their HMAC, so records in a shared store don't leak them.
+type Session struct {
+	Username  string          `json:"username"`
+	Clientid  string          `json:"clientid"`
+	Backend   string          `json:"backend"`
+	Password  string          `json:"password"`
+	Superuser bool            `json:"superuser"`
+	Acls      map[string]bool `json:"acls"`
+	Expires   int64           `json:"expires"`
+}
+
+func aclKey(topic string, acc int) string {
+	return strconv.Itoa(acc) + ":" + topic
+}
+
+//Acl returns the decision recorded for topic and acc, and whether there's one. Superusers are granted every acl.
+func (s *Session) Acl(topic string, acc int) (bool, bool) {
+	if s.Superuser {
+		return true, true
+	}
+	granted, ok := s.Acls[aclKey(topic, acc)]
+	return granted, ok
+}
+
+//Sessions mints, signs and checks sessions, kept in memory or in a Redis shared by a broker cluster.
+type Sessions struct {
+	secret  []byte
+	ttl     time.Duration
+	maxAcls int
+	store   sessionStore
+}
+
+//sessionStore keeps signed session records by username and clientid until they expire.
+type sessionStore interface {
+	get(username, clientid string) (string, bool)
+	put(username, clientid, record string, ttl time.Duration)
+	drop(username string)
+	dropAll()
+}
+
+//NewLocalSessions returns sessions kept in memory, lasting ttl and recording up to maxAcls acl decisions each.
+func NewLocalSessions(secret []byte, ttl time.Duration, maxAcls int) *Sessions {
+	return &Sessions{
+		secret:  secret,
+		ttl:     ttl,
+		maxAcls: maxAcls,
+		store:   &localSessions{records: make(map[string]map[string]localSession)},
+	}
+}
+
+//NewRedisSessions returns sessions kept in Redis using the given client, as a hash per username. Keys are prefixed by prefix.
+func NewRedisSessions(secret []byte, ttl time.Duration, maxAcls int, client *goredis.Client, prefix string) *Sessions {
+	return &Sessions{
+		secret:  secret,
+		ttl:     ttl,
+		maxAcls: maxAcls,
+		store:   &redisSessions{client: client, prefix: prefix},
+	}
+}
+
+func (s *Sessions) mac(value string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Mint starts a session for username and clientid, authenticated by password against backend, replacing any previous one.
+func (s *Sessions) Mint(username, clientid, password, backend string) {
+	if s == nil {
+		return
+	}
+	s.save(&Session{
+		Username: username,
+		Clientid: clientid,
+		Backend:  backend,
+		Password: s.mac("password\n" + password),
+		Acls:     make(map[string]bool),
+		Expires:  time.Now().Add(s.ttl).Unix(),
+	})
+}
+
+//Auth returns the session of username and clientid if there's one that hasn't expired and was authenticated by the same password.
+func (s *Sessions) Auth(username, clientid, password string) (*Session, bool) {
+	session, ok := s.Load(username, clientid)
+	if !ok || !hmac.Equal([]byte(session.Password), []byte(s.mac("password\n"+password))) {
+		return nil, false
+	}
+	return session, true
+}
+
+//Load returns the session of username and clientid if there's one that hasn't expired and whose signature is valid.
+func (s *Sessions) Load(username, clientid string) (*Session, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	record, ok := s.store.get(username, clientid)
+	if !ok {
+		return nil, false
+	}
+
+	//Records are the session's json and its signature, which is hex and so has no dots.
+	i := strings.LastIndex(record, ".")
+	if i < 0 || !hmac.Equal([]byte(record[i+1:]), []byte(s.mac(record[:i]))) {
+		return nil, false
+	}
+
+	var session Session
+	if err := json.Unmarshal([]byte(record[:i]), &session); err != nil {
+		return nil, false
+	}
+	if session.Username != username || session.Clientid != clientid || time.Now().Unix() >= session.Expires {
+		return nil, false
+	}
+	return &session, true
+}
+
+//RecordAcl records an acl decision in the session, unless it already holds as many as allowed. Superuser grants make it grant every acl.
+func (s *Sessions) RecordAcl(session *Session, topic string, acc int, granted, superuser bool) {
+	if s == nil || session == nil {
+		return
+	}
+	if superuser {
+		session.Superuser = true
+	} else if len(session.Acls) < s.maxAcls {
+		session.Acls[aclKey(topic, acc)] = granted
+	} else {
+		return
+	}
+	s.save(session)
+}
+
+//Keeps tells if sessions may keep a decision a backend hinted to be cached for ttl, which they can't if they last longer.
+func (s *Sessions) Keeps(ttl time.Duration) bool {
+	return s != nil && ttl >= s.ttl
+}
+
+//Drop ends every session of username, e.g. when its permissions change.
+func (s *Sessions) Drop(username string) {
+	if s == nil {
+		return
+	}
+	s.store.drop(username)
+}
+
+//DropAll ends every session.
+func (s *Sessions) DropAll() {
+	if s == nil {
+		return
+	}
+	s.store.dropAll()
+}
+
+//save signs and stores the session. Records are kept for a whole ttl, as they're checked against their own expiration, so recording decisions doesn't extend sessions.
+func (s *Sessions) save(session *Session) {
+	if session.Acls == nil {
+		session.Acls = make(map[string]bool)
+	}
+	payload, err := json.Marshal(session)
+	if err != nil {
+		return
+	}
+	s.store.put(session.Username, session.Clientid, string(payload)+"."+s.mac(string(payload)), s.ttl)
+}
+
+type localSession struct {
+	record  string
+	expires time.Time
+}
+
+//localSessions keeps records in memory, sweeping expired ones at most once a minute as records are stored.
+type localSessions struct {
+	sync.Mutex
+	records   map[string]map[string]localSession
+	lastSweep time.Time
+}
+
+func (l *localSessions) get(username, clientid string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	entry, ok := l.records[username][clientid]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.record, true
+}
+
+func (l *localSessions) put(username, clientid, record string, ttl time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.lastSweep = now
+		for u, clients := range l.records {
+			for c, entry := range clients {
+				if now.After(entry.expires) {
+					delete(clients, c)
+				}
+			}
+			if len(clients) == 0 {
+				delete(l.records, u)
+			}
+		}
+	}
+
+	if l.records[username] == nil {
+		l.records[username] = make(map[string]localSession)
+	}
+	l.records[username][clientid] = localSession{record: record, expires: now.Add(ttl)}
+}
+
+func (l *localSessions) drop(username string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.records, username)
+}
+
+func (l *localSessions) dropAll() {
+	l.Lock()
+	defer l.Unlock()
+	l.records = make(map[string]map[string]localSession)
+}
+
+//redisSessions keeps records in a hash per username, by clientid, which expires a ttl after its last record was stored.
+type redisSessions struct {
+	client *goredis.Client
+	prefix string
+}
+
+func (r *redisSessions) key(username string) string {
+	return fmt.Sprintf("%s%s", r.prefix, username)
+}
+
+func (r *redisSessions) get(username, clientid string) (string, bool) {
+	record, err := r.client.HGet(r.key(username), clientid).Result()
+	return record, err == nil
+}
+
+func (r *redisSessions) put(username, clientid, record string, ttl time.Duration) {
+	key := r.key(username)
+	pipe := r.client.TxPipeline()
+	pipe.HSet(key, clientid, record)
+	pipe.Expire(key, ttl)
+	pipe.Exec()
+}
+
+func (r *redisSessions) drop(username string) {
+	r.client.Del(r.key(username))
+}
+
+func (r *redisSessions) dropAll() {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, r.prefix+"*", 100).Result()
+		if err != nil {
+			return
+		}
+		if len(keys) > 0 {
+			r.client.Del(keys...)
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSessions(t *testing.T) {
+
+	Convey("Given local sessions, a minted one should answer auth and recorded acls until dropped", t, func() {
+		sessions := NewLocalSessions([]byte("secret"), time.Minute, 2)
+		sessions.Mint("test", "client", "pass", "files")
+
+		session, ok := sessions.Auth("test", "client", "pass")
+		So(ok, ShouldBeTrue)
+		So(session.Backend, ShouldEqual, "files")
+		So(session.Password, ShouldNotEqual, "pass")
+
+		_, ok = sessions.Auth("test", "client", "wrong")
+		So(ok, ShouldBeFalse)
+		_, ok = sessions.Auth("test", "other", "pass")
+		So(ok, ShouldBeFalse)
+
+		_, known := session.Acl("test/topic", 1)
+		So(known, ShouldBeFalse)
+
+		sessions.RecordAcl(session, "test/topic", 1, true, false)
+		sessions.RecordAcl(session, "test/topic", 2, false, false)
+		//Once maxAcls are recorded, further decisions aren't.
+		sessions.RecordAcl(session, "other/topic", 1, true, false)
+
+		session, ok = sessions.Load("test", "client")
+		So(ok, ShouldBeTrue)
+		granted, known := session.Acl("test/topic", 1)
+		So(known, ShouldBeTrue)
+		So(granted, ShouldBeTrue)
+		granted, known = session.Acl("test/topic", 2)
+		So(known, ShouldBeTrue)
+		So(granted, ShouldBeFalse)
+		_, known = session.Acl("other/topic", 1)
+		So(known, ShouldBeFalse)
+
+		sessions.Drop("test")
+		_, ok = sessions.Load("test", "client")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given a superuser grant, the session should grant every acl", t, func() {
+		sessions := NewLocalSessions([]byte("secret"), time.Minute, 0)
+		sessions.Mint("admin", "client", "pass", "files")
+
+		session, _ := sessions.Load("admin", "client")
+		sessions.RecordAcl(session, "any/topic", 2, true, true)
+
+		session, ok := sessions.Load("admin", "client")
+		So(ok, ShouldBeTrue)
+		granted, known := session.Acl("other/topic", 4)
+		So(known, ShouldBeTrue)
+		So(granted, ShouldBeTrue)
+
+		sessions.DropAll()
+		_, ok = sessions.Load("admin", "client")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given an expired session, it should be ignored", t, func() {
+		sessions := NewLocalSessions([]byte("secret"), time.Minute, 10)
+		sessions.save(&Session{Username: "test", Clientid: "client", Expires: time.Now().Add(-time.Second).Unix()})
+
+		_, ok := sessions.Load("test", "client")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given a tampered record or one signed with another secret, it should be rejected", t, func() {
+		sessions := NewLocalSessions([]byte("secret"), time.Minute, 10)
+		sessions.Mint("test", "client", "pass", "files")
+
+		store := sessions.store.(*localSessions)
+		entry := store.records["test"]["client"]
+		entry.record = "{\"username\":\"test\",\"clientid\":\"client\",\"superuser\":true" + entry.record[len("{\"username\":\"test\",\"clientid\":\"client\""):]
+		store.records["test"]["client"] = entry
+
+		_, ok := sessions.Load("test", "client")
+		So(ok, ShouldBeFalse)
+
+		sessions.Mint("test", "client", "pass", "files")
+		other := NewLocalSessions([]byte("other"), time.Minute, 10)
+		other.store = sessions.store
+		_, ok = other.Load("test", "client")
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Given hinted cache ttls, sessions should only keep decisions that may be cached for as long as they last", t, func() {
+		sessions := NewLocalSessions([]byte("secret"), time.Minute, 10)
+		So(sessions.Keeps(time.Minute), ShouldBeTrue)
+		So(sessions.Keeps(time.Hour), ShouldBeTrue)
+		So(sessions.Keeps(time.Second), ShouldBeFalse)
+		So(sessions.Keeps(0), ShouldBeFalse)
+	})
+
+	Convey("Given nil sessions, nothing should be kept", t, func() {
+		var sessions *Sessions
+		sessions.Mint("test", "client", "pass", "files")
+		_, ok := sessions.Auth("test", "client", "pass")
+		So(ok, ShouldBeFalse)
+		sessions.RecordAcl(nil, "test/topic", 1, true, false)
+		So(sessions.Keeps(time.Hour), ShouldBeFalse)
+		sessions.Drop("test")
+		sessions.DropAll()
+	})
+}
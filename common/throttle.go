@@ -0,0 +1,98 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+//Check kinds of backend calls, from the one throttling sheds last to the one it sheds first.
+const (
+	CheckUser      = "user"
+	CheckAcl       = "acl"
+	CheckSuperuser = "superuser"
+	CheckShadow    = "shadow"
+)
+
+//CheckKinds lists every check kind of backend calls.
+var CheckKinds = []string{CheckUser, CheckAcl, CheckSuperuser, CheckShadow}
+
+//throttleWeight is the weight of a new latency in the throttle's moving average.
+const throttleWeight = 0.2
+
+//Throttle sheds calls to a backend by check kind while its latency is over a threshold, so user checks clients need to connect keep being answered when the backend is slow.
+//Superuser and shadow calls are shed once the average latency crosses the threshold, and acl calls once it crosses twice the threshold. User calls are never shed.
+//While a kind is shed, a probe call of it is still let through every probe interval, so the average may recover.
+type Throttle struct {
+	sync.Mutex
+	threshold time.Duration
+	probe     time.Duration
+	latency   time.Duration
+	probed    map[string]time.Time
+}
+
+//NewThrottle returns a throttle shedding calls when the average latency crosses threshold, probing shed kinds every probe.
+func NewThrottle(threshold, probe time.Duration) *Throttle {
+	return &Throttle{
+		threshold: threshold,
+		probe:     probe,
+		probed:    make(map[string]time.Time),
+	}
+}
+
+//Observe adds the latency of a call to the moving average.
+func (t *Throttle) Observe(latency time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.latency == 0 {
+		t.latency = latency
+		return
+	}
+	t.latency = time.Duration(throttleWeight*float64(latency) + (1-throttleWeight)*float64(t.latency))
+}
+
+//Latency returns the moving average of calls' latency.
+func (t *Throttle) Latency() time.Duration {
+	if t == nil {
+		return 0
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	return t.latency
+}
+
+//Admit tells if a call of the given kind may be made at now, or should be shed given the average latency.
+func (t *Throttle) Admit(kind string, now time.Time) bool {
+	if t == nil {
+		return true
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	var limit time.Duration
+	switch kind {
+	case CheckSuperuser, CheckShadow:
+		limit = t.threshold
+	case CheckAcl:
+		limit = 2 * t.threshold
+	default:
+		return true
+	}
+
+	if t.latency <= limit {
+		return true
+	}
+	if now.Sub(t.probed[kind]) < t.probe {
+		return false
+	}
+
+	t.probed[kind] = now
+	return true
+}
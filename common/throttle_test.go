@@ -0,0 +1,67 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestThrottle(t *testing.T) {
+
+	Convey("Given latency under the threshold, no call should be shed", t, func() {
+		throttle := NewThrottle(100*time.Millisecond, time.Second)
+		throttle.Observe(50 * time.Millisecond)
+		now := time.Now()
+
+		for _, kind := range CheckKinds {
+			So(throttle.Admit(kind, now), ShouldBeTrue)
+		}
+	})
+
+	Convey("Given latency over the threshold, superuser calls should be shed before acl ones", t, func() {
+		throttle := NewThrottle(100*time.Millisecond, time.Second)
+		throttle.Observe(150 * time.Millisecond)
+		now := time.Now()
+
+		//The first shed call of each kind is let through as a probe.
+		So(throttle.Admit(CheckSuperuser, now), ShouldBeTrue)
+		So(throttle.Admit(CheckSuperuser, now), ShouldBeFalse)
+		So(throttle.Admit(CheckShadow, now), ShouldBeTrue)
+		So(throttle.Admit(CheckShadow, now), ShouldBeFalse)
+		So(throttle.Admit(CheckAcl, now), ShouldBeTrue)
+		So(throttle.Admit(CheckAcl, now), ShouldBeTrue)
+		So(throttle.Admit(CheckUser, now), ShouldBeTrue)
+
+		So(throttle.Admit(CheckSuperuser, now.Add(time.Second)), ShouldBeTrue)
+	})
+
+	Convey("Given latency over twice the threshold, acl calls should be shed but user ones admitted", t, func() {
+		throttle := NewThrottle(100*time.Millisecond, time.Second)
+		throttle.Observe(300 * time.Millisecond)
+		now := time.Now()
+
+		So(throttle.Admit(CheckAcl, now), ShouldBeTrue)
+		So(throttle.Admit(CheckAcl, now), ShouldBeFalse)
+		So(throttle.Admit(CheckUser, now), ShouldBeTrue)
+		So(throttle.Admit(CheckUser, now), ShouldBeTrue)
+	})
+
+	Convey("Given faster calls, the average latency should recover", t, func() {
+		throttle := NewThrottle(100*time.Millisecond, time.Second)
+		throttle.Observe(300 * time.Millisecond)
+		for i := 0; i < 20; i++ {
+			throttle.Observe(10 * time.Millisecond)
+		}
+
+		So(throttle.Latency(), ShouldBeLessThan, 100*time.Millisecond)
+		So(throttle.Admit(CheckSuperuser, time.Now()), ShouldBeTrue)
+	})
+
+	Convey("Given no throttle, every call should be admitted", t, func() {
+		var throttle *Throttle
+		throttle.Observe(time.Second)
+		So(throttle.Admit(CheckSuperuser, time.Now()), ShouldBeTrue)
+		So(throttle.Latency(), ShouldEqual, 0)
+	})
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//Trace records the decision path of a single check, such as the backends consulted and their results.
+//A nil *Trace is valid and records nothing, so checks that aren't traced don't need to care.
+type Trace struct {
+	Check    string
+	Username string
+	Steps    []string
+	start    time.Time
+}
+
+//NewTrace starts a trace for a check (auth or acl) of username.
+func NewTrace(check, username string) *Trace {
+	return &Trace{
+		Check:    check,
+		Username: username,
+		start:    time.Now(),
+	}
+}
+
+//Step records a step of the decision, prefixed by the time elapsed since the check started.
+func (t *Trace) Step(format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, fmt.Sprintf("[%s] %s", time.Since(t.start), fmt.Sprintf(format, args...)))
+}
+
+//Log logs the whole decision path with the check's result in a single entry.
+func (t *Trace) Log(granted bool) {
+	if t == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"check":    t.Check,
+		"username": t.Username,
+		"granted":  granted,
+		"took":     time.Since(t.start).String(),
+	}).Infof("decision trace: %s", strings.Join(t.Steps, "; "))
+}
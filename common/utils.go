@@ -2,6 +2,7 @@ package common
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
@@ -29,22 +30,94 @@ func OpenDatabase(dsn, engine string) (*sqlx.DB, error) {
 		return nil, errors.Wrap(err, "database connection error")
 	}
 
+	pingDatabase(db)
+
+	return db, nil
+}
+
+//pingDatabase blocks until the database answers a ping.
+func pingDatabase(db *sqlx.DB) {
 	for {
-		if err = db.Ping(); err != nil {
+		if err := db.Ping(); err != nil {
 			log.Errorf("ping database error, will retry in 2s: %s", err)
 			time.Sleep(2 * time.Second)
 		} else {
 			break
 		}
 	}
+}
 
-	return db, nil
+//strictTopics makes TopicsMatch follow the MQTT spec on edge cases.
+var strictTopics bool
+
+//SetStrictTopicMatching sets whether TopicsMatch strictly follows the MQTT spec, instead of the lenient matching kept for compatibility.
+//When strict, topics starting with $ (e.g. $SYS ones) aren't matched by wildcards at the first level, filters with a wildcard not taking a whole level or with # not at the last one are invalid and match nothing,
+//empty topics and topics with null characters match nothing, and a given filter (as in subscribe checks) with # at a level is only matched by # at a saved one.
+func SetStrictTopicMatching(strict bool) {
+	strictTopics = strict
 }
 
+//TopicsMatch checks if givenTopic is matched by savedTopic, which may have wildcards.
 func TopicsMatch(savedTopic, givenTopic string) bool {
+	if strictTopics {
+		return strictTopicsMatch(savedTopic, givenTopic)
+	}
 	return givenTopic == savedTopic || match(strings.Split(savedTopic, "/"), strings.Split(givenTopic, "/"))
 }
 
+func strictTopicsMatch(savedTopic, givenTopic string) bool {
+	if !validTopic(savedTopic) || !validTopic(givenTopic) {
+		return false
+	}
+
+	route := strings.Split(savedTopic, "/")
+	topic := strings.Split(givenTopic, "/")
+	if !validFilter(route) || !validFilter(topic) {
+		return false
+	}
+
+	if strings.HasPrefix(givenTopic, "$") && (route[0] == "+" || route[0] == "#") {
+		return false
+	}
+
+	for i, level := range route {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if level == "+" {
+			if topic[i] == "#" {
+				return false
+			}
+			continue
+		}
+		if level != topic[i] {
+			return false
+		}
+	}
+
+	return len(route) == len(topic)
+}
+
+func validTopic(topic string) bool {
+	return topic != "" && !strings.ContainsRune(topic, 0)
+}
+
+//validFilter checks wildcards take whole levels and # is only at the last one.
+func validFilter(levels []string) bool {
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+		if level != "+" && level != "#" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
 func match(route []string, topic []string) bool {
 	if len(route) == 0 {
 		if len(topic) == 0 {
@@ -123,17 +196,142 @@ func hashWithSalt(password string, salt []byte, iterations int, algorithm string
 }
 
 // HashCompare verifies that passed password hashes to the same value as the
-// passed passwordHash.
-// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
+// passed passwordHash, using the first registered hasher matching its format.
 func HashCompare(password string, passwordHash string) bool {
-	// SPlit the hash string into its parts.
-	hashSplit := strings.Split(passwordHash, "$")
+	hasher, ok := hasherFor(passwordHash)
+	if !ok {
+		return false
+	}
+	return hasher.Compare(password, passwordHash)
+}
 
-	// Get the iterations and the salt and use them to encode the password
-	// being compared.cre
-	iterations, _ := strconv.Atoi(hashSplit[2])
-	salt, _ := base64.StdEncoding.DecodeString(hashSplit[3])
-	algorithm := hashSplit[1]
+// pbkdf2Compare verifies a password against a PBKDF2 hash created by Hash.
+// Taken from brocaar's lora-app-server: https://github.com/brocaar/lora-app-server
+func pbkdf2Compare(password string, passwordHash string) bool {
+	algorithm, iterations, salt, err := pbkdf2Params(passwordHash)
+	if err != nil {
+		return false
+	}
 	newHash := hashWithSalt(password, salt, iterations, algorithm)
 	return newHash == passwordHash
 }
+
+//pbkdf2Params parses the algorithm, iterations and salt of a PBKDF2 hash, failing for hashes with more than MaxHashIterations.
+func pbkdf2Params(passwordHash string) (string, int, []byte, error) {
+	hashSplit := strings.Split(passwordHash, "$")
+	if len(hashSplit) != 5 {
+		return "", 0, nil, errors.New("PBKDF2 hashes must be PBKDF2$<algorithm>$<iterations>$<salt>$<hash>")
+	}
+
+	iterations, err := checkIterations(hashSplit[2])
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(hashSplit[3])
+	if err != nil {
+		return "", 0, nil, errors.Wrap(err, "bad salt")
+	}
+	if _, err := base64.StdEncoding.DecodeString(hashSplit[4]); err != nil {
+		return "", 0, nil, errors.Wrap(err, "bad hash")
+	}
+	return hashSplit[1], iterations, salt, nil
+}
+
+//checkIterations parses the iterations of a hash, which must be positive and no more than MaxHashIterations.
+func checkIterations(value string) (int, error) {
+	iterations, err := strconv.Atoi(value)
+	if err != nil || iterations <= 0 {
+		return 0, errors.Errorf("bad iterations %s", value)
+	}
+	if iterations > MaxHashIterations {
+		return 0, errors.Errorf("%d iterations exceed the maximum of %d", iterations, MaxHashIterations)
+	}
+	return iterations, nil
+}
+
+//scramPrefix identifies SCRAM-SHA-256 stored credentials.
+const scramPrefix = "SCRAM-SHA-256$"
+
+//ScramHash returns SCRAM-SHA-256 stored credentials for a password in the format used by Postgres (RFC 5803):
+//SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>, with salt and keys base64 encoded.
+func ScramHash(password string, saltSize int, iterations int) (string, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "read random bytes error")
+	}
+
+	storedKey, serverKey := scramKeys(password, salt, iterations)
+
+	return fmt.Sprintf("%s%d:%s$%s:%s", scramPrefix, iterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey),
+		base64.StdEncoding.EncodeToString(serverKey)), nil
+}
+
+//scramKeys derives the StoredKey and ServerKey for a password as defined in RFC 5802.
+func scramKeys(password string, salt []byte, iterations int) ([]byte, []byte) {
+	saltedPassword := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+
+	clientKey := hmacSha256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSha256(saltedPassword, "Server Key")
+
+	return storedKey[:], serverKey
+}
+
+func hmacSha256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+//scramCompare verifies a password against SCRAM-SHA-256 stored credentials.
+//Passwords aren't SASLprep normalized, so non ASCII passwords must have been stored normalized the same way they're sent by clients.
+func scramCompare(password, passwordHash string) bool {
+	iterations, salt, storedKey, serverKey, err := scramParams(passwordHash)
+	if err != nil {
+		return false
+	}
+
+	newStoredKey, newServerKey := scramKeys(password, salt, iterations)
+
+	return hmac.Equal(storedKey, newStoredKey) && hmac.Equal(serverKey, newServerKey)
+}
+
+//scramParams parses the iterations, salt and keys of SCRAM-SHA-256 stored credentials, failing for credentials with more than MaxHashIterations.
+func scramParams(passwordHash string) (int, []byte, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(passwordHash, scramPrefix), "$")
+	if len(parts) != 2 {
+		return 0, nil, nil, nil, errors.New("SCRAM-SHA-256 hashes must be SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>")
+	}
+
+	params := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(params) != 2 || len(keys) != 2 {
+		return 0, nil, nil, nil, errors.New("SCRAM-SHA-256 hashes must be SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>")
+	}
+
+	iterations, err := checkIterations(params[0])
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(params[1])
+	if err != nil {
+		return 0, nil, nil, nil, errors.Wrap(err, "bad salt")
+	}
+
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil {
+		return 0, nil, nil, nil, errors.Wrap(err, "bad StoredKey")
+	}
+
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	if err != nil {
+		return 0, nil, nil, nil, errors.Wrap(err, "bad ServerKey")
+	}
+
+	return iterations, salt, storedKey, serverKey, nil
+}
@@ -0,0 +1,105 @@
+package common
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+//topicCase is a saved topic and a given one, with whether they match in compatibility and strict modes.
+type topicCase struct {
+	saved  string
+	given  string
+	compat bool
+	strict bool
+}
+
+var topicCases = []topicCase{
+	//Plain topics.
+	{"a/b/c", "a/b/c", true, true},
+	{"a/b/c", "a/b", false, false},
+	{"a/b", "a/b/c", false, false},
+	{"a/b/c", "a/B/c", false, false},
+	{"/a", "/a", true, true},
+	{"/a", "a", false, false},
+
+	//Single level wildcards.
+	{"a/+/c", "a/b/c", true, true},
+	{"a/+/c", "a/b/d", false, false},
+	{"a/+", "a/b", true, true},
+	{"a/+", "a/b/c", false, false},
+	{"a/+", "a", false, false},
+	{"+", "a", true, true},
+	{"+", "/a", false, false},
+	{"+/+", "/a", true, true},
+	{"/+", "/a", true, true},
+	{"+/b/+", "a/b/c", true, true},
+
+	//Multi level wildcards.
+	{"#", "a", true, true},
+	{"#", "a/b/c", true, true},
+	{"#", "/a", true, true},
+	{"a/#", "a/b/c", true, true},
+	{"a/#", "a", true, true},
+	{"a/#", "b/c", false, false},
+	{"a/+/#", "a/b", true, true},
+	{"a/+/#", "a", false, false},
+
+	//Trailing slashes are an empty level, matched by + and #.
+	{"a/", "a/", true, true},
+	{"a/", "a", false, false},
+	{"a", "a/", false, false},
+	{"a/+", "a/", true, true},
+	{"a/#", "a/", true, true},
+	{"a/b/", "a/b", false, false},
+
+	//Topics starting with $ aren't matched by first level wildcards in strict mode.
+	{"#", "$SYS/broker/uptime", true, false},
+	{"+/broker/uptime", "$SYS/broker/uptime", true, false},
+	{"+/#", "$SYS/broker", true, false},
+	{"$SYS/#", "$SYS/broker/uptime", true, true},
+	{"$SYS/+/uptime", "$SYS/broker/uptime", true, true},
+	{"a/#", "a/$b", true, true},
+	{"a/+", "a/$b", true, true},
+
+	//Wildcards not taking a whole level, or # not at the last one, are invalid filters in strict mode.
+	{"a/#/c", "a/b/c", true, false},
+	{"a+", "a+", true, false},
+	{"a/b#", "a/b#", true, false},
+	{"a/+b", "a/+b", true, false},
+	{"a/#", "a/b#", true, false},
+
+	//Given filters, as in subscribe checks.
+	{"a/#", "a/+", true, true},
+	{"a/#", "a/#", true, true},
+	{"#", "#", true, true},
+	{"a/+", "a/+", true, true},
+	{"a/+", "a/#", true, false},
+	{"a/+/c", "a/#", false, false},
+	{"a/b", "a/+", false, false},
+	{"+", "#", true, false},
+
+	//Empty topics and topics with null characters are invalid in strict mode.
+	{"", "", true, false},
+	{"#", "", true, false},
+	{"a/#", "a/\x00", true, false},
+}
+
+func TestTopicsMatch(t *testing.T) {
+
+	Convey("Given compatibility mode, topics should match leniently", t, func() {
+		SetStrictTopicMatching(false)
+		for _, c := range topicCases {
+			So(TopicsMatch(c.saved, c.given), ShouldEqual, c.compat)
+		}
+	})
+
+	Convey("Given strict mode, topics should match following the MQTT spec", t, func() {
+		SetStrictTopicMatching(true)
+		defer SetStrictTopicMatching(false)
+		for _, c := range topicCases {
+			So(TopicsMatch(c.saved, c.given), ShouldEqual, c.strict)
+		}
+	})
+
+}
@@ -0,0 +1,18 @@
+create table test_user(
+id mediumint not null auto_increment,
+username varchar(100) not null,
+password_hash varchar(200) not null,
+is_admin boolean not null,
+primary key(id)
+);
+
+create table test_acl(
+id mediumint not null auto_increment,
+test_user_id mediumint not null,
+topic varchar(200) not null,
+rw int not null,
+primary key(id),
+foreign key(test_user_id) references test_user(id)
+ON DELETE CASCADE
+ON UPDATE CASCADE
+);
@@ -3,10 +3,23 @@ package main
 import "C"
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"path"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,15 +30,11 @@ import (
 
 	goredis "github.com/go-redis/redis"
 	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
+	"github.com/iegomez/mosquitto-go-auth/metrics"
 )
 
-type Backend interface {
-	GetUser(username, password string) bool
-	GetSuperuser(username string) bool
-	CheckAcl(username, topic, clientId string, acc int32) bool
-	GetName() string
-	Halt()
-}
+type Backend = bes.Backend
 
 type CommonData struct {
 	Backends         map[string]Backend
@@ -43,11 +52,119 @@ type CommonData struct {
 	RedisCache       *goredis.Client
 	CheckPrefix      bool
 	Prefixes         map[string]string
+	AclRoutes        common.AclRoutes
+	AutoRegister     bool
+	Registrar        string
+	RegisterPattern  *regexp.Regexp
+	BootstrapAcls    []string
+	PasswordMaxAge   time.Duration
+	RestrictExpired  bool
+	ExpiredAcls      []string
+	Metrics          *metrics.StatsD
+	TopN             int
+	TopDeniedUsers   *metrics.TopN
+	TopTopics        *metrics.TopN
+	DebugVars        *common.DebugVars
+	TopTopicLevels   int
+	TraceUsernames   map[string]bool
+	TraceClientids   map[string]bool
+	DebugFilter      *common.DebugFilter
+	InputLimits      InputLimits
+	Lockout          common.Lockout
+	CheckBudget      time.Duration
+	BackendTimeouts  map[string]time.Duration
+	MaxInflight      int64
+	MaxGoroutines    int
+	Breakers         map[string]*common.Breaker
+	BreakerFailOpen  bool
+	Throttles        map[string]*common.Throttle
+	Prewarm          bool
+	PrewarmTopics    []string
+	PrewarmMax       int
+	Prewarmer        *common.Prewarmer
+	RecentTopics     *common.RecentTopics
+	Standbys         map[string]string
+	Syncs            map[string]string
+	DualWrites       map[string]string
+	LockoutRedis     *goredis.Client
+	Connections      common.ConnectionTracker
+	ConnectionLimit  int
+	ConnectionsRedis *goredis.Client
+	PolicyUpdates    *goredis.Client
+	Sessions         *common.Sessions
+	SessionBackends  map[string]bool
+	SessionsRedis    *goredis.Client
+	SelfTests        []common.SelfTestCase
+	ReadOnly         bool
+	SysPolicy        string
+	SysUsers         []string
+	RetainedPolicy   string
+	RetainedAcls     []string
+	Revocation       *common.Revocation
+	Audit            *common.AuditBuffer
+	RevocationSoft   bool
+	Bypass           *common.Bypass
+	ServiceAccounts  *common.ServiceAccounts
+	Degradation      *common.Degradation
+	SuperuserBackend string
+	ShadowBackend    string
+	AclBackendFirst  bool
+	DetailedResults  bool
 	LogLevel         log.Level
 	LogDest          string
 	LogFile          string
 }
 
+//InputLimits holds the maximum lengths accepted for check inputs, 0 meaning no limit.
+type InputLimits struct {
+	Username int
+	Password int
+	Clientid int
+	Topic    int
+}
+
+//Decision is the outcome of a check: whether it was granted, the backend that decided it and why.
+//Backend is the backend's id as given at the backends option (or plugin), and is empty when no backend decided it.
+type Decision struct {
+	Granted bool
+	Backend string
+	Reason  string
+}
+
+//Reasons for decisions.
+const (
+	ReasonInputLimits     = "input_limits"
+	ReasonLockedOut       = "locked_out"
+	ReasonCache           = "cache"
+	ReasonUser            = "user"
+	ReasonSuperuser       = "superuser"
+	ReasonAcl             = "acl"
+	ReasonNotGranted      = "not_granted"
+	ReasonPasswordExpired = "password_expired"
+	ReasonAutoRegister    = "auto_registration"
+	ReasonBootstrapAcls   = "bootstrap_acls"
+	ReasonExpiredAcls     = "expired_acls"
+	ReasonManifest        = "manifest"
+	ReasonConnectionLimit = "connection_limit"
+	ReasonSysPolicy       = "sys_policy"
+	ReasonBypass          = "bypass"
+	ReasonTokenExpired    = "token_expired"
+	ReasonServiceAccount  = "service_account"
+	ReasonDegraded        = "degraded"
+	ReasonSession         = "session"
+	ReasonRetainedPolicy  = "retained_policy"
+	ReasonRevoked         = "certificate_revoked"
+)
+
+//Results of checks returned to mosquitto, which auth-plugin.c maps to its return codes.
+//Unless detailed return codes are enabled, checks are only granted or denied.
+const (
+	ResultGranted  = 0 //MOSQ_ERR_SUCCESS
+	ResultDenied   = 1 //MOSQ_ERR_AUTH for user checks, MOSQ_ERR_ACL_DENIED for acl ones.
+	ResultDeferred = 2 //MOSQ_ERR_PLUGIN_DEFER: no backend knew the user, so other plugins may decide.
+	ResultError    = 3 //MOSQ_ERR_UNKNOWN: backends couldn't decide, being unavailable or misconfigured.
+)
+
 //Cache stores necessary values for Redis cache
 type Cache struct {
 	Host     string
@@ -57,22 +174,53 @@ type Cache struct {
 }
 
 var allowedBackends = map[string]bool{
-	"postgres": true,
-	"jwt":      true,
-	"redis":    true,
-	"http":     true,
-	"files":    true,
-	"mysql":    true,
-	"sqlite":   true,
-	"mongo":    true,
-	"plugin":   true,
-	"grpc":     true,
-}
-
-var backends []string          //List of selected backends.
-var authOpts map[string]string //Options passed by mosquitto.
-var cache Cache                //Cache conf.
-var commonData CommonData      //General struct with options and conf.
+	"postgres":      true,
+	"jwt":           true,
+	"redis":         true,
+	"http":          true,
+	"files":         true,
+	"mysql":         true,
+	"sqlite":        true,
+	"mongo":         true,
+	"plugin":        true,
+	"grpc":          true,
+	"peercred":      true,
+	"bolt":          true,
+	"introspection": true,
+	"oidc":          true,
+	"keycloak":      true,
+	"opa":           true,
+	"javascript":    true,
+	"mssql":         true,
+	"oracle":        true,
+}
+
+//hintedSuffix marks cached values whose expiration was hinted by a backend, so it's not refreshed on cache hits.
+const hintedSuffix = ":hinted"
+
+var backends []string                    //List of selected backends.
+var authOpts map[string]string           //Options passed by mosquitto.
+var optionSources map[string]string      //Source of every option set by a source other than mosquitto, as shown by the startup banner.
+var cache Cache                          //Cache conf.
+var commonData CommonData                //General struct with options and conf.
+var restrictedUsers sync.Map             //Users authenticated with an expired password, restricted to ExpiredAcls.
+var userManifests sync.Map               //Permission manifests given by backends at authentication, by manifestKey.
+var backendInflight map[string]*int64    //Calls in flight per backend, including timed out ones still running.
+var checkInflight map[string]*int64      //Calls in flight per check kind, including timed out ones still running.
+var primariesDown sync.Map               //Primary backends found unreachable, whose standby is promoted in their place.
+var selfTestFailing bool                 //Whether the last self test found unexpected results.
+var backgroundStop = make(chan struct{}) //Closed on cleanup to stop standby health checks and syncs.
+var backendsLock sync.RWMutex            //Held for reading by checks and background tasks using backends, and for writing while swapping them.
+var adminServer *http.Server             //Admin api server, nil unless admin_address is given.
+var debugServer *http.Server             //Debug listener, nil unless debug_address is given.
+
+//swapper swaps backends through the admin api.
+var swapper = &bes.Swapper{
+	Load:   runningBackends,
+	Store:  storeBackends,
+	Create: createBackend,
+	Check:  checkSwap,
+}
 
 //export AuthPluginInit
 func AuthPluginInit(keys []string, values []string, authOptsNum int) {
@@ -100,9 +248,16 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		AuthCacheSeconds: 30,
 		CheckPrefix:      false,
 		Prefixes:         make(map[string]string),
+		TraceUsernames:   make(map[string]bool),
+		TraceClientids:   make(map[string]bool),
 		LogLevel:         log.InfoLevel,
 	}
 
+	//Options from a config file, if given, come first so the ones given to mosquitto override them.
+	optionSources = make(map[string]string)
+	keys, values = withConfigFile(keys[:authOptsNum], values[:authOptsNum])
+	authOptsNum = len(keys)
+
 	//First, get backends
 	backendsOk := false
 	authOpts = make(map[string]string)
@@ -115,6 +270,9 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 					if _, ok := allowedBackends[backend]; !ok {
 						backendsCheck = false
 						log.Errorf("backend not allowed: %s", backend)
+					} else if backend != "plugin" && !bes.Compiled(backend) {
+						backendsCheck = false
+						log.Errorf("backend not compiled in this build: %s", backend)
 					}
 				}
 				backendsOk = backendsCheck
@@ -171,6 +329,9 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		}
 	}
 
+	//Acl limits are set before initializing backends, as some of them load acls when starting.
+	setAclLimits()
+
 	//Initialize backends
 	for _, bename := range backends {
 		var beIface Backend
@@ -181,6 +342,16 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 			if plErr != nil {
 				log.Errorf("Could not init custom plugin: %s", plErr)
 				commonData.Plugin = nil
+			} else if backend, ok, pbErr := bes.NewPluginBackend(plug, authOpts, commonData.LogLevel); ok {
+				//The plugin exports a backend implementing the versioned interface rather than check functions.
+				if pbErr != nil {
+					log.Errorf("Couldn't init plugin backend: %s", pbErr)
+					commonData.Plugin = nil
+					continue
+				}
+				commonData.Plugin = plug
+				setPluginBackend(backend)
+				log.Infof("Backend registered: %s (id plugin, backend interface version %d)", backend.GetName(), bes.PluginInterfaceVersion)
 			} else {
 				commonData.Plugin = plug
 
@@ -264,83 +435,16 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 				haltFunc := plHalt.(func())
 				commonData.PHalt = haltFunc
 
-				log.Infof("Backend registered: %s", commonData.PGetName())
+				log.Infof("Backend registered: %s (id plugin)", commonData.PGetName())
 
 			}
 		} else {
-			switch bename {
-			case "postgres":
-				beIface, bErr = bes.NewPostgres(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["postgres"] = beIface.(bes.Postgres)
-				}
-			case "jwt":
-				beIface, bErr = bes.NewJWT(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["jwt"] = beIface.(bes.JWT)
-				}
-			case "files":
-				beIface, bErr = bes.NewFiles(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["files"] = beIface.(bes.Files)
-				}
-			case "redis":
-				beIface, bErr = bes.NewRedis(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["redis"] = beIface.(bes.Redis)
-				}
-			case "mysql":
-				beIface, bErr = bes.NewMysql(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["mysql"] = beIface.(bes.Mysql)
-				}
-			case "http":
-				beIface, bErr = bes.NewHTTP(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["http"] = beIface.(bes.HTTP)
-				}
-			case "sqlite":
-				beIface, bErr = bes.NewSqlite(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["sqlite"] = beIface.(bes.Sqlite)
-				}
-			case "mongo":
-				beIface, bErr = bes.NewMongo(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["mongo"] = beIface.(bes.Mongo)
-				}
-			case "grpc":
-				beIface, bErr = bes.NewGRPC(authOpts, commonData.LogLevel)
-				if bErr != nil {
-					log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
-				} else {
-					log.Infof("Backend registered: %s", beIface.GetName())
-					cmbackends["grpc"] = beIface.(bes.GRPC)
-				}
+			beIface, bErr = bes.New(bename, authOpts, commonData.LogLevel)
+			if bErr != nil {
+				log.Fatalf("Backend register error: couldn't initialize %s backend with error %s.", bename, bErr)
+			} else {
+				logBackend(bename, beIface)
+				cmbackends[bename] = beIface
 			}
 		}
 
@@ -396,16 +500,34 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 
 		}
 
+		if order, ok := authOpts["acl_check_order"]; ok {
+			switch strings.TrimSpace(order) {
+			case "cache_first":
+				commonData.AclBackendFirst = false
+			case "backend_first":
+				commonData.AclBackendFirst = true
+				log.Info("token expiry will be checked before the acl cache")
+			default:
+				log.Warningf("unknown acl_check_order %s, defaulting to cache_first", order)
+			}
+		}
+
 		addr := fmt.Sprintf("%s:%s", cache.Host, cache.Port)
 
+		dialer, err := common.NewDialer(authOpts, "cache")
+		if err != nil {
+			log.Errorf("couldn't set cache dialer, using the default one. error: %s", err)
+		}
+
 		//If cache is on, try to start redis.
 		goredisClient := goredis.NewClient(&goredis.Options{
 			Addr:     addr,
 			Password: cache.Password, // no password set
 			DB:       int(cache.DB),  // use default DB
+			Dialer:   dialer.RedisDialer(addr),
 		})
 
-		_, err := goredisClient.Ping().Result()
+		_, err = goredisClient.Ping().Result()
 		if err != nil {
 			log.Errorf("couldn't start Redis, defaulting to no cache. error: %s", err)
 			commonData.UseCache = false
@@ -445,303 +567,4054 @@ func AuthPluginInit(keys []string, values []string, authOptsNum int) {
 		commonData.CheckPrefix = false
 	}
 
+	if aclRoutes, ok := authOpts["acl_routes"]; ok {
+		commonData.AclRoutes = parseAclRoutes(aclRoutes)
+	}
+
 	commonData.Backends = cmbackends
 
-}
+	commonData.InputLimits = InputLimits{
+		Username: parseLimit("max_username_length"),
+		Password: parseLimit("max_password_length"),
+		Clientid: parseLimit("max_clientid_length"),
+		Topic:    parseLimit("max_topic_length"),
+	}
 
-//export AuthUnpwdCheck
-func AuthUnpwdCheck(username, password string) bool {
+	if traceUsernames, ok := authOpts["trace_usernames"]; ok {
+		for _, username := range strings.Split(strings.Replace(traceUsernames, " ", "", -1), ",") {
+			if username != "" {
+				commonData.TraceUsernames[username] = true
+			}
+		}
+	}
 
-	authenticated := false
-	var cached = false
-	var granted = false
-	if commonData.UseCache {
-		log.Debugf("checking auth cache for %s", username)
-		cached, granted = CheckAuthCache(username, password)
-		if cached {
-			log.Debugf("found in cache: %s", username)
-			return granted
+	if traceClientids, ok := authOpts["trace_clientids"]; ok {
+		for _, clientid := range strings.Split(strings.Replace(traceClientids, " ", "", -1), ",") {
+			if clientid != "" {
+				commonData.TraceClientids[clientid] = true
+			}
 		}
 	}
 
-	//If prefixes are enabled, checkt if username has a valid prefix and use the correct backend if so.
-	if commonData.CheckPrefix {
-		validPrefix, bename := CheckPrefix(username)
-		if validPrefix {
+	setDebugFilter()
 
-			if bename == "plugin" {
-				authenticated = CheckPluginAuth(username, password)
-			} else {
+	if statsd, ok := authOpts["statsd"]; ok && strings.Replace(statsd, " ", "", -1) == "true" {
+		sink, err := metrics.NewStatsD(authOpts, commonData.LogLevel)
+		if err != nil {
+			log.Errorf("couldn't start StatsD metrics: %s", err)
+		} else {
+			commonData.Metrics = sink
+			log.Infof("sending StatsD metrics to %s:%s", sink.Host, sink.Port)
+		}
+	}
 
-				var backend = commonData.Backends[bename]
+	if topN, ok := authOpts["statsd_top_n"]; ok && commonData.Metrics != nil {
+		setTopN(topN)
+	}
 
-				if backend.GetUser(username, password) {
-					authenticated = true
-					log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
-				}
+	if strict, ok := authOpts["strict_topic_matching"]; ok && strings.Replace(strict, " ", "", -1) == "true" {
+		common.SetStrictTopicMatching(true)
+		log.Info("acl topics will be matched strictly following the MQTT spec")
+	}
 
-			}
+	if detailed, ok := authOpts["detailed_return_codes"]; ok && strings.Replace(detailed, " ", "", -1) == "true" {
+		commonData.DetailedResults = true
+		log.Info("checks of unknown users will be deferred, and those failed by backends reported as errors")
+	}
 
-		} else {
-			//If there's no valid prefix, check all backends.
-			authenticated = CheckBackendsAuth(username, password)
-			//If not authenticated, check for a present plugin
-			if !authenticated {
-				authenticated = CheckPluginAuth(username, password)
-			}
-		}
-	} else {
-		authenticated = CheckBackendsAuth(username, password)
-		//If not authenticated, check for a present plugin
-		if !authenticated {
-			authenticated = CheckPluginAuth(username, password)
-		}
+	//In read only mode nothing is written to backends, so features that do are disabled.
+	if readOnly, ok := authOpts["read_only"]; ok && strings.Replace(readOnly, " ", "", -1) == "true" {
+		commonData.ReadOnly = true
+		log.Info("read only mode enabled, backends won't be written to")
 	}
 
-	if commonData.UseCache {
-		authGranted := "false"
-		if authenticated {
-			authGranted = "true"
-		}
-		log.Debugf("setting auth cache for %s", username)
-		SetAuthCache(username, password, authGranted)
+	if policy, ok := authOpts["sys_topics_policy"]; ok {
+		setSysPolicy(policy)
 	}
 
-	return authenticated
-}
+	if policy, ok := authOpts["retained_policy"]; ok {
+		setRetainedPolicy(policy)
+	}
 
-//export AuthAclCheck
-func AuthAclCheck(clientid, username, topic string, acc int) bool {
+	if sink, ok := authOpts["audit_sink"]; ok {
+		setAudit(strings.TrimSpace(sink))
+	}
 
-	aclCheck := false
-	var cached = false
-	var granted = false
-	if commonData.UseCache {
-		log.Debugf("checking acl cache for %s", username)
-		cached, granted = CheckAclCache(username, topic, clientid, acc)
-		if cached {
-			log.Debugf("found in cache: %s", username)
-			return granted
-		}
+	setRevocation()
+
+	setBypass()
+
+	setServiceAccounts()
+
+	if tiers, ok := authOpts["degradation_tiers"]; ok {
+		setDegradation(tiers)
 	}
 
-	//If prefixes are enabled, checkt if username has a valid prefix and use the correct backend if so.
-	//Else, check all backends.
-	if commonData.CheckPrefix {
-		validPrefix, bename := CheckPrefix(username)
-		if validPrefix {
+	if superuserBackend, ok := authOpts["superuser_backend"]; ok {
+		setSuperuserBackend(strings.TrimSpace(superuserBackend))
+	}
 
-			if bename == "plugin" {
+	if shadowBackend, ok := authOpts["shadow_backend"]; ok {
+		setShadowBackend(strings.TrimSpace(shadowBackend))
+	}
 
-				aclCheck = CheckPluginAcl(username, topic, clientid, acc)
+	if registrar, ok := authOpts["autoregister_backend"]; ok {
+		setAutoRegister(registrar)
+	}
 
-			} else {
+	if maxAge, ok := authOpts["password_max_age"]; ok {
+		setPasswordMaxAge(maxAge)
+	}
+
+	if maxFailures, ok := authOpts["lockout_max_failures"]; ok {
+		setLockout(maxFailures)
+	}
 
-				var backend = commonData.Backends[bename]
+	if limit, ok := authOpts["connection_limit"]; ok {
+		setConnectionLimit(limit)
+	}
 
-				log.Debugf("Superuser check with backend %s", backend.GetName())
-				if backend.GetSuperuser(username) {
-					log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
-					aclCheck = true
-				}
+	if ttl, ok := authOpts["session_ttl"]; ok {
+		setSessions(ttl)
+	}
 
-				//If not superuser, check acl.
-				if !aclCheck {
-					log.Debugf("Acl check with backend %s", backend.GetName())
-					if backend.CheckAcl(username, topic, clientid, int32(acc)) {
-						log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
-						aclCheck = true
-					}
-				}
-			}
+	if source, ok := authOpts["policy_updates"]; ok {
+		setPolicyUpdates(strings.Replace(source, " ", "", -1))
+	}
 
+	if budget, ok := authOpts["check_budget"]; ok {
+		d, err := time.ParseDuration(strings.Replace(budget, " ", "", -1))
+		if err == nil && d > 0 {
+			commonData.CheckBudget = d
+			log.Infof("checks will be given a budget of %s across backends", d)
 		} else {
-			//If there's no valid prefix, check all backends.
-			aclCheck = CheckBackendsAcl(username, topic, clientid, acc)
-			//If acl hasn't passed, check for plugin.
-			if !aclCheck {
-				aclCheck = CheckPluginAcl(username, topic, clientid, acc)
-			}
-		}
-	} else {
-		aclCheck = CheckBackendsAcl(username, topic, clientid, acc)
-		//If acl hasn't passed, check for plugin.
-		if !aclCheck {
-			aclCheck = CheckPluginAcl(username, topic, clientid, acc)
+			log.Errorf("couldn't parse check_budget %s, budget disabled", budget)
 		}
 	}
 
-	if commonData.UseCache {
-		authGranted := "false"
-		if aclCheck {
-			authGranted = "true"
-		}
-		log.Debugf("setting acl cache (granted = %s) for %s", authGranted, username)
-		SetAclCache(username, topic, clientid, acc, authGranted)
+	if timeouts, ok := authOpts["backend_timeouts"]; ok {
+		commonData.BackendTimeouts = parseBackendTimeouts(timeouts)
 	}
 
-	log.Debugf("Acl is %t for user %s", aclCheck, username)
+	setGuardrails()
 
-	return aclCheck
-}
+	if breakers, ok := authOpts["breaker_backends"]; ok {
+		setBreakers(breakers)
+	}
 
-//export AuthPskKeyGet
-func AuthPskKeyGet() bool {
-	return true
-}
+	if throttles, ok := authOpts["throttle_backends"]; ok {
+		setThrottles(throttles)
+	}
 
-//CheckAuthCache checks if the username/password pair is present in the cache. Return if it's present and, if so, if it was granted privileges.
-func CheckAuthCache(username, password string) (bool, bool) {
-	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("auth%s%s", username, password)))
-	val, err := commonData.RedisCache.Get(pair).Result()
-	if err != nil {
-		return false, false
+	setPrewarm()
+
+	if standbys, ok := authOpts["standby_backends"]; ok {
+		setStandbys(standbys)
 	}
-	//refresh expiration
-	commonData.RedisCache.Expire(pair, time.Duration(commonData.AuthCacheSeconds)*time.Second)
-	if val == "true" {
-		return true, true
+
+	if syncs, ok := authOpts["sync_backends"]; ok {
+		setSyncs(syncs)
 	}
-	return true, false
-}
 
-//SetAuthCache sets a pair, granted option and expiration time.
-func SetAuthCache(username, password string, granted string) error {
-	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("auth%s%s", username, password)))
-	err := commonData.RedisCache.Set(pair, granted, time.Duration(commonData.AuthCacheSeconds)*time.Second).Err()
-	if err != nil {
-		return err
+	if dualWrites, ok := authOpts["dual_write_backends"]; ok {
+		setDualWrites(dualWrites)
 	}
 
-	return nil
-}
+	setSelfTest()
 
-//CheckAclCache checks if the username/topic/clientid/acc mix is present in the cache. Return if it's present and, if so, if it was granted privileges.
-func CheckAclCache(username, topic, clientid string, acc int) (bool, bool) {
-	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("acl%s%s%s%d", username, topic, clientid, acc)))
-	val, err := commonData.RedisCache.Get(pair).Result()
-	if err != nil {
-		return false, false
+	if address, ok := authOpts["admin_address"]; ok {
+		setAdmin(address)
 	}
-	//refresh expiration
-	commonData.RedisCache.Expire(pair, time.Duration(commonData.AclCacheSeconds)*time.Second)
-	if val == "true" {
-		return true, true
+
+	if address, ok := authOpts["debug_address"]; ok {
+		setDebug(address)
 	}
-	return true, false
+
+	setBanner()
 }
 
-//SetAclCache sets a mix, granted option and expiration time.
-func SetAclCache(username, topic, clientid string, acc int, granted string) error {
-	pair := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("acl%s%s%s%d", username, topic, clientid, acc)))
-	err := commonData.RedisCache.Set(pair, granted, time.Duration(commonData.AclCacheSeconds)*time.Second).Err()
-	if err != nil {
-		return err
+//logBackend logs a registered backend along with the checks it supports, warning if it's not ready to answer them yet.
+func logBackend(bename string, backend Backend) {
+	log.Infof("Backend registered: %s (id %s), supports: %s", backend.GetName(), bename, bes.CapabilitiesOf(backend))
+	if err := bes.Ready(backend); err != nil {
+		log.Warningf("backend %s is not ready: %s", bename, err)
 	}
+}
 
-	return nil
+//backendCapabilities returns the capabilities of the named backend, so it's not called for checks it doesn't support.
+func backendCapabilities(bename string) bes.Capabilities {
+	return bes.CapabilitiesOf(commonData.Backends[bename])
 }
 
-//CheckPrefix checks if a username contains a valid prefix. If so, returns ok and the suitable backend name; else, !ok and empty string.
-func CheckPrefix(username string) (bool, string) {
-	if strings.Index(username, "_") > 0 {
-		userPrefix := username[0:strings.Index(username, "_")]
-		if prefix, ok := commonData.Prefixes[userPrefix]; ok {
-			log.Debugf("Found prefix for user %s, using backend %s.", username, prefix)
-			return true, prefix
+//setGuardrails tracks calls in flight per backend, capping them at backend_max_inflight and the plugin's goroutines at max_goroutines if given.
+//Calls in flight, goroutines and backends' open connections are reported every resources_report_interval if given.
+func setGuardrails() {
+	backendInflight = inflightCounters(commonData.Backends)
+	checkInflight = make(map[string]*int64, len(common.CheckKinds))
+	for _, kind := range common.CheckKinds {
+		checkInflight[kind] = new(int64)
+	}
+
+	if maxInflight, ok := authOpts["backend_max_inflight"]; ok {
+		n, err := strconv.ParseInt(strings.Replace(maxInflight, " ", "", -1), 10, 64)
+		if err == nil && n > 0 {
+			commonData.MaxInflight = n
+			log.Infof("backends will be limited to %d calls in flight", n)
+		} else {
+			log.Errorf("couldn't parse backend_max_inflight %s, calls in flight won't be capped", maxInflight)
+		}
+	}
+
+	if maxGoroutines, ok := authOpts["max_goroutines"]; ok {
+		n, err := strconv.Atoi(strings.Replace(maxGoroutines, " ", "", -1))
+		if err == nil && n > 0 {
+			commonData.MaxGoroutines = n
+			log.Infof("backends won't be called while there are more than %d goroutines", n)
+		} else {
+			log.Errorf("couldn't parse max_goroutines %s, goroutines won't be capped", maxGoroutines)
+		}
+	}
+
+	if intervalOpt, ok := authOpts["resources_report_interval"]; ok {
+		d, err := time.ParseDuration(strings.Replace(intervalOpt, " ", "", -1))
+		if err == nil && d > 0 {
+			go runResourceReports(d, backgroundStop)
+		} else {
+			log.Errorf("couldn't parse resources_report_interval %s, resources won't be reported", intervalOpt)
 		}
 	}
-	return false, ""
 }
 
-//CheckBackendsAuth checks for all backends if a username is authenticated and sets the authenticated param.
-func CheckBackendsAuth(username, password string) bool {
+//setBreakers sets a circuit breaker for each of the given backends, which opens after breaker_failures consecutive calls fail with the backend unavailable (5 by default),
+//and probes the backend after being open for breaker_open_timeout (30s by default). While open, calls are denied, or granted if breaker_policy is open.
+func setBreakers(breakersStr string) {
+	failures := 5
+	if failuresStr, ok := authOpts["breaker_failures"]; ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(failuresStr)); err == nil && n > 0 {
+			failures = n
+		} else {
+			log.Warnf("couldn't parse breaker_failures %s, defaulting to %d", failuresStr, failures)
+		}
+	}
 
-	authenticated := false
+	openFor := 30 * time.Second
+	if openForStr, ok := authOpts["breaker_open_timeout"]; ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(openForStr)); err == nil && d > 0 {
+			openFor = d
+		} else {
+			log.Warnf("couldn't parse breaker_open_timeout %s, defaulting to %s", openForStr, openFor)
+		}
+	}
 
-	for _, bename := range backends {
+	switch policy := strings.TrimSpace(authOpts["breaker_policy"]); policy {
+	case "", "closed":
+	case "open":
+		commonData.BreakerFailOpen = true
+		log.Warn("breaker_policy is open, acl calls to backends with an open circuit breaker will be granted")
+	default:
+		log.Errorf("unknown breaker_policy %s, failing closed", policy)
+	}
 
-		if bename == "plugin" {
+	commonData.Breakers = make(map[string]*common.Breaker)
+	for _, bename := range parseList(breakersStr) {
+		if _, ok := commonData.Backends[bename]; !ok {
+			log.Errorf("circuit breaker for %s ignored, backend is not registered", bename)
 			continue
 		}
+		commonData.Breakers[bename] = common.NewBreaker(failures, openFor)
+		log.Infof("backend %s will have a circuit breaker opening after %d failures for %s", bename, failures, openFor)
+	}
+}
 
-		var backend = commonData.Backends[bename]
+//setThrottles sets a throttle for each of the given backend:threshold pairs, shedding superuser and acl calls while the backend's average latency is over the threshold.
+//Shed kinds are probed every throttle_probe_interval (1s by default).
+func setThrottles(throttlesStr string) {
+	probe := time.Second
+	if probeStr, ok := authOpts["throttle_probe_interval"]; ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(probeStr)); err == nil && d > 0 {
+			probe = d
+		} else {
+			log.Warnf("couldn't parse throttle_probe_interval %s, defaulting to %s", probeStr, probe)
+		}
+	}
 
-		log.Debugf("checking user %s with backend %s", username, backend.GetName())
+	commonData.Throttles = make(map[string]*common.Throttle)
+	for _, throttleStr := range strings.Split(strings.Replace(throttlesStr, " ", "", -1), ",") {
+		if throttleStr == "" {
+			continue
+		}
+		pair := strings.Split(throttleStr, ":")
+		if len(pair) != 2 {
+			log.Errorf("backend throttle %s is not well formatted, ignoring it", throttleStr)
+			continue
+		}
+		if _, ok := commonData.Backends[pair[0]]; !ok {
+			log.Errorf("throttle for %s ignored, backend is not registered", pair[0])
+			continue
+		}
+		d, err := time.ParseDuration(pair[1])
+		if err != nil || d <= 0 {
+			log.Errorf("couldn't parse throttle threshold %s for backend %s, ignoring it", pair[1], pair[0])
+			continue
+		}
+		log.Infof("backend %s will be throttled when its latency crosses %s", pair[0], d)
+		commonData.Throttles[pair[0]] = common.NewThrottle(d, probe)
+	}
+}
 
-		if backend.GetUser(username, password) {
-			authenticated = true
-			log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
-			break
+//inflightCounters returns a calls in flight counter for every backend, keeping the current ones for backends already counted.
+func inflightCounters(backends map[string]Backend) map[string]*int64 {
+	counters := make(map[string]*int64, len(backends))
+	for bename := range backends {
+		if counter, ok := backendInflight[bename]; ok {
+			counters[bename] = counter
+		} else {
+			counters[bename] = new(int64)
 		}
 	}
+	return counters
+}
 
-	return authenticated
+//runResourceReports reports resources every interval until stop is closed.
+func runResourceReports(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			withBackends(ReportResources)
+		}
+	}
 }
 
-//CheckBackendsAcl  checks for all backends if a username is superuser or has acl rights and sets the aclCheck param.
-func CheckBackendsAcl(username, topic, clientid string, acc int) bool {
-	//Check superusers first
+//ReportResources logs and sends the number of goroutines, the calls in flight of every check kind, and the calls in flight and open connections of every backend.
+func ReportResources() {
+	goroutines := runtime.NumGoroutine()
+	commonData.Metrics.Gauge("runtime.goroutines", goroutines)
+	fields := log.Fields{"goroutines": goroutines}
+	for kind, inflight := range checkInflight {
+		n := atomic.LoadInt64(inflight)
+		fields[kind+"_inflight"] = n
+		commonData.Metrics.Gauge("check."+kind+".inflight", int(n))
+	}
+	if commonData.Audit != nil {
+		commonData.Metrics.Gauge("audit.pending_bytes", int(commonData.Audit.Pending()))
+		commonData.Metrics.Gauge("audit.dropped", int(commonData.Audit.Dropped()))
+		commonData.Metrics.Gauge("audit.failed", int(commonData.Audit.Failed()))
+		fields["audit_pending_bytes"] = commonData.Audit.Pending()
+	}
+	log.WithFields(fields).Debug("resources")
 
-	aclCheck := false
+	for bename, inflight := range backendInflight {
+		fields := log.Fields{
+			"backend":  bename,
+			"inflight": atomic.LoadInt64(inflight),
+		}
+		commonData.Metrics.Gauge("backend."+bename+".inflight", int(atomic.LoadInt64(inflight)))
+		if throttle, ok := commonData.Throttles[bename]; ok {
+			fields["latency"] = throttle.Latency()
+		}
+		if counter, ok := commonData.Backends[bename].(bes.ConnectionCounter); ok {
+			open := counter.OpenConnections()
+			fields["open_connections"] = open
+			commonData.Metrics.Gauge("backend."+bename+".open_connections", open)
+		}
+		log.WithFields(fields).Debug("backend resources")
+	}
+}
 
-	for _, bename := range backends {
+//AdmitCall checks the backend's calls in flight and the plugin's goroutines are within their caps, so a stuck backend is denied instead of piling up calls.
+func AdmitCall(ctx *checkContext, bename string) bool {
+	if inflight, ok := backendInflight[bename]; ok && commonData.MaxInflight > 0 && atomic.LoadInt64(inflight) >= commonData.MaxInflight {
+		log.Warnf("backend %s has %d calls in flight, denying call", bename, atomic.LoadInt64(inflight))
+		ctx.trace.Step("backend %s has too many calls in flight", bename)
+		commonData.Metrics.Incr("backend." + bename + ".inflight_capped")
+		return false
+	}
+	if commonData.MaxGoroutines > 0 {
+		if n := runtime.NumGoroutine(); n > commonData.MaxGoroutines {
+			log.Warnf("%d goroutines running, denying call to backend %s", n, bename)
+			ctx.trace.Step("too many goroutines to call backend %s", bename)
+			commonData.Metrics.Incr("goroutines_capped")
+			return false
+		}
+	}
+	return true
+}
 
-		if bename == "plugin" {
-			continue
+//trackCall wraps a backend call of the given check kind so it's counted as in flight for the backend and the kind until it returns,
+//and its latency is sent as backend.<id>.<kind>.latency and given to the backend's throttle, if any.
+func trackCall(bename, check string, call func() (bool, bes.CacheHint, error)) func() (bool, bes.CacheHint, error) {
+	inflight, ok := backendInflight[bename]
+	if !ok {
+		return call
+	}
+	kindInflight := checkInflight[check]
+	throttle := commonData.Throttles[bename]
+	return func() (bool, bes.CacheHint, error) {
+		atomic.AddInt64(inflight, 1)
+		defer atomic.AddInt64(inflight, -1)
+		if kindInflight != nil {
+			atomic.AddInt64(kindInflight, 1)
+			defer atomic.AddInt64(kindInflight, -1)
 		}
 
-		var backend = commonData.Backends[bename]
+		start := time.Now()
+		defer func() {
+			latency := time.Since(start)
+			commonData.Metrics.Timing("backend."+bename+"."+check+".latency", latency)
+			throttle.Observe(latency)
+		}()
+		return call()
+	}
+}
 
-		log.Debugf("Superuser check with backend %s", backend.GetName())
-		if backend.GetSuperuser(username) {
-			log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
-			aclCheck = true
-			break
-		}
+//setAdmin serves the admin api at address, requiring admin_token as bearer token, which may only be left out at loopback addresses.
+func setAdmin(address string) {
+	token := authOpts["admin_token"]
+	if err := common.CheckAdminAccess(address, token); err != nil {
+		log.Errorf("bad admin_address %s, admin api disabled: %s", address, err)
+		return
 	}
 
-	if !aclCheck {
-		for _, bename := range backends {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Errorf("couldn't listen at admin_address %s, admin api disabled: %s", address, err)
+		return
+	}
 
-			if bename == "plugin" {
-				continue
-			}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/backends", adminBackends)
+	mux.HandleFunc("/backends/commit", adminCommit)
+	mux.HandleFunc("/backends/rollback", adminRollback)
+	mux.HandleFunc("/users/", adminUsers)
 
-			var backend = commonData.Backends[bename]
+	if token == "" {
+		log.Warning("admin api has no admin_token, any local process may change backends")
+	} else if common.CheckLoopback(address) != nil {
+		log.Warning("admin api is served over plain http, so keep admin_address on a private interface for its token not to be seen")
+	}
 
-			log.Debugf("Acl check with backend %s", backend.GetName())
-			if backend.CheckAcl(username, topic, clientid, int32(acc)) {
-				log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
-				aclCheck = true
-				break
-			}
-		}
+	adminServer = &http.Server{
+		Handler:      common.RequireToken(token, common.RejectCrossSite(mux)),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: time.Minute,
 	}
+	log.Infof("admin api listening at %s", listener.Addr())
+	go adminServer.Serve(listener)
+}
 
-	return aclCheck
+//setDebug serves expvar counters and pprof profiles at address, which must be a loopback one, and starts counting checks for them.
+func setDebug(address string) {
+	if err := common.CheckLoopback(address); err != nil {
+		log.Errorf("bad debug_address %s, debug listener disabled: %s", address, err)
+		return
+	}
 
-}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Errorf("couldn't listen at debug_address %s, debug listener disabled: %s", address, err)
+		return
+	}
 
-//CheckPluginAuth checks that the plugin is not nil and returns the plugins auth response.
-func CheckPluginAuth(username, password string) bool {
-	if commonData.Plugin != nil {
-		return commonData.PGetUser(username, password)
+	commonData.DebugVars = common.NewDebugVars()
+
+	//Cpu profiles and traces are written for as many seconds as requested, so writes aren't bounded.
+	debugServer = &http.Server{
+		Handler:     common.DebugHandler(),
+		ReadTimeout: 10 * time.Second,
 	}
-	return false
+	log.Infof("debug listener serving expvar and pprof at %s", listener.Addr())
+	go debugServer.Serve(listener)
 }
 
-//CheckPluginAcl checks that the plugin is not nil and returns the superuser/acl response.
-func CheckPluginAcl(username, topic, clientid string, acc int) bool {
-	aclCheck := false
-	if commonData.Plugin != nil {
-		aclCheck = commonData.PGetSuperuser(username)
-		if !aclCheck {
-			aclCheck = commonData.PCheckAcl(username, topic, clientid, acc)
+//adminBackends shows the backends on GET and swaps them on PUT.
+func adminBackends(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var swap bes.Swap
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&swap); err != nil {
+			writeAdmin(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if err := SwapBackends(swap); err != nil {
+			writeAdmin(w, http.StatusConflict, map[string]interface{}{"error": err.Error()})
+			return
 		}
+	default:
+		writeAdmin(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+		return
 	}
-	return aclCheck
+	writeAdmin(w, http.StatusOK, BackendsStatus())
+}
+
+//adminCommit commits the last swap on POST.
+func adminCommit(w http.ResponseWriter, r *http.Request) {
+	adminSwapAction(w, r, CommitBackends)
+}
+
+//adminRollback rolls back the last swap on POST.
+func adminRollback(w http.ResponseWriter, r *http.Request) {
+	adminSwapAction(w, r, RollbackBackends)
+}
+
+func adminSwapAction(w http.ResponseWriter, r *http.Request, action func() error) {
+	if r.Method != http.MethodPost {
+		writeAdmin(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+		return
+	}
+	if err := action(); err != nil {
+		writeAdmin(w, http.StatusConflict, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	writeAdmin(w, http.StatusOK, BackendsStatus())
+}
+
+//AdminUser is a user as stored through the admin api. A plain password is hashed before storing it, while a hash is stored as given once checked to be well formed.
+type AdminUser struct {
+	Password     string            `json:"password,omitempty"`
+	PasswordHash string            `json:"password_hash,omitempty"`
+	Superuser    bool              `json:"superuser"`
+	Acls         []bes.ManifestAcl `json:"acls"`
+}
+
+//adminUsers shows, stores and deletes users of backends that keep them, at /users/<backend>/<username> on GET, PUT and DELETE.
+//Changed users' cached decisions and manifests are dropped so the change applies right away, and changes are written to the backend being migrated to, if any.
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/users/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		writeAdmin(w, http.StatusNotFound, map[string]interface{}{"error": "expected /users/<backend>/<username>"})
+		return
+	}
+	bename, username := parts[0], parts[1]
+
+	if r.Method != http.MethodGet && commonData.ReadOnly {
+		writeAdmin(w, http.StatusForbidden, map[string]interface{}{"error": "read only mode"})
+		return
+	}
+
+	//The user is read and hashed before holding the backends, so a slow request doesn't keep a swap, and thus checks, waiting.
+	var stored bes.SnapshotUser
+	if r.Method == http.MethodPut {
+		var user AdminUser
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&user); err != nil {
+			writeAdmin(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		hash := user.PasswordHash
+		if user.Password != "" {
+			var err error
+			if hash, err = bes.HashPassword(user.Password); err != nil {
+				writeAdmin(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+				return
+			}
+		} else if hash == "" {
+			writeAdmin(w, http.StatusBadRequest, map[string]interface{}{"error": "password or password_hash is required"})
+			return
+		} else if err := common.ValidateHash(hash); err != nil {
+			writeAdmin(w, http.StatusBadRequest, map[string]interface{}{"error": "bad password_hash: " + err.Error()})
+			return
+		}
+		if err := bes.CheckManifestLimits(user.Acls, username); err != nil {
+			writeAdmin(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		stored = bes.SnapshotUser{Username: username, PasswordHash: hash, Superuser: user.Superuser, Acls: user.Acls}
+	}
+
+	//Backends are held until the change is written to both the backend and the one being migrated to, so a swap can't halt either meanwhile.
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	store, ok := commonData.Backends[bename].(bes.UserStore)
+	if !ok {
+		writeAdmin(w, http.StatusNotFound, map[string]interface{}{"error": fmt.Sprintf("backend %s doesn't store users", bename)})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		user, found, err := store.StoredUser(username)
+		if err != nil {
+			writeAdmin(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		if !found {
+			writeAdmin(w, http.StatusNotFound, map[string]interface{}{"error": "user not found"})
+			return
+		}
+		writeAdmin(w, http.StatusOK, map[string]interface{}{"username": user.Username, "superuser": user.Superuser, "acls": user.Acls})
+	case http.MethodPut:
+		if err := store.StoreUser(stored); err != nil {
+			writeAdmin(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		ApplyPolicyUpdate(username)
+		response := map[string]interface{}{"username": username, "superuser": stored.Superuser, "acls": stored.Acls}
+		if err := DualWrite(bename, func(backend bes.Backend) error {
+			if targetStore, ok := backend.(bes.UserStore); ok {
+				return targetStore.StoreUser(stored)
+			}
+			return nil
+		}); err != nil {
+			response["dual_write_error"] = err.Error()
+		}
+		writeAdmin(w, http.StatusOK, response)
+	case http.MethodDelete:
+		if err := store.DeleteUser(username); err == bes.ErrNotFound {
+			writeAdmin(w, http.StatusNotFound, map[string]interface{}{"error": "user not found"})
+			return
+		} else if err != nil {
+			writeAdmin(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+			return
+		}
+		ApplyPolicyUpdate(username)
+		response := map[string]interface{}{"username": username, "deleted": true}
+		//Users stored before the migration started may be missing from the new backend.
+		if err := DualWrite(bename, func(backend bes.Backend) error {
+			if targetStore, ok := backend.(bes.UserStore); ok {
+				if err := targetStore.DeleteUser(username); err != bes.ErrNotFound {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			response["dual_write_error"] = err.Error()
+		}
+		writeAdmin(w, http.StatusOK, response)
+	default:
+		writeAdmin(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "method not allowed"})
+	}
+}
+
+func writeAdmin(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Debugf("admin api response error: %s", err)
+	}
+}
+
+//BackendsStatus returns the backends in check order and, while the last swap isn't committed, those it replaced and created.
+func BackendsStatus() map[string]interface{} {
+	swap := swapper.Status()
+	status := map[string]interface{}{
+		"backends": swap.Backends,
+		"pending":  swap.Pending,
+	}
+	if swap.Pending {
+		status["previous"] = swap.Previous
+		status["created"] = swap.Created
+	}
+	return status
+}
+
+//SwapBackends replaces the backends with the ones given through the admin api, in check order, as told by bes.Swapper.
+//Only options of the backends it creates may be given.
+func SwapBackends(swap bes.Swap) error {
+	status, err := swapper.Swap(swap)
+	if err != nil {
+		return err
+	}
+	AuditEvent("backends_swapped", log.Fields{"backends": strings.Join(swap.Backends, ","), "previous": strings.Join(status.Previous, ","), "created": strings.Join(status.Created, ",")})
+	return nil
+}
+
+//CommitBackends commits the last swap, halting the backends it removed or reloaded.
+func CommitBackends() error {
+	if err := swapper.Commit(); err != nil {
+		return err
+	}
+	AuditEvent("backends_committed", log.Fields{"backends": strings.Join(runningBackends().Order, ",")})
+	return nil
+}
+
+//RollbackBackends restores the backends and options replaced by the last swap, halting the backends it created.
+func RollbackBackends() error {
+	if err := swapper.Rollback(); err != nil {
+		return err
+	}
+	AuditEvent("backends_rolled_back", log.Fields{"backends": strings.Join(runningBackends().Order, ",")})
+	return nil
+}
+
+//runningBackends returns the backends checks are using, in check order, and the options they were created with.
+func runningBackends() bes.BackendSet {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	return bes.BackendSet{Order: backends, Backends: commonData.Backends, Opts: authOpts}
+}
+
+//storeBackends replaces the backends checks are using, waiting for ongoing checks.
+func storeBackends(set bes.BackendSet) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends = set.Order
+	commonData.Backends = set.Backends
+	authOpts = set.Opts
+	backendInflight = inflightCounters(set.Backends)
+}
+
+func createBackend(bename string, opts map[string]string) (Backend, error) {
+	backend, err := bes.New(bename, opts, commonData.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	logBackend(bename, backend)
+	return backend, nil
+}
+
+//checkSwap rejects swaps to backends not allowed or compiled, adding or removing the custom plugin, or removing backends other features use.
+func checkSwap(swap bes.Swap, current bes.BackendSet) error {
+	listed := make(map[string]bool)
+	for _, bename := range swap.Backends {
+		listed[bename] = true
+		if _, ok := allowedBackends[bename]; !ok {
+			return fmt.Errorf("backend not allowed: %s", bename)
+		}
+		if bename != "plugin" && !bes.Compiled(bename) {
+			return fmt.Errorf("backend not compiled in this build: %s", bename)
+		}
+	}
+
+	hadPlugin := false
+	for _, bename := range current.Order {
+		hadPlugin = hadPlugin || bename == "plugin"
+	}
+	if listed["plugin"] != hadPlugin {
+		return errors.New("the plugin backend can't be added or removed at runtime")
+	}
+
+	for bename := range current.Backends {
+		if listed[bename] {
+			continue
+		}
+		if feature, ok := backendReference(bename); ok {
+			return fmt.Errorf("backend %s can't be removed, it's used by %s", bename, feature)
+		}
+	}
+	return nil
+}
+
+//backendReference returns the feature using bename, if any, so it's not removed from under it.
+func backendReference(bename string) (string, bool) {
+	for _, prefixBackend := range commonData.Prefixes {
+		if prefixBackend == bename {
+			return "prefixes", true
+		}
+	}
+	for _, route := range commonData.AclRoutes {
+		if route.Backend == bename {
+			return "acl routes", true
+		}
+	}
+	for primary, standby := range commonData.Standbys {
+		if primary == bename || standby == bename {
+			return "standbys", true
+		}
+	}
+	for target, source := range commonData.Syncs {
+		if target == bename || source == bename {
+			return "syncs", true
+		}
+	}
+	for old, target := range commonData.DualWrites {
+		if old == bename || target == bename {
+			return "dual writes", true
+		}
+	}
+	if commonData.AutoRegister && commonData.Registrar == bename {
+		return "auto registration", true
+	}
+	if commonData.SuperuserBackend == bename {
+		return "superuser_backend", true
+	}
+	if commonData.ShadowBackend == bename {
+		return "shadow_backend", true
+	}
+	return "", false
+}
+
+//withBackends runs f holding backends for reading, so they aren't swapped while in use.
+func withBackends(f func()) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	f()
+}
+
+//setSelfTest parses the self test cases given at self_test and self_test_file and runs them, then every self_test_interval if given.
+func setSelfTest() {
+	spec, hasSpec := authOpts["self_test"]
+	file := strings.TrimSpace(authOpts["self_test_file"])
+
+	if !hasSpec && file == "" {
+		return
+	}
+
+	cases, err := common.ParseSelfTestCases(spec)
+	if err != nil {
+		log.Errorf("couldn't parse self_test, self test disabled. error: %s", err)
+		return
+	}
+
+	if file != "" {
+		fileCases, err := common.ReadSelfTestCases(file)
+		if err != nil {
+			log.Errorf("couldn't parse self_test_file, self test disabled. error: %s", err)
+			return
+		}
+		cases = append(cases, fileCases...)
+	}
+
+	if len(cases) == 0 {
+		log.Warning("no self test cases given, self test disabled")
+		return
+	}
+
+	commonData.SelfTests = cases
+	log.Infof("running %d self test cases", len(cases))
+	RunSelfTest()
+
+	if intervalOpt, ok := authOpts["self_test_interval"]; ok {
+		d, err := time.ParseDuration(strings.Replace(intervalOpt, " ", "", -1))
+		if err == nil && d > 0 {
+			go runSelfTests(d, backgroundStop)
+		} else {
+			log.Errorf("couldn't parse self_test_interval %s, self test will only run at startup", intervalOpt)
+		}
+	}
+}
+
+//setAclLimits sets the limits on each user's acl rules given by acl_max_rules, acl_max_rule_length and acl_max_wildcards, so a single account can't degrade matching for the whole broker.
+//Checks of users over them are denied and logged as errors, and their rules rejected when loaded from files or stored through the admin API.
+func setAclLimits() {
+	var limits common.AclLimits
+	for option, limit := range map[string]*int{
+		"acl_max_rules":       &limits.MaxRules,
+		"acl_max_rule_length": &limits.MaxRuleLength,
+		"acl_max_wildcards":   &limits.MaxWildcards,
+	} {
+		value, ok := authOpts[option]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.Replace(value, " ", "", -1))
+		if err != nil || n < 0 {
+			log.Errorf("couldn't parse %s %s, it won't be limited", option, value)
+			continue
+		}
+		*limit = n
+	}
+
+	common.SetAclLimits(limits)
+	if limits != (common.AclLimits{}) {
+		log.Infof("acl limits: %d rules, %d bytes per rule, %d wildcards per rule (0 is unlimited)", limits.MaxRules, limits.MaxRuleLength, limits.MaxWildcards)
+	}
+}
+
+//setTopN enables tracking the n most denied users and most checked topic prefixes, reporting them every statsd_top_interval.
+//Trackers keep 10 times n keys, so memory and reported series stay bounded whatever the number of users and topics.
+func setTopN(topN string) {
+	n, err := strconv.Atoi(strings.Replace(topN, " ", "", -1))
+	if err != nil || n <= 0 {
+		log.Errorf("couldn't parse statsd_top_n %s, top reports disabled", topN)
+		return
+	}
+
+	interval := time.Minute
+	if intervalOpt, ok := authOpts["statsd_top_interval"]; ok {
+		d, err := time.ParseDuration(strings.Replace(intervalOpt, " ", "", -1))
+		if err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Warningf("couldn't parse statsd_top_interval %s, defaulting to %s", intervalOpt, interval)
+		}
+	}
+
+	levels := 2
+	if levelsOpt, ok := authOpts["statsd_top_topic_levels"]; ok {
+		l, err := strconv.Atoi(strings.Replace(levelsOpt, " ", "", -1))
+		if err == nil && l > 0 {
+			levels = l
+		} else {
+			log.Warningf("couldn't parse statsd_top_topic_levels %s, defaulting to %d", levelsOpt, levels)
+		}
+	}
+
+	commonData.TopN = n
+	commonData.TopTopicLevels = levels
+	commonData.TopDeniedUsers = metrics.NewTopN(10 * n)
+	commonData.TopTopics = metrics.NewTopN(10 * n)
+	log.Infof("reporting the top %d denied users and checked topic prefixes every %s", n, interval)
+
+	go runTopReports(interval, backgroundStop)
+}
+
+//runTopReports reports the top denied users and checked topic prefixes every interval until stop is closed.
+func runTopReports(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ReportTop()
+		}
+	}
+}
+
+//ReportTop logs and sends the top denied users and checked topic prefixes seen since the last report.
+func ReportTop() {
+	for name, tracker := range map[string]*metrics.TopN{"denied_users": commonData.TopDeniedUsers, "topic_prefixes": commonData.TopTopics} {
+		entries := tracker.Top(commonData.TopN)
+		if len(entries) == 0 {
+			continue
+		}
+		for i, entry := range entries {
+			log.WithFields(log.Fields{
+				"top":   name,
+				"rank":  i + 1,
+				"key":   entry.Key,
+				"count": entry.Count,
+			}).Info("top report")
+		}
+		commonData.Metrics.Top(name, entries)
+	}
+}
+
+//CountTopic counts an acl check towards its topic's prefix of TopTopicLevels levels.
+func CountTopic(topic string) {
+	if commonData.TopTopics == nil {
+		return
+	}
+	levels := strings.SplitN(topic, "/", commonData.TopTopicLevels+1)
+	if len(levels) > commonData.TopTopicLevels {
+		levels = levels[:commonData.TopTopicLevels]
+	}
+	commonData.TopTopics.Add(strings.Join(levels, "/"))
+}
+
+//runSelfTests runs the self test every interval until stop is closed.
+func runSelfTests(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			RunSelfTest()
+		}
+	}
+}
+
+//RunSelfTest runs every self test case against backends, logging an error for each unexpected result, and returns whether they all passed.
+//Cases bypass the cache, lockouts and connection limits, so they neither depend on nor affect clients' checks.
+//The health status, sent as the self_test.healthy gauge, flips when cases start or stop failing.
+func RunSelfTest() bool {
+	passed := true
+
+	for _, c := range commonData.SelfTests {
+		decision := runSelfTestCase(c)
+		if decision.Granted != c.Allow {
+			passed = false
+			log.WithFields(log.Fields{
+				"case":     c.String(),
+				"expected": c.Allow,
+				"granted":  decision.Granted,
+				"backend":  decision.Backend,
+				"reason":   decision.Reason,
+			}).Error("self test case failed")
+		}
+	}
+
+	if !passed && !selfTestFailing {
+		log.Error("self test failing, health status is now unhealthy")
+	} else if passed && selfTestFailing {
+		log.Info("self test passing again, health status is now healthy")
+	}
+	selfTestFailing = !passed
+
+	healthy := 1
+	if !passed {
+		healthy = 0
+	}
+	commonData.Metrics.Gauge("self_test.healthy", healthy)
+
+	return passed
+}
+
+//runSelfTestCase decides a self test case with a check context of its own, holding backends for reading so they aren't swapped meanwhile.
+//Clients' checks run alongside it, as everything they don't share with it is kept in their context.
+func runSelfTestCase(c common.SelfTestCase) Decision {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	ctx := newCheckContext(c.Check, c.Username, c.Clientid, time.Now())
+	if c.Check == "acl" {
+		return DecideAcl(ctx, c.Username, c.Topic, c.Clientid, c.Acc)
+	}
+	return DecideAuth(ctx, c.Username, c.Password)
+}
+
+//setDebugFilter enables debug logging for checks of usernames and clientids matching the debug_usernames and debug_clientids patterns, or those in debug_file, which is reloaded when it changes.
+func setDebugFilter() {
+	usernames := parseList(authOpts["debug_usernames"])
+	clientids := parseList(authOpts["debug_clientids"])
+	file := strings.TrimSpace(authOpts["debug_file"])
+
+	if len(usernames) == 0 && len(clientids) == 0 && file == "" {
+		return
+	}
+
+	filter, err := common.NewDebugFilter(usernames, clientids, file)
+	if err != nil {
+		log.Errorf("couldn't set debug filter, selective debug logging disabled. error: %s", err)
+		return
+	}
+	commonData.DebugFilter = filter
+
+	if file != "" {
+		interval := 10 * time.Second
+		if intervalOpt, ok := authOpts["debug_file_interval"]; ok {
+			d, err := time.ParseDuration(strings.Replace(intervalOpt, " ", "", -1))
+			if err == nil && d > 0 {
+				interval = d
+			} else {
+				log.Warningf("couldn't parse debug_file_interval %s, defaulting to %s", intervalOpt, interval)
+			}
+		}
+		go runDebugReload(interval, backgroundStop)
+	}
+
+	log.Infof("checks for usernames %v and clientids %v will be logged at debug level", usernames, clientids)
+}
+
+//runDebugReload reloads the debug file every interval until stop is closed.
+func runDebugReload(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := commonData.DebugFilter.Reload()
+		if err != nil {
+			log.Errorf("couldn't reload debug file, keeping previous patterns. error: %s", err)
+		} else if reloaded {
+			log.Info("reloaded debug file")
+		}
+	}
+}
+
+//withConfigFile prepends the options read from the config_file option's file, if given, to the given ones, ending the program if it can't be read.
+func withConfigFile(keys, values []string) ([]string, []string) {
+	var file string
+	for i, key := range keys {
+		if key == "config_file" {
+			file = strings.TrimSpace(values[i])
+		}
+	}
+	if file == "" {
+		return keys, values
+	}
+
+	opts, err := common.LoadConfigFile(file)
+	if err != nil {
+		log.Fatalf("config file error: %s", err)
+	}
+
+	fileKeys := make([]string, 0, len(opts)+len(keys))
+	fileValues := make([]string, 0, len(opts)+len(values))
+	for key, value := range opts {
+		fileKeys = append(fileKeys, key)
+		fileValues = append(fileValues, value)
+		optionSources[key] = common.SourceConfigFile
+	}
+	//Options given to mosquitto override the file's.
+	for _, key := range keys {
+		delete(optionSources, key)
+	}
+	log.Infof("read %d options from config file %s", len(opts), file)
+
+	return append(fileKeys, keys...), append(fileValues, values...)
+}
+
+//parseList splits a comma separated option, dropping spaces and empty items.
+func parseList(option string) []string {
+	var items []string
+	for _, item := range strings.Split(strings.Replace(option, " ", "", -1), ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+//parseAclRoutes parses comma separated topic:backend pairs, ignoring any backend that isn't registered.
+func parseAclRoutes(routesStr string) common.AclRoutes {
+	routes, errs := common.ParseAclRoutes(routesStr, backends)
+	for _, err := range errs {
+		log.Errorf("%s, ignoring it", err)
+	}
+	for _, route := range routes {
+		log.Infof("acl checks for topic %s will be routed to backend %s", route.Topic, route.Backend)
+	}
+	return routes
+}
+
+//parseBackendTimeouts parses comma separated backend:duration pairs, ignoring any backend that isn't registered.
+func parseBackendTimeouts(timeoutsStr string) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for _, timeoutStr := range strings.Split(strings.Replace(timeoutsStr, " ", "", -1), ",") {
+		if timeoutStr == "" {
+			continue
+		}
+		pair := strings.Split(timeoutStr, ":")
+		if len(pair) != 2 {
+			log.Errorf("backend timeout %s is not well formatted, ignoring it", timeoutStr)
+			continue
+		}
+		if _, ok := commonData.Backends[pair[0]]; !ok {
+			log.Errorf("backend timeout for %s ignored, backend is not registered", pair[0])
+			continue
+		}
+		d, err := time.ParseDuration(pair[1])
+		if err != nil || d <= 0 {
+			log.Errorf("couldn't parse timeout %s for backend %s, ignoring it", pair[1], pair[0])
+			continue
+		}
+		log.Infof("backend %s will time out after %s", pair[0], d)
+		timeouts[pair[0]] = d
+	}
+	return timeouts
+}
+
+//parseLimit gets a non negative length limit from the given option, defaulting to 0 (no limit).
+func parseLimit(option string) int {
+	limitStr, ok := authOpts[option]
+	if !ok {
+		return 0
+	}
+	limit, err := strconv.Atoi(strings.Replace(limitStr, " ", "", -1))
+	if err != nil || limit < 0 {
+		log.Warningf("couldn't parse %s (err: %v), defaulting to no limit", option, err)
+		return 0
+	}
+	return limit
+}
+
+//setBypass sets the clients matching the bypass_usernames and bypass_clientids patterns to be checked against bypass_password_file and bypass_topics only, without calling backends.
+func setBypass() {
+	usernames := parseList(authOpts["bypass_usernames"])
+	clientids := parseList(authOpts["bypass_clientids"])
+
+	if len(usernames) == 0 && len(clientids) == 0 {
+		return
+	}
+
+	topics := parseList(authOpts["bypass_topics"])
+	if len(topics) == 0 {
+		log.Warning("bypass_topics is empty, bypassed clients will be denied every topic")
+	}
+
+	passwordFile := strings.TrimSpace(authOpts["bypass_password_file"])
+
+	bypass, err := common.NewBypass(usernames, clientids, topics, passwordFile)
+	if err != nil {
+		log.Errorf("couldn't set bypass, bypass disabled. error: %s", err)
+		return
+	}
+	commonData.Bypass = bypass
+
+	if passwordFile == "" {
+		log.Warning("bypass_password_file not given, bypassed clients will be authenticated by backends")
+	}
+	log.Infof("usernames %v and clientids %v will bypass backends for topics %v", usernames, clientids, topics)
+}
+
+//setServiceAccounts sets the usernames matching the superuser_patterns globs or superuser_regex to be superusers,
+//and those matching the service_accounts pattern:template pairs to be checked against the topics of their acl_template_<template> option, without calling backends.
+func setServiceAccounts() {
+	superusers := parseList(authOpts["superuser_patterns"])
+	superuserRegex := strings.TrimSpace(authOpts["superuser_regex"])
+	accounts := parseList(authOpts["service_accounts"])
+
+	if len(superusers) == 0 && superuserRegex == "" && len(accounts) == 0 {
+		return
+	}
+
+	templates := make(map[string][]string)
+	for option, value := range authOpts {
+		if strings.HasPrefix(option, "acl_template_") {
+			templates[strings.TrimPrefix(option, "acl_template_")] = parseList(value)
+		}
+	}
+
+	serviceAccounts, err := common.NewServiceAccounts(superusers, superuserRegex, accounts, templates)
+	if err != nil {
+		log.Errorf("couldn't set service accounts, superuser patterns and service accounts disabled. error: %s", err)
+		return
+	}
+	commonData.ServiceAccounts = serviceAccounts
+
+	log.Infof("usernames matching %v will be superusers, service accounts %v will be checked against their acl templates", superusers, accounts)
+}
+
+//setDegradation sets the tiers checks degrade to as backend outages go on, given as after:tier pairs, e.g. 0s:cache, 2m:seen, 30m:deny.
+//Up to degradation_max_seen clients, and as many grants, are remembered for the seen tier.
+func setDegradation(tiersStr string) {
+	tiers, err := common.ParseDegradationTiers(tiersStr)
+	if err != nil {
+		log.Errorf("couldn't set degradation tiers, degradation disabled. error: %s", err)
+		return
+	}
+
+	maxSeen := 100000
+	if maxSeenStr, ok := authOpts["degradation_max_seen"]; ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(maxSeenStr)); err == nil && n > 0 {
+			maxSeen = n
+		} else {
+			log.Warnf("couldn't parse degradation_max_seen %s, defaulting to %d", maxSeenStr, maxSeen)
+		}
+	}
+
+	degradation, err := common.NewDegradation(tiers, maxSeen)
+	if err != nil {
+		log.Errorf("couldn't set degradation tiers, degradation disabled. error: %s", err)
+		return
+	}
+	commonData.Degradation = degradation
+
+	log.Infof("checks will degrade to tiers %s during backend outages", tiersStr)
+}
+
+//setShadowBackend checks the given backend in shadow mode: it's left out of the backends chain, and every check answered by backends or the cache is checked against it too, comparing results without enforcing them.
+func setShadowBackend(bename string) {
+	if _, ok := commonData.Backends[bename]; !ok {
+		log.Errorf("shadow backend %s is not registered, shadow mode disabled", bename)
+		return
+	}
+	if bename == commonData.SuperuserBackend {
+		log.Errorf("shadow backend %s is the superuser backend, shadow mode disabled", bename)
+		return
+	}
+	commonData.ShadowBackend = bename
+	log.Infof("backend %s will be checked in shadow mode", bename)
+}
+
+//setSuperuserBackend delegates every superuser check to the given backend, which is then left out of the backends chain.
+func setSuperuserBackend(bename string) {
+	if _, ok := commonData.Backends[bename]; !ok {
+		log.Errorf("superuser backend %s is not registered, superuser checks won't be delegated", bename)
+		return
+	}
+	if !backendCapabilities(bename).Superuser {
+		log.Warningf("superuser backend %s doesn't check superusers with its options, no user will be a superuser", bename)
+	}
+	commonData.SuperuserBackend = bename
+	log.Infof("superuser checks will be delegated to backend %s", bename)
+}
+
+//setSysPolicy sets who may access $SYS topics regardless of backends' acls: nobody (deny), superusers, or the usernames matching the sys_topics_users patterns (users).
+//The backends policy, the default, checks them against backends as any other topic.
+func setSysPolicy(policy string) {
+	policy = strings.TrimSpace(policy)
+
+	switch policy {
+	case "backends":
+		return
+	case "deny", "superusers":
+	case "users":
+		users := parseList(authOpts["sys_topics_users"])
+		for _, pattern := range users {
+			if _, err := path.Match(pattern, ""); err != nil {
+				log.Errorf("bad sys_topics_users pattern %s, $SYS topics will be denied to everyone. error: %s", pattern, err)
+				commonData.SysPolicy = "deny"
+				return
+			}
+		}
+		if len(users) == 0 {
+			log.Warning("sys_topics_users is empty, $SYS topics will be denied to everyone")
+		}
+		commonData.SysUsers = users
+	default:
+		log.Errorf("unknown sys_topics_policy %s, $SYS topics will be denied to everyone", policy)
+		policy = "deny"
+	}
+
+	commonData.SysPolicy = policy
+	log.Infof("$SYS topics access policy: %s", policy)
+}
+
+//setRetainedPolicy sets who may publish retained messages besides being granted the topic: nobody (deny), superusers,
+//or clients granted one of the retained_acls (acls). The backends policy, the default, checks them as any other publish.
+func setRetainedPolicy(policy string) {
+	policy = strings.TrimSpace(policy)
+
+	switch policy {
+	case "backends":
+		return
+	case "deny", "superusers":
+	case "acls":
+		acls := parseList(authOpts["retained_acls"])
+		if len(acls) == 0 {
+			log.Warning("retained_acls is empty, retained messages will be denied to everyone")
+		}
+		commonData.RetainedAcls = acls
+	default:
+		log.Errorf("unknown retained_policy %s, retained messages will be denied to everyone", policy)
+		policy = "deny"
+	}
+
+	commonData.RetainedPolicy = policy
+	log.Infof("retained messages policy: %s", policy)
+}
+
+//setRevocation enables checking client certificates given by mosquitto against the CRLs in revocation_crl_file, reloaded every revocation_crl_interval when it changes,
+//and their issuer's OCSP responder if revocation_ocsp is true. Issuers are read from revocation_ca_file.
+func setRevocation() {
+	crlFile := strings.TrimSpace(authOpts["revocation_crl_file"])
+	useOCSP := strings.Replace(authOpts["revocation_ocsp"], " ", "", -1) == "true"
+	if crlFile == "" && !useOCSP {
+		return
+	}
+
+	timeout := 5 * time.Second
+	if timeoutOpt, ok := authOpts["revocation_ocsp_timeout"]; ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(timeoutOpt)); err == nil && d > 0 {
+			timeout = d
+		} else {
+			log.Warnf("couldn't parse revocation_ocsp_timeout %s, defaulting to %s", timeoutOpt, timeout)
+		}
+	}
+
+	maxAge := time.Hour
+	if maxAgeOpt, ok := authOpts["revocation_ocsp_max_age"]; ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(maxAgeOpt)); err == nil && d > 0 {
+			maxAge = d
+		} else {
+			log.Warnf("couldn't parse revocation_ocsp_max_age %s, defaulting to %s", maxAgeOpt, maxAge)
+		}
+	}
+
+	revocation, err := common.NewRevocation(crlFile, strings.TrimSpace(authOpts["revocation_ca_file"]), useOCSP, strings.TrimSpace(authOpts["revocation_ocsp_url"]), timeout, maxAge)
+	if err != nil {
+		log.Fatalf("couldn't set certificate revocation checks: %s", err)
+	}
+	commonData.Revocation = revocation
+
+	switch policy := strings.TrimSpace(authOpts["revocation_policy"]); policy {
+	case "", "hard":
+	case "soft":
+		commonData.RevocationSoft = true
+		log.Warn("revocation_policy is soft, certificates whose revocation status can't be told will be allowed")
+	default:
+		log.Errorf("unknown revocation_policy %s, certificates whose revocation status can't be told will be denied", policy)
+	}
+
+	if crlFile != "" {
+		interval := time.Minute
+		if intervalOpt, ok := authOpts["revocation_crl_interval"]; ok {
+			d, err := time.ParseDuration(strings.Replace(intervalOpt, " ", "", -1))
+			if err == nil && d > 0 {
+				interval = d
+			} else {
+				log.Warningf("couldn't parse revocation_crl_interval %s, defaulting to %s", intervalOpt, interval)
+			}
+		}
+		go runRevocationReload(interval, backgroundStop)
+	}
+
+	log.Infof("client certificates will be checked for revocation (crl file: %q, ocsp: %t)", crlFile, useOCSP)
+}
+
+//runRevocationReload reloads the CRL file every interval until stop is closed.
+func runRevocationReload(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := commonData.Revocation.Reload()
+		if err != nil {
+			log.Errorf("couldn't reload crl file, keeping previous crls. error: %s", err)
+		} else if reloaded {
+			log.Info("reloaded crl file")
+		}
+	}
+}
+
+//setAudit sends audit events to the given sink, buffering them on disk at audit_buffer_dir so they survive sink outages and restarts.
+//The buffer holds up to audit_buffer_max_size MB, and events are written in batches of up to audit_batch_size every audit_flush_interval.
+func setAudit(name string) {
+	dir := strings.TrimSpace(authOpts["audit_buffer_dir"])
+	if dir == "" {
+		log.Fatal("audit_sink needs audit_buffer_dir")
+	}
+
+	maxSize := int64(100)
+	if maxSizeOpt, ok := authOpts["audit_buffer_max_size"]; ok {
+		if n, err := strconv.ParseInt(strings.Replace(maxSizeOpt, " ", "", -1), 10, 64); err == nil && n > 0 {
+			maxSize = n
+		} else {
+			log.Warnf("couldn't parse audit_buffer_max_size %s, defaulting to %d", maxSizeOpt, maxSize)
+		}
+	}
+
+	batchSize := 100
+	if batchSizeOpt, ok := authOpts["audit_batch_size"]; ok {
+		if n, err := strconv.Atoi(strings.Replace(batchSizeOpt, " ", "", -1)); err == nil && n > 0 {
+			batchSize = n
+		} else {
+			log.Warnf("couldn't parse audit_batch_size %s, defaulting to %d", batchSizeOpt, batchSize)
+		}
+	}
+
+	interval := time.Second
+	if intervalOpt, ok := authOpts["audit_flush_interval"]; ok {
+		if d, err := time.ParseDuration(strings.Replace(intervalOpt, " ", "", -1)); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Warnf("couldn't parse audit_flush_interval %s, defaulting to %s", intervalOpt, interval)
+		}
+	}
+
+	sink, err := common.NewAuditSink(name, authOpts)
+	if err != nil {
+		log.Fatalf("couldn't create audit sink: %s", err)
+	}
+
+	buffer, err := common.NewAuditBuffer(sink, dir, maxSize*1024*1024, batchSize, interval)
+	if err != nil {
+		log.Fatalf("couldn't create audit buffer: %s", err)
+	}
+	commonData.Audit = buffer
+
+	log.Infof("audit events will be sent to the %s sink, buffered at %s", name, dir)
+}
+
+//setBanner logs the effective options, with their source and secrets masked, along with the backends, cache and policies they amount to,
+//unless startup_banner is false, and writes them as json to startup_banner_file if given.
+func setBanner() {
+	banner := common.NewBanner(backends, authOpts, optionSources)
+
+	banner.Cache["enabled"] = commonData.UseCache
+	if commonData.UseCache {
+		banner.Cache["host"] = cache.Host + ":" + cache.Port
+		banner.Cache["db"] = cache.DB
+		banner.Cache["auth_seconds"] = commonData.AuthCacheSeconds
+		banner.Cache["acl_seconds"] = commonData.AclCacheSeconds
+		banner.Cache["backend_first"] = commonData.AclBackendFirst
+	}
+
+	banner.Policies["read_only"] = commonData.ReadOnly
+	banner.Policies["check_prefix"] = commonData.CheckPrefix
+	banner.Policies["sys_topics"] = commonData.SysPolicy
+	banner.Policies["retained"] = commonData.RetainedPolicy
+	banner.Policies["revocation"] = commonData.Revocation != nil
+	banner.Policies["lockout"] = commonData.Lockout != nil
+	banner.Policies["connection_limit"] = commonData.ConnectionLimit
+	banner.Policies["auto_register"] = commonData.AutoRegister
+	banner.Policies["superuser_backend"] = commonData.SuperuserBackend
+	banner.Policies["shadow_backend"] = commonData.ShadowBackend
+	banner.Policies["dual_writes"] = len(commonData.DualWrites)
+	banner.Policies["breaker_fail_open"] = commonData.BreakerFailOpen
+	banner.Policies["detailed_return_codes"] = commonData.DetailedResults
+	banner.Policies["acl_limits"] = common.GetAclLimits()
+
+	if enabled, ok := authOpts["startup_banner"]; !ok || strings.Replace(enabled, " ", "", -1) != "false" {
+		banner.Log()
+	}
+
+	if file, ok := authOpts["startup_banner_file"]; ok && strings.TrimSpace(file) != "" {
+		if err := banner.WriteFile(strings.TrimSpace(file)); err != nil {
+			log.Errorf("couldn't write startup banner: %s", err)
+		}
+	}
+}
+
+//setAutoRegister enables registering unknown clients as pending in the given backend, if it supports it and a username pattern is given.
+func setAutoRegister(registrar string) {
+	if commonData.ReadOnly {
+		log.Error("auto registration writes to backends, it's disabled in read only mode")
+		return
+	}
+
+	backend, ok := commonData.Backends[registrar]
+	if !ok {
+		log.Errorf("autoregister backend %s is not registered, auto registration disabled", registrar)
+		return
+	}
+
+	if _, ok := backend.(bes.Registrar); !ok {
+		log.Errorf("backend %s can't register pending clients, auto registration disabled", registrar)
+		return
+	}
+
+	//A pattern is mandatory so that not every unknown client gets registered.
+	pattern, ok := authOpts["autoregister_pattern"]
+	if !ok || pattern == "" {
+		log.Error("autoregister_pattern is missing, auto registration disabled")
+		return
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		log.Errorf("couldn't compile autoregister_pattern (err: %s), auto registration disabled", err)
+		return
+	}
+
+	if bootstrapAcls, ok := authOpts["autoregister_acls"]; ok {
+		for _, topic := range strings.Split(strings.Replace(bootstrapAcls, " ", "", -1), ",") {
+			if topic != "" {
+				commonData.BootstrapAcls = append(commonData.BootstrapAcls, topic)
+			}
+		}
+	}
+
+	commonData.AutoRegister = true
+	commonData.Registrar = registrar
+	commonData.RegisterPattern = re
+	log.Infof("auto registration enabled for usernames matching %s with backend %s", pattern, registrar)
+}
+
+//setLockout enables locking users out after maxFailures failed auth attempts, keeping attempts in memory or in a Redis shared by a broker cluster.
+func setLockout(maxFailures string) {
+	max, err := strconv.ParseInt(strings.Replace(maxFailures, " ", "", -1), 10, 64)
+	if err != nil || max <= 0 {
+		log.Errorf("couldn't parse lockout_max_failures %s, lockout disabled", maxFailures)
+		return
+	}
+
+	policy := common.LockoutPolicy{
+		MaxFailures: max,
+		Window:      time.Minute,
+		Duration:    5 * time.Minute,
+	}
+
+	if window, ok := authOpts["lockout_window"]; ok {
+		d, err := time.ParseDuration(strings.Replace(window, " ", "", -1))
+		if err == nil && d > 0 {
+			policy.Window = d
+		} else {
+			log.Warningf("couldn't parse lockout_window %s, defaulting to %s", window, policy.Window)
+		}
+	}
+
+	if duration, ok := authOpts["lockout_duration"]; ok {
+		d, err := time.ParseDuration(strings.Replace(duration, " ", "", -1))
+		if err == nil && d > 0 {
+			policy.Duration = d
+		} else {
+			log.Warningf("couldn't parse lockout_duration %s, defaulting to %s", duration, policy.Duration)
+		}
+	}
+
+	if maxEntries, ok := authOpts["lockout_max_entries"]; ok {
+		n, err := strconv.Atoi(strings.Replace(maxEntries, " ", "", -1))
+		if err == nil && n > 0 {
+			policy.MaxEntries = n
+		} else {
+			log.Warningf("couldn't parse lockout_max_entries %s, defaulting to %d", maxEntries, common.DefaultLockoutMaxEntries)
+		}
+	}
+
+	store := "local"
+	if lockoutStore, ok := authOpts["lockout_store"]; ok {
+		store = strings.Replace(lockoutStore, " ", "", -1)
+	}
+
+	switch store {
+	case "local":
+		commonData.Lockout = common.NewLocalLockout(policy)
+	case "redis":
+		client, prefix, err := newStoreRedis("lockout")
+		if err != nil {
+			log.Errorf("couldn't start lockout Redis, lockout disabled. error: %s", err)
+			return
+		}
+		commonData.LockoutRedis = client
+		commonData.Lockout = common.NewRedisLockout(policy, client, prefix)
+	default:
+		log.Errorf("lockout_store %s unknown, lockout disabled", store)
+		return
+	}
+
+	log.Infof("users will be locked out for %s after %d failed attempts within %s (%s store)", policy.Duration, policy.MaxFailures, policy.Window, store)
+}
+
+//setSessions mints a session lasting ttl when a client authenticates against a backend, which answers the client's later checks until it expires,
+//so backends are only checked for acls the session hasn't seen yet. Sessions are kept locally or in Redis, signed with session_secret.
+func setSessions(ttlStr string) {
+	ttl, err := time.ParseDuration(strings.Replace(ttlStr, " ", "", -1))
+	if err != nil || ttl <= 0 {
+		log.Errorf("couldn't parse session_ttl %s, sessions disabled", ttlStr)
+		return
+	}
+
+	maxAcls := 100
+	if maxAclsStr, ok := authOpts["session_max_acls"]; ok {
+		max, err := strconv.Atoi(strings.Replace(maxAclsStr, " ", "", -1))
+		if err == nil && max >= 0 {
+			maxAcls = max
+		} else {
+			log.Warningf("couldn't parse session_max_acls %s, defaulting to %d", maxAclsStr, maxAcls)
+		}
+	}
+
+	if backendsStr, ok := authOpts["session_backends"]; ok {
+		commonData.SessionBackends = make(map[string]bool)
+		for _, bename := range parseList(backendsStr) {
+			commonData.SessionBackends[bename] = true
+		}
+	}
+
+	store := "local"
+	if sessionStore, ok := authOpts["session_store"]; ok {
+		store = strings.Replace(sessionStore, " ", "", -1)
+	}
+
+	//Sessions in a shared store need a secret shared by the cluster, while local ones may be signed with a random one.
+	secret := []byte(authOpts["session_secret"])
+	if len(secret) == 0 {
+		if store != "local" {
+			log.Errorf("session_secret is required for the %s session store, sessions disabled", store)
+			return
+		}
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Errorf("couldn't generate a session secret, sessions disabled. error: %s", err)
+			return
+		}
+	}
+
+	switch store {
+	case "local":
+		commonData.Sessions = common.NewLocalSessions(secret, ttl, maxAcls)
+	case "redis":
+		client, prefix, err := newStoreRedis("session")
+		if err != nil {
+			log.Errorf("couldn't start session Redis, sessions disabled. error: %s", err)
+			return
+		}
+		commonData.SessionsRedis = client
+		commonData.Sessions = common.NewRedisSessions(secret, ttl, maxAcls, client, prefix)
+	default:
+		log.Errorf("session_store %s unknown, sessions disabled", store)
+		return
+	}
+
+	log.Infof("authenticated clients will get sessions lasting %s, recording up to %d acls (%s store)", ttl, maxAcls, store)
+}
+
+//SessionBackend checks if clients authenticated by bename get a session.
+func SessionBackend(bename string) bool {
+	return commonData.SessionBackends == nil || commonData.SessionBackends[bename]
+}
+
+//SessionKeeps checks if sessions may keep the check's decision: backends hinting it not to be cached, or to be for less than sessions last, are asked again instead.
+func SessionKeeps(ctx *checkContext) bool {
+	return !ctx.hint.Hinted || commonData.Sessions.Keeps(ctx.hint.TTL)
+}
+
+//setPolicyUpdates starts consuming user and acl change events published by a provisioning system, either to a Redis stream or a Pub/Sub channel,
+//invalidating the cached decisions and permission manifest of the changed user right away instead of waiting for them to expire.
+func setPolicyUpdates(source string) {
+	if source != "stream" && source != "pubsub" {
+		log.Errorf("policy_updates %s unknown, expected stream or pubsub, policy updates disabled", source)
+		return
+	}
+
+	key := "mosquitto_auth:policy_updates"
+	if updatesKey, ok := authOpts["policy_updates_key"]; ok {
+		key = updatesKey
+	}
+
+	client, _, err := newStoreRedis("policy_updates")
+	if err != nil {
+		log.Errorf("couldn't start policy updates Redis, policy updates disabled. error: %s", err)
+		return
+	}
+	commonData.PolicyUpdates = client
+
+	if source == "stream" {
+		go runPolicyStream(client, key, backgroundStop)
+	} else {
+		go runPolicyChannel(client, key, backgroundStop)
+	}
+
+	log.Infof("consuming policy updates from Redis %s %s", source, key)
+}
+
+//runPolicyStream reads events added to the stream after startup until stop is closed. Each entry's username field names the changed user.
+func runPolicyStream(client *goredis.Client, stream string, stop <-chan struct{}) {
+	lastID := "$"
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		streams, err := client.XRead(&goredis.XReadArgs{
+			Streams: []string{stream, lastID},
+			Count:   100,
+			Block:   time.Second,
+		}).Result()
+		if err == goredis.Nil {
+			continue
+		}
+		if err != nil {
+			log.Errorf("policy updates stream read error: %s", err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		for _, s := range streams {
+			for _, message := range s.Messages {
+				lastID = message.ID
+				username, _ := message.Values["username"].(string)
+				ApplyPolicyUpdate(username)
+			}
+		}
+	}
+}
+
+//runPolicyChannel receives events published to the channel until stop is closed. Each message's payload is the changed user's username.
+func runPolicyChannel(client *goredis.Client, channel string, stop <-chan struct{}) {
+	pubsub := client.Subscribe(channel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-stop:
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			ApplyPolicyUpdate(message.Payload)
+		}
+	}
+}
+
+//ApplyPolicyUpdate drops what's kept for the given user, so their next checks are decided by backends. An empty username or * drops it for every user.
+func ApplyPolicyUpdate(username string) {
+	if username == "" || username == "*" {
+		DropManifests("")
+		commonData.Sessions.DropAll()
+		if commonData.UseCache {
+			commonData.RedisCache.FlushDB()
+		}
+		log.Infof("policy update: dropped cached decisions, manifests and sessions for every user")
+		return
+	}
+
+	DropManifests(username)
+	commonData.Sessions.Drop(username)
+	if commonData.UseCache {
+		index := cacheIndexKey(username)
+		pairs, err := commonData.RedisCache.SMembers(index).Result()
+		if err != nil {
+			log.Errorf("policy update: couldn't get cached decisions of %s: %s", username, err)
+			return
+		}
+		commonData.RedisCache.Del(append(pairs, index)...)
+	}
+	log.Infof("policy update: dropped cached decisions, manifest and sessions of %s", username)
+}
+
+//cacheIndexKey is the key of the set indexing a user's cached decisions.
+func cacheIndexKey(username string) string {
+	return "policy_updates:user:" + username
+}
+
+//indexCacheKey adds a cached decision to its user's index when policy updates are consumed, so it may be invalidated.
+//The index outlives every decision in it by expiring no sooner than the longest of the configured expiration and the hinted ttl, if any.
+func indexCacheKey(username, pair string, expiration, ttl time.Duration) {
+	if commonData.PolicyUpdates == nil || !commonData.UseCache {
+		return
+	}
+	if ttl > expiration {
+		expiration = ttl
+	}
+	if expiration <= 0 {
+		expiration = time.Hour
+	}
+
+	index := cacheIndexKey(username)
+	pipe := commonData.RedisCache.TxPipeline()
+	pipe.SAdd(index, pair)
+	pipe.Expire(index, expiration)
+	if _, err := pipe.Exec(); err != nil {
+		log.Debugf("couldn't index cached decision for %s: %s", username, err)
+	}
+}
+
+//newStoreRedis connects to the Redis set by the <name>_redis_host, _port, _password and _db options, which store state shared by a broker cluster.
+//It returns the client along with the key prefix set by <name>_redis_prefix, which defaults to mosquitto_auth:<name>:.
+func newStoreRedis(name string) (*goredis.Client, string, error) {
+	host := "localhost"
+	port := "6379"
+	db := 3
+	prefix := fmt.Sprintf("mosquitto_auth:%s:", name)
+	if storeHost, ok := authOpts[name+"_redis_host"]; ok {
+		host = storeHost
+	}
+	if storePort, ok := authOpts[name+"_redis_port"]; ok {
+		port = storePort
+	}
+	if storeDB, ok := authOpts[name+"_redis_db"]; ok {
+		if n, err := strconv.Atoi(storeDB); err == nil {
+			db = n
+		} else {
+			log.Warningf("couldn't parse %s_redis_db (err: %s), defaulting to %d", name, err, db)
+		}
+	}
+	if storePrefix, ok := authOpts[name+"_redis_prefix"]; ok {
+		prefix = storePrefix
+	}
+
+	dialer, err := common.NewDialer(authOpts, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	addr := fmt.Sprintf("%s:%s", host, port)
+	client := goredis.NewClient(&goredis.Options{
+		Addr:     addr,
+		Password: authOpts[name+"_redis_password"],
+		DB:       db,
+		Dialer:   dialer.RedisDialer(addr),
+	})
+	if _, err := client.Ping().Result(); err != nil {
+		client.Close()
+		return nil, "", err
+	}
+
+	return client, prefix, nil
+}
+
+//CheckLockout checks if username is locked out after too many failed attempts.
+func CheckLockout(username string) bool {
+	if commonData.Lockout == nil || !commonData.Lockout.Locked(username) {
+		return false
+	}
+	AuditEvent("auth_locked_out", log.Fields{"username": username})
+	return true
+}
+
+//RecordAuthAttempt counts a failed attempt towards username's lockout, or forgets previous ones on success.
+func RecordAuthAttempt(username string, granted bool) {
+	if commonData.Lockout == nil {
+		return
+	}
+	if granted {
+		commonData.Lockout.Reset(username)
+	} else {
+		commonData.Lockout.Fail(username)
+	}
+}
+
+//setConnectionLimit enables limiting simultaneous connections per username to limit, or to the one given by backends, keeping connection leases in memory or in a Redis shared by a broker cluster.
+func setConnectionLimit(limit string) {
+	n, err := strconv.Atoi(strings.Replace(limit, " ", "", -1))
+	if err != nil || n < 0 {
+		log.Errorf("couldn't parse connection_limit %s, connection limits disabled", limit)
+		return
+	}
+	commonData.ConnectionLimit = n
+
+	lease := 5 * time.Minute
+	if leaseOpt, ok := authOpts["connection_lease"]; ok {
+		d, err := time.ParseDuration(strings.Replace(leaseOpt, " ", "", -1))
+		if err == nil && d > 0 {
+			lease = d
+		} else {
+			log.Warningf("couldn't parse connection_lease %s, defaulting to %s", leaseOpt, lease)
+		}
+	}
+
+	store := "local"
+	if connectionsStore, ok := authOpts["connection_limit_store"]; ok {
+		store = strings.Replace(connectionsStore, " ", "", -1)
+	}
+
+	switch store {
+	case "local":
+		commonData.Connections = common.NewLocalConnections(lease)
+	case "redis":
+		client, prefix, err := newStoreRedis("connection_limit")
+		if err != nil {
+			log.Errorf("couldn't start connection limit Redis, connection limits disabled. error: %s", err)
+			return
+		}
+		commonData.ConnectionsRedis = client
+		commonData.Connections = common.NewRedisConnections(lease, client, prefix)
+	default:
+		log.Errorf("connection_limit_store %s unknown, connection limits disabled", store)
+		return
+	}
+
+	log.Infof("users will be limited to %d simultaneous connections unless backends say otherwise, with %s leases (%s store)", n, lease, store)
+}
+
+//MaxConnections gets the simultaneous connections limit for username from the first backend that knows it, or the connection_limit option.
+func MaxConnections(username string) (int, string) {
+	for _, bename := range chainedBackends() {
+		limiter, ok := commonData.Backends[bename].(bes.ConnectionLimiter)
+		if !ok {
+			continue
+		}
+		if max, known := limiter.MaxConnections(username); known {
+			return max, bename
+		}
+	}
+	return commonData.ConnectionLimit, ""
+}
+
+//CheckConnectionLimit takes a connection lease for an authenticated client, denying it when username already has as many connections from other clientids as its limit allows.
+func CheckConnectionLimit(ctx *checkContext, username, clientid string, decision Decision) Decision {
+	//Without a clientid, as with plugin versions older than 3, connections can't be told apart.
+	if commonData.Connections == nil || !decision.Granted || clientid == "" {
+		return decision
+	}
+
+	max, bename := MaxConnections(username)
+	if max <= 0 {
+		return decision
+	}
+
+	if commonData.Connections.Acquire(username, clientid, max) {
+		ctx.trace.Step("took connection lease within limit of %d", max)
+		return decision
+	}
+
+	ctx.trace.Step("connection limit of %d reached", max)
+	AuditEvent("connection_limit_exceeded", log.Fields{
+		"username":        username,
+		"clientid":        clientid,
+		"max_connections": max,
+		"backend":         bename,
+	})
+	return Decision{Granted: false, Backend: decision.Backend, Reason: ReasonConnectionLimit}
+}
+
+//RenewConnection extends the connection lease of a client on activity.
+func RenewConnection(username, clientid string) {
+	if commonData.Connections != nil && clientid != "" {
+		commonData.Connections.Renew(username, clientid)
+	}
+}
+
+//setPrewarm enables warming the acl cache for topics matching authorized subscriptions, taken from a list and/or an index of recently checked topics.
+func setPrewarm() {
+	if prewarmTopics, ok := authOpts["prewarm_topics"]; ok {
+		for _, topic := range strings.Split(strings.Replace(prewarmTopics, " ", "", -1), ",") {
+			if strings.ContainsAny(topic, "+#") {
+				log.Errorf("prewarm topic %s has wildcards, ignoring it", topic)
+			} else if topic != "" {
+				commonData.PrewarmTopics = append(commonData.PrewarmTopics, topic)
+			}
+		}
+	}
+
+	if recentSize, ok := authOpts["prewarm_recent_topics"]; ok {
+		size, err := strconv.Atoi(strings.Replace(recentSize, " ", "", -1))
+		if err == nil && size > 0 {
+			commonData.RecentTopics = common.NewRecentTopics(size)
+		} else {
+			log.Errorf("couldn't parse prewarm_recent_topics %s, recent topics won't be prewarmed", recentSize)
+		}
+	}
+
+	if len(commonData.PrewarmTopics) == 0 && commonData.RecentTopics == nil {
+		return
+	}
+
+	if !commonData.UseCache {
+		log.Warn("acl prewarming needs the cache, prewarming disabled")
+		commonData.PrewarmTopics = nil
+		commonData.RecentTopics = nil
+		return
+	}
+
+	commonData.PrewarmMax = 50
+	if prewarmMax, ok := authOpts["prewarm_max_topics"]; ok {
+		max, err := strconv.Atoi(strings.Replace(prewarmMax, " ", "", -1))
+		if err == nil && max > 0 {
+			commonData.PrewarmMax = max
+		} else {
+			log.Warningf("couldn't parse prewarm_max_topics %s, defaulting to %d", prewarmMax, commonData.PrewarmMax)
+		}
+	}
+
+	queueSize := 100
+	if prewarmQueue, ok := authOpts["prewarm_queue"]; ok {
+		size, err := strconv.Atoi(strings.Replace(prewarmQueue, " ", "", -1))
+		if err == nil && size > 0 {
+			queueSize = size
+		} else {
+			log.Warningf("couldn't parse prewarm_queue %s, defaulting to %d", prewarmQueue, queueSize)
+		}
+	}
+
+	commonData.Prewarmer = common.NewPrewarmer(queueSize, backgroundStop)
+	commonData.Prewarm = true
+	log.Infof("acl cache will be prewarmed in the background on subscriptions for up to %d topics, queueing up to %d subscriptions", commonData.PrewarmMax, queueSize)
+}
+
+//setStandbys parses comma separated primary:standby backend pairs and starts checking primaries health, promoting their standby when they're unreachable.
+//Standbys that may import snapshots are kept in sync from primaries that may export them.
+func setStandbys(standbysStr string) {
+	commonData.Standbys = make(map[string]string)
+	for _, pairStr := range strings.Split(strings.Replace(standbysStr, " ", "", -1), ",") {
+		if pairStr == "" {
+			continue
+		}
+		pair := strings.Split(pairStr, ":")
+		if len(pair) != 2 {
+			log.Errorf("standby %s is not well formatted, ignoring it", pairStr)
+			continue
+		}
+		primary, standby := pair[0], pair[1]
+		if _, ok := commonData.Backends[primary]; !ok {
+			log.Errorf("standby %s ignored, primary backend %s is not registered", standby, primary)
+			continue
+		}
+		if _, ok := commonData.Backends[standby]; !ok {
+			log.Errorf("standby %s for %s ignored, it is not registered", standby, primary)
+			continue
+		}
+		if _, ok := commonData.Backends[primary].(bes.HealthChecker); !ok {
+			log.Errorf("standby %s ignored, primary backend %s can't check its health", standby, primary)
+			continue
+		}
+		_, exporter := commonData.Backends[primary].(bes.Exporter)
+		_, importer := commonData.Backends[standby].(bes.Importer)
+		log.Infof("backend %s will be promoted when %s is unreachable (synced: %t)", standby, primary, exporter && importer && !commonData.ReadOnly)
+		commonData.Standbys[primary] = standby
+	}
+
+	if len(commonData.Standbys) == 0 {
+		return
+	}
+
+	healthInterval := 10 * time.Second
+	if interval, ok := authOpts["standby_health_interval"]; ok {
+		d, err := time.ParseDuration(strings.Replace(interval, " ", "", -1))
+		if err == nil && d > 0 {
+			healthInterval = d
+		} else {
+			log.Warningf("couldn't parse standby_health_interval %s, defaulting to %s", interval, healthInterval)
+		}
+	}
+
+	syncInterval := 5 * time.Minute
+	if interval, ok := authOpts["standby_sync_interval"]; ok {
+		d, err := time.ParseDuration(strings.Replace(interval, " ", "", -1))
+		if err == nil && d > 0 {
+			syncInterval = d
+		} else {
+			log.Warningf("couldn't parse standby_sync_interval %s, defaulting to %s", interval, syncInterval)
+		}
+	}
+
+	go runStandbys(healthInterval, syncInterval, backgroundStop)
+}
+
+//runStandbys checks primaries health and syncs standbys until stop is closed, syncing right away so standbys are ready as soon as possible.
+func runStandbys(healthInterval, syncInterval time.Duration, stop chan struct{}) {
+	healthTicker := time.NewTicker(healthInterval)
+	defer healthTicker.Stop()
+	syncTicker := time.NewTicker(syncInterval)
+	defer syncTicker.Stop()
+
+	withBackends(SyncStandbys)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-healthTicker.C:
+			withBackends(CheckPrimaries)
+		case <-syncTicker.C:
+			withBackends(SyncStandbys)
+		}
+	}
+}
+
+//CheckPrimaries checks every primary's health, promoting or demoting its standby when it changes.
+func CheckPrimaries() {
+	for primary, standby := range commonData.Standbys {
+		healthy := commonData.Backends[primary].(bes.HealthChecker).Healthy()
+		_, wasDown := primariesDown.Load(primary)
+		if !healthy && !wasDown {
+			primariesDown.Store(primary, true)
+			AuditEvent("standby_promoted", log.Fields{"backend": primary, "standby": standby})
+		} else if healthy && wasDown {
+			primariesDown.Delete(primary)
+			AuditEvent("standby_demoted", log.Fields{"backend": primary, "standby": standby})
+		}
+	}
+}
+
+//SyncStandbys imports a snapshot from every reachable primary that may export one into its standby, if it may import it.
+func SyncStandbys() {
+	for primary, standby := range commonData.Standbys {
+		if _, down := primariesDown.Load(primary); down {
+			continue
+		}
+		_, exporter := commonData.Backends[primary].(bes.Exporter)
+		_, importer := commonData.Backends[standby].(bes.Importer)
+		if exporter && importer && !commonData.ReadOnly {
+			SyncBackend(primary, standby)
+		}
+	}
+}
+
+//SyncBackend imports a snapshot exported by source into target, which must be an exporter and an importer respectively.
+func SyncBackend(source, target string) {
+	snapshot, err := commonData.Backends[source].(bes.Exporter).Export()
+	if err != nil {
+		log.Errorf("couldn't export snapshot from %s: %s", source, err)
+		commonData.Metrics.Incr("sync." + target + ".failure")
+		return
+	}
+	if err := commonData.Backends[target].(bes.Importer).Import(snapshot); err != nil {
+		log.Errorf("couldn't import snapshot into %s: %s", target, err)
+		commonData.Metrics.Incr("sync." + target + ".failure")
+		return
+	}
+	log.Infof("synced %d users from %s to %s", len(snapshot.Users), source, target)
+	commonData.Metrics.Incr("sync." + target + ".success")
+}
+
+//setSyncs parses comma separated source:target backend pairs and starts periodically syncing every target from its source.
+//Sources are only used for syncing, so they're left out of the backends chain and checks are answered by targets.
+func setSyncs(syncsStr string) {
+	if commonData.ReadOnly {
+		log.Error("syncs import snapshots into backends, they're disabled in read only mode")
+		return
+	}
+
+	commonData.Syncs = make(map[string]string)
+	for _, pairStr := range strings.Split(strings.Replace(syncsStr, " ", "", -1), ",") {
+		if pairStr == "" {
+			continue
+		}
+		pair := strings.Split(pairStr, ":")
+		if len(pair) != 2 {
+			log.Errorf("sync %s is not well formatted, ignoring it", pairStr)
+			continue
+		}
+		source, target := pair[0], pair[1]
+		if _, ok := commonData.Backends[source].(bes.Exporter); !ok {
+			log.Errorf("sync to %s ignored, source %s is not registered or can't export snapshots", target, source)
+			continue
+		}
+		if _, ok := commonData.Backends[target].(bes.Importer); !ok {
+			log.Errorf("sync from %s ignored, target %s is not registered or can't import snapshots", source, target)
+			continue
+		}
+		if _, ok := commonData.Syncs[target]; ok {
+			log.Errorf("sync from %s ignored, target %s already has a source", source, target)
+			continue
+		}
+		log.Infof("backend %s will be synced from %s", target, source)
+		commonData.Syncs[target] = source
+	}
+
+	if len(commonData.Syncs) == 0 {
+		return
+	}
+
+	syncInterval := 5 * time.Minute
+	if interval, ok := authOpts["sync_interval"]; ok {
+		d, err := time.ParseDuration(strings.Replace(interval, " ", "", -1))
+		if err == nil && d > 0 {
+			syncInterval = d
+		} else {
+			log.Warningf("couldn't parse sync_interval %s, defaulting to %s", interval, syncInterval)
+		}
+	}
+
+	go runSyncs(syncInterval, backgroundStop)
+}
+
+//runSyncs syncs every target from its source until stop is closed, syncing right away so targets are up to date as soon as possible.
+func runSyncs(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		withBackends(func() {
+			for target, source := range commonData.Syncs {
+				SyncBackend(source, target)
+			}
+		})
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//isSyncSource checks if bename is only used as a source to sync other backends from.
+func isSyncSource(bename string) bool {
+	for _, source := range commonData.Syncs {
+		if source == bename {
+			return true
+		}
+	}
+	return false
+}
+
+//setDualWrites parses comma separated old:new backend pairs for a staged migration between them. Checks are answered by old backends alone,
+//as new ones are left out of the backends chain, while users written to old backends by auto registration or the admin api are written to their new one too.
+//Switching over is then a matter of checking new backends instead, and rolling back one of dropping the pairs, as old backends miss no write.
+func setDualWrites(dualWritesStr string) {
+	if commonData.ReadOnly {
+		log.Error("dual writes write to backends, they're disabled in read only mode")
+		return
+	}
+
+	commonData.DualWrites = make(map[string]string)
+	for _, pairStr := range strings.Split(strings.Replace(dualWritesStr, " ", "", -1), ",") {
+		if pairStr == "" {
+			continue
+		}
+		pair := strings.Split(pairStr, ":")
+		if len(pair) != 2 || pair[0] == pair[1] {
+			log.Errorf("dual write %s is not well formatted, ignoring it", pairStr)
+			continue
+		}
+		old, target := pair[0], pair[1]
+		oldBackend, ok := commonData.Backends[old]
+		if !ok {
+			log.Errorf("dual write to %s ignored, old backend %s is not registered", target, old)
+			continue
+		}
+		targetBackend, ok := commonData.Backends[target]
+		if !ok {
+			log.Errorf("dual write from %s ignored, new backend %s is not registered", old, target)
+			continue
+		}
+		if _, ok := commonData.DualWrites[old]; ok {
+			log.Errorf("dual write to %s ignored, %s already writes to another backend", target, old)
+			continue
+		}
+
+		_, oldRegistrar := oldBackend.(bes.Registrar)
+		_, targetRegistrar := targetBackend.(bes.Registrar)
+		_, oldStore := oldBackend.(bes.UserStore)
+		_, targetStore := targetBackend.(bes.UserStore)
+		registrations, users := oldRegistrar && targetRegistrar, oldStore && targetStore
+		if !registrations && !users {
+			log.Errorf("dual write from %s ignored, %s can't take any of its writes", old, target)
+			continue
+		}
+		if oldRegistrar && !targetRegistrar {
+			log.Warningf("%s can't register pending clients, registrations in %s won't be written to it", target, old)
+		}
+		if oldStore && !targetStore {
+			log.Warningf("%s doesn't store users, users stored in %s won't be written to it", target, old)
+		}
+
+		log.Infof("writes to backend %s will be written to %s too (registrations: %t, users: %t)", old, target, registrations, users)
+		commonData.DualWrites[old] = target
+	}
+}
+
+//isDualWriteTarget checks if bename is only written to as the new backend of a migration.
+func isDualWriteTarget(bename string) bool {
+	for _, target := range commonData.DualWrites {
+		if target == bename {
+			return true
+		}
+	}
+	return false
+}
+
+//DualWrite writes to the new backend of old, if it's being migrated to one, with write. Failures are logged and counted, but old backends are the source of truth,
+//so writes to them aren't undone. It returns the error, if any, so callers may report it.
+func DualWrite(old string, write func(backend bes.Backend) error) error {
+	target, ok := commonData.DualWrites[old]
+	if !ok {
+		return nil
+	}
+
+	if err := write(commonData.Backends[target]); err != nil {
+		log.Errorf("dual write from %s to %s failed: %s", old, target, err)
+		commonData.Metrics.Incr("dual_write." + target + ".failure")
+		return err
+	}
+	commonData.Metrics.Incr("dual_write." + target + ".success")
+	return nil
+}
+
+//ActiveBackend returns the standby for bename if it's a primary found unreachable, else bename itself.
+func ActiveBackend(bename string) string {
+	if standby, ok := commonData.Standbys[bename]; ok {
+		if _, down := primariesDown.Load(bename); down {
+			return standby
+		}
+	}
+	return bename
+}
+
+//isStandby checks if bename is the standby of some primary, so it's only checked when promoted.
+func isStandby(bename string) bool {
+	for _, standby := range commonData.Standbys {
+		if standby == bename {
+			return true
+		}
+	}
+	return false
+}
+
+//setPasswordMaxAge enables denying or restricting users whose password is older than maxAge.
+func setPasswordMaxAge(maxAge string) {
+	age, err := time.ParseDuration(strings.Replace(maxAge, " ", "", -1))
+	if err != nil || age <= 0 {
+		log.Errorf("couldn't parse password_max_age %s, password expiry disabled", maxAge)
+		return
+	}
+
+	commonData.PasswordMaxAge = age
+
+	mode := "deny"
+	if expiredMode, ok := authOpts["password_expired_mode"]; ok {
+		mode = strings.Replace(expiredMode, " ", "", -1)
+	}
+
+	switch mode {
+	case "deny":
+		commonData.RestrictExpired = false
+	case "restrict":
+		commonData.RestrictExpired = true
+		if expiredAcls, ok := authOpts["password_expired_acls"]; ok {
+			for _, topic := range strings.Split(strings.Replace(expiredAcls, " ", "", -1), ",") {
+				if topic != "" {
+					commonData.ExpiredAcls = append(commonData.ExpiredAcls, topic)
+				}
+			}
+		}
+	default:
+		log.Warnf("password_expired_mode %s unknown, defaulting to deny", mode)
+		mode = "deny"
+	}
+
+	log.Infof("passwords older than %s will be expired with mode %s", age, mode)
+}
+
+//export AuthUnpwdCheck
+func AuthUnpwdCheck(username, password, clientid, address, certSubject, certificate string, cleanSession, protocolVersion, socket int) int {
+	return checkAuth(username, password, clientid, address, certSubject, certificate, cleanSession, protocolVersion, socket)
+}
+
+//checkAuth checks a user for AuthUnpwdCheck, holding backends so they aren't swapped meanwhile, and returns the check's result.
+func checkAuth(username, password, clientid, address, certSubject, certificate string, cleanSession, protocolVersion, socket int) int {
+
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	if StartDebug(username, clientid) {
+		defer StopDebug()
+	}
+
+	start := time.Now()
+	ctx := newCheckContext("auth", username, clientid, start)
+	ctx.client = newClientMetadata(address, certSubject, certificate, cleanSession, protocolVersion, socket)
+	ctx.inputs = log.Fields{"clientid": clientid}
+
+	//Reject oversized input before it reaches the cache or any backend.
+	if !WithinInputLimits(username, password, clientid, "") {
+		ctx.trace.Step("input exceeds length limits")
+		decision := Decision{Reason: ReasonInputLimits}
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "auth", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Clients with a revoked certificate are denied before anything may grant them.
+	if !CheckRevocation(ctx) {
+		decision := Decision{Reason: ReasonRevoked}
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "auth", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Bypassed clients are checked against the bypass password file only, so they don't depend on backends nor the plugin's stores.
+	if commonData.Bypass.Matches(username, clientid) && commonData.Bypass.ChecksAuth() {
+		decision := Decision{Granted: commonData.Bypass.CheckAuth(username, password), Reason: ReasonBypass}
+		ctx.trace.Step("bypassed client checked against bypass password file: %t", decision.Granted)
+		FinishTrace(ctx, decision.Granted)
+		RecordCheck(ctx, "auth", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Locked out users are denied before the cache, so a cached grant doesn't bypass the lockout.
+	if CheckLockout(username) {
+		ctx.trace.Step("locked out after too many failed attempts")
+		decision := Decision{Reason: ReasonLockedOut}
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "auth", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//A session minted when the client last authenticated answers for the backend that granted it.
+	if session, ok := commonData.Sessions.Auth(username, clientid, password); ok && commonData.Degradation.Tier(start) != common.TierDeny {
+		ctx.trace.Step("found session minted by backend %s", session.Backend)
+		RecordAuthAttempt(username, true)
+		decision := Decision{Granted: true, Backend: session.Backend, Reason: ReasonSession}
+		//Passwords may expire while the session lasts, so their age is checked as for backends' grants.
+		if commonData.PasswordMaxAge > 0 {
+			if !CheckPasswordAge(username) {
+				decision = Decision{Granted: false, Backend: session.Backend, Reason: ReasonPasswordExpired}
+			}
+			ctx.trace.Step("password age check: %t", decision.Granted)
+		}
+		decision = CheckConnectionLimit(ctx, username, clientid, decision)
+		FinishTrace(ctx, decision.Granted)
+		RecordCheck(ctx, "auth", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	var decision Decision
+	var cached = false
+	var granted = false
+	//Once an outage reaches the deny tier, cached grants aren't served either.
+	if commonData.UseCache && commonData.Degradation.Tier(start) != common.TierDeny {
+		log.Debugf("checking auth cache for %s", username)
+		cached, granted = CheckAuthCache(username, password)
+		if cached {
+			log.Debugf("found in cache: %s", username)
+			ctx.trace.Step("found in cache with granted = %t", granted)
+			RecordAuthAttempt(username, granted)
+			if granted {
+				commonData.Degradation.SeeUser(username, password)
+			}
+			ShadowAuth(ctx, username, password, Decision{Granted: granted, Backend: "cache", Reason: ReasonCache})
+			decision = CheckConnectionLimit(ctx, username, clientid, Decision{Granted: granted, Backend: "cache", Reason: ReasonCache})
+			FinishTrace(ctx, decision.Granted)
+			RecordCheck(ctx, "auth", start, username, decision)
+			return CheckResult(ctx, decision)
+		}
+	}
+
+	decision = DecideAuth(ctx, username, password)
+	ShadowAuth(ctx, username, password, decision)
+
+	//During backend outages the decision is degraded, and as it doesn't depend on credentials it's neither cached nor counted towards lockout.
+	decision, degraded := DegradeDecision(ctx, decision, func() bool {
+		return commonData.Degradation.SeenUser(username, password)
+	})
+	if degraded {
+		decision = CheckConnectionLimit(ctx, username, clientid, decision)
+		FinishTrace(ctx, decision.Granted)
+		RecordCheck(ctx, "auth", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Check if the password has expired, denying or restricting the user if so.
+	if decision.Granted && commonData.PasswordMaxAge > 0 {
+		if !CheckPasswordAge(username) {
+			decision = Decision{Granted: false, Backend: decision.Backend, Reason: ReasonPasswordExpired}
+		}
+		ctx.trace.Step("password age check: %t", decision.Granted)
+	}
+
+	//Keep the client's permission manifest, if the backend gave one, to answer acl checks from it.
+	//It's only replaced once the client authenticates, so failed attempts with its username can't drop it.
+	if decision.Granted {
+		SetManifest(decision.Backend, username, clientid)
+	}
+
+	//Mint a session for clients authenticated by a backend, replacing the one of the same username and clientid.
+	//Denied attempts leave sessions as they are, so anyone failing with a username can't end its clients' sessions.
+	if decision.Granted && decision.Reason == ReasonUser && SessionBackend(decision.Backend) && SessionKeeps(ctx) {
+		commonData.Sessions.Mint(username, clientid, password, decision.Backend)
+		ctx.trace.Step("minted session")
+	}
+
+	//If still not authenticated, check if the client may be registered as pending or already is.
+	if !decision.Granted && commonData.AutoRegister {
+		if CheckAutoRegister(username, password) {
+			decision = Decision{Granted: true, Backend: commonData.Registrar, Reason: ReasonAutoRegister}
+		}
+		ctx.trace.Step("auto registration check: %t", decision.Granted)
+	}
+
+	authenticated := decision.Granted
+	if authenticated {
+		commonData.Degradation.SeeUser(username, password)
+	}
+
+	//Deferred and failed checks aren't cached, so they reach backends again.
+	if commonData.UseCache && Conclusive(ctx, decision) {
+		authGranted := "false"
+		if authenticated {
+			authGranted = "true"
+		}
+		if ctx.hint.Hinted && ctx.hint.TTL <= 0 {
+			log.Debugf("backend asked not to cache auth for %s", username)
+		} else {
+			log.Debugf("setting auth cache for %s", username)
+			SetAuthCache(username, password, authGranted, ctx.hint.TTL, ctx.hint.Hinted)
+		}
+	}
+
+	//Connection limits don't count towards lockout nor are cached, as they don't depend on credentials.
+	RecordAuthAttempt(username, authenticated)
+	decision = CheckConnectionLimit(ctx, username, clientid, decision)
+	FinishTrace(ctx, decision.Granted)
+	RecordCheck(ctx, "auth", start, username, decision)
+
+	return CheckResult(ctx, decision)
+}
+
+//export AuthAclCheck
+func AuthAclCheck(clientid, username, topic string, acc, retain int, address, certSubject, certificate string, cleanSession, protocolVersion, socket int) int {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	metadata := newClientMetadata(address, certSubject, certificate, cleanSession, protocolVersion, socket)
+	return checkAcl(clientid, username, topic, acc, retain == 1 && acc == bes.MOSQ_ACL_WRITE, false, metadata)
+}
+
+//newClientMetadata returns what mosquitto told about the client being checked, for its check to pass to remote backends.
+//certificate is the DER encoded client certificate, cleanSession is 1 or 0, or -1 when unknown, protocolVersion 0 when unknown and socket -1 when unknown.
+func newClientMetadata(address, certSubject, certificate string, cleanSession, protocolVersion, socket int) *common.ClientMetadata {
+	metadata := common.ClientMetadata{
+		Address:         address,
+		ProtocolVersion: protocolVersion,
+		CertSubject:     certSubject,
+	}
+	if certificate != "" {
+		metadata.Certificate = []byte(certificate)
+	}
+	if cleanSession >= 0 {
+		clean := cleanSession == 1
+		metadata.CleanSession = &clean
+	}
+	if socket >= 0 {
+		metadata.Socket = &socket
+	}
+	return &metadata
+}
+
+//checkAcl checks acls for AuthAclCheck, which holds backends so they aren't swapped meanwhile, or for prewarming, and returns the check's result.
+//retained tells if it's the publish of a retained message, and metadata is what mosquitto told about the client.
+func checkAcl(clientid, username, topic string, acc int, retained, prewarm bool, metadata *common.ClientMetadata) int {
+	address := metadata.Address
+
+	//Register the client's address, if given, so backends may check acl conditions against it.
+	if address != "" && common.SetClientAddress(clientid, address) {
+		defer common.ClearClientAddress(clientid)
+	}
+
+	//Prewarming doesn't debug, as the log level is global and the client may be checked meanwhile.
+	if !prewarm && StartDebug(username, clientid) {
+		defer StopDebug()
+	}
+
+	start := time.Now()
+	var ctx *checkContext
+	if prewarm {
+		ctx = newPrewarmContext(start)
+	} else {
+		ctx = newCheckContext("acl", username, clientid, start)
+	}
+	ctx.client = metadata
+	ctx.inputs = log.Fields{"clientid": clientid, "topic": topic, "acc": acc}
+	if retained {
+		ctx.inputs["retained"] = true
+	}
+	ctx.trace.Step("checking topic %s with acc %d for clientid %s", topic, acc, clientid)
+
+	//Reject oversized input before it reaches the cache or any backend.
+	if !WithinInputLimits(username, "", clientid, topic) {
+		ctx.trace.Step("input exceeds length limits")
+		decision := Decision{Reason: ReasonInputLimits}
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "acl", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Clients with a revoked certificate are denied before the cache, so their cached grants aren't served.
+	if !CheckRevocation(ctx) {
+		decision := Decision{Reason: ReasonRevoked}
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "acl", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	if !ctx.prewarm {
+		CountTopic(topic)
+	}
+
+	//Bypassed clients are checked against the bypass topics only.
+	if commonData.Bypass.Matches(username, clientid) {
+		decision := Decision{Granted: commonData.Bypass.CheckAcl(username, clientid, topic), Reason: ReasonBypass}
+		ctx.trace.Step("bypassed client checked against bypass topics: %t", decision.Granted)
+		FinishTrace(ctx, decision.Granted)
+		RecordCheck(ctx, "acl", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Any activity keeps the client's connection lease.
+	if !ctx.prewarm {
+		RenewConnection(username, clientid)
+	}
+
+	//Retained publishes must also pass the retained policy. It's checked before the cache, as they share cache entries with other publishes.
+	if retained && commonData.RetainedPolicy != "" {
+		if decision := CheckRetainedPolicy(ctx, username, topic, clientid); !decision.Granted {
+			ctx.trace.Step("retained publish denied by %s policy", commonData.RetainedPolicy)
+			FinishTrace(ctx, false)
+			RecordCheck(ctx, "acl", start, username, decision)
+			return CheckResult(ctx, decision)
+		}
+		ctx.trace.Step("retained publish allowed by %s policy", commonData.RetainedPolicy)
+	}
+
+	var decision Decision
+	var cached = false
+	var granted = false
+	var degraded = false
+
+	//When checking backends first, expired tokens are denied before a cached decision may grant them.
+	if commonData.UseCache && commonData.AclBackendFirst && TokenExpired(username) {
+		ctx.trace.Step("token expired")
+		decision = Decision{Reason: ReasonTokenExpired}
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "acl", start, username, decision)
+		return CheckResult(ctx, decision)
+	}
+
+	//Once an outage reaches the deny tier, cached grants aren't served either.
+	if commonData.UseCache && commonData.Degradation.Tier(start) != common.TierDeny {
+		log.Debugf("checking acl cache for %s", username)
+		cached, granted = CheckAclCache(username, topic, clientid, acc, address)
+		if cached {
+			log.Debugf("found in cache: %s", username)
+			ctx.trace.Step("found in cache with granted = %t", granted)
+			if granted {
+				commonData.Degradation.SeeGrant(username, topic, acc)
+			}
+			decision = Decision{Granted: granted, Backend: "cache", Reason: ReasonCache}
+			ShadowAcl(ctx, username, topic, clientid, acc, decision)
+			FinishTrace(ctx, granted)
+			RecordCheck(ctx, "acl", start, username, decision)
+			return CheckResult(ctx, decision)
+		}
+	}
+
+	//$SYS topics are checked against their policy, if any.
+	//Pending clients may only access bootstrap acls, and users with an expired password only expired acls.
+	//Else, usernames matching a superuser pattern are granted, and service accounts only get their acl template.
+	//Else, if the user got a permission manifest when authenticating, check only against it.
+	//Else, if the client has a session, check against it and then backends.
+	//Else, check backends.
+	if commonData.SysPolicy != "" && IsSysTopic(topic) {
+		decision = CheckSysPolicy(ctx, username)
+		ctx.trace.Step("$SYS topic checked against %s policy: %t", commonData.SysPolicy, decision.Granted)
+	} else if IsPendingClient(username) {
+		decision = Decision{Granted: CheckAclList(commonData.BootstrapAcls, username, topic, clientid), Backend: commonData.Registrar, Reason: ReasonBootstrapAcls}
+		ctx.trace.Step("pending user checked against bootstrap acls: %t", decision.Granted)
+	} else if IsRestrictedUser(username) {
+		decision = Decision{Granted: CheckAclList(commonData.ExpiredAcls, username, topic, clientid), Reason: ReasonExpiredAcls}
+		ctx.trace.Step("user with expired password checked against expired acls: %t", decision.Granted)
+	} else if commonData.ServiceAccounts.IsSuperuser(username) {
+		decision = Decision{Granted: true, Reason: ReasonSuperuser}
+		ctx.trace.Step("username matches a superuser pattern")
+	} else if template, topics, ok := commonData.ServiceAccounts.Template(username); ok {
+		decision = Decision{Granted: CheckAclList(topics, username, topic, clientid), Reason: ReasonServiceAccount}
+		ctx.trace.Step("service account checked against acl template %s: %t", template, decision.Granted)
+	} else if manifest, ok := userManifests.Load(manifestKey{username, clientid}); ok {
+		decision = Decision{Granted: bes.ManifestAllows(manifest.([]bes.ManifestAcl), username, topic, clientid, int32(acc)), Reason: ReasonManifest}
+		ctx.trace.Step("checked against permission manifest: %t", decision.Granted)
+	} else if session, ok := commonData.Sessions.Load(username, clientid); ok {
+		//Sessions answer acls they've seen, and record backends' answers to the ones they haven't.
+		if sessionGranted, known := session.Acl(topic, acc); known {
+			decision = Decision{Granted: sessionGranted, Backend: session.Backend, Reason: ReasonSession}
+			ctx.trace.Step("checked against session: %t", decision.Granted)
+		} else {
+			decision = DecideAcl(ctx, username, topic, clientid, acc)
+			ShadowAcl(ctx, username, topic, clientid, acc, decision)
+			decision, degraded = DegradeDecision(ctx, decision, func() bool {
+				return commonData.Degradation.SeenGrant(username, topic, acc)
+			})
+			if !degraded && ctx.failure == nil && SessionKeeps(ctx) {
+				commonData.Sessions.RecordAcl(session, topic, acc, decision.Granted, decision.Reason == ReasonSuperuser)
+			}
+		}
+	} else {
+		decision = DecideAcl(ctx, username, topic, clientid, acc)
+		ShadowAcl(ctx, username, topic, clientid, acc, decision)
+		decision, degraded = DegradeDecision(ctx, decision, func() bool {
+			return commonData.Degradation.SeenGrant(username, topic, acc)
+		})
+	}
+
+	aclCheck := decision.Granted
+	if aclCheck && !degraded {
+		commonData.Degradation.SeeGrant(username, topic, acc)
+	}
+
+	//Degraded decisions aren't cached, so they don't outlive the outage, and neither are deferred and failed ones.
+	if commonData.UseCache && !degraded && Conclusive(ctx, decision) {
+		authGranted := "false"
+		if aclCheck {
+			authGranted = "true"
+		}
+		if ctx.hint.Hinted && ctx.hint.TTL <= 0 {
+			log.Debugf("backend asked not to cache acl for %s", username)
+		} else {
+			log.Debugf("setting acl cache (granted = %s) for %s", authGranted, username)
+			SetAclCache(username, topic, clientid, acc, address, authGranted, ctx.hint.TTL, ctx.hint.Hinted)
+		}
+	}
+
+	log.Debugf("Acl is %t for user %s", aclCheck, username)
+
+	FinishTrace(ctx, aclCheck)
+	RecordCheck(ctx, "acl", start, username, decision)
+
+	if commonData.Prewarm && !ctx.prewarm {
+		if acc == bes.MOSQ_ACL_SUBSCRIBE {
+			if aclCheck {
+				QueuePrewarm(clientid, username, topic, metadata)
+			}
+		} else {
+			commonData.RecentTopics.Add(topic)
+		}
+	}
+
+	return CheckResult(ctx, decision)
+}
+
+//export AuthPskKeyGet
+func AuthPskKeyGet(hint, identity string) *C.char {
+
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	if StartDebug(identity, "") {
+		defer StopDebug()
+	}
+
+	start := time.Now()
+	ctx := newCheckContext("psk", identity, "", start)
+
+	if !WithinInputLimits(identity, "", "", "") {
+		ctx.trace.Step("input exceeds length limits")
+		FinishTrace(ctx, false)
+		RecordCheck(ctx, "psk", start, identity, Decision{Reason: ReasonInputLimits})
+		return nil
+	}
+
+	key, decision := CheckBackendsPskKey(ctx, hint, identity)
+
+	FinishTrace(ctx, decision.Granted)
+	RecordCheck(ctx, "psk", start, identity, decision)
+
+	if !decision.Granted {
+		return nil
+	}
+
+	//The caller owns the returned string and must free it.
+	return C.CString(key)
+}
+
+//CheckAuthCache checks if the username/password pair is present in the cache. Return if it's present and, if so, if it was granted privileges.
+func CheckAuthCache(username, password string) (bool, bool) {
+	pair, expiry := authCacheKey(username, password)
+	expiration := time.Duration(commonData.AuthCacheSeconds) * time.Second
+	cached, granted := checkCache(pair, expiration, expiry)
+	if cached {
+		indexCacheKey(username, pair, expiration, 0)
+	}
+	return cached, granted
+}
+
+//SetAuthCache sets a pair, granted option and expiration time. If hinted, the backend given ttl is used instead of the configured one.
+func SetAuthCache(username, password string, granted string, ttl time.Duration, hinted bool) error {
+	pair, expiry := authCacheKey(username, password)
+	expiration := time.Duration(commonData.AuthCacheSeconds) * time.Second
+	indexCacheKey(username, pair, expiration, ttl)
+	return setCache(pair, granted, expiration, expiry, ttl, hinted)
+}
+
+//CheckAclCache checks if the username/topic/clientid/acc/address mix is present in the cache. Return if it's present and, if so, if it was granted privileges.
+func CheckAclCache(username, topic, clientid string, acc int, address string) (bool, bool) {
+	pair, expiry := aclCacheKey(username, topic, clientid, acc, address)
+	expiration := time.Duration(commonData.AclCacheSeconds) * time.Second
+	cached, granted := checkCache(pair, expiration, expiry)
+	if cached {
+		indexCacheKey(username, pair, expiration, 0)
+	}
+	return cached, granted
+}
+
+//SetAclCache sets a mix, granted option and expiration time. If hinted, the backend given ttl is used instead of the configured one.
+func SetAclCache(username, topic, clientid string, acc int, address string, granted string, ttl time.Duration, hinted bool) error {
+	pair, expiry := aclCacheKey(username, topic, clientid, acc, address)
+	expiration := time.Duration(commonData.AclCacheSeconds) * time.Second
+	indexCacheKey(username, pair, expiration, ttl)
+	return setCache(pair, granted, expiration, expiry, ttl, hinted)
+}
+
+//checkCache gets a cached decision, refreshing its expiration unless it was hinted by a backend.
+func checkCache(pair string, expiration time.Duration, expiry time.Time) (bool, bool) {
+	val, err := commonData.RedisCache.Get(pair).Result()
+	if err != nil {
+		return false, false
+	}
+	if !strings.HasSuffix(val, hintedSuffix) {
+		if expiration, ok := boundExpiration(expiration, expiry); ok {
+			commonData.RedisCache.Expire(pair, expiration)
+		}
+	}
+	if strings.TrimSuffix(val, hintedSuffix) == "true" {
+		return true, true
+	}
+	return true, false
+}
+
+//setCache caches a decision for the configured expiration, or the hinted ttl, bounded by the username's token expiry if any.
+func setCache(pair, granted string, expiration time.Duration, expiry time.Time, ttl time.Duration, hinted bool) error {
+	if hinted {
+		expiration = ttl
+		granted += hintedSuffix
+	}
+	expiration, ok := boundExpiration(expiration, expiry)
+	if !ok {
+		return nil
+	}
+	return commonData.RedisCache.Set(pair, granted, expiration).Err()
+}
+
+//boundExpiration bounds a cache expiration, where zero means none, to the time left until expiry, unless it's zero.
+//It returns false when expiry already passed, so nothing should be cached.
+func boundExpiration(expiration time.Duration, expiry time.Time) (time.Duration, bool) {
+	if expiry.IsZero() {
+		return expiration, true
+	}
+	left := time.Until(expiry)
+	if left <= 0 {
+		return 0, false
+	}
+	if expiration <= 0 || left < expiration {
+		return left, true
+	}
+	return expiration, true
+}
+
+//authCacheKey returns the cache key for an auth check, along with the expiry of username's token if any.
+//Tokens identified by a backend are keyed by their id and a digest of the check, so keys stay short and may be found by id, e.g. to invalidate them.
+func authCacheKey(username, password string) (string, time.Time) {
+	if id, expiry, ok := cacheTokenID(username); ok {
+		return fmt.Sprintf("auth:jti:%s:%s", id, cacheDigest(username, password)), expiry
+	}
+	return b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("auth%s%s", username, password))), time.Time{}
+}
+
+//aclCacheKey returns the cache key for an acl check, along with the expiry of username's token if any.
+func aclCacheKey(username, topic, clientid string, acc int, address string) (string, time.Time) {
+	if id, expiry, ok := cacheTokenID(username); ok {
+		return fmt.Sprintf("acl:jti:%s:%s", id, cacheDigest(username, topic, clientid, strconv.Itoa(acc), address)), expiry
+	}
+	return b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("acl%s%s%s%d%s", username, topic, clientid, acc, address))), time.Time{}
+}
+
+//cacheTokenID returns the id and expiry of username when it's a token identified by a backend.
+func cacheTokenID(username string) (string, time.Time, bool) {
+	for _, bename := range backends {
+		if bename == commonData.ShadowBackend {
+			continue
+		}
+		if identifier, ok := commonData.Backends[bename].(bes.TokenIdentifier); ok {
+			if id, expiry, ok := identifier.TokenID(username); ok {
+				return id, expiry, true
+			}
+		}
+	}
+	return "", time.Time{}, false
+}
+
+//TokenExpired checks if username is a token some backend tells to be expired.
+func TokenExpired(username string) bool {
+	for _, bename := range backends {
+		if bename == commonData.ShadowBackend {
+			continue
+		}
+		if expirer, ok := commonData.Backends[bename].(bes.TokenExpirer); ok && expirer.TokenExpired(username) {
+			return true
+		}
+	}
+	return false
+}
+
+//cacheDigest hashes the parts of a check into a hex string.
+func cacheDigest(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+//CheckPrefix checks if a username contains a valid prefix. If so, returns ok and the suitable backend name; else, !ok and empty string.
+func CheckPrefix(username string) (bool, string) {
+	if strings.Index(username, "_") > 0 {
+		userPrefix := username[0:strings.Index(username, "_")]
+		if prefix, ok := commonData.Prefixes[userPrefix]; ok {
+			log.Debugf("Found prefix for user %s, using backend %s.", username, prefix)
+			return true, prefix
+		}
+	}
+	return false, ""
+}
+
+//CheckAclRoute checks if a topic matches a configured acl route. If so, returns ok and the backend name; else, !ok and empty string.
+func CheckAclRoute(topic string) (bool, string) {
+	if bename, ok := commonData.AclRoutes.Match(topic); ok {
+		log.Debugf("Found acl route for topic %s, using backend %s.", topic, bename)
+		return true, bename
+	}
+	return false, ""
+}
+
+//DecideAuth checks username and password against backends: the one selected by the username's prefix, if prefixes are enabled and it has a valid one, else every backend and then the plugin, if any.
+func DecideAuth(ctx *checkContext, username, password string) Decision {
+	if commonData.CheckPrefix {
+		validPrefix, bename := CheckPrefix(username)
+		if validPrefix {
+			bename = ActiveBackend(bename)
+			ctx.trace.Step("prefix selects backend %s", bename)
+
+			if bename == "plugin" {
+				return CheckPluginAuth(ctx, username, password)
+			}
+
+			var backend = ClientBackend(ctx, bename)
+
+			if !backendCapabilities(bename).User {
+				ctx.trace.Step("backend %s doesn't check users", bename)
+				return Decision{Granted: false, Backend: bename, Reason: ReasonNotGranted}
+			}
+
+			authenticated := CallBackend(ctx, bename, common.CheckUser, 1, func() (bool, bes.CacheHint, error) {
+				return bes.HintedCheckUser(backend, username, password)
+			})
+			ctx.trace.Step("user check with backend %s: %t", bename, authenticated)
+			if !authenticated {
+				return Decision{Granted: false, Backend: bename, Reason: ReasonNotGranted}
+			}
+			log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
+			return Decision{Granted: true, Backend: bename, Reason: ReasonUser}
+		}
+	}
+
+	decision := CheckBackendsAuth(ctx, username, password)
+	//If not authenticated, check for a present plugin
+	if !decision.Granted && commonData.Plugin != nil {
+		decision = CheckPluginAuth(ctx, username, password)
+	}
+	return decision
+}
+
+//DecideAcl checks acl rights against backends: the one the topic is routed to, if any, else the one selected by the username's prefix, if prefixes are enabled and it has a valid one, else every backend and then the plugin, if any.
+func DecideAcl(ctx *checkContext, username, topic, clientid string, acc int) Decision {
+	if routed, bename := CheckAclRoute(topic); routed {
+		ctx.trace.Step("acl route selects backend %s", bename)
+		return CheckBackendAcl(ctx, bename, username, topic, clientid, acc)
+	}
+
+	if commonData.CheckPrefix {
+		validPrefix, bename := CheckPrefix(username)
+		if validPrefix {
+			bename = ActiveBackend(bename)
+			ctx.trace.Step("prefix selects backend %s", bename)
+			return CheckBackendAcl(ctx, bename, username, topic, clientid, acc)
+		}
+	}
+
+	decision := CheckBackendsAcl(ctx, username, topic, clientid, acc)
+	//If acl hasn't passed, check for plugin.
+	if !decision.Granted && commonData.Plugin != nil {
+		decision = CheckPluginAcl(ctx, username, topic, clientid, acc)
+	}
+	return decision
+}
+
+//IsSysTopic checks if topic is a $SYS one, or a filter for them.
+func IsSysTopic(topic string) bool {
+	return topic == "$SYS" || strings.HasPrefix(topic, "$SYS/")
+}
+
+//CheckSysPolicy checks if username may access $SYS topics by the policy set.
+func CheckSysPolicy(ctx *checkContext, username string) Decision {
+	switch commonData.SysPolicy {
+	case "superusers":
+		decision := CheckBackendsSuperuser(ctx, username)
+		decision.Reason = ReasonSysPolicy
+		return decision
+	case "users":
+		for _, pattern := range commonData.SysUsers {
+			if ok, _ := path.Match(pattern, username); ok {
+				return Decision{Granted: true, Reason: ReasonSysPolicy}
+			}
+		}
+	}
+	return Decision{Granted: false, Reason: ReasonSysPolicy}
+}
+
+//CheckRevocation checks the certificate of the client being checked, if given by mosquitto, isn't revoked.
+//Certificates whose status can't be told are denied, unless the revocation policy is soft.
+func CheckRevocation(ctx *checkContext) bool {
+	metadata := ctx.client
+	if commonData.Revocation == nil || metadata == nil || len(metadata.Certificate) == 0 {
+		return true
+	}
+
+	err := commonData.Revocation.Check(metadata.Certificate, time.Now())
+	if err == nil {
+		return true
+	}
+	if err == common.ErrCertificateRevoked {
+		log.Warnf("client certificate %s is revoked", metadata.CertSubject)
+		ctx.trace.Step("client certificate revoked")
+		commonData.Metrics.Incr("revocation.revoked")
+		return false
+	}
+
+	commonData.Metrics.Incr("revocation.unknown")
+	if commonData.RevocationSoft {
+		log.Warnf("couldn't check revocation of client certificate %s, allowing it: %s", metadata.CertSubject, err)
+		ctx.trace.Step("client certificate revocation unknown, allowed")
+		return true
+	}
+	log.Warnf("couldn't check revocation of client certificate %s, denying it: %s", metadata.CertSubject, err)
+	ctx.trace.Step("client certificate revocation unknown, denied")
+	return false
+}
+
+//CheckRetainedPolicy checks if username may publish retained messages to topic by the policy set, besides being granted the topic.
+func CheckRetainedPolicy(ctx *checkContext, username, topic, clientid string) Decision {
+	switch commonData.RetainedPolicy {
+	case "superusers":
+		decision := CheckBackendsSuperuser(ctx, username)
+		decision.Reason = ReasonRetainedPolicy
+		return decision
+	case "acls":
+		return Decision{Granted: CheckAclList(commonData.RetainedAcls, username, topic, clientid), Reason: ReasonRetainedPolicy}
+	}
+	return Decision{Granted: false, Reason: ReasonRetainedPolicy}
+}
+
+//CheckBackendsSuperuser checks for all backends, and then the plugin if present, if username is a superuser, unless it matches a superuser pattern.
+func CheckBackendsSuperuser(ctx *checkContext, username string) Decision {
+	if commonData.ServiceAccounts.IsSuperuser(username) {
+		ctx.trace.Step("username matches a superuser pattern")
+		return Decision{Granted: true, Reason: ReasonSuperuser}
+	}
+
+	if commonData.SuperuserBackend != "" {
+		return CheckDelegatedSuperuser(ctx, username, 1)
+	}
+
+	chain := chainedBackends()
+
+	for i, bename := range chain {
+		var backend = ClientBackend(ctx, bename)
+
+		isSuperuser := CallBackend(ctx, bename, common.CheckSuperuser, len(chain)-i, func() (bool, bes.CacheHint, error) {
+			return bes.HintedCheckSuperuser(backend, username)
+		})
+		ctx.trace.Step("superuser check with backend %s: %t", bename, isSuperuser)
+		if isSuperuser {
+			return Decision{Granted: true, Backend: bename, Reason: ReasonSuperuser}
+		}
+	}
+
+	if commonData.Plugin != nil && commonData.PGetSuperuser(username) {
+		ctx.trace.Step("superuser check with plugin: true")
+		return Decision{Granted: true, Backend: "plugin", Reason: ReasonSuperuser}
+	}
+
+	return Decision{Granted: false, Reason: ReasonNotGranted}
+}
+
+//CheckDelegatedSuperuser checks if username is a superuser with the backend superuser checks are delegated to.
+func CheckDelegatedSuperuser(ctx *checkContext, username string, callsLeft int) Decision {
+	bename := ActiveBackend(commonData.SuperuserBackend)
+	var backend = ClientBackend(ctx, bename)
+
+	isSuperuser := CallBackend(ctx, bename, common.CheckSuperuser, callsLeft, func() (bool, bes.CacheHint, error) {
+		return bes.HintedCheckSuperuser(backend, username)
+	})
+	ctx.trace.Step("superuser check with delegated backend %s: %t", bename, isSuperuser)
+	if isSuperuser {
+		log.Debugf("superuser %s acl authenticated with delegated backend %s", username, backend.GetName())
+		return Decision{Granted: true, Backend: bename, Reason: ReasonSuperuser}
+	}
+
+	return Decision{Granted: false, Backend: bename, Reason: ReasonNotGranted}
+}
+
+//CheckBackendAcl checks if a username is superuser or has acl rights for a single backend.
+func CheckBackendAcl(ctx *checkContext, bename, username, topic, clientid string, acc int) Decision {
+
+	if bename == "plugin" {
+		return CheckPluginAcl(ctx, username, topic, clientid, acc)
+	}
+
+	bename = ActiveBackend(bename)
+
+	var backend = ClientBackend(ctx, bename)
+	capabilities := backendCapabilities(bename)
+
+	if commonData.SuperuserBackend != "" {
+		if decision := CheckDelegatedSuperuser(ctx, username, 2); decision.Granted {
+			return decision
+		}
+	} else if capabilities.Superuser {
+		log.Debugf("Superuser check with backend %s", backend.GetName())
+		isSuperuser := CallBackend(ctx, bename, common.CheckSuperuser, 2, func() (bool, bes.CacheHint, error) {
+			return bes.HintedCheckSuperuser(backend, username)
+		})
+		ctx.trace.Step("superuser check with backend %s: %t", bename, isSuperuser)
+		if isSuperuser {
+			log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
+			return Decision{Granted: true, Backend: bename, Reason: ReasonSuperuser}
+		}
+	}
+
+	if !capabilities.Acl {
+		ctx.trace.Step("backend %s doesn't check acls", bename)
+		return Decision{Granted: false, Backend: bename, Reason: ReasonNotGranted}
+	}
+
+	log.Debugf("Acl check with backend %s", backend.GetName())
+	aclCheck := CallBackend(ctx, bename, common.CheckAcl, 1, func() (bool, bes.CacheHint, error) {
+		return bes.HintedCheckAcl(backend, username, topic, clientid, int32(acc))
+	})
+	ctx.trace.Step("acl check with backend %s: %t", bename, aclCheck)
+	if aclCheck {
+		log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
+		return Decision{Granted: true, Backend: bename, Reason: ReasonAcl}
+	}
+
+	return Decision{Granted: false, Backend: bename, Reason: ReasonNotGranted}
+}
+
+//CheckBackendsAuth checks for all backends if a username is authenticated, returning a decision from the backend that authenticated it, if any.
+func CheckBackendsAuth(ctx *checkContext, username, password string) Decision {
+
+	chain := chainedBackends()
+
+	for i, bename := range chain {
+
+		if !backendCapabilities(bename).User {
+			continue
+		}
+
+		var backend = ClientBackend(ctx, bename)
+
+		log.Debugf("checking user %s with backend %s", username, backend.GetName())
+
+		authenticated := CallBackend(ctx, bename, common.CheckUser, len(chain)-i, func() (bool, bes.CacheHint, error) {
+			return bes.HintedCheckUser(backend, username, password)
+		})
+		ctx.trace.Step("user check with backend %s: %t", bename, authenticated)
+		if authenticated {
+			log.Debugf("user %s authenticated with backend %s", username, backend.GetName())
+			return Decision{Granted: true, Backend: bename, Reason: ReasonUser}
+		}
+	}
+
+	return Decision{Granted: false, Reason: ReasonNotGranted}
+
+}
+
+//CheckBackendsAcl  checks for all backends if a username is superuser or has acl rights, returning a decision from the backend that granted it, if any.
+func CheckBackendsAcl(ctx *checkContext, username, topic, clientid string, acc int) Decision {
+	//Check superusers first
+
+	aclCheck := false
+	chain := chainedBackends()
+	consulted := make([]bes.Consultation, 0, 2*len(chain))
+
+	if commonData.SuperuserBackend != "" {
+		if decision := CheckDelegatedSuperuser(ctx, username, len(chain)+1); decision.Granted {
+			return decision
+		}
+	} else {
+		//Every backend may be consulted twice, for superuser and acl checks, so budget shares count both.
+		for i, bename := range chain {
+
+			if !backendCapabilities(bename).Superuser {
+				continue
+			}
+
+			var backend = ClientBackend(ctx, bename)
+
+			log.Debugf("Superuser check with backend %s", backend.GetName())
+			aclCheck = ConsultBackend(ctx, &consulted, bename, common.CheckSuperuser, 2*len(chain)-i, func(told []bes.Consultation) (bool, bes.CacheHint, error) {
+				return bes.ExplainedCheckSuperuser(backend, told, username)
+			})
+			ctx.trace.Step("superuser check with backend %s: %t", bename, aclCheck)
+			if aclCheck {
+				log.Debugf("superuser %s acl authenticated with backend %s", username, backend.GetName())
+				return Decision{Granted: true, Backend: bename, Reason: ReasonSuperuser}
+			}
+		}
+	}
+
+	if !aclCheck {
+		for i, bename := range chain {
+
+			if !backendCapabilities(bename).Acl {
+				continue
+			}
+
+			var backend = ClientBackend(ctx, bename)
+
+			log.Debugf("Acl check with backend %s", backend.GetName())
+			aclCheck = ConsultBackend(ctx, &consulted, bename, common.CheckAcl, len(chain)-i, func(told []bes.Consultation) (bool, bes.CacheHint, error) {
+				return bes.ExplainedCheckAcl(backend, told, username, topic, clientid, int32(acc))
+			})
+			ctx.trace.Step("acl check with backend %s: %t", bename, aclCheck)
+			if aclCheck {
+				log.Debugf("user %s acl authenticated with backend %s", username, backend.GetName())
+				return Decision{Granted: true, Backend: bename, Reason: ReasonAcl}
+			}
+		}
+	}
+
+	return Decision{Granted: false, Reason: ReasonNotGranted}
+
+}
+
+//ConsultBackend calls a backend as CallBackend does within an acl check, telling it the results of the backends consulted before it, which call passes along, and then adding its own.
+//The results are kept by the check, so concurrent checks never see each other's.
+func ConsultBackend(ctx *checkContext, consulted *[]bes.Consultation, bename, check string, callsLeft int, call func(told []bes.Consultation) (bool, bes.CacheHint, error)) bool {
+	told := *consulted
+
+	//The failure of an earlier backend is kept unless this one fails too.
+	previous := ctx.failure
+	ctx.failure = nil
+	granted := CallBackend(ctx, bename, check, callsLeft, func() (bool, bes.CacheHint, error) {
+		return call(told)
+	})
+
+	consultation := bes.Consultation{Backend: bename, Check: check, Granted: granted}
+	if ctx.failure != nil {
+		consultation.Error = bes.ErrorKindName(ctx.failure)
+	} else {
+		ctx.failure = previous
+	}
+	*consulted = append(*consulted, consultation)
+
+	return granted
+}
+
+//chainedBackends returns the registered backends in the order they're checked, leaving out the plugin.
+//Standbys are left out too, taking their primary's place when promoted, and so are sync sources, dual write targets and the backend superuser checks are delegated to.
+func chainedBackends() []string {
+	chain := make([]string, 0, len(backends))
+	for _, bename := range backends {
+		if bename != "plugin" && !isStandby(bename) && !isSyncSource(bename) && !isDualWriteTarget(bename) && bename != commonData.SuperuserBackend && bename != commonData.ShadowBackend {
+			chain = append(chain, ActiveBackend(bename))
+		}
+	}
+	return chain
+}
+
+//DegradeDecision applies the tier reached by an ongoing backend outage to a decision made by backends, seen telling if the check was granted before.
+//Denials due to backends being unavailable start or continue the outage, while any other decision ends it.
+//With the seen tier, previously granted checks are granted, and with other tiers, or no tier yet, the check is denied. It returns whether the decision was degraded.
+func DegradeDecision(ctx *checkContext, decision Decision, seen func() bool) (Decision, bool) {
+	//Acls granted by a breaker failing open last only as long as the outage, so they're neither cached nor recorded as seen.
+	if decision.Granted && ctx.failedOpen {
+		return Decision{Granted: true, Backend: decision.Backend, Reason: ReasonDegraded}, true
+	}
+
+	if commonData.Degradation == nil {
+		return decision, false
+	}
+
+	now := time.Now()
+	if decision.Granted || ctx.failure == nil || bes.ErrorKind(ctx.failure) != bes.ErrBackendUnavailable {
+		if lasted, ok := commonData.Degradation.Recovered(now); ok {
+			log.Infof("backends recovered after an outage of %s", lasted)
+			commonData.Metrics.Incr("degradation.recovered")
+		}
+		return decision, false
+	}
+
+	tier, changed := commonData.Degradation.Failed(now)
+	if changed {
+		log.Warnf("backends unavailable, checks degraded to tier %s", tier)
+		commonData.Metrics.Incr("degradation." + tier)
+	}
+
+	if tier == common.TierSeen && seen() {
+		ctx.trace.Step("backends unavailable, granted as seen before")
+		return Decision{Granted: true, Reason: ReasonDegraded}, true
+	}
+
+	ctx.trace.Step("backends unavailable, denied with degradation tier %q", tier)
+	return Decision{Granted: false, Backend: decision.Backend, Reason: ReasonDegraded}, true
+}
+
+//checkContext is the state of a single check, threaded through the calls deciding it, so checks made at the same time,
+//such as self tests and prewarming, don't share it.
+type checkContext struct {
+	budget   common.CheckBudget
+	trace    *common.Trace //Trace of the check, nil unless its username or clientid is traced.
+	inputs   log.Fields    //Inputs of the check besides its username, logged along with its decision so it may be replayed.
+	failure  error         //Error reported by the last backend that failed in the check, nil if none did.
+	calls    int           //Backend calls made in the check.
+	notFound int           //Backend calls in the check that didn't find the user.
+	hint     bes.CacheHint //Shortest cache ttl hinted by the backends called in the check.
+	prewarm  bool          //Whether it's a prewarm check rather than a client's.
+
+	failedOpen bool //Whether an acl call was granted for its backend's breaker being open and failing open.
+
+	client *common.ClientMetadata //What mosquitto told about the client being checked, passed to backends that take it. Nil when unknown.
+}
+
+//newCheckContext starts a check of the given kind (auth, acl or psk) at start, within the check budget if set, and traced if its username or clientid is.
+func newCheckContext(check, username, clientid string, start time.Time) *checkContext {
+	ctx := &checkContext{budget: common.NewCheckBudget(start, commonData.CheckBudget)}
+	if commonData.TraceUsernames[username] || (clientid != "" && commonData.TraceClientids[clientid]) {
+		ctx.trace = common.NewTrace(check, username)
+	}
+	return ctx
+}
+
+//newPrewarmContext starts a prewarm check at start, within the check budget if set. Prewarm checks aren't clients' checks, so they're neither traced nor recorded as their decisions.
+func newPrewarmContext(start time.Time) *checkContext {
+	return &checkContext{budget: common.NewCheckBudget(start, commonData.CheckBudget), prewarm: true}
+}
+
+//ClientBackend returns the named backend as it checks the client of the check, passing what mosquitto told about it to backends that take it.
+func ClientBackend(ctx *checkContext, bename string) Backend {
+	return bes.ForClient(commonData.Backends[bename], ctx.client)
+}
+
+//CallBackend runs a backend call within its timeout and its share of the check budget: the time left divided by the calls left, including this one.
+//Calls that time out are denied, so the next backend in the chain still gets its share. They're left running and their result is discarded.
+//The check kind, one of common.CheckKinds, tells which calls are shed first by the backend's throttle.
+func CallBackend(ctx *checkContext, bename, check string, callsLeft int, call func() (bool, bes.CacheHint, error)) bool {
+	ctx.calls++
+	timeout, limited := commonData.BackendTimeouts[bename]
+
+	if share, budgeted := ctx.budget.Share(time.Now(), callsLeft); budgeted {
+		if share <= 0 {
+			log.Warnf("check budget exhausted before calling backend %s", bename)
+			ctx.trace.Step("check budget exhausted before calling backend %s", bename)
+			return false
+		}
+		if !limited || share < timeout {
+			timeout = share
+			limited = true
+		}
+	}
+
+	if !AdmitCall(ctx, bename) {
+		RecordBackendError(ctx, bename, bes.ErrBackendUnavailable)
+		return false
+	}
+
+	//Calls to backends with an open breaker are skipped, taken as the backend being unavailable unless acl ones failing open.
+	//Acls granted so are degraded decisions, see DegradeDecision.
+	if !commonData.Breakers[bename].Allow(time.Now()) {
+		ctx.trace.Step("circuit breaker of backend %s is open", bename)
+		commonData.Metrics.Incr("backend." + bename + ".breaker_skipped")
+		commonData.DebugVars.Incr("backend." + bename + ".breaker_skipped")
+		if common.SkippedGrant(check, commonData.BreakerFailOpen) {
+			ctx.trace.Step("acl call to backend %s granted failing open", bename)
+			ctx.failedOpen = true
+			return true
+		}
+		RecordBackendError(ctx, bename, bes.ErrBackendUnavailable)
+		return false
+	}
+
+	//Superuser and acl calls to a slow backend are shed, so user checks keep being answered. They're taken as the backend being unavailable, so their denial isn't cached.
+	if throttle := commonData.Throttles[bename]; !throttle.Admit(check, time.Now()) {
+		log.Debugf("%s call to backend %s shed, average latency is %s", check, bename, throttle.Latency())
+		ctx.trace.Step("%s call to backend %s shed by its throttle", check, bename)
+		commonData.Metrics.Incr("backend." + bename + "." + check + ".shed")
+		commonData.DebugVars.Incr("backend." + bename + "." + check + ".shed")
+		RecordBackendError(ctx, bename, bes.ErrBackendUnavailable)
+		return false
+	}
+
+	call = trackCall(bename, check, call)
+
+	if !limited {
+		granted, hint, err := call()
+		RecordBreaker(bename, err)
+		RecordBackendError(ctx, bename, err)
+		ctx.hint = ctx.hint.Shortest(hint)
+		return granted
+	}
+
+	//A call that times out only gets to write its own result, which is discarded.
+	result, ok := bes.CallWithin(timeout, call)
+	if !ok {
+		log.Warnf("backend %s timed out after %s", bename, timeout)
+		ctx.trace.Step("backend %s timed out after %s", bename, timeout)
+		commonData.Metrics.Incr("backend." + bename + ".timeout")
+		commonData.DebugVars.Incr("backend." + bename + ".timeout")
+		RecordBreaker(bename, bes.ErrBackendUnavailable)
+		RecordBackendError(ctx, bename, bes.ErrBackendUnavailable)
+		return false
+	}
+
+	RecordBreaker(bename, result.Err)
+	RecordBackendError(ctx, bename, result.Err)
+	ctx.hint = ctx.hint.Shortest(result.Hint)
+	return result.Granted
+}
+
+//RecordBreaker records the outcome of a call in the backend's circuit breaker, if it has one.
+//Only the backend being unavailable counts as a failure, while any other outcome, denials included, is a success.
+func RecordBreaker(bename string, err error) {
+	breaker, ok := commonData.Breakers[bename]
+	if !ok {
+		return
+	}
+
+	failed := err != nil && bes.ErrorKind(err) == bes.ErrBackendUnavailable
+	if state, changed := breaker.Record(failed, time.Now()); changed {
+		if state == common.BreakerOpen {
+			log.Warnf("circuit breaker of backend %s opened", bename)
+		} else {
+			log.Infof("circuit breaker of backend %s closed", bename)
+		}
+		commonData.Metrics.Incr("backend." + bename + ".breaker_" + state)
+		AuditEvent("breaker_"+state, log.Fields{"backend": bename})
+	}
+}
+
+//ShadowAuth checks the user against the shadow backend, if any, comparing its result with the live decision.
+func ShadowAuth(ctx *checkContext, username, password string, decision Decision) {
+	if commonData.ShadowBackend == "" {
+		return
+	}
+	backend := ClientBackend(ctx, commonData.ShadowBackend)
+	granted := callShadow(ctx, func() (bool, bes.CacheHint, error) {
+		return bes.HintedCheckUser(backend, username, password)
+	})
+	CompareShadow(ctx, "auth", username, "", decision, granted)
+}
+
+//ShadowAcl checks the acl against the shadow backend, if any, as a superuser or for the topic, comparing its result with the live decision.
+func ShadowAcl(ctx *checkContext, username, topic, clientid string, acc int, decision Decision) {
+	if commonData.ShadowBackend == "" || ctx.prewarm {
+		return
+	}
+	backend := ClientBackend(ctx, commonData.ShadowBackend)
+	granted := callShadow(ctx, func() (bool, bes.CacheHint, error) {
+		return bes.HintedCheckAccess(backend, username, topic, clientid, int32(acc))
+	})
+	CompareShadow(ctx, "acl", username, topic, decision, granted)
+}
+
+//callShadow calls the shadow backend as any other, within timeouts and caps, but keeps its errors and cache hints from affecting the live check.
+func callShadow(ctx *checkContext, call func() (bool, bes.CacheHint, error)) bool {
+	shadow := &checkContext{budget: ctx.budget, trace: ctx.trace}
+	return CallBackend(shadow, commonData.ShadowBackend, common.CheckShadow, 1, call)
+}
+
+//CompareShadow logs and counts whether the shadow backend agreed with the live decision. Mismatches are logged at info level, matches at debug level.
+func CompareShadow(ctx *checkContext, check, username, topic string, decision Decision, granted bool) {
+	result := "match"
+	if granted != decision.Granted {
+		result = "mismatch"
+	}
+
+	fields := log.Fields{
+		"check":    check,
+		"username": username,
+		"live":     decision.Granted,
+		"shadow":   granted,
+		"backend":  decision.Backend,
+		"reason":   decision.Reason,
+	}
+	if topic != "" {
+		fields["topic"] = topic
+	}
+	if result == "mismatch" {
+		log.WithFields(fields).Info("shadow mismatch")
+	} else {
+		log.WithFields(fields).Debug("shadow match")
+	}
+	ctx.trace.Step("shadow backend %s check: %t (%s)", commonData.ShadowBackend, granted, result)
+	commonData.Metrics.Incr("shadow." + check + "." + result)
+}
+
+//RecordBackendError logs and counts a backend's error by its kind, keeping it as the check's failure.
+//Users not found and bad credentials are expected denials, so they're only logged at debug level.
+func RecordBackendError(ctx *checkContext, bename string, err error) {
+	if err == nil {
+		return
+	}
+
+	kind := bes.ErrorKindName(err)
+	switch bes.ErrorKind(err) {
+	case bes.ErrNotFound:
+		ctx.notFound++
+		log.Debugf("backend %s check failed (%s): %s", bename, kind, err)
+	case bes.ErrBadCredentials:
+		log.Debugf("backend %s check failed (%s): %s", bename, kind, err)
+	default:
+		log.Warnf("backend %s check failed (%s): %s", bename, kind, err)
+	}
+	ctx.trace.Step("backend %s check failed: %s", bename, err)
+	commonData.Metrics.Incr("backend." + bename + ".error." + kind)
+	commonData.DebugVars.Incr("backend." + bename + ".error." + kind)
+	ctx.failure = err
+}
+
+//QueuePrewarm queues prewarming the acls of an authorized subscription, to be run in the background with the metadata of the subscribing client.
+//It's dropped if the queue is full.
+func QueuePrewarm(clientid, username, subscription string, metadata *common.ClientMetadata) {
+	if commonData.Prewarmer.Add(func() {
+		PrewarmAcls(clientid, username, subscription, metadata)
+	}) {
+		return
+	}
+	log.Debugf("prewarm queue full, dropping prewarming of %s for %s", subscription, username)
+	commonData.Metrics.Incr("prewarm.dropped")
+}
+
+//PrewarmAcls runs read checks for the configured and recent topics matching an authorized subscription, so their results are cached before messages are delivered.
+func PrewarmAcls(clientid, username, subscription string, metadata *common.ClientMetadata) {
+	var topics []string
+	for _, topic := range commonData.PrewarmTopics {
+		topic, ok := common.ExpandAclTopic(topic, username, clientid)
+		if ok && common.TopicsMatch(subscription, topic) {
+			topics = append(topics, topic)
+		}
+	}
+	topics = append(topics, commonData.RecentTopics.Matching(subscription, commonData.PrewarmMax)...)
+
+	warmed := make(map[string]bool)
+	var pending []string
+	for _, topic := range topics {
+		if len(warmed) >= commonData.PrewarmMax {
+			break
+		}
+		if warmed[topic] {
+			continue
+		}
+		warmed[topic] = true
+		pending = append(pending, topic)
+	}
+
+	//Topics the backend can check in a single batch are, and the rest are checked one by one.
+	//Cached results are left as they are, else the check caches its result.
+	var left []string
+	withClientBackends(func() {
+		left = BatchAcls(clientid, username, pending, bes.MOSQ_ACL_READ, metadata.Address)
+	})
+	for _, topic := range left {
+		withClientBackends(func() {
+			checkAcl(clientid, username, topic, bes.MOSQ_ACL_READ, false, true, metadata)
+		})
+	}
+
+	if len(warmed) > 0 {
+		log.Debugf("prewarmed %d acls for %s subscribing to %s", len(warmed), username, subscription)
+	}
+}
+
+//withClientBackends runs f holding backends for reading, so they aren't swapped meanwhile. Clients' checks run alongside it,
+//as everything they don't share with it is kept in their context.
+func withClientBackends(f func()) {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+	f()
+}
+
+//BatchAcls checks topics with acc for a client in a single call to the backend that would check them, if it batches acls, caching the results.
+//Cached topics are skipped, and it returns those left to be checked one by one: $SYS and routed ones, or all of them if they couldn't be batched.
+func BatchAcls(clientid, username string, topics []string, acc int, address string) []string {
+	bename, batcher, ok := aclBatcher(username, clientid)
+	if !ok || len(topics) < 2 {
+		return topics
+	}
+
+	var left, batched []string
+	var queries []bes.AclQuery
+	for _, topic := range topics {
+		if routed, _ := CheckAclRoute(topic); routed || IsSysTopic(topic) {
+			left = append(left, topic)
+			continue
+		}
+		if cached, _ := CheckAclCache(username, topic, clientid, acc, address); cached {
+			continue
+		}
+		batched = append(batched, topic)
+		queries = append(queries, bes.AclQuery{Topic: topic, Acc: int32(acc)})
+	}
+
+	if len(queries) < 2 {
+		return append(left, batched...)
+	}
+
+	ctx := newPrewarmContext(time.Now())
+	backend := commonData.Backends[bename]
+
+	//Superusers are granted every topic, as they would be one by one.
+	results := make(chan []bool, 1)
+	if CallBackend(ctx, bename, common.CheckSuperuser, 2, func() (bool, bes.CacheHint, error) {
+		return bes.HintedCheckSuperuser(backend, username)
+	}) {
+		granted := make([]bool, len(queries))
+		for i := range granted {
+			granted[i] = true
+		}
+		results <- granted
+	} else if !CallBackend(ctx, bename, common.CheckAcl, 1, func() (bool, bes.CacheHint, error) {
+		granted, err := batcher.CheckAclBatch(username, clientid, queries)
+		if err != nil {
+			log.Warnf("couldn't batch acls for %s with backend %s: %s", username, bename, err)
+			return false, bes.CacheHint{}, nil
+		}
+		results <- granted
+		return true, bes.CacheHint{}, nil
+	}) || ctx.failedOpen {
+		return append(left, batched...)
+	}
+
+	granted := <-results
+	for i, topic := range batched {
+		authGranted := "false"
+		if granted[i] {
+			authGranted = "true"
+			commonData.Degradation.SeeGrant(username, topic, acc)
+		}
+		if err := SetAclCache(username, topic, clientid, acc, address, authGranted, 0, false); err != nil {
+			log.Debugf("couldn't cache batched acl for %s: %s", username, err)
+		}
+	}
+
+	log.Debugf("batched %d acls for %s with backend %s", len(batched), username, bename)
+	commonData.Metrics.Incr("backend." + bename + ".acl_batch")
+
+	return left
+}
+
+//aclBatcher returns the backend that would check username's acls, if it batches them.
+//That's the one selected by the username's prefix, else the only backend in the chain, as long as there's no plugin, delegated superuser backend nor shadow backend to check too.
+//Users whose acls aren't checked by backends, such as pending, restricted and service accounts, or those with a permission manifest, aren't batched.
+func aclBatcher(username, clientid string) (string, bes.AclBatcher, bool) {
+	if !commonData.UseCache || commonData.SuperuserBackend != "" || commonData.ShadowBackend != "" {
+		return "", nil, false
+	}
+
+	if IsPendingClient(username) || IsRestrictedUser(username) || commonData.ServiceAccounts.IsSuperuser(username) {
+		return "", nil, false
+	}
+	if _, _, ok := commonData.ServiceAccounts.Template(username); ok {
+		return "", nil, false
+	}
+	if _, ok := userManifests.Load(manifestKey{username, clientid}); ok {
+		return "", nil, false
+	}
+
+	bename := ""
+	if commonData.CheckPrefix {
+		if validPrefix, prefixed := CheckPrefix(username); validPrefix {
+			bename = ActiveBackend(prefixed)
+		}
+	}
+	if bename == "" {
+		chain := chainedBackends()
+		if len(chain) != 1 || commonData.Plugin != nil {
+			return "", nil, false
+		}
+		bename = chain[0]
+	}
+
+	batcher, ok := commonData.Backends[bename].(bes.AclBatcher)
+	if !ok || !backendCapabilities(bename).Batch {
+		return "", nil, false
+	}
+
+	return bename, batcher, true
+}
+
+//CheckAutoRegister authenticates a pending client with its registration password, or registers it as pending if its username matches the registration pattern.
+func CheckAutoRegister(username, password string) bool {
+	if !commonData.RegisterPattern.MatchString(username) {
+		return false
+	}
+
+	registrar := commonData.Backends[commonData.Registrar].(bes.Registrar)
+
+	if registrar.IsPending(username) {
+		pending := registrar.GetPending(username, password)
+		log.Debugf("pending user %s authenticated: %t", username, pending)
+		return pending
+	}
+
+	if err := registrar.RegisterPending(username, password); err != nil {
+		log.Errorf("couldn't register user %s as pending: %s", username, err)
+		return false
+	}
+
+	DualWrite(commonData.Registrar, func(backend bes.Backend) error {
+		targetRegistrar, ok := backend.(bes.Registrar)
+		if !ok {
+			return nil
+		}
+		return targetRegistrar.RegisterPending(username, password)
+	})
+
+	log.Infof("registered user %s as pending with backend %s", username, commonData.Registrar)
+	return true
+}
+
+//IsPendingClient checks if auto registration is enabled and username is pending.
+func IsPendingClient(username string) bool {
+	if !commonData.AutoRegister || !commonData.RegisterPattern.MatchString(username) {
+		return false
+	}
+	return commonData.Backends[commonData.Registrar].(bes.Registrar).IsPending(username)
+}
+
+//CheckAclList checks the topic against a list of acls that grant full access, such as bootstrap or expired password ones.
+func CheckAclList(acls []string, username, topic, clientid string) bool {
+	for _, acl := range acls {
+		aclTopic, ok := common.ExpandAclTopic(acl, username, clientid)
+		if ok && common.TopicsMatch(aclTopic, topic) {
+			log.Debugf("user %s granted acl %s", username, acl)
+			return true
+		}
+	}
+	return false
+}
+
+//CheckPasswordAge checks the user's password age with the first backend that knows it. When expired, the user is denied or, if restricting, allowed and restricted to expired acls.
+func CheckPasswordAge(username string) bool {
+	restrictedUsers.Delete(username)
+
+	for _, bename := range backends {
+		ager, ok := commonData.Backends[bename].(bes.PasswordAger)
+		if !ok || bename == commonData.ShadowBackend {
+			continue
+		}
+
+		changedAt, known := ager.PasswordChangedAt(username)
+		if !known {
+			continue
+		}
+
+		age := time.Since(changedAt)
+		if age <= commonData.PasswordMaxAge {
+			return true
+		}
+
+		AuditEvent("password_expired", log.Fields{
+			"username":   username,
+			"backend":    bename,
+			"changed_at": changedAt.Format(time.RFC3339),
+			"restricted": commonData.RestrictExpired,
+		})
+
+		if commonData.RestrictExpired {
+			restrictedUsers.Store(username, true)
+			return true
+		}
+		return false
+	}
+
+	return true
+}
+
+//manifestKey keys permission manifests by username and clientid, so a manifest only answers checks of the client it was given for.
+type manifestKey struct {
+	username string
+	clientid string
+}
+
+//SetManifest replaces the permission manifest of username's client with the one the backend that authenticated it gives, if any.
+func SetManifest(bename, username, clientid string) {
+	key := manifestKey{username, clientid}
+
+	manifester, ok := commonData.Backends[bename].(bes.Manifester)
+	if !ok || !backendCapabilities(bename).Manifest {
+		userManifests.Delete(key)
+		return
+	}
+
+	if manifest, ok := manifester.Manifest(username); ok {
+		log.Debugf("got manifest with %d acls for user %s from backend %s", len(manifest), username, bename)
+		userManifests.Store(key, manifest)
+		return
+	}
+	userManifests.Delete(key)
+}
+
+//DropManifests drops the permission manifests of every client of username, or of every user if empty.
+func DropManifests(username string) {
+	userManifests.Range(func(k, _ interface{}) bool {
+		if username == "" || k.(manifestKey).username == username {
+			userManifests.Delete(k)
+		}
+		return true
+	})
+}
+
+//IsRestrictedUser checks if the user was authenticated with an expired password and restricted.
+func IsRestrictedUser(username string) bool {
+	if commonData.PasswordMaxAge <= 0 || !commonData.RestrictExpired {
+		return false
+	}
+	_, ok := restrictedUsers.Load(username)
+	return ok
+}
+
+//WithinInputLimits checks that the given inputs don't exceed their configured maximum lengths.
+func WithinInputLimits(username, password, clientid, topic string) bool {
+	limits := commonData.InputLimits
+	if limits.Username > 0 && len(username) > limits.Username {
+		log.Warnf("username of length %d exceeds limit of %d, denying", len(username), limits.Username)
+		return false
+	}
+	if limits.Password > 0 && len(password) > limits.Password {
+		log.Warnf("password for user %s exceeds limit of %d, denying", username, limits.Password)
+		return false
+	}
+	if limits.Clientid > 0 && len(clientid) > limits.Clientid {
+		log.Warnf("clientid of length %d for user %s exceeds limit of %d, denying", len(clientid), username, limits.Clientid)
+		return false
+	}
+	if limits.Topic > 0 && len(topic) > limits.Topic {
+		log.Warnf("topic of length %d for user %s exceeds limit of %d, denying", len(topic), username, limits.Topic)
+		return false
+	}
+	return true
+}
+
+//StartDebug raises the log level to debug for the ongoing check if its username or clientid matches the debug filter, returning whether it did.
+//Since mosquitto runs checks one at a time, the level only changes for the check's own logs, except for those of background tasks.
+func StartDebug(username, clientid string) bool {
+	if commonData.LogLevel >= log.DebugLevel || !commonData.DebugFilter.Matches(username, clientid) {
+		return false
+	}
+	log.SetLevel(log.DebugLevel)
+	log.Debugf("debug logging check for username %s and clientid %s", username, clientid)
+	return true
+}
+
+//StopDebug restores the configured log level after a debugged check.
+func StopDebug() {
+	log.SetLevel(commonData.LogLevel)
+}
+
+//FinishTrace logs the check's trace, if any, with its result.
+func FinishTrace(ctx *checkContext, granted bool) {
+	ctx.trace.Log(granted)
+}
+
+//CheckResult returns the result of a check given its decision. With detailed return codes, checks no backend granted are deferred
+//when every backend called didn't find the user, and failed when the last backend failing was unavailable or misconfigured, or the decision was degraded.
+//Any other denial, such as those by lockout or policies, stays a denial.
+func CheckResult(ctx *checkContext, decision Decision) int {
+	if decision.Granted {
+		return ResultGranted
+	}
+	if !commonData.DetailedResults {
+		return ResultDenied
+	}
+
+	switch decision.Reason {
+	case ReasonDegraded:
+		return ResultError
+	case ReasonNotGranted:
+		if ctx.failure != nil {
+			switch bes.ErrorKind(ctx.failure) {
+			case bes.ErrBackendUnavailable, bes.ErrMisconfigured:
+				return ResultError
+			}
+		}
+		//Denials by the plugin aren't known to be about the user being unknown.
+		if decision.Backend != "plugin" && ctx.notFound == ctx.calls {
+			return ResultDeferred
+		}
+	}
+	return ResultDenied
+}
+
+//Conclusive tells if a decision is granted or denied as the check's result, rather than deferred or failed.
+func Conclusive(ctx *checkContext, decision Decision) bool {
+	result := CheckResult(ctx, decision)
+	return result == ResultGranted || result == ResultDenied
+}
+
+//RecordCheck logs the decision of an auth or acl check, and sends its result and latency to the metrics sink, if any.
+func RecordCheck(ctx *checkContext, check string, start time.Time, username string, decision Decision) {
+	if ctx.prewarm {
+		return
+	}
+	fields := log.Fields{
+		"check":    check,
+		"username": username,
+		"granted":  decision.Granted,
+		"backend":  decision.Backend,
+		"reason":   decision.Reason,
+	}
+	for k, v := range ctx.inputs {
+		fields[k] = v
+	}
+	if ctx.failure != nil {
+		fields["error"] = bes.ErrorKindName(ctx.failure)
+	}
+	log.WithFields(fields).Debug("decision")
+
+	result := "denied"
+	if decision.Granted {
+		result = "granted"
+	}
+	if decision.Reason == ReasonCache {
+		commonData.DebugVars.Incr(check + ".cache_hit")
+	}
+	commonData.DebugVars.Incr(check + "." + result)
+
+	if commonData.Metrics == nil {
+		return
+	}
+
+	if decision.Reason == ReasonCache {
+		commonData.Metrics.Incr(check + ".cache_hit")
+	}
+	commonData.Metrics.Incr(check + "." + result)
+
+	if !decision.Granted {
+		commonData.TopDeniedUsers.Add(username)
+	}
+
+	//Count decisions per backend too, by their stable id.
+	if decision.Backend != "" && decision.Backend != "cache" {
+		commonData.Metrics.Incr("backend." + decision.Backend + "." + check + "." + result)
+	}
+
+	commonData.Metrics.Timing(check+".latency", time.Since(start))
+}
+
+//AuditEvent logs a security relevant event with its fields, and sends it to the audit sink if there's one.
+func AuditEvent(event string, fields log.Fields) {
+	if !commonData.Audit.Add(event, fields) {
+		log.WithFields(fields).Errorf("audit queue is full, dropping event %s", event)
+		commonData.Metrics.Incr("audit.dropped")
+	}
+	fields["event"] = event
+	log.WithFields(fields).Warn("audit event")
+}
+
+//CheckBackendsPskKey checks for all backends if there's a psk key for identity, returning the first one found along with the decision.
+func CheckBackendsPskKey(ctx *checkContext, hint, identity string) (string, Decision) {
+
+	for _, bename := range backends {
+
+		if bename == "plugin" || bename == commonData.ShadowBackend {
+			continue
+		}
+
+		getter, ok := commonData.Backends[bename].(bes.PskKeyGetter)
+		if !ok || !backendCapabilities(bename).Psk {
+			continue
+		}
+
+		key, found := getter.GetPskKey(hint, identity)
+		ctx.trace.Step("psk key check with backend %s: %t", bename, found)
+		if found {
+			log.Debugf("psk key for identity %s found with backend %s", identity, bename)
+			return key, Decision{Granted: true, Backend: bename, Reason: ReasonUser}
+		}
+	}
+
+	return "", Decision{Granted: false, Reason: ReasonNotGranted}
+
+}
+
+//setPluginBackend answers the plugin's checks with a backend loaded from it.
+func setPluginBackend(backend bes.Backend) {
+	commonData.PGetName = backend.GetName
+	commonData.PGetUser = backend.GetUser
+	commonData.PGetSuperuser = backend.GetSuperuser
+	commonData.PCheckAcl = func(username, topic, clientid string, acc int) bool {
+		return backend.CheckAcl(username, topic, clientid, int32(acc))
+	}
+	commonData.PHalt = backend.Halt
+}
+
+//CheckPluginAuth checks that the plugin is not nil and returns the plugins auth decision.
+func CheckPluginAuth(ctx *checkContext, username, password string) Decision {
+	if commonData.Plugin != nil {
+		authenticated := commonData.PGetUser(username, password)
+		ctx.trace.Step("user check with plugin: %t", authenticated)
+		if authenticated {
+			return Decision{Granted: true, Backend: "plugin", Reason: ReasonUser}
+		}
+		return Decision{Granted: false, Backend: "plugin", Reason: ReasonNotGranted}
+	}
+	return Decision{Granted: false, Reason: ReasonNotGranted}
+}
+
+//CheckPluginAcl checks that the plugin is not nil and returns the superuser/acl decision.
+func CheckPluginAcl(ctx *checkContext, username, topic, clientid string, acc int) Decision {
+	if commonData.Plugin != nil {
+		if commonData.SuperuserBackend != "" {
+			if decision := CheckDelegatedSuperuser(ctx, username, 2); decision.Granted {
+				return decision
+			}
+		} else if commonData.PGetSuperuser(username) {
+			ctx.trace.Step("superuser check with plugin: true")
+			return Decision{Granted: true, Backend: "plugin", Reason: ReasonSuperuser}
+		} else {
+			ctx.trace.Step("superuser check with plugin: false")
+		}
+		aclCheck := commonData.PCheckAcl(username, topic, clientid, acc)
+		ctx.trace.Step("acl check with plugin: %t", aclCheck)
+		if aclCheck {
+			return Decision{Granted: true, Backend: "plugin", Reason: ReasonAcl}
+		}
+		return Decision{Granted: false, Backend: "plugin", Reason: ReasonNotGranted}
+	}
+	return Decision{Granted: false, Reason: ReasonNotGranted}
 }
 
 //export AuthPluginCleanup
@@ -752,6 +4625,42 @@ func AuthPluginCleanup() {
 		commonData.RedisCache.Close()
 	}
 
+	commonData.Metrics.Close()
+
+	close(backgroundStop)
+
+	if adminServer != nil {
+		adminServer.Close()
+	}
+
+	if debugServer != nil {
+		debugServer.Close()
+	}
+
+	//Backends replaced by a pending swap are halted too.
+	if swapper.Status().Pending {
+		CommitBackends()
+	}
+
+	if commonData.LockoutRedis != nil {
+		commonData.LockoutRedis.Close()
+	}
+
+	if commonData.ConnectionsRedis != nil {
+		commonData.ConnectionsRedis.Close()
+	}
+
+	if commonData.PolicyUpdates != nil {
+		commonData.PolicyUpdates.Close()
+	}
+
+	if commonData.SessionsRedis != nil {
+		commonData.SessionsRedis.Close()
+	}
+
+	//Queued audit events are kept on disk if the sink can't take them.
+	commonData.Audit.Close()
+
 	//Halt every registered backend.
 
 	for _, v := range commonData.Backends {
@@ -1,12 +1,14 @@
 module github.com/iegomez/mosquitto-go-auth
 
-go 1.12
+go 1.17
 
 require (
 	github.com/brocaar/lora-app-server v2.5.1+incompatible
 	github.com/brocaar/loraserver v2.5.0+incompatible // indirect
 	github.com/brocaar/lorawan v0.0.0-20190523144945-4c051b1fa597 // indirect
+	github.com/denisenkom/go-mssqldb v0.11.0
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/dop251/goja v0.0.0-20240220182346-e401ed450204
 	github.com/eclipse/paho.mqtt.golang v1.2.0 // indirect
 	github.com/go-redis/redis v6.14.1+incompatible
 	github.com/go-sql-driver/mysql v1.4.0
@@ -23,14 +25,17 @@ require (
 	github.com/onsi/ginkgo v1.8.0 // indirect
 	github.com/onsi/gomega v1.5.0 // indirect
 	github.com/pkg/errors v0.8.1
+	github.com/sijms/go-ora/v2 v2.8.19
 	github.com/sirupsen/logrus v1.3.0
 	github.com/smartystreets/goconvey v0.0.0-20190330032615-68dc04aab96a
 	github.com/tidwall/pretty v0.0.0-20190325153808-1166b9ac2b65 // indirect
 	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
 	github.com/xdg/stringprep v1.0.0 // indirect
+	go.etcd.io/bbolt v1.3.3
 	go.mongodb.org/mongo-driver v1.0.0
 	go.opencensus.io v0.22.0 // indirect
-	golang.org/x/crypto v0.0.0-20190325154230-a5d413f7728c
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	google.golang.org/api v0.6.0 // indirect
 	google.golang.org/grpc v1.21.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+)
+
+//StatsD sends counters and timings to a StatsD server over udp. With DogStatsD enabled, tags are appended in DogStatsD format.
+//A nil *StatsD is valid and discards every metric, so callers don't need to check if metrics are enabled.
+type StatsD struct {
+	Host      string
+	Port      string
+	Prefix    string
+	Tags      []string
+	DogStatsD bool
+	conn      net.Conn
+}
+
+//NewStatsD initializes a StatsD sink from the statsd_ options.
+func NewStatsD(authOpts map[string]string, logLevel log.Level) (*StatsD, error) {
+
+	log.SetLevel(logLevel)
+
+	var statsd = &StatsD{
+		Host:   "localhost",
+		Port:   "8125",
+		Prefix: "mosquitto_auth.",
+	}
+
+	if host, ok := authOpts["statsd_host"]; ok {
+		statsd.Host = host
+	}
+
+	if port, ok := authOpts["statsd_port"]; ok {
+		statsd.Port = port
+	}
+
+	if prefix, ok := authOpts["statsd_prefix"]; ok {
+		statsd.Prefix = prefix
+		if statsd.Prefix != "" && !strings.HasSuffix(statsd.Prefix, ".") {
+			statsd.Prefix += "."
+		}
+	}
+
+	if dogStatsD, ok := authOpts["statsd_dogstatsd"]; ok && dogStatsD == "true" {
+		statsd.DogStatsD = true
+	}
+
+	if tags, ok := authOpts["statsd_tags"]; ok {
+		if !statsd.DogStatsD {
+			log.Warn("statsd_tags are only sent in DogStatsD format, ignoring them")
+		} else {
+			for _, tag := range strings.Split(strings.Replace(tags, " ", "", -1), ",") {
+				if tag != "" {
+					statsd.Tags = append(statsd.Tags, tag)
+				}
+			}
+		}
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(statsd.Host, statsd.Port))
+	if err != nil {
+		return nil, errors.Errorf("StatsD error: couldn't dial %s:%s: %s\n", statsd.Host, statsd.Port, err)
+	}
+	statsd.conn = conn
+
+	return statsd, nil
+}
+
+//Incr increments the counter name by one.
+func (s *StatsD) Incr(name string, tags ...string) {
+	s.send(name, "1|c", tags)
+}
+
+//Timing sends the duration d for name in milliseconds.
+func (s *StatsD) Timing(name string, d time.Duration, tags ...string) {
+	s.send(name, fmt.Sprintf("%d|ms", d.Nanoseconds()/int64(time.Millisecond)), tags)
+}
+
+//Gauge sets the gauge name to value.
+func (s *StatsD) Gauge(name string, value int, tags ...string) {
+	s.send(name, fmt.Sprintf("%d|g", value), tags)
+}
+
+//send writes a single metric. Errors are only logged, as metrics must never affect auth checks.
+func (s *StatsD) send(name, value string, tags []string) {
+	if s == nil || s.conn == nil {
+		return
+	}
+
+	metric := fmt.Sprintf("%s%s:%s", s.Prefix, name, value)
+	if s.DogStatsD {
+		allTags := append(append([]string{}, s.Tags...), tags...)
+		if len(allTags) > 0 {
+			metric = fmt.Sprintf("%s|#%s", metric, strings.Join(allTags, ","))
+		}
+	}
+
+	if _, err := s.conn.Write([]byte(metric)); err != nil {
+		log.Debugf("statsd write error: %s", err)
+	}
+}
+
+//Close closes the udp connection.
+func (s *StatsD) Close() {
+	if s != nil && s.conn != nil {
+		s.conn.Close()
+	}
+}
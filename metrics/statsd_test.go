@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStatsD(t *testing.T) {
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	read := func() string {
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+
+	authOpts := make(map[string]string)
+	authOpts["statsd_host"] = "127.0.0.1"
+	authOpts["statsd_port"] = port
+	authOpts["statsd_prefix"] = "auth"
+
+	Convey("Given plain StatsD, metrics should be sent with prefix and without tags", t, func() {
+		statsd, err := NewStatsD(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer statsd.Close()
+
+		statsd.Incr("acl.granted", "backend:files")
+		So(read(), ShouldEqual, "auth.acl.granted:1|c")
+
+		statsd.Timing("acl.latency", 15*time.Millisecond)
+		So(read(), ShouldEqual, "auth.acl.latency:15|ms")
+
+		statsd.Gauge("self_test.healthy", 0)
+		So(read(), ShouldEqual, "auth.self_test.healthy:0|g")
+	})
+
+	Convey("Given DogStatsD, metrics should be sent with global and metric tags", t, func() {
+		authOpts["statsd_dogstatsd"] = "true"
+		authOpts["statsd_tags"] = "env:test, region:eu"
+		statsd, err := NewStatsD(authOpts, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer statsd.Close()
+
+		statsd.Incr("auth.denied", "backend:files")
+		So(read(), ShouldEqual, "auth.auth.denied:1|c|#env:test,region:eu,backend:files")
+	})
+
+	Convey("A nil StatsD should discard metrics", t, func() {
+		var statsd *StatsD
+		So(func() { statsd.Incr("auth.granted") }, ShouldNotPanic)
+	})
+
+}
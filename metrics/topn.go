@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//TopN counts the most frequent keys in bounded memory, using the Space-Saving algorithm: once capacity keys are tracked, a new key replaces the least counted one, inheriting its count.
+//Counts of the most frequent keys are then overestimated by at most the smallest tracked count, so capacity should be a few times the number of keys reported.
+type TopN struct {
+	sync.Mutex
+	capacity int
+	counts   map[string]int
+}
+
+//TopEntry is a key and its approximate count.
+type TopEntry struct {
+	Key   string
+	Count int
+}
+
+//NewTopN returns a tracker keeping at most capacity keys.
+func NewTopN(capacity int) *TopN {
+	return &TopN{
+		capacity: capacity,
+		counts:   make(map[string]int, capacity),
+	}
+}
+
+//Add counts one occurrence of key.
+func (t *TopN) Add(key string) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.counts[key]; ok || len(t.counts) < t.capacity {
+		t.counts[key]++
+		return
+	}
+
+	minKey, minCount := "", 0
+	for k, c := range t.counts {
+		if minKey == "" || c < minCount {
+			minKey, minCount = k, c
+		}
+	}
+	delete(t.counts, minKey)
+	t.counts[key] = minCount + 1
+}
+
+//Top returns the n most counted keys, most counted first, and forgets every count so the next report covers a new window.
+func (t *TopN) Top(n int) []TopEntry {
+	if t == nil {
+		return nil
+	}
+
+	t.Lock()
+	entries := make([]TopEntry, 0, len(t.counts))
+	for k, c := range t.counts {
+		entries = append(entries, TopEntry{Key: k, Count: c})
+	}
+	t.counts = make(map[string]int, t.capacity)
+	t.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+//Top sends the entries as the gauges top.<name>.<rank>, ranked from 1, so the number of series is bounded by the number of entries.
+//With DogStatsD, each gauge is tagged with its key, replacing the characters that would break the format.
+func (s *StatsD) Top(name string, entries []TopEntry) {
+	for i, entry := range entries {
+		s.Gauge("top."+name+"."+strconv.Itoa(i+1), entry.Count, "key:"+tagReplacer.Replace(entry.Key))
+	}
+}
+
+var tagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
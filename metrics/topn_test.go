@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTopN(t *testing.T) {
+
+	Convey("Given fewer keys than capacity, counts should be exact and ordered", t, func() {
+		top := NewTopN(10)
+		for i := 0; i < 5; i++ {
+			top.Add("a")
+		}
+		for i := 0; i < 3; i++ {
+			top.Add("b")
+		}
+		top.Add("c")
+		top.Add("d")
+
+		So(top.Top(3), ShouldResemble, []TopEntry{{"a", 5}, {"b", 3}, {"c", 1}})
+	})
+
+	Convey("Given more keys than capacity, frequent keys should still be reported in bounded memory", t, func() {
+		top := NewTopN(5)
+		for i := 0; i < 1000; i++ {
+			top.Add("heavy")
+			top.Add("user" + strconv.Itoa(i))
+			if i%2 == 0 {
+				top.Add("medium")
+			}
+		}
+
+		So(len(top.counts), ShouldEqual, 5)
+
+		entries := top.Top(2)
+		So(entries[0].Key, ShouldEqual, "heavy")
+		So(entries[0].Count, ShouldBeGreaterThanOrEqualTo, 1000)
+		So(entries[1].Key, ShouldEqual, "medium")
+	})
+
+	Convey("Given a report, counts should be forgotten", t, func() {
+		top := NewTopN(5)
+		top.Add("a")
+		So(top.Top(5), ShouldHaveLength, 1)
+		So(top.Top(5), ShouldBeEmpty)
+	})
+
+	Convey("Given a nil tracker, adding and reporting should do nothing", t, func() {
+		var top *TopN
+		top.Add("a")
+		So(top.Top(5), ShouldBeEmpty)
+	})
+
+	Convey("Given DogStatsD, top entries should be sent as ranked gauges tagged with their key", t, func() {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+		statsd, err := NewStatsD(map[string]string{
+			"statsd_host":      "127.0.0.1",
+			"statsd_port":      port,
+			"statsd_prefix":    "auth",
+			"statsd_dogstatsd": "true",
+		}, log.DebugLevel)
+		So(err, ShouldBeNil)
+		defer statsd.Close()
+
+		read := func() string {
+			buf := make([]byte, 1024)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return ""
+			}
+			return string(buf[:n])
+		}
+
+		statsd.Top("denied_users", []TopEntry{{"mallory", 12}, {"a,b|c", 3}})
+		So(read(), ShouldEqual, "auth.top.denied_users.1:12|g|#key:mallory")
+		So(read(), ShouldEqual, "auth.top.denied_users.2:3|g|#key:a_b_c")
+	})
+
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/iegomez/mosquitto-go-auth/backends"
+)
+
+//BackendInterfaceVersion tells the backend interface version this plugin implements.
+var BackendInterfaceVersion = 1
+
+//Backend is a dummy backend denying every check.
+type Backend struct{}
+
+func NewBackend(authOpts map[string]string, logLevel log.Level) (backends.Backend, error) {
+	//Initialize your backend with the necessary options
+	log.Infof("Plugin backend initialized!")
+	log.Infof("Received %d options.", len(authOpts))
+	return Backend{}, nil
+}
+
+func (o Backend) GetUser(username, password string) bool {
+	log.Infof("Checking get user with custom plugin backend.")
+	return false
+}
+
+func (o Backend) GetSuperuser(username string) bool {
+	log.Infof("Checking get superuser with custom plugin backend.")
+	return false
+}
+
+func (o Backend) CheckAcl(username, topic, clientid string, acc int32) bool {
+	log.Infof("Checking acl with custom plugin backend.")
+	return false
+}
+
+func (o Backend) GetName() string {
+	return "Custom plugin backend"
+}
+
+func (o Backend) Halt() {
+	//Do whatever cleanup is needed.
+}
@@ -12,13 +12,19 @@ const saltSize = 16
 
 func main() {
 
-	var algorithm = flag.String("a", "sha512", "algorithm (sha256 or default: sha512)")
+	var algorithm = flag.String("a", "sha512", "algorithm (sha256, scram-sha-256 or default: sha512)")
 	var HashIterations = flag.Int("i", 100000, "hash iterations (default: 100000)")
 	var password = flag.String("p", "", "password")
 
 	flag.Parse()
 
-	pwHash, err := common.Hash(*password, saltSize, *HashIterations, *algorithm)
+	var pwHash string
+	var err error
+	if *algorithm == "scram-sha-256" {
+		pwHash, err = common.ScramHash(*password, saltSize, *HashIterations)
+	} else {
+		pwHash, err = common.Hash(*password, saltSize, *HashIterations, *algorithm)
+	}
 	if err != nil {
 		fmt.Errorf("error: %s\n", err)
 	} else {
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//Reasons of decisions made by backends, or cached from them, which are the ones replayed.
+var replayedReasons = map[string]bool{
+	"superuser":   true,
+	"acl":         true,
+	"not_granted": true,
+	"cache":       true,
+}
+
+func main() {
+
+	var confPath = flag.String("c", "", "mosquitto conf file with the plugin's auth_opt_ options")
+	var logPath = flag.String("l", "-", "log file with the plugin's decisions logged at debug level (default: stdin)")
+	var verbose = flag.Bool("v", false, "log backends' own messages")
+
+	flag.Parse()
+
+	if *confPath == "" {
+		fmt.Fprintln(os.Stderr, "error: missing conf file (-c)")
+		os.Exit(2)
+	}
+
+	logLevel := log.ErrorLevel
+	if *verbose {
+		logLevel = log.DebugLevel
+	}
+	log.SetLevel(logLevel)
+
+	authOpts, err := readAuthOpts(*confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
+	}
+
+	chain, err := newChain(authOpts, logLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
+	}
+	defer func() {
+		for _, backend := range chain {
+			backend.Halt()
+		}
+	}()
+
+	var input io.Reader = os.Stdin
+	if *logPath != "-" {
+		file, err := os.Open(*logPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(2)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	replayed, changed, skipped := 0, 0, 0
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		decision, ok := common.ParseDecisionLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		//Passwords aren't logged, so only acl checks decided by backends may be replayed.
+		if decision.Case.Check != "acl" || !replayedReasons[decision.Reason] {
+			skipped++
+			continue
+		}
+
+		replayed++
+		c := decision.Case
+		if granted := checkAcl(chain, c); granted != c.Allow {
+			changed++
+			fmt.Printf("changed: %s recorded=%t (backend %s, reason %s) replayed=%t\n", c, c.Allow, decision.Backend, decision.Reason, granted)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("replayed %d decisions, %d changed, %d skipped\n", replayed, changed, skipped)
+	if changed > 0 {
+		os.Exit(1)
+	}
+}
+
+//readAuthOpts reads the plugin's options from a mosquitto conf file: the values of auth_opt_<option> lines by option.
+func readAuthOpts(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	authOpts := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "auth_opt_") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(line, "auth_opt_"), " ", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = strings.TrimSpace(parts[1])
+		}
+		authOpts[parts[0]] = value
+	}
+	return authOpts, scanner.Err()
+}
+
+//newChain initializes the backends given at the backends option, in order. The custom plugin can't be replayed, so it's left out.
+func newChain(authOpts map[string]string, logLevel log.Level) ([]bes.Backend, error) {
+	var chain []bes.Backend
+	for _, bename := range strings.Split(strings.Replace(authOpts["backends"], " ", "", -1), ",") {
+		if bename == "" {
+			continue
+		}
+		if bename == "plugin" {
+			fmt.Fprintln(os.Stderr, "warning: the custom plugin is left out of the replay")
+			continue
+		}
+		backend, err := bes.New(bename, authOpts, logLevel)
+		if err != nil {
+			for _, initialized := range chain {
+				initialized.Halt()
+			}
+			return nil, fmt.Errorf("couldn't initialize %s backend: %s", bename, err)
+		}
+		chain = append(chain, backend)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no backends to replay decisions against")
+	}
+	return chain, nil
+}
+
+//checkAcl grants the check if any backend finds the user a superuser or grants the topic.
+func checkAcl(chain []bes.Backend, c common.SelfTestCase) bool {
+	for _, backend := range chain {
+		if backend.GetSuperuser(c.Username) {
+			return true
+		}
+	}
+	for _, backend := range chain {
+		if backend.CheckAcl(c.Username, c.Topic, c.Clientid, int32(c.Acc)) {
+			return true
+		}
+	}
+	return false
+}
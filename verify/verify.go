@@ -0,0 +1,184 @@
+//Package verify exposes the plugin's credential verification core, so sibling services such as device bootstrap servers or REST APIs
+//may check passwords, tokens and acls exactly as the broker does, against the same data, instead of reimplementing it.
+//
+//Its API is kept stable across releases: exported names won't be removed nor change their meaning, while the backends package may change freely.
+package verify
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/pkg/errors"
+
+	bes "github.com/iegomez/mosquitto-go-auth/backends"
+	"github.com/iegomez/mosquitto-go-auth/common"
+)
+
+//Access is the access requested by an acl check, with mosquitto's values.
+type Access int32
+
+const (
+	Read      Access = bes.MOSQ_ACL_READ
+	Write     Access = bes.MOSQ_ACL_WRITE
+	ReadWrite Access = bes.MOSQ_ACL_READWRITE
+	Subscribe Access = bes.MOSQ_ACL_SUBSCRIBE
+)
+
+//Kinds of errors a failed check may have, as told by ErrorKind.
+var (
+	ErrNotFound           = bes.ErrNotFound
+	ErrBadCredentials     = bes.ErrBadCredentials
+	ErrBackendUnavailable = bes.ErrBackendUnavailable
+	ErrMisconfigured      = bes.ErrMisconfigured
+)
+
+//ErrorKind returns the kind of a check's error, one of the Err values.
+func ErrorKind(err error) error {
+	return bes.ErrorKind(err)
+}
+
+//HashPassword hashes a password with the plugin's default settings, as the pw utility does.
+func HashPassword(password string) (string, error) {
+	return bes.HashPassword(password)
+}
+
+//CheckPassword checks a password against a hash made by HashPassword or the pw utility, in any of the algorithms the plugin supports.
+func CheckPassword(password, hash string) bool {
+	return common.HashCompare(password, hash)
+}
+
+//TopicMatches checks if topic matches filter, which may have + and # wildcards.
+func TopicMatches(filter, topic string) bool {
+	return common.TopicsMatch(filter, topic)
+}
+
+//Acl is a topic filter a user may access with the given access. The filter may have %u and %c placeholders for the username and clientid.
+type Acl struct {
+	Topic  string `json:"topic"`
+	Access Access `json:"acc"`
+}
+
+//AclAllows checks if any of the acls grants the given access to topic, as the plugin checks permission manifests.
+func AclAllows(acls []Acl, username, clientid, topic string, acc Access) bool {
+	manifest := make([]bes.ManifestAcl, len(acls))
+	for i, acl := range acls {
+		manifest[i] = bes.ManifestAcl{Topic: acl.Topic, Acc: int32(acl.Access)}
+	}
+	return bes.ManifestAllows(manifest, username, topic, clientid, int32(acc))
+}
+
+//Result is the outcome of a check: whether it was granted, by which backend and, if it wasn't, the error of the last backend that told one.
+type Result struct {
+	Granted bool
+	Backend string
+	Err     error
+}
+
+//Token is a verified token's username, claims and expiry, which is zero if it doesn't expire.
+type Token struct {
+	Username string
+	Claims   map[string]interface{}
+	Expiry   time.Time
+}
+
+//Verifier checks credentials against the backends configured by the plugin's options, in the same order.
+type Verifier struct {
+	names    []string
+	backends map[string]bes.Backend
+}
+
+//New creates the backends given by the backends option, with the same options the plugin takes without their auth_opt_ prefix,
+//e.g. {"backends": "files", "password_path": "/etc/mosquitto/passwords"}. Backends' log level is set by the log_level option, defaulting to info.
+func New(opts map[string]string) (*Verifier, error) {
+	level := log.InfoLevel
+	if logLevel, ok := opts["log_level"]; ok {
+		parsed, err := log.ParseLevel(strings.TrimSpace(logLevel))
+		if err != nil {
+			return nil, errors.Errorf("verify: unknown log_level %s", logLevel)
+		}
+		level = parsed
+	}
+
+	v := &Verifier{backends: make(map[string]bes.Backend)}
+	for _, name := range strings.Split(strings.Replace(opts["backends"], " ", "", -1), ",") {
+		if name == "" {
+			continue
+		}
+		if _, ok := v.backends[name]; ok {
+			continue
+		}
+		backend, err := bes.New(name, opts, level)
+		if err != nil {
+			v.Close()
+			return nil, errors.Errorf("verify: %s", err)
+		}
+		v.names = append(v.names, name)
+		v.backends[name] = backend
+	}
+
+	if len(v.names) == 0 {
+		return nil, errors.New("verify: no backends given")
+	}
+
+	return v, nil
+}
+
+//CheckUser checks username and password, or token, with each backend until one grants them.
+func (v *Verifier) CheckUser(username, password string) Result {
+	return v.check(func(backend bes.Backend) (bool, error) {
+		return bes.CheckUser(backend, username, password)
+	})
+}
+
+//CheckSuperuser checks if username is a superuser for any backend.
+func (v *Verifier) CheckSuperuser(username string) Result {
+	return v.check(func(backend bes.Backend) (bool, error) {
+		return bes.CheckSuperuser(backend, username)
+	})
+}
+
+//CheckAcl checks if username, connected as clientid, may access topic, granting it to superusers as the plugin does.
+func (v *Verifier) CheckAcl(username, clientid, topic string, acc Access) Result {
+	return v.check(func(backend bes.Backend) (bool, error) {
+		return bes.CheckAccess(backend, username, topic, clientid, int32(acc))
+	})
+}
+
+//VerifyToken verifies a token with the first jwt backend in local mode, as it's verified when checking it.
+func (v *Verifier) VerifyToken(token string) (Token, error) {
+	for _, name := range v.names {
+		jwt, ok := v.backends[name].(bes.JWT)
+		if !ok || jwt.Remote {
+			continue
+		}
+		username, claims, expiry, err := jwt.VerifyToken(token)
+		if err != nil {
+			return Token{}, &bes.CheckError{Kind: ErrBadCredentials, Cause: err}
+		}
+		return Token{Username: username, Claims: claims, Expiry: expiry}, nil
+	}
+	return Token{}, &bes.CheckError{Kind: ErrMisconfigured, Cause: errors.New("no jwt backend in local mode")}
+}
+
+//Close halts every backend.
+func (v *Verifier) Close() {
+	for _, backend := range v.backends {
+		backend.Halt()
+	}
+}
+
+func (v *Verifier) check(call func(backend bes.Backend) (bool, error)) Result {
+	var result Result
+	for _, name := range v.names {
+		granted, err := call(v.backends[name])
+		if granted {
+			return Result{Granted: true, Backend: name}
+		}
+		if err != nil {
+			result.Err = err
+		}
+	}
+	return result
+}
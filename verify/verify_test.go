@@ -0,0 +1,87 @@
+package verify
+
+import (
+	"testing"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerifier(t *testing.T) {
+
+	opts := map[string]string{
+		"backends":      "files, jwt",
+		"password_path": "../test-files/passwords",
+		"acl_path":      "../test-files/acls",
+		"jwt_secret":    "some_jwt_secret",
+		"jwt_delegate":  "files",
+		"jwt_userfield": "Username",
+		"log_level":     "error",
+	}
+
+	Convey("Given the plugin's options, the verifier should check credentials with its backends", t, func() {
+		v, err := New(opts)
+		So(err, ShouldBeNil)
+		defer v.Close()
+
+		result := v.CheckUser("test1", "test1")
+		So(result.Granted, ShouldBeTrue)
+		So(result.Backend, ShouldEqual, "files")
+
+		result = v.CheckUser("test1", "wrong")
+		So(result.Granted, ShouldBeFalse)
+		So(ErrorKind(result.Err), ShouldEqual, ErrBadCredentials)
+
+		So(v.CheckSuperuser("test1").Granted, ShouldBeFalse)
+		So(v.CheckAcl("test1", "client", "test/topic/1", Write).Granted, ShouldBeTrue)
+		So(v.CheckAcl("test1", "client", "test/topic/1", Read).Granted, ShouldBeFalse)
+	})
+
+	Convey("Given a token, the verifier should verify it as the jwt backend does", t, func() {
+		v, err := New(opts)
+		So(err, ShouldBeNil)
+		defer v.Close()
+
+		exp := time.Now().Add(time.Hour).Unix()
+		token, err := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, jwtgo.MapClaims{"username": "test1", "exp": exp}).SignedString([]byte("some_jwt_secret"))
+		So(err, ShouldBeNil)
+
+		verified, err := v.VerifyToken(token)
+		So(err, ShouldBeNil)
+		So(verified.Username, ShouldEqual, "test1")
+		So(verified.Expiry.Unix(), ShouldEqual, exp)
+
+		result := v.CheckUser(token, "")
+		So(result.Granted, ShouldBeTrue)
+		So(result.Backend, ShouldEqual, "jwt")
+
+		forged, _ := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, jwtgo.MapClaims{"username": "test1"}).SignedString([]byte("wrong_secret"))
+		_, err = v.VerifyToken(forged)
+		So(ErrorKind(err), ShouldEqual, ErrBadCredentials)
+	})
+
+	Convey("Given unknown backends or none, the verifier should fail", t, func() {
+		_, err := New(map[string]string{"backends": "unknown"})
+		So(err, ShouldNotBeNil)
+		_, err = New(map[string]string{})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given acls, they should be matched as permission manifests are", t, func() {
+		acls := []Acl{{Topic: "devices/%u/#", Access: ReadWrite}, {Topic: "commands/%c", Access: Read}}
+		So(AclAllows(acls, "dev1", "c1", "devices/dev1/temp", Write), ShouldBeTrue)
+		So(AclAllows(acls, "dev1", "c1", "devices/dev2/temp", Write), ShouldBeFalse)
+		So(AclAllows(acls, "dev1", "c1", "commands/c1", Subscribe), ShouldBeTrue)
+		So(AclAllows(acls, "dev1", "c1", "commands/c1", Write), ShouldBeFalse)
+		So(TopicMatches("a/+/c", "a/b/c"), ShouldBeTrue)
+	})
+
+	Convey("Given a hashed password, it should be checked", t, func() {
+		hash, err := HashPassword("secret")
+		So(err, ShouldBeNil)
+		So(CheckPassword("secret", hash), ShouldBeTrue)
+		So(CheckPassword("wrong", hash), ShouldBeFalse)
+	})
+
+}